@@ -0,0 +1,384 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Suffix of the artifacts in the cache, named after the artifact name in a
+// directory named after the device type.
+const artifactCacheSuffix = ".mender"
+
+// Suffix of the artifacts downloaded in part when the daemon was stopped,
+// kept to resume the downloads from.
+const artifactPartialSuffix = ".partial"
+
+// Suffix of the files next to the artifacts in the cache with the hex encoded
+// SHA256 checksums of the artifacts.
+const artifactChecksumSuffix = ".sha256"
+
+// artifactCache keeps the artifacts installed in a directory, e.g. on
+// removable storage, so that they are installed from there rather than
+// downloaded again once the server offers them again; sibling devices can be
+// provisioned offline from the same storage.
+type artifactCache struct {
+	dir string
+	// artifacts of the same name may be built for other device types
+	deviceType string
+	// number of artifacts kept, the oldest are removed; all if zero
+	keep int
+}
+
+// typeDir is the directory of the artifacts for the device type.
+func (a *artifactCache) typeDir() string {
+	return filepath.Join(a.dir, url.PathEscape(a.deviceType))
+}
+
+func (a *artifactCache) path(artifactName string) string {
+	return filepath.Join(a.typeDir(), url.PathEscape(artifactName)+artifactCacheSuffix)
+}
+
+// open returns the cached artifact of the given name and its size, or nil if
+// it is not cached.
+func (a *artifactCache) open(artifactName string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(a.path(artifactName))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// names returns the names of the artifacts in the cache.
+func (a *artifactCache) names() []string {
+	files, _ := filepath.Glob(filepath.Join(a.typeDir(), "*"+artifactCacheSuffix))
+	var names []string
+	for _, f := range files {
+		name, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f),
+			artifactCacheSuffix))
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (a *artifactCache) partialPath(artifactName string) string {
+	return a.path(artifactName) + artifactPartialSuffix
+}
+
+// checksum returns the SHA256 checksum of the cached artifact of the given
+// name, empty if it is not known.
+func (a *artifactCache) checksum(artifactName string) string {
+	sum, err := ioutil.ReadFile(a.path(artifactName) + artifactChecksumSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(sum))
+}
+
+func (a *artifactCache) remove(artifactName string) error {
+	os.Remove(a.path(artifactName) + artifactChecksumSuffix)
+	err := os.Remove(a.path(artifactName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// store returns a reader passing r on, caching what is read; the artifact is
+// only added to the cache once committed, and only if it matches the
+// checksums, if any. If it can not be cached, r is returned as is.
+func (a *artifactCache) store(artifactName string, r io.ReadCloser,
+	size int64, checksums []string) io.ReadCloser {
+
+	if err := os.MkdirAll(a.typeDir(), 0755); err != nil {
+		log.Warnf("not caching artifact %s: %v", artifactName, err)
+		return r
+	}
+	f, err := ioutil.TempFile(a.typeDir(), ".tmp-")
+	if err != nil {
+		log.Warnf("not caching artifact %s: %v", artifactName, err)
+		return r
+	}
+	return &cachingReader{
+		ReadCloser: r,
+		cache:      a,
+		name:       artifactName,
+		size:       size,
+		checksums:  checksums,
+		f:          f,
+	}
+}
+
+// resume returns a reader passing r on as store does, continuing with the
+// part of the artifact kept by checkpoint, if any: that part is read from the
+// cache, and skip makes r continue where it ends. Parts which can not be
+// resumed from are removed, as are those of other artifacts.
+func (a *artifactCache) resume(artifactName string, r io.ReadCloser, size int64,
+	checksums []string, skip func(offset int64) error) io.ReadCloser {
+
+	a.removePartials(artifactName)
+	path := a.partialPath(artifactName)
+	prefix, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return a.store(artifactName, r, size, checksums)
+	} else if err != nil {
+		log.Warnf("not resuming download of artifact %s: %v", artifactName, err)
+		os.Remove(path)
+		return a.store(artifactName, r, size, checksums)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	var n int64
+	if err == nil {
+		n, err = prefix.Seek(0, io.SeekEnd)
+	}
+	if err == nil {
+		_, err = prefix.Seek(0, io.SeekStart)
+	}
+	if err == nil && (n == 0 || (size >= 0 && n >= size)) {
+		err = errors.Errorf("%d bytes kept of %d", n, size)
+	}
+	if err == nil {
+		err = skip(n)
+	}
+	if err != nil {
+		log.Warnf("not resuming download of artifact %s: %v", artifactName, err)
+		prefix.Close()
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(path)
+		return a.store(artifactName, r, size, checksums)
+	}
+
+	log.Infof("resuming download of artifact %s after the %d bytes kept", artifactName, n)
+	c := &cachingReader{
+		ReadCloser: r,
+		cache:      a,
+		name:       artifactName,
+		size:       size,
+		checksums:  checksums,
+		f:          f,
+		n:          n,
+	}
+	return &resumedReader{
+		Reader:  io.MultiReader(prefix, c),
+		prefix:  prefix,
+		caching: c,
+	}
+}
+
+// removePartials removes the parts kept of artifacts other than the one
+// given, the deployments of which are not resumed anymore.
+func (a *artifactCache) removePartials(artifactName string) {
+	partials, _ := filepath.Glob(filepath.Join(a.typeDir(), "*"+artifactPartialSuffix))
+	for _, p := range partials {
+		if p != a.partialPath(artifactName) {
+			log.Infof("removing partial download %s", filepath.Base(p))
+			os.Remove(p)
+		}
+	}
+}
+
+// prune removes the oldest artifacts beyond those kept.
+func (a *artifactCache) prune() {
+	if a.keep <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(a.typeDir())
+	if err != nil {
+		log.Warnf("failed to prune artifact cache: %v", err)
+		return
+	}
+	var cached []os.FileInfo
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), artifactCacheSuffix) {
+			cached = append(cached, fi)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().After(cached[j].ModTime())
+	})
+	for i := a.keep; i < len(cached); i++ {
+		log.Infof("removing artifact %s from the cache", cached[i].Name())
+		path := filepath.Join(a.typeDir(), cached[i].Name())
+		os.Remove(path + artifactChecksumSuffix)
+		if err := os.Remove(path); err != nil {
+			log.Warnf("failed to prune artifact cache: %v", err)
+		}
+	}
+}
+
+// cachingReader writes the artifact read through it to a temporary file of
+// the cache. Caching is given up if the file can not be written.
+type cachingReader struct {
+	io.ReadCloser
+	cache *artifactCache
+	name  string
+	// expected size of the artifact; unknown if negative
+	size int64
+	// the cached artifact is verified against these, as the rest of it
+	// is read past any verification of the stream
+	checksums []string
+	// nil once caching is given up
+	f *os.File
+	n int64
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 && c.f != nil {
+		if _, werr := c.f.Write(p[:n]); werr != nil {
+			log.Warnf("not caching artifact %s: %v", c.name, werr)
+			c.abort()
+		}
+		c.n += int64(n)
+	}
+	return n, err
+}
+
+// commit adds the artifact to the cache, once the rest of it not read by the
+// installer has been read.
+func (c *cachingReader) commit() error {
+	if c.f == nil {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		c.abort()
+		return errors.Wrapf(err, "failed to read the rest of artifact %s", c.name)
+	}
+	if c.f == nil {
+		return errors.Errorf("failed to write artifact %s to the cache", c.name)
+	}
+	if c.size >= 0 && c.n != c.size {
+		c.abort()
+		return errors.Errorf("artifact %s has size %d, expected %d", c.name, c.n, c.size)
+	}
+	err := c.f.Sync()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	var sum string
+	if err == nil {
+		sum, err = verifyFile(c.f.Name(), c.checksums)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(c.cache.path(c.name)+artifactChecksumSuffix,
+			[]byte(sum+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(c.f.Name(), c.cache.path(c.name))
+	}
+	if err != nil {
+		os.Remove(c.f.Name())
+		os.Remove(c.cache.path(c.name) + artifactChecksumSuffix)
+		c.f = nil
+		return errors.Wrapf(err, "failed to store artifact %s in the cache", c.name)
+	}
+	c.f = nil
+	log.Infof("stored artifact %s in the cache", c.name)
+	c.cache.prune()
+	return nil
+}
+
+// verifyFile checks the file at path against the checksums, if any, and
+// returns its hex encoded SHA256 checksum.
+func verifyFile(path string, checksums []string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+	if len(checksums) > 0 {
+		cr, err := utils.NewChecksumReader(ioutil.NopCloser(r), checksums...)
+		if err != nil {
+			return "", err
+		}
+		r = cr
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkpoint keeps what was cached so far, without reading the rest of the
+// artifact, to resume the download from once the daemon is started again.
+func (c *cachingReader) checkpoint() error {
+	if c.f == nil {
+		return nil
+	}
+	path := c.cache.partialPath(c.name)
+	err := c.f.Sync()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && c.f.Name() != path {
+		err = os.Rename(c.f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(c.f.Name())
+		c.f = nil
+		return errors.Wrapf(err, "failed to keep partial download of artifact %s", c.name)
+	}
+	c.f = nil
+	log.Infof("kept %d bytes of artifact %s to resume the download from", c.n, c.name)
+	return nil
+}
+
+// abort removes what was cached so far.
+func (c *cachingReader) abort() {
+	if c.f == nil {
+		return
+	}
+	c.f.Close()
+	os.Remove(c.f.Name())
+	c.f = nil
+}
+
+// resumedReader reads the part of an artifact kept in the cache, then the
+// rest of it as it is downloaded and cached.
+type resumedReader struct {
+	io.Reader
+	prefix  *os.File
+	caching *cachingReader
+}
+
+func (r *resumedReader) Close() error {
+	r.prefix.Close()
+	return r.caching.Close()
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cacheArtifact(t *testing.T, cache *artifactCache, name string, data []byte) {
+	r := cache.store(name, ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil)
+	c, ok := r.(*cachingReader)
+	require.True(t, ok)
+	// the installer reads part of it only
+	_, err := io.ReadFull(r, make([]byte, len(data)/2))
+	require.NoError(t, err)
+	require.NoError(t, c.commit())
+}
+
+func readCached(t *testing.T, cache *artifactCache, name string) []byte {
+	r, size, err := cache.open(name)
+	require.NoError(t, err)
+	if r == nil {
+		return nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), size)
+	return data
+}
+
+func TestArtifactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &artifactCache{dir: filepath.Join(dir, "usb")}
+
+	assert.Nil(t, readCached(t, cache, "release-1"))
+
+	data := bytes.Repeat([]byte("artifact"), 1024)
+	cacheArtifact(t, cache, "release-1", data)
+	assert.Equal(t, data, readCached(t, cache, "release-1"))
+
+	// names are escaped
+	cacheArtifact(t, cache, "../release/2", data)
+	assert.Equal(t, data, readCached(t, cache, "../release/2"))
+	_, err = os.Stat(filepath.Join(cache.dir, "..%2Frelease%2F2.mender"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, cache.remove("release-1"))
+	assert.Nil(t, readCached(t, cache, "release-1"))
+	assert.NoError(t, cache.remove("release-1"))
+
+	// aborted
+	r := cache.store("release-3", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil)
+	_, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	r.(*cachingReader).abort()
+	assert.NoError(t, r.(*cachingReader).commit())
+	assert.Nil(t, readCached(t, cache, "release-3"))
+
+	// short of the expected size
+	r = cache.store("release-3", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)+1), nil)
+	assert.Error(t, r.(*cachingReader).commit())
+	assert.Nil(t, readCached(t, cache, "release-3"))
+
+	// not matching the checksum of the deployment, also in the part the
+	// installer did not read
+	sum := sha256.Sum256(data)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	broken := append(append([]byte{}, data...), '!')
+	r = cache.store("release-3", ioutil.NopCloser(bytes.NewReader(broken)), -1,
+		[]string{checksum})
+	_, err = io.ReadFull(r, make([]byte, len(data)/2))
+	require.NoError(t, err)
+	assert.Error(t, r.(*cachingReader).commit())
+	assert.Nil(t, readCached(t, cache, "release-3"))
+	r = cache.store("release-3", ioutil.NopCloser(bytes.NewReader(data)), -1,
+		[]string{checksum})
+	assert.NoError(t, r.(*cachingReader).commit())
+	assert.Equal(t, data, readCached(t, cache, "release-3"))
+	assert.NoError(t, cache.remove("release-3"))
+
+	// no temporary files are left behind, only the artifact and its
+	// checksum
+	files, err := ioutil.ReadDir(cache.dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Len(t, cache.checksum("../release/2"), 64)
+}
+
+func TestArtifactCacheResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &artifactCache{dir: dir}
+	data := bytes.Repeat([]byte("artifact"), 1024)
+	var skipped int64
+	skip := func(offset int64) error {
+		skipped = offset
+		return nil
+	}
+
+	// nothing to resume from
+	r := cache.resume("release-1", ioutil.NopCloser(bytes.NewReader(data)),
+		int64(len(data)), nil, skip)
+	require.IsType(t, &cachingReader{}, r)
+	_, err = io.ReadFull(r, make([]byte, 1000))
+	require.NoError(t, err)
+	require.NoError(t, r.(*cachingReader).checkpoint())
+	assert.Zero(t, skipped)
+	fi, err := os.Stat(cache.partialPath("release-1"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1000, fi.Size())
+
+	// the rest is downloaded
+	r = cache.resume("release-1", ioutil.NopCloser(bytes.NewReader(data[1000:])),
+		int64(len(data)), nil, skip)
+	require.IsType(t, &resumedReader{}, r)
+	assert.EqualValues(t, 1000, skipped)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	require.NoError(t, r.(*resumedReader).caching.commit())
+	r.Close()
+	assert.Equal(t, data, readCached(t, cache, "release-1"))
+	_, err = os.Stat(cache.partialPath("release-1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// downloads which can not be skipped start over
+	r = cache.resume("release-2", ioutil.NopCloser(bytes.NewReader(data)),
+		int64(len(data)), nil, skip)
+	_, err = io.ReadFull(r, make([]byte, 1000))
+	require.NoError(t, err)
+	require.NoError(t, r.(*cachingReader).checkpoint())
+	r = cache.resume("release-2", ioutil.NopCloser(bytes.NewReader(data)),
+		int64(len(data)), nil, func(int64) error { return errors.New("no ranges") })
+	require.IsType(t, &cachingReader{}, r)
+	read, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	_, err = os.Stat(cache.partialPath("release-2"))
+	assert.True(t, os.IsNotExist(err))
+	r.(*cachingReader).abort()
+
+	// parts of other artifacts are removed
+	r = cache.resume("release-3", ioutil.NopCloser(bytes.NewReader(data)),
+		int64(len(data)), nil, skip)
+	_, err = io.ReadFull(r, make([]byte, 1000))
+	require.NoError(t, err)
+	require.NoError(t, r.(*cachingReader).checkpoint())
+	r = cache.resume("release-4", ioutil.NopCloser(bytes.NewReader(data)),
+		int64(len(data)), nil, skip)
+	r.(*cachingReader).abort()
+	_, err = os.Stat(cache.partialPath("release-3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArtifactCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := &artifactCache{dir: dir, keep: 2}
+
+	now := time.Now()
+	for i, name := range []string{"release-1", "release-2", "release-3"} {
+		cacheArtifact(t, cache, name, []byte(name))
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(cache.path(name), mtime, mtime))
+	}
+	cacheArtifact(t, cache, "release-4", []byte("release-4"))
+
+	assert.Nil(t, readCached(t, cache, "release-1"))
+	assert.Nil(t, readCached(t, cache, "release-2"))
+	assert.Equal(t, []byte("release-3"), readCached(t, cache, "release-3"))
+	assert.Equal(t, []byte("release-4"), readCached(t, cache, "release-4"))
+}
+
+func TestArtifactCacheUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// e.g. the removable storage is not mounted
+	notDir := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(notDir, nil, 0644))
+	cache := &artifactCache{dir: filepath.Join(notDir, "cache")}
+
+	in := ioutil.NopCloser(bytes.NewReader([]byte("artifact")))
+	assert.Equal(t, in, cache.store("release-1", in, 8, nil))
+}
+
+func TestMenderArtifactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "release-1"
+	data := []byte("artifact")
+
+	// not cached unless configured
+	in := ioutil.NopCloser(bytes.NewReader(data))
+	assert.Equal(t, in, mender.CacheUpdate(update, in, 8))
+	r, _ := mender.OpenCachedUpdate(update)
+	assert.Nil(t, r)
+	mender.FinishCachedUpdate(update, nil)
+
+	mender.artifactCache = &artifactCache{dir: dir, deviceType: "beaglebone"}
+	// not cached if storing failed
+	in = mender.CacheUpdate(update, ioutil.NopCloser(bytes.NewReader(data)), 8)
+	mender.FinishCachedUpdate(update, errors.New("install failed"))
+	r, _ = mender.OpenCachedUpdate(update)
+	assert.Nil(t, r)
+
+	in = mender.CacheUpdate(update, ioutil.NopCloser(bytes.NewReader(data)), 8)
+	mender.FinishCachedUpdate(update, nil)
+	r, size := mender.OpenCachedUpdate(update)
+	require.NotNil(t, r)
+	assert.EqualValues(t, 8, size)
+	r.Close()
+	// for the device type only
+	_, err = os.Stat(filepath.Join(dir, "beaglebone", "release-1.mender"))
+	assert.NoError(t, err)
+	other := &artifactCache{dir: dir, deviceType: "raspberrypi4"}
+	assert.Nil(t, readCached(t, other, "release-1"))
+
+	// kept if installing it failed otherwise
+	assert.False(t, mender.FinishCachedUpdate(update, utils.WithErrorKind(
+		utils.ErrorKindStorage, errors.New("write failed"))))
+	r, _ = mender.OpenCachedUpdate(update)
+	require.NotNil(t, r)
+	r.Close()
+	// but not if it is broken, which is then fetched from elsewhere
+	assert.True(t, mender.FinishCachedUpdate(update, utils.WithErrorKind(
+		utils.ErrorKindArtifact, errors.New("invalid signature"))))
+	r, _ = mender.OpenCachedUpdate(update)
+	assert.Nil(t, r)
+	// unlike broken downloads from the server
+	in = mender.CacheUpdate(update, ioutil.NopCloser(bytes.NewReader(data)), 8)
+	assert.False(t, mender.FinishCachedUpdate(update, utils.WithErrorKind(
+		utils.ErrorKindArtifact, errors.New("invalid signature"))))
+}
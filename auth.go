@@ -14,8 +14,11 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -34,12 +37,36 @@ type AuthManager interface {
 	HasKey() bool
 	// generate device key (will overwrite an already existing key)
 	GenerateKey() error
+	// switch the device to the tenant of token, or back to the configured
+	// one if token is empty; the device authorizes again
+	SetTenantToken(token []byte) error
+	// generate a new device key, pending until the server accepts it; the
+	// current key is used meanwhile
+	GeneratePendingKey() error
+	// authorization data of the pending key, nil if there is none; the
+	// device switches to that key once authorized with it
+	PendingKey() client.AuthDataMessenger
+	// when the device key was generated; keys generated before that was
+	// recorded count as generated at the first call, zero if that fails
+	KeyCreated() time.Time
 
 	client.AuthDataMessenger
 }
 
 const (
 	authTokenName = "authtoken"
+	// tenant token the device has been switched to, in place of the
+	// configured one
+	tenantTokenName = "tenant-token"
+	// tenant token the auth token was issued with
+	authTokenTenantName = "authtoken-tenant"
+	// tokens about to expire are renewed before use; requests made with
+	// expired ones would be rejected anyway
+	authTokenExpiryMargin = time.Minute
+	// time the device key was generated, as RFC 3339
+	keyCreatedName = "key-created"
+	// suffix of the name of the new device key, while it is pending
+	pendingKeySuffix = ".pending"
 
 	noAuthToken = client.EmptyAuthToken
 )
@@ -92,13 +119,53 @@ func (m *MenderAuthManager) IsAuthorized() bool {
 		return false
 	}
 
-	// TODO check if JWT is valid?
+	// tokens issued before the tenant was recorded are kept until they
+	// expire or are rejected
+	if issued, err := m.store.ReadAll(authTokenTenantName); err == nil &&
+		string(issued) != m.currentTenantToken() {
+		log.Info("tenant token changed; authorizing with the new tenant")
+		return false
+	}
+
+	if exp, ok := authTokenExpiry(adata); ok && !time.Now().Add(authTokenExpiryMargin).Before(exp) {
+		log.Infof("authorization token expired at %v", exp)
+		return false
+	}
 
 	return true
 }
 
+// authTokenExpiry returns the expiration time of a JWT auth token. Tokens
+// which can not be parsed, or do not expire, are left for the server to
+// validate.
+func authTokenExpiry(token client.AuthToken) (time.Time, bool) {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
 func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
+	// the key may have been rotated by another process meanwhile, e.g. by
+	// mender rotate-key while the daemon is running
+	if err := m.keyStore.Load(); err != nil && !store.IsNoKeys(err) {
+		log.Warnf("failed to reload device key: %v", err)
+	}
+	return m.makeAuthRequest(m.keyStore)
+}
 
+func (m *MenderAuthManager) makeAuthRequest(keyStore *store.Keystore) (*client.AuthRequest, error) {
 	var err error
 	authd := client.AuthReqData{}
 
@@ -110,12 +177,12 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	authd.IdData = idata
 
 	// fill device public key
-	authd.Pubkey, err = m.keyStore.PublicPEM()
+	authd.Pubkey, err = keyStore.PublicPEM()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to obtain device public key")
 	}
 
-	tentok := strings.TrimSpace(string(m.tenantToken))
+	tentok := m.currentTenantToken()
 
 	log.Debugf("tenant token: %s", tentok)
 
@@ -130,7 +197,7 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	}
 
 	// generate signature
-	sig, err := m.keyStore.Sign(reqdata)
+	sig, err := keyStore.Sign(reqdata)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to sign auth request")
 	}
@@ -147,12 +214,52 @@ func (m *MenderAuthManager) RecvAuthResponse(data []byte) error {
 		return errors.New("empty auth response data")
 	}
 
-	if err := m.store.WriteAll(authTokenName, data); err != nil {
+	tentok := m.currentTenantToken()
+	err := store.WriteTransaction(m.store, func(txn store.Transaction) error {
+		if err := txn.WriteAll(authTokenName, data); err != nil {
+			return err
+		}
+		return txn.WriteAll(authTokenTenantName, []byte(tentok))
+	})
+	if err != nil {
 		return errors.Wrapf(err, "failed to save auth token")
 	}
 	return nil
 }
 
+// currentTenantToken returns the tenant token the device has been switched
+// to, if any, or the configured one.
+func (m *MenderAuthManager) currentTenantToken() string {
+	if data, err := m.store.ReadAll(tenantTokenName); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return strings.TrimSpace(string(m.tenantToken))
+}
+
+func (m *MenderAuthManager) SetTenantToken(token []byte) error {
+	removeIfPresent := func(txn store.Transaction, name string) error {
+		if _, err := txn.ReadAll(name); err != nil {
+			return nil
+		}
+		return txn.Remove(name)
+	}
+	err := store.WriteTransaction(m.store, func(txn store.Transaction) error {
+		if tentok := strings.TrimSpace(string(token)); tentok != "" {
+			if err := txn.WriteAll(tenantTokenName, []byte(tentok)); err != nil {
+				return err
+			}
+		} else if err := removeIfPresent(txn, tenantTokenName); err != nil {
+			return err
+		}
+		// the auth token is of the previous tenant
+		if err := removeIfPresent(txn, authTokenName); err != nil {
+			return err
+		}
+		return removeIfPresent(txn, authTokenTenantName)
+	})
+	return errors.Wrapf(err, "failed to switch tenant token")
+}
+
 func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
 	data, err := m.store.ReadAll(authTokenName)
 	if err != nil {
@@ -187,5 +294,101 @@ func (m *MenderAuthManager) GenerateKey() error {
 		log.Errorf("failed to save device key: %s", err)
 		return NewFatalError(err)
 	}
+	if err := m.store.WriteAll(keyCreatedName,
+		[]byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		log.Warnf("failed to record when the device key was generated: %v", err)
+	}
+	return nil
+}
+
+func (m *MenderAuthManager) pendingKeyStore() *store.Keystore {
+	return store.NewKeystore(m.store, m.keyStore.GetKeyName()+pendingKeySuffix)
+}
+
+func (m *MenderAuthManager) GeneratePendingKey() error {
+	ks := m.pendingKeyStore()
+	if err := ks.Generate(); err != nil {
+		return errors.Wrapf(err, "failed to generate new device key")
+	}
+	if err := ks.Save(); err != nil {
+		return errors.Wrapf(err, "failed to save new device key")
+	}
+	return nil
+}
+
+func (m *MenderAuthManager) PendingKey() client.AuthDataMessenger {
+	ks := m.pendingKeyStore()
+	if err := ks.Load(); err != nil {
+		if !store.IsNoKeys(err) {
+			log.Warnf("failed to load new device key: %v", err)
+		}
+		return nil
+	}
+	return &pendingKeyAuth{mgr: m, keyStore: ks}
+}
+
+func (m *MenderAuthManager) KeyCreated() time.Time {
+	data, err := m.store.ReadAll(keyCreatedName)
+	if err == nil {
+		if created, err := time.Parse(time.RFC3339, string(data)); err == nil {
+			return created
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := m.store.WriteAll(keyCreatedName, []byte(now.Format(time.RFC3339))); err != nil {
+		log.Warnf("failed to record the age of the device key: %v", err)
+		return time.Time{}
+	}
+	return now
+}
+
+// pendingKeyAuth authorizes the device with its pending key, switching to
+// that key once authorized.
+type pendingKeyAuth struct {
+	mgr      *MenderAuthManager
+	keyStore *store.Keystore
+}
+
+func (p *pendingKeyAuth) MakeAuthRequest() (*client.AuthRequest, error) {
+	return p.mgr.makeAuthRequest(p.keyStore)
+}
+
+// RecvAuthResponse replaces the device key with the pending one, and the
+// auth token with the one issued for it, at once; the device is never left
+// with a key the server does not accept the token of.
+func (p *pendingKeyAuth) RecvAuthResponse(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty auth response data")
+	}
+
+	m := p.mgr
+	tentok := m.currentTenantToken()
+	err := store.WriteTransaction(m.store, func(txn store.Transaction) error {
+		pending := p.keyStore.GetKeyName()
+		key, err := txn.ReadAll(pending)
+		if err != nil {
+			return err
+		}
+		if err := txn.WriteAll(m.keyStore.GetKeyName(), key); err != nil {
+			return err
+		}
+		if err := txn.Remove(pending); err != nil {
+			return err
+		}
+		if err := txn.WriteAll(keyCreatedName,
+			[]byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+			return err
+		}
+		if err := txn.WriteAll(authTokenName, data); err != nil {
+			return err
+		}
+		return txn.WriteAll(authTokenTenantName, []byte(tentok))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to switch to the new device key")
+	}
+	if err := m.keyStore.Load(); err != nil {
+		return errors.Wrapf(err, "failed to load the new device key")
+	}
 	return nil
 }
@@ -14,12 +14,16 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewAuthManager(t *testing.T) {
@@ -185,3 +189,164 @@ func TestAuthManagerResponse(t *testing.T) {
 	assert.Equal(t, []byte("fooresp"), tokdata)
 	assert.True(t, am.IsAuthorized())
 }
+
+// makeTestJWT returns an unsigned JWT with the given claims.
+func makeTestJWT(claims string) client.AuthToken {
+	enc := base64.RawURLEncoding
+	return client.AuthToken(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) +
+		"." + enc.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl")
+}
+
+func TestAuthManagerTokenExpiry(t *testing.T) {
+	ms := store.NewMemStore()
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: &IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore: store.NewKeystore(ms, "key"),
+	})
+
+	valid := makeTestJWT(fmt.Sprintf(`{"sub":"device","exp":%d}`,
+		time.Now().Add(time.Hour).Unix()))
+	ms.WriteAll(authTokenName, []byte(valid))
+	assert.True(t, am.IsAuthorized())
+
+	expired := makeTestJWT(fmt.Sprintf(`{"sub":"device","exp":%d}`,
+		time.Now().Add(-time.Hour).Unix()))
+	ms.WriteAll(authTokenName, []byte(expired))
+	assert.False(t, am.IsAuthorized())
+
+	// tokens close to expiry are considered expired already
+	expiring := makeTestJWT(fmt.Sprintf(`{"sub":"device","exp":%d}`,
+		time.Now().Add(10*time.Second).Unix()))
+	ms.WriteAll(authTokenName, []byte(expiring))
+	assert.False(t, am.IsAuthorized())
+
+	// tokens without expiry are left for the server to validate
+	ms.WriteAll(authTokenName, []byte(makeTestJWT(`{"sub":"device"}`)))
+	assert.True(t, am.IsAuthorized())
+	ms.WriteAll(authTokenName, []byte("not.a.jwt"))
+	assert.True(t, am.IsAuthorized())
+}
+
+func TestAuthManagerTenantToken(t *testing.T) {
+	ms := store.NewMemStore()
+
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore:    store.NewKeystore(ms, "key"),
+		TenantToken: []byte("tenant1"),
+	})
+	require.NoError(t, am.GenerateKey())
+
+	assert.NoError(t, am.RecvAuthResponse([]byte("token1")))
+	assert.True(t, am.IsAuthorized())
+
+	// switching tenants drops the auth token of the previous one
+	assert.NoError(t, am.SetTenantToken([]byte("tenant2\n")))
+	assert.False(t, am.IsAuthorized())
+	req, err := am.MakeAuthRequest()
+	require.NoError(t, err)
+	assert.Equal(t, client.AuthToken("tenant2"), req.Token)
+	var ard client.AuthReqData
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.Equal(t, "tenant2", ard.TenantToken)
+
+	assert.NoError(t, am.RecvAuthResponse([]byte("token2")))
+	assert.True(t, am.IsAuthorized())
+
+	// as does changing the configured tenant token, once the device is
+	// switched back to it
+	am = NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore:    store.NewKeystore(ms, "key"),
+		TenantToken: []byte("tenant3"),
+	})
+	assert.True(t, am.IsAuthorized())
+	assert.NoError(t, am.SetTenantToken(nil))
+	assert.False(t, am.IsAuthorized())
+	req, err = am.MakeAuthRequest()
+	require.NoError(t, err)
+	assert.Equal(t, client.AuthToken("tenant3"), req.Token)
+
+	assert.NoError(t, am.RecvAuthResponse([]byte("token3")))
+	assert.True(t, am.IsAuthorized())
+	am.(*MenderAuthManager).tenantToken = client.AuthToken("tenant4")
+	assert.False(t, am.IsAuthorized())
+
+	// tokens issued without the tenant recorded are kept
+	ms.Remove(authTokenTenantName)
+	assert.True(t, am.IsAuthorized())
+}
+
+func TestAuthManagerKeyRotation(t *testing.T) {
+	ms := store.NewMemStore()
+
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore: store.NewKeystore(ms, "key"),
+	})
+	require.NoError(t, am.GenerateKey())
+	require.NoError(t, am.RecvAuthResponse([]byte("token1")))
+	assert.Nil(t, am.PendingKey())
+	created := am.KeyCreated()
+	assert.WithinDuration(t, time.Now(), created, time.Minute)
+
+	mam := am.(*MenderAuthManager)
+	oldPub, err := mam.keyStore.PublicPEM()
+	require.NoError(t, err)
+
+	require.NoError(t, am.GeneratePendingKey())
+	pending := am.PendingKey()
+	require.NotNil(t, pending)
+	req, err := pending.MakeAuthRequest()
+	require.NoError(t, err)
+	var ard client.AuthReqData
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.NotEqual(t, oldPub, ard.Pubkey)
+	newPub := ard.Pubkey
+
+	// the current key is used until the new one is accepted
+	req, err = am.MakeAuthRequest()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.Equal(t, oldPub, ard.Pubkey)
+	assert.True(t, am.IsAuthorized())
+
+	assert.Error(t, pending.RecvAuthResponse(nil))
+	ms.ReadOnly(true)
+	assert.Error(t, pending.RecvAuthResponse([]byte("token2")))
+	ms.ReadOnly(false)
+	data, err := ms.ReadAll(authTokenName)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token1"), data)
+
+	require.NoError(t, pending.RecvAuthResponse([]byte("token2")))
+	assert.Nil(t, am.PendingKey())
+	pub, err := mam.keyStore.PublicPEM()
+	require.NoError(t, err)
+	assert.Equal(t, newPub, pub)
+	token, err := am.AuthToken()
+	assert.NoError(t, err)
+	assert.Equal(t, client.AuthToken("token2"), token)
+	assert.False(t, am.KeyCreated().Before(created))
+
+	// keys generated before their age was recorded count as new
+	ms.Remove(keyCreatedName)
+	assert.WithinDuration(t, time.Now(), am.KeyCreated(), time.Minute)
+	_, err = ms.ReadAll(keyCreatedName)
+	assert.NoError(t, err)
+}
@@ -14,10 +14,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
 	"os"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -39,6 +44,10 @@ type BlockDevice struct {
 	w         *utils.LimitedWriter // wrapper for `out` limited the number of bytes written
 	typeUBI   bool                 // Set to true if we are updating an UBI volume
 	ImageSize int64                // image size
+	DirectIO  bool                 // write with O_DIRECT, if supported
+	direct    *directWriter        // set if writing with O_DIRECT
+	hash      hash.Hash            // checksum of the data written
+	written   int64                // number of bytes written
 }
 
 // Write writes data `p` to underlying block device. Will automatically open
@@ -46,7 +55,7 @@ type BlockDevice struct {
 func (bd *BlockDevice) Write(p []byte) (int, error) {
 	if bd.out == nil {
 		log.Infof("opening device %s for writing", bd.Path)
-		out, err := os.OpenFile(bd.Path, os.O_WRONLY, 0)
+		out, err := bd.openForWriting()
 		if err != nil {
 			return 0, err
 		}
@@ -88,9 +97,16 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 			W: out,
 			N: size,
 		}
+		if bd.direct != nil {
+			bd.w.W = bd.direct
+		}
+		bd.hash = sha256.New()
+		bd.written = 0
 	}
 
 	w, err := bd.w.Write(p)
+	bd.hash.Write(p[:w])
+	bd.written += int64(w)
 	if err != nil {
 		log.Errorf("written %v out of %v bytes to partition %s: %v",
 			w, len(p), bd.Path, err)
@@ -102,6 +118,13 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 // data. Othewise, behaves like io.Closer.
 func (bd *BlockDevice) Close() error {
 	if bd.out != nil {
+		if bd.direct != nil {
+			if err := bd.direct.Flush(); err != nil {
+				log.Errorf("failed to write to partition %s: %v", bd.Path, err)
+				return err
+			}
+			bd.direct = nil
+		}
 		if err := bd.out.Sync(); err != nil {
 			log.Errorf("failed to fsync partition %s: %v", bd.Path, err)
 			return err
@@ -116,6 +139,56 @@ func (bd *BlockDevice) Close() error {
 	return nil
 }
 
+func (bd *BlockDevice) openForWriting() (*os.File, error) {
+	// UBI volumes are updated through the character device
+	if bd.DirectIO && !bd.typeUBI {
+		out, ok, err := openDirect(bd.Path, os.O_WRONLY)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			bd.direct = newDirectWriter(out)
+			return out, nil
+		}
+		log.Infof("O_DIRECT not supported by %s, writing through page cache",
+			bd.Path)
+	}
+	return os.OpenFile(bd.Path, os.O_WRONLY, 0)
+}
+
+// Verify reads back the data written to the device and compares it with what
+// was written. It is to be called once the device has been closed.
+func (bd *BlockDevice) Verify() error {
+	if bd.hash == nil {
+		return errors.New("nothing written to verify")
+	}
+
+	var r io.Reader
+	in, ok, err := openDirect(bd.Path, os.O_RDONLY)
+	if err == nil && ok {
+		r = newDirectReader(in)
+	} else if err == nil {
+		in, err = os.OpenFile(bd.Path, os.O_RDONLY, 0)
+		r = in
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s for verification", bd.Path)
+	}
+	defer in.Close()
+
+	h := sha256.New()
+	if n, err := io.CopyN(h, r, bd.written); err != nil {
+		return errors.Wrapf(err, "failed to read back %s after %v of %v bytes",
+			bd.Path, n, bd.written)
+	}
+	if !bytes.Equal(h.Sum(nil), bd.hash.Sum(nil)) {
+		return errors.Errorf("data read back from %s does not match the data "+
+			"written", bd.Path)
+	}
+	log.Infof("verified %v bytes written to %s", bd.written, bd.Path)
+	return nil
+}
+
 // Size queries the size of the underlying block device. Automatically opens a
 // new fd in O_RDONLY mode, thus can be used in parallel to other operations.
 func (bd *BlockDevice) Size() (uint64, error) {
@@ -14,6 +14,9 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -22,6 +25,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBlockDeviceFail(t *testing.T) {
@@ -106,6 +110,51 @@ func TestBlockDeviceWrite(t *testing.T) {
 	BlockDeviceGetSizeOf = old
 }
 
+func TestBlockDeviceDirectWriteVerify(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-block-device-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	bdpath := path.Join(td, "foo")
+	require.NoError(t, createFile(bdpath))
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 4*1024*1024, nil, bdpath)
+
+	// not a multiple of either the chunk size or the alignment
+	data := make([]byte, 2*directIOChunkSize+3*directIOAlignment+123)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	bd := BlockDevice{Path: bdpath, DirectIO: true}
+	// before anything was written
+	assert.Error(t, bd.Verify())
+
+	buf := make([]byte, 512)
+	n, err := io.CopyBuffer(&bd, bytes.NewReader(data), buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.NoError(t, bd.Close())
+
+	written, err := ioutil.ReadFile(bdpath)
+	require.NoError(t, err)
+	assert.Equal(t, data, written)
+	assert.NoError(t, bd.Verify())
+
+	// corrupted after writing
+	f, err := os.OpenFile(bdpath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^data[directIOChunkSize]}, directIOChunkSize)
+	require.NoError(t, err)
+	f.Close()
+	assert.Error(t, bd.Verify())
+
+	// device ends before the data read back
+	require.NoError(t, os.Truncate(bdpath, int64(len(data)-1)))
+	assert.Error(t, bd.Verify())
+}
+
 func TestBlockDeviceSize(t *testing.T) {
 	td, err := ioutil.TempDir("", "mender-block-device-")
 	assert.NoError(t, err)
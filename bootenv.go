@@ -23,6 +23,8 @@ import (
 	"github.com/pkg/errors"
 )
 
+const saveEnvCanaryErrMsg = "Failed mender_saveenv_canary check. There is an error in the U-Boot setup. Likely causes are: 1) Mismatch between the U-Boot boot loader environment location and the location specified in /etc/fw_env.config. 2) 'mender_setup' is not run by the U-Boot boot script"
+
 type uBootEnv struct {
 	Commander
 }
@@ -51,16 +53,15 @@ func (e *uBootEnv) checkEnvCanary() error {
 		return nil
 	}
 
-	errMsg := "Failed mender_saveenv_canary check. There is an error in the U-Boot setup. Likely causes are: 1) Mismatch between the U-Boot boot loader environment location and the location specified in /etc/fw_env.config. 2) 'mender_setup' is not run by the U-Boot boot script"
 	getEnvCmd = e.Command("fw_printenv", "mender_saveenv_canary")
 	vars, err = getEnvironmentVariable(getEnvCmd)
 	if err != nil {
-		return errors.Wrapf(err, errMsg)
+		return errors.Wrapf(err, saveEnvCanaryErrMsg)
 	}
 	value, ok = vars["mender_saveenv_canary"]
 	if !ok || value != "1" {
 		err = errors.New("mender_saveenv_canary variable could not be parsed")
-		return errors.Wrapf(err, errMsg)
+		return errors.Wrapf(err, saveEnvCanaryErrMsg)
 	}
 
 	// Canary OK!
@@ -129,7 +130,8 @@ func getEnvironmentVariable(cmd *exec.Cmd) (BootVars, error) {
 
 	for scanner.Scan() {
 		log.Debug("Have U-Boot variable: ", scanner.Text())
-		splited_line := strings.Split(scanner.Text(), "=")
+		// values may contain '=' themselves, e.g. bootargs
+		splited_line := strings.SplitN(scanner.Text(), "=", 2)
 
 		//we are having empty line (usually at the end of output)
 		if scanner.Text() == "" {
@@ -139,6 +141,8 @@ func getEnvironmentVariable(cmd *exec.Cmd) (BootVars, error) {
 		//we have some malformed data or Warning/Error
 		if len(splited_line) != 2 {
 			log.Error("U-Boot variable malformed or error occured")
+			// reap the process before bailing out
+			cmd.Wait()
 			return nil, errors.New("Invalid U-Boot variable or error: " + scanner.Text())
 		}
 
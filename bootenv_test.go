@@ -99,6 +99,15 @@ func Test_EnvRead_HaveVariable_ReadsVariable(t *testing.T) {
 	}
 }
 
+func Test_EnvRead_ValueWithEquals_ReadsVariable(t *testing.T) {
+	runner := newTestOSCalls("bootargs=console=ttyS0,115200 root=/dev/mmcblk0p2\n", 0)
+	fakeEnv := uBootEnv{&runner}
+
+	variables, err := fakeEnv.ReadEnv("bootargs")
+	assert.NoError(t, err)
+	assert.Equal(t, "console=ttyS0,115200 root=/dev/mmcblk0p2", variables["bootargs"])
+}
+
 func Test_EnvRead_HaveEnvWarning_FailsReading(t *testing.T) {
 	runner := newTestOSCalls("Warning: Bad CRC, using default environment\nvar=1\n", 0)
 	fakeEnv := uBootEnv{&runner}
@@ -0,0 +1,281 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the client, for scripts to tell the outcome of a command.
+const (
+	exitOK    = 0
+	exitError = 1
+	// commit or rollback without an update in progress
+	exitNothingToDo = 2
+	// check-update, send-inventory, pause-download or resume-download
+	// without a daemon to notify
+	exitDaemonNotRunning = 3
+	// invalid command line, as EX_USAGE of sysexits.h
+	exitUsage = 64
+)
+
+// usageError is returned for invalid command lines.
+type usageError struct {
+	error
+}
+
+func (e usageError) Cause() error {
+	return e.error
+}
+
+// exitCode returns the exit code of the client for the result of doMain.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	switch errors.Cause(err) {
+	case flag.ErrHelp:
+		return exitOK
+	case errorNoUpgradeMounted:
+		return exitNothingToDo
+	case errDaemonNotRunning, errControlAPIUnreachable:
+		return exitDaemonNotRunning
+	case errMsgNoArgumentsGiven, errMsgAmbiguousArgumentsGiven:
+		return exitUsage
+	}
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+	return exitError
+}
+
+// cliCommand is a subcommand of the client, as in `mender install <url>`; the
+// flags of the older command line, e.g. -daemon, are still accepted.
+type cliCommand struct {
+	name        string
+	description string
+	// name of the argument the command takes, if any
+	arg string
+	// adds the flags specific to the command
+	flags func(f *flag.FlagSet, opts *runOptionsType)
+	// selects what the command does
+	run func(opts *runOptionsType, arg string)
+}
+
+var cliCommands = []cliCommand{
+	{
+		name:        "daemon",
+		description: "Run as a daemon, checking for and installing updates.",
+		flags:       addBootstrapFlags,
+		run:         func(opts *runOptionsType, _ string) { *opts.daemon = true },
+	},
+	{
+		name:        "check-update",
+		description: "Make the running daemon check for updates right away.",
+		run:         func(opts *runOptionsType, _ string) { *opts.updateCheck = true },
+	},
+	{
+		name:        "send-inventory",
+		description: "Make the running daemon send the inventory right away.",
+		run:         func(opts *runOptionsType, _ string) { *opts.sendInventory = true },
+	},
+	{
+		name:        "pause-download",
+		description: "Make the running daemon pause the artifact download, closing its connection.",
+		run:         func(opts *runOptionsType, _ string) { *opts.pauseDownload = true },
+	},
+	{
+		name:        "resume-download",
+		description: "Make the running daemon resume the paused artifact download.",
+		run:         func(opts *runOptionsType, _ string) { *opts.resumeDownload = true },
+	},
+	{
+		name:        "show-artifact",
+		description: "Print the name of the installed artifact.",
+		run:         func(opts *runOptionsType, _ string) { *opts.showArtifact = true },
+	},
+	{
+		name:        "install",
+		description: "Install the artifact from a local file or a URL.",
+		arg:         "<file or url>",
+		flags: func(f *flag.FlagSet, opts *runOptionsType) {
+			opts.checksum = f.String("checksum", "",
+				"Expected SHA256 checksum of the artifact.")
+			opts.runStateScripts = f.Bool("f", false,
+				"Force installation of artifacts with state scripts.")
+			opts.dryRun = f.Bool("dry-run", false,
+				"Only verify the artifact and print what would be installed.")
+			addServerFlags(f, opts)
+		},
+		run: func(opts *runOptionsType, arg string) { *opts.imageFile = arg },
+	},
+	{
+		name:        "commit",
+		description: "Commit the installed update.",
+		run:         func(opts *runOptionsType, _ string) { *opts.commit = true },
+	},
+	{
+		name:        "rollback",
+		description: "Roll back the installed update; the previous image is booted after reboot.",
+		run:         func(opts *runOptionsType, _ string) { *opts.rollback = true },
+	},
+	{
+		name:        "bootstrap",
+		description: "Generate the device keys and authorize with the server.",
+		flags:       addBootstrapFlags,
+		run:         func(opts *runOptionsType, _ string) { *opts.bootstrap = true },
+	},
+	{
+		name:        "rotate-key",
+		description: "Generate a new device key and submit it for authorization; the current key is used until the server accepts the new one.",
+		flags:       addServerFlags,
+		run:         func(opts *runOptionsType, _ string) { *opts.rotateKey = true },
+	},
+	{
+		name:        "decommission",
+		description: "Wipe the device key, auth token, state and deployment logs, retiring the device.",
+		flags: func(f *flag.FlagSet, opts *runOptionsType) {
+			opts.notifyServer = f.Bool("notify", false,
+				"Notify the server before wiping; nothing is wiped if that fails.")
+			addServerFlags(f, opts)
+		},
+		run: func(opts *runOptionsType, _ string) { *opts.decommission = true },
+	},
+	{
+		name:        "version",
+		description: "Print the version of the client.",
+		run:         func(opts *runOptionsType, _ string) { *opts.version = true },
+	},
+}
+
+func findCommand(name string) (cliCommand, bool) {
+	for _, cmd := range cliCommands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// addServerFlags adds the flags for connecting to the server.
+func addServerFlags(f *flag.FlagSet, opts *runOptionsType) {
+	f.StringVar(&opts.Config.ServerCert, "trusted-certs", "",
+		"Trusted server certificates.")
+	f.BoolVar(&opts.Config.NoVerify, "skipverify", false,
+		"Skip certificate verification.")
+}
+
+// addBootstrapFlags adds the flags for authorizing with the server.
+func addBootstrapFlags(f *flag.FlagSet, opts *runOptionsType) {
+	addServerFlags(f, opts)
+	opts.bootstrapForce = f.Bool("forcebootstrap", false,
+		"Generate new device keys.")
+	opts.tenantToken = f.String("tenant-token", "",
+		"Switch the device to the tenant of this token, in place of the configured one; "+
+			"an empty token switches it back to the configured one.")
+}
+
+// newRunOptions returns the options with nothing selected.
+func newRunOptions() runOptionsType {
+	return runOptionsType{
+		version:         new(bool),
+		config:          new(string),
+		fallbackConfig:  new(string),
+		dataStore:       new(string),
+		imageFile:       new(string),
+		runStateScripts: new(bool),
+		commit:          new(bool),
+		rollback:        new(bool),
+		bootstrap:       new(bool),
+		daemon:          new(bool),
+		bootstrapForce:  new(bool),
+		showArtifact:    new(bool),
+		updateCheck:     new(bool),
+		sendInventory:   new(bool),
+		pauseDownload:   new(bool),
+		resumeDownload:  new(bool),
+		dryRun:          new(bool),
+		checksum:        new(string),
+		decommission:    new(bool),
+		notifyServer:    new(bool),
+		tenantToken:     new(string),
+		rotateKey:       new(bool),
+	}
+}
+
+func parseCommand(cmd cliCommand, args []string) (runOptionsType, error) {
+	parsing := flag.NewFlagSet("mender "+cmd.name, flag.ContinueOnError)
+	opts := newRunOptions()
+	opts.config = parsing.String("config", defaultConfFile,
+		"Configuration file location.")
+	opts.fallbackConfig = parsing.String("fallback-config", defaultFallbackConfFile,
+		"Fallback configuration file location.")
+	opts.dataStore = parsing.String("data", defaultDataStore,
+		"Mender state data location.")
+	if cmd.flags != nil {
+		cmd.flags(parsing, &opts)
+	}
+	logFlags := addLogFlags(parsing)
+	parsing.Usage = func() {
+		fmt.Fprintf(parsing.Output(), "Usage: mender %s [flags] %s\n\n%s\n\nFlags:\n",
+			cmd.name, cmd.arg, cmd.description)
+		parsing.PrintDefaults()
+	}
+
+	if err := parsing.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return opts, err
+		}
+		return opts, usageError{err}
+	}
+	want := 0
+	if cmd.arg != "" {
+		want = 1
+	}
+	if parsing.NArg() != want {
+		parsing.Usage()
+		return opts, usageError{errors.Errorf("%s takes %d argument(s), %d given",
+			cmd.name, want, parsing.NArg())}
+	}
+	cmd.run(&opts, parsing.Arg(0))
+
+	if err := parseLogFlags(logFlags); err != nil {
+		return opts, usageError{err}
+	}
+	opts.logLevelGiven = logFlags.levelGiven()
+	parsing.Visit(func(f *flag.Flag) {
+		if f.Name == "tenant-token" {
+			opts.tenantTokenGiven = true
+		}
+	})
+	return opts, nil
+}
+
+// printCommands lists the subcommands, for the usage of the client.
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Usage: mender <command> [flags]\n\nCommands:\n")
+	for _, cmd := range cliCommands {
+		name := cmd.name
+		if cmd.arg != "" {
+			name += " " + cmd.arg
+		}
+		fmt.Fprintf(w, "  %-28s %s\n", name, cmd.description)
+	}
+	fmt.Fprintf(w, "\nRun 'mender <command> -help' for the flags of a command.\n"+
+		"The flags of older versions are still accepted:\n")
+}
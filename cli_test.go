@@ -0,0 +1,118 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os/exec"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArgsParseCommands(t *testing.T) {
+	opts, err := argsParse([]string{"install", "-checksum", "abc", "-f",
+		"-skipverify", "https://server/artifact.mender"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://server/artifact.mender", *opts.imageFile)
+	assert.Equal(t, "abc", *opts.checksum)
+	assert.True(t, *opts.runStateScripts)
+	assert.True(t, opts.Config.NoVerify)
+	assert.False(t, *opts.dryRun)
+	assert.False(t, *opts.daemon)
+
+	opts, err = argsParse([]string{"install", "--dry-run", "artifact.mender"})
+	require.NoError(t, err)
+	assert.Equal(t, "artifact.mender", *opts.imageFile)
+	assert.True(t, *opts.dryRun)
+
+	opts, err = argsParse([]string{"daemon", "-config", "/etc/mender.conf",
+		"-forcebootstrap"})
+	require.NoError(t, err)
+	assert.True(t, *opts.daemon)
+	assert.True(t, *opts.bootstrapForce)
+	assert.Equal(t, "/etc/mender.conf", *opts.config)
+	assert.Equal(t, "", *opts.imageFile)
+
+	for name, selected := range map[string]func(runOptionsType) bool{
+		"check-update":    func(o runOptionsType) bool { return *o.updateCheck },
+		"send-inventory":  func(o runOptionsType) bool { return *o.sendInventory },
+		"pause-download":  func(o runOptionsType) bool { return *o.pauseDownload },
+		"resume-download": func(o runOptionsType) bool { return *o.resumeDownload },
+		"show-artifact":   func(o runOptionsType) bool { return *o.showArtifact },
+		"commit":          func(o runOptionsType) bool { return *o.commit },
+		"rollback":        func(o runOptionsType) bool { return *o.rollback },
+		"bootstrap":       func(o runOptionsType) bool { return *o.bootstrap },
+		"version":         func(o runOptionsType) bool { return *o.version },
+		"decommission":    func(o runOptionsType) bool { return *o.decommission },
+		"rotate-key":      func(o runOptionsType) bool { return *o.rotateKey },
+	} {
+		opts, err := argsParse([]string{name})
+		require.NoError(t, err, name)
+		assert.True(t, selected(opts), name)
+	}
+
+	opts, err = argsParse([]string{"bootstrap", "-tenant-token", "tenant2"})
+	require.NoError(t, err)
+	assert.True(t, *opts.bootstrap)
+	assert.Equal(t, "tenant2", *opts.tenantToken)
+	assert.True(t, opts.tenantTokenGiven)
+	opts, err = argsParse([]string{"bootstrap", "-tenant-token", ""})
+	require.NoError(t, err)
+	assert.True(t, opts.tenantTokenGiven)
+	opts, err = argsParse([]string{"bootstrap"})
+	require.NoError(t, err)
+	assert.False(t, opts.tenantTokenGiven)
+
+	opts, err = argsParse([]string{"decommission", "-notify"})
+	require.NoError(t, err)
+	assert.True(t, *opts.decommission)
+	assert.True(t, *opts.notifyServer)
+
+	// flags are specific to the commands
+	_, err = argsParse([]string{"commit", "-checksum", "abc"})
+	assert.Equal(t, exitUsage, exitCode(err))
+	_, err = argsParse([]string{"install"})
+	assert.Equal(t, exitUsage, exitCode(err))
+	_, err = argsParse([]string{"commit", "now"})
+	assert.Equal(t, exitUsage, exitCode(err))
+	_, err = argsParse([]string{"reboot"})
+	assert.EqualError(t, err, `unknown command "reboot"; see 'mender -help'`)
+	assert.Equal(t, exitUsage, exitCode(err))
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, exitOK, exitCode(nil))
+	assert.Equal(t, exitOK, exitCode(flag.ErrHelp))
+	assert.Equal(t, exitNothingToDo, exitCode(errorNoUpgradeMounted))
+	assert.Equal(t, exitUsage, exitCode(errMsgNoArgumentsGiven))
+	assert.Equal(t, exitError, exitCode(errors.New("failed")))
+
+	err := updateCheck(exec.Command("true"), exec.Command("echo", "MainPID=0"))
+	assert.Equal(t, exitDaemonNotRunning, exitCode(err))
+	_, err = argsParse([]string{"-no-such-flag"})
+	assert.Equal(t, exitUsage, exitCode(err))
+}
+
+func TestPrintCommands(t *testing.T) {
+	var buf bytes.Buffer
+	printCommands(&buf)
+	assert.Contains(t, buf.String(), "install <file or url>")
+	for _, cmd := range cliCommands {
+		assert.Contains(t, buf.String(), cmd.description)
+	}
+}
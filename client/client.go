@@ -21,12 +21,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http2"
 )
@@ -60,6 +61,24 @@ var (
 
 	// connection keepalive options
 	connectionKeepaliveTime = 10 * time.Second
+
+	// defaults for establishing connections, matching http.DefaultTransport
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	// time a connection may not make any progress for
+	defaultIdleTimeout = 2 * time.Minute
+
+	// connection pooling, so that the requests of an update check cycle are
+	// sent over one connection and TLS session; the server, the artifact
+	// storage and the gateway are usually all the hosts talked to
+	defaultMaxIdleConns        = 8
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	// TLS sessions kept for resuming, instead of full handshakes, once
+	// pooled connections have been closed
+	tlsSessionCacheSize = 8
 )
 
 // Mender API Client wrapper. A standard http.Client is compatible with this
@@ -78,12 +97,14 @@ type APIError struct {
 	error
 	reqID        string
 	serverErrMsg string
+	status       int
 }
 
 func NewAPIError(err error, resp *http.Response) *APIError {
 	a := APIError{
-		error: err,
-		reqID: resp.Header.Get("request_id"),
+		error:  err,
+		reqID:  resp.Header.Get("request_id"),
+		status: resp.StatusCode,
 	}
 
 	if resp.StatusCode >= 400 && resp.StatusCode < 600 {
@@ -110,11 +131,99 @@ func (a *APIError) Cause() error {
 	return a.error
 }
 
+// ErrorKind classifies the error by the status of the response: the server
+// failing or being overloaded is a network error, one rejecting the device
+// an authorization error.
+func (a *APIError) ErrorKind() utils.ErrorKind {
+	switch {
+	case a.status == http.StatusUnauthorized:
+		return utils.ErrorKindAuth
+	case a.status == http.StatusRequestTimeout,
+		a.status == http.StatusTooManyRequests,
+		a.status >= 500:
+		return utils.ErrorKindNetwork
+	}
+	return utils.ErrorKindUnknown
+}
+
 type RequestProcessingFunc func(response *http.Response) (interface{}, error)
 
-// wrapper for http.Client with additional methods
+// wrapper for http.Client with additional methods; its transport adds the
+// configured headers to requests and signs them, so that requests sent
+// through the embedded http.Client are as well
 type ApiClient struct {
 	http.Client
+	// servers to fail over to, nil if a single server is configured
+	servers *serverList
+	// headers added to all outgoing requests not setting them already
+	headers http.Header
+	// on-premise gateway requests to its host are sent to, if configured
+	gateway *gateway
+	// client of artifact downloads, not authenticating to the hosts, and
+	// the hosts the downloads may end up at; any if empty
+	downloads     *http.Client
+	downloadHosts []string
+}
+
+// Do sends an HTTP request to the gateway, the download hosts or the servers,
+// failing over between the latter, as configured.
+func (a *ApiClient) Do(req *http.Request) (*http.Response, error) {
+	if a.gateway != nil && a.gateway.match(req) {
+		return a.gateway.client.Do(req)
+	}
+	if isDownload(req) {
+		return a.download(req)
+	}
+	if a.servers != nil {
+		return a.servers.do(req, a.do)
+	}
+	return a.do(req)
+}
+
+func (a *ApiClient) do(req *http.Request) (*http.Response, error) {
+	return a.Client.Do(req)
+}
+
+// transport returns the transport the requests of the client are sent with.
+func (a *ApiClient) transport() *http.Transport {
+	if t, ok := a.Transport.(*requestTransport); ok {
+		return t.base
+	}
+	t, _ := a.Transport.(*http.Transport)
+	return t
+}
+
+// requestTransport adds headers to the requests not setting them already,
+// and signs them if request signing is configured, before sending them with
+// base.
+type requestTransport struct {
+	base    *http.Transport
+	headers http.Header
+	// nil unless request signing is configured
+	signer *RequestSigner
+}
+
+func (t *requestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the request must not be modified
+	r := req.Clone(req.Context())
+	for name, values := range t.headers {
+		if _, ok := r.Header[name]; !ok {
+			r.Header[name] = append([]string(nil), values...)
+		}
+	}
+	if t.signer != nil {
+		if err := t.signer.Sign(r); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(r)
+}
+
+func (t *requestTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
 }
 
 type ClientReauthorizeFunc func() (AuthToken, error)
@@ -148,6 +257,9 @@ func (ar *ApiRequest) Do(req *http.Request) (*http.Response, error) {
 		// Try to refresh it and reattempt sending the request
 		log.Info("Device unauthorized; attempting reauthorization")
 		if jwt, e := ar.revoke(); e == nil {
+			// the response is discarded; close it so that the
+			// connection can be reused for the retried request
+			r.Body.Close()
 			// retry API request with new JWT token
 			ar.auth = jwt
 			// check if request had a body
@@ -174,7 +286,7 @@ func NewApiClient(conf Config) (*ApiClient, error) {
 func New(conf Config) (*ApiClient, error) {
 
 	var client *http.Client
-	if conf == (Config{}) {
+	if conf.ServerCert == "" && !conf.IsHttps && !conf.NoVerify {
 		client = newHttpClient()
 	} else {
 		var err error
@@ -191,16 +303,92 @@ func New(conf Config) (*ApiClient, error) {
 	client.Timeout = defaultClientReadingTimeout
 
 	transport := client.Transport.(*http.Transport)
+	proxy, err := newProxy(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
 	//set keepalive options
-	transport.DialContext = (&net.Dialer{
-		KeepAlive: connectionKeepaliveTime,
-	}).DialContext
+	dialTimeout := conf.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	idleTimeout := conf.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	dial, err := newDialer(dialTimeout, conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.DialContext = idleTimeoutDialer(dial, idleTimeout)
+
+	transport.TLSHandshakeTimeout = conf.TLSHandshakeTimeout
+	if transport.TLSHandshakeTimeout == 0 {
+		transport.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
 
+	transport.MaxIdleConns = defaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+
+	// the custom TLS configuration and dialer disable HTTP/2 unless the
+	// transport is configured for it explicitly
 	if err := http2.ConfigureTransport(transport); err != nil {
 		log.Warnf("failed to enable HTTP/2 for client: %v", err)
 	}
 
-	return &ApiClient{*client}, nil
+	var signer *RequestSigner
+	if conf.SigningSecret != "" {
+		signer = NewRequestSigner(conf.SigningKeyID, []byte(conf.SigningSecret))
+	}
+
+	var servers *serverList
+	if len(conf.Servers) > 1 {
+		servers = newServerList(conf.Servers)
+	}
+
+	var gw *gateway
+	if conf.GatewayURL != "" {
+		var err error
+		if gw, err = newGateway(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidateDownloadHosts(conf.DownloadHosts); err != nil {
+		return nil, err
+	}
+
+	headers := requestHeaders(conf)
+	client.Transport = &requestTransport{
+		base:    transport,
+		headers: headers,
+		signer:  signer,
+	}
+	return &ApiClient{
+		Client:        *client,
+		servers:       servers,
+		headers:       headers,
+		gateway:       gw,
+		downloads:     newDownloadClient(transport),
+		downloadHosts: conf.DownloadHosts,
+	}, nil
+}
+
+// requestHeaders returns the headers to add to all requests; the configured
+// headers take precedence over the defaults.
+func requestHeaders(conf Config) http.Header {
+	headers := http.Header{}
+	headers.Set("Accept", "application/json")
+	if conf.UserAgent != "" {
+		headers.Set("User-Agent", conf.UserAgent)
+	}
+	for name, value := range conf.Headers {
+		headers.Set(name, value)
+	}
+	return headers
 }
 
 func newHttpClient() *http.Client {
@@ -216,11 +404,42 @@ func newHttpsClient(conf Config) (*http.Client, error) {
 	}
 
 	if conf.NoVerify {
-		log.Warnf("certificate verification skipped..")
+		log.Warn("Server certificate verification is DISABLED. The connection " +
+			"is not secure and must only be used for testing.")
+	}
+	clientCert, err := newClientCertificate(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load client certificate")
+	}
+
+	minVersion := conf.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
 	}
 	tlsc := tls.Config{
 		RootCAs:            trustedcerts,
 		InsecureSkipVerify: conf.NoVerify,
+		MinVersion:         minVersion,
+		CipherSuites:       conf.TLSCipherSuites,
+		ServerName:         conf.TLSServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+	}
+	if clientCert != nil {
+		tlsc.GetClientCertificate = clientCert.get
+	}
+	var verifiers []func(tls.ConnectionState) error
+	if len(conf.PublicKeyPins) > 0 {
+		verifiers = append(verifiers, verifyPublicKeyPins(conf.PublicKeyPins))
+	}
+	revocation, err := newRevocationChecker(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot initialize revocation checking")
+	}
+	if revocation != nil {
+		verifiers = append(verifiers, revocation.verify)
+	}
+	if len(verifiers) > 0 {
+		tlsc.VerifyConnection = verifyServerHosts(serverHosts(conf), verifiers)
 	}
 	transport := http.Transport{
 		TLSClientConfig: &tlsc,
@@ -236,26 +455,138 @@ type Config struct {
 	ServerCert string
 	IsHttps    bool
 	NoVerify   bool
+	// key ID and shared secret used for HMAC signing of requests; signing
+	// is disabled if the secret is empty
+	SigningKeyID  string
+	SigningSecret string
+	// URL of the proxy to use for all requests, an HTTP(S) or a SOCKS5
+	// one; if empty the proxy is taken from the environment
+	HttpProxy string
+	// URL of the proxy artifact downloads go through instead, if set
+	DownloadProxy string
+	// hosts artifact downloads may end up at after any redirects, as
+	// "cdn.example.com" or "*.s3.amazonaws.com"; any if empty
+	DownloadHosts []string
+	// minimum TLS version, TLS 1.2 if zero
+	TLSMinVersion uint16
+	// allowed cipher suites, crypto/tls defaults if empty
+	TLSCipherSuites []uint16
+	// server name to verify the server certificate against, if different
+	// from the host name in the server URL
+	TLSServerName string
+	// public keys the certificate chain of the servers must contain one of,
+	// in addition to being trusted; no pinning if empty
+	PublicKeyPins []PublicKeyPin
+	// revocation checking of the server certificate chains against the
+	// CRLs in a PEM or DER file, and against the OCSP responses stapled by
+	// the servers; revoked certificates are always refused, certificates
+	// the status of which is unknown only if hard-failing
+	CRLFile            string
+	OCSPStapling       bool
+	RevocationHardFail bool
+	// timeouts for establishing a connection and for the TLS handshake,
+	// defaults are used if zero
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// time to wait for the response headers once the request has been
+	// sent; no limit if zero
+	ResponseHeaderTimeout time.Duration
+	// time reads and writes on connections may not make any progress for,
+	// the default is used if zero
+	IdleTimeout time.Duration
+	// certificate and private key for authenticating to the server; the
+	// key is a PEM file, or a key URI interpreted by the key engine
+	ClientCert string
+	ClientKey  string
+	KeyEngine  string
+	// program signing with the key for the external key engine
+	KeyHelper string
+	// servers requests fail over to, in order, if the server a request is
+	// made to can not be reached or fails; requests to URLs of other
+	// servers, e.g. artifact downloads, are not affected
+	Servers []string
+	// URL of the server the requests are made to; public key pins and
+	// revocation checks apply to it and to Servers only
+	ServerURL string
+	// User-Agent of all requests, and headers added to all requests
+	UserAgent string
+	Headers   map[string]string
+	// on-premise gateway relaying requests to the server, and the
+	// certificate it is verified against instead of ServerCert
+	GatewayURL  string
+	GatewayCert string
+	// IP version, 4 or 6, connections are restricted to; either if zero
+	IPVersion int
+	// IP addresses hosts are connected to at, by hostname, rather than
+	// resolving their names, and the DNS server the names of other hosts
+	// are resolved with; that of the system if empty
+	Hosts    map[string][]string
+	Resolver string
 }
 
-func loadServerTrust(conf Config) (*x509.CertPool, error) {
-	if conf.ServerCert == "" {
-		// TODO: this is for pre-production version only to simplify tests.
-		// Make sure to remove in production version.
-		log.Warn("Server certificate not provided. Trusting all servers.")
+// ParseTLSVersion converts a TLS version given as "1.0" to "1.3" to the value
+// used by crypto/tls. An empty version yields zero, meaning the default.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.Errorf("unsupported TLS version: %q", version)
+}
+
+// ParseCipherSuites converts cipher suite names, as defined by crypto/tls
+// (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), to their IDs. Suites known to
+// be insecure are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
 		return nil, nil
 	}
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.Errorf("unsupported cipher suite: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
+func loadServerTrust(conf Config) (*x509.CertPool, error) {
 	syscerts, err := x509.SystemCertPool()
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to load system certificates")
+	}
+
+	if conf.ServerCert == "" {
+		// the server is verified against the system certificates only;
+		// skipping verification requires SkipVerify to be set explicitly
+		log.Info("Server certificate not provided, using system certificates.")
+		if syscerts == nil || len(syscerts.Subjects()) == 0 {
+			log.Warn("No system certificates found; server verification will fail.")
+		}
+		return syscerts, nil
 	}
 
 	// Read certificate file.
 	servcert, err := ioutil.ReadFile(conf.ServerCert)
 	if err != nil {
 		log.Errorf("%s is inaccessible: %s", conf.ServerCert, err.Error())
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to read server certificate; "+
+			"check the ServerCertificate setting")
 	}
 
 	if len(servcert) == 0 {
@@ -282,11 +613,60 @@ func loadServerTrust(conf Config) (*x509.CertPool, error) {
 	syscerts.AppendCertsFromPEM(servcert)
 
 	if len(syscerts.Subjects()) == 0 {
-		return nil, errorAddingServerCertificateToPool
+		return nil, errors.Wrapf(errorAddingServerCertificateToPool,
+			"%s does not contain a PEM encoded certificate", conf.ServerCert)
 	}
 	return syscerts, nil
 }
 
+// serverHosts returns the hosts of the servers and the name their
+// certificates are verified against. Other hosts, such as the storage
+// artifacts are downloaded from, are trusted as usual.
+func serverHosts(conf Config) []string {
+	var hosts []string
+	for _, server := range append([]string{conf.ServerURL}, conf.Servers...) {
+		if server == "" {
+			continue
+		}
+		if u, err := url.Parse(buildURL(server)); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	if conf.TLSServerName != "" {
+		hosts = append(hosts, conf.TLSServerName)
+	}
+	return hosts
+}
+
+// verifyServerHosts returns the tls.Config.VerifyConnection function applying
+// the verifiers to connections to hosts, and to none if no hosts are given.
+// Hosts given by IP address have no server name to tell them apart by, and
+// are verified if any hosts are given.
+func verifyServerHosts(hosts []string,
+	verifiers []func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+
+	return func(cs tls.ConnectionState) error {
+		if len(hosts) == 0 || (cs.ServerName != "" && !containsHost(hosts, cs.ServerName)) {
+			return nil
+		}
+		for _, verify := range verifiers {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
 func buildURL(server string) string {
 	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://") {
 		return server
@@ -336,13 +716,76 @@ func GetExponentialBackoffTime(tried int, maxInterval time.Duration) (time.Durat
 	return interval, nil
 }
 
+// Maximum number of bytes of a response body that is quoted in decoding errors
+// on either side of the offending offset.
+const decodeErrorContext = 32
+
+// DecodeError is returned when a response from the server can not be decoded.
+// Apart from the original decoding error it carries the offset at which
+// decoding failed and a short, bounded excerpt of the body around that offset.
+type DecodeError struct {
+	error
+	Offset  int64
+	Snippet string
+}
+
+func NewDecodeError(err error, body []byte) *DecodeError {
+	d := DecodeError{
+		error:  err,
+		Offset: -1,
+	}
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		d.Offset = e.Offset
+	case *json.UnmarshalTypeError:
+		d.Offset = e.Offset
+	}
+
+	if d.Offset >= 0 {
+		d.Snippet = bodySnippet(body, d.Offset)
+	}
+	return &d
+}
+
+func (d *DecodeError) Error() string {
+	// json.UnmarshalTypeError already reports the field and the types
+	// involved, only the location needs to be added
+	if d.Offset < 0 {
+		return d.error.Error()
+	}
+	return fmt.Sprintf("%s (offset: %d, near: %q)", d.error.Error(), d.Offset, d.Snippet)
+}
+
+// Cause returns the underlying decoding error.
+func (d *DecodeError) Cause() error {
+	return d.error
+}
+
+// bodySnippet returns at most 2*decodeErrorContext bytes of body centered
+// around offset.
+func bodySnippet(body []byte, offset int64) string {
+	start := offset - decodeErrorContext
+	if start < 0 {
+		start = 0
+	}
+	end := offset + decodeErrorContext
+	if end > int64(len(body)) {
+		end = int64(len(body))
+	}
+	if start >= end {
+		return ""
+	}
+	return string(body[start:end])
+}
+
 // unmarshalErrorMessage unmarshals the error message contained in an
 // error request from the server.
 func unmarshalErrorMessage(r io.Reader) string {
 	e := new(struct {
 		Error string `json:"error"`
 	})
-	if err := json.NewDecoder(r).Decode(e); err != nil {
+	if err := json.NewDecoder(io.LimitReader(r, maxResponseSize)).Decode(e); err != nil {
 		return fmt.Sprintf("failed to parse server response: %v", err)
 	}
 	return e.Error
@@ -18,7 +18,6 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
@@ -27,7 +26,7 @@ import (
 	"github.com/pkg/errors"
 )
 
-var AuthErrorUnauthorized = errors.New("authentication request rejected")
+var AuthErrorUnauthorized error = authError("authentication request rejected")
 
 type AuthRequester interface {
 	Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error)
@@ -98,7 +97,7 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 		return nil, NewAPIError(AuthErrorUnauthorized, rsp)
 	case http.StatusOK:
 		log.Debugf("receive response data")
-		data, err := ioutil.ReadAll(rsp.Body)
+		data, err := readResponseBody(rsp.Body)
 		if err != nil {
 			return nil, NewAPIError(errors.Wrapf(err, "failed to receive authorization response data"), rsp)
 		}
@@ -0,0 +1,189 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeyEngineFile reads the client key from a PEM file.
+	KeyEngineFile = ""
+	// KeyEngineExternal delegates signing with the client key to a helper
+	// program, so that the key can be kept in a TPM or a PKCS#11 token.
+	KeyEngineExternal = "external"
+)
+
+// externalSigner is a crypto.Signer calling the key helper for each
+// signature as
+//
+//	<helper> sign <key-uri> <hash> <padding>
+//
+// with the digest on stdin. The helper writes the raw signature to stdout;
+// <hash> is e.g. "sha256" and <padding> is "pkcs1" or "pss" for RSA keys,
+// with PSS salts as long as the hash, and "ecdsa" for ECDSA keys, which
+// produce ASN.1 DER encoded signatures.
+type externalSigner struct {
+	helper string
+	uri    string
+	pub    crypto.PublicKey
+}
+
+func (s *externalSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *externalSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var padding string
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		padding = "pkcs1"
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			padding = "pss"
+		}
+	case *ecdsa.PublicKey:
+		padding = "ecdsa"
+	default:
+		return nil, errors.Errorf("unsupported client key type %T", s.pub)
+	}
+	hash := strings.ToLower(strings.Replace(opts.HashFunc().String(), "-", "", -1))
+
+	cmd := exec.Command(s.helper, "sign", s.uri, hash, padding)
+	cmd.Stdin = bytes.NewReader(digest)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sig, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "key helper failed to sign: %s",
+			strings.TrimSpace(stderr.String()))
+	}
+	if len(sig) == 0 {
+		return nil, errors.New("key helper returned an empty signature")
+	}
+	return sig, nil
+}
+
+// loadClientCertificate loads the certificate for authenticating to the
+// server, if one is configured. The private key is read from a file or opened
+// through the configured key engine.
+func loadClientCertificate(conf Config) (*tls.Certificate, error) {
+	if conf.ClientCert == "" {
+		if conf.ClientKey != "" {
+			return nil, errors.New("client key given without a client certificate")
+		}
+		return nil, nil
+	}
+
+	certPEM, err := ioutil.ReadFile(conf.ClientCert)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read client certificate")
+	}
+
+	switch conf.KeyEngine {
+	case KeyEngineFile:
+		keyPEM, err := ioutil.ReadFile(conf.ClientKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read client key")
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client certificate or key")
+		}
+		return &cert, nil
+
+	case KeyEngineExternal:
+		if conf.KeyHelper == "" {
+			return nil, errors.New("key helper required for external client keys")
+		}
+		var cert tls.Certificate
+		for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				cert.Certificate = append(cert.Certificate, block.Bytes)
+			}
+		}
+		if len(cert.Certificate) == 0 {
+			return nil, errors.New("no certificate found in client certificate file")
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client certificate")
+		}
+		cert.Leaf = leaf
+		cert.PrivateKey = &externalSigner{
+			helper: conf.KeyHelper,
+			uri:    conf.ClientKey,
+			pub:    leaf.PublicKey,
+		}
+		log.Infof("using client key %s through key helper %s", conf.ClientKey,
+			conf.KeyHelper)
+		return &cert, nil
+	}
+	return nil, errors.Errorf("unsupported key engine: %q", conf.KeyEngine)
+}
+
+// clientCertificate hands the client certificate to TLS handshakes, loading
+// it again once its file has been replaced, e.g. as it has been renewed. The
+// certificate loaded before is kept if the new one can not be loaded.
+type clientCertificate struct {
+	conf    Config
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCertificate(conf Config) (*clientCertificate, error) {
+	cert, err := loadClientCertificate(conf)
+	if err != nil || cert == nil {
+		return nil, err
+	}
+	c := &clientCertificate{conf: conf, cert: cert}
+	if fi, err := os.Stat(conf.ClientCert); err == nil {
+		c.modTime = fi.ModTime()
+	}
+	return c, nil
+}
+
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fi, err := os.Stat(c.conf.ClientCert)
+	if err != nil || fi.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := loadClientCertificate(c.conf)
+	if err != nil {
+		log.Warnf("keeping the client certificate loaded before: %v", err)
+		return c.cert, nil
+	}
+	log.Infof("reloaded client certificate %s", c.conf.ClientCert)
+	c.cert = cert
+	c.modTime = fi.ModTime()
+	return c.cert, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// opensslKeyHelper signs with a key file standing in for a hardware token.
+const opensslKeyHelper = `#!/bin/sh
+[ "$1" = sign ] || exit 1
+case $4 in
+pkcs1) exec openssl pkeyutl -sign -inkey "$2" -pkeyopt digest:$3 ;;
+pss) exec openssl pkeyutl -sign -inkey "$2" -pkeyopt digest:$3 \
+	-pkeyopt rsa_padding_mode:pss -pkeyopt rsa_pss_saltlen:digest ;;
+ecdsa) exec openssl pkeyutl -sign -inkey "$2" ;;
+esac
+exit 1
+`
+
+// writeClientCert writes a self signed certificate for key and the key
+// itself to dir; writeClientCertCN with the given common name.
+func writeClientCert(t *testing.T, dir string, key crypto.Signer) (string, string) {
+	return writeClientCertCN(t, dir, key, "device")
+}
+
+func writeClientCertCN(t *testing.T, dir string, key crypto.Signer, cn string) (string, string) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	require.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// requestWithClientCert makes a request to a server requiring a client
+// certificate and returns the common name the server got.
+func requestWithClientCert(t *testing.T, conf Config) (string, error) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	conf.IsHttps = true
+	conf.NoVerify = true
+	ac, err := NewApiClient(conf)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := ac.Get(ts.URL)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	return string(body), err
+}
+
+func TestClientCertificateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientkey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certFile, keyFile := writeClientCert(t, dir, key)
+
+	cn, err := requestWithClientCert(t, Config{ClientCert: certFile, ClientKey: keyFile})
+	assert.NoError(t, err)
+	assert.Equal(t, "device", cn)
+
+	// broken settings are reported when creating the client
+	_, err = NewApiClient(Config{IsHttps: true, NoVerify: true, ClientKey: keyFile})
+	assert.Error(t, err)
+	_, err = NewApiClient(Config{IsHttps: true, NoVerify: true,
+		ClientCert: certFile, ClientKey: certFile})
+	assert.Error(t, err)
+	_, err = NewApiClient(Config{IsHttps: true, NoVerify: true,
+		ClientCert: certFile, ClientKey: keyFile, KeyEngine: "openssl"})
+	assert.Error(t, err)
+	_, err = NewApiClient(Config{IsHttps: true, NoVerify: true,
+		ClientCert: certFile, ClientKey: "pkcs11:object=device", KeyEngine: KeyEngineExternal})
+	assert.Error(t, err)
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientkey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certFile, keyFile := writeClientCert(t, dir, key)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, SessionTicketsDisabled: true}
+	ts.StartTLS()
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{IsHttps: true, NoVerify: true,
+		ClientCert: certFile, ClientKey: keyFile})
+	require.NoError(t, err)
+	get := func() string {
+		ac.CloseIdleConnections()
+		rsp, err := ac.Get(ts.URL)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "device", get())
+
+	// replaced, as renewed
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	writeClientCertCN(t, dir, key, "renewed")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "renewed", get())
+
+	// the certificate loaded before is kept if the new one is broken
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "renewed", get())
+}
+
+func TestClientCertificateExternalKey(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	dir, err := ioutil.TempDir("", "clientkey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	helper := filepath.Join(dir, "key-helper")
+	require.NoError(t, ioutil.WriteFile(helper, []byte(opensslKeyHelper), 0755))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		certFile, keyFile := writeClientCert(t, dir, key)
+		for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+			cn, err := requestWithClientCert(t, Config{
+				ClientCert:    certFile,
+				ClientKey:     keyFile,
+				KeyEngine:     KeyEngineExternal,
+				KeyHelper:     helper,
+				TLSMinVersion: version,
+			})
+			assert.NoError(t, err, "%T, TLS version %x", key, version)
+			assert.Equal(t, "device", cn)
+		}
+	}
+
+	// failures of the helper fail the handshake
+	certFile, _ := writeClientCert(t, dir, ecKey)
+	_, err = requestWithClientCert(t, Config{
+		ClientCert: certFile,
+		ClientKey:  "pkcs11:object=missing",
+		KeyEngine:  KeyEngineExternal,
+		KeyHelper:  helper,
+	})
+	assert.Error(t, err)
+}
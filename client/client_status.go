@@ -30,6 +30,21 @@ const (
 	StatusSuccess          = "success"
 	StatusFailure          = "failure"
 	StatusAlreadyInstalled = "already-installed"
+
+	// the update does not fit on the device
+	StatusInsufficientSpace = "insufficient-space"
+	// the update is downloaded, waiting to be installed in a maintenance
+	// window
+	StatusPauseBeforeInstalling = "pause_before_installing"
+	// the deployment is paused by its update control map
+	StatusPauseBeforeDownloading = "pause_before_downloading"
+	StatusPauseBeforeCommitting  = "pause_before_committing"
+	// the device does not meet the conditions for installing updates
+	// yet; the update is checked for again at the next poll
+	StatusDeferred = "deferred"
+	// the daemon was stopped during the deployment, which is resumed once
+	// it is started again
+	StatusPausedByShutdown = "paused_by_shutdown"
 )
 
 var (
@@ -77,12 +92,13 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 
 	defer r.Body.Close()
 
-	// HTTP 204 No Content
+	// HTTP 204 No Content; 200 OK is accepted as well as some servers reply
+	// with the stored status
 	switch {
 	case r.StatusCode == http.StatusConflict:
 		log.Warnf("status report rejected, deployment aborted at the backend")
 		return NewAPIError(ErrDeploymentAborted, r)
-	case r.StatusCode != http.StatusNoContent:
+	case r.StatusCode != http.StatusNoContent && r.StatusCode != http.StatusOK:
 		log.Errorf("got unexpected HTTP status when reporting status: %v", r.StatusCode)
 		return NewAPIError(errors.Errorf("reporting status failed, bad status %v", r.StatusCode), r)
 	}
@@ -99,7 +115,9 @@ func makeStatusReportRequest(server string, report StatusReport) (*http.Request,
 
 	out := &bytes.Buffer{}
 	enc := json.NewEncoder(out)
-	enc.Encode(&report)
+	if err := enc.Encode(&report); err != nil {
+		return nil, errors.Wrapf(err, "failed to encode status report")
+	}
 
 	hreq, err := http.NewRequest(http.MethodPut, url, out)
 	if err != nil {
@@ -44,7 +44,7 @@ func TestStatusClient(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -86,3 +86,39 @@ func TestStatusClient(t *testing.T) {
 	errCause := errors.Cause(err)
 	assert.Equal(t, errCause, ErrDeploymentAborted)
 }
+
+func TestStatusClientResponseCodes(t *testing.T) {
+	var httpStatus int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(httpStatus)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	client := NewStatus()
+	report := StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusInstalling,
+	}
+
+	for _, tc := range []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusNoContent, true},
+		{http.StatusOK, true},
+		{http.StatusAccepted, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, false},
+	} {
+		httpStatus = tc.status
+		err = client.Report(ac, ts.URL, report)
+		if tc.ok {
+			assert.NoError(t, err, "status %d", tc.status)
+		} else {
+			assert.Error(t, err, "status %d", tc.status)
+		}
+	}
+}
@@ -15,8 +15,8 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -24,9 +24,11 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -36,7 +38,7 @@ func dummy() (AuthToken, error) {
 }
 func TestHttpClient(t *testing.T) {
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, cl)
 
@@ -46,15 +48,17 @@ func TestHttpClient(t *testing.T) {
 
 	// missing cert in config should yield an error
 	cl, err = NewApiClient(
-		Config{"missing.crt", true, false},
+		Config{ServerCert: "missing.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.Nil(t, cl)
 	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "missing.crt")
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
 }
 
 func TestApiClientRequest(t *testing.T) {
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, cl)
 
@@ -94,6 +98,52 @@ func TestApiClientRequest(t *testing.T) {
 	assert.Equal(t, "Bearer zed", responder.headers.Get("Authorization"))
 }
 
+func TestApiClientReauthorize(t *testing.T) {
+	var auths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	// failing reauthorization leaves the original response
+	hreq, _ := http.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString("data"))
+	rsp, err := cl.Request("expired", dummy).Do(hreq)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+	assert.Equal(t, []string{"Bearer expired"}, auths)
+
+	// request is resent, body included, with the new token
+	auths = nil
+	req := cl.Request("expired", func() (AuthToken, error) {
+		return AuthToken("fresh"), nil
+	})
+	hreq, _ = http.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString("data"))
+	rsp, err = req.Do(hreq)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, _ := ioutil.ReadAll(rsp.Body)
+	assert.Equal(t, "data", string(body))
+	assert.Equal(t, []string{"Bearer expired", "Bearer fresh"}, auths)
+
+	// new token is used for subsequent requests
+	auths = nil
+	hreq, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err = req.Do(hreq)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{"Bearer fresh"}, auths)
+}
+
 func TestClientConnectionTimeout(t *testing.T) {
 
 	prevReadingTimeout := defaultClientReadingTimeout
@@ -110,7 +160,7 @@ func TestClientConnectionTimeout(t *testing.T) {
 	}()
 
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, cl)
 	assert.NoError(t, err)
@@ -175,6 +225,37 @@ func TestCaLoading(t *testing.T) {
 	assert.True(t, oursOK)
 }
 
+func TestSystemCaLoading(t *testing.T) {
+	// without a server certificate system certificates are trusted, and
+	// not every server
+	certs, err := loadServerTrust(Config{})
+	assert.NoError(t, err)
+	assert.NotNil(t, certs)
+
+	ac, err := NewApiClient(Config{IsHttps: true})
+	require.NoError(t, err)
+	tlsc := ac.transport().TLSClientConfig
+	assert.False(t, tlsc.InsecureSkipVerify)
+	assert.NotNil(t, tlsc.RootCAs)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err = ac.Do(req)
+	assert.Error(t, err)
+
+	// unless verification is explicitly disabled
+	ac, err = NewApiClient(Config{IsHttps: true, NoVerify: true})
+	require.NoError(t, err)
+	req, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err := ac.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
 func TestEmptySystemCertPool(t *testing.T) {
 	version := runtime.Version()
 	if strings.HasPrefix(version, "1.6") || strings.HasPrefix(version, "1.7") || strings.HasPrefix(version, "1.8") {
@@ -277,3 +358,240 @@ func TestUnMarshalErrorMessage(t *testing.T) {
 	expected := "failed to decode device group data: JSON payload is empty"
 	assert.Equal(t, expected, unmarshalErrorMessage(bytes.NewReader([]byte(jsonErrMsg))))
 }
+
+func TestApiClientProxy(t *testing.T) {
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	_, err := NewApiClient(Config{HttpProxy: "http://[::1"})
+	assert.Error(t, err)
+
+	ac, err := NewApiClient(Config{
+		HttpProxy: strings.Replace(proxy.URL, "http://", "http://user:secret@", 1),
+	})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://mender.invalid/foo", nil)
+	rsp, err := ac.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.NotNil(t, proxied)
+	assert.Equal(t, "mender.invalid", proxied.Host)
+	assert.Equal(t, "/foo", proxied.URL.Path)
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", proxied.Header.Get("Proxy-Authorization"))
+
+	// proxy is taken from the environment by default
+	ac, err = NewApiClient(Config{})
+	require.NoError(t, err)
+	transport := ac.transport()
+	assert.NotNil(t, transport.Proxy)
+}
+
+func TestApiClientHeaders(t *testing.T) {
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ac, err := NewApiClient(Config{
+		UserAgent: "mender/1.0 (qemu; Linux 4.14)",
+		Headers: map[string]string{
+			"x-mender-site": "factory-1",
+		},
+	})
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = ac.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "mender/1.0 (qemu; Linux 4.14)", received.Get("User-Agent"))
+	assert.Equal(t, "application/json", received.Get("Accept"))
+	assert.Equal(t, "factory-1", received.Get("X-Mender-Site"))
+
+	// headers of the request are kept
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	_, err = ac.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "application/octet-stream", received.Get("Accept"))
+
+	// configured headers override the defaults
+	ac, err = NewApiClient(Config{
+		UserAgent: "mender/1.0",
+		Headers: map[string]string{
+			"User-Agent": "custom",
+		},
+	})
+	require.NoError(t, err)
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = ac.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "custom", received.Get("User-Agent"))
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	v, err := ParseTLSVersion("")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), v)
+
+	v, err = ParseTLSVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+
+	_, err = ParseTLSVersion("3.0")
+	assert.Error(t, err)
+
+	cs, err := ParseCipherSuites(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, cs)
+
+	cs, err = ParseCipherSuites([]string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}, cs)
+
+	// insecure and unknown suites are rejected
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err)
+	_, err = ParseCipherSuites([]string{"foo"})
+	assert.Error(t, err)
+}
+
+func TestHttpsClientTLSConfig(t *testing.T) {
+	ac, err := NewApiClient(Config{IsHttps: true, NoVerify: true})
+	require.NoError(t, err)
+	tlsc := ac.transport().TLSClientConfig
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsc.MinVersion)
+	assert.Nil(t, tlsc.CipherSuites)
+	assert.Equal(t, "", tlsc.ServerName)
+
+	ac, err = NewApiClient(Config{
+		IsHttps:         true,
+		NoVerify:        true,
+		TLSMinVersion:   tls.VersionTLS13,
+		TLSCipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		TLSServerName:   "mender.io",
+	})
+	require.NoError(t, err)
+	tlsc = ac.transport().TLSClientConfig
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsc.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		tlsc.CipherSuites)
+	assert.Equal(t, "mender.io", tlsc.ServerName)
+}
+
+func TestApiClientTimeouts(t *testing.T) {
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	tr := ac.transport()
+	assert.Equal(t, defaultTLSHandshakeTimeout, tr.TLSHandshakeTimeout)
+	assert.Equal(t, time.Duration(0), tr.ResponseHeaderTimeout)
+
+	ac, err = NewApiClient(Config{
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	tr = ac.transport()
+	assert.Equal(t, 5*time.Second, tr.TLSHandshakeTimeout)
+	assert.Equal(t, 100*time.Millisecond, tr.ResponseHeaderTimeout)
+
+	// a server not sending response headers in time fails the request
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = ac.Do(req)
+	assert.Error(t, err)
+}
+
+func TestApiClientConnectionReuse(t *testing.T) {
+	var lock sync.Mutex
+	conns := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ts.EnableHTTP2 = true
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			conns++
+			lock.Unlock()
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{IsHttps: true, NoVerify: true})
+	require.NoError(t, err)
+	tr := ac.transport()
+	assert.Equal(t, defaultMaxIdleConns, tr.MaxIdleConns)
+	assert.Equal(t, defaultIdleConnTimeout, tr.IdleConnTimeout)
+	assert.NotNil(t, tr.TLSClientConfig.ClientSessionCache)
+
+	// auth, update check, status report and inventory of one cycle
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		rsp, err := ac.Do(req)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		assert.Equal(t, 2, rsp.ProtoMajor)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, conns)
+}
+
+func TestVerifyServerHosts(t *testing.T) {
+	errFailed := errors.New("failed")
+	verify := verifyServerHosts(serverHosts(Config{
+		Servers: []string{"https://mender.io:443", "hosted.mender.io"},
+	}), []func(tls.ConnectionState) error{
+		func(tls.ConnectionState) error { return nil },
+		func(tls.ConnectionState) error { return errFailed },
+	})
+
+	// hosts other than the servers, e.g. artifact storage, are not verified
+	assert.NoError(t, verify(tls.ConnectionState{ServerName: "s3.amazonaws.com"}))
+	assert.Equal(t, errFailed, verify(tls.ConnectionState{ServerName: "hosted.mender.io"}))
+	assert.Equal(t, errFailed, verify(tls.ConnectionState{ServerName: "Mender.io"}))
+	// no server name to tell the host by
+	assert.Equal(t, errFailed, verify(tls.ConnectionState{}))
+
+	verify = verifyServerHosts(serverHosts(Config{TLSServerName: "mender.io"}),
+		[]func(tls.ConnectionState) error{
+			func(tls.ConnectionState) error { return errFailed },
+		})
+	assert.Equal(t, errFailed, verify(tls.ConnectionState{ServerName: "mender.io"}))
+	assert.NoError(t, verify(tls.ConnectionState{ServerName: "s3.amazonaws.com"}))
+
+	// a single server, without servers to fail over to
+	verify = verifyServerHosts(serverHosts(Config{ServerURL: "https://hosted.mender.io"}),
+		[]func(tls.ConnectionState) error{
+			func(tls.ConnectionState) error { return errFailed },
+		})
+	assert.Equal(t, errFailed, verify(tls.ConnectionState{ServerName: "hosted.mender.io"}))
+	assert.NoError(t, verify(tls.ConnectionState{ServerName: "s3.amazonaws.com"}))
+
+	// no hosts are verified if the servers are not known
+	verify = verifyServerHosts(nil, []func(tls.ConnectionState) error{
+		func(tls.ConnectionState) error { return errFailed },
+	})
+	assert.NoError(t, verify(tls.ConnectionState{ServerName: "s3.amazonaws.com"}))
+	assert.NoError(t, verify(tls.ConnectionState{}))
+}
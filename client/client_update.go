@@ -15,37 +15,119 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
-const (
-	minimumImageSize int64 = 4096 //kB
-)
+// DefaultMinImageSize is the size, in bytes, below which downloaded artifacts
+// are refused unless configured otherwise.
+const DefaultMinImageSize int64 = 4096
 
 type Updater interface {
-	GetScheduledUpdate(api ApiRequester, server string, current CurrentUpdate) (interface{}, error)
-	FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error)
+	GetScheduledUpdate(ctx context.Context, api ApiRequester, server string, current CurrentUpdate) (interface{}, error)
+	FetchUpdate(ctx context.Context, api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error)
 }
 
 var (
-	ErrNotAuthorized = errors.New("client not authorized")
+	ErrNotAuthorized error = authError("client not authorized")
 )
 
+// Bounds of the next update check time hinted by the server.
+const (
+	minUpdatePollHint = time.Second
+	maxUpdatePollHint = 24 * time.Hour
+)
+
+// NoUpdateResponse is returned by GetScheduledUpdate if there is no update for
+// the device, but the server asked to check again at a given time.
+type NoUpdateResponse struct {
+	// time to wait before the next update check
+	NextPoll time.Duration
+}
+
+// parseRetryAfter parses the Retry-After header, given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var after time.Duration
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		after = time.Duration(secs) * time.Second
+	} else if when, err := http.ParseTime(value); err == nil {
+		after = when.Sub(now)
+	} else {
+		log.Warnf("ignoring invalid Retry-After header: %q", value)
+		return 0, false
+	}
+
+	if after < minUpdatePollHint {
+		after = minUpdatePollHint
+	} else if after > maxUpdatePollHint {
+		after = maxUpdatePollHint
+	}
+	return after, true
+}
+
+// UpdateResponseConfig sets how strictly the update check responses of the
+// server are checked.
+type UpdateResponseConfig struct {
+	// reject responses with fields the client does not know
+	Strict bool
+	// allow artifacts to be downloaded over plain HTTP from servers the
+	// client talks to over HTTPS
+	AllowHTTP bool
+}
+
+// updateResponseRules are the checks of update check responses beyond the
+// fields they must have.
+type updateResponseRules struct {
+	// unknown fields are rejected
+	strict bool
+	// the URI schemes artifacts may be downloaded with; not checked if
+	// empty, as for the deployments of file:// update sources
+	schemes []string
+}
+
 type UpdateClient struct {
 	minImageSize int64
+	responses    UpdateResponseConfig
+	// file keeping what is downloaded of an update, for fetches of the
+	// same URL to continue from if the download fails; none if empty
+	partialFile string
+
+	// last update check response carrying an ETag, replayed when the server
+	// answers 304 Not Modified
+	lock  sync.Mutex
+	check *cachedUpdateCheck
+}
+
+type cachedUpdateCheck struct {
+	url    string
+	etag   string
+	status int
+	header http.Header
+	body   []byte
 }
 
 func NewUpdate() *UpdateClient {
 	up := UpdateClient{
-		minImageSize: minimumImageSize,
+		minImageSize: DefaultMinImageSize,
 	}
 	return &up
 }
@@ -57,19 +139,46 @@ type CurrentUpdate struct {
 	DeviceType string
 }
 
-func (u *UpdateClient) GetScheduledUpdate(api ApiRequester, server string,
+// GetScheduledUpdate asks the server whether there is an update for the
+// device. The request is aborted once ctx is done.
+func (u *UpdateClient) GetScheduledUpdate(ctx context.Context, api ApiRequester, server string,
 	current CurrentUpdate) (interface{}, error) {
 
-	return u.getUpdateInfo(api, processUpdateResponse, server, current)
+	return u.getUpdateInfo(ctx, api, u.updateResponseProcessor(server), server, current)
 }
 
-func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessingFunc,
+// updateResponseProcessor returns the parser of the update check responses
+// of server. Artifacts are downloaded over HTTPS only, unless configured
+// otherwise, or the server is talked to over plain HTTP anyway.
+func (u *UpdateClient) updateResponseProcessor(server string) RequestProcessingFunc {
+	rules := updateResponseRules{
+		strict:  u.responses.Strict,
+		schemes: []string{"https"},
+	}
+	if u.responses.AllowHTTP || strings.HasPrefix(strings.ToLower(buildURL(server)), "http://") {
+		rules.schemes = append(rules.schemes, "http")
+	}
+	return func(response *http.Response) (interface{}, error) {
+		return processUpdateResponse(response, rules)
+	}
+}
+
+func (u *UpdateClient) getUpdateInfo(ctx context.Context, api ApiRequester, process RequestProcessingFunc,
 	server string, current CurrentUpdate) (interface{}, error) {
-	req, err := makeUpdateCheckRequest(server, current)
+	req, err := makeUpdateCheckRequest(ctx, server, current)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create update check request")
 	}
 
+	u.lock.Lock()
+	cached := u.check
+	u.lock.Unlock()
+	if cached != nil && cached.url == req.URL.String() {
+		req.Header.Set("If-None-Match", cached.etag)
+	} else {
+		cached = nil
+	}
+
 	r, err := api.Do(req)
 
 	if err != nil {
@@ -79,51 +188,179 @@ func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessing
 
 	defer r.Body.Close()
 
-	respdata, err := ioutil.ReadAll(r.Body)
+	respdata, err := readResponseBody(r.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read the request body")
 	}
 
+	if r.StatusCode == http.StatusNotModified && cached != nil {
+		log.Debug("Update check response not modified")
+		retryAfter := r.Header.Get("Retry-After")
+		r.StatusCode = cached.status
+		r.Header = cloneHeader(cached.header)
+		r.Header.Del("Retry-After")
+		if retryAfter != "" {
+			r.Header.Set("Retry-After", retryAfter)
+		}
+		respdata = cached.body
+	}
+
 	r.Body = ioutil.NopCloser(bytes.NewReader(respdata))
 	data, err := process(r)
 	if err != nil {
+		u.cacheUpdateCheck(nil)
 		r.Body = ioutil.NopCloser(bytes.NewReader(respdata))
 		return data, NewAPIError(err, r)
 	}
+
+	if etag := r.Header.Get("ETag"); etag != "" {
+		u.cacheUpdateCheck(&cachedUpdateCheck{
+			url:    req.URL.String(),
+			etag:   etag,
+			status: r.StatusCode,
+			header: cloneHeader(r.Header),
+			body:   respdata,
+		})
+	} else {
+		u.cacheUpdateCheck(nil)
+	}
 	return data, err
 }
 
+// cacheUpdateCheck replaces the cached update check response; nil drops it.
+func (u *UpdateClient) cacheUpdateCheck(check *cachedUpdateCheck) {
+	u.lock.Lock()
+	u.check = check
+	u.lock.Unlock()
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
 // FetchUpdate returns a byte stream which is a download of the given link.
-func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error) {
-	req, err := makeUpdateFetchRequest(url)
+// Cancelling ctx aborts the download, including any attempts to resume it, so
+// ctx must stay valid until the returned stream has been consumed.
+func (u *UpdateClient) FetchUpdate(ctx context.Context, api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error) {
+	req, err := makeUpdateFetchRequest(ctx, url)
 	if err != nil {
 		return nil, -1, errors.Wrapf(err, "failed to create update fetch request")
 	}
 
+	var prefix *os.File
+	var offset, size int64
+	if u.partialFile != "" {
+		prefix, offset, size = openPartialDownload(u.partialFile, url)
+	}
+	if prefix != nil {
+		log.Infof("Resuming the download of the update kept up to offset %d", offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	closePrefix := func(discard bool) {
+		if prefix != nil {
+			prefix.Close()
+			prefix = nil
+			if discard {
+				removePartialDownload(u.partialFile)
+			}
+		}
+	}
+
 	r, err := api.Do(req)
 	if err != nil {
+		closePrefix(false)
 		log.Error("Can not fetch update image: ", err)
 		return nil, -1, errors.Wrapf(err, "update fetch request failed")
 	}
 
 	log.Debugf("Received fetch update response %v+", r)
 
-	if r.StatusCode != http.StatusOK {
+	if prefix != nil && r.StatusCode == http.StatusOK {
+		log.Info("The server does not resume the download; downloading the update again")
+		closePrefix(true)
+		offset = 0
+		req.Header.Del("Range")
+	}
+	if prefix == nil && r.StatusCode != http.StatusOK ||
+		prefix != nil && r.StatusCode != http.StatusPartialContent {
+
 		r.Body.Close()
+		// starting over, unless the error is transient
+		closePrefix(r.StatusCode == http.StatusRequestedRangeNotSatisfiable)
 		log.Errorf("Error fetching shcheduled update info: code (%d)", r.StatusCode)
 		return nil, -1, NewAPIError(errors.New("error receiving scheduled update information"), r)
 	}
 
-	if r.ContentLength < 0 {
-		r.Body.Close()
-		return nil, -1, errors.New("Will not continue with unknown image size.")
-	} else if r.ContentLength < u.minImageSize {
-		r.Body.Close()
-		log.Errorf("Image smaller than expected. Expected: %d, received: %d", u.minImageSize, r.ContentLength)
-		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
+	resumer := NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req)
+	resumer.acceptRanges = r.Header.Get("Accept-Ranges") == "bytes"
+	if prefix != nil {
+		if size < 0 {
+			size = contentRangeSize(r)
+		}
+		resumer.offset = offset
+		resumer.contentLength = size
+		stream, err := resumer.getStreamFromPartialContent(r)
+		if err != nil {
+			r.Body.Close()
+			closePrefix(true)
+			return nil, -1, errors.Wrapf(err, "failed to resume the download of the update")
+		}
+		resumer.stream = stream
+	} else {
+		size = r.ContentLength
+	}
+
+	// the size is unknown with chunked transfer encoding, in which case
+	// it is checked once the download is complete
+	if size >= 0 && size < u.minImageSize {
+		resumer.Close()
+		closePrefix(true)
+		log.Errorf("Image smaller than expected. Expected at least: %d, received: %d",
+			u.minImageSize, size)
+		return nil, -1, utils.WithErrorKind(utils.ErrorKindArtifact, errors.Errorf(
+			"image size %d is smaller than the minimum of %d bytes",
+			size, u.minImageSize))
+	}
+
+	var stream io.ReadCloser = resumer
+	if size < 0 {
+		log.Info("Size of the image is unknown; downloading it until the server ends it")
+		if u.minImageSize > 0 {
+			stream = &minSizeReader{UpdateResumer: resumer, min: u.minImageSize,
+				read: offset}
+		}
 	}
+	if u.partialFile != "" {
+		stream = keepPartialDownload(&partialDownload{
+			stream:  stream,
+			resumer: resumer,
+			prefix:  prefix,
+			path:    u.partialFile,
+		}, url, offset, size)
+	}
+	return stream, size, nil
+}
 
-	return NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req), r.ContentLength, nil
+// minSizeReader fails at the end of a download of unknown size if less than
+// min bytes were read.
+type minSizeReader struct {
+	*UpdateResumer
+	min  int64
+	read int64
+}
+
+func (m *minSizeReader) Read(buf []byte) (int, error) {
+	n, err := m.UpdateResumer.Read(buf)
+	m.read += int64(n)
+	if err == io.EOF && m.read < m.min {
+		return n, utils.WithErrorKind(utils.ErrorKindArtifact, errors.Errorf(
+			"image size %d is smaller than the minimum of %d bytes", m.read, m.min))
+	}
+	return n, err
 }
 
 // have update for the client
@@ -132,11 +369,42 @@ type UpdateResponse struct {
 		Source struct {
 			URI    string
 			Expire string
+			// optional hex encoded SHA256 of the artifact, or
+			// <algorithm>:<hex>
+			Checksum string `json:"checksum,omitempty"`
+			// optional further URLs of the artifact, large artifacts
+			// may be downloaded from in parallel
+			Mirrors []string `json:"mirrors,omitempty"`
+			// optional hex encoded digests of the artifact by their
+			// algorithm, e.g. sha512; all of them are verified
+			Checksums map[string]string `json:"checksums,omitempty"`
 		}
 		CompatibleDevices []string `json:"device_types_compatible"`
 		ArtifactName      string   `json:"artifact_name"`
 	}
 	ID string
+	// cache of the gateway the artifact may be downloaded from; only ever
+	// taken from the ArtifactCacheHeader, never from the response body
+	ArtifactCache string `json:"-"`
+	// lets the server pause the deployment; updated while it is paused
+	UpdateControlMap *SignedUpdateControlMap `json:"update_control_map,omitempty"`
+	// optional hints of the server on how to download the artifact, e.g.
+	// to stage rollouts over cellular connections
+	DownloadPolicy *DownloadPolicy `json:"download_policy,omitempty"`
+}
+
+// DownloadPolicy limits the download of the artifact of a deployment, on top
+// of the limits configured on the device.
+type DownloadPolicy struct {
+	// highest average rate of the download, in bytes per second
+	MaxRate int64 `json:"max_rate,omitempty"`
+	// most ranges downloaded at a time, if downloaded in parallel
+	MaxConnections int `json:"max_connections,omitempty"`
+	// the download is started in these windows only, given as
+	// MaintenanceWindows are configured; any time if empty
+	Windows []string `json:"windows,omitempty"`
+	// further URLs of the artifact, added to its mirrors
+	Mirrors []string `json:"mirrors,omitempty"`
 }
 
 func (ur UpdateResponse) CompatibleDevices() []string {
@@ -151,7 +419,108 @@ func (ur UpdateResponse) URI() string {
 	return ur.Artifact.Source.URI
 }
 
-func validateGetUpdate(update UpdateResponse) error {
+// LinkExpired tells whether the link to the artifact has expired by now;
+// links without a valid expiry time never do.
+func (ur UpdateResponse) LinkExpired(now time.Time) bool {
+	if ur.Artifact.Source.Expire == "" {
+		return false
+	}
+	expire, err := time.Parse(time.RFC3339, ur.Artifact.Source.Expire)
+	return err == nil && !now.Before(expire)
+}
+
+// Mirrors returns the further URIs the artifact may be downloaded from in
+// parallel to its URI.
+func (ur UpdateResponse) Mirrors() []string {
+	if ur.DownloadPolicy == nil || len(ur.DownloadPolicy.Mirrors) == 0 {
+		return ur.Artifact.Source.Mirrors
+	}
+	mirrors := append([]string{}, ur.Artifact.Source.Mirrors...)
+	for _, m := range ur.DownloadPolicy.Mirrors {
+		known := m == ur.URI()
+		for _, k := range mirrors {
+			known = known || m == k
+		}
+		if !known {
+			mirrors = append(mirrors, m)
+		}
+	}
+	return mirrors
+}
+
+// DownloadURIs returns the URIs to download the artifact from, in order; the
+// cache advertised by the gateway comes first.
+func (ur UpdateResponse) DownloadURIs() []string {
+	if ur.ArtifactCache != "" {
+		cached, err := cacheURI(ur.ArtifactCache, ur.URI())
+		if err == nil {
+			return []string{cached, ur.URI()}
+		}
+		log.Warn(err)
+	}
+	return []string{ur.URI()}
+}
+
+func (ur UpdateResponse) Checksum() string {
+	return ur.Artifact.Source.Checksum
+}
+
+// Checksums returns all the checksums of the artifact as <algorithm>:<hex>,
+// or plain hex SHA256 as given in Checksum, sorted by algorithm.
+func (ur UpdateResponse) Checksums() []string {
+	var checksums []string
+	if ur.Artifact.Source.Checksum != "" {
+		checksums = append(checksums, ur.Artifact.Source.Checksum)
+	}
+	algorithms := make([]string, 0, len(ur.Artifact.Source.Checksums))
+	for algorithm := range ur.Artifact.Source.Checksums {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		checksums = append(checksums,
+			algorithm+":"+ur.Artifact.Source.Checksums[algorithm])
+	}
+	return checksums
+}
+
+// decodeUpdateResponse decodes an update check response, which must be a
+// single JSON object; strictly, fields the client does not know are
+// rejected.
+func decodeUpdateResponse(data []byte, strict bool) (UpdateResponse, error) {
+	var update UpdateResponse
+	if err := json.Unmarshal(data, &update); err != nil {
+		return update, NewDecodeError(err, data)
+	}
+	if strict {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(new(UpdateResponse)); err != nil {
+			return update, errors.Wrapf(err, "unexpected update response")
+		}
+	}
+	return update, nil
+}
+
+// validateArtifactURI checks that uri is an absolute URL of one of schemes.
+func validateArtifactURI(uri string, schemes []string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errors.Wrapf(err, "invalid artifact URI")
+	}
+	if u.Host == "" {
+		return errors.Errorf("artifact URI %q is not absolute", uri)
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return errors.Errorf("artifact URI scheme %q not allowed; expected one of %v",
+		u.Scheme, schemes)
+}
+
+func validateGetUpdate(update UpdateResponse, rules updateResponseRules) error {
 	// check if we have JSON data correctly decoded
 	if update.ID == "" ||
 		len(update.Artifact.CompatibleDevices) == 0 ||
@@ -159,6 +528,38 @@ func validateGetUpdate(update UpdateResponse) error {
 		update.Artifact.Source.URI == "" {
 		return errors.New("Missing parameters in encoded JSON update response")
 	}
+	for _, dt := range update.Artifact.CompatibleDevices {
+		if dt == "" {
+			return errors.New("empty compatible device type in update response")
+		}
+	}
+
+	if len(rules.schemes) > 0 {
+		uris := append([]string{update.Artifact.Source.URI}, update.Mirrors()...)
+		for _, uri := range uris {
+			if err := validateArtifactURI(uri, rules.schemes); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c := update.Artifact.Source.Checksum; c != "" {
+		if err := utils.ValidateChecksum(c); err != nil {
+			return err
+		}
+	}
+	for algorithm, digest := range update.Artifact.Source.Checksums {
+		if strings.Contains(algorithm, ":") {
+			return errors.Errorf("invalid checksum algorithm '%s'", algorithm)
+		}
+		if err := utils.ValidateChecksum(algorithm + ":" + digest); err != nil {
+			return err
+		}
+	}
+	if p := update.DownloadPolicy; p != nil && (p.MaxRate < 0 || p.MaxConnections < 0) {
+		return errors.Errorf("invalid download policy: max_rate %d, max_connections %d",
+			p.MaxRate, p.MaxConnections)
+	}
 
 	log.Infof("Correct request for getting image from: %s [name: %v; devices: %v]",
 		update.Artifact.Source.URI,
@@ -167,7 +568,7 @@ func validateGetUpdate(update UpdateResponse) error {
 	return nil
 }
 
-func processUpdateResponse(response *http.Response) (interface{}, error) {
+func processUpdateResponse(response *http.Response, rules updateResponseRules) (interface{}, error) {
 	log.Debug("Received response:", response.Status)
 
 	respBody, err := ioutil.ReadAll(response.Body)
@@ -179,19 +580,24 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 	case http.StatusOK:
 		log.Debug("Have update available")
 
-		var data UpdateResponse
-		if err := json.Unmarshal(respBody, &data); err != nil {
+		data, err := decodeUpdateResponse(respBody, rules.strict)
+		if err != nil {
 			return nil, errors.Wrapf(err, "failed to parse response")
 		}
 
-		if err := validateGetUpdate(data); err != nil {
+		if err := validateGetUpdate(data, rules); err != nil {
 			return nil, err
 		}
+		data.ArtifactCache = response.Header.Get(ArtifactCacheHeader)
 
 		return data, nil
 
 	case http.StatusNoContent:
 		log.Debug("No update available")
+		if after, ok := parseRetryAfter(response.Header.Get("Retry-After"),
+			time.Now()); ok {
+			return NoUpdateResponse{NextPoll: after}, nil
+		}
 		return nil, nil
 
 	case http.StatusUnauthorized:
@@ -204,7 +610,7 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 	}
 }
 
-func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request, error) {
+func makeUpdateCheckRequest(ctx context.Context, server string, current CurrentUpdate) (*http.Request, error) {
 	vals := url.Values{}
 	if current.DeviceType != "" {
 		vals.Add("device_type", current.DeviceType)
@@ -222,13 +628,13 @@ func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request
 	if err != nil {
 		return nil, err
 	}
-	return req, nil
+	return req.WithContext(ctx), nil
 }
 
-func makeUpdateFetchRequest(url string) (*http.Request, error) {
+func makeUpdateFetchRequest(ctx context.Context, url string) (*http.Request, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	return req, nil
+	return req.WithContext(downloadContext(ctx)), nil
 }
@@ -14,16 +14,20 @@
 package client
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const correctUpdateResponse = `{
@@ -152,7 +156,7 @@ func TestParseUpdateResponse(t *testing.T) {
 			Body:       &testReadCloser{strings.NewReader(string(tt.responseBody))},
 		}
 
-		_, err := processUpdateResponse(response)
+		_, err := processUpdateResponse(response, httpsOnly)
 		if tt.shoulReturnError {
 			assert.Error(t, err)
 		} else if !tt.shoulReturnError {
@@ -164,6 +168,41 @@ func TestParseUpdateResponse(t *testing.T) {
 	}
 }
 
+func TestParseUpdateResponseRetryAfter(t *testing.T) {
+	response := &http.Response{
+		StatusCode: http.StatusNoContent,
+		Header:     http.Header{"Retry-After": []string{"120"}},
+		Body:       &testReadCloser{strings.NewReader("")},
+	}
+	data, err := processUpdateResponse(response, httpsOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, NoUpdateResponse{NextPoll: 2 * time.Minute}, data)
+
+	// no hint
+	response.Header = http.Header{}
+	data, err = processUpdateResponse(response, httpsOnly)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	now := time.Now()
+	for _, tc := range []struct {
+		value string
+		after time.Duration
+		ok    bool
+	}{
+		{"0", time.Second, true},
+		{"600", 10 * time.Minute, true},
+		{"100000000", 24 * time.Hour, true},
+		{now.Add(time.Hour).UTC().Format(http.TimeFormat), time.Hour, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	} {
+		after, ok := parseRetryAfter(tc.value, now)
+		assert.Equal(t, tc.ok, ok, tc.value)
+		assert.InDelta(t, float64(tc.after), float64(after), float64(time.Second), tc.value)
+	}
+}
+
 func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	// Test server that always responds with 200 code, and specific payload
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -175,7 +214,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -185,7 +224,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, errors.New("") }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.Error(t, err)
 }
 
@@ -200,7 +239,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -209,7 +248,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	assert.NotNil(t, client)
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, nil }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 }
 
@@ -224,7 +263,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -232,7 +271,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	data, err := client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{})
+	data, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 	update, ok := data.(UpdateResponse)
 	assert.True(t, ok)
@@ -250,7 +289,7 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -258,7 +297,7 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL, 1*time.Minute)
 	assert.Error(t, err)
 }
 
@@ -273,7 +312,7 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -281,7 +320,7 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, "broken-request", 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, "broken-request", 1*time.Minute)
 	assert.Error(t, err)
 }
 
@@ -296,7 +335,7 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true, NoVerify: false},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -305,24 +344,24 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	assert.NotNil(t, client)
 	client.minImageSize = 1
 
-	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL, 1*time.Minute)
 	assert.NoError(t, err)
 }
 
 func Test_UpdateApiClientError(t *testing.T) {
 	client := NewUpdate()
 
-	_, err := client.GetScheduledUpdate(NewMockApiClient(nil, errors.New("foo")),
+	_, err := client.GetScheduledUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		"http://foo.bar", CurrentUpdate{})
 	assert.Error(t, err)
 
-	_, _, err = client.FetchUpdate(NewMockApiClient(nil, errors.New("foo")),
+	_, _, err = client.FetchUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		"http://foo.bar", 1*time.Minute)
 	assert.Error(t, err)
 }
 
 func TestMakeUpdateCheckRequest(t *testing.T) {
-	req, err := makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{})
+	req, err := makeUpdateCheckRequest(context.Background(), "http://foo.bar", CurrentUpdate{})
 	assert.NotNil(t, req)
 	assert.NoError(t, err)
 
@@ -330,7 +369,7 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 
-	req, err = makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{
+	req, err = makeUpdateCheckRequest(context.Background(), "http://foo.bar", CurrentUpdate{
 		Artifact: "foo",
 	})
 	assert.NotNil(t, req)
@@ -340,7 +379,7 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 
-	req, err = makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{
+	req, err = makeUpdateCheckRequest(context.Background(), "http://foo.bar", CurrentUpdate{
 		Artifact:   "foo",
 		DeviceType: "hammer",
 	})
@@ -351,3 +390,404 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 }
+
+func TestParseUpdateResponseDecodeError(t *testing.T) {
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       &testReadCloser{strings.NewReader(malformedUpdateResponse)},
+	}
+	_, err := processUpdateResponse(response, httpsOnly)
+	assert.Error(t, err)
+	_, ok := errors.Cause(err).(*json.SyntaxError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "offset:")
+	assert.Contains(t, err.Error(), "device_types_com")
+
+	// type errors carry the offending field
+	response = &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       &testReadCloser{strings.NewReader(`{"id": 123}`)},
+	}
+	_, err = processUpdateResponse(response, httpsOnly)
+	assert.Error(t, err)
+	_, ok = errors.Cause(err).(*json.UnmarshalTypeError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "UpdateResponse.id")
+	assert.Contains(t, err.Error(), "123")
+}
+
+// Rules of update check responses of servers talked to over HTTPS.
+var httpsOnly = updateResponseRules{schemes: []string{"https"}}
+
+func updateResponseWith(uri string, extra string) string {
+	return fmt.Sprintf(`{
+	"id": "deployment-123",%s
+	"artifact": {
+		"source": {
+			"uri": %q
+		},
+		"device_types_compatible": ["BBB"],
+		"artifact_name": "myapp-release-z-build-123"
+	}
+}`, extra, uri)
+}
+
+func TestProcessUpdateResponseStrict(t *testing.T) {
+	response := func(body string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       &testReadCloser{strings.NewReader(body)},
+		}
+	}
+	unknown := updateResponseWith("https://menderupdate.com", `
+	"bad_field": "13876-123132-321123",`)
+
+	// unknown fields are ignored unless strict
+	_, err := processUpdateResponse(response(unknown), httpsOnly)
+	assert.NoError(t, err)
+
+	strict := updateResponseRules{strict: true, schemes: httpsOnly.schemes}
+	_, err = processUpdateResponse(response(unknown), strict)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad_field")
+
+	data, err := processUpdateResponse(response(correctUpdateResponse), strict)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://menderupdate.com", data.(UpdateResponse).URI())
+}
+
+func TestValidateGetUpdateURIs(t *testing.T) {
+	decode := func(body string) UpdateResponse {
+		update, err := decodeUpdateResponse([]byte(body), false)
+		require.NoError(t, err)
+		return update
+	}
+
+	assert.NoError(t, validateGetUpdate(decode(updateResponseWith(
+		"https://menderupdate.com/artifact", "")), httpsOnly))
+	for _, uri := range []string{
+		"http://menderupdate.com/artifact",
+		"file:///etc/shadow",
+		"/artifact",
+		"menderupdate.com/artifact",
+		"https://",
+		"https://menderupdate.com/%zz",
+	} {
+		assert.Error(t, validateGetUpdate(decode(updateResponseWith(uri, "")),
+			httpsOnly), uri)
+	}
+
+	// plain HTTP, where allowed
+	withHTTP := updateResponseRules{schemes: []string{"https", "http"}}
+	assert.NoError(t, validateGetUpdate(decode(updateResponseWith(
+		"http://menderupdate.com/artifact", "")), withHTTP))
+
+	// mirrors are checked too
+	update := decode(updateResponseWith("https://menderupdate.com/artifact", ""))
+	update.Artifact.Source.Mirrors = []string{"http://mirror.com/artifact"}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+	assert.NoError(t, validateGetUpdate(update, withHTTP))
+	update.Artifact.Source.Mirrors = nil
+	update.DownloadPolicy = &DownloadPolicy{Mirrors: []string{"http://mirror.com/artifact"}}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+	update.DownloadPolicy = &DownloadPolicy{MaxRate: -1}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+
+	// no rules of the schemes, as of local update files
+	update = decode(updateResponseWith("/var/lib/mender/artifact.mender", ""))
+	assert.NoError(t, validateGetUpdate(update, updateResponseRules{}))
+
+	update = decode(updateResponseWith("https://menderupdate.com/artifact", ""))
+	update.Artifact.CompatibleDevices = []string{"BBB", ""}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+}
+
+func TestValidateGetUpdateChecksums(t *testing.T) {
+	update, err := decodeUpdateResponse([]byte(updateResponseWith(
+		"https://menderupdate.com/artifact", "")), false)
+	require.NoError(t, err)
+	digest := strings.Repeat("ab", 32)
+
+	for c, valid := range map[string]bool{
+		digest:                    true,
+		"sha256:" + digest:        true,
+		"sha256:" + digest[:62]:   false,
+		"sha256:" + digest + "zz": false,
+		"zz":                      false,
+		"sha256:":                 false,
+		"SHA 256:" + digest:       false,
+		"blake3:" + digest:        true,
+	} {
+		update.Artifact.Source.Checksum = c
+		if valid {
+			assert.NoError(t, validateGetUpdate(update, httpsOnly), c)
+		} else {
+			assert.Error(t, validateGetUpdate(update, httpsOnly), c)
+		}
+	}
+	update.Artifact.Source.Checksum = ""
+
+	update.Artifact.Source.Checksums = map[string]string{"sha256": digest}
+	assert.NoError(t, validateGetUpdate(update, httpsOnly))
+	update.Artifact.Source.Checksums = map[string]string{"sha256": "xyz"}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+	update.Artifact.Source.Checksums = map[string]string{"sha256:sha256": digest}
+	assert.Error(t, validateGetUpdate(update, httpsOnly))
+}
+
+func TestUpdateResponseProcessor(t *testing.T) {
+	body := updateResponseWith("http://menderupdate.com/artifact", "")
+	response := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       &testReadCloser{strings.NewReader(body)},
+		}
+	}
+
+	client := NewUpdate()
+	_, err := client.updateResponseProcessor("https://mender.io")(response())
+	assert.Error(t, err)
+	// servers talked to over plain HTTP may send plain HTTP URIs
+	_, err = client.updateResponseProcessor("http://mender.io")(response())
+	assert.NoError(t, err)
+
+	client.responses.AllowHTTP = true
+	_, err = client.updateResponseProcessor("https://mender.io")(response())
+	assert.NoError(t, err)
+}
+
+func FuzzProcessUpdateResponse(f *testing.F) {
+	for _, body := range []string{
+		correctUpdateResponse,
+		correctUpdateResponseMultipleDevices,
+		updateResponseEmptyDevices,
+		malformedUpdateResponse,
+		missingDevicesUpdateResponse,
+		missingNameUpdateResponse,
+		updateResponseWith("http://menderupdate.com", `
+	"bad_field": 1,`),
+		`{"id": 123}`,
+		`null`,
+		"",
+	} {
+		f.Add([]byte(body), false)
+		f.Add([]byte(body), true)
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte, strict bool) {
+		rules := updateResponseRules{strict: strict, schemes: httpsOnly.schemes}
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(string(body))),
+		}
+		data, err := processUpdateResponse(response, rules)
+		if err != nil {
+			return
+		}
+		// whatever is accepted is a valid update
+		update, ok := data.(UpdateResponse)
+		require.True(t, ok)
+		assert.NoError(t, validateGetUpdate(update, rules))
+	})
+}
+
+func TestNewDecodeError(t *testing.T) {
+	body := []byte(malformedUpdateResponse)
+	var data UpdateResponse
+	jerr := json.Unmarshal(body, &data)
+	assert.Error(t, jerr)
+
+	derr := NewDecodeError(jerr, body)
+	assert.Equal(t, jerr, derr.Cause())
+	assert.True(t, derr.Offset > 0)
+	assert.Contains(t, derr.Snippet, "device_types_com")
+	assert.True(t, len(derr.Snippet) <= 2*decodeErrorContext)
+
+	// errors without location information are passed through
+	derr = NewDecodeError(errors.New("foo"), body)
+	assert.Equal(t, int64(-1), derr.Offset)
+	assert.Equal(t, "", derr.Snippet)
+	assert.Equal(t, "foo", derr.Error())
+}
+
+func TestBodySnippet(t *testing.T) {
+	body := []byte(strings.Repeat("a", 100) + "X" + strings.Repeat("b", 100))
+	s := bodySnippet(body, 100)
+	assert.Len(t, s, 2*decodeErrorContext)
+	assert.Contains(t, s, "X")
+
+	assert.Equal(t, "abc", bodySnippet([]byte("abc"), 1))
+	assert.Equal(t, "", bodySnippet([]byte("abc"), 100))
+}
+
+func TestUpdateRequestsCancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.GetScheduledUpdate(ctx, ac, ts.URL, CurrentUpdate{})
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, _, err = client.FetchUpdate(ctx, ac, ts.URL, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestUpdateCheckETag(t *testing.T) {
+	etag := `"v1"`
+	update := true
+	var matches []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matches = append(matches, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if !update {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, correctUpdateResponse)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	for i := 0; i < 2; i++ {
+		data, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://menderupdate.com", data.(UpdateResponse).URI())
+	}
+	assert.Equal(t, []string{"", etag}, matches)
+
+	// the cached response is only sent for the same request
+	_, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL,
+		CurrentUpdate{Artifact: "release-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", matches[2])
+
+	// the Retry-After of the not modified response applies
+	etag = `"v2"`
+	update = false
+	data, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Equal(t, NoUpdateResponse{NextPoll: 2 * time.Minute}, data)
+}
+
+func TestFetchUpdateMinImageSize(t *testing.T) {
+	content := strings.Repeat("x", 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// no Content-Length once flushed
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	client := NewUpdate()
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL, time.Minute)
+	assert.EqualError(t, err, "image size 100 is smaller than the minimum of 4096 bytes")
+
+	// the size is checked once downloaded if unknown
+	r, size, err := client.FetchUpdate(context.Background(), ac, ts.URL+"/chunked", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), size)
+	_, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, "image size 100 is smaller than the minimum of 4096 bytes")
+	r.Close()
+
+	client.minImageSize = 100
+	r, size, err = client.FetchUpdate(context.Background(), ac, ts.URL+"/chunked", time.Minute)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+	r.Close()
+
+	// any size is accepted
+	client.minImageSize = 0
+	r, size, err = client.FetchUpdate(context.Background(), ac, ts.URL, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), size)
+	r.Close()
+}
+
+func TestUpdateResponseChecksums(t *testing.T) {
+	var update UpdateResponse
+	assert.Empty(t, update.Checksums())
+
+	err := json.Unmarshal([]byte(`{"artifact": {"source": {
+		"uri": "https://menderupdate.com",
+		"checksum": "abcd",
+		"checksums": {"sha512": "ef01", "blake2b": "2345"}}}}`), &update)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abcd", "blake2b:2345", "sha512:ef01"}, update.Checksums())
+}
+
+func TestUpdateResponseLinkExpired(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var update UpdateResponse
+	assert.False(t, update.LinkExpired(now))
+
+	update.Artifact.Source.Expire = "2020-01-02T04:00:00Z"
+	assert.False(t, update.LinkExpired(now))
+	assert.True(t, update.LinkExpired(now.Add(time.Hour)))
+
+	update.Artifact.Source.Expire = "tomorrow"
+	assert.False(t, update.LinkExpired(now))
+}
+
+func TestUpdateResponseDownloadPolicy(t *testing.T) {
+	var update UpdateResponse
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "deployment-1",
+		"artifact": {
+			"artifact_name": "release-1",
+			"device_types_compatible": ["BBB"],
+			"source": {
+				"uri": "https://origin/artifact",
+				"mirrors": ["https://mirror-1/artifact"]
+			}
+		},
+		"download_policy": {
+			"max_rate": 65536,
+			"max_connections": 2,
+			"windows": ["Mon-Fri 01:00-05:00"],
+			"mirrors": ["https://mirror-1/artifact", "https://mirror-2/artifact",
+				"https://origin/artifact"]
+		}
+	}`), &update))
+	assert.Equal(t, &DownloadPolicy{
+		MaxRate:        65536,
+		MaxConnections: 2,
+		Windows:        []string{"Mon-Fri 01:00-05:00"},
+		Mirrors: []string{"https://mirror-1/artifact", "https://mirror-2/artifact",
+			"https://origin/artifact"},
+	}, update.DownloadPolicy)
+	assert.Equal(t, []string{"https://mirror-1/artifact", "https://mirror-2/artifact"},
+		update.Mirrors())
+	assert.NoError(t, validateGetUpdate(update,
+		updateResponseRules{schemes: []string{"https"}}))
+}
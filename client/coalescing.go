@@ -0,0 +1,196 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// Coalescing configures how status reports and inventory updates are kept
+// from flooding the server, e.g. on rapid state transitions.
+type Coalescing struct {
+	// skip status reports the same as the last one sent of the deployment,
+	// unless the server may abort the deployment in answer to them
+	SkipUnchangedStatus bool
+	// minimum time between status reports; reports of intermediate
+	// statuses due sooner are skipped, the others are delayed; no limit if
+	// zero
+	StatusMinInterval time.Duration
+	// submit only the inventory attributes changed since the last
+	// inventory update, skipping updates without changes
+	InventoryChangesOnly bool
+	// minimum time between inventory updates; updates due sooner are
+	// skipped, their changes are sent with the next one; no limit if zero
+	InventoryMinInterval time.Duration
+}
+
+// abortableStatus tells whether the server answering the report of a status
+// aborts the deployment, as the client checks for these reports; they are
+// therefore never skipped.
+func abortableStatus(status string) bool {
+	switch status {
+	case StatusDownloading, StatusInstalling, StatusRebooting:
+		return true
+	}
+	return false
+}
+
+// intermediateStatus tells whether a report is superseded by the ones
+// following it anyway, so that it may be skipped; reports of the progress of
+// a status, in its substate, are.
+func intermediateStatus(report StatusReport) bool {
+	switch report.Status {
+	case StatusDeferred, StatusPausedByShutdown:
+		return true
+	}
+	return report.SubState != ""
+}
+
+type coalescingStatus struct {
+	reporter StatusReporter
+	conf     Coalescing
+	now      func() time.Time
+	sleep    func(time.Duration)
+
+	mutex    sync.Mutex
+	last     StatusReport
+	lastSent time.Time
+}
+
+// NewCoalescingStatus returns a reporter sending the reports through
+// reporter as configured by conf.
+func NewCoalescingStatus(reporter StatusReporter, conf Coalescing) StatusReporter {
+	return &coalescingStatus{
+		reporter: reporter,
+		conf:     conf,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+func (c *coalescingStatus) Report(api ApiRequester, url string, report StatusReport) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conf.SkipUnchangedStatus && report == c.last && !abortableStatus(report.Status) {
+		log.Debugf("status %s of deployment %s already reported; skipping",
+			report.Status, report.DeploymentID)
+		return nil
+	}
+	if c.conf.StatusMinInterval > 0 && !c.lastSent.IsZero() {
+		if wait := c.lastSent.Add(c.conf.StatusMinInterval).Sub(c.now()); wait > 0 {
+			if intermediateStatus(report) {
+				log.Debugf("status %s of deployment %s reported too soon "+
+					"after the last one; skipping", report.Status, report.DeploymentID)
+				return nil
+			}
+			c.sleep(wait)
+		}
+	}
+
+	if err := c.reporter.Report(api, url, report); err != nil {
+		return err
+	}
+	c.last = report
+	c.lastSent = c.now()
+	return nil
+}
+
+type coalescingInventory struct {
+	submitter InventorySubmitter
+	conf      Coalescing
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	sent     map[string]interface{}
+	lastSent time.Time
+}
+
+// NewCoalescingInventory returns a submitter sending the inventory updates
+// through submitter as configured by conf.
+func NewCoalescingInventory(submitter InventorySubmitter, conf Coalescing) InventorySubmitter {
+	return &coalescingInventory{
+		submitter: submitter,
+		conf:      conf,
+		now:       time.Now,
+	}
+}
+
+func (c *coalescingInventory) Submit(api ApiRequester, url string, data interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conf.InventoryMinInterval > 0 && !c.lastSent.IsZero() &&
+		c.now().Before(c.lastSent.Add(c.conf.InventoryMinInterval)) {
+		log.Debugf("inventory update too soon after the last one; skipping")
+		return nil
+	}
+
+	attrs, ok := data.(InventoryData)
+	if !ok || !c.conf.InventoryChangesOnly {
+		if err := c.submitter.Submit(api, url, data); err != nil {
+			return err
+		}
+		c.lastSent = c.now()
+		if ok {
+			c.remember(attrs)
+		}
+		return nil
+	}
+
+	changed := make(InventoryData, 0, len(attrs))
+	for _, a := range attrs {
+		if v, ok := c.sent[a.Name]; !ok || !reflect.DeepEqual(v, a.Value) {
+			changed = append(changed, a)
+		}
+	}
+	if len(changed) == 0 {
+		log.Debugf("inventory unchanged; skipping inventory update")
+		return nil
+	}
+	if err := c.submitter.Submit(api, url, changed); err != nil {
+		return err
+	}
+	c.lastSent = c.now()
+	c.remember(changed)
+	return nil
+}
+
+// InventoryResetter is implemented by submitters remembering what the server
+// has got of the inventory.
+type InventoryResetter interface {
+	// ResetInventory forgets what the server has got, so that the whole
+	// inventory is sent with the next update.
+	ResetInventory()
+}
+
+func (c *coalescingInventory) ResetInventory() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = nil
+}
+
+// remember records the values of the attributes the server has got.
+func (c *coalescingInventory) remember(attrs InventoryData) {
+	if c.sent == nil {
+		c.sent = make(map[string]interface{}, len(attrs))
+	}
+	for _, a := range attrs {
+		c.sent[a.Name] = a.Value
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingReporter struct {
+	reports []StatusReport
+	err     error
+}
+
+func (r *recordingReporter) Report(api ApiRequester, url string, report StatusReport) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.reports = append(r.reports, report)
+	return nil
+}
+
+type recordingSubmitter struct {
+	submitted []interface{}
+	err       error
+}
+
+func (r *recordingSubmitter) Submit(api ApiRequester, url string, data interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.submitted = append(r.submitted, data)
+	return nil
+}
+
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept += d
+	c.now = c.now.Add(d)
+}
+
+func TestCoalescingStatus(t *testing.T) {
+	report := func(status string) StatusReport {
+		return StatusReport{DeploymentID: "foo", Status: status}
+	}
+
+	// passed through as is by default
+	rec := &recordingReporter{}
+	s := NewCoalescingStatus(rec, Coalescing{})
+	assert.NoError(t, s.Report(nil, "", report(StatusDownloading)))
+	assert.NoError(t, s.Report(nil, "", report(StatusDownloading)))
+	assert.Len(t, rec.reports, 2)
+
+	rec = &recordingReporter{}
+	s = NewCoalescingStatus(rec, Coalescing{SkipUnchangedStatus: true})
+	assert.NoError(t, s.Report(nil, "", report(StatusDeferred)))
+	assert.NoError(t, s.Report(nil, "", report(StatusDeferred)))
+	assert.NoError(t, s.Report(nil, "",
+		StatusReport{DeploymentID: "bar", Status: StatusDeferred}))
+	assert.NoError(t, s.Report(nil, "", report(StatusDeferred)))
+	assert.Len(t, rec.reports, 3)
+	// the server may abort the deployment in answer to these
+	assert.NoError(t, s.Report(nil, "", report(StatusDownloading)))
+	assert.NoError(t, s.Report(nil, "", report(StatusDownloading)))
+	assert.Len(t, rec.reports, 5)
+
+	// failed reports are not remembered
+	rec.err = errors.New("no connection")
+	assert.Error(t, s.Report(nil, "", report(StatusSuccess)))
+	rec.err = nil
+	assert.NoError(t, s.Report(nil, "", report(StatusSuccess)))
+	assert.Len(t, rec.reports, 6)
+
+	rec = &recordingReporter{}
+	clock := &fakeClock{now: time.Now()}
+	s = NewCoalescingStatus(rec, Coalescing{StatusMinInterval: 10 * time.Second})
+	s.(*coalescingStatus).now = clock.Now
+	s.(*coalescingStatus).sleep = clock.Sleep
+	assert.NoError(t, s.Report(nil, "", report(StatusDownloading)))
+	clock.now = clock.now.Add(3 * time.Second)
+	// skipped, superseded by the final status
+	assert.NoError(t, s.Report(nil, "", report(StatusDeferred)))
+	assert.Equal(t, time.Duration(0), clock.slept)
+	// waits for the rest of the interval
+	assert.NoError(t, s.Report(nil, "", report(StatusSuccess)))
+	assert.Equal(t, 7*time.Second, clock.slept)
+	assert.Equal(t, []StatusReport{report(StatusDownloading), report(StatusSuccess)},
+		rec.reports)
+
+	// the server may abort the deployment in answer to these, they are
+	// delayed rather than skipped
+	clock.now = clock.now.Add(3 * time.Second)
+	assert.NoError(t, s.Report(nil, "", report(StatusInstalling)))
+	assert.Equal(t, 14*time.Second, clock.slept)
+	clock.now = clock.now.Add(10 * time.Second)
+	assert.NoError(t, s.Report(nil, "", report(StatusRebooting)))
+	assert.Len(t, rec.reports, 4)
+
+	// progress reports are skipped rather than delaying the download
+	slept := clock.slept
+	clock.now = clock.now.Add(3 * time.Second)
+	assert.NoError(t, s.Report(nil, "", StatusReport{DeploymentID: "foo",
+		Status: StatusDownloading, SubState: "downloaded 10 bytes"}))
+	assert.Equal(t, slept, clock.slept)
+	assert.Len(t, rec.reports, 4)
+}
+
+func TestCoalescingInventory(t *testing.T) {
+	attrs := func(values ...string) InventoryData {
+		data := InventoryData{}
+		for i := 0; i < len(values); i += 2 {
+			data = append(data, InventoryAttribute{Name: values[i], Value: values[i+1]})
+		}
+		return data
+	}
+
+	// passed through as is by default
+	rec := &recordingSubmitter{}
+	i := NewCoalescingInventory(rec, Coalescing{})
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo")))
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo")))
+	assert.Len(t, rec.submitted, 2)
+
+	rec = &recordingSubmitter{}
+	i = NewCoalescingInventory(rec, Coalescing{InventoryChangesOnly: true})
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.1")))
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.1")))
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.2")))
+	assert.Equal(t, []interface{}{
+		attrs("device_type", "foo", "ip", "10.0.0.1"),
+		attrs("ip", "10.0.0.2"),
+	}, rec.submitted)
+
+	// changes failing to be submitted are sent with the next update
+	rec.err = errors.New("no connection")
+	assert.Error(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.3")))
+	rec.err = nil
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.3")))
+	assert.Equal(t, attrs("ip", "10.0.0.3"), rec.submitted[2])
+
+	// the whole inventory is sent once reset, e.g. after authorizing again
+	i.(InventoryResetter).ResetInventory()
+	assert.NoError(t, i.Submit(nil, "", attrs("device_type", "foo", "ip", "10.0.0.3")))
+	assert.Equal(t, attrs("device_type", "foo", "ip", "10.0.0.3"), rec.submitted[3])
+
+	rec = &recordingSubmitter{}
+	clock := &fakeClock{now: time.Now()}
+	i = NewCoalescingInventory(rec, Coalescing{InventoryChangesOnly: true,
+		InventoryMinInterval: time.Minute})
+	i.(*coalescingInventory).now = clock.Now
+	assert.NoError(t, i.Submit(nil, "", attrs("ip", "10.0.0.1")))
+	clock.now = clock.now.Add(10 * time.Second)
+	assert.NoError(t, i.Submit(nil, "", attrs("ip", "10.0.0.2")))
+	assert.NoError(t, i.Submit(nil, "", attrs("ip", "10.0.0.3", "foo", "bar")))
+	assert.Len(t, rec.submitted, 1)
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(t, i.Submit(nil, "", attrs("ip", "10.0.0.3", "foo", "bar")))
+	assert.Equal(t, attrs("ip", "10.0.0.3", "foo", "bar"), rec.submitted[1])
+}
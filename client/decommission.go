@@ -0,0 +1,46 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Decommission asks the server to decommission the device, removing its
+// authentication sets and inventory, so that it has to be accepted again,
+// possibly by another tenant, once it authorizes with a new key.
+func Decommission(api ApiRequester, server string) error {
+	req, err := http.NewRequest(http.MethodPost,
+		buildApiURL(server, "/authentication/decommission"), nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create decommission request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "decommission request failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return NewAPIError(ErrNotAuthorized, r)
+	}
+	return NewAPIError(errors.Errorf("decommissioning failed, bad status %v",
+		r.StatusCode), r)
+}
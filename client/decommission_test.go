@@ -0,0 +1,50 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecommission(t *testing.T) {
+	status := http.StatusNoContent
+	var method, path string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{IsHttps: true, NoVerify: true},
+	)
+	require.NoError(t, err)
+
+	assert.NoError(t, Decommission(ac, ts.URL))
+	assert.Equal(t, http.MethodPost, method)
+	assert.Equal(t, apiPrefix+"authentication/decommission", path)
+
+	status = http.StatusUnauthorized
+	err = Decommission(ac, ts.URL)
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+
+	status = http.StatusInternalServerError
+	assert.Error(t, Decommission(ac, ts.URL))
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time the connection attempt over IPv6 is given before one over IPv4 is
+// started in parallel, for hosts having addresses of both.
+var happyEyeballsDelay = 300 * time.Millisecond
+
+// ValidateIPVersion checks the IP version connections are restricted to: 4
+// or 6, or zero for either.
+func ValidateIPVersion(version int) error {
+	switch version {
+	case 0, 4, 6:
+		return nil
+	}
+	return errors.Errorf("unsupported IP version: %d", version)
+}
+
+// Port DNS servers are queried on, unless the address of the DNS server
+// has one.
+const defaultDNSPort = "53"
+
+// ValidateHosts checks the IP addresses hostnames are pinned to, and the
+// address of the DNS server, "192.0.2.53" or "[2001:db8::53]:5353".
+func ValidateHosts(hosts map[string][]string, resolver string) error {
+	for host, addrs := range hosts {
+		if len(addrs) == 0 {
+			return errors.Errorf("no addresses of pinned host %q", host)
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return errors.Errorf("invalid address %q of pinned host %q", addr, host)
+			}
+		}
+	}
+	if resolver != "" {
+		if _, err := resolverAddress(resolver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolverAddress(resolver string) (string, error) {
+	if net.ParseIP(resolver) != nil {
+		return net.JoinHostPort(resolver, defaultDNSPort), nil
+	}
+	host, _, err := net.SplitHostPort(resolver)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", errors.Errorf("invalid DNS server address: %q", resolver)
+	}
+	return resolver, nil
+}
+
+// NewServerDialer returns the dialer of connections to servers the API client
+// uses, as set up by newDialer, for connections made alongside the client.
+func NewServerDialer(timeout time.Duration, conf Config) (
+	func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+
+	return newDialer(timeout, conf)
+}
+
+// newDialer returns the dialer of connections to servers. Hosts with both
+// IPv6 and IPv4 addresses are connected to over IPv6 first, falling back to
+// IPv4 if that does not succeed within happyEyeballsDelay (Happy Eyeballs,
+// RFC 6555), unless the connections are restricted to conf.IPVersion. IPv6
+// only networks work with either, as hosts without IPv4 addresses are
+// connected to over IPv6 right away.
+//
+// Hosts pinned in conf.Hosts are connected to at their addresses, in turn,
+// without resolving their names; the others are resolved with the DNS
+// server conf.Resolver, if set. Only the connections are affected: the TLS
+// server name and the certificate verification are those of the URL of the
+// request still. If requests go through a proxy, it is the proxy host that
+// is pinned or resolved.
+func newDialer(timeout time.Duration, conf Config) (dialContextFunc, error) {
+	if err := ValidateHosts(conf.Hosts, conf.Resolver); err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     connectionKeepaliveTime,
+		FallbackDelay: happyEyeballsDelay,
+	}
+	if conf.Resolver != "" {
+		server, _ := resolverAddress(conf.Resolver)
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				rd := net.Dialer{Timeout: timeout}
+				return rd.DialContext(ctx, network, server)
+			},
+		}
+	}
+	hosts := make(map[string][]string, len(conf.Hosts))
+	for host, addrs := range conf.Hosts {
+		hosts[strings.ToLower(host)] = addrs
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			switch conf.IPVersion {
+			case 4:
+				network = "tcp4"
+			case 6:
+				network = "tcp6"
+			}
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		pinned, ok := hosts[strings.ToLower(host)]
+		if !ok {
+			return d.DialContext(ctx, network, addr)
+		}
+		for _, ip := range pinned {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, errors.Wrapf(err, "failed to connect to pinned host %s", host)
+	}, nil
+}
+
+// hostPort returns the host and port of u, with defaultPort if u has none;
+// IPv6 addresses are enclosed in brackets.
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostPort(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"https://mender.io":             "mender.io:443",
+		"https://mender.io:8443":        "mender.io:8443",
+		"https://192.168.1.1":           "192.168.1.1:443",
+		"https://[2001:db8::1]":         "[2001:db8::1]:443",
+		"https://[2001:db8::1]:8443/x":  "[2001:db8::1]:8443",
+		"https://[fe80::1%25eth0]:8443": "[fe80::1%eth0]:8443",
+	} {
+		u, err := url.Parse(uri)
+		require.NoError(t, err)
+		assert.Equal(t, expected, hostPort(u, "443"), uri)
+	}
+}
+
+func TestValidateIPVersion(t *testing.T) {
+	assert.NoError(t, ValidateIPVersion(0))
+	assert.NoError(t, ValidateIPVersion(4))
+	assert.NoError(t, ValidateIPVersion(6))
+	assert.Error(t, ValidateIPVersion(5))
+}
+
+func TestIPVersion(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ts4 := httptest.NewServer(handler)
+	defer ts4.Close()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	ts6 := httptest.NewUnstartedServer(handler)
+	ts6.Listener.Close()
+	ts6.Listener = l
+	ts6.Start()
+	defer ts6.Close()
+
+	get := func(version int, url string) error {
+		ac, err := New(Config{IPVersion: version})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		res, err := ac.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// literal IPv6 server address
+	assert.NoError(t, get(0, ts6.URL))
+	assert.NoError(t, get(6, ts6.URL))
+	assert.Error(t, get(4, ts6.URL))
+
+	assert.NoError(t, get(0, ts4.URL))
+	assert.NoError(t, get(4, ts4.URL))
+	assert.Error(t, get(6, ts4.URL))
+}
+
+func TestValidateHosts(t *testing.T) {
+	assert.NoError(t, ValidateHosts(nil, ""))
+	assert.NoError(t, ValidateHosts(map[string][]string{
+		"hosted.mender.io": {"192.0.2.1", "2001:db8::1"},
+	}, "192.0.2.53"))
+	assert.NoError(t, ValidateHosts(nil, "[2001:db8::53]:5353"))
+
+	assert.Error(t, ValidateHosts(map[string][]string{"hosted.mender.io": nil}, ""))
+	assert.Error(t, ValidateHosts(map[string][]string{
+		"hosted.mender.io": {"hosted.mender.io"},
+	}, ""))
+	assert.Error(t, ValidateHosts(nil, "dns.example.com"))
+	assert.Error(t, ValidateHosts(nil, "dns.example.com:53"))
+
+	addr, err := resolverAddress("192.0.2.53")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.53:53", addr)
+	addr, err = resolverAddress("2001:db8::53")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::53]:53", addr)
+
+	_, err = New(Config{Resolver: "dns.example.com"})
+	assert.Error(t, err)
+}
+
+func TestPinnedHosts(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "dialer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw,
+	}), 0600))
+
+	get := func(host string, hosts map[string][]string) error {
+		ac, err := New(Config{ServerCert: certFile, Hosts: hosts})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodGet, "https://"+host+":"+port, nil)
+		require.NoError(t, err)
+		res, err := ac.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// the test certificate is for example.com; addresses not accepting
+	// connections are skipped
+	assert.NoError(t, get("example.com", map[string][]string{
+		"Example.COM": {"127.0.0.2", "127.0.0.1"},
+	}))
+	// verified against the hostname of the request, not the address
+	err = get("mender.example.net", map[string][]string{
+		"mender.example.net": {"127.0.0.1"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mender.example.net")
+
+	assert.Error(t, get("example.com", map[string][]string{
+		"example.com": {"127.0.0.2"},
+	}))
+}
+
+func TestResolver(t *testing.T) {
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer dns.Close()
+	queries := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, _, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries <- string(buf[:n])
+		}
+	}()
+
+	dial, err := newDialer(time.Second, Config{Resolver: dns.LocalAddr().String(),
+		Hosts: map[string][]string{"pinned.example.com": {"127.0.0.1"}}})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// the DNS server does not answer
+	_, err = dial(ctx, "tcp", "mender.example.com:443")
+	assert.Error(t, err)
+	select {
+	case q := <-queries:
+		// the name is encoded as labels prefixed with their lengths
+		assert.True(t, strings.Contains(q, "mender"), "%q", q)
+	case <-time.After(time.Second):
+		t.Fatal("the name was not resolved with the DNS server")
+	}
+
+	// pinned hosts are not resolved
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := dial(context.Background(), "tcp", "pinned.example.com:"+port)
+	require.NoError(t, err)
+	conn.Close()
+	select {
+	case q := <-queries:
+		assert.False(t, strings.Contains(q, "pinned"), "%q", q)
+	default:
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// Redirects artifact downloads may go through, e.g. from the server to a
+// CDN, before they are given up.
+const maxDownloadRedirects = 10
+
+// ValidateDownloadHosts checks the hosts artifacts may be downloaded from:
+// hostnames, or patterns as "*.s3.amazonaws.com" matching their subdomains.
+func ValidateDownloadHosts(hosts []string) error {
+	for _, host := range hosts {
+		pattern := strings.TrimPrefix(host, "*.")
+		if pattern == "" || strings.ContainsAny(pattern, "*/: ") {
+			return errors.Errorf("invalid download host %q", host)
+		}
+	}
+	return nil
+}
+
+func downloadHostAllowed(hosts []string, host string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// newDownloadClient returns the client artifacts are downloaded with. The
+// links are presigned, typically by third-party storage or a CDN the server
+// redirects to, so neither the client certificate, nor the authorization
+// token, the request signature or the configured headers are sent along;
+// the connections are made as those of transport otherwise, through the
+// same proxy and dialer, trusting the same certificates.
+func newDownloadClient(transport *http.Transport) *http.Client {
+	t := &http.Transport{
+		Proxy:                 transport.Proxy,
+		DialContext:           transport.DialContext,
+		TLSClientConfig:       downloadTLSConfig(transport.TLSClientConfig),
+		TLSHandshakeTimeout:   transport.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: transport.ResponseHeaderTimeout,
+		MaxIdleConns:          transport.MaxIdleConns,
+		MaxIdleConnsPerHost:   transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:       transport.IdleConnTimeout,
+	}
+	if err := http2.ConfigureTransport(t); err != nil {
+		log.Warnf("failed to enable HTTP/2 for downloads: %v", err)
+	}
+	return &http.Client{
+		Transport: t,
+		Timeout:   defaultClientReadingTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxDownloadRedirects {
+				return errors.Errorf("stopped after %d redirects", len(via))
+			}
+			if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+				return errors.Errorf("refusing redirect of download to %s URL",
+					req.URL.Scheme)
+			}
+			req.Header.Del("Authorization")
+			return nil
+		},
+	}
+}
+
+// downloadTLSConfig returns the TLS configuration of the connections to
+// the servers without the client certificate. The server name is that of
+// the download host, rather than the one the servers are verified against,
+// and the public key pins and revocation checks of the servers do not apply
+// to download hosts and mirrors.
+func downloadTLSConfig(tlsc *tls.Config) *tls.Config {
+	if tlsc == nil {
+		return nil
+	}
+	c := tlsc.Clone()
+	c.Certificates = nil
+	c.GetClientCertificate = nil
+	c.ServerName = ""
+	c.VerifyConnection = nil
+	c.ClientSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	return c
+}
+
+// download sends a request of an artifact, checking that it ends up at one
+// of the download hosts after any redirects.
+func (a *ApiClient) download(req *http.Request) (*http.Response, error) {
+	req.Header.Del("Authorization")
+	if ua := a.headers.Get("User-Agent"); ua != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	r, err := a.downloads.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if final := r.Request.URL; !downloadHostAllowed(a.downloadHosts, final.Hostname()) {
+		r.Body.Close()
+		return nil, errors.Errorf("artifact download from %s not allowed",
+			(&url.URL{Scheme: final.Scheme, Host: final.Host}).String())
+	}
+	return r, nil
+}
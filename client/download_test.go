@@ -0,0 +1,148 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDownloadHosts(t *testing.T) {
+	assert.NoError(t, ValidateDownloadHosts(nil))
+	assert.NoError(t, ValidateDownloadHosts([]string{"cdn.example.com", "*.s3.amazonaws.com"}))
+	for _, host := range []string{"", "*.", "cdn.*.com", "https://cdn.example.com",
+		"cdn.example.com:443"} {
+		assert.Error(t, ValidateDownloadHosts([]string{host}), host)
+	}
+}
+
+func TestDownloadHostAllowed(t *testing.T) {
+	assert.True(t, downloadHostAllowed(nil, "anything.example.com"))
+
+	hosts := []string{"cdn.example.com", "*.s3.amazonaws.com"}
+	assert.True(t, downloadHostAllowed(hosts, "cdn.example.com"))
+	assert.True(t, downloadHostAllowed(hosts, "CDN.example.com"))
+	assert.True(t, downloadHostAllowed(hosts, "bucket.s3.amazonaws.com"))
+	assert.False(t, downloadHostAllowed(hosts, "s3.amazonaws.com"))
+	assert.False(t, downloadHostAllowed(hosts, "evil-s3.amazonaws.com"))
+	assert.False(t, downloadHostAllowed(hosts, "other.example.com"))
+}
+
+func TestDownloadTLSConfig(t *testing.T) {
+	assert.Nil(t, downloadTLSConfig(nil))
+
+	tlsc := &tls.Config{
+		Certificates: []tls.Certificate{{}},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{}, nil
+		},
+		ServerName: "mender.example.com",
+		MinVersion: tls.VersionTLS13,
+		VerifyConnection: func(tls.ConnectionState) error {
+			return errors.New("pin mismatch")
+		},
+	}
+	c := downloadTLSConfig(tlsc)
+	assert.Nil(t, c.Certificates)
+	assert.Nil(t, c.GetClientCertificate)
+	assert.Empty(t, c.ServerName)
+	assert.Nil(t, c.VerifyConnection)
+	assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+	// the configuration of the server connections is left alone
+	assert.NotNil(t, tlsc.GetClientCertificate)
+}
+
+func TestDownloadRedirect(t *testing.T) {
+	artifact := strings.Repeat("a", 8192)
+	var received http.Header
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte(artifact))
+	}))
+	defer storage.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storage.URL+"/bucket/artifact?signature=x", http.StatusFound)
+	}))
+	defer server.Close()
+
+	ac, err := NewApiClient(Config{
+		SigningSecret: "secret",
+		UserAgent:     "mender/1.0",
+		Headers:       map[string]string{"X-Tenant": "acme"},
+	})
+	require.NoError(t, err)
+
+	req, err := makeUpdateFetchRequest(context.Background(), server.URL+"/download")
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	rsp, err := ac.Do(req)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, artifact, string(data))
+
+	// nothing authenticating the device reaches the storage
+	require.NotNil(t, received)
+	assert.Empty(t, received.Get("Authorization"))
+	assert.Empty(t, received.Get(SignatureHeader))
+	assert.Empty(t, received.Get("X-Tenant"))
+	assert.Equal(t, "mender/1.0", received.Get("User-Agent"))
+
+	// the final host must be allowed
+	ac, err = NewApiClient(Config{DownloadHosts: []string{"cdn.example.com"}})
+	require.NoError(t, err)
+	_, _, err = NewUpdate().FetchUpdate(context.Background(), ac, server.URL+"/download",
+		time.Minute)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not allowed")
+
+	ac, err = NewApiClient(Config{DownloadHosts: []string{"127.0.0.1"}})
+	require.NoError(t, err)
+	r, _, err := NewUpdate().FetchUpdate(context.Background(), ac, server.URL+"/download",
+		time.Minute)
+	require.NoError(t, err)
+	r.Close()
+
+	_, err = NewApiClient(Config{DownloadHosts: []string{"https://cdn.example.com"}})
+	assert.Error(t, err)
+}
+
+func TestDownloadRedirectDowngrade(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 8192)))
+	}))
+	defer storage.Close()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storage.URL+"/artifact", http.StatusFound)
+	}))
+	defer server.Close()
+
+	ac, err := NewApiClient(Config{IsHttps: true, NoVerify: true})
+	require.NoError(t, err)
+	_, _, err = NewUpdate().FetchUpdate(context.Background(), ac, server.URL+"/download",
+		time.Minute)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing redirect")
+}
@@ -0,0 +1,344 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Limit of the certificates returned by an enrollment server.
+const maxEnrollmentResponseSize = 1024 * 1024
+
+// Time an enrollment request may take.
+var enrollmentTimeout = time.Minute
+
+// ErrEnrollmentPending is returned if the enrollment server has accepted the
+// certificate request, but has not issued the certificate yet.
+var ErrEnrollmentPending = errors.New("certificate enrollment pending")
+
+// Enrollment obtains the client certificate from an EST enrollment server
+// (RFC 7030), rather than it being provisioned with the image, and renews it
+// before it expires. The initial certificate is requested authenticating
+// with a factory provisioned bootstrap credential, renewals with the current
+// certificate. Each certificate is issued for a newly generated key.
+type Enrollment struct {
+	// base URL of the EST server, including the CA label if any, e.g.
+	// https://est.example.com/.well-known/est
+	ServerURL string
+	// certificate the enrollment server is verified against; the system
+	// certificates are used if empty
+	ServerCert string
+	// bootstrap certificate and key authenticating the initial enrollment
+	// over TLS, and/or credentials for HTTP basic authentication, which are
+	// sent with renewals too
+	BootstrapCert string
+	BootstrapKey  string
+	Username      string
+	Password      string
+	// subject common name of the initial certificate; renewals keep the
+	// subject of the current certificate
+	CommonName string
+	// files the enrolled certificate and key are written to
+	ClientCert string
+	ClientKey  string
+	// the certificate is renewed once less than this is left of its
+	// validity; a third of the validity if zero
+	RenewBefore time.Duration
+	// URL of the proxy to use; if empty the proxy is taken from the
+	// environment
+	HttpProxy string
+}
+
+// RenewalTime returns when the current certificate is to be renewed; the
+// zero time if there is no valid certificate yet.
+func (e Enrollment) RenewalTime() time.Time {
+	cert, err := e.currentCertificate()
+	if err != nil {
+		return time.Time{}
+	}
+	return e.renewalTime(cert.Leaf)
+}
+
+func (e Enrollment) renewalTime(cert *x509.Certificate) time.Time {
+	before := e.RenewBefore
+	if before <= 0 {
+		before = cert.NotAfter.Sub(cert.NotBefore) / 3
+	}
+	return cert.NotAfter.Add(-before)
+}
+
+// currentCertificate returns the enrolled certificate if it is valid still.
+func (e Enrollment) currentCertificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(cert.Leaf.NotBefore) || !now.Before(cert.Leaf.NotAfter) {
+		return nil, errors.Errorf("client certificate is valid from %s to %s only",
+			cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+	}
+	return &cert, nil
+}
+
+// Enroll obtains a new certificate, renewing the current one if it is valid
+// still, and writes it and its key to ClientCert and ClientKey. It returns
+// when the new certificate is to be renewed.
+func (e Enrollment) Enroll(ctx context.Context) (time.Time, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to generate client key")
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: e.CommonName},
+	}
+	var credential *tls.Certificate
+	operation := "simpleenroll"
+	current, err := e.currentCertificate()
+	switch {
+	case err == nil:
+		operation = "simplereenroll"
+		credential = current
+		template.RawSubject = current.Leaf.RawSubject
+		template.DNSNames = current.Leaf.DNSNames
+		template.IPAddresses = current.Leaf.IPAddresses
+	case e.BootstrapCert != "":
+		log.Infof("enrolling client certificate with bootstrap certificate (%v)", err)
+		bootstrap, err := tls.LoadX509KeyPair(e.BootstrapCert, e.BootstrapKey)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "invalid bootstrap certificate or key")
+		}
+		credential = &bootstrap
+	case e.Username == "":
+		return time.Time{}, errors.New("no bootstrap credential to enroll with")
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to create certificate request")
+	}
+
+	certs, err := e.request(ctx, operation, credential, csr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf := certs[0]
+	if !publicKeyEqual(leaf.PublicKey, &key.PublicKey) {
+		return time.Time{}, errors.New("enrolled certificate is not issued for the client key")
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to encode client key")
+	}
+	var certPEM bytes.Buffer
+	for _, c := range certs {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	// the key first, as the certificate changing prompts reloading both
+	err = writeFileAtomic(e.ClientKey,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err == nil {
+		err = writeFileAtomic(e.ClientCert, certPEM.Bytes(), 0644)
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to store enrolled certificate")
+	}
+	log.Infof("enrolled client certificate %q, valid until %s", leaf.Subject.CommonName,
+		leaf.NotAfter)
+	return e.renewalTime(leaf), nil
+}
+
+func publicKeyEqual(pub interface{}, key *ecdsa.PublicKey) bool {
+	p, ok := pub.(*ecdsa.PublicKey)
+	return ok && p.Curve == key.Curve && p.X.Cmp(key.X) == 0 && p.Y.Cmp(key.Y) == 0
+}
+
+// request sends the certificate request to the EST operation, and returns
+// the certificates issued, the client certificate first.
+func (e Enrollment) request(ctx context.Context, operation string,
+	credential *tls.Certificate, csr []byte) ([]*x509.Certificate, error) {
+
+	trust, err := loadServerTrust(Config{ServerCert: e.ServerCert})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot initialize enrollment server trust")
+	}
+	tlsc := &tls.Config{
+		RootCAs:    trust,
+		MinVersion: tls.VersionTLS12,
+	}
+	if credential != nil {
+		tlsc.Certificates = []tls.Certificate{*credential}
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsc,
+	}
+	if transport.Proxy, err = proxyFunc(e.HttpProxy); err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   enrollmentTimeout,
+	}
+
+	body := base64.StdEncoding.EncodeToString(csr)
+	req, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(e.ServerURL, "/")+"/"+operation, strings.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create enrollment request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Content-Transfer-Encoding", "base64")
+	if e.Username != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "enrollment request failed")
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: r.Body, N: maxEnrollmentResponseSize})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read enrollment response")
+	}
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted:
+		return nil, errors.Wrapf(ErrEnrollmentPending, "retry after %s",
+			r.Header.Get("Retry-After"))
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errors.Wrapf(ErrNotAuthorized, "enrollment refused: %s",
+			bodySnippet(data, 0))
+	default:
+		return nil, errors.Errorf("enrollment failed, bad status %v: %s",
+			r.StatusCode, bodySnippet(data, 0))
+	}
+
+	der, err := base64.StdEncoding.DecodeString(string(bytes.Join(
+		bytes.Fields(data), nil)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid enrollment response")
+	}
+	return parseCertsOnly(der)
+}
+
+// PKCS#7 (RFC 2315) SignedData of degenerate certs-only messages, as the
+// certificates are returned by EST servers.
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// the explicit tag, the content itself being its Bytes
+	Content asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"tag:0,optional"`
+	CRLs             asn1.RawValue `asn1:"tag:1,optional"`
+	SignerInfos      asn1.RawValue
+}
+
+// parseCertsOnly returns the certificates of a certs-only message, the one
+// not issuing any of the others first.
+func parseCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.Wrapf(err, "invalid PKCS#7 message")
+	}
+	if !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, errors.Errorf("unexpected PKCS#7 content type %v", info.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, errors.Wrapf(err, "invalid PKCS#7 signed data")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate in PKCS#7 message")
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate in PKCS#7 message")
+	}
+
+	for i, c := range certs {
+		issuer := false
+		for _, other := range certs {
+			if other != c && bytes.Equal(other.RawIssuer, c.RawSubject) &&
+				other.CheckSignatureFrom(c) == nil {
+				issuer = true
+				break
+			}
+		}
+		if !issuer {
+			certs[0], certs[i] = certs[i], certs[0]
+			break
+		}
+	}
+	return certs, nil
+}
+
+// writeFileAtomic replaces the file name with data, so that it is never
+// read partially written.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,270 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certsOnly encodes certificates as EST servers return them.
+func certsOnly(t *testing.T, certs ...*x509.Certificate) []byte {
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+	empty := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	data, err := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{
+		asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	require.NoError(t, err)
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: empty,
+		ContentInfo:      asn1.RawValue{FullBytes: data},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: raw},
+		SignerInfos: empty,
+	})
+	require.NoError(t, err)
+	der, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: sd},
+	})
+	require.NoError(t, err)
+	return der
+}
+
+// estServer issues certificates of its CA to clients authenticating with
+// the bootstrap certificate, or with certificates it issued.
+type estServer struct {
+	*httptest.Server
+	t         *testing.T
+	ca        *x509.Certificate
+	caKey     *ecdsa.PrivateKey
+	bootstrap *x509.Certificate
+	validity  time.Duration
+	pending   bool
+
+	mutex      sync.Mutex
+	operations []string
+	serial     int64
+}
+
+func newESTServer(t *testing.T) *estServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Device CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	s := &estServer{t: t, ca: ca, caKey: caKey, validity: 3 * time.Hour, serial: 1}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	return s
+}
+
+func (s *estServer) authenticated(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return user == "device" && pass == "secret"
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	peer := r.TLS.PeerCertificates[0]
+	if s.bootstrap != nil && peer.Equal(s.bootstrap) {
+		return true
+	}
+	return peer.CheckSignatureFrom(s.ca) == nil
+}
+
+func (s *estServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	op := filepath.Base(r.URL.Path)
+	s.operations = append(s.operations, op)
+	if op != "simpleenroll" && op != "simplereenroll" ||
+		r.Header.Get("Content-Type") != "application/pkcs10" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.authenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.pending {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	der, err := base64.StdEncoding.DecodeString(string(body))
+	require.NoError(s.t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	require.NoError(s.t, err)
+	require.NoError(s.t, csr.CheckSignature())
+
+	s.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(s.serial),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.validity),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, csr.PublicKey, s.caKey)
+	require.NoError(s.t, err)
+	leaf, err := x509.ParseCertificate(cert)
+	require.NoError(s.t, err)
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	// the CA first, the client finds its certificate anyway
+	w.Write([]byte(base64.StdEncoding.EncodeToString(certsOnly(s.t, s.ca, leaf))))
+}
+
+func (s *estServer) writeServerCert(t *testing.T, dir string) string {
+	name := filepath.Join(dir, "est.crt")
+	require.NoError(t, ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0600))
+	return name
+}
+
+func TestEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrollment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newESTServer(t)
+	defer s.Close()
+
+	bootstrapKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bootstrapCert, bootstrapKeyFile := writeClientCertCN(t, dir, bootstrapKey, "bootstrap")
+	pemData, err := ioutil.ReadFile(bootstrapCert)
+	require.NoError(t, err)
+	block, _ := pem.Decode(pemData)
+	s.bootstrap, err = x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	e := Enrollment{
+		ServerURL:  s.URL + "/.well-known/est/",
+		ServerCert: s.writeServerCert(t, dir),
+		CommonName: "device-1",
+		ClientCert: filepath.Join(dir, "enrolled.crt"),
+		ClientKey:  filepath.Join(dir, "enrolled.key"),
+	}
+	assert.True(t, e.RenewalTime().IsZero())
+
+	// no bootstrap credential
+	_, err = e.Enroll(context.Background())
+	assert.Error(t, err)
+
+	e.BootstrapCert = bootstrapCert
+	e.BootstrapKey = bootstrapKeyFile
+	renewal, err := e.Enroll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"simpleenroll"}, s.operations)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), renewal, time.Minute)
+	assert.Equal(t, renewal, e.RenewalTime())
+
+	cert, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+	require.NoError(t, err)
+	assert.Len(t, cert.Certificate, 2)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "device-1", leaf.Subject.CommonName)
+	assert.NoError(t, leaf.CheckSignatureFrom(s.ca))
+	fi, err := os.Stat(e.ClientKey)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// renewed with the enrolled certificate, for a new key, keeping the
+	// subject
+	e.BootstrapCert = ""
+	e.CommonName = "other"
+	e.RenewBefore = time.Hour
+	renewal, err = e.Enroll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"simpleenroll", "simplereenroll"}, s.operations)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), renewal, time.Minute)
+	renewed, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+	require.NoError(t, err)
+	renewedLeaf, err := x509.ParseCertificate(renewed.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "device-1", renewedLeaf.Subject.CommonName)
+	assert.NotEqual(t, leaf.SerialNumber, renewedLeaf.SerialNumber)
+	assert.NotEqual(t, cert.PrivateKey, renewed.PrivateKey)
+
+	// pending enrollments are retried
+	s.pending = true
+	_, err = e.Enroll(context.Background())
+	assert.Equal(t, ErrEnrollmentPending, errors.Cause(err))
+	s.pending = false
+
+	// HTTP basic authentication
+	os.Remove(e.ClientCert)
+	e.Username = "device"
+	e.Password = "wrong"
+	_, err = e.Enroll(context.Background())
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+	e.Password = "secret"
+	_, err = e.Enroll(context.Background())
+	assert.NoError(t, err)
+
+	// the enrollment server must be trusted
+	e.ServerCert = bootstrapCert
+	_, err = e.Enroll(context.Background())
+	assert.Error(t, err)
+}
+
+func TestParseCertsOnly(t *testing.T) {
+	_, err := parseCertsOnly([]byte("garbage"))
+	assert.Error(t, err)
+	_, err = parseCertsOnly(certsOnly(t))
+	assert.Error(t, err)
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"github.com/mendersoftware/mender/utils"
+)
+
+// authError is an error of the device not being authorized, classified as
+// such by utils.ErrorKindOf.
+type authError string
+
+func (e authError) Error() string {
+	return string(e)
+}
+
+func (e authError) ErrorKind() utils.ErrorKind {
+	return utils.ErrorKindAuth
+}
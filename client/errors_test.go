@@ -0,0 +1,75 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthErrorKind(t *testing.T) {
+	for _, err := range []error{ErrNotAuthorized, AuthErrorUnauthorized,
+		errors.Wrap(ErrNotAuthorized, "failed")} {
+		assert.Equal(t, utils.ErrorKindAuth, utils.ErrorKindOf(err), err.Error())
+	}
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(errors.Wrap(ErrNotAuthorized, "failed")))
+}
+
+func TestAPIErrorKind(t *testing.T) {
+	for status, kind := range map[int]utils.ErrorKind{
+		http.StatusBadRequest:          utils.ErrorKindUnknown,
+		http.StatusNotFound:            utils.ErrorKindUnknown,
+		http.StatusUnauthorized:        utils.ErrorKindAuth,
+		http.StatusTooManyRequests:     utils.ErrorKindNetwork,
+		http.StatusInternalServerError: utils.ErrorKindNetwork,
+		http.StatusBadGateway:          utils.ErrorKindNetwork,
+	} {
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(status)
+		err := NewAPIError(errors.New("request failed"), rec.Result())
+		assert.Equal(t, kind, utils.ErrorKindOf(errors.Wrap(err, "failed")), status)
+	}
+}
+
+func TestErrorKindOfRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := ts.URL
+	ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	_, err = ac.Do(req)
+	require.Error(t, err)
+	assert.Equal(t, utils.ErrorKindNetwork, utils.ErrorKindOf(errors.Wrap(err, "request failed")))
+
+	client := NewUpdate()
+	client.minImageSize = 4096
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 16)))
+	}))
+	defer ts.Close()
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL, 0)
+	assert.Error(t, err)
+	assert.Equal(t, utils.ErrorKindArtifact, utils.ErrorKindOf(err))
+}
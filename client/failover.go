@@ -0,0 +1,125 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/log"
+)
+
+// serverList is an ordered list of servers requests fail over to when the
+// server they are made to can not be reached or responds with a 5xx status.
+// The last server which worked is used for subsequent requests.
+type serverList struct {
+	mutex   sync.Mutex
+	servers []string
+	current int
+}
+
+func newServerList(servers []string) *serverList {
+	s := &serverList{}
+	for _, server := range servers {
+		s.servers = append(s.servers, strings.TrimSuffix(buildURL(server), "/"))
+	}
+	return s
+}
+
+// match returns the part of the URL following the server it belongs to.
+func (s *serverList) match(u string) (string, bool) {
+	for _, server := range s.servers {
+		if !strings.HasPrefix(u, server) {
+			continue
+		}
+		rest := u[len(server):]
+		if rest == "" || rest[0] == '/' || rest[0] == '?' {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+func (s *serverList) getCurrent() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.current
+}
+
+func (s *serverList) setCurrent(i int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current = i
+}
+
+// rewind prepares the body of req for sending it once more.
+func rewind(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// do sends req to the current server, and to the following ones in turn as
+// long as they fail. Requests to URLs of other servers are sent as they are.
+func (s *serverList) do(req *http.Request,
+	do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+
+	rest, ok := s.match(req.URL.String())
+	if !ok {
+		return do(req)
+	}
+
+	start := s.getCurrent()
+	for i := 0; ; i++ {
+		idx := (start + i) % len(s.servers)
+		u, err := url.Parse(s.servers[idx] + rest)
+		if err != nil {
+			return nil, err
+		}
+		req.URL = u
+		req.Host = u.Host
+
+		rsp, err := do(req)
+		if err == nil && rsp.StatusCode < http.StatusInternalServerError {
+			if idx != start {
+				log.Infof("failed over to server %s", s.servers[idx])
+				s.setCurrent(idx)
+			}
+			return rsp, nil
+		}
+
+		if i+1 == len(s.servers) || req.Context().Err() != nil || !rewind(req) {
+			return rsp, err
+		}
+		if err != nil {
+			log.Warnf("request to server %s failed: %v; trying the next server",
+				s.servers[idx], err)
+		} else {
+			log.Warnf("server %s responded with status %d; trying the next server",
+				s.servers[idx], rsp.StatusCode)
+			rsp.Body.Close()
+		}
+	}
+}
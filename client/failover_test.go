@@ -0,0 +1,134 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFailoverServer struct {
+	*httptest.Server
+	status int
+	hits   int
+	body   string
+}
+
+func newTestFailoverServer(status int) *testFailoverServer {
+	s := &testFailoverServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits++
+		body, _ := ioutil.ReadAll(r.Body)
+		s.body = string(body)
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+func TestServerFailover(t *testing.T) {
+	down := newTestFailoverServer(http.StatusOK)
+	down.Close()
+	failing := newTestFailoverServer(http.StatusServiceUnavailable)
+	defer failing.Close()
+	working := newTestFailoverServer(http.StatusNoContent)
+	defer working.Close()
+
+	ac, err := New(Config{
+		Servers: []string{down.URL, failing.URL + "/", working.URL},
+	})
+	require.NoError(t, err)
+
+	// the request, including its body, ends up at the working server
+	req, err := http.NewRequest(http.MethodPut, buildApiURL(down.URL, "/inventory"),
+		bytes.NewBufferString("data"))
+	require.NoError(t, err)
+	rsp, err := ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, 1, failing.hits)
+	assert.Equal(t, 1, working.hits)
+	assert.Equal(t, "data", working.body)
+
+	// which is used for subsequent requests right away
+	req, err = http.NewRequest(http.MethodGet, buildApiURL(down.URL, "/update"), nil)
+	require.NoError(t, err)
+	rsp, err = ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, 1, failing.hits)
+	assert.Equal(t, 2, working.hits)
+
+	// client errors are not failed over
+	working.status = http.StatusNotFound
+	req, err = http.NewRequest(http.MethodGet, buildApiURL(down.URL, "/update"), nil)
+	require.NoError(t, err)
+	rsp, err = ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	assert.Equal(t, 1, failing.hits)
+	assert.Equal(t, 3, working.hits)
+
+	// if all of them fail the last failure is returned
+	working.status = http.StatusBadGateway
+	req, err = http.NewRequest(http.MethodGet, buildApiURL(down.URL, "/update"), nil)
+	require.NoError(t, err)
+	rsp, err = ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	assert.Equal(t, 2, failing.hits)
+	assert.Equal(t, 4, working.hits)
+}
+
+func TestServerFailoverOtherURLs(t *testing.T) {
+	failing := newTestFailoverServer(http.StatusServiceUnavailable)
+	defer failing.Close()
+	working := newTestFailoverServer(http.StatusOK)
+	defer working.Close()
+	other := newTestFailoverServer(http.StatusInternalServerError)
+	defer other.Close()
+
+	ac, err := New(Config{
+		Servers: []string{failing.URL, working.URL},
+	})
+	require.NoError(t, err)
+
+	// e.g. artifact downloads from a storage server
+	req, err := http.NewRequest(http.MethodGet, other.URL+"/artifact", nil)
+	require.NoError(t, err)
+	rsp, err := ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	assert.Equal(t, 1, other.hits)
+	assert.Equal(t, 0, failing.hits+working.hits)
+
+	// bodies which can not be sent again are not failed over
+	req, err = http.NewRequest(http.MethodPut, failing.URL+"/status",
+		ioutil.NopCloser(bytes.NewBufferString("data")))
+	require.NoError(t, err)
+	rsp, err = ac.Do(req)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	assert.Equal(t, 0, working.hits)
+}
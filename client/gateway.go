@@ -0,0 +1,74 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// ArtifactCacheHeader is set by gateways on update check responses to
+// advertise the local cache artifacts can be downloaded from.
+const ArtifactCacheHeader = "X-MEN-Artifact-Cache"
+
+// gateway sends the requests to an on-premise gateway relaying them to the
+// server; the gateway is verified against its own trust anchors.
+type gateway struct {
+	host   string
+	client *ApiClient
+}
+
+func newGateway(conf Config) (*gateway, error) {
+	u, err := url.Parse(conf.GatewayURL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid gateway URL %q", conf.GatewayURL)
+	}
+
+	gwConf := conf
+	gwConf.ServerCert = conf.GatewayCert
+	// the gateway has keys of its own, trusted through its certificate
+	gwConf.PublicKeyPins = nil
+	gwConf.CRLFile = ""
+	gwConf.OCSPStapling = false
+	gwConf.IsHttps = u.Scheme == "https"
+	gwConf.GatewayURL = ""
+	gwConf.Servers = nil
+	client, err := New(gwConf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot initialize gateway client")
+	}
+	return &gateway{
+		host:   u.Host,
+		client: client,
+	}, nil
+}
+
+// match tells if the request is to be sent to the gateway.
+func (g *gateway) match(req *http.Request) bool {
+	return req.URL.Host == g.host
+}
+
+// cacheURI returns the URI of the artifact in the cache of a gateway.
+func cacheURI(cache, uri string) (string, error) {
+	u, err := url.Parse(cache)
+	if err != nil || u.Host == "" {
+		return "", errors.Errorf("invalid artifact cache URL %q", cache)
+	}
+	q := u.Query()
+	q.Set("uri", uri)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
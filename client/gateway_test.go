@@ -0,0 +1,174 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTLSServer starts a server with its own self signed certificate,
+// which is written to certFile.
+func newTestTLSServer(t *testing.T, name, certFile string) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+	ts.StartTLS()
+	return ts
+}
+
+func getBody(ac *ApiClient, url string) (string, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	rsp, err := ac.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	return string(body), err
+}
+
+func TestGatewayTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	originCert := filepath.Join(dir, "origin.crt")
+	gatewayCert := filepath.Join(dir, "gateway.crt")
+	origin := newTestTLSServer(t, "origin", originCert)
+	defer origin.Close()
+	gw := newTestTLSServer(t, "gateway", gatewayCert)
+	defer gw.Close()
+
+	ac, err := NewApiClient(Config{
+		IsHttps:     true,
+		ServerCert:  originCert,
+		GatewayURL:  gw.URL,
+		GatewayCert: gatewayCert,
+	})
+	require.NoError(t, err)
+
+	body, err := getBody(ac, gw.URL+"/api/devices/v1/deployments/device/deployments/next")
+	assert.NoError(t, err)
+	assert.Equal(t, "gateway", body)
+	body, err = getBody(ac, origin.URL+"/artifact")
+	assert.NoError(t, err)
+	assert.Equal(t, "origin", body)
+
+	// the trust anchors are not shared
+	ac, err = NewApiClient(Config{
+		IsHttps:     true,
+		ServerCert:  gatewayCert,
+		GatewayURL:  gw.URL,
+		GatewayCert: originCert,
+	})
+	require.NoError(t, err)
+	_, err = getBody(ac, gw.URL)
+	assert.Error(t, err)
+	_, err = getBody(ac, origin.URL)
+	assert.Error(t, err)
+
+	_, err = NewApiClient(Config{GatewayURL: "gateway.local"})
+	assert.Error(t, err)
+}
+
+func TestUpdateDownloadURIs(t *testing.T) {
+	var update UpdateResponse
+	update.Artifact.Source.URI = "https://s3.amazonaws.com/artifact?X-Amz-Signature=abc"
+	assert.Equal(t, []string{update.URI()}, update.DownloadURIs())
+
+	update.ArtifactCache = "https://gateway.local/cache"
+	assert.Equal(t, []string{
+		"https://gateway.local/cache?uri=https%3A%2F%2Fs3.amazonaws.com%2Fartifact%3FX-Amz-Signature%3Dabc",
+		update.URI(),
+	}, update.DownloadURIs())
+
+	// broken cache settings are ignored
+	update.ArtifactCache = "cache"
+	assert.Equal(t, []string{update.URI()}, update.DownloadURIs())
+}
+
+func TestParseUpdateResponseArtifactCache(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ArtifactCacheHeader, "https://gateway.local/cache")
+		w.Write([]byte(correctUpdateResponse))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	data, err := NewUpdate().GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+	require.NoError(t, err)
+	update, ok := data.(UpdateResponse)
+	require.True(t, ok)
+	assert.Equal(t, "https://gateway.local/cache", update.ArtifactCache)
+}
+
+func TestParseUpdateResponseArtifactCacheIgnoresBody(t *testing.T) {
+	body := strings.Replace(correctUpdateResponse, `"id":`,
+		`"artifact_cache": "https://other.local/cache", "id":`, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	data, err := NewUpdate().GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+	require.NoError(t, err)
+	update, ok := data.(UpdateResponse)
+	require.True(t, ok)
+	assert.Empty(t, update.ArtifactCache)
+}
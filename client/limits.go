@@ -0,0 +1,118 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrResponseTooLarge = errors.New("response from server is too large")
+
+	// Limit for API responses read into memory; artifacts are streamed and
+	// not affected.
+	maxResponseSize int64 = 1024 * 1024
+)
+
+// readResponseBody reads a response body of at most maxResponseSize bytes.
+func readResponseBody(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+	return data, nil
+}
+
+// idleTimeoutConn fails reads and writes that make no progress within the
+// timeout, so that a stalled server can not hang the client.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func idleTimeoutDialer(dial dialContextFunc, timeout time.Duration) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idleTimeoutConn{Conn: conn, timeout: timeout}, nil
+	}
+}
+
+// timeoutRequester limits the time requests take, including reading the
+// response body.
+type timeoutRequester struct {
+	api     ApiRequester
+	timeout time.Duration
+}
+
+// WithTimeout returns an ApiRequester whose requests are cancelled if they,
+// including reading the response, take longer than timeout.
+func WithTimeout(api ApiRequester, timeout time.Duration) ApiRequester {
+	if timeout <= 0 {
+		return api
+	}
+	return &timeoutRequester{api: api, timeout: timeout}
+}
+
+// cancelOnClose releases the context of a request once its response has
+// been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (t *timeoutRequester) Do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	rsp, err := t.api.Do(req.WithContext(ctx))
+	if err != nil || rsp == nil {
+		cancel()
+		return rsp, err
+	}
+	rsp.Body = &cancelOnClose{ReadCloser: rsp.Body, cancel: cancel}
+	return rsp, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadResponseBody(t *testing.T) {
+	old := maxResponseSize
+	defer func() { maxResponseSize = old }()
+	maxResponseSize = 10
+
+	data, err := readResponseBody(strings.NewReader("0123456789"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789"), data)
+
+	_, err = readResponseBody(strings.NewReader("0123456789a"))
+	assert.Equal(t, ErrResponseTooLarge, err)
+}
+
+func TestUpdateCheckResponseTooLarge(t *testing.T) {
+	old := maxResponseSize
+	defer func() { maxResponseSize = old }()
+	maxResponseSize = 1024
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte(" "), 4096))
+	}))
+	defer srv.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	_, err = NewUpdate().GetScheduledUpdate(context.Background(), ac, srv.URL,
+		CurrentUpdate{Artifact: "a", DeviceType: "d"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrResponseTooLarge.Error())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ac, err := NewApiClient(Config{IdleTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	// a server stalling in the middle of the body fails reading it
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("data"))
+		w.(http.Flusher).Flush()
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	rsp, err := ac.Do(req)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestWithTimeout(t *testing.T) {
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	assert.Equal(t, ac, WithTimeout(ac, 0))
+
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-unblock
+		}
+		w.Write([]byte("done"))
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	api := WithTimeout(ac, 100*time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/slow", nil)
+	_, err = api.Do(req)
+	assert.Error(t, err)
+
+	// the timeout covers reading the response, it is released on close
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/fast", nil)
+	rsp, err := api.Do(req)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "done", string(data))
+	assert.NoError(t, rsp.Body.Close())
+}
@@ -0,0 +1,373 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Multicast DNS (RFC 6762) group queries are sent to; only what announcing
+// and looking up instances of a service by SRV records needs is supported.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+	// top bit of the class of questions asking for unicast responses, and
+	// of the class of records flushing caches
+	dnsClassTopBit       = 0x8000
+	dnsFlagResponse      = 0x8000
+	dnsFlagAuthoritative = 0x0400
+	// TTL of the records of responses to queries not sent from the mDNS
+	// port (RFC 6762, section 6.7)
+	mdnsLegacyTTL = 10
+	mdnsMaxPacket = 9000
+)
+
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// dnsSRV is an SRV record, the only kind of answer supported.
+type dnsSRV struct {
+	name   string
+	port   uint16
+	target string
+}
+
+type dnsMessage struct {
+	id        uint16
+	flags     uint16
+	questions []dnsQuestion
+	answers   []dnsSRV
+}
+
+// mdnsName returns the fully qualified name of an instance of service, e.g.
+// "a1b2._mender-artifact._tcp.local.".
+func mdnsName(service, instance string) string {
+	return strings.ToLower(instance + "." + service + ".local.")
+}
+
+func packName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func (m *dnsMessage) pack() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	for _, q := range m.questions {
+		b = packName(b, q.name)
+		b = append(b, byte(q.qtype>>8), byte(q.qtype), byte(q.qclass>>8), byte(q.qclass))
+	}
+	for _, a := range m.answers {
+		b = packName(b, a.name)
+		b = append(b, 0, dnsTypeSRV, 0, dnsClassIN, 0, 0, 0, mdnsLegacyTTL)
+		data := []byte{0, 0, 0, 0, byte(a.port >> 8), byte(a.port)}
+		data = packName(data, a.target)
+		b = append(b, byte(len(data)>>8), byte(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+var errInvalidDNSMessage = errors.New("invalid DNS message")
+
+// readName reads the name at off of msg, following compression pointers,
+// and returns it with the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errInvalidDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".") + "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errInvalidDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case l&0xc0 != 0:
+			return "", 0, errInvalidDNSMessage
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errInvalidDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSMessage parses the questions and the SRV answers of msg; other
+// records are skipped.
+func parseDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errInvalidDNSMessage
+	}
+	m := &dnsMessage{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		m.questions = append(m.questions, dnsQuestion{
+			name:   name,
+			qtype:  binary.BigEndian.Uint16(msg[next:]),
+			qclass: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+		off = next + 4
+	}
+	for i := 0; i < ancount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+length > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		if rtype == dnsTypeSRV && length >= 7 {
+			target, _, err := readName(msg, data+6)
+			if err != nil {
+				return nil, err
+			}
+			m.answers = append(m.answers, dnsSRV{
+				name:   name,
+				port:   binary.BigEndian.Uint16(msg[data+4:]),
+				target: target,
+			})
+		}
+		off = data + length
+	}
+	return m, nil
+}
+
+// MDNSResponder announces instances of a service provided by the device,
+// answering mDNS queries for their SRV records, e.g. for the artifacts it
+// shares with peers.
+type MDNSResponder struct {
+	conn    *net.UDPConn
+	service string
+	port    uint16
+	target  string
+	// whether the device provides the instance
+	has  func(instance string) bool
+	done chan struct{}
+	once sync.Once
+}
+
+// StartMDNSResponder answers queries for instances of service, e.g.
+// "_mender-artifact._tcp", provided by the device on port as told by has.
+func StartMDNSResponder(service string, port int,
+	has func(instance string) bool) (*MDNSResponder, error) {
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to join mDNS group")
+	}
+	return newMDNSResponder(conn, service, port, has), nil
+}
+
+func newMDNSResponder(conn *net.UDPConn, service string, port int,
+	has func(instance string) bool) *MDNSResponder {
+
+	target := "mender"
+	if host, err := os.Hostname(); err == nil && host != "" {
+		target = strings.Split(host, ".")[0]
+	}
+	r := &MDNSResponder{
+		conn:    conn,
+		service: service,
+		port:    uint16(port),
+		target:  target + ".local.",
+		has:     has,
+		done:    make(chan struct{}),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *MDNSResponder) serve() {
+	defer close(r.done)
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		resp, unicast := r.respond(buf[:n], from.Port != mdnsAddr.Port)
+		if resp == nil {
+			continue
+		}
+		to := mdnsAddr
+		if unicast {
+			to = from
+		}
+		if _, err := r.conn.WriteToUDP(resp.pack(), to); err != nil {
+			log.Debugf("failed to answer mDNS query of %s: %v", from, err)
+		}
+	}
+}
+
+// respond returns the response to the query in msg, or nil if none of the
+// instances asked for is provided by the device, and whether it is sent to
+// the sender only: if asked for, or if the query is a legacy one, not sent
+// from the mDNS port, which repeats the ID and the questions of the query.
+func (r *MDNSResponder) respond(msg []byte, legacy bool) (*dnsMessage, bool) {
+	query, err := parseDNSMessage(msg)
+	if err != nil || query.flags&dnsFlagResponse != 0 {
+		return nil, false
+	}
+	suffix := mdnsName(r.service, "")
+	resp := &dnsMessage{id: query.id, flags: dnsFlagResponse | dnsFlagAuthoritative}
+	unicast := legacy
+	for _, q := range query.questions {
+		if q.qtype != dnsTypeSRV || q.qclass&^dnsClassTopBit != dnsClassIN ||
+			!strings.HasSuffix(q.name, suffix) {
+			continue
+		}
+		instance := strings.TrimSuffix(q.name, suffix)
+		if strings.Contains(instance, ".") || !r.has(instance) {
+			continue
+		}
+		unicast = unicast || q.qclass&dnsClassTopBit != 0
+		resp.questions = append(resp.questions, dnsQuestion{
+			name: q.name, qtype: dnsTypeSRV, qclass: dnsClassIN})
+		resp.answers = append(resp.answers, dnsSRV{
+			name: q.name, port: r.port, target: r.target})
+	}
+	if resp.answers == nil {
+		return nil, false
+	}
+	if !legacy {
+		resp.id = 0
+		resp.questions = nil
+	}
+	return resp, unicast
+}
+
+func (r *MDNSResponder) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.conn.Close()
+		<-r.done
+	})
+	return err
+}
+
+// LookupMDNS queries the local network for instance of service, returning
+// the addresses, as host:port, of the devices providing it which answered
+// within timeout.
+func LookupMDNS(ctx context.Context, service, instance string,
+	timeout time.Duration) ([]string, error) {
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open mDNS query socket")
+	}
+	defer conn.Close()
+
+	name := mdnsName(service, instance)
+	query := dnsMessage{
+		id: uint16(time.Now().UnixNano()),
+		questions: []dnsQuestion{{
+			name:   name,
+			qtype:  dnsTypeSRV,
+			qclass: dnsClassIN | dnsClassTopBit,
+		}},
+	}
+	if _, err := conn.WriteToUDP(query.pack(), mdnsAddr); err != nil {
+		return nil, errors.Wrapf(err, "failed to send mDNS query")
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	conn.SetReadDeadline(deadline)
+
+	var addrs []string
+	seen := make(map[string]bool)
+	buf := make([]byte, mdnsMaxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return addrs, ctx.Err()
+			}
+			return addrs, errors.Wrapf(err, "failed to read mDNS responses")
+		}
+		resp, err := parseDNSMessage(buf[:n])
+		if err != nil || resp.flags&dnsFlagResponse == 0 {
+			continue
+		}
+		for _, a := range resp.answers {
+			if a.name != name {
+				continue
+			}
+			addr := net.JoinHostPort(from.IP.String(), strconv.Itoa(int(a.port)))
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessage(t *testing.T) {
+	m := dnsMessage{
+		id:        42,
+		flags:     dnsFlagResponse,
+		questions: []dnsQuestion{{name: "a1._test._tcp.local.", qtype: dnsTypeSRV, qclass: dnsClassIN}},
+		answers:   []dnsSRV{{name: "a1._test._tcp.local.", port: 8443, target: "device.local."}},
+	}
+	parsed, err := parseDNSMessage(m.pack())
+	require.NoError(t, err)
+	assert.Equal(t, &m, parsed)
+
+	// names compressed with pointers
+	msg := m.pack()[:12]
+	msg = packName(msg, "a1._test._tcp.local.")
+	msg = append(msg, 0, dnsTypeSRV, 0, dnsClassIN)
+	msg = append(msg, 0xc0, 12, 0, dnsTypeSRV, 0, dnsClassIN, 0, 0, 0, 10, 0, 8,
+		0, 0, 0, 0, 0x20, 0xfb, 0xc0, 15)
+	parsed, err = parseDNSMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []dnsSRV{{name: "a1._test._tcp.local.", port: 8443,
+		target: "_test._tcp.local."}}, parsed.answers)
+
+	// pointer loops and truncated messages
+	_, err = parseDNSMessage(append(msg[:len(msg)-2], 0xc0, byte(len(msg)-2)))
+	assert.Error(t, err)
+	_, err = parseDNSMessage(msg[:len(msg)-3])
+	assert.Error(t, err)
+	_, err = parseDNSMessage(msg[:8])
+	assert.Error(t, err)
+}
+
+func TestMDNSRespond(t *testing.T) {
+	r := &MDNSResponder{service: "_test._tcp", port: 8443, target: "device.local.",
+		has: func(instance string) bool { return instance == "a1" }}
+	query := func(qclass uint16, names ...string) []byte {
+		m := dnsMessage{id: 7}
+		for _, name := range names {
+			m.questions = append(m.questions, dnsQuestion{name: name,
+				qtype: dnsTypeSRV, qclass: qclass})
+		}
+		return m.pack()
+	}
+
+	resp, unicast := r.respond(query(dnsClassIN, "A1._test._tcp.local.",
+		"a2._test._tcp.local."), true)
+	require.NotNil(t, resp)
+	assert.True(t, unicast)
+	assert.Equal(t, uint16(7), resp.id)
+	assert.Equal(t, []dnsQuestion{{name: "a1._test._tcp.local.", qtype: dnsTypeSRV,
+		qclass: dnsClassIN}}, resp.questions)
+	assert.Equal(t, []dnsSRV{{name: "a1._test._tcp.local.", port: 8443,
+		target: "device.local."}}, resp.answers)
+
+	// queries from the mDNS port are answered to the group, unless asked not
+	// to
+	resp, unicast = r.respond(query(dnsClassIN, "a1._test._tcp.local."), false)
+	require.NotNil(t, resp)
+	assert.False(t, unicast)
+	assert.Equal(t, uint16(0), resp.id)
+	assert.Nil(t, resp.questions)
+	_, unicast = r.respond(query(dnsClassIN|dnsClassTopBit, "a1._test._tcp.local."), false)
+	assert.True(t, unicast)
+
+	for _, msg := range [][]byte{
+		query(dnsClassIN, "a2._test._tcp.local."),
+		query(dnsClassIN, "a1._other._tcp.local."),
+		query(dnsClassIN, "x.a1._test._tcp.local."),
+		resp.pack(),
+		[]byte("bogus"),
+	} {
+		resp, _ := r.respond(msg, true)
+		assert.Nil(t, resp)
+	}
+}
+
+func TestMDNSLookup(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	oldAddr := mdnsAddr
+	mdnsAddr = conn.LocalAddr().(*net.UDPAddr)
+	defer func() { mdnsAddr = oldAddr }()
+
+	r := newMDNSResponder(conn, "_test._tcp", 8443,
+		func(instance string) bool { return instance == "a1" })
+	defer r.Close()
+
+	addrs, err := LookupMDNS(context.Background(), "_test._tcp", "a1", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:8443"}, addrs)
+
+	addrs, err = LookupMDNS(context.Background(), "_test._tcp", "a2", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, addrs)
+
+	// canceled before the time is up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err = LookupMDNS(ctx, "_test._tcp", "a1", 10*time.Second)
+	assert.Error(t, err)
+	assert.WithinDuration(t, time.Now(), start, time.Second)
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MQTT control packet types (MQTT 3.1.1, section 2.2.1); only what a
+// subscriber needs is supported.
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttMaxPacket   = 1 << 20
+	mqttSubscribeID = 1
+)
+
+// MQTTSubscription describes the topic to subscribe to at an MQTT broker.
+type MQTTSubscription struct {
+	// tcp://host:1883 or ssl://host:8883; the TLS settings of the client
+	// apply to the latter
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	// interval of the keep alive pings; one minute if zero
+	KeepAlive time.Duration
+}
+
+// MQTTMessage is a message published to the subscribed topic.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// SubscribeMQTT subscribes to the topic, passing the messages published to it
+// on to handle until ctx is done or the connection is lost. Messages are
+// received with QoS 1 at most.
+func (a *ApiClient) SubscribeMQTT(ctx context.Context, sub MQTTSubscription,
+	handle func(MQTTMessage)) error {
+
+	u, err := url.Parse(sub.Broker)
+	if err != nil {
+		return errors.Wrapf(err, "invalid MQTT broker URL")
+	}
+	var secure bool
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "mqtts":
+		secure = true
+	default:
+		return errors.Errorf("unsupported MQTT broker URL %s", sub.Broker)
+	}
+	host := hostPort(u, "1883")
+	if secure {
+		host = hostPort(u, "8883")
+	}
+	keepAlive := sub.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = time.Minute
+	}
+
+	conn, err := a.dialConn(ctx, host, u.Hostname(), secure, []string{"mqtt"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the connection is dropped once ctx is done, ending the reads
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	mc := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+	// the broker has one and a half keep alive intervals to answer
+	conn.SetDeadline(time.Now().Add(keepAlive * 3 / 2))
+	if err := mc.connect(sub, keepAlive); err != nil {
+		return mc.err(ctx, err)
+	}
+	if err := mc.subscribe(sub.Topic); err != nil {
+		return mc.err(ctx, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	go mc.ping(keepAlive, stop)
+	for {
+		conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		packetType, flags, body, err := mc.readPacket()
+		if err != nil {
+			return mc.err(ctx, err)
+		}
+		switch packetType {
+		case mqttPublish:
+			msg, id, err := parseMQTTPublish(flags, body)
+			if err != nil {
+				return err
+			}
+			if id != 0 {
+				ack := make([]byte, 2)
+				binary.BigEndian.PutUint16(ack, id)
+				if err := mc.writePacket(mqttPubAck<<4, ack); err != nil {
+					return mc.err(ctx, err)
+				}
+			}
+			handle(msg)
+		case mqttPingResp:
+		default:
+			return errors.Errorf("unexpected MQTT packet type %d", packetType)
+		}
+	}
+}
+
+type mqttConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	wlock sync.Mutex
+}
+
+// err returns the error of ctx instead of the one caused by dropping the
+// connection.
+func (mc *mqttConn) err(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func (mc *mqttConn) connect(sub MQTTSubscription, keepAlive time.Duration) error {
+	// clean session, so that nothing is left at the broker to reconnect to
+	flags := byte(0x02)
+	body := append(mqttString("MQTT"), 4, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(keepAlive/time.Second))
+	body = append(body, mqttString(sub.ClientID)...)
+	if sub.Username != "" {
+		flags |= 0x80
+		body = append(body, mqttString(sub.Username)...)
+		if sub.Password != "" {
+			flags |= 0x40
+			body = append(body, mqttString(sub.Password)...)
+		}
+	}
+	body[7] = flags
+	if err := mc.writePacket(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	packetType, _, ack, err := mc.readPacket()
+	if err != nil {
+		return errors.Wrapf(err, "MQTT connect failed")
+	}
+	if packetType != mqttConnAck || len(ack) != 2 {
+		return errors.New("MQTT connect failed: invalid response")
+	}
+	if ack[1] != 0 {
+		return errors.Errorf("MQTT broker refused the connection, code %d", ack[1])
+	}
+	return nil
+}
+
+func (mc *mqttConn) subscribe(topic string) error {
+	body := []byte{0, mqttSubscribeID}
+	body = append(body, mqttString(topic)...)
+	body = append(body, 1)
+	if err := mc.writePacket(mqttSubscribe<<4|0x2, body); err != nil {
+		return err
+	}
+
+	packetType, _, ack, err := mc.readPacket()
+	if err != nil {
+		return errors.Wrapf(err, "MQTT subscribe failed")
+	}
+	if packetType != mqttSubAck || len(ack) != 3 {
+		return errors.New("MQTT subscribe failed: invalid response")
+	}
+	if ack[2] == 0x80 {
+		return errors.Errorf("MQTT broker refused subscription to %s", topic)
+	}
+	return nil
+}
+
+func (mc *mqttConn) ping(interval time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+			if err := mc.writePacket(mqttPingReq<<4, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (mc *mqttConn) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	mc.wlock.Lock()
+	defer mc.wlock.Unlock()
+	_, err := mc.conn.Write(packet)
+	return err
+}
+
+func (mc *mqttConn) readPacket() (byte, byte, []byte, error) {
+	header, err := mc.r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var n, shift uint
+	for i := 0; ; i++ {
+		b, err := mc.r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if i == 4 {
+			return 0, 0, nil, errors.New("invalid MQTT packet length")
+		}
+		n |= uint(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, 0, nil, errors.Errorf("MQTT packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(mc.r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// parseMQTTPublish returns the message and, if it has to be acknowledged, the
+// packet identifier.
+func parseMQTTPublish(flags byte, body []byte) (MQTTMessage, uint16, error) {
+	var msg MQTTMessage
+	if len(body) < 2 {
+		return msg, 0, errors.New("invalid MQTT publish packet")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return msg, 0, errors.New("invalid MQTT publish packet")
+	}
+	msg.Topic = string(body[2 : 2+n])
+	body = body[2+n:]
+
+	var id uint16
+	if qos := (flags >> 1) & 0x3; qos > 0 {
+		if qos > 1 {
+			return msg, 0, errors.New("MQTT QoS 2 is not supported")
+		}
+		if len(body) < 2 {
+			return msg, 0, errors.New("invalid MQTT publish packet")
+		}
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	msg.Payload = body
+	return msg, id, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMQTTBroker accepts one subscriber, publishing the messages to it.
+func testMQTTBroker(t *testing.T, connAck byte, publish []MQTTMessage) (string, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// packets received from the subscriber
+	received := make(chan []byte, 10)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mc := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+		readPacket := func() (byte, []byte) {
+			packetType, _, body, err := mc.readPacket()
+			if err != nil {
+				return 0, nil
+			}
+			received <- append([]byte{packetType}, body...)
+			return packetType, body
+		}
+		if packetType, _ := readPacket(); packetType != mqttConnect {
+			return
+		}
+		mc.writePacket(mqttConnAck<<4, []byte{0, connAck})
+		packetType, body := readPacket()
+		if packetType != mqttSubscribe {
+			return
+		}
+		mc.writePacket(mqttSubAck<<4, []byte{body[0], body[1], 1})
+		for i, msg := range publish {
+			body := append(mqttString(msg.Topic), 0, byte(i+1))
+			mc.writePacket(mqttPublish<<4|0x2, append(body, msg.Payload...))
+		}
+		for {
+			if packetType, _ := readPacket(); packetType == 0 {
+				return
+			}
+		}
+	}()
+	return "tcp://" + l.Addr().String(), received
+}
+
+func TestSubscribeMQTT(t *testing.T) {
+	broker, received := testMQTTBroker(t, 0, []MQTTMessage{
+		{Topic: "devices/1/deployments", Payload: []byte("available")},
+	})
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := make(chan MQTTMessage, 1)
+	errs := make(chan error)
+	go func() {
+		errs <- ac.SubscribeMQTT(ctx, MQTTSubscription{
+			Broker:   broker,
+			ClientID: "device-1",
+			Username: "device",
+			Password: "token",
+			Topic:    "devices/1/deployments",
+		}, func(msg MQTTMessage) {
+			msgs <- msg
+		})
+	}()
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "devices/1/deployments", msg.Topic)
+		assert.Equal(t, "available", string(msg.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	connect := <-received
+	assert.Equal(t, byte(mqttConnect), connect[0])
+	assert.True(t, bytes.Contains(connect, []byte("device-1")))
+	assert.True(t, bytes.Contains(connect, []byte("token")))
+	subscribe := <-received
+	assert.True(t, bytes.HasSuffix(subscribe, append([]byte("devices/1/deployments"), 1)))
+	// the message is acknowledged
+	assert.Equal(t, []byte{mqttPubAck, 0, 1}, <-received)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSubscribeMQTTRefused(t *testing.T) {
+	broker, _ := testMQTTBroker(t, 5, nil)
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	err = ac.SubscribeMQTT(context.Background(), MQTTSubscription{
+		Broker: broker,
+		Topic:  "deployments",
+	}, func(MQTTMessage) {})
+	assert.EqualError(t, err, "MQTT broker refused the connection, code 5")
+
+	err = ac.SubscribeMQTT(context.Background(), MQTTSubscription{
+		Broker: "http://broker",
+	}, func(MQTTMessage) {})
+	assert.Error(t, err)
+}
+
+func TestParseMQTTPublish(t *testing.T) {
+	msg, id, err := parseMQTTPublish(0, append(mqttString("topic"), "payload"...))
+	require.NoError(t, err)
+	assert.Equal(t, MQTTMessage{Topic: "topic", Payload: []byte("payload")}, msg)
+	assert.Equal(t, uint16(0), id)
+
+	_, _, err = parseMQTTPublish(0x4, append(mqttString("topic"), 0, 1))
+	assert.Error(t, err)
+	_, _, err = parseMQTTPublish(0, []byte{0, 10, 't'})
+	assert.Error(t, err)
+}
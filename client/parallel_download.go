@@ -0,0 +1,228 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Size of the ranges of parallel downloads, unless configured otherwise.
+const DefaultParallelChunkSize int64 = 8 * 1024 * 1024
+
+// Attempts of fetching a range from each of the URLs of a parallel download.
+const parallelChunkAttempts = 2
+
+// ParallelDownload configures downloading artifacts in ranges fetched in
+// parallel.
+type ParallelDownload struct {
+	// ranges fetched at a time
+	Connections int
+	// size of the ranges, in bytes
+	ChunkSize int64
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// parallelDownload reads an artifact of known size in ranges fetched in
+// parallel, in turn from each of its URLs, and passes them on in order.
+// At most twice as many ranges as there are connections are kept in memory.
+type parallelDownload struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	api       ApiRequester
+	urls      []string
+	size      int64
+	chunkSize int64
+
+	// the download already started, from the first URL, read for the first
+	// range
+	first     io.ReadCloser
+	closeOnce sync.Once
+
+	chunks []chan chunkResult
+	// slots of the ranges fetched but not read yet
+	window chan struct{}
+	conns  chan struct{}
+
+	next int
+	cur  []byte
+	err  error
+}
+
+// NewParallelDownload returns the artifact of size bytes at urls, all of which
+// must serve the same artifact and support range requests. The download
+// already started from urls[0], first, is used for the first range.
+func NewParallelDownload(ctx context.Context, api ApiRequester, first io.ReadCloser,
+	urls []string, size int64, conf ParallelDownload) io.ReadCloser {
+
+	if conf.ChunkSize <= 0 {
+		conf.ChunkSize = DefaultParallelChunkSize
+	}
+	if conf.Connections < 1 {
+		conf.Connections = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &parallelDownload{
+		ctx:       ctx,
+		cancel:    cancel,
+		api:       api,
+		urls:      urls,
+		size:      size,
+		chunkSize: conf.ChunkSize,
+		first:     first,
+		chunks:    make([]chan chunkResult, (size+conf.ChunkSize-1)/conf.ChunkSize),
+		window:    make(chan struct{}, 2*conf.Connections),
+		conns:     make(chan struct{}, conf.Connections),
+	}
+	for i := range p.chunks {
+		p.chunks[i] = make(chan chunkResult, 1)
+	}
+	go p.dispatch()
+	return p
+}
+
+func (p *parallelDownload) dispatch() {
+	for i := range p.chunks {
+		select {
+		case p.window <- struct{}{}:
+		case <-p.ctx.Done():
+			return
+		}
+		go p.fetch(i)
+	}
+}
+
+func (p *parallelDownload) fetch(i int) {
+	select {
+	case p.conns <- struct{}{}:
+		defer func() { <-p.conns }()
+	case <-p.ctx.Done():
+		p.chunks[i] <- chunkResult{err: p.ctx.Err()}
+		return
+	}
+
+	start := int64(i) * p.chunkSize
+	length := p.chunkSize
+	if start+length > p.size {
+		length = p.size - start
+	}
+	var err error
+	for attempt := 0; attempt < len(p.urls)*parallelChunkAttempts; attempt++ {
+		if p.ctx.Err() != nil {
+			err = p.ctx.Err()
+			break
+		}
+		var data []byte
+		url := p.urls[(i+attempt)%len(p.urls)]
+		if i == 0 && attempt == 0 {
+			data, err = readChunk(p.first, length)
+			p.closeFirst()
+		} else {
+			data, err = p.fetchRange(url, start, length)
+		}
+		if err == nil {
+			p.chunks[i] <- chunkResult{data: data}
+			return
+		}
+		log.Warnf("failed to download bytes %d-%d of the update from %s: %v",
+			start, start+length-1, url, err)
+	}
+	p.chunks[i] <- chunkResult{err: errors.Wrapf(err,
+		"failed to download bytes %d-%d of the update", start, start+length-1)}
+}
+
+func (p *parallelDownload) fetchRange(url string, start, length int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(downloadContext(p.ctx))
+	end := start + length - 1
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	r, err := p.api.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf("unexpected status %d of range request", r.StatusCode)
+	}
+	// all the URLs must serve the same artifact
+	expected := fmt.Sprintf("bytes %d-%d/%d", start, end, p.size)
+	if cr := r.Header.Get("Content-Range"); cr != expected {
+		return nil, errors.Errorf("unexpected Content-Range %q, expected %q", cr, expected)
+	}
+	return readChunk(r.Body, length)
+}
+
+func readChunk(r io.Reader, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (p *parallelDownload) closeFirst() {
+	p.closeOnce.Do(func() {
+		p.first.Close()
+	})
+}
+
+func (p *parallelDownload) Read(buf []byte) (int, error) {
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.next == len(p.chunks) {
+			return 0, io.EOF
+		}
+		// the previous range has been read
+		if p.next > 0 {
+			<-p.window
+		}
+		var res chunkResult
+		select {
+		case res = <-p.chunks[p.next]:
+		case <-p.ctx.Done():
+			res.err = p.ctx.Err()
+		}
+		if res.err != nil {
+			p.err = res.err
+			continue
+		}
+		p.cur = res.data
+		p.next++
+	}
+	n := copy(buf, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+func (p *parallelDownload) Close() error {
+	p.cancel()
+	p.closeFirst()
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelDownload(t *testing.T) {
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	var mutex sync.Mutex
+	requests := map[string]int{}
+	serve := func(name string, data []byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			requests[name]++
+			mutex.Unlock()
+			http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(data))
+		}))
+	}
+	origin := serve("origin", content)
+	defer origin.Close()
+	mirror := serve("mirror", content)
+	defer mirror.Close()
+	// serving another artifact
+	other := serve("other", content[:5000])
+	defer other.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	download := func(urls ...string) ([]byte, error) {
+		// the download already started from the first URL
+		first := ioutil.NopCloser(bytes.NewReader(content))
+		r := NewParallelDownload(context.Background(), http.DefaultClient, first, urls,
+			int64(len(content)), ParallelDownload{Connections: 3, ChunkSize: 1000})
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	// the ranges after the first are fetched in turn from the URLs
+	data, err := download(origin.URL, mirror.URL)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, map[string]int{"origin": 4, "mirror": 5}, requests)
+
+	// falling back to the other URLs
+	data, err = download(broken.URL, other.URL, mirror.URL)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	_, err = download(origin.URL, broken.URL, other.URL)
+	assert.NoError(t, err)
+	_, err = download(broken.URL, other.URL)
+	assert.Error(t, err)
+}
+
+func TestParallelDownloadClose(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	first := ioutil.NopCloser(bytes.NewReader(make([]byte, 100)))
+	r := NewParallelDownload(context.Background(), http.DefaultClient, first,
+		[]string{srv.URL}, 1000, ParallelDownload{Connections: 2, ChunkSize: 100})
+	buf := make([]byte, 200)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+
+	// the ranges in progress are canceled
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(buf)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download not canceled")
+	}
+}
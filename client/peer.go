@@ -0,0 +1,142 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Path artifacts are shared with peers under, by their names.
+const PeerArtifactsPath = "/v1/artifacts/"
+
+// PeerTLS authenticates the devices sharing artifacts on the local network
+// to each other: both the devices serving artifacts and those downloading
+// them authenticate with their client certificates, signed by the CA the
+// fleet shares. The names of the peers are not checked, as they are only
+// known by their addresses.
+type PeerTLS struct {
+	cert  *clientCertificate
+	roots *x509.CertPool
+}
+
+// NewPeerTLS loads the client certificate of conf, and the certificates of
+// the CA of the peers from caFile.
+func NewPeerTLS(conf Config, caFile string) (*PeerTLS, error) {
+	cert, err := newClientCertificate(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load client certificate")
+	}
+	if cert == nil {
+		return nil, errors.New("client certificate required for sharing artifacts with peers")
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA certificate of peers")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", caFile)
+	}
+	return &PeerTLS{cert: cert, roots: roots}, nil
+}
+
+// ServerConfig returns the TLS configuration of serving artifacts to peers.
+func (p *PeerTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.cert.get(nil)
+		},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  p.roots,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// verifyPeer checks the certificate chain of a peer serving artifacts,
+// without its name.
+func (p *PeerTLS) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Wrapf(err, "invalid certificate of peer")
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		// certificates of devices are issued for authenticating clients
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return errors.Wrapf(err, "untrusted certificate of peer")
+}
+
+// client returns the HTTP client of downloading artifacts from peers,
+// directly rather than through the proxies of the server.
+func (p *PeerTLS) client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				GetClientCertificate: p.cert.get,
+				// verified by verifyPeer instead, without the name
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: p.verifyPeer,
+				MinVersion:            tls.VersionTLS12,
+			},
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+// FetchPeerArtifact starts downloading the artifact of the given name from
+// the peer at addr, host:port, returning it with its size. The connection and
+// the response headers take timeout at most; the download is aborted once
+// ctx is done.
+func (p *PeerTLS) FetchPeerArtifact(ctx context.Context, addr, artifactName string,
+	timeout time.Duration) (io.ReadCloser, int64, error) {
+
+	u := url.URL{Scheme: "https", Host: addr,
+		Path: PeerArtifactsPath + artifactName}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "failed to create peer download request")
+	}
+	r, err := p.client(timeout).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "failed to download artifact from peer %s", addr)
+	}
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, -1, errors.Errorf("peer %s answered with status %d", addr, r.StatusCode)
+	}
+	return r.Body, r.ContentLength, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePeerCert writes a device certificate signed by ca, and its key, to a
+// directory below dir named after the device.
+func writePeerCert(t *testing.T, dir, name string, ca *testCert) Config {
+	cert := newTestCert(t, 2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.key)
+	require.NoError(t, err)
+
+	dir = filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	conf := Config{
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+	require.NoError(t, ioutil.WriteFile(conf.ClientCert, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: cert.cert.Raw}), 0600))
+	require.NoError(t, ioutil.WriteFile(conf.ClientKey, pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return conf
+}
+
+func writeCACert(t *testing.T, dir, name string, ca *testCert) string {
+	file := filepath.Join(dir, name+".crt")
+	require.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	return file
+}
+
+func servePeer(t *testing.T, p *PeerTLS) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(PeerArtifactsPath+"release 1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("artifact"))
+	})
+	server := &http.Server{Handler: mux, TLSConfig: p.ServerConfig()}
+	go server.ServeTLS(l, "", "")
+	return l.Addr().String(), func() { server.Close() }
+}
+
+func TestPeerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "fleet")
+	caFile := writeCACert(t, dir, "fleet", ca)
+	serving, err := NewPeerTLS(writePeerCert(t, dir, "serving", ca), caFile)
+	require.NoError(t, err)
+	fetching, err := NewPeerTLS(writePeerCert(t, dir, "fetching", ca), caFile)
+	require.NoError(t, err)
+
+	addr, stop := servePeer(t, serving)
+	defer stop()
+
+	r, size, err := fetching.FetchPeerArtifact(context.Background(), addr, "release 1",
+		time.Second)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "artifact", string(data))
+	assert.Equal(t, int64(len(data)), size)
+
+	_, _, err = fetching.FetchPeerArtifact(context.Background(), addr, "release 2",
+		time.Second)
+	assert.Error(t, err)
+
+	// devices of other fleets are neither served nor downloaded from
+	other := newTestCA(t, "other")
+	otherFile := writeCACert(t, dir, "other", other)
+	rogue, err := NewPeerTLS(writePeerCert(t, dir, "rogue", other), otherFile)
+	require.NoError(t, err)
+	_, _, err = rogue.FetchPeerArtifact(context.Background(), addr, "release 1",
+		time.Second)
+	assert.Error(t, err)
+
+	rogueAddr, stopRogue := servePeer(t, rogue)
+	defer stopRogue()
+	_, _, err = fetching.FetchPeerArtifact(context.Background(), rogueAddr, "release 1",
+		time.Second)
+	assert.Error(t, err)
+
+	// a client certificate is required
+	_, err = NewPeerTLS(Config{}, caFile)
+	assert.Error(t, err)
+	_, err = NewPeerTLS(writePeerCert(t, dir, "device", ca), filepath.Join(dir, "none.crt"))
+	assert.Error(t, err)
+}
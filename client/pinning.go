@@ -0,0 +1,82 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// PublicKeyPin is the SHA-256 hash of the DER encoded SubjectPublicKeyInfo of
+// a certificate, as pinned in HTTP Public Key Pinning (RFC 7469).
+type PublicKeyPin [sha256.Size]byte
+
+// ErrPublicKeyPinMismatch is returned for connections to servers none of the
+// certificates of which have a pinned public key.
+var ErrPublicKeyPinMismatch = errors.New("server public key does not match any pinned key")
+
+// ParsePublicKeyPins parses pins given as base64 encoded hashes, optionally
+// prefixed with "sha256/" as in `openssl x509 -pubkey | openssl pkey -pubin
+// -outform der | openssl dgst -sha256 -binary | base64`.
+func ParsePublicKeyPins(pins []string) ([]PublicKeyPin, error) {
+	var parsed []PublicKeyPin
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, errors.Errorf("invalid public key pin %q, expecting "+
+				"a base64 encoded SHA-256 hash", pin)
+		}
+		var p PublicKeyPin
+		copy(p[:], hash)
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+func publicKeyPin(cert *x509.Certificate) PublicKeyPin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// verifyPublicKeyPins returns the tls.Config.VerifyConnection function
+// refusing connections unless a certificate of the verified chain has one of
+// the pinned keys. With verification disabled only the server certificate
+// itself is checked. Several pins allow rotating keys.
+func verifyPublicKeyPins(pins []PublicKeyPin) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var certs []*x509.Certificate
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+		for _, cert := range certs {
+			pin := publicKeyPin(cert)
+			for _, p := range pins {
+				if p == pin {
+					return nil
+				}
+			}
+		}
+		log.Errorf("Public key of server %q is not pinned; refusing to connect.",
+			cs.ServerName)
+		return ErrPublicKeyPinMismatch
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePublicKeyPins(t *testing.T) {
+	hash := sha256.Sum256([]byte("key"))
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+
+	pins, err := ParsePublicKeyPins([]string{pin, "sha256/" + pin})
+	assert.NoError(t, err)
+	assert.Equal(t, []PublicKeyPin{hash, hash}, pins)
+
+	pins, err = ParsePublicKeyPins(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, pins)
+
+	_, err = ParsePublicKeyPins([]string{"not base64!"})
+	assert.Error(t, err)
+	_, err = ParsePublicKeyPins([]string{base64.StdEncoding.EncodeToString([]byte("short"))})
+	assert.Error(t, err)
+}
+
+func TestPublicKeyPinning(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pinning")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ts.Certificate().Raw,
+	}), 0600))
+
+	serverPin := publicKeyPin(ts.Certificate())
+	otherPin := PublicKeyPin(sha256.Sum256([]byte("other key")))
+
+	get := func(conf Config) error {
+		conf.ServerURL = ts.URL
+		ac, err := New(conf)
+		require.NoError(t, err)
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		rsp, err := ac.Do(req)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+
+	// the trusted server has a pinned key, the second pin being for rotation
+	assert.NoError(t, get(Config{ServerCert: certFile,
+		PublicKeyPins: []PublicKeyPin{otherPin, serverPin}}))
+	assert.NoError(t, get(Config{NoVerify: true,
+		PublicKeyPins: []PublicKeyPin{serverPin}}))
+
+	// a trusted server with another key is refused
+	err = get(Config{ServerCert: certFile,
+		PublicKeyPins: []PublicKeyPin{otherPin}})
+	assert.Error(t, err)
+	assert.Contains(t, errors.Cause(err).Error(), ErrPublicKeyPinMismatch.Error())
+	assert.Error(t, get(Config{NoVerify: true,
+		PublicKeyPins: []PublicKeyPin{otherPin}}))
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSignerStable(t *testing.T) {
+	s := NewRequestSigner("key-1", []byte("secret"))
+	ts := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return ts }
+
+	sign := func(body string) http.Header {
+		req, err := http.NewRequest(http.MethodPut,
+			"https://foo.bar/api/devices/v1/foo?bar=baz",
+			bytes.NewBufferString(body))
+		require.NoError(t, err)
+		require.NoError(t, s.Sign(req))
+
+		// body must still be readable after signing
+		data, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(data))
+		return req.Header
+	}
+
+	h1 := sign("some data")
+	h2 := sign("some data")
+	assert.Equal(t, "key-1", h1.Get(SignatureKeyIDHeader))
+	assert.Equal(t, "1500000000", h1.Get(SignatureTimestampHeader))
+	assert.NotEmpty(t, h1.Get(SignatureHeader))
+	assert.Equal(t, h1.Get(SignatureHeader), h2.Get(SignatureHeader))
+
+	assert.Equal(t,
+		s.signature(http.MethodPut, "/api/devices/v1/foo?bar=baz",
+			"1500000000", []byte("some data")),
+		h1.Get(SignatureHeader))
+
+	// different body yields different signature
+	h3 := sign("other data")
+	assert.NotEqual(t, h1.Get(SignatureHeader), h3.Get(SignatureHeader))
+
+	// as does a different secret
+	s2 := NewRequestSigner("key-1", []byte("other secret"))
+	s2.now = s.now
+	req, _ := http.NewRequest(http.MethodPut,
+		"https://foo.bar/api/devices/v1/foo?bar=baz",
+		bytes.NewBufferString("some data"))
+	assert.NoError(t, s2.Sign(req))
+	assert.NotEqual(t, h1.Get(SignatureHeader), req.Header.Get(SignatureHeader))
+}
+
+func TestRequestSignerTimestamp(t *testing.T) {
+	s := NewRequestSigner("key-1", []byte("secret"))
+
+	req, _ := http.NewRequest(http.MethodGet, "https://foo.bar/", nil)
+	before := time.Now().Unix()
+	assert.NoError(t, s.Sign(req))
+	after := time.Now().Unix()
+
+	ts, err := strconv.ParseInt(req.Header.Get(SignatureTimestampHeader), 10, 64)
+	assert.NoError(t, err)
+	assert.True(t, ts >= before && ts <= after)
+}
+
+func TestApiClientSignsRequests(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = ac.Do(req)
+	assert.NoError(t, err)
+	assert.Empty(t, headers.Get(SignatureHeader))
+
+	ac, err = NewApiClient(Config{
+		SigningKeyID:  "key-1",
+		SigningSecret: "secret",
+	})
+	require.NoError(t, err)
+
+	// signing composes with the authorization header set by ApiRequest
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = ac.Request("token", dummy).Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", headers.Get(SignatureKeyIDHeader))
+	assert.NotEmpty(t, headers.Get(SignatureTimestampHeader))
+	assert.NotEmpty(t, headers.Get(SignatureHeader))
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+
+	// as are requests sent through the embedded http.Client, which are
+	// left as they are
+	headers = nil
+	req, _ = http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("body"))
+	_, err = ac.Client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", headers.Get(SignatureKeyIDHeader))
+	assert.NotEmpty(t, headers.Get(SignatureHeader))
+	assert.Equal(t, "application/json", headers.Get("Accept"))
+	assert.Empty(t, req.Header.Get(SignatureHeader))
+}
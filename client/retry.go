@@ -0,0 +1,73 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrRetryAttemptsExceeded = errors.New("maximum number of retry attempts exceeded")
+	ErrRetryTimeExceeded     = errors.New("maximum retry time exceeded")
+)
+
+// RetryPolicy describes how failed requests to the server, such as update
+// checks and artifact downloads, are retried. Intervals follow
+// GetExponentialBackoffTime, optionally randomized by Jitter.
+type RetryPolicy struct {
+	// Upper bound of a single backoff interval.
+	MaxInterval time.Duration
+	// Maximum number of retries; zero means that only the backoff scheme
+	// limits the number of attempts.
+	MaxAttempts int
+	// Retrying stops once waiting for the next attempt would exceed this
+	// much time since the first failure; zero disables the limit.
+	MaxElapsedTime time.Duration
+	// Fraction, between 0 and 1, of the interval by which it may be randomly
+	// shortened or extended.
+	Jitter float64
+}
+
+// NextInterval returns the time to wait before the next attempt, given the
+// number of attempts done so far and the time elapsed since the first failure.
+// An error is returned if no more attempts should be made.
+func (p RetryPolicy) NextInterval(tried int, elapsed time.Duration) (time.Duration, error) {
+	if p.MaxAttempts > 0 && tried >= p.MaxAttempts {
+		return 0, ErrRetryAttemptsExceeded
+	}
+
+	intvl, err := GetExponentialBackoffTime(tried, p.MaxInterval)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delta := int64(jitter * float64(intvl))
+		if delta > 0 {
+			intvl += time.Duration(rand.Int63n(2*delta+1) - delta)
+		}
+	}
+
+	if p.MaxElapsedTime > 0 && elapsed+intvl > p.MaxElapsedTime {
+		return 0, ErrRetryTimeExceeded
+	}
+	return intvl, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	// without limits the policy follows the plain backoff scheme
+	p := RetryPolicy{MaxInterval: 2 * time.Minute}
+	for i := 0; i < 6; i++ {
+		intvl, err := p.NextInterval(i, 0)
+		exp, expErr := GetExponentialBackoffTime(i, p.MaxInterval)
+		assert.Equal(t, exp, intvl)
+		assert.Equal(t, expErr, err)
+	}
+	_, err := p.NextInterval(6, 0)
+	assert.Error(t, err)
+
+	// max attempts
+	p.MaxAttempts = 2
+	_, err = p.NextInterval(1, 0)
+	assert.NoError(t, err)
+	_, err = p.NextInterval(2, 0)
+	assert.Equal(t, ErrRetryAttemptsExceeded, err)
+
+	// max elapsed time
+	p = RetryPolicy{
+		MaxInterval:    10 * time.Minute,
+		MaxElapsedTime: 10 * time.Minute,
+	}
+	intvl, err := p.NextInterval(0, 9*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, intvl)
+	_, err = p.NextInterval(0, 9*time.Minute+time.Second)
+	assert.Equal(t, ErrRetryTimeExceeded, err)
+
+	// jitter keeps the interval within bounds
+	p = RetryPolicy{
+		MaxInterval: 10 * time.Minute,
+		Jitter:      0.5,
+	}
+	for i := 0; i < 100; i++ {
+		intvl, err := p.NextInterval(0, 0)
+		assert.NoError(t, err)
+		assert.True(t, intvl >= 30*time.Second && intvl <= 90*time.Second,
+			"interval out of bounds: %v", intvl)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrCertificateRevoked is returned for connections to servers with a
+	// revoked certificate in their chain.
+	ErrCertificateRevoked = errors.New("server certificate is revoked")
+	// ErrRevocationUnknown is returned, if revocation checking hard-fails,
+	// for connections to servers the certificate of which can not be
+	// checked, e.g. for lack of a current CRL or stapled OCSP response.
+	ErrRevocationUnknown = errors.New("revocation status of server certificate is unknown")
+)
+
+// allowed difference of the clocks of the device and of OCSP responders
+const ocspClockSkew = 5 * time.Minute
+
+type revocationStatus int
+
+const (
+	revocationUnknown revocationStatus = iota
+	revocationGood
+	revocationRevoked
+)
+
+// revocationChecker checks the certificate chains of servers against the CRLs
+// of a file, reloaded as it changes, and against stapled OCSP responses.
+type revocationChecker struct {
+	crlFile  string
+	ocsp     bool
+	hardFail bool
+
+	lock    sync.Mutex
+	crls    []*x509.RevocationList
+	modTime time.Time
+}
+
+// newRevocationChecker returns the checker configured, or nil if revocation
+// checking is disabled.
+func newRevocationChecker(conf Config) (*revocationChecker, error) {
+	if conf.CRLFile == "" && !conf.OCSPStapling {
+		return nil, nil
+	}
+	rc := &revocationChecker{
+		crlFile:  conf.CRLFile,
+		ocsp:     conf.OCSPStapling,
+		hardFail: conf.RevocationHardFail,
+	}
+	if rc.crlFile != "" {
+		if _, err := rc.loadCRLs(); err != nil {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// loadCRLs returns the CRLs of the file, parsing it again if it has been
+// modified since it was last loaded.
+func (rc *revocationChecker) loadCRLs() ([]*x509.RevocationList, error) {
+	if rc.crlFile == "" {
+		return nil, nil
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	info, err := os.Stat(rc.crlFile)
+	if err != nil {
+		return rc.crls, errors.Wrapf(err, "failed to read CRL file")
+	}
+	if info.ModTime().Equal(rc.modTime) {
+		return rc.crls, nil
+	}
+	data, err := ioutil.ReadFile(rc.crlFile)
+	if err != nil {
+		return rc.crls, errors.Wrapf(err, "failed to read CRL file")
+	}
+	crls, err := parseCRLs(data)
+	if err != nil {
+		return rc.crls, errors.Wrapf(err, "invalid CRL file %s", rc.crlFile)
+	}
+	rc.crls = crls
+	rc.modTime = info.ModTime()
+	return crls, nil
+}
+
+// parseCRLs parses a DER encoded CRL, or any number of PEM encoded ones.
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no PEM encoded CRL found")
+	}
+	return crls, nil
+}
+
+// verify is the tls.Config.VerifyConnection function of the checker. The
+// connection is refused if a certificate of the chain is revoked and, when
+// hard-failing, if the status of the server certificate is not known. Chains
+// are not checked if verification is disabled.
+func (rc *revocationChecker) verify(cs tls.ConnectionState) error {
+	crls, err := rc.loadCRLs()
+	if err != nil {
+		log.Errorf("Revocation checking: %v", err)
+	}
+	var firstErr error
+	for _, chain := range cs.VerifiedChains {
+		err := rc.verifyChain(chain, cs.OCSPResponse, crls, time.Now())
+		if err == nil {
+			return nil
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (rc *revocationChecker) verifyChain(chain []*x509.Certificate, staple []byte,
+	crls []*x509.RevocationList, now time.Time) error {
+
+	if len(chain) < 2 {
+		// the server certificate is trusted itself
+		return nil
+	}
+	leaf := chain[0]
+
+	known := false
+	for i := 0; i+1 < len(chain); i++ {
+		switch crlStatus(crls, chain[i], chain[i+1], now) {
+		case revocationRevoked:
+			log.Errorf("Certificate %q is revoked by CRL; refusing to connect.",
+				chain[i].Subject.CommonName)
+			return ErrCertificateRevoked
+		case revocationGood:
+			known = known || i == 0
+		}
+	}
+
+	if rc.ocsp {
+		status, err := ocspStatus(staple, leaf, chain[1], now)
+		switch status {
+		case revocationRevoked:
+			log.Errorf("Certificate %q is revoked by OCSP response; refusing "+
+				"to connect.", leaf.Subject.CommonName)
+			return ErrCertificateRevoked
+		case revocationGood:
+			known = true
+		default:
+			log.Debugf("Revocation checking: %v", err)
+		}
+	}
+
+	if !known {
+		if rc.hardFail {
+			log.Errorf("Revocation status of certificate %q is unknown; refusing "+
+				"to connect.", leaf.Subject.CommonName)
+			return ErrRevocationUnknown
+		}
+		log.Warnf("Revocation status of certificate %q is unknown.",
+			leaf.Subject.CommonName)
+	}
+	return nil
+}
+
+// crlStatus returns the status of cert in the current CRLs of its issuer.
+func crlStatus(crls []*x509.RevocationList, cert, issuer *x509.Certificate,
+	now time.Time) revocationStatus {
+
+	status := revocationUnknown
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			log.Warnf("Revocation checking: CRL of %q has an invalid signature: %v",
+				crl.Issuer.CommonName, err)
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			log.Warnf("Revocation checking: CRL of %q expired at %s",
+				crl.Issuer.CommonName, crl.NextUpdate)
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revocationRevoked
+			}
+		}
+		status = revocationGood
+	}
+	return status
+}
+
+// ASN.1 structures of OCSP responses (RFC 6960, section 4.2.1).
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw         asn1.RawContent
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+var ocspSignatureAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	algo x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+	{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+}
+
+// ocspStatus returns the status of cert in the stapled OCSP response, which
+// must be current and signed by the issuer or a responder it delegated to.
+func ocspStatus(staple []byte, cert, issuer *x509.Certificate,
+	now time.Time) (revocationStatus, error) {
+
+	if len(staple) == 0 {
+		return revocationUnknown, errors.New("no OCSP response stapled")
+	}
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(staple, &resp); err != nil || len(rest) > 0 {
+		return revocationUnknown, errors.New("malformed OCSP response")
+	}
+	if resp.Status != 0 {
+		return revocationUnknown, errors.Errorf("OCSP response status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return revocationUnknown, errors.New("unsupported OCSP response type")
+	}
+	var basic ocspBasicResponse
+	if rest, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil || len(rest) > 0 {
+		return revocationUnknown, errors.New("malformed OCSP response")
+	}
+	if err := checkOCSPSignature(basic, issuer, now); err != nil {
+		return revocationUnknown, err
+	}
+
+	for _, r := range basic.TBSResponseData.Responses {
+		if !r.CertID.matches(cert, issuer) {
+			continue
+		}
+		if now.Add(ocspClockSkew).Before(r.ThisUpdate) ||
+			(!r.NextUpdate.IsZero() && now.Add(-ocspClockSkew).After(r.NextUpdate)) {
+			return revocationUnknown, errors.New("OCSP response is not current")
+		}
+		switch {
+		case bool(r.Good):
+			return revocationGood, nil
+		case bool(r.Unknown):
+			return revocationUnknown, errors.New("OCSP responder does not know the certificate")
+		default:
+			return revocationRevoked, nil
+		}
+	}
+	return revocationUnknown, errors.New("OCSP response is for another certificate")
+}
+
+func checkOCSPSignature(basic ocspBasicResponse, issuer *x509.Certificate, now time.Time) error {
+	algo := x509.UnknownSignatureAlgorithm
+	for _, a := range ocspSignatureAlgorithms {
+		if a.oid.Equal(basic.SignatureAlgorithm.Algorithm) {
+			algo = a.algo
+		}
+	}
+	if algo == x509.UnknownSignatureAlgorithm {
+		return errors.Errorf("unsupported OCSP signature algorithm %v",
+			basic.SignatureAlgorithm.Algorithm)
+	}
+
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return errors.Wrapf(err, "invalid OCSP responder certificate")
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return errors.Wrapf(err, "OCSP responder is not authorized by the issuer")
+			}
+			if !hasExtKeyUsage(responder, x509.ExtKeyUsageOCSPSigning) {
+				return errors.New("OCSP responder is not authorized to sign responses")
+			}
+			if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+				return errors.New("OCSP responder certificate is not valid")
+			}
+			signer = responder
+		}
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.Raw,
+		basic.Signature.RightAlign()); err != nil {
+		return errors.Wrapf(err, "invalid OCSP response signature")
+	}
+	return nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// matches tells if the ID is the one of cert, issued by issuer.
+func (id ocspCertID) matches(cert, issuer *x509.Certificate) bool {
+	var h hash.Hash
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		h = sha1.New()
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		h = sha256.New()
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA384):
+		h = sha512.New384()
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA512):
+		h = sha512.New()
+	default:
+		return false
+	}
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+	return bytes.Equal(id.NameHash, nameHash) && bytes.Equal(id.IssuerKeyHash, keyHash)
+}
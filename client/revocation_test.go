@@ -0,0 +1,326 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, template *x509.Certificate,
+	parent *testCert) *testCert {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert,
+		&key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert, key}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, 1, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+}
+
+func newTestServerCert(t *testing.T, serial int64, ca *testCert) *testCert {
+	return newTestCert(t, serial, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+}
+
+// testOCSPResponse returns an OCSP response for cert, issued by issuer, with
+// the status and nextUpdate given, and signed by signer.
+func testOCSPResponse(t *testing.T, cert *x509.Certificate, issuer, signer *testCert,
+	status revocationStatus, nextUpdate time.Time) []byte {
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(issuer.cert.RawSubjectPublicKeyInfo, &spki)
+	require.NoError(t, err)
+	nameHash := sha1.Sum(issuer.cert.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+
+	single := ocspSingleResponse{
+		CertID: ocspCertID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidSHA1,
+				Parameters: asn1.NullRawValue,
+			},
+			NameHash:      nameHash[:],
+			IssuerKeyHash: keyHash[:],
+			SerialNumber:  cert.SerialNumber,
+		},
+		ThisUpdate: time.Now().Add(-time.Minute).UTC(),
+		NextUpdate: nextUpdate.UTC(),
+	}
+	switch status {
+	case revocationGood:
+		single.Good = true
+	case revocationRevoked:
+		single.Revoked.RevocationTime = time.Now().Add(-time.Minute).UTC()
+	default:
+		single.Unknown = true
+	}
+	responderID, err := asn1.Marshal(asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true,
+		Bytes: []byte{0x04, 0x00},
+	})
+	require.NoError(t, err)
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{FullBytes: responderID},
+		ProducedAt:  time.Now().UTC().Truncate(time.Second),
+		Responses:   []ocspSingleResponse{single},
+	})
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(tbs)
+	signature, err := signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	basic := ocspBasicResponse{
+		TBSResponseData: ocspResponseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2},
+		},
+		Signature: asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	}
+	if signer != issuer {
+		basic.Certificates = []asn1.RawValue{{FullBytes: signer.cert.Raw}}
+	}
+	basicDER, err := asn1.Marshal(basic)
+	require.NoError(t, err)
+	resp, err := asn1.Marshal(ocspResponse{
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basicDER},
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+func testCRL(t *testing.T, ca *testCert, nextUpdate time.Time, revoked ...*big.Int) []byte {
+	var entries []x509.RevocationListEntry
+	for _, serial := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-2 * time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	server := newTestServerCert(t, 2, ca)
+	responder := newTestCert(t, 3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "responder"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, ca)
+	notResponder := newTestServerCert(t, 4, ca)
+	later := time.Now().Add(time.Hour)
+
+	check := func(hardFail bool, staple []byte) error {
+		rc := &revocationChecker{ocsp: true, hardFail: hardFail}
+		return rc.verify(tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{server.cert, ca.cert}},
+			OCSPResponse:   staple,
+		})
+	}
+
+	good := testOCSPResponse(t, server.cert, ca, ca, revocationGood, later)
+	assert.NoError(t, check(true, good))
+	delegated := testOCSPResponse(t, server.cert, ca, responder, revocationGood, later)
+	assert.NoError(t, check(true, delegated))
+
+	// revoked certificates are refused even when soft-failing
+	revoked := testOCSPResponse(t, server.cert, ca, ca, revocationRevoked, later)
+	assert.Equal(t, ErrCertificateRevoked, check(false, revoked))
+	assert.Equal(t, ErrCertificateRevoked, check(true, revoked))
+
+	// responses not telling the status
+	for _, staple := range [][]byte{
+		nil,
+		[]byte("garbage"),
+		testOCSPResponse(t, server.cert, ca, ca, revocationUnknown, later),
+		testOCSPResponse(t, server.cert, ca, ca, revocationGood, time.Now().Add(-time.Hour)),
+		testOCSPResponse(t, server.cert, ca, other, revocationGood, later),
+		testOCSPResponse(t, server.cert, ca, notResponder, revocationGood, later),
+		testOCSPResponse(t, responder.cert, ca, ca, revocationGood, later),
+	} {
+		assert.NoError(t, check(false, staple))
+		assert.Equal(t, ErrRevocationUnknown, check(true, staple))
+	}
+
+	// verification disabled, or the server certificate is trusted itself
+	rc := &revocationChecker{ocsp: true, hardFail: true}
+	assert.NoError(t, rc.verify(tls.ConnectionState{}))
+	assert.NoError(t, rc.verify(tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{server.cert}},
+	}))
+}
+
+func TestCRLChecking(t *testing.T) {
+	root := newTestCA(t, "root")
+	ca := newTestCert(t, 2, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, root)
+	other := newTestCA(t, "other")
+	server := newTestServerCert(t, 3, ca)
+	later := time.Now().Add(time.Hour)
+
+	dir, err := ioutil.TempDir("", "crl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	crlFile := filepath.Join(dir, "crl.pem")
+
+	check := func(hardFail bool, crls ...[]byte) error {
+		var data []byte
+		for _, crl := range crls {
+			data = append(data, crl...)
+		}
+		require.NoError(t, ioutil.WriteFile(crlFile, data, 0600))
+		// the file is reloaded as it changes
+		os.Chtimes(crlFile, time.Now(), time.Now().Add(time.Duration(len(data))))
+		rc, err := newRevocationChecker(Config{CRLFile: crlFile, RevocationHardFail: hardFail})
+		require.NoError(t, err)
+		return rc.verify(tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{server.cert, ca.cert, root.cert}},
+		})
+	}
+
+	assert.NoError(t, check(true, testCRL(t, ca, later)))
+	assert.NoError(t, check(true, testCRL(t, root, later), testCRL(t, ca, later)))
+	assert.Equal(t, ErrCertificateRevoked,
+		check(false, testCRL(t, ca, later, server.cert.SerialNumber)))
+	// the intermediate CA is revoked
+	assert.Equal(t, ErrCertificateRevoked,
+		check(false, testCRL(t, root, later, ca.cert.SerialNumber), testCRL(t, ca, later)))
+
+	// CRLs not telling the status of the server certificate
+	for _, crl := range [][]byte{
+		testCRL(t, root, later),
+		testCRL(t, ca, time.Now().Add(-time.Minute)),
+		testCRL(t, other, later, server.cert.SerialNumber),
+	} {
+		assert.NoError(t, check(false, crl))
+		assert.Equal(t, ErrRevocationUnknown, check(true, crl))
+	}
+
+	// the CRL file is read when creating the client
+	_, err = newRevocationChecker(Config{CRLFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(crlFile, []byte("garbage"), 0600))
+	_, err = newRevocationChecker(Config{CRLFile: crlFile})
+	assert.Error(t, err)
+	_, err = New(Config{IsHttps: true, CRLFile: crlFile})
+	assert.Error(t, err)
+
+	rc, err := newRevocationChecker(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, rc)
+}
+
+func TestRevocationCheckingConnection(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	server := newTestServerCert(t, 2, ca)
+	later := time.Now().Add(time.Hour)
+
+	dir, err := ioutil.TempDir("", "revocation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: ca.cert.Raw,
+	}), 0600))
+
+	get := func(staple []byte) error {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		ts.TLS = &tls.Config{Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server.cert.Raw},
+			PrivateKey:  server.key,
+			OCSPStaple:  staple,
+		}}}
+		ts.StartTLS()
+		defer ts.Close()
+
+		ac, err := New(Config{ServerCert: caFile, ServerURL: ts.URL, OCSPStapling: true,
+			RevocationHardFail: true})
+		require.NoError(t, err)
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		rsp, err := ac.Do(req)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, get(testOCSPResponse(t, server.cert, ca, ca, revocationGood, later)))
+	assert.Error(t, get(testOCSPResponse(t, server.cert, ca, ca, revocationRevoked, later)))
+	assert.Error(t, get(nil))
+}
@@ -11,6 +11,21 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
+
+// Package test provides a fake Mender server, for testing clients against.
+// It serves the authorization, inventory, deployments, status and log
+// endpoints of the device API, and the download of artifacts, with faults
+// injected as configured by ClientTestServer.Faults:
+//
+//	srv := test.NewClientTestServer()
+//	defer srv.Close()
+//	srv.Auth.Authorize = true
+//	srv.Auth.Token = []byte("token")
+//	srv.Update.Has = true
+//	srv.UpdateDownload.Data.Write(artifact)
+//	srv.Faults.TruncateDownload = 1024
+//
+// Clients, including builds of the mender binary, are pointed at srv.URL.
 package test
 
 import (
@@ -21,8 +36,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -34,6 +50,8 @@ type updateType struct {
 	Unauthorized bool
 	Called       bool
 	Current      client.CurrentUpdate
+	// Retry-After header of responses without update
+	RetryAfter string
 }
 
 type updateDownloadType struct {
@@ -49,9 +67,10 @@ type authType struct {
 }
 
 type statusType struct {
-	Status  string
-	Aborted bool
-	Called  bool
+	Status   string
+	SubState string
+	Aborted  bool
+	Called   bool
 }
 
 type logType struct {
@@ -64,6 +83,22 @@ type inventoryType struct {
 	Attrs  []client.InventoryAttribute
 }
 
+// Faults are injected into the responses of a ClientTestServer, to test how
+// clients cope with servers misbehaving.
+type Faults struct {
+	// responses are delayed by that long
+	Delay time.Duration
+	// downloads of artifacts are cut off after that many bytes of each
+	// response; range requests resuming them are served, and cut off too
+	TruncateDownload int64
+	// that many of the following requests, but downloads, are rejected
+	// with 401 Unauthorized, as if the server had revoked the token
+	UnauthorizedRequests int
+	// that many of the following requests fail with 503 Service
+	// Unavailable
+	UnavailableRequests int
+}
+
 type ClientTestServer struct {
 	*httptest.Server
 
@@ -73,8 +108,15 @@ type ClientTestServer struct {
 	Status         statusType
 	Log            logType
 	Inventory      inventoryType
+	Faults         Faults
+
+	faultsMutex sync.Mutex
 }
 
+// Path of the artifact downloads, which update responses point to unless
+// they specify another URI.
+const DownloadPath = "/api/devices/v1/download"
+
 func NewClientTestServer() *ClientTestServer {
 	cts := &ClientTestServer{}
 
@@ -85,18 +127,73 @@ func NewClientTestServer() *ClientTestServer {
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/log", cts.logReq)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/status", cts.statusReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/", cts.deploymentsReq)
-	mux.HandleFunc("/api/devices/v1/download", cts.updateDownloadReq)
+	mux.HandleFunc(DownloadPath, cts.updateDownloadReq)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Infof("fallback request handler, request %v", r)
 		w.WriteHeader(http.StatusBadRequest)
 	})
 
-	srv := httptest.NewServer(mux)
+	srv := httptest.NewServer(cts.injectFaults(mux))
 	cts.Server = srv
 
 	return cts
 }
 
+// injectFaults fails, or delays, requests to h as configured by cts.Faults.
+func (cts *ClientTestServer) injectFaults(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cts.faultsMutex.Lock()
+		delay := cts.Faults.Delay
+		unavailable := cts.Faults.UnavailableRequests > 0
+		if unavailable {
+			cts.Faults.UnavailableRequests--
+		}
+		unauthorized := !unavailable && cts.Faults.UnauthorizedRequests > 0 &&
+			r.URL.Path != DownloadPath
+		if unauthorized {
+			cts.Faults.UnauthorizedRequests--
+		}
+		cts.faultsMutex.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case unavailable:
+			log.Infof("injecting fault: unavailable, request %v", r.URL)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case unauthorized:
+			log.Infof("injecting fault: unauthorized, request %v", r.URL)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// truncatingWriter fails writes of the response body once limit bytes have
+// been written, so that the connection is closed short of its length.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit int64
+}
+
+func (t *truncatingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > t.limit {
+		p = p[:t.limit]
+	}
+	n, err := t.ResponseWriter.Write(p)
+	t.limit -= int64(n)
+	if err == nil && t.limit == 0 {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
 func writeJSON(out io.Writer, data interface{}) error {
 	enc := json.NewEncoder(out)
 	return enc.Encode(data)
@@ -114,6 +211,9 @@ func (cts *ClientTestServer) Reset() {
 	cts.Log = logType{}
 	cts.Inventory = inventoryType{}
 	cts.Status = statusType{}
+	cts.faultsMutex.Lock()
+	cts.Faults = Faults{}
+	cts.faultsMutex.Unlock()
 }
 
 func isMethod(method string, w http.ResponseWriter, r *http.Request) bool {
@@ -300,6 +400,7 @@ func (cts *ClientTestServer) statusReq(w http.ResponseWriter, r *http.Request, i
 	}
 
 	cts.Status.Status = report.Status
+	cts.Status.SubState = report.SubState
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -337,6 +438,9 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 	case cts.Update.Unauthorized == true:
 		w.WriteHeader(http.StatusUnauthorized)
 	case cts.Update.Has == false:
+		if cts.Update.RetryAfter != "" {
+			w.Header().Set("Retry-After", cts.Update.RetryAfter)
+		}
 		w.WriteHeader(http.StatusNoContent)
 	case cts.Update.Has == true:
 		w.WriteHeader(http.StatusOK)
@@ -348,7 +452,7 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 			cts.Update.Data.Artifact.ArtifactName = "foo"
 		}
 		if cts.Update.Data.URI() == "" {
-			cts.Update.Data.Artifact.Source.URI = cts.URL + "/download"
+			cts.Update.Data.Artifact.Source.URI = cts.URL + DownloadPath
 		}
 		if len(cts.Update.Data.Artifact.CompatibleDevices) == 0 {
 			cts.Update.Data.Artifact.CompatibleDevices = []string{"vexpress"}
@@ -372,8 +476,15 @@ func (cts *ClientTestServer) updateDownloadReq(w http.ResponseWriter, r *http.Re
 		w.WriteHeader(http.StatusBadRequest)
 	}
 
-	w.Header().Set("Content-Length", strconv.Itoa(cts.UpdateDownload.Data.Len()))
+	cts.faultsMutex.Lock()
+	truncate := cts.Faults.TruncateDownload
+	cts.faultsMutex.Unlock()
+	if truncate > 0 {
+		w = &truncatingWriter{ResponseWriter: w, limit: truncate}
+	}
+
+	// downloads are resumed with range requests
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, &cts.UpdateDownload.Data)
+	http.ServeContent(w, r, "artifact", time.Time{},
+		bytes.NewReader(cts.UpdateDownload.Data.Bytes()))
 }
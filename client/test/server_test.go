@@ -0,0 +1,125 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	r, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	return r, body, err
+}
+
+func TestClientTestServerUpdate(t *testing.T) {
+	srv := NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Has = true
+	artifact := bytes.Repeat([]byte("artifact"), 128)
+	srv.UpdateDownload.Data.Write(artifact)
+
+	ac, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	data, err := client.NewUpdate().GetScheduledUpdate(context.Background(), ac, srv.URL,
+		client.CurrentUpdate{})
+	require.NoError(t, err)
+	update := data.(client.UpdateResponse)
+	assert.Equal(t, srv.URL+DownloadPath, update.URI())
+
+	// downloads can be repeated
+	for i := 0; i < 2; i++ {
+		r, body, err := get(t, update.URI(), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, artifact, body)
+	}
+	assert.True(t, srv.UpdateDownload.Called)
+}
+
+func TestClientTestServerTruncateDownload(t *testing.T) {
+	srv := NewClientTestServer()
+	defer srv.Close()
+	artifact := bytes.Repeat([]byte("artifact"), 128)
+	srv.UpdateDownload.Data.Write(artifact)
+	srv.Faults.TruncateDownload = 100
+
+	r, body, err := get(t, srv.URL+DownloadPath, nil)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.EqualValues(t, len(artifact), r.ContentLength)
+	assert.Equal(t, artifact[:100], body)
+
+	// the download is resumed, and cut off again
+	r, body, err = get(t, srv.URL+DownloadPath, http.Header{"Range": {"bytes=100-"}})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, artifact[100:200], body)
+
+	// but not the end of it
+	r, body, err = get(t, srv.URL+DownloadPath, http.Header{"Range": {"bytes=1000-"}})
+	assert.NoError(t, err)
+	assert.Equal(t, artifact[1000:], body)
+}
+
+func TestClientTestServerFaults(t *testing.T) {
+	srv := NewClientTestServer()
+	defer srv.Close()
+	ac, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	status := client.NewStatus()
+	report := client.StatusReport{DeploymentID: "foo", Status: client.StatusInstalling}
+
+	// 401 storm
+	srv.Faults.UnauthorizedRequests = 2
+	for i := 0; i < 2; i++ {
+		err = status.Report(ac, srv.URL, report)
+		assert.Equal(t, utils.ErrorKindAuth, utils.ErrorKindOf(err))
+	}
+	assert.False(t, srv.Status.Called)
+	assert.NoError(t, status.Report(ac, srv.URL, report))
+	assert.Equal(t, client.StatusInstalling, srv.Status.Status)
+
+	srv.Faults.UnavailableRequests = 1
+	err = status.Report(ac, srv.URL, report)
+	assert.Equal(t, utils.ErrorKindNetwork, utils.ErrorKindOf(err))
+	assert.NoError(t, status.Report(ac, srv.URL, report))
+	assert.Equal(t, 0, srv.Faults.UnavailableRequests)
+
+	// slow responses
+	srv.Faults.Delay = 100 * time.Millisecond
+	start := time.Now()
+	assert.NoError(t, status.Report(ac, srv.URL, report))
+	assert.True(t, time.Since(start) >= srv.Faults.Delay)
+
+	srv.Reset()
+	assert.Equal(t, Faults{}, srv.Faults)
+}
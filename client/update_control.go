@@ -0,0 +1,175 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// Actions of update control maps at a point of a deployment.
+const (
+	UpdateControlContinue = "continue"
+	UpdateControlPause    = "pause"
+	UpdateControlFail     = "fail"
+)
+
+// UpdateControlMap lets the server pause a deployment at given points, until
+// it releases it with an updated map, or fail it.
+type UpdateControlMap struct {
+	ID string `json:"id"`
+	// actions by the point of the deployment, named after the state it is
+	// about to enter, e.g. ArtifactInstall_Enter; the deployment continues
+	// at points not listed
+	States map[string]UpdateControlState `json:"states"`
+	// the actions do not apply anymore from then on; never if zero
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// UpdateControlState is the action of an update control map at a point.
+type UpdateControlState struct {
+	Action string `json:"action"`
+	// action once the map has expired; deployments paused fail, others
+	// continue, if empty
+	OnMapExpire string `json:"on_map_expire,omitempty"`
+}
+
+func validUpdateControlAction(action string) bool {
+	switch action {
+	case UpdateControlContinue, UpdateControlPause, UpdateControlFail:
+		return true
+	}
+	return false
+}
+
+// Validate checks the actions of the map.
+func (m *UpdateControlMap) Validate() error {
+	for point, s := range m.States {
+		if !validUpdateControlAction(s.Action) {
+			return errors.Errorf("invalid action %q of update control map at %s",
+				s.Action, point)
+		}
+		if s.OnMapExpire != "" && !validUpdateControlAction(s.OnMapExpire) {
+			return errors.Errorf("invalid expiry action %q of update control map at %s",
+				s.OnMapExpire, point)
+		}
+	}
+	return nil
+}
+
+// Action returns the action of the map at point at the given time; of nil
+// maps, continuing.
+func (m *UpdateControlMap) Action(point string, now time.Time) string {
+	if m == nil {
+		return UpdateControlContinue
+	}
+	s, ok := m.States[point]
+	if !ok {
+		return UpdateControlContinue
+	}
+	if m.Expires.IsZero() || now.Before(m.Expires) {
+		return s.Action
+	}
+	switch {
+	case s.OnMapExpire != "":
+		return s.OnMapExpire
+	case s.Action == UpdateControlPause:
+		return UpdateControlFail
+	}
+	return UpdateControlContinue
+}
+
+// SignedUpdateControlMap is an update control map as sent by the server,
+// kept as is so that its signature can be verified again once restored.
+type SignedUpdateControlMap struct {
+	Map json.RawMessage `json:"map"`
+	// base64 encoded signature of Map, with the key of the server; of Map
+	// without insignificant whitespace, as it is stored compacted
+	Signature string `json:"signature,omitempty"`
+}
+
+// Verify decodes the map, checking its signature with key first unless key
+// is nil; unsigned maps are rejected then. Without a key, it is up to the
+// caller to trust the map as unsigned.
+func (s *SignedUpdateControlMap) Verify(key []byte) (*UpdateControlMap, error) {
+	if key != nil {
+		if s.Signature == "" {
+			return nil, errors.New("update control map is not signed")
+		}
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, s.Map); err != nil {
+			return nil, errors.Wrapf(err, "invalid update control map")
+		}
+		err := artifact.NewVerifier(key).Verify(compacted.Bytes(), []byte(s.Signature))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signature of update control map")
+		}
+	}
+	var m UpdateControlMap
+	if err := json.Unmarshal(s.Map, &m); err != nil {
+		return nil, errors.Wrapf(err, "invalid update control map")
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FetchUpdateControlMap fetches the current update control map of a
+// deployment, or nil if the server has removed it.
+func FetchUpdateControlMap(api ApiRequester, server, deploymentID string) (
+	*SignedUpdateControlMap, error) {
+	path := fmt.Sprintf("/deployments/device/deployments/%s/update_control_map",
+		deploymentID)
+	req, err := http.NewRequest(http.MethodGet, buildApiURL(server, path), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create update control map request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching update control map failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	case http.StatusConflict:
+		return nil, NewAPIError(ErrDeploymentAborted, r)
+	case http.StatusUnauthorized:
+		return nil, NewAPIError(ErrNotAuthorized, r)
+	default:
+		return nil, NewAPIError(errors.Errorf(
+			"fetching update control map failed, bad status %v", r.StatusCode), r)
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read update control map")
+	}
+	var signed SignedUpdateControlMap
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, errors.Wrapf(err, "invalid update control map response")
+	}
+	return &signed, nil
+}
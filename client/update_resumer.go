@@ -17,15 +17,29 @@ package client
 import (
 	"fmt"
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// UpdateResumer is an io.ReadCloser wrapping the body of an artifact download.
+// When the connection breaks before contentLength bytes have been read, the
+// download is resumed from the current offset by re-issuing the request with
+// a Range header, backing off between attempts up to maxWait.
+//
+// Once it gives up, what was read is kept by partialDownload, if the update
+// client has a partial file configured, and the next FetchUpdate of the same
+// URL, e.g. as the fetch is retried, continues from there.
+//
+// The download can be suspended, e.g. while on a metered connection, which
+// closes the connection until it is resumed from the current offset.
 type UpdateResumer struct {
 	stream        io.ReadCloser
 	apiReq        ApiRequester
@@ -34,9 +48,20 @@ type UpdateResumer struct {
 	contentLength int64
 	retryAttempts int
 	maxWait       time.Duration
+
+	mutex sync.Mutex
+	// closed once the suspended download is resumed; nil unless suspended
+	resumed chan struct{}
+	// set if the stream was closed by Suspend, not broken, so it has to
+	// be requested again
+	reconnect bool
+	// set if the server advertised support of range requests
+	acceptRanges bool
 }
 
-// Note: It is important that nothing has been read from the stream yet.
+// NewUpdateResumer returns a resumable reader for stream, which is the body of
+// the response to req. Note: It is important that nothing has been read from
+// the stream yet.
 func NewUpdateResumer(stream io.ReadCloser,
 	contentLength int64,
 	maxWait time.Duration,
@@ -55,13 +80,27 @@ func NewUpdateResumer(stream io.ReadCloser,
 func (h *UpdateResumer) Read(buf []byte) (int, error) {
 	origOffset := h.offset
 	for {
-		bytesRead, err := h.stream.Read(buf[h.offset-origOffset:])
+		stream, err := h.activeStream()
+		if err != nil {
+			return int(h.offset - origOffset), err
+		}
+		bytesRead, err := stream.Read(buf[h.offset-origOffset:])
 		if bytesRead > 0 {
 			h.offset += int64(bytesRead)
 		}
+		if err != nil && h.suspended() {
+			// the read was cut short by Suspend; the stream is requested
+			// again once resumed
+			if h.offset > origOffset {
+				return int(h.offset - origOffset), nil
+			}
+			continue
+		}
+		// the end of downloads of unknown size can only be told by a
+		// clean EOF
 		if err == nil ||
 			h.offset <= 0 ||
-			(err == io.EOF && h.offset >= h.contentLength) {
+			(err == io.EOF && (h.contentLength < 0 || h.offset >= h.contentLength)) {
 
 			return int(h.offset - origOffset), err
 		}
@@ -69,48 +108,170 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 		// If we get here we have unexpected EOF, either an actual unexpected
 		// EOF, or a normal EOF, but with an unexpected number of bytes. This is
 		// a sign that we should try to resume from the same position.
+		stream, err = h.reopen(err)
+		if err != nil {
+			return int(h.offset - origOffset), utils.WithErrorKind(utils.ErrorKindNetwork, err)
+		}
+		h.setStream(stream)
 
-		h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+		// Repeat from the top.
+	}
+}
 
-		var res *http.Response
-		for {
+// AcceptsRanges tells whether the server advertised support of range
+// requests, so that the download can be split into ranges.
+func (h *UpdateResumer) AcceptsRanges() bool {
+	return h.acceptRanges
+}
+
+// SkipTo continues the download at offset rather than at the start, e.g.
+// where an earlier download of the same artifact was stopped at. The server
+// must support range requests, and nothing must have been read yet.
+func (h *UpdateResumer) SkipTo(offset int64) error {
+	if !h.acceptRanges {
+		return errors.New("server does not support range requests")
+	}
+	if h.contentLength >= 0 && offset > h.contentLength {
+		return errors.Errorf("offset %d beyond the size of the artifact, %d",
+			offset, h.contentLength)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.offset != 0 {
+		return errors.New("download started already")
+	}
+	h.offset = offset
+	if !h.reconnect {
+		h.reconnect = true
+		h.stream.Close()
+	}
+	return nil
+}
+
+// Suspend stops the download and closes the connection, until Resume is
+// called.
+func (h *UpdateResumer) Suspend() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.resumed != nil {
+		return
+	}
+	h.resumed = make(chan struct{})
+	if !h.reconnect {
+		h.reconnect = true
+		// makes a Read in progress return
+		h.stream.Close()
+	}
+	log.Info("Download suspended")
+}
+
+// Resume continues a suspended download from where it was suspended.
+func (h *UpdateResumer) Resume() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.resumed != nil {
+		close(h.resumed)
+		h.resumed = nil
+	}
+}
+
+func (h *UpdateResumer) suspended() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.reconnect
+}
+
+// setStream continues reading from stream, unless the download has been
+// suspended in the meantime.
+func (h *UpdateResumer) setStream(stream io.ReadCloser) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.resumed != nil {
+		stream.Close()
+		h.reconnect = true
+		return
+	}
+	h.stream = stream
+	h.reconnect = false
+}
+
+// activeStream returns the stream to read from, waiting while the download
+// is suspended and requesting it again once it is resumed.
+func (h *UpdateResumer) activeStream() (io.ReadCloser, error) {
+	for {
+		h.mutex.Lock()
+		resumed, reconnect, stream := h.resumed, h.reconnect, h.stream
+		h.mutex.Unlock()
+
+		if resumed != nil {
+			select {
+			case <-resumed:
+			case <-h.req.Context().Done():
+				return nil, errors.Wrapf(h.req.Context().Err(), "Cannot resume download")
+			}
+			continue
+		}
+		if !reconnect {
+			return stream, nil
+		}
+		stream, err := h.reopen(nil)
+		if err != nil {
+			return nil, err
+		}
+		h.setStream(stream)
+	}
+}
+
+// reopen requests the download again from the current offset, retrying with
+// backoff until it succeeds; the first attempt is made right away unless the
+// connection broke with err.
+func (h *UpdateResumer) reopen(err error) (io.ReadCloser, error) {
+	h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+
+	for {
+		if err != nil {
 			log.Errorf("Download connection broken: %s", err.Error())
 
 			waitTime, err := GetExponentialBackoffTime(h.retryAttempts, h.maxWait)
 			if err != nil {
-				return int(h.offset - origOffset),
-					errors.Wrapf(err, "Cannot resume download")
+				return nil, errors.Wrapf(err, "Cannot resume download")
 			}
 
 			log.Infof("Resuming download in %s", waitTime.String())
 			h.retryAttempts += 1
 
-			time.Sleep(waitTime)
-
-			log.Infof("Attempting to resume artifact download from offset %d", h.offset)
-
-			res, err = h.apiReq.Do(h.req)
-			if err != nil {
-				log.Infof("Download resume request failed: %s", err.Error())
-				continue
+			select {
+			case <-time.After(waitTime):
+			case <-h.req.Context().Done():
+				return nil, errors.Wrapf(h.req.Context().Err(), "Cannot resume download")
 			}
+		}
 
-			stream, err := h.getStreamFromPartialContent(res)
-			if err != nil {
-				continue
-			}
+		log.Infof("Attempting to resume artifact download from offset %d", h.offset)
 
-			h.stream = stream
-			break
+		var res *http.Response
+		res, err = h.apiReq.Do(h.req)
+		if err != nil {
+			log.Infof("Download resume request failed: %s", err.Error())
+			continue
 		}
 
-		// Repeat from the top.
+		stream, serr := h.getStreamFromPartialContent(res)
+		if serr != nil {
+			err = serr
+			continue
+		}
+		return stream, nil
 	}
 }
 
 func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.ReadCloser, error) {
 	var err error
 
+	if h.offset == 0 && res.StatusCode == http.StatusOK {
+		// suspended before anything was read
+		return res.Body, nil
+	}
 	if h.offset > 0 && res.StatusCode != http.StatusPartialContent {
 		return nil, fmt.Errorf("Could not resume download from offset %d. HTTP status code: %s",
 			h.offset, res.Status)
@@ -126,12 +287,13 @@ func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.Read
 	hRangePosAndSize := strings.Split(hRangeStr, "/")
 	if len(hRangePosAndSize) > 2 {
 		return nil, fmt.Errorf("Unexpected Content-Range received from server: %s", hRangeStr)
-	} else if len(hRangePosAndSize) == 2 {
+	} else if len(hRangePosAndSize) == 2 && hRangePosAndSize[1] != "*" {
+		// "*" if the size is unknown to the server
 		var sizeFromServer int64
 		sizeFromServer, err = strconv.ParseInt(hRangePosAndSize[1], 10, 64)
 		if err != nil {
 			return nil, fmt.Errorf("HTTP server returned garbled or missing range: '%s'", hRangeStr)
-		} else if sizeFromServer != h.contentLength {
+		} else if h.contentLength >= 0 && sizeFromServer != h.contentLength {
 			return nil, fmt.Errorf("Size of artifact changed after download was resumed "+
 				"(expected %d, got %d)", h.contentLength, sizeFromServer)
 		}
@@ -171,5 +333,176 @@ func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.Read
 }
 
 func (h *UpdateResumer) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	return h.stream.Close()
 }
+
+// Suffix of the file next to the partial download with the URL and the size
+// of the update it is part of.
+const partialInfoSuffix = ".info"
+
+// partialDownload writes what is downloaded of an update to a file, so that
+// the download is continued from there rather than started over when the
+// same URL is fetched again after it failed. The part kept of an earlier
+// download, if any, is read first.
+type partialDownload struct {
+	// the rest of the download, from the end of prefix
+	stream  io.ReadCloser
+	resumer *UpdateResumer
+	prefix  *os.File
+	// nil once the download is not kept anymore
+	f    *os.File
+	path string
+}
+
+// openPartialDownload returns the part kept of the download of url, its
+// length, and the size of the update, unknown if negative; nil if there is
+// none. Parts of downloads of other URLs are removed.
+func openPartialDownload(path, url string) (*os.File, int64, int64) {
+	info, err := ioutil.ReadFile(path + partialInfoSuffix)
+	if os.IsNotExist(err) {
+		os.Remove(path)
+		return nil, 0, 0
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(info)), "\n", 2)
+	var size int64 = -1
+	if err == nil && len(fields) == 2 {
+		size, err = strconv.ParseInt(fields[1], 10, 64)
+	}
+	if err != nil || len(fields) != 2 || fields[0] != url {
+		removePartialDownload(path)
+		return nil, 0, 0
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		removePartialDownload(path)
+		return nil, 0, 0
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 || (size >= 0 && fi.Size() >= size) {
+		f.Close()
+		removePartialDownload(path)
+		return nil, 0, 0
+	}
+	return f, fi.Size(), size
+}
+
+func removePartialDownload(path string) {
+	os.Remove(path)
+	os.Remove(path + partialInfoSuffix)
+}
+
+// keepPartialDownload returns d writing what is read of stream to the file at
+// path, after the offset bytes kept of it already; stream is returned as is if
+// the file can not be written.
+func keepPartialDownload(d *partialDownload, url string, offset, size int64) io.ReadCloser {
+	var f *os.File
+	var err error
+	if offset > 0 {
+		f, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0)
+	} else {
+		err = ioutil.WriteFile(d.path+partialInfoSuffix,
+			[]byte(fmt.Sprintf("%s\n%d\n", url, size)), 0600)
+		if err == nil {
+			f, err = os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		}
+	}
+	if err != nil {
+		log.Warnf("Not keeping the partial download of the update: %v", err)
+		if d.prefix != nil {
+			d.prefix.Close()
+		}
+		removePartialDownload(d.path)
+		return d.stream
+	}
+	d.f = f
+	return d
+}
+
+func (d *partialDownload) Read(buf []byte) (int, error) {
+	if d.prefix != nil {
+		n, err := d.prefix.Read(buf)
+		if err == io.EOF {
+			d.prefix.Close()
+			d.prefix = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	n, err := d.stream.Read(buf)
+	if n > 0 && d.f != nil {
+		if _, werr := d.f.Write(buf[:n]); werr != nil {
+			log.Warnf("Not keeping the partial download of the update: %v", werr)
+			d.discard()
+		}
+	}
+	// there is nothing left to resume, or nothing to resume from
+	if err == io.EOF || utils.ErrorKindOf(err) == utils.ErrorKindArtifact {
+		d.discard()
+	}
+	return n, err
+}
+
+// discard removes the partial download.
+func (d *partialDownload) discard() {
+	if d.f == nil {
+		return
+	}
+	d.f.Close()
+	removePartialDownload(d.path)
+	d.f = nil
+}
+
+func (d *partialDownload) AcceptsRanges() bool {
+	return d.resumer.AcceptsRanges()
+}
+
+// SkipTo continues the download at offset, see UpdateResumer.SkipTo; it is
+// not kept then, as the file would not start with the start of the update.
+func (d *partialDownload) SkipTo(offset int64) error {
+	if err := d.resumer.SkipTo(offset); err != nil {
+		return err
+	}
+	d.discard()
+	return nil
+}
+
+func (d *partialDownload) Suspend() {
+	d.resumer.Suspend()
+}
+
+func (d *partialDownload) Resume() {
+	d.resumer.Resume()
+}
+
+// Close keeps what was downloaded so far, unless the download is complete.
+func (d *partialDownload) Close() error {
+	if d.prefix != nil {
+		d.prefix.Close()
+	}
+	if d.f != nil {
+		if err := d.f.Close(); err != nil {
+			removePartialDownload(d.path)
+		}
+		d.f = nil
+	}
+	return d.stream.Close()
+}
+
+// contentRangeSize returns the size of the update given in the Content-Range
+// of the response, unknown if negative.
+func contentRangeSize(res *http.Response) int64 {
+	hRangeStr := res.Header.Get("Content-Range")
+	i := strings.LastIndex(hRangeStr, "/")
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(hRangeStr[i+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
@@ -15,14 +15,20 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -358,3 +364,229 @@ func TestBrokenReadAndPartialDownload(t *testing.T) {
 
 	t.Run("group", testBrokenReadAndPartialDownload_group)
 }
+
+func TestUpdateResumerSuspend(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100000))
+	var mutex sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mutex.Unlock()
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	r := NewUpdateResumer(res.Body, res.ContentLength, time.Minute, http.DefaultClient, req)
+
+	start := make([]byte, 1000)
+	_, err = io.ReadFull(r, start)
+	require.NoError(t, err)
+
+	r.Suspend()
+	done := make(chan []byte)
+	go func() {
+		rest, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		done <- rest
+	}()
+	select {
+	case <-done:
+		t.Fatal("download read while suspended")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// resumed from the same offset, not counted as a broken connection
+	r.Resume()
+	select {
+	case rest := <-done:
+		assert.Equal(t, content, append(start, rest...))
+	case <-time.After(10 * time.Second):
+		t.Fatal("download not resumed")
+	}
+	assert.Equal(t, []string{"", "bytes=1000-"}, ranges)
+	assert.Equal(t, 0, r.retryAttempts)
+	r.Close()
+
+	// suspended downloads are given up once their request is cancelled
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	r = NewUpdateResumer(res.Body, res.ContentLength, time.Minute, http.DefaultClient, req)
+	r.Suspend()
+	cancel()
+	_, err = r.Read(start)
+	assert.Error(t, err)
+	r.Close()
+}
+
+func TestUpdateResumerUnknownSize(t *testing.T) {
+	oldExponentialBackoffSmallestUnit := exponentialBackoffSmallestUnit
+	exponentialBackoffSmallestUnit = 10 * time.Millisecond
+	defer func() {
+		exponentialBackoffSmallestUnit = oldExponentialBackoffSmallestUnit
+	}()
+
+	content := []byte(strings.Repeat("0123456789", 200))
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.Header.Get("Range") == "" {
+			// chunked, breaking half way
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:1000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		assert.Equal(t, "bytes=1000-", r.Header.Get("Range"))
+		w.Header().Set("Content-Range", "bytes 1000-1999/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.(http.Flusher).Flush()
+		w.Write(content[1000:])
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), res.ContentLength)
+
+	r := NewUpdateResumer(res.Body, res.ContentLength, time.Minute, http.DefaultClient, req)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"", "bytes=1000-"}, ranges)
+}
+
+func TestUpdateResumerSkipTo(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	r := NewUpdateResumer(res.Body, res.ContentLength, time.Minute, http.DefaultClient, req)
+
+	// the server has to support range requests
+	assert.Error(t, r.SkipTo(4000))
+	r.acceptRanges = true
+	assert.Error(t, r.SkipTo(int64(len(content)+1)))
+
+	require.NoError(t, r.SkipTo(4000))
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content[4000:], rest)
+	assert.Equal(t, []string{"", "bytes=4000-"}, ranges)
+	assert.Equal(t, 0, r.retryAttempts)
+
+	// not once the download has started
+	assert.Error(t, r.SkipTo(100))
+	r.Close()
+}
+
+func TestFetchUpdateResumesPartialDownload(t *testing.T) {
+	oldExponentialBackoffSmallestUnit := exponentialBackoffSmallestUnit
+	exponentialBackoffSmallestUnit = time.Millisecond
+	defer func() {
+		exponentialBackoffSmallestUnit = oldExponentialBackoffSmallestUnit
+	}()
+
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var mutex sync.Mutex
+	var ranges []string
+	down := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.URL.Path == "/other" || !down {
+			http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the connection drops after the first 1000 bytes, and the
+		// server is down until the download is given up
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:1000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "partial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	partial := path.Join(dir, "partial_download")
+	u := NewUpdate()
+	u.partialFile = partial
+
+	r, size, err := u.FetchUpdate(context.Background(), http.DefaultClient,
+		ts.URL+"/artifact", time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+	r.Close()
+	kept, err := ioutil.ReadFile(partial)
+	require.NoError(t, err)
+	assert.Equal(t, content[:1000], kept)
+
+	// the next fetch of the same URL continues where the last one stopped
+	mutex.Lock()
+	down = false
+	ranges = nil
+	mutex.Unlock()
+	r, size, err = u.FetchUpdate(context.Background(), http.DefaultClient,
+		ts.URL+"/artifact", time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"bytes=1000-"}, ranges)
+
+	// nothing is kept once complete
+	_, err = os.Stat(partial)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(partial + partialInfoSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// parts of other downloads are not resumed
+	r, _, err = u.FetchUpdate(context.Background(), http.DefaultClient,
+		ts.URL+"/artifact", time.Millisecond)
+	require.NoError(t, err)
+	buf := make([]byte, 500)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	r.Close()
+	mutex.Lock()
+	ranges = nil
+	mutex.Unlock()
+	r, _, err = u.FetchUpdate(context.Background(), http.DefaultClient,
+		ts.URL+"/other", time.Millisecond)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{""}, ranges)
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// FileDeploymentDescriptor is the file describing the deployment in the
+// directory of a file:// update source, in the format of the update check
+// response of the server.
+const FileDeploymentDescriptor = "deployment.json"
+
+// UpdateTransports is an Updater passing update checks and downloads on to
+// the Updater registered for the scheme of the server or artifact URL.
+// Further transports can be added to it by scheme.
+type UpdateTransports map[string]Updater
+
+// NewUpdateTransports returns the transports for HTTP(S) servers and for
+// file:// update sources, such as USB sticks on air-gapped devices. Artifacts
+// downloaded from servers must have minImageSize bytes at least; the update
+// check responses of servers are checked as set by responses. Downloads from
+// servers are kept in partialFile, unless empty, to continue from if they fail.
+func NewUpdateTransports(minImageSize int64, responses UpdateResponseConfig,
+	partialFile string) UpdateTransports {
+
+	up := NewUpdate()
+	up.minImageSize = minImageSize
+	up.responses = responses
+	up.partialFile = partialFile
+	return UpdateTransports{
+		"http":  up,
+		"https": up,
+		"file":  NewFileUpdate(),
+	}
+}
+
+func (t UpdateTransports) transport(uri string) (Updater, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid URL")
+	}
+	up, ok := t[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, errors.Errorf("no update transport for %q URLs", u.Scheme)
+	}
+	return up, nil
+}
+
+func (t UpdateTransports) GetScheduledUpdate(ctx context.Context, api ApiRequester,
+	server string, current CurrentUpdate) (interface{}, error) {
+
+	up, err := t.transport(server)
+	if err != nil {
+		return nil, err
+	}
+	return up.GetScheduledUpdate(ctx, api, server, current)
+}
+
+func (t UpdateTransports) FetchUpdate(ctx context.Context, api ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+
+	up, err := t.transport(url)
+	if err != nil {
+		return nil, -1, err
+	}
+	return up.FetchUpdate(ctx, api, url, maxWait)
+}
+
+// IsLocalUpdateSource tells if updates are read from a local directory
+// rather than from a server.
+func IsLocalUpdateSource(server string) bool {
+	return strings.HasPrefix(strings.ToLower(server), "file://")
+}
+
+// FileUpdater reads updates from a local directory, given as file:// URL.
+type FileUpdater struct{}
+
+func NewFileUpdate() *FileUpdater {
+	return &FileUpdater{}
+}
+
+func filePath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid URL")
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.Errorf("file URL %s is not local", uri)
+	}
+	return u.Path, nil
+}
+
+// GetScheduledUpdate reads the deployment descriptor of the update source;
+// there is no update if the directory does not have one.
+func (f *FileUpdater) GetScheduledUpdate(ctx context.Context, api ApiRequester,
+	server string, current CurrentUpdate) (interface{}, error) {
+
+	dir, err := filePath(server)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, FileDeploymentDescriptor))
+	if os.IsNotExist(err) {
+		log.Debugf("no deployment in %s", dir)
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read deployment")
+	}
+
+	update, err := decodeUpdateResponse(data, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse deployment")
+	}
+	if err := validateGetUpdate(update, updateResponseRules{}); err != nil {
+		return nil, err
+	}
+
+	// artifacts are usually given relative to the descriptor
+	if uri := update.Artifact.Source.URI; !strings.Contains(uri, "://") {
+		if !filepath.IsAbs(uri) {
+			uri = filepath.Join(dir, uri)
+		}
+		update.Artifact.Source.URI = (&url.URL{Scheme: "file", Path: uri}).String()
+	}
+	return update, nil
+}
+
+// FetchUpdate opens the artifact file.
+func (f *FileUpdater) FetchUpdate(ctx context.Context, api ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+
+	path, err := filePath(url)
+	if err != nil {
+		return nil, -1, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "failed to open artifact")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, -1, errors.Wrapf(err, "failed to open artifact")
+	}
+	return file, info.Size(), nil
+}
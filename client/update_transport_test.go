@@ -0,0 +1,98 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateTransports(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, correctUpdateResponse)
+	}))
+	defer ts.Close()
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	transports := NewUpdateTransports(DefaultMinImageSize, UpdateResponseConfig{}, "")
+	data, err := transports.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://menderupdate.com", data.(UpdateResponse).URI())
+
+	_, err = transports.GetScheduledUpdate(context.Background(), ac, "mqtt://broker", CurrentUpdate{})
+	assert.EqualError(t, err, `no update transport for "mqtt" URLs`)
+	_, _, err = transports.FetchUpdate(context.Background(), ac, "ftp://server/artifact", time.Minute)
+	assert.Error(t, err)
+
+	assert.True(t, IsLocalUpdateSource("file:///media/usb"))
+	assert.False(t, IsLocalUpdateSource(ts.URL))
+}
+
+func TestFileUpdater(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-updates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	source := "file://" + dir
+
+	up := NewUpdateTransports(DefaultMinImageSize, UpdateResponseConfig{}, "")
+	data, err := up.GetScheduledUpdate(context.Background(), nil, source, CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "release-2.mender"),
+		[]byte("artifact"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, FileDeploymentDescriptor), []byte(`{
+		"id": "usb",
+		"artifact": {
+			"artifact_name": "release-2",
+			"device_types_compatible": ["qemux86-64"],
+			"source": {"uri": "release-2.mender"}
+		}
+	}`), 0644))
+
+	data, err = up.GetScheduledUpdate(context.Background(), nil, source, CurrentUpdate{})
+	require.NoError(t, err)
+	update := data.(UpdateResponse)
+	assert.Equal(t, "release-2", update.ArtifactName())
+	assert.Equal(t, "file://"+filepath.Join(dir, "release-2.mender"), update.URI())
+
+	img, size, err := up.FetchUpdate(context.Background(), nil, update.URI(), time.Minute)
+	require.NoError(t, err)
+	defer img.Close()
+	assert.Equal(t, int64(8), size)
+	content, err := ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	assert.Equal(t, "artifact", string(content))
+
+	_, _, err = up.FetchUpdate(context.Background(), nil, "file://"+dir+"/missing", time.Minute)
+	assert.Error(t, err)
+	_, _, err = up.FetchUpdate(context.Background(), nil, "file://server/artifact", time.Minute)
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, FileDeploymentDescriptor),
+		[]byte(`{"id": "usb"}`), 0644))
+	_, err = up.GetScheduledUpdate(context.Background(), nil, source, CurrentUpdate{})
+	assert.Error(t, err)
+}
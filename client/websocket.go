@@ -0,0 +1,396 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocket message types (RFC 6455, section 5.2).
+const (
+	WebSocketText   = 0x1
+	WebSocketBinary = 0x2
+
+	wsContinuation = 0x0
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// largest message accepted from the peer
+	maxWebSocketMessage = 1024 * 1024
+	// how often clients ping the server; the server has as long again to
+	// answer before the connection is considered dead
+	wsPingInterval = 30 * time.Second
+)
+
+// WebSocket is a minimal WebSocket connection, as much of RFC 6455 as
+// exchanging messages with the server takes.
+type WebSocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// clients mask the frames they send, servers do not
+	mask bool
+	// serializes the writes of the frames
+	wlock sync.Mutex
+	// clients ping the server, and expect to read from it, this often
+	pingInterval time.Duration
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// DialWebSocket opens a WebSocket connection to the http(s) URL, using the
+// dialer and trust anchors of the client. Proxies are not supported.
+func (a *ApiClient) DialWebSocket(ctx context.Context, uri string,
+	header http.Header) (*WebSocket, error) {
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid WebSocket URL")
+	}
+	if a.gateway != nil && a.gateway.host == u.Host {
+		return a.gateway.client.DialWebSocket(ctx, uri, header)
+	}
+	host := hostPort(u, "80")
+	if u.Scheme == "https" {
+		host = hostPort(u, "443")
+	}
+
+	// upgrading the connection takes HTTP/1.1
+	conn, err := a.dialConn(ctx, host, u.Hostname(), u.Scheme == "https",
+		[]string{"http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := a.upgrade(ctx, conn, u, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// dialConn connects to host with the dialer and TLS settings of the client,
+// so that the raw connection trusts the same servers as its requests do. The
+// connection is long-lived, and keeps its own deadlines rather than the idle
+// timeout of requests.
+func (a *ApiClient) dialConn(ctx context.Context, host, serverName string,
+	secure bool, protos []string) (net.Conn, error) {
+
+	transport := a.transport()
+	dial := (&net.Dialer{}).DialContext
+	if transport != nil && transport.DialContext != nil {
+		dial = transport.DialContext
+	}
+	conn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", host)
+	}
+	if ic, ok := conn.(*idleTimeoutConn); ok {
+		conn = ic.Conn
+	}
+	if !secure {
+		return conn, nil
+	}
+
+	conf := &tls.Config{}
+	if transport != nil && transport.TLSClientConfig != nil {
+		conf = transport.TLSClientConfig.Clone()
+	}
+	conf.NextProtos = protos
+	if conf.ServerName == "" {
+		conf.ServerName = serverName
+	}
+	tconn := tls.Client(conn, conf)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "TLS handshake with %s failed", host)
+	}
+	return tconn, nil
+}
+
+func (a *ApiClient) upgrade(ctx context.Context, conn net.Conn, u *url.URL,
+	header http.Header) (*WebSocket, error) {
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range a.headers {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrapf(err, "failed to send WebSocket handshake")
+	}
+
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read WebSocket handshake")
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, NewAPIError(errors.Errorf("WebSocket handshake failed: %s",
+			rsp.Status), rsp)
+	}
+	if rsp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("WebSocket handshake failed: invalid accept key")
+	}
+	ws := &WebSocket{
+		conn:         conn,
+		r:            r,
+		mask:         true,
+		pingInterval: wsPingInterval,
+		done:         make(chan struct{}),
+	}
+	go ws.keepAlive()
+	return ws, nil
+}
+
+// keepAlive pings the server until the connection is closed, so that it is
+// not dropped as idle on the way, and a dead server is noticed.
+func (ws *WebSocket) keepAlive() {
+	ticker := time.NewTicker(ws.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.writeFrame(wsPing, nil); err != nil {
+				return
+			}
+		case <-ws.done:
+			return
+		}
+	}
+}
+
+// AcceptWebSocket upgrades the server side of the request to a WebSocket
+// connection.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "not a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can not be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("connection can not be upgraded")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, r: rw.Reader, done: make(chan struct{})}, nil
+}
+
+// ReadMessage returns the type and the payload of the next data message,
+// answering the control frames received in the meantime. io.EOF is returned
+// once the peer closes the connection.
+func (ws *WebSocket) ReadMessage() (int, []byte, error) {
+	var msgType int
+	var msg []byte
+	for {
+		if ws.pingInterval > 0 {
+			ws.conn.SetReadDeadline(time.Now().Add(2 * ws.pingInterval))
+		}
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if msgType == 0 {
+				return 0, nil, errors.New("unexpected WebSocket continuation frame")
+			}
+		case WebSocketText, WebSocketBinary:
+			if msgType != 0 {
+				return 0, nil, errors.New("unexpected WebSocket data frame")
+			}
+			msgType = opcode
+		default:
+			return 0, nil, errors.Errorf("unsupported WebSocket opcode %d", opcode)
+		}
+
+		if len(msg)+len(payload) > maxWebSocketMessage {
+			return 0, nil, errors.New("WebSocket message too large")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msgType, msg, nil
+		}
+	}
+}
+
+func (ws *WebSocket) readFrame() (bool, int, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode := int(hdr[0] & 0x0f)
+	masked := hdr[1]&0x80 != 0
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, errors.New("WebSocket frame too large")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.r, key[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(key, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a data message of the given type; it is safe to call
+// from multiple goroutines.
+func (ws *WebSocket) WriteMessage(msgType int, data []byte) error {
+	return ws.writeFrame(msgType, data)
+}
+
+func (ws *WebSocket) writeFrame(opcode int, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|byte(opcode))
+
+	var maskBit byte
+	if ws.mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	start := len(frame)
+	if ws.mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start += 4
+		frame = append(frame, payload...)
+		maskBytes(key, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	ws.wlock.Lock()
+	defer ws.wlock.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+func maskBytes(key [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= key[i%4]
+	}
+}
+
+// Close sends a close frame and closes the connection.
+func (ws *WebSocket) Close() error {
+	ws.closeOnce.Do(func() {
+		close(ws.done)
+	})
+	ws.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return ws.conn.Close()
+}
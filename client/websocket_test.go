@@ -0,0 +1,157 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoWebSocket sends the messages it receives back, after a ping.
+func echoWebSocket(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ws, err := AcceptWebSocket(w, r)
+		require.NoError(t, err)
+		defer ws.Close()
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.writeFrame(wsPing, []byte("ping"))
+			if err := ws.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func testEcho(t *testing.T, ac *ApiClient, url string) {
+	ws, err := ac.DialWebSocket(context.Background(), url,
+		http.Header{"Authorization": []string{"Bearer token"}})
+	require.NoError(t, err)
+	defer ws.Close()
+
+	for _, size := range []int{0, 10, 200, 70000} {
+		msg := bytes.Repeat([]byte{'m'}, size)
+		require.NoError(t, ws.WriteMessage(WebSocketBinary, msg))
+		msgType, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, WebSocketBinary, msgType)
+		assert.Equal(t, string(msg), string(data))
+	}
+	require.NoError(t, ws.WriteMessage(WebSocketText, []byte("hello")))
+	msgType, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, WebSocketText, msgType)
+	assert.Equal(t, "hello", string(data))
+
+	// the peer answers the close
+	require.NoError(t, ws.writeFrame(wsClose, nil))
+	_, _, err = ws.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWebSocket(t *testing.T) {
+	ts := httptest.NewServer(echoWebSocket(t))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	testEcho(t, ac, ts.URL)
+
+	_, err = ac.DialWebSocket(context.Background(), ts.URL, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "websocket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := filepath.Join(dir, "server.crt")
+	ts := newTestTLSServer(t, "server", cert)
+	defer ts.Close()
+	ts.Config.Handler = echoWebSocket(t)
+
+	ac, err := NewApiClient(Config{IsHttps: true, ServerCert: cert})
+	require.NoError(t, err)
+	testEcho(t, ac, ts.URL)
+
+	// the server is not trusted
+	ac, err = NewApiClient(Config{IsHttps: true})
+	require.NoError(t, err)
+	_, err = ac.DialWebSocket(context.Background(), ts.URL, nil)
+	assert.Error(t, err)
+}
+
+func TestWebSocketIdle(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := AcceptWebSocket(w, r)
+		require.NoError(t, err)
+		defer ws.Close()
+		time.Sleep(300 * time.Millisecond)
+		ws.WriteMessage(WebSocketText, []byte("late"))
+		ws.ReadMessage()
+	}))
+	defer ts.Close()
+
+	// the connection outlives the idle timeout of requests
+	ac, err := NewApiClient(Config{IdleTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	ws, err := ac.DialWebSocket(context.Background(), ts.URL, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "late", string(data))
+}
+
+func TestWebSocketFragments(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := AcceptWebSocket(w, r)
+		require.NoError(t, err)
+		defer ws.Close()
+		ws.conn.Write([]byte{WebSocketText, 3, 'o', 'n', 'e'})
+		ws.conn.Write([]byte{0x80 | wsPing, 0})
+		ws.conn.Write([]byte{0x80 | wsContinuation, 3, 't', 'w', 'o'})
+		ws.ReadMessage()
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	require.NoError(t, err)
+	ws, err := ac.DialWebSocket(context.Background(), ts.URL, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "onetwo", string(data))
+}
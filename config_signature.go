@@ -0,0 +1,72 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// ConfigVerifyKey is the base64 encoded PEM public key the configuration
+// files, and the keys they point to, must be signed with, set at build time:
+//
+//	go build -ldflags "-X main.ConfigVerifyKey=$(base64 -w0 root.pub)"
+//
+// The signatures are not checked if it is empty.
+var ConfigVerifyKey string
+
+// Suffix of the files holding the signatures of the files they are named
+// after, e.g. mender.conf.sig: base64 encoded, as given by
+//
+//	openssl dgst -sha256 -sign root.key mender.conf | base64 -w0
+const configSignatureSuffix = ".sig"
+
+// configRootKey returns the key built in as ConfigVerifyKey, or nil if
+// there is none.
+func configRootKey() ([]byte, error) {
+	if ConfigVerifyKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(ConfigVerifyKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid built-in configuration verify key")
+	}
+	return key, nil
+}
+
+// verifyConfigSignature checks that data, read from file, is signed with the
+// built-in key, if there is one. The data is passed in rather than read
+// again, so that what is verified is what is used.
+func verifyConfigSignature(file string, data []byte) error {
+	key, err := configRootKey()
+	if err != nil || key == nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(file + configSignatureSuffix)
+	if os.IsNotExist(err) {
+		return errors.Errorf("%s is not signed, refusing to use it", file)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read signature of %s", file)
+	}
+	if err := artifact.NewVerifier(key).Verify(data, bytes.TrimSpace(sig)); err != nil {
+		return errors.Wrapf(err, "invalid signature of %s, it may have been tampered with",
+			file)
+	}
+	return nil
+}
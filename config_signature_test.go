@@ -0,0 +1,92 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setConfigVerifyKey(key string) func() {
+	old := ConfigVerifyKey
+	ConfigVerifyKey = base64.StdEncoding.EncodeToString([]byte(key))
+	return func() { ConfigVerifyKey = old }
+}
+
+func writeSigned(t *testing.T, file string, data []byte) {
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	sig, err := artifact.NewSigner([]byte(PrivateRSAKey)).Sign(data)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file+configSignatureSuffix, sig, 0600))
+}
+
+func TestConfigSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-signature")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	confFile := path.Join(dir, "mender.conf")
+	conf := []byte(`{"ServerURL": "https://docker.mender.io"}`)
+
+	// not checked without a built-in key
+	require.NoError(t, ioutil.WriteFile(confFile, conf, 0600))
+	config, err := loadConfig(confFile, "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://docker.mender.io", config.ServerURL)
+
+	defer setConfigVerifyKey(PublicRSAKey)()
+
+	_, err = loadConfig(confFile, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not signed")
+
+	writeSigned(t, confFile, conf)
+	config, err = loadConfig(confFile, "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://docker.mender.io", config.ServerURL)
+
+	require.NoError(t, ioutil.WriteFile(confFile,
+		[]byte(`{"ServerURL": "https://evil.example.com"}`), 0600))
+	_, err = loadConfig(confFile, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tampered")
+
+	// the keys the configuration points to are verified as well
+	keyFile := path.Join(dir, "artifact-verify-key.pem")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(PublicRSAKey), 0600))
+	writeSigned(t, confFile, []byte(`{"ArtifactVerifyKey": "`+keyFile+`"}`))
+	_, err = loadConfig(confFile, "")
+	assert.Error(t, err)
+
+	writeSigned(t, keyFile, []byte(PublicRSAKey))
+	config, err = loadConfig(confFile, "")
+	require.NoError(t, err)
+	key, err := config.GetVerificationKey()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(PublicRSAKey), key)
+
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(PrivateRSAKey), 0600))
+	_, err = config.GetVerificationKey()
+	assert.Error(t, err)
+
+	ConfigVerifyKey = "not base64!"
+	_, err = loadConfig(confFile, "")
+	assert.Error(t, err)
+}
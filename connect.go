@@ -0,0 +1,400 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	deviceConnectURL     = "/api/devices/v1/deviceconnect/connect"
+	defaultShellCommand  = "/bin/sh"
+	maxConnectBackoff    = 10 * time.Minute
+	connectChunkSize     = 32 * 1024
+	portForwardDialLimit = 10 * time.Second
+)
+
+// Types of the messages exchanged with the server; "shell", "file-get",
+// "file-put" and "port-forward" are sent by the server to open sessions,
+// "data" and "close" by both sides.
+const (
+	connectShell       = "shell"
+	connectFileGet     = "file-get"
+	connectFilePut     = "file-put"
+	connectPortForward = "port-forward"
+	connectData        = "data"
+	connectClose       = "close"
+	connectError       = "error"
+)
+
+// connectMessage is sent as a WebSocket text message in either direction.
+type connectMessage struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	// user of the server UI opening the session
+	User    string `json:"user,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Address string `json:"address,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// remoteConnect keeps a WebSocket connection open to the server, serving
+// the remote shell, file transfer and port forwarding sessions the server
+// opens through it.
+type remoteConnect struct {
+	api    *client.ApiClient
+	server string
+	token  func() (client.AuthToken, error)
+	config menderConfig
+	audit  *os.File
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lock     sync.Mutex
+	ws       *client.WebSocket
+	sessions map[string]io.WriteCloser
+}
+
+func startRemoteConnect(api *client.ApiClient, config menderConfig,
+	token func() (client.AuthToken, error)) (*remoteConnect, error) {
+
+	rc := &remoteConnect{
+		api:      api,
+		server:   config.ServerURL,
+		token:    token,
+		config:   config,
+		done:     make(chan struct{}),
+		sessions: make(map[string]io.WriteCloser),
+	}
+	if config.DeviceConnect.AuditLogFile != "" {
+		f, err := os.OpenFile(config.DeviceConnect.AuditLogFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open remote connect audit log")
+		}
+		rc.audit = f
+	}
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+
+	go rc.run()
+	log.Infof("remote connect: enabled")
+	return rc, nil
+}
+
+// Close drops the connection, ending all the sessions.
+func (rc *remoteConnect) Close() error {
+	rc.cancel()
+	rc.lock.Lock()
+	if rc.ws != nil {
+		rc.ws.Close()
+	}
+	rc.lock.Unlock()
+	<-rc.done
+	if rc.audit != nil {
+		return rc.audit.Close()
+	}
+	return nil
+}
+
+func (rc *remoteConnect) run() {
+	defer close(rc.done)
+	for attempt := 0; ; attempt++ {
+		connected, err := rc.connect()
+		if rc.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			attempt = 0
+		}
+		wait, berr := client.GetExponentialBackoffTime(attempt, maxConnectBackoff)
+		if berr != nil {
+			wait = maxConnectBackoff
+		}
+		log.Warnf("remote connect: connection failed: %v; retrying in %v", err, wait)
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// connect serves the sessions until the connection is lost; connected tells
+// if the connection was established at all.
+func (rc *remoteConnect) connect() (bool, error) {
+	token, err := rc.token()
+	if err != nil || token == "" {
+		return false, errors.New("device is not authorized")
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+string(token))
+	ws, err := rc.api.DialWebSocket(rc.ctx, rc.server+deviceConnectURL, header)
+	if err != nil {
+		return false, err
+	}
+
+	rc.lock.Lock()
+	rc.ws = ws
+	rc.lock.Unlock()
+	log.Infof("remote connect: connected to %s", rc.server)
+
+	err = rc.serve(ws)
+
+	rc.lock.Lock()
+	rc.ws = nil
+	ids := make([]string, 0, len(rc.sessions))
+	for id := range rc.sessions {
+		ids = append(ids, id)
+	}
+	rc.lock.Unlock()
+	for _, id := range ids {
+		rc.endSession(id)
+	}
+	ws.Close()
+	return true, err
+}
+
+func (rc *remoteConnect) serve(ws *client.WebSocket) error {
+	for {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgType != client.WebSocketText {
+			continue
+		}
+		var msg connectMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warnf("remote connect: invalid message: %v", err)
+			continue
+		}
+		if err := rc.handle(ws, msg); err != nil {
+			log.Warnf("remote connect: session %s: %v", msg.Session, err)
+			rc.send(ws, connectMessage{
+				Type:    connectError,
+				Session: msg.Session,
+				Error:   err.Error(),
+			})
+		}
+	}
+}
+
+func (rc *remoteConnect) handle(ws *client.WebSocket, msg connectMessage) error {
+	if msg.Session == "" {
+		return errors.New("missing session")
+	}
+
+	switch msg.Type {
+	case connectShell:
+		if !rc.config.DeviceConnect.Shell {
+			return errors.New("remote shell is disabled")
+		}
+		return rc.openShell(ws, msg)
+	case connectFileGet, connectFilePut:
+		if !rc.config.DeviceConnect.FileTransfer {
+			return errors.New("file transfer is disabled")
+		}
+		return rc.openFile(ws, msg)
+	case connectPortForward:
+		if !rc.config.DeviceConnect.PortForward {
+			return errors.New("port forwarding is disabled")
+		}
+		return rc.openPortForward(ws, msg)
+	case connectData:
+		rc.lock.Lock()
+		s := rc.sessions[msg.Session]
+		rc.lock.Unlock()
+		if s == nil {
+			return errors.New("no such session")
+		}
+		if _, err := s.Write(msg.Data); err != nil {
+			rc.endSession(msg.Session)
+			return err
+		}
+		return nil
+	case connectClose:
+		return rc.endSession(msg.Session)
+	default:
+		return errors.Errorf("unsupported message type %q", msg.Type)
+	}
+}
+
+func (rc *remoteConnect) send(ws *client.WebSocket, msg connectMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(client.WebSocketText, data)
+}
+
+func (rc *remoteConnect) auditf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	log.Infof("remote connect: %s", line)
+	if rc.audit != nil {
+		fmt.Fprintf(rc.audit, "%s %s\n", time.Now().UTC().Format(time.RFC3339), line)
+	}
+}
+
+func (rc *remoteConnect) addSession(msg connectMessage, s io.WriteCloser,
+	what string) error {
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if _, ok := rc.sessions[msg.Session]; ok {
+		s.Close()
+		return errors.New("session exists already")
+	}
+	rc.sessions[msg.Session] = s
+	rc.auditf("session %s opened by %q: %s", msg.Session, msg.User, what)
+	return nil
+}
+
+// endSession closes the session, if it was not closed already.
+func (rc *remoteConnect) endSession(id string) error {
+	rc.lock.Lock()
+	s, ok := rc.sessions[id]
+	delete(rc.sessions, id)
+	rc.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	err := s.Close()
+	rc.auditf("session %s closed", id)
+	return err
+}
+
+// forward sends what is read from r to the server, closing the session once
+// there is nothing more to read.
+func (rc *remoteConnect) forward(ws *client.WebSocket, id string, r io.Reader) {
+	buf := make([]byte, connectChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if serr := rc.send(ws, connectMessage{
+				Type:    connectData,
+				Session: id,
+				Data:    buf[:n],
+			}); serr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	rc.endSession(id)
+	rc.send(ws, connectMessage{Type: connectClose, Session: id})
+}
+
+// shellInput is the input of a shell session; closing it ends the shell.
+type shellInput struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (s *shellInput) Close() error {
+	err := s.WriteCloser.Close()
+	s.cmd.Process.Kill()
+	return err
+}
+
+func (rc *remoteConnect) openShell(ws *client.WebSocket, msg connectMessage) error {
+	shell := rc.config.DeviceConnect.ShellCommand
+	if shell == "" {
+		shell = defaultShellCommand
+	}
+	cmd := exec.Command(shell)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start %s", shell)
+	}
+
+	if err := rc.addSession(msg, &shellInput{stdin, cmd}, "shell "+shell); err != nil {
+		cmd.Wait()
+		return err
+	}
+	go func() {
+		rc.forward(ws, msg.Session, stdout)
+		cmd.Wait()
+	}()
+	return nil
+}
+
+func (rc *remoteConnect) openFile(ws *client.WebSocket, msg connectMessage) error {
+	if msg.Path == "" {
+		return errors.New("missing path")
+	}
+	if msg.Type == connectFilePut {
+		f, err := os.OpenFile(msg.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		// the data follows, the server closes the session once done
+		return rc.addSession(msg, f, "file-put "+msg.Path)
+	}
+
+	f, err := os.Open(msg.Path)
+	if err != nil {
+		return err
+	}
+	if err := rc.addSession(msg, f, "file-get "+msg.Path); err != nil {
+		return err
+	}
+	go rc.forward(ws, msg.Session, f)
+	return nil
+}
+
+func (rc *remoteConnect) openPortForward(ws *client.WebSocket, msg connectMessage) error {
+	host, _, err := net.SplitHostPort(msg.Address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid address")
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.Errorf("forwarding to %s is not allowed, only to the "+
+			"loopback interface", msg.Address)
+	}
+	conn, err := net.DialTimeout("tcp", msg.Address, portForwardDialLimit)
+	if err != nil {
+		return err
+	}
+	if err := rc.addSession(msg, conn, "port-forward "+msg.Address); err != nil {
+		return err
+	}
+	go rc.forward(ws, msg.Session, conn)
+	return nil
+}
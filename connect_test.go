@@ -0,0 +1,213 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConnectServer struct {
+	*httptest.Server
+	conns chan *client.WebSocket
+}
+
+func newTestConnectServer(t *testing.T) *testConnectServer {
+	ts := &testConnectServer{conns: make(chan *client.WebSocket, 1)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != deviceConnectURL || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ws, err := client.AcceptWebSocket(w, r)
+		require.NoError(t, err)
+		ts.conns <- ws
+	}))
+	return ts
+}
+
+func startTestRemoteConnect(t *testing.T, config menderConfig) (*remoteConnect,
+	*client.WebSocket, func()) {
+
+	ts := newTestConnectServer(t)
+	api, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	config.ServerURL = ts.URL
+	rc, err := startRemoteConnect(api, config, func() (client.AuthToken, error) {
+		return "token", nil
+	})
+	require.NoError(t, err)
+
+	select {
+	case ws := <-ts.conns:
+		return rc, ws, func() {
+			rc.Close()
+			ts.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("device did not connect")
+	}
+	return nil, nil, nil
+}
+
+func sendConnect(t *testing.T, ws *client.WebSocket, msg connectMessage) {
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteMessage(client.WebSocketText, data))
+}
+
+// readSession returns the data received in the session until it is closed.
+func readSession(t *testing.T, ws *client.WebSocket) (string, []connectMessage) {
+	var data []byte
+	var msgs []connectMessage
+	for {
+		_, raw, err := ws.ReadMessage()
+		require.NoError(t, err)
+		var msg connectMessage
+		require.NoError(t, json.Unmarshal(raw, &msg))
+		msgs = append(msgs, msg)
+		switch msg.Type {
+		case connectData:
+			data = append(data, msg.Data...)
+		case connectClose, connectError:
+			return string(data), msgs
+		}
+	}
+}
+
+func TestRemoteConnectDisabled(t *testing.T) {
+	var config menderConfig
+	config.DeviceConnect.Enabled = true
+	_, ws, stop := startTestRemoteConnect(t, config)
+	defer stop()
+
+	for _, msg := range []connectMessage{
+		{Type: connectShell, Session: "1"},
+		{Type: connectFileGet, Session: "2", Path: "/etc/hostname"},
+		{Type: connectPortForward, Session: "3", Address: "127.0.0.1:22"},
+		{Type: "reboot", Session: "4"},
+		{Type: connectData, Session: "5"},
+	} {
+		sendConnect(t, ws, msg)
+		_, msgs := readSession(t, ws)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, connectError, msgs[0].Type, msg.Type)
+		assert.Equal(t, msg.Session, msgs[0].Session)
+	}
+}
+
+func TestRemoteConnectShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	audit := filepath.Join(dir, "audit.log")
+
+	var config menderConfig
+	config.DeviceConnect.Enabled = true
+	config.DeviceConnect.Shell = true
+	config.DeviceConnect.AuditLogFile = audit
+	_, ws, stop := startTestRemoteConnect(t, config)
+
+	sendConnect(t, ws, connectMessage{Type: connectShell, Session: "s1", User: "admin"})
+	sendConnect(t, ws, connectMessage{Type: connectData, Session: "s1",
+		Data: []byte("echo hello; echo world >&2; exit\n")})
+	data, _ := readSession(t, ws)
+	assert.Equal(t, "hello\nworld\n", data)
+
+	// sessions are closed by the server
+	sendConnect(t, ws, connectMessage{Type: connectShell, Session: "s2", User: "admin"})
+	sendConnect(t, ws, connectMessage{Type: connectClose, Session: "s2"})
+	_, msgs := readSession(t, ws)
+	assert.Equal(t, connectClose, msgs[len(msgs)-1].Type)
+	stop()
+
+	log, err := ioutil.ReadFile(audit)
+	require.NoError(t, err)
+	assert.Contains(t, string(log), `session s1 opened by "admin": shell /bin/sh`)
+	assert.Contains(t, string(log), "session s1 closed")
+	assert.Contains(t, string(log), "session s2 closed")
+}
+
+func TestRemoteConnectFileTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var config menderConfig
+	config.DeviceConnect.Enabled = true
+	config.DeviceConnect.FileTransfer = true
+	_, ws, stop := startTestRemoteConnect(t, config)
+	defer stop()
+
+	file := filepath.Join(dir, "file")
+	sendConnect(t, ws, connectMessage{Type: connectFilePut, Session: "put", Path: file})
+	sendConnect(t, ws, connectMessage{Type: connectData, Session: "put", Data: []byte("file ")})
+	sendConnect(t, ws, connectMessage{Type: connectData, Session: "put", Data: []byte("contents")})
+	sendConnect(t, ws, connectMessage{Type: connectClose, Session: "put"})
+
+	sendConnect(t, ws, connectMessage{Type: connectFileGet, Session: "get", Path: file})
+	data, _ := readSession(t, ws)
+	assert.Equal(t, "file contents", data)
+
+	sendConnect(t, ws, connectMessage{Type: connectFileGet, Session: "missing",
+		Path: filepath.Join(dir, "missing")})
+	_, msgs := readSession(t, ws)
+	assert.Equal(t, connectError, msgs[0].Type)
+}
+
+func TestRemoteConnectPortForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 4)
+		n, _ := conn.Read(buf)
+		conn.Write(append([]byte("re: "), buf[:n]...))
+		conn.Close()
+	}()
+
+	var config menderConfig
+	config.DeviceConnect.Enabled = true
+	config.DeviceConnect.PortForward = true
+	_, ws, stop := startTestRemoteConnect(t, config)
+	defer stop()
+
+	sendConnect(t, ws, connectMessage{Type: connectPortForward, Session: "pf",
+		Address: l.Addr().String()})
+	sendConnect(t, ws, connectMessage{Type: connectData, Session: "pf", Data: []byte("ping")})
+	data, _ := readSession(t, ws)
+	assert.Equal(t, "re: ping", data)
+
+	// only the local ports can be reached
+	sendConnect(t, ws, connectMessage{Type: connectPortForward, Session: "remote",
+		Address: "192.0.2.1:22"})
+	_, msgs := readSession(t, ws)
+	assert.Equal(t, connectError, msgs[0].Type)
+	assert.Contains(t, msgs[0].Error, "loopback")
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Ways of telling whether the device is online, as configured by
+// ConnectivityCheck.
+const (
+	connectivityProbe          = "probe"
+	connectivityNetworkManager = "networkmanager"
+	connectivityConnMan        = "connman"
+	connectivityNone           = "none"
+)
+
+// Time the connectivity probe may take to connect.
+var connectivityProbeTimeout = 5 * time.Second
+
+// How often the connectivity is checked again while the device is offline.
+var offlineRecheckInterval = time.Minute
+
+// connectivityChecker tells whether the device is online. Checkers failing to
+// tell, e.g. as the connection manager is not running, return an error; the
+// device is assumed to be online then.
+type connectivityChecker interface {
+	Online() (bool, error)
+}
+
+// validateConnectivityCheck checks the configured ConnectivityCheck.
+func validateConnectivityCheck(check string) error {
+	switch check {
+	case "", connectivityProbe, connectivityNetworkManager, connectivityConnMan,
+		connectivityNone:
+		return nil
+	}
+	return errors.Errorf("unsupported ConnectivityCheck: %q", check)
+}
+
+// newConnectivityChecker returns the checker selected by the configuration,
+// or nil if the connectivity is not checked.
+func newConnectivityChecker(config menderConfig) (connectivityChecker, error) {
+	switch config.ConnectivityCheck {
+	case "", connectivityNone:
+		return nil, nil
+	case connectivityProbe:
+		if config.ServerURL == "" {
+			return nil, nil
+		}
+		addr, err := probeAddress(config.ServerURL, config.HttpProxy)
+		if err != nil {
+			log.Warnf("not checking whether the device is online: %v", err)
+			return nil, nil
+		}
+		// connecting the way the client does, with the hosts pinned and
+		// the DNS server configured
+		dial, err := client.NewServerDialer(connectivityProbeTimeout,
+			config.GetHttpConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &dialProbe{address: addr, dial: dial}, nil
+	case connectivityNetworkManager:
+		return busctlChecker(networkManagerOnline), nil
+	case connectivityConnMan:
+		return busctlChecker(connManOnline), nil
+	}
+	return nil, validateConnectivityCheck(config.ConnectivityCheck)
+}
+
+// probeAddress returns the address the probe connects to: that of the proxy
+// requests to the server go through, if any, or that of the server.
+func probeAddress(serverURL, httpProxy string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" {
+		return "", errors.Errorf("invalid server URL for the connectivity probe: %q",
+			serverURL)
+	}
+	proxy := http.ProxyFromEnvironment
+	if httpProxy != "" {
+		proxyURL, err := url.Parse(httpProxy)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid proxy URL")
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	if p, err := proxy(&http.Request{URL: u}); err == nil && p != nil {
+		u = p
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// dialProbe considers the device online if it can connect to address.
+type dialProbe struct {
+	address string
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (p *dialProbe) Online() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectivityProbeTimeout)
+	defer cancel()
+	conn, err := p.dial(ctx, "tcp", p.address)
+	if err != nil {
+		log.Debugf("connectivity probe of %s failed: %v", p.address, err)
+		return false, nil
+	}
+	conn.Close()
+	return true, nil
+}
+
+// busctlChecker asks a connection manager over D-Bus, with busctl.
+type busctlChecker func(run func(args ...string) (string, error)) (bool, error)
+
+func (c busctlChecker) Online() (bool, error) {
+	return c(func(args ...string) (string, error) {
+		out, err := exec.Command("busctl", append([]string{"--system"}, args...)...).Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "busctl %s failed", strings.Join(args, " "))
+		}
+		return string(out), nil
+	})
+}
+
+// States of NetworkManager; the device is connected, at least to its local
+// network, from nmStateConnectedLocal on.
+const nmStateConnectedLocal = 50
+
+// networkManagerOnline reads the State property of NetworkManager, given by
+// busctl as "u 70".
+func networkManagerOnline(run func(args ...string) (string, error)) (bool, error) {
+	out, err := run("get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "State")
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false, errors.Errorf("unexpected NetworkManager state: %q", out)
+	}
+	state, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, errors.Errorf("unexpected NetworkManager state: %q", out)
+	}
+	return state >= nmStateConnectedLocal, nil
+}
+
+var connManStateRegexp = regexp.MustCompile(`"State" s "([a-z]+)"`)
+
+// connManOnline reads the State of the ConnMan manager properties, given by
+// busctl as `a{sv} 3 "State" s "online" ...`; the device is connected in the
+// ready and online states, the latter once ConnMan reached the internet.
+func connManOnline(run func(args ...string) (string, error)) (bool, error) {
+	out, err := run("call", "net.connman", "/", "net.connman.Manager", "GetProperties")
+	if err != nil {
+		return false, err
+	}
+	m := connManStateRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return false, errors.Errorf("unexpected ConnMan properties: %q", out)
+	}
+	return m[1] == "ready" || m[1] == "online", nil
+}
+
+// connectivityMonitor logs when the device goes offline and back online,
+// rather than every time the connectivity is checked.
+type connectivityMonitor struct {
+	checker connectivityChecker
+	mutex   sync.Mutex
+	offline bool
+	failing bool
+}
+
+func (m *connectivityMonitor) Online() bool {
+	online, err := m.checker.Online()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		if !m.failing {
+			log.Warnf("can not check whether the device is online, assuming it is: %v", err)
+		}
+		m.failing = true
+		online = true
+	} else {
+		m.failing = false
+	}
+	if online == m.offline {
+		if online {
+			log.Info("device is online again")
+		} else {
+			log.Info("device is offline; deferring update checks and downloads")
+		}
+	}
+	m.offline = !online
+	return online
+}
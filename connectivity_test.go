@@ -0,0 +1,158 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeAddress(t *testing.T) {
+	for url, addr := range map[string]string{
+		"https://hosted.mender.io":      "hosted.mender.io:443",
+		"http://docker.mender.io":       "docker.mender.io:80",
+		"https://docker.mender.io:8443": "docker.mender.io:8443",
+		"https://[2001:db8::1]":         "[2001:db8::1]:443",
+	} {
+		a, err := probeAddress(url, "")
+		assert.NoError(t, err, url)
+		assert.Equal(t, addr, a, url)
+	}
+
+	// through the proxy
+	a, err := probeAddress("https://hosted.mender.io", "http://proxy:3128")
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy:3128", a)
+	a, err = probeAddress("https://hosted.mender.io", "socks5://bastion")
+	assert.NoError(t, err)
+	assert.Equal(t, "bastion:1080", a)
+
+	_, err = probeAddress("bogusurl", "")
+	assert.Error(t, err)
+}
+
+func TestDialProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+
+	var dialer net.Dialer
+	p := &dialProbe{address: addr, dial: dialer.DialContext}
+	online, err := p.Online()
+	assert.NoError(t, err)
+	assert.True(t, online)
+
+	l.Close()
+	online, err = p.Online()
+	assert.NoError(t, err)
+	assert.False(t, online)
+}
+
+func TestConnectionManagerState(t *testing.T) {
+	output := func(out string, err error) func(args ...string) (string, error) {
+		return func(args ...string) (string, error) {
+			return out, err
+		}
+	}
+
+	for out, online := range map[string]bool{
+		"u 70\n": true,
+		"u 50\n": true,
+		"u 20\n": false,
+	} {
+		o, err := networkManagerOnline(output(out, nil))
+		assert.NoError(t, err, out)
+		assert.Equal(t, online, o, out)
+	}
+	_, err := networkManagerOnline(output("s \"connected\"\n", nil))
+	assert.Error(t, err)
+	_, err = networkManagerOnline(output("", errors.New("no NetworkManager")))
+	assert.Error(t, err)
+
+	props := `a{sv} 3 "State" s "%s" "OfflineMode" b false "SessionMode" b false` + "\n"
+	for state, online := range map[string]bool{
+		"online":  true,
+		"ready":   true,
+		"idle":    false,
+		"offline": false,
+	} {
+		o, err := connManOnline(output(strings.Replace(props, "%s", state, 1), nil))
+		assert.NoError(t, err, state)
+		assert.Equal(t, online, o, state)
+	}
+	_, err = connManOnline(output("a{sv} 0\n", nil))
+	assert.Error(t, err)
+}
+
+type fakeConnectivityChecker struct {
+	online bool
+	err    error
+}
+
+func (f *fakeConnectivityChecker) Online() (bool, error) {
+	return f.online, f.err
+}
+
+func TestConnectivityMonitor(t *testing.T) {
+	checker := &fakeConnectivityChecker{online: true}
+	m := &connectivityMonitor{checker: checker}
+	assert.True(t, m.Online())
+	checker.online = false
+	assert.False(t, m.Online())
+	assert.False(t, m.Online())
+
+	// assumed to be online if it can not be told
+	checker.err = errors.New("busctl failed")
+	assert.True(t, m.Online())
+}
+
+func TestNewConnectivityChecker(t *testing.T) {
+	// not checked unless configured
+	c, err := newConnectivityChecker(menderConfig{ServerURL: "https://hosted.mender.io"})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	c, err = newConnectivityChecker(menderConfig{ServerURL: "https://hosted.mender.io",
+		ConnectivityCheck: connectivityNone})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	// the probe connects to the server the way the client does
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	config := menderConfig{ServerURL: "https://mender.invalid:" + port,
+		ConnectivityCheck: connectivityProbe}
+	config.DNS.Hosts = map[string][]string{"mender.invalid": {"127.0.0.1"}}
+	c, err = newConnectivityChecker(config)
+	require.NoError(t, err)
+	require.IsType(t, &dialProbe{}, c)
+	assert.Equal(t, "mender.invalid:"+port, c.(*dialProbe).address)
+	online, err := c.Online()
+	assert.NoError(t, err)
+	assert.True(t, online)
+
+	c, err = newConnectivityChecker(menderConfig{ConnectivityCheck: connectivityConnMan})
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+
+	_, err = newConnectivityChecker(menderConfig{ConnectivityCheck: "ping"})
+	assert.Error(t, err)
+}
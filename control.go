@@ -0,0 +1,295 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// stateEvent is sent to subscribers of the control API whenever the daemon
+// enters a new state.
+type stateEvent struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// eventBroker passes state events on to subscribers. Events are dropped for
+// subscribers not keeping up, rather than holding up the state machine.
+type eventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan stateEvent]struct{}
+}
+
+func (b *eventBroker) subscribe() chan stateEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan stateEvent]struct{})
+	}
+	ch := make(chan stateEvent, 16)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan stateEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *eventBroker) publish(s State) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ev := stateEvent{State: s.Id().String(), Time: time.Now()}
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			log.Debugf("control API subscriber too slow; dropping event %v", ev.State)
+		}
+	}
+}
+
+// downloadPauser is implemented by controllers able to pause downloads.
+type downloadPauser interface {
+	PauseDownload(paused bool)
+	DownloadPaused() bool
+}
+
+// payloadsProvider is implemented by controllers tracking the status of the
+// payloads of artifacts.
+type payloadsProvider interface {
+	Payloads() (installer.Payloads, error)
+}
+
+// metricsProvider is implemented by controllers collecting health metrics.
+type metricsProvider interface {
+	Metrics() *clientMetrics
+}
+
+// controlServer serves the local control API of the daemon, which other
+// applications on the device can use, over a unix socket:
+//
+//	GET  /v1/state            current state, whether downloads are paused and
+//	                          the status of the payloads of the last artifact
+//	POST /v1/update-check     check for updates right away
+//	POST /v1/download/pause   stop reading the artifact being downloaded
+//	POST /v1/download/resume  continue the download
+//	GET  /v1/events           stream of state changes, one JSON object per line
+//	GET  /v1/metrics          health metrics in the Prometheus text format
+type controlServer struct {
+	daemon   *menderDaemon
+	listener net.Listener
+	server   *http.Server
+}
+
+func startControlServer(d *menderDaemon, socket string) (*controlServer, error) {
+	// a socket left over by a previous run would make listening fail
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove stale control socket")
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on control socket")
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "failed to set permissions of control socket")
+	}
+
+	c := &controlServer{
+		daemon:   d,
+		listener: l,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/state", c.handleState)
+	mux.HandleFunc("/v1/update-check", c.handleUpdateCheck)
+	mux.HandleFunc("/v1/download/pause", c.handlePause(true))
+	mux.HandleFunc("/v1/download/resume", c.handlePause(false))
+	mux.HandleFunc("/v1/events", c.handleEvents)
+	mux.HandleFunc("/v1/metrics", c.handleMetrics)
+	c.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := c.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("control API failed: %v", err)
+		}
+	}()
+	log.Infof("serving control API on %s", socket)
+	return c, nil
+}
+
+func (c *controlServer) Close() error {
+	return c.server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("control API failed to write response: %v", err)
+	}
+}
+
+func (c *controlServer) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rsp := struct {
+		State          string             `json:"state"`
+		DownloadPaused bool               `json:"download_paused"`
+		Payloads       installer.Payloads `json:"payloads,omitempty"`
+	}{
+		State: c.daemon.mender.GetCurrentState().Id().String(),
+	}
+	if p, ok := c.daemon.mender.(downloadPauser); ok {
+		rsp.DownloadPaused = p.DownloadPaused()
+	}
+	if p, ok := c.daemon.mender.(payloadsProvider); ok {
+		payloads, err := p.Payloads()
+		if err != nil {
+			log.Warnf("control API failed to read the status of the payloads: %v", err)
+		}
+		rsp.Payloads = payloads
+	}
+	writeJSON(w, rsp)
+}
+
+func (c *controlServer) handleUpdateCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Info("update check requested through control API")
+	// waking up the state machine may block until it is waiting
+	go c.daemon.ForceUpdateCheck()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *controlServer) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		p, ok := c.daemon.mender.(downloadPauser)
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		log.Infof("download paused through control API: %v", paused)
+		p.PauseDownload(paused)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ch := c.daemon.events.subscribe()
+	defer c.daemon.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (c *controlServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := c.daemon.mender.(metricsProvider)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := p.Metrics().WriteTo(w); err != nil {
+		log.Warnf("control API failed to write metrics: %v", err)
+	}
+}
+
+// errControlAPIUnreachable is returned by the commands using the control API
+// if the daemon is not listening on the control socket.
+var errControlAPIUnreachable = errors.New("could not connect to the control API of the mender daemon")
+
+// controlClient returns a client for the control API served on socket.
+func controlClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+// pauseDownload makes the daemon listening on socket pause, or resume, the
+// artifact download.
+func pauseDownload(socket string, paused bool) error {
+	if socket == "" {
+		return errors.New("the control API of the daemon is disabled; " +
+			"ControlSocket has to be configured")
+	}
+	path := "/v1/download/resume"
+	if paused {
+		path = "/v1/download/pause"
+	}
+	rsp, err := controlClient(socket).Post("http://mender"+path, "", nil)
+	if err != nil {
+		return errors.Wrap(errControlAPIUnreachable, err.Error())
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotImplemented:
+		return errors.New("the daemon can not pause downloads")
+	default:
+		return errors.Errorf("control API returned %s", rsp.Status)
+	}
+}
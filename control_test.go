@@ -0,0 +1,142 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	// stale sockets are replaced
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{store: ms},
+	})
+	d := NewDaemon(mender, ms)
+
+	cs, err := startControlServer(d, socket)
+	require.NoError(t, err)
+	defer cs.Close()
+	cl := controlClient(socket)
+
+	getState := func() map[string]interface{} {
+		rsp, err := cl.Get("http://mender/v1/state")
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		var state map[string]interface{}
+		require.NoError(t, json.NewDecoder(rsp.Body).Decode(&state))
+		return state
+	}
+
+	state := getState()
+	assert.Equal(t, "init", state["state"])
+	assert.Equal(t, false, state["download_paused"])
+
+	rsp, err := cl.Post("http://mender/v1/download/pause", "", nil)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.True(t, mender.DownloadPaused())
+	assert.Equal(t, true, getState()["download_paused"])
+
+	rsp, err = cl.Post("http://mender/v1/download/resume", "", nil)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.False(t, mender.DownloadPaused())
+
+	// as by mender pause-download and resume-download
+	require.NoError(t, pauseDownload(socket, true))
+	assert.True(t, mender.DownloadPaused())
+	require.NoError(t, pauseDownload(socket, false))
+	assert.False(t, mender.DownloadPaused())
+	assert.Error(t, pauseDownload("", true))
+	err = pauseDownload(filepath.Join(dir, "none.sock"), true)
+	assert.Equal(t, exitDaemonNotRunning, exitCode(err))
+
+	rsp, err = cl.Post("http://mender/v1/update-check", "", nil)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	select {
+	case <-d.updateCheck:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update check not triggered")
+	}
+
+	rsp, err = cl.Get("http://mender/v1/update-check")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+	rsp, err = cl.Get("http://mender/v1/metrics")
+	require.NoError(t, err)
+	metrics, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Contains(t, string(metrics), "mender_update_checks_total 0\n")
+}
+
+func TestControlServerEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	ms := store.NewMemStore()
+	d := NewDaemon(newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{store: ms},
+	}), ms)
+
+	cs, err := startControlServer(d, socket)
+	require.NoError(t, err)
+	defer cs.Close()
+
+	rsp, err := controlClient(socket).Get("http://mender/v1/events")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", rsp.Header.Get("Content-Type"))
+
+	// the subscription is in place once the headers have been received
+	d.events.publish(updateCheckState)
+	d.events.publish(NewCheckWaitState())
+
+	lines := bufio.NewScanner(rsp.Body)
+	for _, exp := range []string{"update-check", "check-wait"} {
+		require.True(t, lines.Scan())
+		var ev stateEvent
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &ev))
+		assert.Equal(t, exp, ev.State)
+		assert.False(t, ev.Time.IsZero())
+	}
+}
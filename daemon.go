@@ -15,6 +15,7 @@ package main
 
 import (
 	"os"
+	"sync/atomic"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/store"
@@ -24,11 +25,18 @@ import (
 // Config section
 
 type menderDaemon struct {
-	mender      Controller
-	stop        bool
+	mender Controller
+	// set to 1 by StopDaemon, e.g. from the signal handler
+	stop        int32
 	sctx        StateContext
 	store       store.Store
 	updateCheck chan bool // state-machine interrupt.
+	// state-machine interrupt forcing an inventory update
+	inventoryUpdate chan bool
+	watchdog        stateWatchdog
+	events          eventBroker
+	// configuration reloaded on SIGHUP, applied between states
+	configReload chan *menderConfig
 }
 
 func NewDaemon(mender Controller, store store.Store) *menderDaemon {
@@ -38,14 +46,82 @@ func NewDaemon(mender Controller, store store.Store) *menderDaemon {
 		sctx: StateContext{
 			store: store,
 		},
-		store:       store,
-		updateCheck: make(chan bool, 1),
+		store:           store,
+		updateCheck:     make(chan bool, 1),
+		inventoryUpdate: make(chan bool, 1),
+		configReload:    make(chan *menderConfig, 1),
 	}
 	return &daemon
 }
 
+// StopDaemon makes the daemon stop once the current state is left; a
+// download in progress is interrupted and paused rather than waited for.
 func (d *menderDaemon) StopDaemon() {
-	d.stop = true
+	atomic.StoreInt32(&d.stop, 1)
+	d.mender.Shutdown()
+}
+
+// ForceUpdateCheck makes the daemon check for updates right away, unless an
+// update is in progress.
+func (d *menderDaemon) ForceUpdateCheck() {
+	select {
+	case d.updateCheck <- true:
+	default:
+		// a check is pending already
+	}
+	d.wake()
+}
+
+// ForceInventoryUpdate makes the daemon submit the inventory right away,
+// unless an update is in progress.
+func (d *menderDaemon) ForceInventoryUpdate() {
+	select {
+	case d.inventoryUpdate <- true:
+	default:
+		// an inventory update is pending already
+	}
+	d.wake()
+}
+
+// ReloadConfig makes the daemon apply the settings of a reloaded
+// configuration which can be changed while it is running once the current
+// state is left; waiting for the next update check or inventory update is
+// recalculated with the new poll intervals.
+func (d *menderDaemon) ReloadConfig(config *menderConfig) {
+	select {
+	case <-d.configReload:
+		// superseded
+	default:
+	}
+	d.configReload <- config
+	// GetCurrentState is synchronized with the daemon, and Recheck only
+	// signals the state, so this is safe from the signal handler
+	if cw, ok := d.mender.GetCurrentState().(*CheckWaitState); ok {
+		cw.Recheck()
+	}
+}
+
+func (d *menderDaemon) wake() {
+	// If the state machine is in a wait state - force a wake-up.
+	ws, ok := d.mender.GetCurrentState().(WaitState)
+	if ok {
+		ws.Wake()
+	}
+}
+
+// forceState returns the state to continue with after the update check or
+// inventory update was forced, or nil if an update is in progress.
+func (d *menderDaemon) forceState(state State) State {
+	_, err := LoadStateData(d.sctx.store)
+	// No previous state stored, means no update was in progress,
+	// and we can safely force the state.
+	if err != nil && os.IsNotExist(err) {
+		if d.mender.IsAuthorized() {
+			return state
+		}
+		return initState
+	}
+	return nil
 }
 
 func (d *menderDaemon) Cleanup() {
@@ -58,33 +134,52 @@ func (d *menderDaemon) Cleanup() {
 }
 
 func (d *menderDaemon) shouldStop() bool {
-	return d.stop
+	return atomic.LoadInt32(&d.stop) == 1
 }
 
 func (d *menderDaemon) Run() error {
 	// set the first state transition
 	var toState State = d.mender.GetCurrentState()
 	cancelled := false
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warnf("failed to notify systemd: %v", err)
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
+		log.Infof("feeding systemd watchdog every %v", interval/2)
+		stop := make(chan struct{})
+		defer close(stop)
+		go d.watchdog.run(interval/2, stop)
+	}
+
 	for {
-		// If signal SIGUSR1 received, check for update straight away.
+		// If signal SIGUSR1 received, check for update straight away;
+		// on SIGUSR2 submit the inventory.
 		select {
 		case sig := <-d.updateCheck:
 			log.Debugf("received signal: %t", sig)
-			_, err := LoadStateData(d.sctx.store)
-			// No previous state stored, means no update was in progress,
-			// and we can safely force an update check.
-			if err != nil && os.IsNotExist(err) {
-				log.Debugf("received signal: %t. Forcing device from %s state to initState\n", toState, sig)
-				if d.mender.IsAuthorized() {
-					toState = updateCheckState
-				} else {
-					toState = initState
-				}
+			if s := d.forceState(updateCheckState); s != nil {
+				log.Debugf("forcing device from %s state to %s", toState, s)
+				toState = s
+				d.mender.SetNextState(toState)
+			}
+		case <-d.inventoryUpdate:
+			if s := d.forceState(inventoryUpdateState); s != nil {
+				log.Debugf("forcing device from %s state to %s", toState, s)
+				toState = s
 				d.mender.SetNextState(toState)
 			}
+		case config := <-d.configReload:
+			if m, ok := d.mender.(*mender); ok {
+				if err := m.ReloadConfig(*config); err != nil {
+					log.Errorf("failed to apply reloaded configuration: %v", err)
+				}
+			}
 		default:
 			// Identity op - do nothing.
 		}
+		d.watchdog.enter(toState)
+		d.events.publish(toState)
 		toState, cancelled = d.mender.TransitionState(toState, &d.sctx)
 		if toState.Id() == MenderStateError {
 			es, ok := toState.(*ErrorState)
@@ -200,4 +200,30 @@ func TestDaemonRun(t *testing.T) {
 		assert.Equal(t, daemon.mender.GetCurrentState(), checkWaitState)
 		daemon.StopDaemon()
 	})
+	t.Run("forced inventory update", func(t *testing.T) {
+		dtc := &daemonTestController{
+			stateTestController{
+				pollIntvl:  time.Second * 5,
+				retryIntvl: time.Second * 5,
+				authorized: true,
+				state:      checkWaitState,
+			},
+			0,
+		}
+		daemon := NewDaemon(dtc, store.NewMemStore())
+		daemon.StopDaemon() // Stop after a single pass.
+		daemon.inventoryUpdate <- true
+		daemon.Run()
+		assert.False(t, daemon.sctx.lastInventoryUpdate.IsZero())
+		assert.Equal(t, 0, dtc.updateCheckCount)
+		assert.Equal(t, checkWaitState, daemon.mender.GetCurrentState())
+
+		// not while an update is in progress
+		dtc.state = checkWaitState
+		daemon.sctx.lastInventoryUpdate = time.Time{}
+		StoreStateData(daemon.store, StateData{Name: MenderStateReboot})
+		daemon.inventoryUpdate <- true
+		daemon.Run()
+		assert.True(t, daemon.sctx.lastInventoryUpdate.IsZero())
+	})
 }
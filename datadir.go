@@ -0,0 +1,114 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The client writes to the data directory only, so that it runs on read-only
+// root filesystems, with the data directory on the data partition. Its
+// layout is:
+//
+//	mender-store         database of the client state and its lock file
+//	deployments.*.log    logs of the latest deployments
+//	scripts/             state scripts of the artifact being installed
+//	modules/             work files of update modules and delta updates
+//	device_type          device type, written when provisioning the device
+//	uefi_env             boot variables of UEFI devices
+//	deployment.json      metadata of the deployment in progress, for scripts
+//	partial_download     part of the update downloaded when the download failed,
+//	                     to continue from as it is retried, and its .info
+//
+// Files configured explicitly, such as MetricsTextFile, ControlSocket or the
+// enrolled client certificate, are written where configured, and have to be
+// on the data partition, or on a tmpfs, as well.
+
+// dataPath returns the path of name in the configured DataDir, or fallback,
+// the default, if DataDir is not set.
+func (c menderConfig) dataPath(name, fallback string) string {
+	if c.DataDir == "" {
+		return fallback
+	}
+	return filepath.Join(c.DataDir, name)
+}
+
+func (c menderConfig) artScriptsPath() string {
+	return c.dataPath("scripts", defaultArtScriptsPath)
+}
+
+func (c menderConfig) modulesWorkPath() string {
+	return c.dataPath("modules", defaultModulesWorkPath)
+}
+
+func (c menderConfig) deviceTypeFile() string {
+	return c.dataPath("device_type", defaultDeviceTypeFile)
+}
+
+func (c menderConfig) deploymentFile() string {
+	return c.dataPath("deployment.json", defaultDeploymentFile)
+}
+
+func (c menderConfig) partialDownloadFile() string {
+	return c.dataPath("partial_download", filepath.Join(getStateDirPath(), "partial_download"))
+}
+
+func (c menderConfig) uefiEnvFile() string {
+	if c.UEFI.EnvFile != "" {
+		return c.UEFI.EnvFile
+	}
+	return c.dataPath("uefi_env", filepath.Join(getStateDirPath(), "uefi_env"))
+}
+
+// checkWritablePaths makes sure the daemon can write where it has to, and
+// fails early, naming the path, rather than once it does, e.g. as the root
+// filesystem is read-only. The data directory has to exist already, as it is
+// the mount point of the data partition, or a link to it, then.
+func checkWritablePaths(config menderConfig, dataDir string) error {
+	files := map[string]string{
+		"MetricsTextFile":            config.MetricsTextFile,
+		"ControlSocket":              config.ControlSocket,
+		"DeviceAPI.Socket":           config.DeviceAPI.Socket,
+		"Reboot.RequestFile":         config.Reboot.RequestFile,
+		"DeviceConnect.AuditLogFile": config.DeviceConnect.AuditLogFile,
+	}
+	if config.Enrollment.ServerURL != "" {
+		files["HttpsClient.Certificate"] = config.HttpsClient.Certificate
+		files["HttpsClient.Key"] = config.HttpsClient.Key
+	}
+	if config.Bootloader == bootloaderUEFI {
+		files["UEFI.EnvFile"] = config.UEFI.EnvFile
+	}
+	dirs := map[string]string{"data directory": dataDir}
+	for what, file := range files {
+		if file != "" {
+			dirs["directory of "+what] = filepath.Dir(file)
+		}
+	}
+
+	for what, dir := range dirs {
+		f, err := ioutil.TempFile(dir, ".mender-write-check")
+		if err != nil {
+			return errors.Wrapf(err, "%s %s is not writable; it must be on the "+
+				"data partition if the root filesystem is read-only", what, dir)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataDirLayout(t *testing.T) {
+	var config menderConfig
+	assert.Equal(t, defaultArtScriptsPath, config.artScriptsPath())
+	assert.Equal(t, defaultModulesWorkPath, config.modulesWorkPath())
+	assert.Equal(t, defaultDeviceTypeFile, config.deviceTypeFile())
+
+	config.DataDir = "/data/mender"
+	assert.Equal(t, "/data/mender/scripts", config.artScriptsPath())
+	assert.Equal(t, "/data/mender/modules", config.modulesWorkPath())
+	assert.Equal(t, "/data/mender/device_type", config.deviceTypeFile())
+
+	m, err := NewMender(config, MenderPieces{})
+	require.NoError(t, err)
+	assert.Equal(t, "/data/mender/scripts", m.stateScriptPath)
+	assert.Equal(t, "/data/mender/scripts",
+		m.stateScriptExecutor.(statescript.Launcher).ArtScriptsPath)
+	assert.Equal(t, "/data/mender/modules", m.updateModules.WorkDir)
+	assert.Equal(t, "/data/mender/device_type", m.deviceTypeFile)
+}
+
+func TestCheckWritablePaths(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-datadir")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	dataDir := filepath.Join(td, "data")
+	var config menderConfig
+	config.MetricsTextFile = filepath.Join(td, "metrics.prom")
+	assert.Error(t, checkWritablePaths(config, dataDir))
+	require.NoError(t, os.Mkdir(dataDir, 0755))
+	assert.NoError(t, checkWritablePaths(config, dataDir))
+	files, err := ioutil.ReadDir(dataDir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// not a directory, as good as read-only for root
+	notADir := filepath.Join(td, "file")
+	require.NoError(t, ioutil.WriteFile(notADir, nil, 0644))
+	assert.Error(t, checkWritablePaths(config, filepath.Join(notADir, "data")))
+
+	config.ControlSocket = filepath.Join(notADir, "mender.sock")
+	err = checkWritablePaths(config, dataDir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ControlSocket")
+
+	// the client certificate is written only if it is enrolled
+	config.ControlSocket = ""
+	config.HttpsClient.Certificate = filepath.Join(notADir, "client.crt")
+	assert.NoError(t, checkWritablePaths(config, dataDir))
+	config.Enrollment.ServerURL = "https://est.example.com/.well-known/est"
+	assert.Error(t, checkWritablePaths(config, dataDir))
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/store"
+)
+
+// Versions of the schema of the data store.
+const (
+	// the device key is kept in the data store instead of a file of its
+	// own next to it
+	storeSchemaDeviceKey = 1
+)
+
+// storeMigrations upgrade the data store in dataDir to the current schema.
+func storeMigrations(dataDir string) []store.Migration {
+	return []store.Migration{
+		{
+			Version: storeSchemaDeviceKey,
+			Migrate: func(txn store.Transaction) error {
+				key, err := ioutil.ReadFile(path.Join(dataDir, defaultKeyFile))
+				if os.IsNotExist(err) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if _, err := txn.ReadAll(defaultKeyFile); err == nil {
+					// a key was generated already
+					return nil
+				}
+				return txn.WriteAll(defaultKeyFile, key)
+			},
+		},
+	}
+}
+
+// migrateStore upgrades the data store in dataDir, removing the files which
+// have been moved into it.
+func migrateStore(db store.Store, dataDir string) error {
+	from, err := store.Migrate(db, storeMigrations(dataDir))
+	if err != nil {
+		return err
+	}
+	if from < storeSchemaDeviceKey {
+		keyFile := path.Join(dataDir, defaultKeyFile)
+		if err := os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+			log.Warnf("failed to remove %s moved to the data store: %v",
+				keyFile, err)
+		}
+	}
+	return nil
+}
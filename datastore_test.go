@@ -0,0 +1,63 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datastore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, defaultKeyFile)
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("key"), 0600))
+
+	db := store.NewDBStore(dir)
+	require.NotNil(t, db)
+	defer db.Close()
+	require.NoError(t, migrateStore(db, dir))
+
+	// the key file is moved into the store
+	key, err := db.ReadAll(defaultKeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", string(key))
+	_, err = os.Stat(keyFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// once
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("other key"), 0600))
+	require.NoError(t, migrateStore(db, dir))
+	key, err = db.ReadAll(defaultKeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", string(key))
+
+	// keys in the store are kept
+	ms := store.NewMemStore()
+	require.NoError(t, ms.WriteAll(defaultKeyFile, []byte("new key")))
+	require.NoError(t, migrateStore(ms, dir))
+	key, err = ms.ReadAll(defaultKeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "new key", string(key))
+
+	// nothing to migrate on new devices
+	require.NoError(t, migrateStore(store.NewMemStore(), path.Join(dir, "new")))
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// decommissionFiles returns the files identifying the device or recording
+// its state, in dataDir: the data store, with the device key, the auth token
+// and the state of deployments, the logs of the deployments, and the key the
+// device had before it was kept in the data store. The enrolled client
+// certificate and its key are included as well, as the device enrolls again.
+// The configuration, with the tenant token, is left for the device to be
+// transferred to another tenant with.
+func decommissionFiles(config menderConfig, dataDir string) ([]string, error) {
+	files := []string{
+		filepath.Join(dataDir, store.DBStoreName),
+		filepath.Join(dataDir, store.DBStoreName+"-lock"),
+		filepath.Join(dataDir, defaultKeyFile),
+	}
+	logs, err := filepath.Glob(filepath.Join(dataDir, baseLogFileName+".*.log"))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, logs...)
+	if config.Enrollment.ServerURL != "" {
+		files = append(files, config.HttpsClient.Certificate, config.HttpsClient.Key)
+	}
+	return files, nil
+}
+
+// wipeFile overwrites the file with zeros before removing it, so that what
+// it held can not be read back from the blocks it used, at least on file
+// systems writing in place. Files which do not exist are skipped.
+func wipeFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to wipe %s", name)
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		zeros := make([]byte, 32*1024)
+		for left := fi.Size(); left > 0 && err == nil; left -= int64(len(zeros)) {
+			if left < int64(len(zeros)) {
+				zeros = zeros[:left]
+			}
+			_, err = f.Write(zeros)
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Remove(name)
+	}
+	return errors.Wrapf(err, "failed to wipe %s", name)
+}
+
+// notifyDecommission tells the server the device is retired, authorizing
+// with it first if the device has no valid auth token.
+func notifyDecommission(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	m, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+	if merr := m.Authorize(); merr != nil {
+		return errors.Wrap(merr.Cause(), "failed to authorize to notify the server")
+	}
+	return client.Decommission(m.limitedRequest(), config.ServerURL)
+}
+
+// doDecommission wipes the identity and the state of the device, so that it
+// can be retired, or transferred to another tenant, after which it
+// authorizes as a new device with a new key. The server is notified first if
+// notify is set; nothing is wiped if that fails. The daemon, found with
+// cmdGetPID, must not be running, as it keeps the data store open.
+func doDecommission(config *menderConfig, opts *runOptionsType, cmdGetPID *exec.Cmd) error {
+	pid, err := getMenderDaemonPID(cmdGetPID)
+	if err == nil {
+		return errors.Errorf("the mender daemon is running (PID %s); "+
+			"stop it before decommissioning the device", pid)
+	} else if err != errDaemonNotRunning {
+		return errors.Wrap(err, "can not tell if the mender daemon is stopped; "+
+			"refusing to decommission the device")
+	}
+
+	if *opts.notifyServer {
+		if err := notifyDecommission(config, opts); err != nil {
+			return errors.Wrap(err, "failed to notify the server of decommissioning")
+		}
+		log.Info("the server has been notified of decommissioning the device")
+	}
+
+	files, err := decommissionFiles(*config, *opts.dataStore)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := wipeFile(file); err != nil {
+			return err
+		}
+	}
+	log.Infof("device decommissioned; wiped the device key, auth token, "+
+		"state and deployment logs in %s", *opts.dataStore)
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecommission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decommission")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wiped := []string{store.DBStoreName, store.DBStoreName + "-lock",
+		"deployments.0001.deployment1.log", "deployments.0002.deployment2.log",
+		"client.crt", "client.key"}
+	kept := []string{"mender.conf", "device_type", "uefi_env"}
+	for _, name := range append(wiped, kept...) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte("contents of "+name), 0600))
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	config := &menderConfig{}
+	config.Enrollment.ServerURL = "https://est.example.com"
+	config.HttpsClient.Certificate = filepath.Join(dir, "client.crt")
+	config.HttpsClient.Key = filepath.Join(dir, "client.key")
+	opts := newRunOptions()
+	*opts.dataStore = dir
+
+	// not while the daemon is running
+	err = doDecommission(config, &opts, exec.Command("echo", "MainPID=1234"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "1234")
+	for _, name := range wiped {
+		assert.True(t, exists(filepath.Join(dir, name)))
+	}
+	// nor if it can not be told whether the daemon is running
+	err = doDecommission(config, &opts, exec.Command("false"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing")
+	for _, name := range wiped {
+		assert.True(t, exists(filepath.Join(dir, name)))
+	}
+
+	// nothing is wiped if the server can not be notified
+	*opts.notifyServer = true
+	config.ServerURL = "https://127.0.0.1:1"
+	assert.Error(t, doDecommission(config, &opts, exec.Command("echo", "MainPID=0")))
+	assert.True(t, exists(filepath.Join(dir, "deployments.0001.deployment1.log")))
+
+	*opts.notifyServer = false
+	assert.NoError(t, doDecommission(config, &opts, exec.Command("echo", "MainPID=0")))
+	for _, name := range wiped {
+		assert.False(t, exists(filepath.Join(dir, name)), name)
+	}
+	for _, name := range kept {
+		assert.True(t, exists(filepath.Join(dir, name)))
+	}
+
+	// again, with nothing left to wipe
+	assert.NoError(t, doDecommission(config, &opts, exec.Command("echo", "MainPID=0")))
+}
+
+func TestWipeFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "wipe")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(make([]byte, 100*1024))
+	require.NoError(t, err)
+	f.Close()
+
+	// a link to the file keeps its blocks around
+	link := f.Name() + ".link"
+	require.NoError(t, os.Link(f.Name(), link))
+	defer os.Remove(link)
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("secret key"), 0600))
+
+	assert.NoError(t, wipeFile(f.Name()))
+	_, err = os.Stat(f.Name())
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(link)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, len("secret key")), data)
+
+	assert.NoError(t, wipeFile(f.Name()))
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Environment variables state scripts and update modules are run with during
+// a deployment.
+const (
+	envDeploymentID   = "MENDER_DEPLOYMENT_ID"
+	envArtifactName   = "MENDER_ARTIFACT_NAME"
+	envArtifactSize   = "MENDER_ARTIFACT_SIZE"
+	envArtifactHost   = "MENDER_ARTIFACT_URI_HOST"
+	envPayloadTypes   = "MENDER_PAYLOAD_TYPES"
+	envDeploymentFile = "MENDER_DEPLOYMENT_FILE"
+)
+
+// deploymentInfo is the metadata of the deployment in progress, passed to
+// state scripts and update modules in their environment and as JSON in the
+// deployment file. The size of the artifact is known once it is downloaded,
+// from Download_Leave on, the types of its payloads once it is installed.
+type deploymentInfo struct {
+	ID           string   `json:"id"`
+	ArtifactName string   `json:"artifact_name"`
+	ArtifactSize int64    `json:"artifact_size,omitempty"`
+	URIHost      string   `json:"uri_host,omitempty"`
+	PayloadTypes []string `json:"payload_types,omitempty"`
+}
+
+// deploymentTracker keeps the metadata of the deployment in progress, and the
+// deployment file, up to date.
+type deploymentTracker struct {
+	file  string
+	mutex sync.Mutex
+	info  *deploymentInfo
+}
+
+// track sets the deployment in progress, or none if update is nil. What is
+// known of the deployment already is kept, also from before a restart, as
+// long as it is the same deployment.
+func (t *deploymentTracker) track(update *client.UpdateResponse) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if update == nil {
+		if t.info != nil {
+			t.info = nil
+			if err := os.Remove(t.file); err != nil && !os.IsNotExist(err) {
+				log.Warnf("failed to remove the deployment file: %v", err)
+			}
+		}
+		return
+	}
+
+	info := deploymentInfo{}
+	if t.info != nil && t.info.ID == update.ID {
+		info = *t.info
+	} else if prev, err := t.load(); err == nil && prev.ID == update.ID {
+		info = *prev
+	}
+	info.ID = update.ID
+	info.ArtifactName = update.ArtifactName()
+	if u, err := url.Parse(update.URI()); err == nil && u.Hostname() != "" {
+		info.URIHost = u.Hostname()
+	}
+	t.update(&info)
+}
+
+// setSize records the size of the artifact of the deployment in progress.
+func (t *deploymentTracker) setSize(size int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.info == nil || size <= 0 {
+		return
+	}
+	info := *t.info
+	info.ArtifactSize = size
+	t.update(&info)
+}
+
+// setPayloadTypes records the types of the payloads of the artifact of the
+// deployment in progress.
+func (t *deploymentTracker) setPayloadTypes(types []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.info == nil || len(types) == 0 {
+		return
+	}
+	info := *t.info
+	info.PayloadTypes = types
+	t.update(&info)
+}
+
+// update replaces the metadata, writing the deployment file if it changed.
+func (t *deploymentTracker) update(info *deploymentInfo) {
+	if reflect.DeepEqual(t.info, info) {
+		return
+	}
+	t.info = info
+	if err := t.save(); err != nil {
+		log.Warnf("failed to write the deployment file: %v", err)
+	}
+}
+
+func (t *deploymentTracker) load() (*deploymentInfo, error) {
+	data, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		return nil, err
+	}
+	var info deploymentInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.Wrapf(err, "invalid deployment file %s", t.file)
+	}
+	return &info, nil
+}
+
+// save writes the deployment file atomically, so that scripts never read a
+// partial one.
+func (t *deploymentTracker) save() error {
+	data, err := json.Marshal(t.info)
+	if err != nil {
+		return err
+	}
+	tmp := t.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// environ returns the environment variables of the deployment in progress,
+// none if there is none.
+func (t *deploymentTracker) environ() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.info == nil {
+		return nil
+	}
+	env := []string{
+		envDeploymentID + "=" + t.info.ID,
+		envArtifactName + "=" + t.info.ArtifactName,
+		envDeploymentFile + "=" + t.file,
+	}
+	if t.info.ArtifactSize > 0 {
+		env = append(env, envArtifactSize+"="+strconv.FormatInt(t.info.ArtifactSize, 10))
+	}
+	if t.info.URIHost != "" {
+		env = append(env, envArtifactHost+"="+t.info.URIHost)
+	}
+	if len(t.info.PayloadTypes) > 0 {
+		env = append(env, envPayloadTypes+"="+strings.Join(t.info.PayloadTypes, ","))
+	}
+	return env
+}
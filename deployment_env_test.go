@@ -0,0 +1,116 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeploymentTracker(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-deployment")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	file := filepath.Join(td, "deployment.json")
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-1"
+	update.Artifact.Source.URI = "https://s3.example.com:9000/artifacts/release-1.mender"
+
+	tracker := &deploymentTracker{file: file}
+	assert.Nil(t, tracker.environ())
+	// nothing known of updates not in progress
+	tracker.setSize(1024)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	tracker.track(&update)
+	assert.Equal(t, []string{
+		"MENDER_DEPLOYMENT_ID=foo",
+		"MENDER_ARTIFACT_NAME=release-1",
+		"MENDER_DEPLOYMENT_FILE=" + file,
+		"MENDER_ARTIFACT_URI_HOST=s3.example.com",
+	}, tracker.environ())
+
+	tracker.setSize(1024)
+	tracker.setPayloadTypes([]string{"rootfs-image", "app"})
+	env := tracker.environ()
+	assert.Contains(t, env, "MENDER_ARTIFACT_SIZE=1024")
+	assert.Contains(t, env, "MENDER_PAYLOAD_TYPES=rootfs-image,app")
+
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	var info deploymentInfo
+	require.NoError(t, json.Unmarshal(data, &info))
+	assert.Equal(t, deploymentInfo{
+		ID:           "foo",
+		ArtifactName: "release-1",
+		ArtifactSize: 1024,
+		URIHost:      "s3.example.com",
+		PayloadTypes: []string{"rootfs-image", "app"},
+	}, info)
+
+	// kept after a restart, e.g. once rebooted into the update, the URI of
+	// which may have expired
+	tracker = &deploymentTracker{file: file}
+	update.Artifact.Source.URI = ""
+	tracker.track(&update)
+	assert.Contains(t, tracker.environ(), "MENDER_ARTIFACT_SIZE=1024")
+	assert.Contains(t, tracker.environ(), "MENDER_ARTIFACT_URI_HOST=s3.example.com")
+
+	// but not for another deployment
+	other := client.UpdateResponse{ID: "bar"}
+	other.Artifact.ArtifactName = "release-2"
+	tracker.track(&other)
+	assert.Equal(t, []string{
+		"MENDER_DEPLOYMENT_ID=bar",
+		"MENDER_ARTIFACT_NAME=release-2",
+		"MENDER_DEPLOYMENT_FILE=" + file,
+	}, tracker.environ())
+
+	tracker.track(nil)
+	assert.Nil(t, tracker.environ())
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeploymentEnvironment(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-deployment")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	config := menderConfig{DataDir: td}
+	assert.Equal(t, filepath.Join(td, "deployment.json"), config.deploymentFile())
+	m := newTestMender(nil, config, testMenderPieces{})
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-1"
+	m.deployment.track(&update)
+	// the scripts and the modules get the metadata of the deployment
+	expected := []string{
+		"MENDER_DEPLOYMENT_ID=foo",
+		"MENDER_ARTIFACT_NAME=release-1",
+		"MENDER_DEPLOYMENT_FILE=" + filepath.Join(td, "deployment.json"),
+	}
+	assert.Equal(t, expected, m.updateModules.Env())
+	assert.Equal(t, expected, m.stateScriptExecutor.(statescript.Launcher).Env())
+}
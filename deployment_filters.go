@@ -0,0 +1,158 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Directory the power supplies of the device are described in, and the
+// command telling the wireless network the device is connected to.
+var (
+	powerSupplyDir = "/sys/class/power_supply"
+	ssidCommand    = []string{"iwgetid", "-r"}
+)
+
+// validateDeploymentFilters checks the configured DeploymentFilters.
+func validateDeploymentFilters(c menderConfig) error {
+	if p := c.DeploymentFilters.MinBatteryPercent; p < 0 || p > 100 {
+		return errors.Errorf("DeploymentFilters.MinBatteryPercent must be "+
+			"between 0 and 100: %d", p)
+	}
+	return nil
+}
+
+// checkDeploymentFilters tells why updates of the artifact are not to be
+// installed now, as configured by DeploymentFilters, or nil if they are.
+func checkDeploymentFilters(c menderConfig, artifactName string) error {
+	filters := c.DeploymentFilters
+	if filters.RequireACPower || filters.MinBatteryPercent > 0 {
+		power := readPowerStatus(powerSupplyDir)
+		// devices without a battery are powered otherwise
+		if power.batteries > 0 {
+			if filters.RequireACPower && !power.onAC {
+				return errors.New("device is not on AC power")
+			}
+			if power.batteryPercent < filters.MinBatteryPercent {
+				return errors.Errorf("battery is at %d%%, below %d%%",
+					power.batteryPercent, filters.MinBatteryPercent)
+			}
+		}
+	}
+
+	if len(filters.SSIDs) > 0 {
+		ssid, err := currentSSID()
+		if err != nil {
+			return errors.Wrapf(err, "device is not connected to any of the "+
+				"wireless networks %v", filters.SSIDs)
+		}
+		found := false
+		for _, s := range filters.SSIDs {
+			if s == ssid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("device is connected to wireless network %q, "+
+				"not to any of %v", ssid, filters.SSIDs)
+		}
+	}
+
+	if filters.Helper != "" {
+		log.Infof("running deployment filter helper %s", filters.Helper)
+		out, err := exec.Command(filters.Helper, artifactName).CombinedOutput()
+		if len(out) > 0 {
+			log.Infof("output of deployment filter helper: %s",
+				strings.TrimSpace(string(out)))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "deployment filter helper rejected the update")
+		}
+	}
+	return nil
+}
+
+type powerStatus struct {
+	batteries int
+	onAC      bool
+	// charge of the least charged battery
+	batteryPercent int
+}
+
+// readPowerStatus reads the power supplies of the device from dir, as in
+// /sys/class/power_supply. The device is on AC power if a mains or USB power
+// supply is online, or a battery is charging or full.
+func readPowerStatus(dir string) powerStatus {
+	var status powerStatus
+	supplies, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read power supplies: %v", err)
+		}
+		return status
+	}
+	read := func(supply, attr string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, supply, attr))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	for _, supply := range supplies {
+		name := supply.Name()
+		switch supplyType := read(name, "type"); {
+		case supplyType == "Battery":
+			capacity, err := strconv.Atoi(read(name, "capacity"))
+			if err != nil {
+				log.Warnf("failed to read the capacity of battery %s: %v", name, err)
+				continue
+			}
+			if status.batteries == 0 || capacity < status.batteryPercent {
+				status.batteryPercent = capacity
+			}
+			status.batteries++
+			switch read(name, "status") {
+			case "Charging", "Full":
+				status.onAC = true
+			}
+		case supplyType == "Mains" || strings.HasPrefix(supplyType, "USB"):
+			if read(name, "online") == "1" {
+				status.onAC = true
+			}
+		}
+	}
+	return status
+}
+
+// currentSSID returns the wireless network the device is connected to.
+func currentSSID() (string, error) {
+	out, err := exec.Command(ssidCommand[0], ssidCommand[1:]...).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s failed", strings.Join(ssidCommand, " "))
+	}
+	ssid := strings.TrimSpace(string(out))
+	if ssid == "" {
+		return "", errors.New("no wireless network")
+	}
+	return ssid, nil
+}
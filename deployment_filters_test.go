@@ -0,0 +1,108 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePowerSupply(t *testing.T, dir, name string, attrs map[string]string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0755))
+	for attr, value := range attrs {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, attr),
+			[]byte(value+"\n"), 0644))
+	}
+}
+
+func TestReadPowerStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power_supply")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Equal(t, powerStatus{}, readPowerStatus(filepath.Join(dir, "none")))
+
+	writePowerSupply(t, dir, "BAT0", map[string]string{
+		"type": "Battery", "capacity": "80", "status": "Discharging"})
+	writePowerSupply(t, dir, "BAT1", map[string]string{
+		"type": "Battery", "capacity": "40", "status": "Discharging"})
+	writePowerSupply(t, dir, "AC", map[string]string{
+		"type": "Mains", "online": "0"})
+	assert.Equal(t, powerStatus{batteries: 2, batteryPercent: 40},
+		readPowerStatus(dir))
+
+	writePowerSupply(t, dir, "AC", map[string]string{"online": "1"})
+	assert.Equal(t, powerStatus{batteries: 2, onAC: true, batteryPercent: 40},
+		readPowerStatus(dir))
+
+	// charging without a mains supply described
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "AC")))
+	writePowerSupply(t, dir, "BAT1", map[string]string{"status": "Charging"})
+	assert.True(t, readPowerStatus(dir).onAC)
+}
+
+func TestCheckDeploymentFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	origPowerSupplyDir, origSSIDCommand := powerSupplyDir, ssidCommand
+	defer func() {
+		powerSupplyDir, ssidCommand = origPowerSupplyDir, origSSIDCommand
+	}()
+	powerSupplyDir = filepath.Join(dir, "power_supply")
+
+	var config menderConfig
+	assert.NoError(t, checkDeploymentFilters(config, "release-2"))
+
+	// devices without a battery are on AC power
+	config.DeploymentFilters.RequireACPower = true
+	config.DeploymentFilters.MinBatteryPercent = 50
+	assert.NoError(t, checkDeploymentFilters(config, "release-2"))
+
+	writePowerSupply(t, powerSupplyDir, "BAT0", map[string]string{
+		"type": "Battery", "capacity": "40", "status": "Discharging"})
+	err = checkDeploymentFilters(config, "release-2")
+	assert.EqualError(t, err, "device is not on AC power")
+
+	writePowerSupply(t, powerSupplyDir, "BAT0", map[string]string{"status": "Charging"})
+	err = checkDeploymentFilters(config, "release-2")
+	assert.EqualError(t, err, "battery is at 40%, below 50%")
+
+	writePowerSupply(t, powerSupplyDir, "BAT0", map[string]string{"capacity": "50"})
+	assert.NoError(t, checkDeploymentFilters(config, "release-2"))
+
+	config.DeploymentFilters.SSIDs = []string{"depot", "workshop"}
+	ssidCommand = []string{"echo", "workshop"}
+	assert.NoError(t, checkDeploymentFilters(config, "release-2"))
+	ssidCommand = []string{"echo", "field"}
+	assert.Error(t, checkDeploymentFilters(config, "release-2"))
+	// not connected
+	ssidCommand = []string{"false"}
+	assert.Error(t, checkDeploymentFilters(config, "release-2"))
+	ssidCommand = []string{"echo", "depot"}
+
+	helper := filepath.Join(dir, "helper")
+	require.NoError(t, ioutil.WriteFile(helper, []byte("#!/bin/sh\n"+
+		"echo \"checking $1\"\n"+
+		"test \"$1\" = release-2\n"), 0755))
+	config.DeploymentFilters.Helper = helper
+	assert.NoError(t, checkDeploymentFilters(config, "release-2"))
+	assert.Error(t, checkDeploymentFilters(config, "release-3"))
+}
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // error messages
@@ -36,6 +37,10 @@ var (
 type FileLogger struct {
 	logFileName string
 	logFile     io.WriteCloser
+	// number of bytes in the log file
+	size int64
+	// set once entries have been dropped because the file grew too big
+	truncated bool
 }
 
 // NewFileLogger creates instance of file logger; it is initialized
@@ -48,15 +53,24 @@ func NewFileLogger(name string) *FileLogger {
 		return nil
 	}
 
+	// we might be appending to the logs of an interrupted deployment
+	var size int64
+	if info, err := logFile.Stat(); err == nil {
+		size = info.Size()
+	}
+
 	// return FileLogger only when logging is possible (we can open log file)
 	return &FileLogger{
 		logFileName: name,
 		logFile:     logFile,
+		size:        size,
 	}
 }
 
 func (fl *FileLogger) Write(log []byte) (int, error) {
-	return fl.logFile.Write(log)
+	n, err := fl.logFile.Write(log)
+	fl.size += int64(n)
+	return n, err
 }
 
 func (fl *FileLogger) Deinit() error {
@@ -69,6 +83,9 @@ type DeploymentLogManager struct {
 	logger       *FileLogger
 	// how many log files we are keeping in log directory before rotating
 	maxLogFiles int
+	// size limit of the logs of a single deployment; entries past the limit
+	// are dropped so that a misbehaving update can not fill the disk
+	maxLogSizeBytes int64
 
 	minLogSizeBytes uint64
 	// it is easy to add logging hook, but not so much remove it;
@@ -86,7 +103,8 @@ func NewDeploymentLogManager(logDirLocation string) *DeploymentLogManager {
 		//logger:
 		// for now we can hardcode this
 		maxLogFiles:     5,
-		minLogSizeBytes: 1024 * 100, //100kb
+		maxLogSizeBytes: 1024 * 1024 * 5, //5mb
+		minLogSizeBytes: 1024 * 100,      //100kb
 		loggingEnabled:  false,
 	}
 }
@@ -95,10 +113,34 @@ func (dlm DeploymentLogManager) WriteLog(log []byte) error {
 	if dlm.logger == nil {
 		return ErrLoggerNotInitialized
 	}
+	if dlm.maxLogSizeBytes > 0 &&
+		dlm.logger.size+int64(len(log)) > dlm.maxLogSizeBytes {
+		if dlm.logger.truncated {
+			return nil
+		}
+		// leave a note in the logs, so that it is clear that entries
+		// are missing
+		dlm.logger.truncated = true
+		return dlm.writeTruncationNote()
+	}
 	_, err := dlm.logger.Write(log)
 	return err
 }
 
+func (dlm DeploymentLogManager) writeTruncationNote() error {
+	note, err := json.Marshal(map[string]string{
+		"timestamp": time.Now().Format(time.RFC3339),
+		"level":     "warning",
+		"message": fmt.Sprintf("deployment log exceeded %d bytes; "+
+			"further entries are discarded", dlm.maxLogSizeBytes),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dlm.logger.Write(append(note, '\n'))
+	return err
+}
+
 // check if there is enough space to store the logs
 func (dlm *DeploymentLogManager) haveEnoughSpaceForStoringLogs() bool {
 	var stat syscall.Statfs_t
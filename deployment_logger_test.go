@@ -14,6 +14,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -335,3 +336,37 @@ func TestFindLogFiles(t *testing.T) {
 	assert.Empty(t, logs)
 
 }
+
+func TestDeploymentLogSizeLimit(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	logManager := NewDeploymentLogManager(tempDir)
+	logManager.maxLogSizeBytes = 64
+
+	entry := []byte(`{"level":"info","message":"0123456789"}` + "\n")
+	assert.NoError(t, logManager.Enable("1111-2222"))
+	assert.NoError(t, logManager.WriteLog(entry))
+	// exceeds the limit; entry is replaced by a note
+	assert.NoError(t, logManager.WriteLog(entry))
+	// further entries are dropped silently
+	assert.NoError(t, logManager.WriteLog(entry))
+	logManager.Disable()
+
+	logs, err := logManager.GetLogs("1111-2222")
+	assert.NoError(t, err)
+	var parsed struct {
+		Messages []map[string]string `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(logs, &parsed))
+	assert.Len(t, parsed.Messages, 2)
+	assert.Equal(t, "0123456789", parsed.Messages[0]["message"])
+	assert.Contains(t, parsed.Messages[1]["message"], "exceeded 64 bytes")
+
+	// the size of existing logs is taken into account after a restart
+	logManager = NewDeploymentLogManager(tempDir)
+	logManager.maxLogSizeBytes = 64
+	assert.NoError(t, logManager.Enable("1111-2222"))
+	assert.True(t, logManager.logger.size > 64)
+	logManager.Disable()
+}
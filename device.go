@@ -16,30 +16,73 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/pkg/errors"
 )
 
 type deviceConfig struct {
 	rootfsPartA string
 	rootfsPartB string
+	reboot      rebootConfig
+}
+
+// Ways of rebooting the device, as configured by Reboot.Mode.
+const (
+	// running the reboot command
+	rebootModeCommand = "command"
+	// only writing the reboot request file, for a supervisor outside of
+	// the client to restart the device, or the container the client runs in
+	rebootModeSignal = "signal"
+)
+
+var defaultRebootCommand = []string{"reboot"}
+
+type rebootConfig struct {
+	mode        string
+	command     []string
+	requestFile string
 }
 
 type device struct {
 	BootEnvReadWriter
 	Commander
 	*partitions
+	reboot rebootConfig
 }
 
 var (
 	errorNoUpgradeMounted = errors.New("There is nothing to commit")
 )
 
+// Flushes the file systems; replaced in tests.
+var syncFilesystems = syscall.Sync
+
+// Returns the time elapsed since the system booted; replaced in tests.
+var systemUptime = func() (time.Duration, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("malformed /proc/uptime")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "malformed /proc/uptime")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
 func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *device {
 	partitions := partitions{
 		StatCommander:     sc,
@@ -49,13 +92,51 @@ func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *de
 		active:            "",
 		inactive:          "",
 	}
-	device := device{env, sc, &partitions}
+	device := device{env, sc, &partitions, config.reboot}
 	return &device
 }
 
+// Reboot reboots the device, or asks for it to be rebooted, as configured.
+// The file systems are synced first, so that the state data and the
+// deployment logs are written however the device goes down.
 func (d *device) Reboot() error {
-	log.Info("Mender rebooting from active partition: %s", d.active)
-	return d.Command("reboot").Run()
+	log.Infof("Mender rebooting from active partition: %s", d.active)
+	syncFilesystems()
+
+	if d.reboot.mode == rebootModeSignal {
+		log.Infof("requesting the reboot with %s", d.reboot.requestFile)
+		err := ioutil.WriteFile(d.reboot.requestFile,
+			[]byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "failed to request reboot")
+		}
+		syncFilesystems()
+		return nil
+	}
+
+	command := d.reboot.command
+	if len(command) == 0 {
+		command = defaultRebootCommand
+	}
+	out, err := d.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", strings.Join(command, " "),
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// clearRebootRequest removes the reboot request of a previous run, once the
+// device, or the client, has been restarted.
+func clearRebootRequest(config menderConfig) error {
+	if config.Reboot.Mode != rebootModeSignal {
+		return nil
+	}
+	err := os.Remove(config.Reboot.RequestFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove reboot request")
+	}
+	return nil
 }
 
 func (d *device) SwapPartitions() error {
@@ -81,24 +162,13 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 		return errors.New("Have invalid update. Aborting.")
 	}
 
-	inactivePartition, err := d.GetInactive()
+	b, err := d.inactiveBlockDevice()
 	if err != nil {
 		return err
 	}
-
-	typeUBI := isUbiBlockDevice(inactivePartition)
-	if typeUBI {
-		// UBI block devices are not prefixed with /dev due to the fact
-		// that the kernel root= argument does not handle UBI block
-		// devices which are prefixed with /dev
-		//
-		// Kernel root= only accepts:
-		// - ubi0_0
-		// - ubi:rootfsa
-		inactivePartition = filepath.Join("/dev", inactivePartition)
-	}
-
-	b := &BlockDevice{Path: inactivePartition, typeUBI: typeUBI, ImageSize: size}
+	inactivePartition := b.Path
+	b.ImageSize = size
+	b.DirectIO = true
 
 	if bsz, err := b.Size(); err != nil {
 		log.Errorf("failed to read size of block device %s: %v",
@@ -132,12 +202,75 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 
 	if cerr := b.Close(); cerr != nil {
 		log.Errorf("closing device %v failed: %v", inactivePartition, cerr)
-		if err != nil {
-			return cerr
+		if err == nil {
+			err = cerr
 		}
 	}
+	if err != nil {
+		return err
+	}
+
+	// make sure the image actually made it to the device
+	if err := b.Verify(); err != nil {
+		log.Errorf("verification of device %v failed: %v", inactivePartition, err)
+		return err
+	}
+	return nil
+}
+
+// inactiveBlockDevice returns the partition updates are installed to.
+func (d *device) inactiveBlockDevice() (*BlockDevice, error) {
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	typeUBI := isUbiBlockDevice(inactivePartition)
+	if typeUBI {
+		// UBI block devices are not prefixed with /dev due to the fact
+		// that the kernel root= argument does not handle UBI block
+		// devices which are prefixed with /dev
+		//
+		// Kernel root= only accepts:
+		// - ubi0_0
+		// - ubi:rootfsa
+		inactivePartition = filepath.Join("/dev", inactivePartition)
+	}
+	return &BlockDevice{Path: inactivePartition, typeUBI: typeUBI}, nil
+}
+
+// InactivePartitionSize returns the size of the partition updates are
+// installed to.
+func (d *device) InactivePartitionSize() (uint64, error) {
+	b, err := d.inactiveBlockDevice()
+	if err != nil {
+		return 0, err
+	}
+	return b.Size()
+}
+
+// OpenActiveRootfs opens the partition the device is running from, as the
+// base for applying delta updates.
+func (d *device) OpenActiveRootfs() (installer.ReadAtCloser, int64, error) {
+	activePartition, err := d.GetActive()
+	if err != nil {
+		return nil, 0, err
+	}
+	if isUbiBlockDevice(activePartition) {
+		activePartition = filepath.Join("/dev", activePartition)
+	}
+
+	f, err := os.Open(activePartition)
+	if err != nil {
+		return nil, 0, err
+	}
+	// works for both block devices and regular files
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, errors.Wrapf(err, "failed to read size of %s", activePartition)
+	}
+	return f, size, nil
 }
 
 func (d *device) getInactivePartition() (string, string, error) {
@@ -192,6 +325,20 @@ func (d *device) CommitUpdate() error {
 	return errorNoUpgradeMounted
 }
 
+// RollbackUpdate rejects the update the device is running, making it boot
+// the previous image on the next reboot.
+func (d *device) RollbackUpdate() error {
+	hasUpdate, err := d.HasUpdate()
+	if err != nil {
+		return err
+	}
+	if !hasUpdate {
+		return errorNoUpgradeMounted
+	}
+	log.Info("Rolling back update; the previous image is booted after reboot")
+	return d.SwapPartitions()
+}
+
 func (d *device) HasUpdate() (bool, error) {
 	env, err := d.ReadEnv("upgrade_available")
 	if err != nil {
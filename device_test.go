@@ -15,10 +15,13 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // implements BootEnvReadWriter
@@ -150,6 +153,32 @@ func Test_installUpdate_existingAndNonInactivePartition(t *testing.T) {
 	BlockDeviceGetSectorSizeOf = oldSectorSizeOf
 }
 
+func TestDeviceOpenActiveRootfs(t *testing.T) {
+	testDevice := device{}
+	fakePartitions := partitions{}
+	testDevice.partitions = &fakePartitions
+
+	fakePartitions.active = "/non/existing"
+	_, _, err := testDevice.OpenActiveRootfs()
+	assert.Error(t, err)
+
+	f, _ := os.Create("activePart")
+	defer os.Remove("activePart")
+	f.WriteString("active rootfs")
+	f.Close()
+
+	fakePartitions.active = "activePart"
+	r, size, err := testDevice.OpenActiveRootfs()
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(len("active rootfs")), size)
+
+	buf := make([]byte, 6)
+	_, err = r.ReadAt(buf, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "rootfs", string(buf))
+}
+
 func Test_FetchUpdate_existingAndNonExistingUpdateFile(t *testing.T) {
 	image, _ := os.Create("imageFile")
 	imageContent := "test content"
@@ -181,6 +210,33 @@ func Test_Rollback_OK(t *testing.T) {
 	}
 }
 
+func TestDeviceRollbackUpdate(t *testing.T) {
+	testDevice := device{partitions: &partitions{inactive: "/dev/mmcblk0p2"}}
+
+	env := &fakeBootEnv{
+		readVars: BootVars{
+			"upgrade_available": "1",
+		},
+	}
+	testDevice.BootEnvReadWriter = env
+	assert.NoError(t, testDevice.RollbackUpdate())
+	assert.Equal(t, BootVars{
+		"mender_boot_part":     "2",
+		"mender_boot_part_hex": "2",
+		"upgrade_available":    "0",
+	}, env.writeVars)
+
+	// nothing to roll back
+	env = &fakeBootEnv{
+		readVars: BootVars{
+			"upgrade_available": "0",
+		},
+	}
+	testDevice.BootEnvReadWriter = env
+	assert.Equal(t, errorNoUpgradeMounted, testDevice.RollbackUpdate())
+	assert.Nil(t, env.writeVars)
+}
+
 func TestDeviceHasUpdate(t *testing.T) {
 	runner := newTestOSCalls("", -1)
 	testDevice := NewDevice(
@@ -208,3 +264,78 @@ func TestDeviceHasUpdate(t *testing.T) {
 	assert.True(t, has)
 	assert.NoError(t, err)
 }
+
+func TestSystemUptime(t *testing.T) {
+	if _, err := os.Stat("/proc/uptime"); err != nil {
+		t.Skip("/proc/uptime not available")
+	}
+	uptime, err := systemUptime()
+	assert.NoError(t, err)
+	assert.True(t, uptime > 0)
+}
+
+// dirStatCommander runs the commands found in a directory.
+type dirStatCommander struct {
+	dirCommander
+}
+
+func (dirStatCommander) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func TestDeviceReboot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "reboot"),
+		[]byte("#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/rebooted\"\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "failing-reboot"),
+		[]byte("#!/bin/sh\necho \"no logind\"\nexit 1\n"), 0755))
+
+	oldSync := syncFilesystems
+	defer func() { syncFilesystems = oldSync }()
+	synced := 0
+	syncFilesystems = func() { synced++ }
+
+	d := NewDevice(nil, dirStatCommander{dirCommander{dir}}, deviceConfig{})
+	assert.NoError(t, d.Reboot())
+	assert.Equal(t, 1, synced)
+	_, err = os.Stat(filepath.Join(dir, "rebooted"))
+	assert.NoError(t, err)
+
+	d = NewDevice(nil, dirStatCommander{dirCommander{dir}}, deviceConfig{
+		reboot: rebootConfig{command: []string{"reboot", "--force"}},
+	})
+	assert.NoError(t, d.Reboot())
+	args, err := ioutil.ReadFile(filepath.Join(dir, "rebooted"))
+	assert.NoError(t, err)
+	assert.Equal(t, "--force\n", string(args))
+
+	d.reboot.command = []string{"failing-reboot"}
+	err = d.Reboot()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no logind")
+
+	// only requested, for a supervisor to reboot
+	var config menderConfig
+	config.Reboot.Mode = rebootModeSignal
+	config.Reboot.RequestFile = filepath.Join(dir, "reboot-required")
+	os.Remove(filepath.Join(dir, "rebooted"))
+	synced = 0
+	d = NewDevice(nil, dirStatCommander{dirCommander{dir}}, config.GetDeviceConfig())
+	assert.NoError(t, d.Reboot())
+	assert.True(t, synced > 0)
+	_, err = os.Stat(filepath.Join(dir, "rebooted"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(config.Reboot.RequestFile)
+	assert.NoError(t, err)
+
+	assert.NoError(t, clearRebootRequest(config))
+	_, err = os.Stat(config.Reboot.RequestFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, clearRebootRequest(config))
+
+	config.Reboot.RequestFile = filepath.Join(dir, "missing", "reboot-required")
+	d = NewDevice(nil, dirStatCommander{dirCommander{dir}}, config.GetDeviceConfig())
+	assert.Error(t, d.Reboot())
+}
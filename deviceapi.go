@@ -0,0 +1,246 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	deviceAPIPrefix = "/api/devices/v1/"
+	// requests of applications are read in full, so that they can be sent
+	// again once the client has authorized again
+	deviceAPIMaxRequestSize = 1024 * 1024
+)
+
+// Device API calls applications may make unless configured otherwise.
+var defaultDeviceAPIPaths = []string{
+	"inventory/device/attributes",
+	"deployments/device/deployments/",
+}
+
+// deviceAPIProxy serves the device API of the server to applications on the
+// device over a unix socket, under the same paths, e.g.
+//
+//	PATCH /api/devices/v1/inventory/device/attributes
+//
+// The requests are sent on to the server with the auth token of the client,
+// so that the applications get to call the API as the device without access
+// to the device key. Only root and the configured users and groups, as told
+// by the credentials of the peer of the socket, may connect, and only the
+// configured paths may be called.
+type deviceAPIProxy struct {
+	api      *client.ApiClient
+	server   string
+	token    func() (client.AuthToken, error)
+	paths    []string
+	listener net.Listener
+	srv      *http.Server
+}
+
+func startDeviceAPIProxy(api *client.ApiClient, config menderConfig,
+	token func() (client.AuthToken, error)) (*deviceAPIProxy, error) {
+
+	socket := config.DeviceAPI.Socket
+	// a socket left over by a previous run would make listening fail
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove stale device API socket")
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on device API socket")
+	}
+	// anyone may connect; who is allowed to is told by the credentials of
+	// the peer
+	if err := os.Chmod(socket, 0666); err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "failed to set permissions of device API socket")
+	}
+
+	p := &deviceAPIProxy{
+		api:    api,
+		server: config.ServerURL,
+		token:  token,
+		paths:  config.DeviceAPI.AllowedPaths,
+		listener: &peerCredListener{
+			Listener: l,
+			uids:     config.DeviceAPI.AllowedUIDs,
+			gids:     config.DeviceAPI.AllowedGIDs,
+		},
+	}
+	if len(p.paths) == 0 {
+		p.paths = defaultDeviceAPIPaths
+	}
+	p.srv = &http.Server{Handler: p}
+
+	go func() {
+		if err := p.srv.Serve(p.listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("device API proxy failed: %v", err)
+		}
+	}()
+	log.Infof("serving the device API to applications on %s", socket)
+	return p, nil
+}
+
+func (p *deviceAPIProxy) Close() error {
+	return p.srv.Close()
+}
+
+// allowed tells if applications may call the API at apiPath, relative to
+// deviceAPIPrefix.
+func (p *deviceAPIProxy) allowed(apiPath string) bool {
+	for _, allowed := range p.paths {
+		if apiPath == allowed || (strings.HasSuffix(allowed, "/") &&
+			strings.HasPrefix(apiPath, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *deviceAPIProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// no escaping the allowed paths with dot segments
+	apiPath := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(apiPath, deviceAPIPrefix) ||
+		!p.allowed(strings.TrimPrefix(apiPath, deviceAPIPrefix)) {
+		log.Warnf("device API proxy: refusing %s %s", r.Method, r.URL.Path)
+		http.Error(w, "API not available to applications", http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, deviceAPIMaxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	token, err := p.token()
+	if err != nil || token == "" {
+		http.Error(w, "device is not authorized", http.StatusServiceUnavailable)
+		return
+	}
+
+	url := p.server + apiPath
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req = req.WithContext(r.Context())
+	for _, h := range []string{"Content-Type", "Accept"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	// the daemon authorizes again if the token is rejected
+	rsp, err := p.api.Request(token, func() (client.AuthToken, error) {
+		return noAuthToken, errors.New("not authorizing for applications")
+	}).Do(req)
+	if err != nil {
+		log.Warnf("device API proxy: %s %s failed: %v", r.Method, apiPath, err)
+		http.Error(w, "request to the server failed", http.StatusBadGateway)
+		return
+	}
+	defer rsp.Body.Close()
+
+	log.Debugf("device API proxy: %s %s: %s", r.Method, apiPath, rsp.Status)
+	for _, h := range []string{"Content-Type", "Content-Length"} {
+		if v := rsp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(rsp.StatusCode)
+	io.Copy(w, rsp.Body)
+}
+
+// peerCredListener accepts the connections of root and of the given users
+// and groups only.
+type peerCredListener struct {
+	net.Listener
+	uids []int
+	gids []int
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCredentials(conn)
+		if err != nil {
+			log.Warnf("device API proxy: refusing connection: %v", err)
+		} else if l.allowed(cred) {
+			return conn, nil
+		} else {
+			log.Warnf("device API proxy: refusing connection of PID %d, UID %d, GID %d",
+				cred.Pid, cred.Uid, cred.Gid)
+		}
+		conn.Close()
+	}
+}
+
+func (l *peerCredListener) allowed(cred *syscall.Ucred) bool {
+	if cred.Uid == 0 {
+		return true
+	}
+	for _, uid := range l.uids {
+		if uint32(uid) == cred.Uid {
+			return true
+		}
+	}
+	for _, gid := range l.gids {
+		if uint32(gid) == cred.Gid {
+			return true
+		}
+	}
+	return false
+}
+
+// peerCredentials returns the credentials of the process at the other end of
+// a unix socket connection.
+func peerCredentials(conn net.Conn) (*syscall.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	return cred, errors.Wrapf(err, "failed to read peer credentials")
+}
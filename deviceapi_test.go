@@ -0,0 +1,113 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceAPIProxy(t *testing.T) {
+	var method, path, query, auth, body string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, query = r.Method, r.URL.Path, r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "deviceapi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := menderConfig{ServerURL: ts.URL}
+	config.DeviceAPI.Socket = filepath.Join(dir, "device-api.sock")
+	api, err := client.NewApiClient(client.Config{IsHttps: true, NoVerify: true})
+	require.NoError(t, err)
+	token := client.AuthToken("token")
+	p, err := startDeviceAPIProxy(api, config, func() (client.AuthToken, error) {
+		return token, nil
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	cl := controlClient(config.DeviceAPI.Socket)
+
+	call := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, "http://mender"+path,
+			strings.NewReader(`[{"name": "app_version", "value": "1.2"}]`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		// applications can not pass on tokens of their own
+		req.Header.Set("Authorization", "Bearer app")
+		rsp, err := cl.Do(req)
+		require.NoError(t, err)
+		return rsp
+	}
+
+	rsp := call(http.MethodPatch, "/api/devices/v1/inventory/device/attributes")
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	data, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.Equal(t, `{"ok": true}`, string(data))
+	assert.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+	assert.Equal(t, http.MethodPatch, method)
+	assert.Equal(t, "/api/devices/v1/inventory/device/attributes", path)
+	assert.Equal(t, "Bearer token", auth)
+	assert.Equal(t, `[{"name": "app_version", "value": "1.2"}]`, body)
+
+	rsp = call(http.MethodPut, "/api/devices/v1/deployments/device/deployments/d1/status?x=1")
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "/api/devices/v1/deployments/device/deployments/d1/status", path)
+	assert.Equal(t, "x=1", query)
+
+	path = ""
+	for _, refused := range []string{
+		"/api/devices/v1/authentication/auth_requests",
+		"/api/devices/v1/inventory/device/attributes/more",
+		"/api/devices/v1/deployments/device/deployments/../../../authentication/auth_requests",
+		"/api/management/v1/devauth/devices",
+	} {
+		rsp = call(http.MethodPost, refused)
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, rsp.StatusCode, refused)
+	}
+	assert.Empty(t, path)
+
+	token = noAuthToken
+	rsp = call(http.MethodPatch, "/api/devices/v1/inventory/device/attributes")
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+}
+
+func TestPeerCredListener(t *testing.T) {
+	l := &peerCredListener{uids: []int{1000}, gids: []int{50}}
+	assert.True(t, l.allowed(&syscall.Ucred{Uid: 0, Gid: 0}))
+	assert.True(t, l.allowed(&syscall.Ucred{Uid: 1000, Gid: 1000}))
+	assert.True(t, l.allowed(&syscall.Ucred{Uid: 1001, Gid: 50}))
+	assert.False(t, l.allowed(&syscall.Ucred{Uid: 1001, Gid: 1001}))
+}
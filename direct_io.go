@@ -0,0 +1,154 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// alignment of buffers, offsets and sizes of O_DIRECT transfers; a
+	// multiple of the logical sector size of any device we are writing to
+	directIOAlignment = 4096
+	// size of the O_DIRECT transfers
+	directIOChunkSize = 1024 * 1024
+)
+
+// alignedBuffer allocates a buffer of the given size, with its start aligned
+// as O_DIRECT requires.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if off != 0 {
+		off = directIOAlignment - off
+	}
+	return buf[off : off+size]
+}
+
+// openDirect opens the file for O_DIRECT transfers. ok is false if the file
+// system does not support O_DIRECT, in which case the file should be opened
+// normally.
+func openDirect(name string, flag int) (f *os.File, ok bool, err error) {
+	f, err = os.OpenFile(name, flag|unix.O_DIRECT, 0)
+	if perr, isPath := err.(*os.PathError); isPath && perr.Err == syscall.EINVAL {
+		return nil, false, nil
+	}
+	return f, err == nil, err
+}
+
+// directWriter collects the data written in aligned chunks and writes those
+// to the file opened with O_DIRECT, bypassing the page cache.
+type directWriter struct {
+	out *os.File
+	buf []byte
+	n   int
+	off int64
+}
+
+func newDirectWriter(out *os.File) *directWriter {
+	return &directWriter{
+		out: out,
+		buf: alignedBuffer(directIOChunkSize),
+	}
+}
+
+func (dw *directWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		c := copy(dw.buf[dw.n:], p)
+		dw.n += c
+		p = p[c:]
+		if dw.n == len(dw.buf) {
+			if err := dw.writeChunk(dw.n); err != nil {
+				return written, err
+			}
+		}
+		written += c
+	}
+	return written, nil
+}
+
+func (dw *directWriter) writeChunk(n int) error {
+	w, err := dw.out.WriteAt(dw.buf[:n], dw.off)
+	dw.off += int64(w)
+	if err != nil {
+		return err
+	}
+	copy(dw.buf, dw.buf[n:dw.n])
+	dw.n -= n
+	return nil
+}
+
+// Flush writes the data still pending. O_DIRECT can not write a tail
+// shorter than the alignment, so that goes through a regular file descriptor.
+func (dw *directWriter) Flush() error {
+	if aligned := dw.n &^ (directIOAlignment - 1); aligned > 0 {
+		if err := dw.writeChunk(aligned); err != nil {
+			return err
+		}
+	}
+	if dw.n == 0 {
+		return nil
+	}
+
+	out, err := os.OpenFile(dw.out.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := out.WriteAt(dw.buf[:dw.n], dw.off); err != nil {
+		return err
+	}
+	dw.off += int64(dw.n)
+	dw.n = 0
+	return out.Sync()
+}
+
+// directReader reads the file opened with O_DIRECT in aligned chunks, making
+// sure the data comes from the device rather than the page cache.
+type directReader struct {
+	in   *os.File
+	buf  []byte
+	data []byte
+	off  int64
+}
+
+func newDirectReader(in *os.File) *directReader {
+	return &directReader{
+		in:  in,
+		buf: alignedBuffer(directIOChunkSize),
+	}
+}
+
+func (dr *directReader) Read(p []byte) (int, error) {
+	if len(dr.data) == 0 {
+		n, err := dr.in.ReadAt(dr.buf, dr.off)
+		dr.off += int64(n)
+		dr.data = dr.buf[:n]
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, dr.data)
+	dr.data = dr.data[n:]
+	return n, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Time between attempts of renewing the client certificate, and the longest
+// the enroller waits before checking when to renew it again, e.g. after the
+// clock has been set.
+var (
+	enrollmentRetryInterval = 5 * time.Minute
+	enrollmentCheckInterval = time.Hour
+)
+
+// enrollClientCertificate makes sure there is a valid client certificate
+// before the daemon connects to the server, enrolling one if there is none.
+func enrollClientCertificate(e client.Enrollment) error {
+	if !e.RenewalTime().IsZero() {
+		return nil
+	}
+	log.Infof("enrolling client certificate with %s", e.ServerURL)
+	if _, err := e.Enroll(context.Background()); err != nil {
+		return errors.Wrapf(err, "client certificate enrollment failed")
+	}
+	return nil
+}
+
+// certEnroller renews the client certificate before it expires; the client
+// loads the renewed certificate for new connections to the server.
+type certEnroller struct {
+	enrollment client.Enrollment
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+func startCertEnroller(e client.Enrollment) *certEnroller {
+	c := &certEnroller{
+		enrollment: e,
+		done:       make(chan struct{}),
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run(ctx)
+	return c
+}
+
+func (c *certEnroller) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *certEnroller) run(ctx context.Context) {
+	defer close(c.done)
+	renewal := c.enrollment.RenewalTime()
+	for {
+		wait := time.Until(renewal)
+		if wait > enrollmentCheckInterval {
+			wait = enrollmentCheckInterval
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		if time.Now().Before(renewal) {
+			continue
+		}
+
+		log.Infof("renewing client certificate with %s", c.enrollment.ServerURL)
+		next, err := c.enrollment.Enroll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("client certificate renewal failed; retrying in %v: %v",
+				enrollmentRetryInterval, err)
+			renewal = time.Now().Add(enrollmentRetryInterval)
+			continue
+		}
+		renewal = next
+	}
+}
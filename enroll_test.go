@@ -0,0 +1,107 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEnrolledCert writes a client certificate valid for validity.
+func writeEnrolledCert(t *testing.T, e client.Enrollment, validity time.Duration) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(e.ClientCert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(e.ClientKey,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestEnrollClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := client.Enrollment{
+		// nothing listens there
+		ServerURL:  "https://127.0.0.1:1/.well-known/est",
+		Username:   "device",
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+	assert.Error(t, enrollClientCertificate(e))
+
+	// the server is not contacted while the certificate is valid
+	writeEnrolledCert(t, e, time.Hour)
+	assert.NoError(t, enrollClientCertificate(e))
+	writeEnrolledCert(t, e, -time.Second)
+	assert.Error(t, enrollClientCertificate(e))
+}
+
+func TestCertEnroller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroll")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevRetry := enrollmentRetryInterval
+	enrollmentRetryInterval = 10 * time.Millisecond
+	defer func() {
+		enrollmentRetryInterval = prevRetry
+	}()
+
+	e := client.Enrollment{
+		ServerURL:  "https://127.0.0.1:1/.well-known/est",
+		Username:   "device",
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+		// due right away
+		RenewBefore: 2 * time.Hour,
+	}
+	writeEnrolledCert(t, e, time.Hour)
+	before, err := ioutil.ReadFile(e.ClientCert)
+	require.NoError(t, err)
+
+	// renewals failing are retried until the enroller is closed, keeping
+	// the current certificate
+	c := startCertEnroller(e)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, c.Close())
+	after, err := ioutil.ReadFile(e.ClientCert)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
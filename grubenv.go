@@ -0,0 +1,139 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	bootloaderUBoot = "u-boot"
+	bootloaderGrub  = "grub"
+
+	defaultGrubEnvFile = "/boot/grub/grubenv"
+)
+
+// grubEnv reads and writes the GRUB environment block using grub-editenv.
+// The GRUB boot script is expected to use the same variables as U-Boot does:
+// mender_boot_part, upgrade_available and bootcount.
+type grubEnv struct {
+	Commander
+	envFile string
+}
+
+func NewGrubEnvironment(cmd Commander, envFile string) *grubEnv {
+	if envFile == "" {
+		envFile = defaultGrubEnvFile
+	}
+	return &grubEnv{
+		Commander: cmd,
+		envFile:   envFile,
+	}
+}
+
+// NewBootEnvironment returns the boot environment of the configured boot
+// loader.
+func NewBootEnvironment(cmd Commander, config *menderConfig) BootEnvReadWriter {
+	if config.Bootloader == bootloaderGrub {
+		return NewGrubEnvironment(cmd, config.GrubEnvFile)
+	}
+	if config.Bootloader == bootloaderUEFI {
+		return NewUEFIEnvironment(cmd, config)
+	}
+	if config.UBootEnvConfig != "" {
+		return NewUBootEnvFile(config.UBootEnvConfig)
+	}
+	return NewEnvironment(cmd)
+}
+
+func (e *grubEnv) run(args ...string) ([]byte, error) {
+	cmd := e.Command("grub-editenv", append([]string{e.envFile}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "grub-editenv %s failed: %s", args[0],
+			strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ReadEnv returns the given variables, or all of them if no names are given.
+// Like fw_printenv, it fails if any of the given variables is not defined.
+func (e *grubEnv) ReadEnv(names ...string) (BootVars, error) {
+	out, err := e.run("list")
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(BootVars)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Invalid GRUB variable or error: " + line)
+		}
+		log.Debug("Have GRUB variable: ", line)
+		all[kv[0]] = kv[1]
+	}
+
+	if len(names) == 0 {
+		return all, nil
+	}
+	vars := make(BootVars)
+	for _, name := range names {
+		val, ok := all[name]
+		if !ok {
+			return nil, errors.Errorf("GRUB variable %q not defined", name)
+		}
+		vars[name] = val
+	}
+	return vars, nil
+}
+
+// WriteEnv sets the given variables; variables with empty values are
+// removed from the environment.
+func (e *grubEnv) WriteEnv(vars BootVars) error {
+	var set, unset []string
+	for k, v := range vars {
+		if v == "" {
+			unset = append(unset, k)
+		} else {
+			set = append(set, k+"="+v)
+		}
+	}
+	sort.Strings(set)
+	sort.Strings(unset)
+
+	if len(set) > 0 {
+		if _, err := e.run(append([]string{"set"}, set...)...); err != nil {
+			log.Errorln("Error while setting GRUB variables: ", err)
+			return err
+		}
+	}
+	if len(unset) > 0 {
+		if _, err := e.run(append([]string{"unset"}, unset...)...); err != nil {
+			log.Errorln("Error while removing GRUB variables: ", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGrubEditenv keeps the environment as plain name=value lines.
+const fakeGrubEditenv = `#!/bin/sh
+file=$1
+cmd=$2
+shift 2
+touch "$file"
+case $cmd in
+list)
+	cat "$file"
+	;;
+set)
+	for kv in "$@"; do
+		grep -v "^${kv%%=*}=" "$file" > "$file.tmp"
+		echo "$kv" >> "$file.tmp"
+		mv "$file.tmp" "$file"
+	done
+	;;
+unset)
+	for k in "$@"; do
+		grep -v "^$k=" "$file" > "$file.tmp"
+		mv "$file.tmp" "$file"
+	done
+	;;
+*)
+	echo "unknown command $cmd" >&2
+	exit 1
+	;;
+esac
+`
+
+// dirCommander runs the commands found in dir.
+type dirCommander struct {
+	dir string
+}
+
+func (c dirCommander) Command(name string, args ...string) *exec.Cmd {
+	return exec.Command(filepath.Join(c.dir, name), args...)
+}
+
+func TestGrubEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grubenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "grub-editenv"),
+		[]byte(fakeGrubEditenv), 0755))
+
+	env := NewGrubEnvironment(dirCommander{dir}, filepath.Join(dir, "grubenv"))
+
+	vars, err := env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Empty(t, vars)
+
+	assert.NoError(t, env.WriteEnv(BootVars{
+		"mender_boot_part":  "3",
+		"upgrade_available": "1",
+		"bootcount":         "0",
+		"bootargs":          "root=/dev/sda3 rw",
+	}))
+
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{
+		"mender_boot_part":  "3",
+		"upgrade_available": "1",
+	}, vars)
+
+	vars, err = env.ReadEnv("bootargs")
+	assert.NoError(t, err)
+	assert.Equal(t, "root=/dev/sda3 rw", vars["bootargs"])
+
+	// empty values remove variables
+	assert.NoError(t, env.WriteEnv(BootVars{
+		"upgrade_available": "0",
+		"bootargs":          "",
+	}))
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{
+		"mender_boot_part":  "3",
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	}, vars)
+
+	_, err = env.ReadEnv("bootargs")
+	assert.Error(t, err)
+}
+
+func TestGrubEnvFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grubenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "grub-editenv"),
+		[]byte("#!/bin/sh\necho 'invalid environment block' >&2\nexit 1\n"), 0755))
+
+	env := NewGrubEnvironment(dirCommander{dir}, "")
+	assert.Equal(t, defaultGrubEnvFile, env.envFile)
+
+	_, err = env.ReadEnv("mender_boot_part")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid environment block")
+
+	assert.Error(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+}
+
+func TestNewBootEnvironment(t *testing.T) {
+	config := &menderConfig{}
+	_, ok := NewBootEnvironment(new(osCalls), config).(*uBootEnv)
+	assert.True(t, ok)
+
+	config.Bootloader = bootloaderGrub
+	config.GrubEnvFile = "/boot/efi/grubenv"
+	env, ok := NewBootEnvironment(new(osCalls), config).(*grubEnv)
+	assert.True(t, ok)
+	assert.Equal(t, "/boot/efi/grubenv", env.envFile)
+
+	config.Bootloader = bootloaderUBoot
+	config.UBootEnvConfig = "/etc/fw_env.config"
+	uenv, ok := NewBootEnvironment(new(osCalls), config).(*ubootEnvFile)
+	assert.True(t, ok)
+	assert.Equal(t, "/etc/fw_env.config", uenv.configFile)
+
+	config.Bootloader = bootloaderUEFI
+	config.UEFI.EnvFile = "/data/uefi_env"
+	efienv, ok := NewBootEnvironment(new(osCalls), config).(*uefiEnv)
+	assert.True(t, ok)
+	assert.Equal(t, "/data/uefi_env", efienv.envFile)
+	_, ok = efienv.manager.(*efibootmgr)
+	assert.True(t, ok)
+
+	config.Bootloader = "lilo"
+	assert.Error(t, config.validate())
+}
@@ -14,8 +14,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"path"
+	"strings"
 
 	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
@@ -39,9 +41,14 @@ type IdentityDataRunner struct {
 	cmdr   Commander
 }
 
-func NewIdentityDataGetter() IdentityDataGetter {
+// NewIdentityDataGetter returns an identity data getter calling helper, or
+// the default identity helper if helper is empty.
+func NewIdentityDataGetter(helper string) IdentityDataGetter {
+	if helper == "" {
+		helper = identityDataHelper
+	}
 	return &IdentityDataRunner{
-		identityDataHelper,
+		helper,
 		&osCalls{},
 	}
 }
@@ -61,17 +68,27 @@ func (id IdentityDataRunner) Get() (string, error) {
 		return "", errors.Wrapf(err, "failed to open pipe for reading")
 	}
 
+	// keep the diagnostics of the helper for reporting failures
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
 	if err := cmd.Start(); err != nil {
 		return "", errors.Wrapf(err, "failed to call %s", helper)
 	}
 
 	p := utils.KeyValParser{}
-	if err := p.Parse(out); err != nil {
-		return "", errors.Wrapf(err, "failed to parse identity data")
-	}
+	perr := p.Parse(out)
 
+	// always reap the helper, even if its output was unusable
 	if err := cmd.Wait(); err != nil {
-		return "", errors.Wrapf(err, "wait for helper failed")
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Wrapf(err, "identity helper %s failed: %s", helper, msg)
+		}
+		return "", errors.Wrapf(err, "identity helper %s failed", helper)
+	}
+
+	if perr != nil {
+		return "", errors.Wrapf(perr, "failed to parse identity data")
 	}
 
 	collected := p.Collect()
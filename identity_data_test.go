@@ -15,9 +15,13 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeviceIdentityGet(t *testing.T) {
@@ -108,3 +112,37 @@ keyvalue
 		}
 	}
 }
+
+func TestDeviceIdentityHelper(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-identity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	helper := path.Join(tdir, "identity")
+	writeHelper := func(script string) {
+		require.NoError(t, ioutil.WriteFile(helper,
+			[]byte("#!/bin/sh\n"+script), 0755))
+	}
+
+	// configured helper is used instead of the default one
+	ir := NewIdentityDataGetter(helper)
+	assert.Equal(t, helper, ir.(*IdentityDataRunner).Helper)
+	assert.Equal(t, identityDataHelper,
+		NewIdentityDataGetter("").(*IdentityDataRunner).Helper)
+
+	writeHelper("echo mac=de:ad:be:ef:00:01\n")
+	id, err := ir.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"mac":"de:ad:be:ef:00:01"}`, id)
+
+	// diagnostics of a failing helper are reported
+	writeHelper("echo mac=de:ad:be:ef:00:01\necho 'no network interface' >&2\nexit 3\n")
+	_, err = ir.Get()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no network interface")
+
+	// unparsable output is an error
+	writeHelper("echo garbage\n")
+	_, err = ir.Get()
+	assert.Error(t, err)
+}
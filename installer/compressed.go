@@ -0,0 +1,211 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// Commands decompressing the rootfs images compressed with formats not
+// supported by the standard library, by file name extension.
+var decompressCommands = map[string][]string{
+	".xz":   {"xz", "-dc"},
+	".lzma": {"xz", "--format=lzma", "-dc"},
+	".zst":  {"zstd", "-dc"},
+}
+
+// isCompressed tells whether the rootfs image file is compressed, judging by
+// its name.
+func isCompressed(name string) bool {
+	ext := filepath.Ext(name)
+	_, ok := decompressCommands[ext]
+	return ok || ext == ".gz"
+}
+
+// decompress returns the decompressed contents of the image file read from r.
+func decompress(r io.Reader, name string) (io.ReadCloser, error) {
+	ext := filepath.Ext(name)
+	if ext == ".gz" {
+		return gzip.NewReader(r)
+	}
+
+	args, ok := decompressCommands[ext]
+	if !ok {
+		return nil, errors.Errorf("installer: unsupported compression of %s", name)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "installer: failed to decompress %s", name)
+	}
+	return &commandReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// commandReader reads the output of a running command.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+	eof bool
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Close waits for the command to finish; it is stopped if not all of its
+// output was read.
+func (c *commandReader) Close() error {
+	if !c.eof {
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+		return nil
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "installer: %s failed", c.cmd.Path)
+	}
+	return nil
+}
+
+// compressedMetaData is read from the meta-data of rootfs images; it is
+// required for compressed images, as their size and checksum only describe
+// the compressed file.
+type compressedMetaData struct {
+	// size of the decompressed image
+	ImageSize int64 `json:"image_size"`
+	// hex encoded SHA256 of the decompressed image
+	ImageChecksum string `json:"image_checksum"`
+}
+
+// RootfsInstaller installs rootfs images like handlers.Rootfs, decompressing
+// the compressed images while they are being installed.
+type RootfsInstaller struct {
+	*handlers.Rootfs
+	install func(r io.Reader, size int64) error
+	meta    compressedMetaData
+	// hex encoded SHA256 of the image, once installed
+	installedChecksum string
+}
+
+// NewRootfsInstaller returns a handler passing the (decompressed) rootfs
+// images and their sizes to install.
+func NewRootfsInstaller(install func(r io.Reader, size int64) error) *RootfsInstaller {
+	ri := &RootfsInstaller{
+		Rootfs:  handlers.NewRootfsInstaller(),
+		install: install,
+	}
+	ri.Rootfs.InstallHandler = ri.installImage
+	return ri
+}
+
+func (ri *RootfsInstaller) Copy() handlers.Installer {
+	return NewRootfsInstaller(ri.install)
+}
+
+func (ri *RootfsInstaller) ReadHeader(r io.Reader, path string) error {
+	if filepath.Base(path) != "meta-data" {
+		return ri.Rootfs.ReadHeader(r, path)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to read rootfs meta-data")
+	}
+	// meta-data is part of all the payloads, but may be empty
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, &ri.meta); err != nil {
+		return errors.Wrapf(err, "installer: invalid rootfs meta-data")
+	}
+	return nil
+}
+
+func (ri *RootfsInstaller) installImage(r io.Reader, df *handlers.DataFile) error {
+	if !isCompressed(df.Name) {
+		if err := ri.install(r, df.Size); err != nil {
+			return err
+		}
+		ri.installedChecksum = string(df.Checksum)
+		return nil
+	}
+
+	sum, err := hex.DecodeString(ri.meta.ImageChecksum)
+	if err != nil || len(sum) != sha256.Size || ri.meta.ImageSize <= 0 {
+		return errors.New("installer: compressed image is missing a valid " +
+			"image size and checksum")
+	}
+
+	dr, err := decompress(r, df.Name)
+	if err != nil {
+		return err
+	}
+	log.Infof("installer: decompressing image %s of size %v to size %v",
+		df.Name, df.Size, ri.meta.ImageSize)
+
+	hash := sha256.New()
+	rd := &countingReader{r: io.TeeReader(dr, hash)}
+	err = ri.install(rd, ri.meta.ImageSize)
+	if err == nil {
+		// whatever was not installed still needs to be accounted for
+		_, err = io.Copy(ioutil.Discard, rd)
+	}
+	if cerr := dr.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to install compressed image")
+	}
+
+	if rd.n != ri.meta.ImageSize {
+		return errors.Errorf("installer: decompressed image has size %v, "+
+			"expected %v", rd.n, ri.meta.ImageSize)
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return errors.Errorf("installer: checksum of decompressed image %x "+
+			"does not match expected %x", hash.Sum(nil), sum)
+	}
+	ri.installedChecksum = hex.EncodeToString(sum)
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
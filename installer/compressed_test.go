@@ -0,0 +1,165 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const compressedImage = "this is the decompressed rootfs image"
+
+// compressedUpdate composes a rootfs-image payload with the given meta-data
+type compressedUpdate struct {
+	*handlers.Rootfs
+	file string
+	meta string
+}
+
+func (c *compressedUpdate) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+	sw := artifact.NewTarWriterStream(tw)
+	files := &artifact.Files{FileList: []string{filepath.Base(c.file)}}
+	if err := sw.Write(artifact.ToStream(files), filepath.Join(path, "files")); err != nil {
+		return err
+	}
+	tinfo := &artifact.TypeInfo{Type: "rootfs-image"}
+	if err := sw.Write(artifact.ToStream(tinfo), filepath.Join(path, "type-info")); err != nil {
+		return err
+	}
+	return sw.Write([]byte(c.meta), filepath.Join(path, "meta-data"))
+}
+
+func makeCompressedArtifact(t *testing.T, name string, data []byte, meta string) io.ReadCloser {
+	dir, err := ioutil.TempDir("", "compressed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{
+		&compressedUpdate{handlers.NewRootfsV2(file), file, meta},
+	}}
+	require.NoError(t, aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", updates, &artifact.Scripts{}))
+	return &rc{art}
+}
+
+type fImageDevice struct {
+	installed bytes.Buffer
+	size      int64
+}
+
+func (d *fImageDevice) InstallUpdate(r io.ReadCloser, l int64) error {
+	d.size = l
+	_, err := io.Copy(&d.installed, r)
+	return err
+}
+
+func (d *fImageDevice) EnableUpdatedPartition() error { return nil }
+
+func compressedMeta(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return fmt.Sprintf(`{"image_size": %d, "image_checksum": "%s"}`,
+		len(image), hex.EncodeToString(sum[:]))
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestInstallCompressed(t *testing.T) {
+	meta := compressedMeta(compressedImage)
+
+	dev := new(fImageDevice)
+	rootfs, err := InstallWithModules(makeCompressedArtifact(t, "image.ext4.gz",
+		gzipped(t, compressedImage), meta), "vexpress-qemu", nil, "", dev, true, nil)
+	assert.NoError(t, err)
+	assert.True(t, rootfs)
+	assert.Equal(t, compressedImage, dev.installed.String())
+	assert.Equal(t, int64(len(compressedImage)), dev.size)
+
+	// uncompressed images are installed as they are
+	dev = new(fImageDevice)
+	_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4",
+		[]byte(compressedImage), ""), "vexpress-qemu", nil, "", dev, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, compressedImage, dev.installed.String())
+
+	// the decompressed image does not match
+	dev = new(fImageDevice)
+	_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4.gz",
+		gzipped(t, compressedImage+"!"), meta), "vexpress-qemu", nil, "", dev, true, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected")
+
+	// the result can not be verified without checksum
+	_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4.gz",
+		gzipped(t, compressedImage), ""), "vexpress-qemu", nil, "", new(fImageDevice), true, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing a valid image size and checksum")
+
+	// corrupt compressed data
+	_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4.gz",
+		[]byte("not gzip"), meta), "vexpress-qemu", nil, "", new(fImageDevice), true, nil)
+	assert.Error(t, err)
+}
+
+func TestInstallCompressedXz(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not available")
+	}
+	meta := compressedMeta(compressedImage)
+
+	for _, format := range []string{"xz", "lzma"} {
+		cmd := exec.Command("xz", "--format="+format, "-c")
+		cmd.Stdin = bytes.NewBufferString(compressedImage)
+		data, err := cmd.Output()
+		require.NoError(t, err)
+
+		dev := new(fImageDevice)
+		_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4."+format,
+			data, meta), "vexpress-qemu", nil, "", dev, true, nil)
+		assert.NoError(t, err, format)
+		assert.Equal(t, compressedImage, dev.installed.String(), format)
+
+		// corrupt compressed data
+		_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4."+format,
+			data[:len(data)/2], meta), "vexpress-qemu", nil, "", new(fImageDevice), true, nil)
+		assert.Error(t, err, format)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// DeltaUpdateType is the payload type of binary diffs, in bsdiff format,
+// between the running root file system and the updated one.
+const DeltaUpdateType = "rootfs-image-delta"
+
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// DeltaBase is implemented by devices able to install delta updates.
+type DeltaBase interface {
+	// OpenActiveRootfs opens the root file system the device is running
+	// from, which is the base the deltas are applied to, and returns its
+	// size.
+	OpenActiveRootfs() (ReadAtCloser, int64, error)
+}
+
+// deltaMetaData is read from the meta-data of delta payloads.
+type deltaMetaData struct {
+	// hex encoded SHA256 of the reconstructed image
+	ImageChecksum string `json:"image_checksum"`
+}
+
+// DeltaInstaller reconstructs the updated root file system from the running
+// one and a delta, writing it to the inactive partition like a full image.
+type DeltaInstaller struct {
+	*handlers.Generic
+	device  UInstaller
+	base    DeltaBase
+	workDir string
+	meta    deltaMetaData
+	// set once the image has been reconstructed
+	installed bool
+}
+
+func NewDeltaInstaller(device UInstaller, base DeltaBase, workDir string) *DeltaInstaller {
+	return &DeltaInstaller{
+		Generic: handlers.NewGeneric(DeltaUpdateType),
+		device:  device,
+		base:    base,
+		workDir: workDir,
+	}
+}
+
+func (d *DeltaInstaller) Copy() handlers.Installer {
+	return NewDeltaInstaller(d.device, d.base, d.workDir)
+}
+
+func (d *DeltaInstaller) ReadHeader(r io.Reader, path string) error {
+	if filepath.Base(path) != "meta-data" {
+		return d.Generic.ReadHeader(r, path)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to read delta meta-data")
+	}
+	// meta-data is part of all the payloads, but may be empty
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, &d.meta); err != nil {
+		return errors.Wrapf(err, "installer: invalid delta meta-data")
+	}
+	return nil
+}
+
+// Install applies the delta to the running root file system. The delta needs
+// random access, hence it is stored in a temporary file first.
+func (d *DeltaInstaller) Install(r io.Reader, info *os.FileInfo) error {
+	if d.installed {
+		return errors.New("installer: delta update must consist of a single file")
+	}
+
+	sum, err := hex.DecodeString(d.meta.ImageChecksum)
+	if err != nil || len(sum) != sha256.Size {
+		return errors.New("installer: delta update is missing a valid image checksum")
+	}
+
+	if d.workDir != "" {
+		if err := os.MkdirAll(d.workDir, 0700); err != nil {
+			return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+				"installer: failed to create delta work directory"))
+		}
+	}
+	f, err := ioutil.TempFile(d.workDir, "delta")
+	if err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to store delta"))
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to store delta"))
+	}
+
+	patch, err := utils.NewPatch(f, size)
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to read delta")
+	}
+
+	base, baseSize, err := d.base.OpenActiveRootfs()
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to open base of the delta")
+	}
+	defer base.Close()
+
+	log.Infof("installer: applying delta of size %v to reconstruct image of size %v",
+		size, patch.NewSize)
+
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+	applied := make(chan error, 1)
+	go func() {
+		err := patch.Apply(base, baseSize, io.MultiWriter(pw, hash))
+		pw.CloseWithError(err)
+		applied <- err
+	}()
+
+	err = d.device.InstallUpdate(pr, patch.NewSize)
+	// make sure patching terminates if installing failed
+	pr.CloseWithError(io.ErrClosedPipe)
+	aerr := <-applied
+	if err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to install reconstructed image"))
+	}
+	if aerr != nil {
+		return errors.Wrapf(aerr, "installer: failed to apply delta")
+	}
+
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return errors.Errorf("installer: checksum of reconstructed image %x does "+
+			"not match expected %x", hash.Sum(nil), sum)
+	}
+
+	d.installed = true
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	deltaBase   = "hello mender world, this is the old image"
+	deltaTarget = "hello MENDER world, this is the new image!!"
+	// bsdiff patch from deltaBase to deltaTarget
+	deltaPatch = "4253444946463430320000000000000051000000000000002b00000000000000425a68393141592653591fa061e400000ae0405c040804400020002188d3210c08d6e320e20a65be2ee48a70a1203f40c3c8425a683931415926535949e891890000004e19f6c400022000088000040016400010e2a000314006234d3468534000d36a1a113535b348cc852b2193c00a9e369c043be5e697e2ee48a70a12093d123120425a6839314159265359a11fd63600000011804000000080802000219819816177245385090a11fd6360"
+)
+
+// deltaUpdate composes a delta payload with the given meta-data
+type deltaUpdate struct {
+	*handlers.Rootfs
+	file string
+	meta string
+}
+
+func (d *deltaUpdate) GetType() string {
+	return DeltaUpdateType
+}
+
+func (d *deltaUpdate) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+	sw := artifact.NewTarWriterStream(tw)
+	files := &artifact.Files{FileList: []string{filepath.Base(d.file)}}
+	if err := sw.Write(artifact.ToStream(files), filepath.Join(path, "files")); err != nil {
+		return err
+	}
+	tinfo := &artifact.TypeInfo{Type: DeltaUpdateType}
+	if err := sw.Write(artifact.ToStream(tinfo), filepath.Join(path, "type-info")); err != nil {
+		return err
+	}
+	return sw.Write([]byte(d.meta), filepath.Join(path, "meta-data"))
+}
+
+func makeDeltaArtifact(t *testing.T, meta string) io.ReadCloser {
+	patch, err := hex.DecodeString(deltaPatch)
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "delta")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Write(patch)
+	f.Close()
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{
+		&deltaUpdate{handlers.NewRootfsV2(f.Name()), f.Name(), meta},
+	}}
+	require.NoError(t, aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", updates, &artifact.Scripts{}))
+	return &rc{art}
+}
+
+type fDeltaDevice struct {
+	base      string
+	installed bytes.Buffer
+}
+
+func (d *fDeltaDevice) InstallUpdate(r io.ReadCloser, l int64) error {
+	_, err := io.Copy(&d.installed, r)
+	return err
+}
+
+func (d *fDeltaDevice) EnableUpdatedPartition() error { return nil }
+
+func (d *fDeltaDevice) OpenActiveRootfs() (ReadAtCloser, int64, error) {
+	return &rcAt{bytes.NewReader([]byte(d.base))}, int64(len(d.base)), nil
+}
+
+type rcAt struct {
+	*bytes.Reader
+}
+
+func (r *rcAt) Close() error {
+	return nil
+}
+
+func TestInstallDelta(t *testing.T) {
+	sum := sha256.Sum256([]byte(deltaTarget))
+	meta := `{"image_checksum": "` + hex.EncodeToString(sum[:]) + `"}`
+
+	dev := &fDeltaDevice{base: deltaBase}
+	rootfs, err := InstallWithModules(makeDeltaArtifact(t, meta),
+		"vexpress-qemu", nil, "", dev, true, nil)
+	assert.NoError(t, err)
+	assert.True(t, rootfs)
+	assert.Equal(t, deltaTarget, dev.installed.String())
+
+	// delta applied to a different base yields a different image
+	dev = &fDeltaDevice{base: "hello mender world, this is another image"}
+	_, err = InstallWithModules(makeDeltaArtifact(t, meta),
+		"vexpress-qemu", nil, "", dev, true, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match expected")
+
+	// the result can not be verified without checksum
+	dev = &fDeltaDevice{base: deltaBase}
+	_, err = InstallWithModules(makeDeltaArtifact(t, ""),
+		"vexpress-qemu", nil, "", dev, true, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing a valid image checksum")
+
+	// device not supporting deltas
+	_, err = InstallWithModules(makeDeltaArtifact(t, meta),
+		"vexpress-qemu", nil, "", new(fDevice), true, nil)
+	assert.Error(t, err)
+}
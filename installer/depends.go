@@ -0,0 +1,160 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Keys of what artifacts provide.
+const (
+	ProvidesArtifactName   = "artifact_name"
+	ProvidesArtifactGroup  = "artifact_group"
+	ProvidesRootfsChecksum = "rootfs-image.checksum"
+)
+
+// Provides holds what an artifact provides, by key.
+type Provides map[string]string
+
+// Depends holds the values of what the installed artifact provides which an
+// artifact can be installed on top of, by key.
+type Depends map[string][]string
+
+// DependsError is returned if the installed artifact does not satisfy the
+// depends of the artifact being installed.
+type DependsError struct {
+	Key string
+	// what the installed artifact provides, empty if nothing
+	Installed string
+	Accepted  []string
+}
+
+// ErrorKind classifies depends errors as artifact errors: retrying does not
+// change what the installed artifact provides.
+func (e *DependsError) ErrorKind() utils.ErrorKind {
+	return utils.ErrorKindArtifact
+}
+
+func (e *DependsError) Error() string {
+	if e.Installed == "" {
+		return fmt.Sprintf("installer: artifact depends on %s %v, which the "+
+			"installed artifact does not provide", e.Key, e.Accepted)
+	}
+	return fmt.Sprintf("installer: artifact depends on %s %v, but the "+
+		"installed artifact provides %s %q", e.Key, e.Accepted, e.Key, e.Installed)
+}
+
+// Check returns a DependsError if what is provided does not satisfy d.
+func (d Depends) Check(p Provides) error {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		accepted := d[key]
+		installed, ok := p[key]
+		satisfied := false
+		for _, value := range accepted {
+			if ok && value == installed {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return &DependsError{Key: key, Installed: installed, Accepted: accepted}
+		}
+	}
+	return nil
+}
+
+// IsDependsError tells if the installation failed because the depends of the
+// artifact were not satisfied.
+func IsDependsError(err error) bool {
+	_, ok := errors.Cause(err).(*DependsError)
+	return ok
+}
+
+// Dependencies are checked while installing artifacts with
+// InstallWithDependencies.
+type Dependencies struct {
+	// what the installed artifact provides
+	Installed Provides
+	// what the device provides once the artifact is installed; collected
+	// while installing it
+	Provides Provides
+}
+
+// dependsMetaData is read from the meta-data of all the payloads.
+type dependsMetaData struct {
+	Depends  Depends  `json:"artifact_depends"`
+	Provides Provides `json:"artifact_provides"`
+}
+
+// dependsHandler checks the depends of the payload before the handler gets to
+// install it.
+type dependsHandler struct {
+	handlers.Installer
+	deps *Dependencies
+}
+
+func (h *dependsHandler) Copy() handlers.Installer {
+	return &dependsHandler{
+		Installer: h.Installer.Copy(),
+		deps:      h.deps,
+	}
+}
+
+func (h *dependsHandler) ReadHeader(r io.Reader, path string) error {
+	if filepath.Base(path) != "meta-data" {
+		return h.Installer.ReadHeader(r, path)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "installer: failed to read meta-data")
+	}
+	if len(data) > 0 {
+		var meta dependsMetaData
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return errors.Wrapf(err, "installer: invalid meta-data")
+		}
+		if err := meta.Depends.Check(h.deps.Installed); err != nil {
+			return err
+		}
+		for key, value := range meta.Provides {
+			h.deps.Provides[key] = value
+		}
+	}
+	return h.Installer.ReadHeader(bytes.NewReader(data), path)
+}
+
+// unwrapHandler returns the handler installing the payload.
+func unwrapHandler(h handlers.Installer) handlers.Installer {
+	if dh, ok := h.(*dependsHandler); ok {
+		return dh.Installer
+	}
+	return h
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependsCheck(t *testing.T) {
+	installed := Provides{
+		ProvidesArtifactName:  "release-1",
+		ProvidesArtifactGroup: "prod",
+	}
+
+	assert.NoError(t, Depends(nil).Check(installed))
+	assert.NoError(t, Depends{
+		ProvidesArtifactName:  {"release-0", "release-1"},
+		ProvidesArtifactGroup: {"prod"},
+	}.Check(installed))
+
+	err := Depends{ProvidesArtifactName: {"release-2"}}.Check(installed)
+	assert.Equal(t, &DependsError{
+		Key:       ProvidesArtifactName,
+		Installed: "release-1",
+		Accepted:  []string{"release-2"},
+	}, err)
+	assert.EqualError(t, err, `installer: artifact depends on artifact_name `+
+		`[release-2], but the installed artifact provides artifact_name "release-1"`)
+	assert.True(t, IsDependsError(errors.Wrap(err, "install failed")))
+
+	err = Depends{ProvidesRootfsChecksum: {"abc"}}.Check(installed)
+	assert.EqualError(t, err, "installer: artifact depends on "+
+		"rootfs-image.checksum [abc], which the installed artifact does not provide")
+
+	assert.False(t, IsDependsError(errors.New("install failed")))
+}
+
+func TestInstallWithDependencies(t *testing.T) {
+	meta := `{"artifact_depends": {"artifact_name": ["release-1"]},
+		"artifact_provides": {"artifact_group": "beta"}}`
+
+	deps := &Dependencies{Installed: Provides{
+		ProvidesArtifactName:  "release-1",
+		ProvidesArtifactGroup: "prod",
+		"app.version":         "2",
+	}}
+	dev := new(fImageDevice)
+	rootfs, err := InstallWithDependencies(makeCompressedArtifact(t, "image.ext4",
+		[]byte(compressedImage), meta), "vexpress-qemu", nil, "", dev, true, nil, deps)
+	require.NoError(t, err)
+	assert.True(t, rootfs)
+	assert.Equal(t, compressedImage, dev.installed.String())
+	sum := sha256.Sum256([]byte(compressedImage))
+	assert.Equal(t, Provides{
+		ProvidesArtifactName:   "mender-1.1",
+		ProvidesArtifactGroup:  "beta",
+		ProvidesRootfsChecksum: hex.EncodeToString(sum[:]),
+		"app.version":          "2",
+	}, deps.Provides)
+
+	// nothing is installed if the depends are not satisfied
+	deps = &Dependencies{Installed: Provides{ProvidesArtifactName: "release-0"}}
+	dev = new(fImageDevice)
+	_, err = InstallWithDependencies(makeCompressedArtifact(t, "image.ext4",
+		[]byte(compressedImage), meta), "vexpress-qemu", nil, "", dev, true, nil, deps)
+	assert.True(t, IsDependsError(err))
+	assert.Contains(t, err.Error(), `provides artifact_name "release-0"`)
+	assert.Equal(t, 0, dev.installed.Len())
+
+	// the depends are not checked without dependencies
+	_, err = InstallWithModules(makeCompressedArtifact(t, "image.ext4",
+		[]byte(compressedImage), meta), "vexpress-qemu", nil, "", new(fImageDevice),
+		true, nil)
+	assert.NoError(t, err)
+}
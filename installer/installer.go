@@ -24,6 +24,7 @@ import (
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/mendersoftware/mender/statescript"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -35,17 +36,108 @@ type UInstaller interface {
 func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 	device UInstaller, acceptStateScripts bool) error {
 
-	rootfs := handlers.NewRootfsInstaller()
+	_, err := InstallWithModules(art, dt, key, scrDir, device,
+		acceptStateScripts, nil)
+	return err
+}
+
+// InstallWithModules installs the artifact like Install, additionally passing
+// payloads of types other than rootfs-image to the matching update modules.
+// Module payloads are installed and committed right away. Delta payloads are
+// supported if device implements DeltaBase. The returned flag tells whether
+// the artifact contained a rootfs image or delta, that is whether the updated
+// partition needs to be enabled.
+func InstallWithModules(art io.ReadCloser, dt string, key []byte, scrDir string,
+	device UInstaller, acceptStateScripts bool, modules *UpdateModules) (bool, error) {
+
+	return InstallWithDependencies(art, dt, key, scrDir, device,
+		acceptStateScripts, modules, nil)
+}
+
+// InstallWithDependencies installs the artifact like InstallWithModules,
+// provided deps.Installed satisfies the depends of all of its payloads. What
+// the device provides with the artifact installed is returned in
+// deps.Provides. The depends are not checked if deps is nil.
+func InstallWithDependencies(art io.ReadCloser, dt string, key []byte,
+	scrDir string, device UInstaller, acceptStateScripts bool,
+	modules *UpdateModules, deps *Dependencies) (bool, error) {
+
+	payloads, err := install(art, dt, key, scrDir, device,
+		acceptStateScripts, modules, deps, false, false)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range payloads {
+		if p.Module == "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InstallPayloads stores the artifact for installing it later: the rootfs
+// image or delta is written to the inactive partition and the module payloads
+// are handed to their update modules, which do not install them yet.
+// Payloads.Install installs the module payloads, and Payloads.Commit commits
+// all of them together, once the device runs the updated rootfs if any, or
+// Payloads.Rollback rolls them back together. It returns the status of each
+// payload, also if storing one of them failed.
+func InstallPayloads(art io.ReadCloser, dt string, key []byte,
+	scrDir string, device UInstaller, acceptStateScripts bool,
+	modules *UpdateModules, deps *Dependencies) (Payloads, error) {
+
+	return install(art, dt, key, scrDir, device, acceptStateScripts,
+		modules, deps, true, false)
+}
+
+// VerifyArtifact reads the artifact like InstallPayloads, verifying its
+// signature, the checksums of the payloads, device type compatibility and,
+// unless deps is nil, its depends, without installing anything: images are
+// read and discarded, deltas are applied for verification only and the update
+// modules are not called, nor are the state scripts stored. device is only
+// read from, as the base of deltas. It returns the payloads which would be
+// installed.
+func VerifyArtifact(art io.ReadCloser, dt string, key []byte,
+	device UInstaller, acceptStateScripts bool, modules *UpdateModules,
+	deps *Dependencies) (Payloads, error) {
+
+	return install(art, dt, key, "", device, acceptStateScripts,
+		modules, deps, false, true)
+}
+
+// discardInstaller takes the place of the device when verifying artifacts.
+type discardInstaller struct{}
+
+func (discardInstaller) InstallUpdate(r io.ReadCloser, size int64) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err == nil && size > 0 && n != size {
+		return errors.Errorf("installer: read %d bytes of image of size %d", n, size)
+	}
+	return err
+}
+
+func (discardInstaller) EnableUpdatedPartition() error {
+	return nil
+}
 
-	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
-		log.Debugf("installing update %v of size %v", df.Name, df.Size)
-		err := device.InstallUpdate(ioutil.NopCloser(r), df.Size)
+func install(art io.ReadCloser, dt string, key []byte,
+	scrDir string, device UInstaller, acceptStateScripts bool,
+	modules *UpdateModules, deps *Dependencies, deferCommit, verify bool) (Payloads, error) {
+
+	target := device
+	if verify {
+		target = discardInstaller{}
+	}
+
+	rootfs := NewRootfsInstaller(func(r io.Reader, size int64) error {
+		log.Debugf("installing update of size %v", size)
+		err := target.InstallUpdate(ioutil.NopCloser(r), size)
 		if err != nil {
 			log.Errorf("update image installation failed: %v", err)
-			return err
+			return utils.WithErrorKind(utils.ErrorKindStorage, err)
 		}
 		return nil
-	}
+	})
 
 	var ar *areader.Reader
 	// if there is a verification key artifact must be signed
@@ -55,8 +147,51 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 		ar = areader.NewReader(art)
 	}
 
-	if err := ar.RegisterHandler(rootfs); err != nil {
-		return errors.Wrap(err, "failed to register install handler")
+	register := ar.RegisterHandler
+	if deps != nil {
+		deps.Provides = make(Provides)
+		for key, value := range deps.Installed {
+			deps.Provides[key] = value
+		}
+		register = func(h handlers.Installer) error {
+			return ar.RegisterHandler(&dependsHandler{Installer: h, deps: deps})
+		}
+	}
+
+	if err := register(rootfs); err != nil {
+		return nil, errors.Wrap(err, "failed to register install handler")
+	}
+
+	// delta updates are applied to the running root file system
+	if base, ok := device.(DeltaBase); ok {
+		var workDir string
+		if modules != nil {
+			workDir = modules.WorkDir
+		}
+		if err := register(NewDeltaInstaller(target, base,
+			workDir)); err != nil {
+			return nil, errors.Wrap(err, "failed to register delta install handler")
+		}
+	}
+
+	if modules != nil {
+		available, err := listModules(modules.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for updateType, module := range available {
+			if updateType == rootfs.GetType() || updateType == DeltaUpdateType {
+				continue
+			}
+			m := NewModuleInstaller(updateType, module, modules.WorkDir)
+			m.verify = verify
+			m.env = modules.Env
+			m.timeout = modules.Timeout
+			if err := register(m); err != nil {
+				return nil, errors.Wrapf(err,
+					"failed to register update module %s", module)
+			}
+		}
 	}
 
 	ar.CompatibleDevicesCallback = func(devices []string) error {
@@ -71,8 +206,9 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 				return nil
 			}
 		}
-		return errors.Errorf("installer: image (device types %v) not compatible with device %v",
-			devices, dt)
+		return utils.WithErrorKind(utils.ErrorKindArtifact, errors.Errorf(
+			"installer: image (device types %v) not compatible with device %v",
+			devices, dt))
 	}
 
 	// VerifySignatureCallback needs to be registered both for
@@ -90,42 +226,140 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 
 		// Do the verification only if the key is provided.
 		s := artifact.NewVerifier(key)
-		return s.Verify(message, sig)
+		return utils.WithErrorKind(utils.ErrorKindArtifact, s.Verify(message, sig))
 	}
 
 	scr := statescript.NewStore(scrDir)
-	// we need to wipe out the scripts directory first
-	if err := scr.Clear(); err != nil {
-		log.Errorf("installer: error initializing directory for scripts [%s]: %v",
-			scrDir, err)
-		return errors.Wrap(err, "installer: error initializing directory for scripts")
+	// we need to wipe out the scripts directory first; the scripts of the
+	// installed artifact are kept when verifying
+	if !verify {
+		if err := scr.Clear(); err != nil {
+			log.Errorf("installer: error initializing directory for scripts [%s]: %v",
+				scrDir, err)
+			return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrap(err,
+				"installer: error initializing directory for scripts"))
+		}
 	}
 
 	if acceptStateScripts {
 		// All the scripts that are part of the artifact will be processed here.
 		ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
 			log.Debugf("installer: processing script: %s", fi.Name())
+			if verify {
+				_, err := io.Copy(ioutil.Discard, r)
+				return err
+			}
 			return scr.StoreScript(r, fi.Name())
 		}
 	} else {
 		ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
 			errMsg := "will not install artifact with state-scripts when installing from cmd-line. Use -f to override"
-			return errors.New(errMsg)
+			return utils.WithErrorKind(utils.ErrorKindArtifact, errors.New(errMsg))
 		}
 	}
 
 	// read the artifact
-	if err := ar.ReadArtifact(); err != nil {
-		return errors.Wrap(err, "installer: failed to read and install update")
+	rerr := ar.ReadArtifact()
+	// the update modules are done with the payload files streamed to them
+	for i := 0; i < len(ar.GetHandlers()); i++ {
+		if inst, ok := unwrapHandler(ar.GetHandlers()[i]).(*ModuleInstaller); ok {
+			if err := inst.finishDownload(rerr != nil); err != nil && rerr == nil {
+				rerr = err
+			}
+		}
+	}
+
+	var payloads Payloads
+	// the update modules have nothing to clean up after a verification
+	cleanup := func() {
+		if !verify {
+			payloads.cleanup()
+		}
+	}
+	var unsupported []string
+	var rootfsChecksum string
+	var rootfsPayloads int
+	for i := 0; i < len(ar.GetHandlers()); i++ {
+		h := unwrapHandler(ar.GetHandlers()[i])
+		p := PayloadStatus{Index: i, Type: h.GetType(), Status: PayloadInstalled}
+		switch inst := h.(type) {
+		case *ModuleInstaller:
+			p.Status = PayloadDownloaded
+			p.Module, p.WorkDir = inst.module, inst.workDir
+			p.modules = modules
+			if verify {
+				p.WorkDir = ""
+			}
+		case *RootfsInstaller:
+			rootfsPayloads++
+			if inst.installedChecksum != "" {
+				rootfsChecksum = inst.installedChecksum
+			}
+		case *DeltaInstaller:
+			rootfsPayloads++
+			if inst.installed {
+				rootfsChecksum = inst.meta.ImageChecksum
+			}
+		case *handlers.Generic:
+			unsupported = append(unsupported, inst.GetType())
+		}
+		payloads = append(payloads, p)
 	}
 
-	if err := scr.Finalize(ar.GetInfo().Version); err != nil {
-		return errors.Wrap(err, "installer: error finalizing writing scripts")
+	if rerr != nil {
+		cleanup()
+		// unless failing to download or to write it, the artifact is
+		// broken
+		return nil, utils.WithErrorKind(utils.ErrorKindArtifact, errors.Wrap(rerr,
+			"installer: failed to read and install update"))
+	}
+
+	// payloads nobody can install must not be ignored, the update would
+	// be reported as successful otherwise
+	if len(unsupported) > 0 {
+		cleanup()
+		return nil, utils.WithErrorKind(utils.ErrorKindArtifact, errors.Errorf(
+			"installer: no update module for payload types %v", unsupported))
+	}
+
+	// all of them would be written to the same partition
+	if rootfsPayloads > 1 {
+		cleanup()
+		return nil, utils.WithErrorKind(utils.ErrorKindArtifact, errors.New(
+			"installer: artifact contains more than one rootfs image or delta"))
+	}
+
+	if verify {
+		for i := range payloads {
+			payloads[i].Status = PayloadVerified
+		}
+	} else {
+		if err := scr.Finalize(ar.GetInfo().Version); err != nil {
+			payloads.cleanup()
+			return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrap(err,
+				"installer: error finalizing writing scripts"))
+		}
+
+		if !deferCommit {
+			if err := payloads.Install(); err != nil {
+				return payloads, err
+			}
+			if err := payloads.Commit(); err != nil {
+				return payloads, err
+			}
+		}
+	}
+
+	if deps != nil {
+		deps.Provides[ProvidesArtifactName] = ar.GetArtifactName()
+		if rootfsChecksum != "" {
+			deps.Provides[ProvidesRootfsChecksum] = rootfsChecksum
+		}
 	}
 
 	log.Debugf(
 		"installer: successfully read artifact [name: %v; version: %v; compatible devices: %v]",
 		ar.GetArtifactName(), ar.GetInfo().Version, ar.GetCompatibleDevices())
 
-	return nil
+	return payloads, nil
 }
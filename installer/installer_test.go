@@ -18,12 +18,15 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
@@ -38,6 +41,7 @@ func TestInstall(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, errors.Cause(err).Error(),
 		"not compatible with device fake-device")
+	assert.Equal(t, utils.ErrorKindArtifact, utils.ErrorKindOf(err))
 
 	art, err = MakeRootfsImageArtifact(1, false, false)
 	assert.NoError(t, err)
@@ -108,6 +112,48 @@ func TestInstallWithScripts(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestInstallErrorKinds(t *testing.T) {
+	// failing to write the image
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", nil, "", failingDevice{
+		&os.PathError{Op: "write", Path: "/dev/mmcblk0p3", Err: syscall.EIO}}, true)
+	assert.Error(t, err)
+	assert.Equal(t, utils.ErrorKindStorage, utils.ErrorKindOf(err))
+
+	// or to download it
+	art, err = MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", nil, "", failingDevice{
+		&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, true)
+	assert.Error(t, err)
+	assert.Equal(t, utils.ErrorKindNetwork, utils.ErrorKindOf(err))
+
+	// unsigned artifacts are rejected if there is a key
+	art, err = MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", []byte(PublicRSAKey), "", new(fDevice), true)
+	assert.Error(t, err)
+	assert.Equal(t, utils.ErrorKindArtifact, utils.ErrorKindOf(err))
+
+	// state scripts when not accepted
+	art, err = MakeRootfsImageArtifact(2, false, true)
+	assert.NoError(t, err)
+	err = Install(art, "vexpress-qemu", nil, "", new(fDevice), false)
+	assert.Error(t, err)
+	assert.Equal(t, utils.ErrorKindArtifact, utils.ErrorKindOf(err))
+}
+
+type failingDevice struct {
+	err error
+}
+
+func (d failingDevice) InstallUpdate(r io.ReadCloser, l int64) error {
+	return d.err
+}
+
+func (d failingDevice) EnableUpdatedPartition() error { return nil }
+
 type fDevice struct{}
 
 func (d *fDevice) InstallUpdate(r io.ReadCloser, l int64) error {
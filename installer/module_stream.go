@@ -0,0 +1,229 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Named pipes in the work directory of update modules called with Download,
+// as in the update module protocol of the Mender client: reading
+// stream-next gives the path of the next payload file, e.g.
+// "streams/rootfs.ext4", relative to the work directory, or nothing once all
+// of them have been read. The payload files are read from their pipes in
+// streams/ as they are downloaded, so that they need neither be stored nor
+// read twice; their checksums are verified on the way, and the module is
+// only called with ArtifactInstall if all of them match. Modules exiting
+// from Download without reading stream-next find the payload files stored
+// in files/ instead, whatever their exit status.
+const (
+	streamNextName = "stream-next"
+	streamsDir     = "streams"
+)
+
+// moduleDownload is an update module called with Download, streaming the
+// payload files to it.
+type moduleDownload struct {
+	call    *moduleCall
+	workDir string
+	// closed once the module has exited, with err
+	exited chan struct{}
+	err    error
+	// payload files streamed so far
+	streamed int
+	// the module did not read the streams
+	stored bool
+	// the module opened stream-next
+	readNext bool
+}
+
+func (m *ModuleInstaller) startDownload() (*moduleDownload, error) {
+	if err := os.MkdirAll(filepath.Join(m.workDir, streamsDir), 0700); err != nil {
+		return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to create module work directory"))
+	}
+	if err := syscall.Mkfifo(filepath.Join(m.workDir, streamNextName), 0600); err != nil {
+		return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to create %s", streamNextName))
+	}
+	c, err := m.start(ModuleDownload)
+	if err != nil {
+		return nil, err
+	}
+	d := &moduleDownload{call: c, workDir: m.workDir, exited: make(chan struct{})}
+	go func() {
+		d.err = c.wait()
+		close(d.exited)
+	}()
+	return d, nil
+}
+
+// stream passes a payload file on to the module, telling whether it did;
+// payload files are not streamed once the module turned out not to read
+// the streams.
+func (d *moduleDownload) stream(r io.Reader, name string) (bool, error) {
+	if d.stored {
+		return false, nil
+	}
+	stream := filepath.Join(streamsDir, name)
+	path := filepath.Join(d.workDir, stream)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return false, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to create stream of payload file %s", name))
+	}
+
+	next, err := d.openPipe(filepath.Join(d.workDir, streamNextName))
+	if err != nil {
+		return false, err
+	}
+	if next == nil {
+		if d.streamed > 0 {
+			return true, d.exitedBefore(name)
+		}
+		if d.err != nil {
+			log.Debugf("installer: update module %s did not read streams: %v",
+				d.call.m.module, d.err)
+		}
+		log.Infof("installer: update module %s does not read streams, storing "+
+			"the payload files", d.call.m.module)
+		d.stored = true
+		d.removePipes()
+		return false, nil
+	}
+	d.readNext = true
+	_, err = next.Write([]byte(stream + "\n"))
+	next.Close()
+	if err != nil {
+		return true, errors.Wrapf(err, "installer: failed to write %s", streamNextName)
+	}
+
+	f, err := d.openPipe(path)
+	if err != nil {
+		return true, err
+	}
+	if f == nil {
+		return true, d.exitedBefore(name)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return true, errors.Wrapf(err, "installer: failed to stream payload file %s "+
+			"to update module %s", name, d.call.m.module)
+	}
+	d.streamed++
+	return true, f.Close()
+}
+
+// exitedBefore is the error of the module exiting before reading the payload
+// file name.
+func (d *moduleDownload) exitedBefore(name string) error {
+	if d.err != nil {
+		return errors.Wrapf(d.err, "installer: update module %s exited "+
+			"before reading payload file %s", d.call.m.module, name)
+	}
+	return errors.Errorf("installer: update module %s exited before "+
+		"reading payload file %s", d.call.m.module, name)
+}
+
+// openPipe opens a named pipe for writing, once the module opens it for
+// reading; it returns nil if the module exits first.
+func (d *moduleDownload) openPipe(path string) (*os.File, error) {
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		opened <- result{f, err}
+	}()
+
+	select {
+	case res := <-opened:
+		if res.err != nil {
+			return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(
+				res.err, "installer: failed to open %s", path))
+		}
+		return res.f, nil
+	case <-d.exited:
+	}
+	// nobody is going to read; opening the pipe for reading unblocks the
+	// opening for writing
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		// the opening for writing can not be unblocked, and is left behind
+		return nil, utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(
+			err, "installer: failed to open %s", path))
+	}
+	defer r.Close()
+	if res := <-opened; res.f != nil {
+		res.f.Close()
+	}
+	return nil, nil
+}
+
+func (d *moduleDownload) removePipes() {
+	if err := os.RemoveAll(filepath.Join(d.workDir, streamsDir)); err != nil {
+		log.Warnf("installer: failed to remove payload streams: %v", err)
+	}
+	if err := os.Remove(filepath.Join(d.workDir, streamNextName)); err != nil {
+		log.Warnf("installer: failed to remove %s: %v", streamNextName, err)
+	}
+}
+
+// finishDownload tells the module that all the payload files have been
+// streamed and waits for it to exit from Download; if reading the artifact
+// failed, the module is killed instead.
+func (m *ModuleInstaller) finishDownload(failed bool) error {
+	d := m.download
+	if d == nil {
+		return nil
+	}
+	m.download = nil
+
+	var err error
+	if failed {
+		select {
+		case <-d.exited:
+		default:
+			d.call.kill()
+			<-d.exited
+		}
+	} else {
+		if !d.stored {
+			// reading stream-next gives nothing then
+			var next *os.File
+			next, err = d.openPipe(filepath.Join(d.workDir, streamNextName))
+			if next != nil {
+				d.readNext = true
+				next.Close()
+			}
+		}
+		<-d.exited
+		// the exit status of modules not reading the streams is ignored
+		if err == nil && d.readNext {
+			err = d.err
+		}
+	}
+	if !d.stored {
+		d.removePipes()
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReader returns data, then fails like a payload file not matching
+// its checksum.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("checksum mismatch")
+	}
+	return n, err
+}
+
+func TestModuleStreams(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "streams")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	modules := &UpdateModules{
+		Dir:     filepath.Join(tmp, "modules"),
+		WorkDir: filepath.Join(tmp, "work"),
+	}
+	require.NoError(t, os.MkdirAll(modules.Dir, 0755))
+	calls := filepath.Join(tmp, "calls")
+	streamed := filepath.Join(tmp, "streamed")
+	readFile := func(name string) string {
+		data, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		os.Remove(name)
+		return string(data)
+	}
+
+	// module reading the payload files from their streams, recording what
+	// is left in its work directory to install from
+	module := filepath.Join(modules.Dir, "app")
+	require.NoError(t, ioutil.WriteFile(module, []byte(`#!/bin/sh
+echo $1 >> `+calls+`
+case $1 in
+Download)
+	while true; do
+		f=$(cat $2/stream-next)
+		[ -z "$f" ] && break
+		echo $f >> `+streamed+`
+		cat $2/$f >> `+streamed+`
+	done
+	;;
+ArtifactInstall)
+	ls $2 >> `+calls+`
+	;;
+esac
+`), 0755))
+
+	payloads, err := InstallPayloads(makeMultiPayloadArtifact(t, "app"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app downloaded"}, payloadStates(payloads))
+	require.NoError(t, payloads.Install())
+	require.NoError(t, payloads.Commit())
+	assert.Equal(t, []string{"app committed"}, payloadStates(payloads))
+	// nothing stored in the work directory
+	assert.Equal(t, "Download\nArtifactInstall\nArtifactCommit\nCleanup\n", readFile(calls))
+	assert.Regexp(t, "^streams/test_update[0-9]+\npayload$", readFile(streamed))
+
+	// modules failing in Download do not get to install anything
+	require.NoError(t, ioutil.WriteFile(module, []byte("#!/bin/sh\necho $1 >> "+calls+
+		"\nif [ \"$1\" = Download ]; then cat $2/stream-next > /dev/null; exit 1; fi\n"),
+		0755))
+	_, err = InstallPayloads(makeMultiPayloadArtifact(t, "app"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed in Download")
+	assert.Equal(t, "Download\nCleanup\n", readFile(calls))
+
+	// the exit status of modules not reading stream-next is ignored, they
+	// install from the stored payload files
+	require.NoError(t, ioutil.WriteFile(module, []byte("#!/bin/sh\necho $1 >> "+calls+
+		"\n[ \"$1\" = ArtifactInstall ] && ls $2/files >> "+calls+
+		"\n[ \"$1\" != Download ]\n"), 0755))
+	payloads, err = InstallPayloads(makeMultiPayloadArtifact(t, "app"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	require.NoError(t, err)
+	require.NoError(t, payloads.Install())
+	require.NoError(t, payloads.Commit())
+	assert.Equal(t, []string{"app committed"}, payloadStates(payloads))
+	assert.Regexp(t, "^Download\nArtifactInstall\ntest_update[0-9]+\nArtifactCommit\nCleanup\n$",
+		readFile(calls))
+}
+
+func TestModuleStreamFailing(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "streams")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	module := filepath.Join(tmp, "app")
+	require.NoError(t, ioutil.WriteFile(module, []byte(`#!/bin/sh
+f=$(cat $2/stream-next)
+cat $2/$f > /dev/null
+sleep 30
+`), 0755))
+
+	m := NewModuleInstaller("app", module, tmp).Copy().(*ModuleInstaller)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "rootfs.ext4"), nil, 0600))
+	info, err := os.Stat(filepath.Join(tmp, "rootfs.ext4"))
+	require.NoError(t, err)
+	err = m.Install(&failingReader{strings.NewReader("payload")}, &info)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	// the module is stopped rather than waited for
+	start := time.Now()
+	assert.NoError(t, m.finishDownload(true))
+	assert.True(t, time.Since(start) < 10*time.Second)
+	_, err = os.Stat(filepath.Join(m.workDir, streamNextName))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Verbs update modules are called with, as `<module> <verb> <work-dir>`.
+const (
+	ModuleDownload         = "Download"
+	ModuleArtifactInstall  = "ArtifactInstall"
+	ModuleArtifactCommit   = "ArtifactCommit"
+	ModuleArtifactRollback = "ArtifactRollback"
+	ModuleCleanup          = "Cleanup"
+)
+
+// UpdateModules describes where update modules, the executables installing
+// payloads of types other than rootfs-image, are looked up and where the
+// payload files are stored while being installed.
+type UpdateModules struct {
+	// directory with one executable per payload type, named after the type
+	Dir string
+	// directory for the payload files; each payload gets its own
+	// subdirectory holding the files in files/
+	WorkDir string
+	// variables added to the environment of the modules, e.g. the
+	// metadata of the deployment in progress; evaluated for every call
+	Env func() []string
+	// time a call of a module may take before it is killed, failing the
+	// step; no limit if zero
+	Timeout time.Duration
+}
+
+// ModuleInstaller is an artifact handler passing the payload of a single
+// update to an update module. The payload files are streamed to the module,
+// called with Download while they are read, or stored in the work directory
+// if it does not read the streams; the module is called to install them once
+// the whole artifact has been read and verified.
+type ModuleInstaller struct {
+	*handlers.Generic
+	module  string
+	workDir string
+	// shared between copies, so that each payload gets a separate
+	// work directory
+	payloads *int
+	// the payload files are discarded when only verifying the artifact
+	verify  bool
+	env     func() []string
+	timeout time.Duration
+	// the Download call, from reading the first payload file on
+	download *moduleDownload
+}
+
+func NewModuleInstaller(updateType, module, workDir string) *ModuleInstaller {
+	return &ModuleInstaller{
+		Generic:  handlers.NewGeneric(updateType),
+		module:   module,
+		workDir:  workDir,
+		payloads: new(int),
+	}
+}
+
+func (m *ModuleInstaller) Copy() handlers.Installer {
+	dir := filepath.Join(m.workDir, fmt.Sprintf("%04d", *m.payloads))
+	*m.payloads++
+	return &ModuleInstaller{
+		Generic:  handlers.NewGeneric(m.GetType()),
+		module:   m.module,
+		workDir:  dir,
+		payloads: m.payloads,
+		verify:   m.verify,
+		env:      m.env,
+		timeout:  m.timeout,
+	}
+}
+
+func (m *ModuleInstaller) filesDir() string {
+	return filepath.Join(m.workDir, "files")
+}
+
+// Install streams a payload file to the module or, if the module does not
+// read the streams, stores it in the work directory.
+func (m *ModuleInstaller) Install(r io.Reader, info *os.FileInfo) error {
+	if m.verify {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	name := filepath.Base((*info).Name())
+	if m.download == nil {
+		d, err := m.startDownload()
+		if err != nil {
+			return err
+		}
+		m.download = d
+	}
+	if streamed, err := m.download.stream(r, name); streamed || err != nil {
+		return err
+	}
+	return m.store(r, name)
+}
+
+func (m *ModuleInstaller) store(r io.Reader, name string) error {
+	if err := os.MkdirAll(m.filesDir(), 0700); err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to create module work directory"))
+	}
+
+	f, err := os.OpenFile(filepath.Join(m.filesDir(), name),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to store payload file"))
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return utils.WithErrorKind(utils.ErrorKindStorage, errors.Wrapf(err,
+			"installer: failed to store payload file"))
+	}
+	return f.Sync()
+}
+
+// Call runs the update module with the given verb.
+func (m *ModuleInstaller) Call(verb string) error {
+	c, err := m.start(verb)
+	if err != nil {
+		return err
+	}
+	return c.wait()
+}
+
+// moduleCall is an update module started with a verb.
+type moduleCall struct {
+	m        *ModuleInstaller
+	verb     string
+	cmd      *exec.Cmd
+	out      bytes.Buffer
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (m *ModuleInstaller) start(verb string) (*moduleCall, error) {
+	log.Infof("installer: calling update module %s %s", m.module, verb)
+
+	c := &moduleCall{m: m, verb: verb}
+	c.cmd = exec.Command(m.module, verb, m.workDir)
+	if m.env != nil {
+		if env := m.env(); len(env) > 0 {
+			c.cmd.Env = append(os.Environ(), env...)
+		}
+	}
+	c.cmd.Stdout = &c.out
+	c.cmd.Stderr = &c.out
+	// the module gets a process group of its own, so that it can be killed
+	// along with its children if it hangs
+	c.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := c.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "installer: update module %s failed in %s",
+			m.module, verb)
+	}
+	if m.timeout > 0 {
+		c.timer = time.AfterFunc(m.timeout, func() {
+			atomic.StoreInt32(&c.timedOut, 1)
+			log.Errorf("installer: update module %s timed out in %s after %s, "+
+				"killing it", m.module, verb, m.timeout)
+			c.kill()
+		})
+	}
+	return c, nil
+}
+
+// kill kills the module along with its children.
+func (c *moduleCall) kill() {
+	syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// wait waits for the module to exit, returning an error unless it succeeded.
+func (c *moduleCall) wait() error {
+	err := c.cmd.Wait()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.out.Len() > 0 {
+		log.Infof("installer: output of update module %s: %s", c.m.module,
+			strings.TrimSpace(c.out.String()))
+	}
+	if atomic.LoadInt32(&c.timedOut) == 1 {
+		return errors.Errorf("installer: update module %s timed out in %s after %s",
+			c.m.module, c.verb, c.m.timeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "installer: update module %s failed in %s",
+			c.m.module, c.verb)
+	}
+	return nil
+}
+
+// Cleanup lets the module clean up after itself and removes the work
+// directory.
+func (m *ModuleInstaller) Cleanup() {
+	if err := m.Call(ModuleCleanup); err != nil {
+		log.Warn(err)
+	}
+	if err := os.RemoveAll(m.workDir); err != nil {
+		log.Warnf("installer: failed to remove module work directory: %v", err)
+	}
+}
+
+// listModules returns the update modules found in dir by payload type.
+func listModules(dir string) (map[string]string, error) {
+	finfos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "installer: failed to list update modules")
+	}
+
+	execBits := os.FileMode(syscall.S_IXUSR | syscall.S_IXGRP | syscall.S_IXOTH)
+	modules := make(map[string]string)
+	for _, finfo := range finfos {
+		if finfo.IsDir() || finfo.Mode()&execBits == 0 {
+			continue
+		}
+		modules[finfo.Name()] = filepath.Join(dir, finfo.Name())
+	}
+	return modules, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// moduleUpdate composes a payload of a custom type, reusing the rootfs
+// composer for the files and their checksums
+type moduleUpdate struct {
+	*handlers.Rootfs
+	updateType string
+}
+
+func (m *moduleUpdate) GetType() string {
+	return m.updateType
+}
+
+func makeModuleArtifact(t *testing.T, updateType string) io.ReadCloser {
+	upd, err := MakeFakeUpdate("module payload")
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{
+		&moduleUpdate{handlers.NewRootfsV2(upd), updateType},
+	}}
+	require.NoError(t, aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", updates, &artifact.Scripts{}))
+	return &rc{art}
+}
+
+func TestInstallWithModules(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "modules")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	modules := &UpdateModules{
+		Dir:     filepath.Join(tmp, "modules"),
+		WorkDir: filepath.Join(tmp, "work"),
+	}
+	require.NoError(t, os.MkdirAll(modules.Dir, 0755))
+	calls := filepath.Join(tmp, "calls")
+
+	// module recording the verbs it is called with and the payload it got
+	writeModule := func(name, script string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(modules.Dir, name),
+			[]byte("#!/bin/sh\necho $1 >> "+calls+"\n"+script), 0755))
+	}
+	writeModule("test-module", `
+if [ "$1" = ArtifactInstall ]; then
+	cat $2/files/* > `+filepath.Join(tmp, "installed")+`
+fi
+`)
+
+	// rootfs artifacts are not affected by modules
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	require.NoError(t, err)
+	rootfs, err := InstallWithModules(art, "vexpress-qemu", nil, "",
+		new(fDevice), true, modules)
+	assert.NoError(t, err)
+	assert.True(t, rootfs)
+
+	// payload is handed over to the module
+	rootfs, err = InstallWithModules(makeModuleArtifact(t, "test-module"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules)
+	assert.NoError(t, err)
+	assert.False(t, rootfs)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "installed"))
+	assert.NoError(t, err)
+	assert.Equal(t, "module payload", string(data))
+	data, err = ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	assert.Equal(t, "Download\nArtifactInstall\nArtifactCommit\nCleanup\n", string(data))
+	_, err = os.Stat(filepath.Join(modules.WorkDir, "0000"))
+	assert.True(t, os.IsNotExist(err))
+
+	// failing module is rolled back
+	os.Remove(calls)
+	writeModule("test-module", `[ "$1" != ArtifactInstall ]`)
+	_, err = InstallWithModules(makeModuleArtifact(t, "test-module"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules)
+	assert.Error(t, err)
+	data, err = ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	assert.Equal(t, "Download\nArtifactInstall\nArtifactRollback\nCleanup\n", string(data))
+
+	// payload without module must not be ignored
+	_, err = InstallWithModules(makeModuleArtifact(t, "other-module"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no update module for payload types [other-module]")
+
+	_, err = InstallWithModules(makeModuleArtifact(t, "test-module"),
+		"vexpress-qemu", nil, "", new(fDevice), true, nil)
+	assert.Error(t, err)
+}
+
+func TestModuleEnv(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "modules")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	env := "MENDER_DEPLOYMENT_ID=foo"
+	modules := &UpdateModules{
+		Dir:     filepath.Join(tmp, "modules"),
+		WorkDir: filepath.Join(tmp, "work"),
+		Env: func() []string {
+			return []string{env}
+		},
+	}
+	require.NoError(t, os.MkdirAll(modules.Dir, 0755))
+	calls := filepath.Join(tmp, "calls")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(modules.Dir, "app"),
+		[]byte("#!/bin/sh\necho $1 $MENDER_DEPLOYMENT_ID >> "+calls+"\n"), 0755))
+	readCalls := func() string {
+		data, err := ioutil.ReadFile(calls)
+		require.NoError(t, err)
+		os.Remove(calls)
+		return string(data)
+	}
+
+	payloads, err := InstallPayloads(makeMultiPayloadArtifact(t, "rootfs-image", "app"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Download foo\n", readCalls())
+
+	// payloads restored after a restart get the environment set again
+	data, err := json.Marshal(payloads)
+	require.NoError(t, err)
+	var restored Payloads
+	require.NoError(t, json.Unmarshal(data, &restored))
+	env = "MENDER_DEPLOYMENT_ID=bar"
+	restored.SetModules(modules)
+	require.NoError(t, restored.Install())
+	require.NoError(t, restored.Commit())
+	assert.Equal(t, "ArtifactInstall bar\nArtifactCommit bar\nCleanup bar\n", readCalls())
+}
+
+func TestModuleTimeout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "modules")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	module := filepath.Join(tmp, "app")
+	// the child keeps the output open
+	require.NoError(t, ioutil.WriteFile(module,
+		[]byte("#!/bin/sh\n[ \"$1\" != ArtifactInstall ] && exit 0\nsleep 30 &\nsleep 30\n"),
+		0755))
+	m := NewModuleInstaller("app", module, filepath.Join(tmp, "work"))
+	m.timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	err = m.Call(ModuleArtifactInstall)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out in ArtifactInstall")
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	assert.NoError(t, m.Call(ModuleArtifactCommit))
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+)
+
+// Status of a payload of an artifact being installed.
+const (
+	// stored in the work directory of its update module, but not yet
+	// installed by it
+	PayloadDownloaded = "downloaded"
+	PayloadInstalled  = "installed"
+	PayloadCommitted  = "committed"
+	PayloadFailed     = "failed"
+	PayloadRolledBack = "rolled-back"
+	// checked by VerifyArtifact, which installs nothing
+	PayloadVerified = "verified"
+)
+
+// PayloadStatus is the status of a single payload of an artifact.
+type PayloadStatus struct {
+	// index of the payload in the artifact
+	Index  int    `json:"index"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// update module and work directory of module payloads, needed to
+	// commit or roll back the payload after a restart
+	Module  string `json:"module,omitempty"`
+	WorkDir string `json:"work_dir,omitempty"`
+	// environment and timeout the update module is called with
+	modules *UpdateModules
+}
+
+func (p *PayloadStatus) moduleInstaller() *ModuleInstaller {
+	if p.Module == "" {
+		return nil
+	}
+	m := &ModuleInstaller{
+		Generic:  handlers.NewGeneric(p.Type),
+		module:   p.Module,
+		workDir:  p.WorkDir,
+		payloads: new(int),
+	}
+	if p.modules != nil {
+		m.env = p.modules.Env
+		m.timeout = p.modules.Timeout
+	}
+	return m
+}
+
+// Payloads are the payloads of an artifact, in the order of the artifact.
+// The payloads of an artifact are committed, or rolled back, together.
+type Payloads []PayloadStatus
+
+// SetModules sets the environment and the timeout the update modules of the
+// payloads are called with, e.g. of payloads restored after a restart.
+func (ps Payloads) SetModules(modules *UpdateModules) {
+	for i := range ps {
+		ps[i].modules = modules
+	}
+}
+
+// Rootfs tells whether a rootfs image or delta has been installed, that is
+// whether the updated partition needs to be enabled.
+func (ps Payloads) Rootfs() bool {
+	for _, p := range ps {
+		if p.Module == "" && p.Status == PayloadInstalled {
+			return true
+		}
+	}
+	return false
+}
+
+// ModulesOnly tells whether all the payloads are installed by update
+// modules, which leaves the rootfs image as it is.
+func (ps Payloads) ModulesOnly() bool {
+	for _, p := range ps {
+		if p.Module == "" {
+			return false
+		}
+	}
+	return len(ps) > 0
+}
+
+// Pending tells whether any of the payloads has been downloaded or installed,
+// but neither committed nor rolled back yet.
+func (ps Payloads) Pending() bool {
+	for _, p := range ps {
+		if p.Status == PayloadDownloaded || p.Status == PayloadInstalled {
+			return true
+		}
+	}
+	return false
+}
+
+// Install calls the update modules of the downloaded module payloads in turn
+// to install them, rolling back all the payloads if any of them fails.
+func (ps Payloads) Install() error {
+	for i := range ps {
+		p := &ps[i]
+		m := p.moduleInstaller()
+		if p.Status != PayloadDownloaded || m == nil {
+			continue
+		}
+		if err := m.Call(ModuleArtifactInstall); err != nil {
+			ps.fail(i)
+			return err
+		}
+		p.Status = PayloadInstalled
+		log.Infof("installer: payload %d of type %s installed", p.Index, p.Type)
+	}
+	return nil
+}
+
+// Commit commits the installed payloads, those of update modules by calling
+// the modules in turn, and the rootfs image once all of them succeeded. If
+// one of them fails, all the payloads not yet committed are rolled back; the
+// committed ones can not be.
+func (ps Payloads) Commit() error {
+	for _, modules := range []bool{true, false} {
+		for i := range ps {
+			p := &ps[i]
+			m := p.moduleInstaller()
+			if p.Status != PayloadInstalled || (m != nil) != modules {
+				continue
+			}
+			if m != nil {
+				if err := m.Call(ModuleArtifactCommit); err != nil {
+					ps.fail(i)
+					return err
+				}
+			}
+			p.Status = PayloadCommitted
+			log.Infof("installer: payload %d of type %s committed", p.Index, p.Type)
+		}
+	}
+	ps.cleanup()
+	return nil
+}
+
+// Rollback rolls back the payloads which have been installed, but not
+// committed, in reverse order.
+func (ps Payloads) Rollback() {
+	if !ps.Pending() {
+		return
+	}
+	ps.rollback()
+	ps.cleanup()
+}
+
+func (ps Payloads) rollback() {
+	for i := len(ps) - 1; i >= 0; i-- {
+		p := &ps[i]
+		switch p.Status {
+		case PayloadInstalled:
+			if m := p.moduleInstaller(); m != nil {
+				if err := m.Call(ModuleArtifactRollback); err != nil {
+					log.Error(err)
+				}
+			}
+		case PayloadDownloaded:
+		default:
+			continue
+		}
+		p.Status = PayloadRolledBack
+		log.Infof("installer: payload %d of type %s rolled back", p.Index, p.Type)
+	}
+}
+
+// fail rolls back the payloads once payload i failed to install or commit;
+// the failed payload is rolled back as well, as it may be partially applied.
+func (ps Payloads) fail(i int) {
+	ps[i].Status = PayloadInstalled
+	ps.rollback()
+	ps[i].Status = PayloadFailed
+	ps.cleanup()
+}
+
+// cleanup lets the update modules clean up after their payloads.
+func (ps Payloads) cleanup() {
+	for i := range ps {
+		if m := ps[i].moduleInstaller(); m != nil {
+			m.Cleanup()
+		}
+	}
+}
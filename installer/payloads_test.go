@@ -0,0 +1,234 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeMultiPayloadArtifact makes an artifact of a payload of each of the
+// given types
+func makeMultiPayloadArtifact(t *testing.T, types ...string) io.ReadCloser {
+	upd, err := MakeFakeUpdate("payload")
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	var composers []handlers.Composer
+	for _, updateType := range types {
+		if updateType == "rootfs-image" {
+			composers = append(composers, handlers.NewRootfsV2(upd))
+		} else {
+			composers = append(composers,
+				&moduleUpdate{handlers.NewRootfsV2(upd), updateType})
+		}
+	}
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	require.NoError(t, aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", &awriter.Updates{U: composers}, &artifact.Scripts{}))
+	return &rc{art}
+}
+
+// noInstallDevice fails the test if anything is installed to it.
+type noInstallDevice struct {
+	t *testing.T
+}
+
+func (d *noInstallDevice) InstallUpdate(io.ReadCloser, int64) error {
+	d.t.Error("image installed")
+	return nil
+}
+
+func (d *noInstallDevice) EnableUpdatedPartition() error {
+	d.t.Error("partition enabled")
+	return nil
+}
+
+func payloadStates(ps Payloads) []string {
+	var states []string
+	for _, p := range ps {
+		states = append(states, p.Type+" "+p.Status)
+	}
+	return states
+}
+
+func TestInstallPayloads(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "payloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	modules := &UpdateModules{
+		Dir:     filepath.Join(tmp, "modules"),
+		WorkDir: filepath.Join(tmp, "work"),
+	}
+	require.NoError(t, os.MkdirAll(modules.Dir, 0755))
+	calls := filepath.Join(tmp, "calls")
+	// modules recording the verbs they are called with, failing in the verb
+	// written to fail-<module>
+	for _, name := range []string{"app", "data"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(modules.Dir, name),
+			[]byte("#!/bin/sh\necho "+name+" $1 >> "+calls+"\n"+
+				`[ "$(cat `+filepath.Join(tmp, "fail-"+name)+` 2>/dev/null)" != "$1" ]`+"\n"),
+			0755))
+	}
+	failIn := func(module, verb string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "fail-"+module),
+			[]byte(verb), 0600))
+	}
+	readCalls := func() string {
+		data, err := ioutil.ReadFile(calls)
+		require.NoError(t, err)
+		os.Remove(calls)
+		return string(data)
+	}
+	install := func() (Payloads, error) {
+		return InstallPayloads(makeMultiPayloadArtifact(t, "rootfs-image", "app", "data"),
+			"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	}
+
+	// stored along with the rootfs image, but installed later
+	payloads, err := install()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rootfs-image installed", "app downloaded", "data downloaded"},
+		payloadStates(payloads))
+	assert.True(t, payloads.Rootfs())
+	assert.False(t, payloads.ModulesOnly())
+	assert.True(t, payloads.Pending())
+	assert.Equal(t, "app Download\ndata Download\n", readCalls())
+
+	// and committed with it only
+	require.NoError(t, payloads.Install())
+	assert.Equal(t, []string{"rootfs-image installed", "app installed", "data installed"},
+		payloadStates(payloads))
+	assert.Equal(t, "app ArtifactInstall\ndata ArtifactInstall\n", readCalls())
+
+	// which may happen after a restart
+	data, err := json.Marshal(payloads)
+	require.NoError(t, err)
+	var restored Payloads
+	require.NoError(t, json.Unmarshal(data, &restored))
+	require.NoError(t, restored.Commit())
+	assert.Equal(t, []string{"rootfs-image committed", "app committed", "data committed"},
+		payloadStates(restored))
+	assert.False(t, restored.Pending())
+	assert.Equal(t, "app ArtifactCommit\ndata ArtifactCommit\napp Cleanup\ndata Cleanup\n",
+		readCalls())
+	_, err = os.Stat(restored[1].WorkDir)
+	assert.True(t, os.IsNotExist(err))
+
+	// all rolled back together, in reverse order
+	payloads, err = install()
+	require.NoError(t, err)
+	require.NoError(t, payloads.Install())
+	readCalls()
+	payloads.Rollback()
+	assert.Equal(t, []string{"rootfs-image rolled-back", "app rolled-back", "data rolled-back"},
+		payloadStates(payloads))
+	assert.Equal(t, "data ArtifactRollback\napp ArtifactRollback\napp Cleanup\ndata Cleanup\n",
+		readCalls())
+	payloads.Rollback()
+	_, err = os.Stat(calls)
+	assert.True(t, os.IsNotExist(err))
+
+	// also if they were not installed yet
+	payloads, err = install()
+	require.NoError(t, err)
+	readCalls()
+	payloads.Rollback()
+	assert.Equal(t, []string{"rootfs-image rolled-back", "app rolled-back", "data rolled-back"},
+		payloadStates(payloads))
+	assert.Equal(t, "app Cleanup\ndata Cleanup\n", readCalls())
+
+	// one failing payload rolls back the others
+	failIn("data", ModuleArtifactInstall)
+	payloads, err = install()
+	require.NoError(t, err)
+	assert.Error(t, payloads.Install())
+	assert.Equal(t, []string{"rootfs-image rolled-back", "app rolled-back", "data failed"},
+		payloadStates(payloads))
+	assert.False(t, payloads.Rootfs())
+	assert.Equal(t, "app Download\ndata Download\napp ArtifactInstall\ndata ArtifactInstall\n"+
+		"data ArtifactRollback\napp ArtifactRollback\napp Cleanup\ndata Cleanup\n",
+		readCalls())
+
+	failIn("data", ModuleArtifactCommit)
+	payloads, err = install()
+	require.NoError(t, err)
+	require.NoError(t, payloads.Install())
+	readCalls()
+	assert.Error(t, payloads.Commit())
+	assert.Equal(t, []string{"rootfs-image rolled-back", "app committed", "data failed"},
+		payloadStates(payloads))
+	assert.Equal(t, "app ArtifactCommit\ndata ArtifactCommit\n"+
+		"data ArtifactRollback\napp Cleanup\ndata Cleanup\n", readCalls())
+
+	// module payloads only are stored the same
+	os.Remove(filepath.Join(tmp, "fail-data"))
+	payloads, err = InstallPayloads(makeMultiPayloadArtifact(t, "app", "data"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app downloaded", "data downloaded"}, payloadStates(payloads))
+	assert.False(t, payloads.Rootfs())
+	assert.True(t, payloads.ModulesOnly())
+	assert.Equal(t, "app Download\ndata Download\n", readCalls())
+	payloads.Rollback()
+	readCalls()
+
+	// the images would overwrite each other
+	_, err = InstallPayloads(makeMultiPayloadArtifact(t, "rootfs-image", "rootfs-image"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules, nil)
+	assert.Error(t, err)
+
+	// nothing is installed when verifying
+	deps := &Dependencies{Installed: Provides{}}
+	payloads, err = VerifyArtifact(makeMultiPayloadArtifact(t, "rootfs-image", "app"),
+		"vexpress-qemu", nil, &noInstallDevice{t}, true,
+		modules, deps)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rootfs-image verified", "app verified"}, payloadStates(payloads))
+	assert.Equal(t, filepath.Join(modules.Dir, "app"), payloads[1].Module)
+	assert.Equal(t, "mender-1.1", deps.Provides[ProvidesArtifactName])
+	_, err = os.Stat(calls)
+	assert.True(t, os.IsNotExist(err))
+	stored, err := ioutil.ReadDir(modules.WorkDir)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	_, err = VerifyArtifact(makeMultiPayloadArtifact(t, "rootfs-image", "other"),
+		"vexpress-qemu", nil, new(fDevice), true, modules, nil)
+	assert.Error(t, err)
+	_, err = VerifyArtifact(makeMultiPayloadArtifact(t, "rootfs-image"),
+		"other-device", nil, new(fDevice), true, modules, nil)
+	assert.Error(t, err)
+
+	// the older API commits right away
+	rootfs, err := InstallWithModules(makeMultiPayloadArtifact(t, "rootfs-image", "app"),
+		"vexpress-qemu", nil, "", new(fDevice), true, modules)
+	require.NoError(t, err)
+	assert.True(t, rootfs)
+	assert.Equal(t, "app Download\napp ArtifactInstall\napp ArtifactCommit\napp Cleanup\n",
+		readCalls())
+}
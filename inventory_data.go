@@ -19,6 +19,7 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -30,6 +31,10 @@ const (
 	inventoryToolPrefix = "mender-inventory-"
 )
 
+// Maximum time a single inventory tool is allowed to run; a tool that hangs
+// must not prevent the remaining inventory from being submitted.
+var inventoryToolTimeout = 60 * time.Second
+
 func NewInventoryDataRunner(scriptsDir string) InventoryDataRunner {
 	return InventoryDataRunner{
 		scriptsDir,
@@ -86,15 +91,25 @@ func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
 			continue
 		}
 
+		timer := time.AfterFunc(inventoryToolTimeout, func() {
+			log.Errorf("inventory tool %s timed out after %v, killing it",
+				t, inventoryToolTimeout)
+			cmd.Process.Kill()
+		})
+
 		p := utils.KeyValParser{}
-		if err := p.Parse(out); err != nil {
-			log.Warnf("inventory tool %s returned unparsable output: %v", t, err)
-			continue
-		}
+		perr := p.Parse(out)
 
+		// always reap the tool, even if its output was unusable
 		if err := cmd.Wait(); err != nil {
 			log.Warnf("inventory tool %s wait failed: %v", t, err)
 		}
+		timer.Stop()
+
+		if perr != nil {
+			log.Warnf("inventory tool %s returned unparsable output: %v", t, perr)
+			continue
+		}
 
 		idec.AppendFromRaw(p.Collect())
 	}
@@ -14,10 +14,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInventoryDataDecoder(t *testing.T) {
@@ -50,3 +55,28 @@ func TestInventoryDataDecoder(t *testing.T) {
 	assert.Contains(t, idata, client.InventoryAttribute{"foo", []string{"bar", "baz"}})
 	assert.Contains(t, idata, client.InventoryAttribute{"bar", "zen"})
 }
+
+func TestInventoryDataRunnerTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldTimeout := inventoryToolTimeout
+	inventoryToolTimeout = 100 * time.Millisecond
+	defer func() { inventoryToolTimeout = oldTimeout }()
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "mender-inventory-fast"),
+		[]byte("#!/bin/sh\necho foo=bar\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "mender-inventory-hang"),
+		[]byte("#!/bin/sh\necho baz=zen\nexec sleep 10\n"), 0755))
+
+	idr := NewInventoryDataRunner(dir)
+	tstart := time.Now()
+	idata, err := idr.Get()
+	assert.NoError(t, err)
+	assert.True(t, time.Since(tstart) < 5*time.Second)
+
+	// output of the hanging tool is still collected
+	assert.Contains(t, idata, client.InventoryAttribute{"foo", "bar"})
+	assert.Contains(t, idata, client.InventoryAttribute{"baz", "zen"})
+}
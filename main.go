@@ -18,19 +18,23 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"syscall"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 
 	"github.com/pkg/errors"
 )
@@ -41,6 +45,9 @@ type logOptionsType struct {
 	logLevel   *string
 	logModules *string
 	logFile    *string
+	logFormat  *string
+	logMaxSize *int64
+	logBackups *int
 	noSyslog   *bool
 }
 
@@ -52,19 +59,41 @@ type runOptionsType struct {
 	imageFile       *string
 	runStateScripts *bool
 	commit          *bool
+	rollback        *bool
 	bootstrap       *bool
 	daemon          *bool
 	bootstrapForce  *bool
 	showArtifact    *bool
 	updateCheck     *bool
+	sendInventory   *bool
+	pauseDownload   *bool
+	resumeDownload  *bool
+	dryRun          *bool
+	checksum        *string
+	decommission    *bool
+	notifyServer    *bool
+	tenantToken     *string
+	rotateKey       *bool
 	client.Config
+	// work files of update modules go here, rather than to the default
+	// location, if set
+	modulesWorkPath string
+	// a log level was given on the command line, taking precedence over
+	// LogLevel of the configuration
+	logLevelGiven bool
+	// -tenant-token was given, possibly empty to return to the configured
+	// tenant token
+	tenantTokenGiven bool
+	// the configuration as loaded from the files, before the command line
+	// options were applied; changes are told from it when reloading
+	fileConfig *menderConfig
 }
 
 var (
 	errMsgNoArgumentsGiven = errors.New("Must give one of -rootfs, " +
-		"-commit, -bootstrap or -daemon arguments")
+		"-commit, -rollback, -bootstrap or -daemon arguments")
 	errMsgAmbiguousArgumentsGiven = errors.New("Ambiguous parameters given " +
-		"- must give exactly one from: -rootfs, -commit, -bootstrap, -authorize or -daemon")
+		"- must give exactly one from: -rootfs, -commit, -rollback, -bootstrap, -authorize or -daemon")
 	errMsgIncompatibleLogOptions = errors.New("One or more " +
 		"incompatible log log options specified.")
 )
@@ -96,7 +125,20 @@ func (osCalls) Stat(name string) (os.FileInfo, error) {
 }
 
 func argsParse(args []string) (runOptionsType, error) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, ok := findCommand(args[0])
+		if !ok {
+			return newRunOptions(), usageError{
+				errors.Errorf("unknown command %q; see 'mender -help'", args[0])}
+		}
+		return parseCommand(cmd, args[1:])
+	}
+
 	parsing := flag.NewFlagSet("mender", flag.ContinueOnError)
+	parsing.Usage = func() {
+		printCommands(parsing.Output())
+		parsing.PrintDefaults()
+	}
 
 	// FLAGS ---------------------------------------------------------------
 
@@ -114,6 +156,10 @@ func argsParse(args []string) (runOptionsType, error) {
 	commit := parsing.Bool("commit", false,
 		"Commit current update. Returns (2) if no update in progress")
 
+	rollback := parsing.Bool("rollback", false,
+		"Roll back current update; the previous image is booted after reboot. "+
+			"Returns (2) if no update in progress")
+
 	bootstrap := parsing.Bool("bootstrap", false, "Perform bootstrap and exit.")
 
 	showArtifact := parsing.Bool("show-artifact", false, "print the current artifact name to the command line and exit")
@@ -122,12 +168,18 @@ func argsParse(args []string) (runOptionsType, error) {
 		"Root filesystem URI to use for update. Can be either a local "+
 			"file or a URL.")
 
+	checksum := parsing.String("checksum", "",
+		"Expected checksum of the artifact given with -rootfs: hex SHA256,"+
+			" or <algorithm>:<hex>, e.g. sha512:<hex>.")
+
 	forceStateScripts := parsing.Bool("f", false, "force installation of artifacts with state-scripts")
 
 	daemon := parsing.Bool("daemon", false, "Run as a daemon.")
 
 	updateCheck := parsing.Bool("check-update", false, "force update check")
 
+	sendInventory := parsing.Bool("send-inventory", false, "force inventory update")
+
 	// add bootstrap related command line options
 	serverCert := parsing.String("trusted-certs", "", "Trusted server certificates")
 	forcebootstrap := parsing.Bool("forcebootstrap", false, "Force bootstrap")
@@ -139,7 +191,10 @@ func argsParse(args []string) (runOptionsType, error) {
 	// PARSING -------------------------------------------------------------
 
 	if err := parsing.Parse(args); err != nil {
-		return runOptionsType{}, err
+		if err == flag.ErrHelp {
+			return runOptionsType{}, err
+		}
+		return runOptionsType{}, usageError{err}
 	}
 
 	runOptions := runOptionsType{
@@ -150,11 +205,21 @@ func argsParse(args []string) (runOptionsType, error) {
 		imageFile:       imageFile,
 		runStateScripts: forceStateScripts,
 		commit:          commit,
+		rollback:        rollback,
 		bootstrap:       bootstrap,
 		daemon:          daemon,
 		bootstrapForce:  forcebootstrap,
 		showArtifact:    showArtifact,
 		updateCheck:     updateCheck,
+		sendInventory:   sendInventory,
+		pauseDownload:   new(bool),
+		resumeDownload:  new(bool),
+		dryRun:          new(bool),
+		checksum:        checksum,
+		decommission:    new(bool),
+		notifyServer:    new(bool),
+		tenantToken:     new(string),
+		rotateKey:       new(bool),
 		Config: client.Config{
 			ServerCert: *serverCert,
 			NoVerify:   *skipVerify,
@@ -170,13 +235,14 @@ func argsParse(args []string) (runOptionsType, error) {
 	if *version == true {
 		return runOptions, nil
 	}
-	if *updateCheck == true {
+	if *updateCheck == true || *sendInventory == true {
 		return runOptions, nil
 	}
 
 	if err := parseLogFlags(logFlags); err != nil {
 		return runOptions, err
 	}
+	runOptions.logLevelGiven = logFlags.levelGiven()
 
 	if moreThanOneRunOptionSelected(runOptions) {
 		return runOptions, errMsgAmbiguousArgumentsGiven
@@ -195,6 +261,9 @@ func moreThanOneRunOptionSelected(runOptions runOptionsType) bool {
 	if *runOptions.commit {
 		runOptionsCount++
 	}
+	if *runOptions.rollback {
+		runOptionsCount++
+	}
 	if *runOptions.daemon {
 		runOptionsCount++
 	}
@@ -232,10 +301,25 @@ func addLogFlags(f *flag.FlagSet) logOptionsType {
 
 	logOptions.logFile = f.String("log-file", "", "File to log to.")
 
+	logOptions.logMaxSize = f.Int64("log-file-max-size", 0, "Rotate the "+
+		"log file once it grows beyond this many bytes. By default "+
+		"the log file is not rotated.")
+
+	logOptions.logBackups = f.Int("log-file-backups", 1, "Number of "+
+		"rotated log files to keep.")
+
+	logOptions.logFormat = f.String("log-format", "text", "Format of "+
+		"log entries, which can be 'text' or 'json'.")
+
 	return logOptions
 
 }
 
+// levelGiven tells whether a log level was given on the command line.
+func (args logOptionsType) levelGiven() bool {
+	return *args.logLevel != "" || *args.info || *args.debug
+}
+
 func parseLogFlags(args logOptionsType) error {
 	var logOptCount int
 
@@ -265,8 +349,18 @@ func parseLogFlags(args logOptionsType) error {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	switch *args.logFormat {
+	case "text":
+		log.SetFormatter(new(logrus.TextFormatter))
+	case "json":
+		log.SetFormatter(new(logrus.JSONFormatter))
+	default:
+		return errors.Errorf("invalid log format: %q", *args.logFormat)
+	}
+
 	if *args.logFile != "" {
-		fd, err := os.Create(*args.logFile)
+		fd, err := utils.OpenRotatingFile(*args.logFile, *args.logMaxSize,
+			*args.logBackups)
 		if err != nil {
 			return err
 		}
@@ -353,29 +447,59 @@ func doBootstrapAuthorize(config *menderConfig, opts *runOptionsType) error {
 	return nil
 }
 
-func getKeyStore(datastore string, keyName string) *store.Keystore {
-	dirstore := store.NewDirStore(datastore)
-	return store.NewKeystore(dirstore, keyName)
+// doRotateKey generates a new device key, and tells whether the server has
+// accepted it already; the running daemon keeps authorizing with it until it
+// does otherwise.
+func doRotateKey(config *menderConfig, opts *runOptionsType, out io.Writer) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+	if !mp.authMgr.HasKey() {
+		return errors.New("the device has no key to rotate yet; bootstrap it first")
+	}
+	accepted, err := controller.RotateKey()
+	if err != nil {
+		return err
+	}
+	if accepted {
+		fmt.Fprintln(out, "The server accepted the new device key, which is used from now on.")
+	} else {
+		fmt.Fprintln(out, "The new device key is pending acceptance by the server; "+
+			"the current key is used until then.")
+	}
+	return nil
 }
 
 func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, error) {
 
 	tentok := config.GetTenantToken()
 
-	ks := getKeyStore(*opts.dataStore, defaultKeyFile)
-	if ks == nil {
-		return nil, errors.New("failed to setup key storage")
-	}
-
 	dbstore := store.NewDBStore(*opts.dataStore)
 	if dbstore == nil {
 		return nil, errors.New("failed to initialize DB store")
 	}
+	if err := migrateStore(dbstore, *opts.dataStore); err != nil {
+		dbstore.Close()
+		return nil, err
+	}
+
+	ks := store.NewKeystore(dbstore, defaultKeyFile)
+	if ks == nil {
+		dbstore.Close()
+		return nil, errors.New("failed to setup key storage")
+	}
 
 	authmgr := NewAuthManager(AuthManagerConfig{
 		AuthDataStore:  dbstore,
 		KeyStore:       ks,
-		IdentitySource: NewIdentityDataGetter(),
+		IdentitySource: NewIdentityDataGetter(config.DeviceIdentityHelper),
 		TenantToken:    tentok,
 	})
 	if authmgr == nil {
@@ -383,6 +507,17 @@ func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, erro
 		dbstore.Close()
 		return nil, errors.New("error initializing authentication manager")
 	}
+	if opts.tenantTokenGiven {
+		if *opts.tenantToken != "" {
+			log.Info("switching the device to the tenant of the given tenant token")
+		} else {
+			log.Info("switching the device back to the configured tenant token")
+		}
+		if err := authmgr.SetTenantToken([]byte(*opts.tenantToken)); err != nil {
+			dbstore.Close()
+			return nil, err
+		}
+	}
 
 	mp := MenderPieces{
 		store:   dbstore,
@@ -427,17 +562,38 @@ func doMain(args []string) error {
 	if *runOptions.updateCheck {
 		return updateCheck(exec.Command("kill", "--signal", "SIGUSR1"), exec.Command("systemctl", "show", "-p", "MainPID", "mender"))
 	}
+	if *runOptions.sendInventory {
+		return updateCheck(exec.Command("kill", "--signal", "SIGUSR2"), exec.Command("systemctl", "show", "-p", "MainPID", "mender"))
+	}
 
 	config, err := loadConfig(*runOptions.config, *runOptions.fallbackConfig)
 	if err != nil {
 		return err
 	}
+	if *runOptions.pauseDownload || *runOptions.resumeDownload {
+		return pauseDownload(config.ControlSocket, *runOptions.pauseDownload)
+	}
+	fileConfig := *config
+	runOptions.fileConfig = &fileConfig
 
+	// command line options take precedence over the configuration file
+	if config.LogLevel != "" && !runOptions.logLevelGiven {
+		level, _ := log.ParseLevel(config.LogLevel)
+		log.SetLevel(level)
+	}
+	if *runOptions.dataStore != defaultDataStore {
+		config.DataDir = *runOptions.dataStore
+	} else if config.DataDir != "" {
+		*runOptions.dataStore = config.DataDir
+	}
 	if runOptions.Config.NoVerify {
 		config.HttpsClient.SkipVerify = true
 	}
+	if runOptions.Config.ServerCert != "" {
+		config.ServerCertificate = runOptions.Config.ServerCert
+	}
 
-	env := NewEnvironment(new(osCalls))
+	env := NewBootEnvironment(new(osCalls), config)
 	device := NewDevice(env, new(osCalls), config.GetDeviceConfig())
 	ap, err := device.GetActive()
 	if err != nil {
@@ -451,7 +607,7 @@ func doMain(args []string) error {
 	return handleCLIOptions(runOptions, env, device, config)
 }
 
-func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device, config *menderConfig) error {
+func handleCLIOptions(runOptions runOptionsType, env BootEnvReadWriter, device *device, config *menderConfig) error {
 
 	switch {
 
@@ -462,33 +618,114 @@ func handleCLIOptions(runOptions runOptionsType, env *uBootEnv, device *device,
 		return PrintArtifactName(filepath.Join(getConfDirPath(), "artifact_info"))
 
 	case *runOptions.imageFile != "":
-		dt, err := GetDeviceType(defaultDeviceTypeFile)
+		dt, err := GetDeviceType(config.deviceTypeFile())
+		if err != nil {
+			log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", config.deviceTypeFile(), err)
+		}
+		vKey, err := config.GetVerificationKey()
 		if err != nil {
-			log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+			return err
+		}
+		// use the same connection settings as the daemon; command line
+		// options were merged into the configuration already
+		runOptions.Config = config.GetHttpConfig()
+		runOptions.modulesWorkPath = config.modulesWorkPath()
+		if *runOptions.dryRun {
+			installed, err := readInstalledProvides(*runOptions.dataStore)
+			if err != nil {
+				return err
+			}
+			return doVerifyRootfs(device, runOptions, dt, vKey, installed, os.Stdout)
 		}
-		vKey := config.GetVerificationKey()
 		return doRootfs(device, runOptions, dt, vKey)
 
 	case *runOptions.commit:
 		return device.CommitUpdate()
+	case *runOptions.rollback:
+		return device.RollbackUpdate()
+	case *runOptions.rotateKey:
+		return doRotateKey(config, &runOptions, os.Stdout)
+	case *runOptions.decommission:
+		return doDecommission(config, &runOptions,
+			exec.Command("systemctl", "show", "-p", "MainPID", "mender"))
 	case *runOptions.bootstrap:
+		if config.Enrollment.ServerURL != "" {
+			if err := enrollClientCertificate(config.GetEnrollment()); err != nil {
+				return err
+			}
+		}
 		return doBootstrapAuthorize(config, &runOptions)
 
 	case *runOptions.daemon:
+		if err := checkWritablePaths(*config, *runOptions.dataStore); err != nil {
+			return err
+		}
+		if err := clearRebootRequest(*config); err != nil {
+			return err
+		}
+		if config.Enrollment.ServerURL != "" {
+			if err := enrollClientCertificate(config.GetEnrollment()); err != nil {
+				return err
+			}
+			e := startCertEnroller(config.GetEnrollment())
+			defer e.Close()
+		}
 		d, err := initDaemon(config, device, env, &runOptions)
 		if err != nil {
 			return err
 		}
 		defer d.Cleanup()
-		return runDaemon(d)
+		if config.ControlSocket != "" {
+			cs, err := startControlServer(d, config.ControlSocket)
+			if err != nil {
+				return err
+			}
+			defer cs.Close()
+		}
+		if config.StatusPage != "" {
+			sp, err := startStatusPage(d, config.StatusPage)
+			if err != nil {
+				return err
+			}
+			defer sp.Close()
+		}
+		if m, ok := d.mender.(*mender); ok && m.peers != nil {
+			if err := m.peers.serve(config.peerListenAddress()); err != nil {
+				return err
+			}
+			defer m.peers.Close()
+		}
+		if m, ok := d.mender.(*mender); ok && config.DeviceConnect.Enabled {
+			rc, err := startRemoteConnect(m.api, *config, m.authMgr.AuthToken)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+		}
+		if m, ok := d.mender.(*mender); ok && config.DeviceAPI.Socket != "" {
+			p, err := startDeviceAPIProxy(m.api, *config, m.authMgr.AuthToken)
+			if err != nil {
+				return err
+			}
+			defer p.Close()
+		}
+		if m, ok := d.mender.(*mender); ok && config.UpdateNotifications.MQTTBroker != "" {
+			n := startUpdateNotifier(m.api, *config, d.ForceUpdateCheck)
+			defer n.Close()
+		}
+		return runDaemon(d, runOptions.fileConfig, func() (*menderConfig, error) {
+			return loadConfig(*runOptions.config, *runOptions.fallbackConfig)
+		})
 	case *runOptions.imageFile == "" && !*runOptions.commit &&
-		!*runOptions.daemon && !*runOptions.bootstrap:
+		!*runOptions.rollback && !*runOptions.daemon && !*runOptions.bootstrap:
 		return errMsgNoArgumentsGiven
 	}
 
 	return nil
 }
 
+var errDaemonNotRunning = errors.New("could not find the PID of the mender daemon")
+
 func getMenderDaemonPID(cmd *exec.Cmd) (string, error) {
 	buf := bytes.NewBuffer(nil)
 	cmd.Stdout = buf
@@ -496,13 +733,16 @@ func getMenderDaemonPID(cmd *exec.Cmd) (string, error) {
 	if err != nil {
 		return "", errors.New("getMenderDaemonPID: Failed to run systemctl")
 	}
-	if buf.Len() == 0 {
-		return "", errors.New("could not find the PID of the mender daemon")
+	pid := strings.Trim(buf.String(), "MainPID=\n")
+	// systemd reports 0 for services which are not running
+	if pid == "" || pid == "0" {
+		return "", errDaemonNotRunning
 	}
-	return strings.Trim(buf.String(), "MainPID=\n"), nil
+	return pid, nil
 }
 
-// updateCheck sends a SIGUSR1 signal to the running mender daemon.
+// updateCheck sends the signal of cmdKill to the running mender daemon;
+// SIGUSR1 forces an update check and SIGUSR2 an inventory update.
 func updateCheck(cmdKill, cmdGetPID *exec.Cmd) error {
 	pid, err := getMenderDaemonPID(cmdGetPID)
 	if err != nil {
@@ -517,38 +757,127 @@ func updateCheck(cmdKill, cmdGetPID *exec.Cmd) error {
 
 }
 
-func runDaemon(d *menderDaemon) error {
-	// Handle user forcing update check.
+// Settings of the configuration applied when it is reloaded on SIGHUP; the
+// others, e.g. those of the identity of the device and of the servers and
+// artifacts it trusts, are only applied when the daemon is restarted.
+var reloadableConfig = map[string]bool{
+	"UpdatePollIntervalSeconds":    true,
+	"UpdatePollSplaySeconds":       true,
+	"InventoryPollIntervalSeconds": true,
+	"RetryPollIntervalSeconds":     true,
+	"ServerURL":                    true,
+	"Servers":                      true,
+	"HttpProxy":                    true,
+	"DownloadProxy":                true,
+	"DownloadLimit":                true,
+	"LogLevel":                     true,
+}
+
+// restartRequired returns the settings changed from loaded to config which
+// are not applied until the daemon is restarted.
+func restartRequired(loaded, config *menderConfig) []string {
+	var changed []string
+	was, is := reflect.ValueOf(*loaded), reflect.ValueOf(*config)
+	for i := 0; i < was.NumField(); i++ {
+		name := was.Type().Field(i).Name
+		if reloadableConfig[name] {
+			continue
+		}
+		if !reflect.DeepEqual(was.Field(i).Interface(), is.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reloadDaemonConfig applies the configuration settings which can be changed
+// while the daemon is running. Changes of the other settings from loaded,
+// the configuration the daemon was started with, are rejected; loaded may be
+// nil if not known.
+func reloadDaemonConfig(d *menderDaemon, loaded *menderConfig,
+	reload func() (*menderConfig, error)) {
+
+	config, err := reload()
+	if err != nil {
+		log.Errorf("failed to reload configuration: %v", err)
+		return
+	}
+	if loaded != nil {
+		for _, name := range restartRequired(loaded, config) {
+			log.Errorf("configuration setting %s changed; it is not applied "+
+				"until the daemon is restarted", name)
+		}
+	}
+	// a level given on the command line is kept unless the setting changed
+	if config.LogLevel != "" && (loaded == nil || config.LogLevel != loaded.LogLevel) {
+		level, _ := log.ParseLevel(config.LogLevel)
+		log.SetLevel(level)
+	}
+	if m, ok := d.mender.(*mender); ok {
+		m.SetDownloadLimit(config.DownloadLimit.BytesPerSecond,
+			config.DownloadLimit.BurstBytes)
+	}
+	d.ReloadConfig(config)
+}
+
+// runDaemon runs the daemon until it is stopped; if reload is given, it is
+// used for reloading the configuration on SIGHUP, changes being told from
+// loaded, the configuration loaded at startup.
+func runDaemon(d *menderDaemon, loaded *menderConfig,
+	reload func() (*menderConfig, error)) error {
+	// Handle user forcing update check or inventory update.
 	go func() {
-		for {
-			c := make(chan os.Signal)
-			signal.Notify(c, syscall.SIGUSR1) // Relay the usr1-signal into our channel.
-			defer signal.Stop(c)
-			s := <-c // Block until a signal is recieved.
-			if s == syscall.SIGUSR1 {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+		defer signal.Stop(c)
+		for s := range c {
+			switch s {
+			case syscall.SIGUSR1:
 				log.Debug("SIGUSR1 signal received.")
-				d.updateCheck <- true
-				// If the state machine is in a wait state - force a wake-up.
-				ws, ok := d.mender.GetCurrentState().(WaitState)
-				if ok {
-					ws.Wake()
-				}
+				d.ForceUpdateCheck()
+			case syscall.SIGUSR2:
+				log.Debug("SIGUSR2 signal received.")
+				d.ForceInventoryUpdate()
 			}
 		}
 	}()
+	if reload != nil {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGHUP)
+			defer signal.Stop(c)
+			for range c {
+				log.Info("SIGHUP signal received, reloading configuration")
+				reloadDaemonConfig(d, loaded, reload)
+			}
+		}()
+	}
+	// Stop the daemon cleanly on termination.
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(c)
+		s := <-c
+		log.Infof("%v signal received, stopping daemon", s)
+		d.StopDaemon()
+		// If the state machine is in a wait state - interrupt it.
+		ws, ok := d.mender.GetCurrentState().(WaitState)
+		if ok {
+			ws.Cancel()
+		}
+	}()
 	return d.Run()
 }
 
 func main() {
-	if err := doMain(os.Args[1:]); err != nil && err != flag.ErrHelp {
-		var returnCode int
-		if err == errorNoUpgradeMounted {
-			log.Warnln(err.Error())
-			returnCode = 2
-		} else {
-			log.Errorln(err.Error())
-			returnCode = 1
-		}
-		os.Exit(returnCode)
+	err := doMain(os.Args[1:])
+	switch code := exitCode(err); code {
+	case exitOK:
+	case exitNothingToDo:
+		log.Warnln(err.Error())
+		os.Exit(code)
+	default:
+		log.Errorln(err.Error())
+		os.Exit(code)
 	}
 }
@@ -32,6 +32,7 @@ import (
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -67,6 +68,13 @@ func TestArgsParseCheckUpdate(t *testing.T) {
 	assert.Equal(t, true, *runOpts.updateCheck)
 }
 
+func TestArgsParseSendInventory(t *testing.T) {
+	runOpts, err := argsParse([]string{"-send-inventory"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, *runOpts.sendInventory)
+	assert.Equal(t, false, *runOpts.updateCheck)
+}
+
 func TestRunDaemon(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -86,7 +94,7 @@ func TestRunDaemon(t *testing.T) {
 		updateCheck: make(chan bool, 1),
 	}
 	go func() {
-		err := runDaemon(td)
+		err := runDaemon(td, nil, nil)
 		if err != nil {
 			t.FailNow()
 		}
@@ -105,6 +113,66 @@ func TestRunDaemon(t *testing.T) {
 	assert.Contains(t, buf.String(), "forced wake-up from sleep", "daemon was not forced from sleep")
 }
 
+func TestReloadDaemonConfig(t *testing.T) {
+	mender := newDefaultTestMender()
+	td := &menderDaemon{mender: mender, configReload: make(chan *menderConfig, 1)}
+
+	config := &menderConfig{}
+	config.DownloadLimit.BytesPerSecond = 1000
+	config.DownloadLimit.BurstBytes = 5000
+	reloadDaemonConfig(td, nil, func() (*menderConfig, error) {
+		return config, nil
+	})
+	rate, burst := mender.downloadLimiter.Limit()
+	assert.Equal(t, int64(1000), rate)
+	assert.Equal(t, int64(5000), burst)
+	// the other settings are applied by the daemon loop
+	assert.Equal(t, config, <-td.configReload)
+
+	// a broken configuration keeps the current settings
+	reloadDaemonConfig(td, nil, func() (*menderConfig, error) {
+		return nil, errors.New("broken")
+	})
+	rate, burst = mender.downloadLimiter.Limit()
+	assert.Equal(t, int64(1000), rate)
+	assert.Equal(t, int64(5000), burst)
+	assert.Len(t, td.configReload, 0)
+}
+
+func TestReloadDaemonConfigRestartRequired(t *testing.T) {
+	mender := newDefaultTestMender()
+	td := &menderDaemon{mender: mender, configReload: make(chan *menderConfig, 1)}
+
+	oldLevel := log.Log.Level
+	defer log.SetLevel(oldLevel)
+	var buf bytes.Buffer
+	oldOutput := log.Log.Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(oldOutput)
+	log.SetLevel(log.InfoLevel)
+
+	loaded := &menderConfig{ServerURL: "https://old.example.com",
+		ServerCertificate: "/etc/mender/server.crt", LogLevel: "info"}
+	config := *loaded
+	config.ServerURL = "https://new.example.com"
+	config.ServerCertificate = "/data/server.crt"
+	config.LogLevel = "debug"
+	reloadDaemonConfig(td, loaded, func() (*menderConfig, error) {
+		return &config, nil
+	})
+
+	assert.Contains(t, buf.String(), "configuration setting ServerCertificate changed")
+	assert.NotContains(t, buf.String(), "configuration setting ServerURL changed")
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+	assert.Equal(t, []string{"ServerCertificate"}, restartRequired(loaded, &config))
+	// a level given on the command line is kept if the setting is unchanged
+	log.SetLevel(log.WarnLevel)
+	reloadDaemonConfig(td, &config, func() (*menderConfig, error) {
+		return &config, nil
+	})
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+}
+
 func TestLoggingOptions(t *testing.T) {
 	err := doMain([]string{"-commit", "-log-level", "crap"})
 	assert.Error(t, err, "'crap' log level should have given error")
@@ -169,6 +237,45 @@ func TestLoggingOptions(t *testing.T) {
 	assert.True(t, strings.Index(err.Error(), "syslog") < 0)
 }
 
+func TestLogFormatAndRotation(t *testing.T) {
+	oldOutput := log.Log.Out
+	defer log.SetOutput(oldOutput)
+	defer doMain([]string{"-log-format", "text"})
+
+	err := doMain([]string{"-log-format", "xml"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "log format")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	doMain([]string{"-log-format", "json"})
+	log.Errorln("structured entry")
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry), buf.String())
+	assert.Equal(t, "structured entry", entry["msg"])
+	assert.Equal(t, "error", entry["level"])
+
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	logFile := path.Join(tempDir, "mender.log")
+	doMain([]string{"-log-file", logFile, "-log-file-max-size", "100",
+		"-log-file-backups", "2"})
+	for i := 0; i < 10; i++ {
+		log.Errorln("rotated entry")
+	}
+	log.SetOutput(oldOutput)
+
+	for _, name := range []string{logFile, logFile + ".1", logFile + ".2"} {
+		info, err := os.Stat(name)
+		assert.NoError(t, err)
+		if err == nil {
+			assert.True(t, info.Size() <= 100, "%s too large", name)
+		}
+	}
+	_, err = os.Stat(logFile + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestBinarySize(t *testing.T) {
 	// Test that the binary does not unexpectedly increase a lot in size,
 	// this is intended to protect against introducing very large
@@ -291,10 +398,6 @@ func TestMainBootstrap(t *testing.T) {
 	tdir, err := ioutil.TempDir("", "mendertest")
 	defer os.RemoveAll(tdir)
 
-	// setup a dirstore helper to easily access file contents in test dir
-	ds := store.NewDirStore(tdir)
-	assert.NotNil(t, ds)
-
 	db := store.NewDBStore(tdir)
 	defer db.Close()
 	assert.NotNil(t, db)
@@ -323,8 +426,8 @@ echo mac=00:11:22:33:44:55
 	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap"})
 	assert.NoError(t, err)
 
-	// should have generated a key
-	keyold, err := ds.ReadAll(defaultKeyFile)
+	// should have generated a key, kept in the data store
+	keyold, err := db.ReadAll(defaultKeyFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, keyold)
 
@@ -338,7 +441,7 @@ echo mac=00:11:22:33:44:55
 	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap", "-forcebootstrap"})
 	assert.NoError(t, err)
 
-	keynew, err := ds.ReadAll(defaultKeyFile)
+	keynew, err := db.ReadAll(defaultKeyFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, keynew)
 	assert.NotEqual(t, keyold, keynew)
@@ -0,0 +1,296 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how far ahead the next opening of a window is looked for; far enough for
+// windows opening on February 29th only
+const maintenanceWindowHorizon = 5 * 366 * 24 * time.Hour
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// maintenanceWindow is a period of time updates may be installed in, opening
+// at the minutes matching a cron schedule and lasting for a duration.
+type maintenanceWindow struct {
+	minute  [60]bool
+	hour    [24]bool
+	day     [32]bool
+	month   [13]bool
+	weekday [7]bool
+	// as in cron, a day matches either of the day and weekday fields if
+	// both are restricted
+	anyDay, anyWeekday bool
+	duration           time.Duration
+}
+
+// maintenanceWindows are the windows updates may be installed in; they may be
+// installed anytime if there are none.
+type maintenanceWindows []maintenanceWindow
+
+// parseMaintenanceWindows parses windows given either as a time range of the
+// local time, on all days or on the days of the week given, as in
+// "01:00-05:00" or "Mon-Fri 22:00-02:00", or as a cron expression for when
+// the window opens and its duration, as in "0 3 * * Sat,Sun 2h30m".
+func parseMaintenanceWindows(windows []string) (maintenanceWindows, error) {
+	var parsed maintenanceWindows
+	for _, window := range windows {
+		w, err := parseMaintenanceWindow(window)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid maintenance window %q", window)
+		}
+		parsed = append(parsed, w)
+	}
+	return parsed, nil
+}
+
+func parseMaintenanceWindow(window string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	fields := strings.Fields(window)
+	var err error
+	switch len(fields) {
+	case 1, 2:
+		days := "*"
+		if len(fields) == 2 {
+			days = fields[0]
+		}
+		err = w.parseTimeRange(days, fields[len(fields)-1])
+	case 6:
+		err = w.parseCron(fields[:5], fields[5])
+	default:
+		err = errors.New("expecting a time range, or a cron expression and a duration")
+	}
+	if err != nil {
+		return w, err
+	}
+	if _, ok := w.nextOpen(time.Now()); !ok {
+		return w, errors.New("window never opens")
+	}
+	return w, nil
+}
+
+func (w *maintenanceWindow) parseTimeRange(days, timeRange string) error {
+	bounds := strings.Split(timeRange, "-")
+	if len(bounds) != 2 {
+		return errors.Errorf("invalid time range %q", timeRange)
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return err
+	}
+	if start == end || start == 24*time.Hour {
+		return errors.Errorf("invalid time range %q", timeRange)
+	}
+
+	w.minute[int(start/time.Minute)%60] = true
+	w.hour[int(start/time.Hour)] = true
+	w.duration = (end - start + 24*time.Hour) % (24 * time.Hour)
+	if w.duration == 0 {
+		w.duration = 24 * time.Hour
+	}
+	if _, err := parseCronField(days, w.weekday[:], 0, weekdayNames); err != nil {
+		return err
+	}
+	fill(w.day[1:])
+	fill(w.month[1:])
+	w.anyDay = true
+	return nil
+}
+
+// parseTimeOfDay parses a time of day as HH:MM, returning the time since
+// midnight; 24:00 is the end of the day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		h, herr := strconv.Atoi(parts[0])
+		m, merr := strconv.Atoi(parts[1])
+		if herr == nil && merr == nil && h >= 0 && m >= 0 && m < 60 &&
+			(h < 24 || h == 24 && m == 0) {
+			return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+		}
+	}
+	return 0, errors.Errorf("invalid time of day %q, expecting HH:MM", s)
+}
+
+func (w *maintenanceWindow) parseCron(fields []string, duration string) error {
+	var err error
+	if _, err = parseCronField(fields[0], w.minute[:], 0, nil); err != nil {
+		return err
+	}
+	if _, err = parseCronField(fields[1], w.hour[:], 0, nil); err != nil {
+		return err
+	}
+	if w.anyDay, err = parseCronField(fields[2], w.day[1:], 1, nil); err != nil {
+		return err
+	}
+	if _, err = parseCronField(fields[3], w.month[1:], 1, nil); err != nil {
+		return err
+	}
+	// Sunday is 7 as well as 0
+	var weekday [8]bool
+	if w.anyWeekday, err = parseCronField(fields[4], weekday[:], 0, weekdayNames); err != nil {
+		return err
+	}
+	copy(w.weekday[:], weekday[:7])
+	w.weekday[0] = w.weekday[0] || weekday[7]
+
+	w.duration, err = time.ParseDuration(duration)
+	if err != nil || w.duration <= 0 {
+		return errors.Errorf("invalid duration %q", duration)
+	}
+	return nil
+}
+
+// parseCronField sets the values of a cron field, given as a comma separated
+// list of "*", values and ranges, optionally with steps as in "*/15", in set;
+// set[0] is the value first. Values may also be given by name. It returns
+// whether the field is "*".
+func parseCronField(field string, set []bool, first int, names []string) (bool, error) {
+	if field == "*" {
+		fill(set)
+		return true, nil
+	}
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < first || v >= first+len(set) {
+			return 0, errors.Errorf("invalid value %q", s)
+		}
+		return v, nil
+	}
+
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return false, errors.Errorf("invalid step in %q", item)
+			}
+			step = s
+			item = item[:i]
+		}
+		low, high := first, first+len(set)-1
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if low, err = value(bounds[0]); err != nil {
+				return false, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = value(bounds[1]); err != nil {
+					return false, err
+				}
+			} else if step > 1 {
+				// as in "5/10", from 5 on in steps of 10
+				high = first + len(set) - 1
+			}
+			if high < low {
+				return false, errors.Errorf("invalid range %q", item)
+			}
+		}
+		for v := low; v <= high; v += step {
+			set[v-first] = true
+		}
+	}
+	return false, nil
+}
+
+func fill(set []bool) {
+	for i := range set {
+		set[i] = true
+	}
+}
+
+func (w *maintenanceWindow) dayMatches(t time.Time) bool {
+	day, weekday := w.day[t.Day()], w.weekday[t.Weekday()]
+	if w.anyDay || w.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// opensAt tells if the window opens at the minute t is in.
+func (w *maintenanceWindow) opensAt(t time.Time) bool {
+	return w.minute[t.Minute()] && w.hour[t.Hour()] && w.month[t.Month()] &&
+		w.dayMatches(t)
+}
+
+// contains tells if the window is open at t.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	for start := truncateMinute(t); t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.opensAt(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen returns when the window next opens after t.
+func (w *maintenanceWindow) nextOpen(t time.Time) (time.Time, bool) {
+	limit := t.Add(maintenanceWindowHorizon)
+	for s := truncateMinute(t).Add(time.Minute); s.Before(limit); {
+		switch {
+		case !w.month[s.Month()] || !w.dayMatches(s):
+			s = time.Date(s.Year(), s.Month(), s.Day()+1, 0, 0, 0, 0, s.Location())
+		case !w.hour[s.Hour()]:
+			s = time.Date(s.Year(), s.Month(), s.Day(), s.Hour()+1, 0, 0, 0, s.Location())
+		case !w.minute[s.Minute()]:
+			s = s.Add(time.Minute)
+		default:
+			return s, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func truncateMinute(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+}
+
+// wait returns the time until one of the windows is open, zero if one is open
+// at now or there are no windows.
+func (ws maintenanceWindows) wait(now time.Time) time.Duration {
+	if len(ws) == 0 {
+		return 0
+	}
+	var next time.Time
+	for i := range ws {
+		if ws[i].contains(now) {
+			return 0
+		}
+		if open, ok := ws[i].nextOpen(now); ok && (next.IsZero() || open.Before(next)) {
+			next = open
+		}
+	}
+	if next.IsZero() {
+		// checked when parsing the windows
+		return 24 * time.Hour
+	}
+	return next.Sub(now)
+}
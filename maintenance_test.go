@@ -0,0 +1,104 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a time in March 2018; the 7th is a Wednesday
+func testTime(day, hour, min int) time.Time {
+	return time.Date(2018, time.March, day, hour, min, 30, 0, time.UTC)
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	for _, window := range []string{
+		"01:00-05:00",
+		"Mon-Fri 22:00-02:00",
+		"sat,sun 00:00-24:00",
+		"0 3 * * Sat,Sun 2h30m",
+		"*/15 1-4 1,15 * * 10m",
+		"0 0 29 2 * 1h",
+	} {
+		_, err := parseMaintenanceWindows([]string{window})
+		assert.NoError(t, err, window)
+	}
+
+	for _, window := range []string{
+		"",
+		"01:00",
+		"01:00-01:00",
+		"25:00-26:00",
+		"01:60-02:00",
+		"24:00-01:00",
+		"Foo 01:00-02:00",
+		"Fri-Mon 01:00-02:00",
+		"60 * * * * 1h",
+		"0 3 * * * 0s",
+		"0 3 * * * -1h",
+		"0 3 * * * 1x",
+		"0 3 0 * * 1h",
+		"0 3 * 13 * 1h",
+		"0 3 * * 8 1h",
+		"*/0 3 * * * 1h",
+		"0 3 31 2 * 1h",
+		"0 3 * * * * 1h",
+	} {
+		_, err := parseMaintenanceWindows([]string{window})
+		assert.Error(t, err, window)
+	}
+}
+
+func TestMaintenanceWindowWait(t *testing.T) {
+	// updates are installed anytime without windows
+	var ws maintenanceWindows
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(7, 12, 0)))
+
+	ws, err := parseMaintenanceWindows([]string{"Mon-Fri 22:00-02:00"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(7, 22, 0)))
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(8, 1, 59)))
+	assert.Equal(t, 9*time.Hour+29*time.Minute+30*time.Second, ws.wait(testTime(7, 12, 30)))
+	assert.Equal(t, 19*time.Hour+59*time.Minute+30*time.Second, ws.wait(testTime(8, 2, 0)))
+	// opened on Friday, and on Monday next
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(10, 1, 0)))
+	assert.Equal(t, 2*24*time.Hour+19*time.Hour+59*time.Minute+30*time.Second,
+		ws.wait(testTime(10, 0, 0).Add(2*time.Hour)))
+
+	ws, err = parseMaintenanceWindows([]string{"0 3 * * Sat,Sun 2h", "30 12 1 * * 30m"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(10, 3, 0)))
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(11, 4, 59)))
+	assert.Equal(t, 21*time.Hour+59*time.Minute+30*time.Second, ws.wait(testTime(10, 5, 0)))
+	// April 1st is a Sunday, opening the cron window at 3:00 first
+	assert.Equal(t, 2*time.Hour+59*time.Minute+30*time.Second,
+		ws.wait(testTime(1, 0, 0).AddDate(0, 1, 0)))
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(1, 12, 59).AddDate(0, 1, 0)))
+
+	// both days of month and days of week restricted, either matches
+	ws, err = parseMaintenanceWindows([]string{"0 0 15 * Mon 1h"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(12, 0, 0)))
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(15, 0, 0)))
+	assert.NotEqual(t, time.Duration(0), ws.wait(testTime(13, 0, 0)))
+
+	// Sunday is 7 as well as 0
+	ws, err = parseMaintenanceWindows([]string{"0 0 * * 7 1h"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ws.wait(testTime(11, 0, 0)))
+}
@@ -15,12 +15,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -29,6 +36,7 @@ import (
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -52,15 +60,71 @@ type Controller interface {
 	Authorize() menderError
 	GetCurrentArtifactName() (string, error)
 	GetUpdatePollInterval() time.Duration
+	GetUpdatePollSplay() time.Duration
+	GetUpdatePollHint() time.Duration
 	GetInventoryPollInterval() time.Duration
 	GetRetryPollInterval() time.Duration
+	GetRetryPolicy() client.RetryPolicy
+	GetUpdateCommitTimeout() time.Duration
+	GetMaintenanceWindowWait() time.Duration
+	ModuleUpdateOnly() bool
+	// records the update as installed, so that it is not installed again
+	StoreInstalledArtifact(update client.UpdateResponse)
+	// installs the module payloads of the stored artifact
+	InstallModulePayloads() error
+	// rolls back the payloads of the artifact which are installed, but
+	// not committed
+	RollbackPayloads()
 	HasUpgrade() (bool, menderError)
 	CheckUpdate() (*client.UpdateResponse, menderError)
-	FetchUpdate(url string) (io.ReadCloser, int64, error)
+	// large artifacts are downloaded in parallel ranges from url and its
+	// mirrors
+	FetchUpdate(url string, mirrors ...string) (io.ReadCloser, int64, error)
+	// limits the downloads from then on as the server asks, until set to
+	// another policy or nil
+	SetDownloadPolicy(policy *client.DownloadPolicy)
+	// time until a window of the download policy of the update opens;
+	// zero if one is open or the policy has none
+	GetDownloadWindowWait(update client.UpdateResponse) time.Duration
 	ReportUpdateStatus(update client.UpdateResponse, status string) menderError
+	// logs the progress of downloading the update, and reports it to the
+	// server now and then
+	ReportDownloadProgress(update client.UpdateResponse, progress utils.Progress)
 	UploadLog(update client.UpdateResponse, logs []byte) menderError
 	InventoryRefresh() error
+	// authorizes with the pending device key, switching to it once the
+	// server accepts it; rotating the key first if it is due
+	CheckKeyRotation()
 	CheckScriptsCompatibility() error
+	CheckUpdateCommit(artifactName string) error
+	CheckUpdateSpace(size int64) error
+	// tells why the update is not to be installed now, nil if it is
+	CheckDeploymentFilters(update client.UpdateResponse) error
+	// the artifact of the update from the cache, nil if it is not cached
+	OpenCachedUpdate(update client.UpdateResponse) (io.ReadCloser, int64)
+	// the artifact of the update from a peer on the local network, nil if
+	// none has it
+	FetchPeerUpdate(update client.UpdateResponse) (io.ReadCloser, int64)
+	// caches the artifact of the update read from in
+	CacheUpdate(update client.UpdateResponse, in io.ReadCloser, size int64) io.ReadCloser
+	// adds the artifact to the cache once stored, removes it from the
+	// cache if installing it from there failed as it is broken; tells
+	// whether the artifact came from the cache or a peer, and is to be
+	// fetched from elsewhere
+	FinishCachedUpdate(update client.UpdateResponse, storeErr error) bool
+	// tells whether the device is online; update checks are skipped and
+	// downloads deferred while it is not
+	IsOnline() bool
+	// interrupts the download in progress, and fails those started later,
+	// as the daemon is stopping
+	Shutdown()
+	ShuttingDown() bool
+	// action of the update control map of the update at the point of the
+	// deployment
+	UpdateControlAction(update client.UpdateResponse, point string) string
+	// the current update control map of the update, nil if the server has
+	// removed it
+	FetchUpdateControlMap(update client.UpdateResponse) (*client.SignedUpdateControlMap, menderError)
 
 	UInstallCommitRebooter
 	StateRunner
@@ -76,8 +140,30 @@ var (
 	defaultDataStore         = getStateDirPath()
 	defaultArtScriptsPath    = path.Join(getStateDirPath(), "scripts")
 	defaultRootfsScriptsPath = path.Join(getConfDirPath(), "scripts")
+	defaultModulesPath       = path.Join(getDataDirPath(), "modules")
+	defaultModulesWorkPath   = path.Join(getStateDirPath(), "modules")
+	defaultDeploymentFile    = path.Join(getStateDirPath(), "deployment.json")
+
+	errNoArtifactName       = errors.New("cannot determine current artifact name")
+	errIncompatibleArtifact = errors.New("artifact not compatible with device")
+	errInsufficientSpace    = errors.New("insufficient space for the update")
+	errUpdateNotStored      = errors.New("update not stored")
+	errShuttingDown         = errors.New("daemon is shutting down")
+)
 
-	errNoArtifactName = errors.New("cannot determine current artifact name")
+const (
+	// what the installed artifact provides
+	artifactProvidesKey = "artifact-provides"
+	// what the artifact being installed provides, once it is committed
+	pendingArtifactProvidesKey = "artifact-provides-pending"
+	// name in artifact_info when what the installed artifact provides was
+	// stored, to tell whether a rootfs image has been installed without the
+	// daemon since
+	artifactProvidesRootfsKey = "artifact-provides-rootfs"
+	// status of the payloads of the artifact installed last
+	artifactPayloadsKey = "artifact-payloads"
+	// the artifact, and deployment, installed last
+	installedArtifactKey = "installed-artifact"
 )
 
 type MenderState int
@@ -132,6 +218,18 @@ const (
 	MenderStateUpdateError
 	// exit state
 	MenderStateDone
+	// wait before retrying update check after it failed; new states are
+	// appended so that values of states persisted in the store do not change
+	MenderStateCheckRetryWait
+	// wait for a maintenance window to install the downloaded update in
+	MenderStateMaintenanceWait
+	// wait for the device to be online to download the update
+	MenderStateOfflineWait
+	// deployment paused by its update control map
+	MenderStateUpdateControlPause
+	// wait for a window of the download policy of the server to download
+	// the update in
+	MenderStateDownloadWait
 )
 
 var (
@@ -160,6 +258,11 @@ var (
 		MenderStateError:               "error",
 		MenderStateUpdateError:         "update-error",
 		MenderStateDone:                "finished",
+		MenderStateCheckRetryWait:      "update-check-retry-wait",
+		MenderStateMaintenanceWait:     "maintenance-wait",
+		MenderStateOfflineWait:         "offline-wait",
+		MenderStateUpdateControlPause:  "update-control-pause",
+		MenderStateDownloadWait:        "download-wait",
 	}
 
 	//IMPORTANT: make sure that all the statuses that require
@@ -191,6 +294,11 @@ var (
 		MenderStateError:               "",
 		MenderStateUpdateError:         client.StatusFailure,
 		MenderStateDone:                "",
+		MenderStateCheckRetryWait:      "",
+		MenderStateMaintenanceWait:     client.StatusPauseBeforeInstalling,
+		MenderStateOfflineWait:         "",
+		MenderStateUpdateControlPause:  "",
+		MenderStateDownloadWait:        "",
 	}
 )
 
@@ -227,8 +335,12 @@ func (m *MenderState) UnmarshalJSON(data []byte) error {
 
 type mender struct {
 	UInstallCommitRebooter
-	updater             client.Updater
+	updater client.Updater
+	// guards state and snapshot, which are read by the status page and the
+	// control API while the daemon moves on
+	stateMutex          *sync.Mutex
 	state               State
+	snapshot            stateSnapshot
 	stateScriptExecutor statescript.Executor
 	stateScriptPath     string
 	config              menderConfig
@@ -237,8 +349,47 @@ type mender struct {
 	forceBootstrap      bool
 	authReq             client.AuthRequester
 	authMgr             AuthManager
+	store               store.Store
 	api                 *client.ApiClient
 	authToken           client.AuthToken
+	updateModules       installer.UpdateModules
+	downloadLimiter     *utils.RateLimiter
+	// the download in progress, suspended while downloads are paused, and
+	// the cancel function interrupting it on shutdown; guarded by
+	// downloadMutex
+	downloadMutex  *sync.Mutex
+	activeDownload downloadSuspender
+	downloadCancel context.CancelFunc
+	shuttingDown   bool
+	// time until the next update check asked for by the server
+	updatePollHint time.Duration
+	metrics        *clientMetrics
+	// updates are installed in these windows only, if any
+	maintenanceWindows maintenanceWindows
+	// limits of the server of the downloads, on top of those configured
+	downloadPolicy *client.DownloadPolicy
+	// nil if the connectivity is not checked
+	connectivity *connectivityMonitor
+	// nil if artifacts are not cached
+	artifactCache *artifactCache
+	// the artifact being cached while downloaded, and the name of the
+	// one installed from the cache, of the update being stored
+	caching        *cachingReader
+	cachedArtifact string
+	// nil if artifacts are not shared with peers
+	peers *peerDistribution
+	// address of the peer the update being stored is downloaded from
+	peerArtifact string
+	// status reports and inventory updates are sent through these, which
+	// coalesce them as configured
+	statusReporter     client.StatusReporter
+	inventorySubmitter client.InventorySubmitter
+	// metadata of the deployment in progress, passed to state scripts
+	// and update modules
+	deployment *deploymentTracker
+	// deployment the download progress was last reported of, and when
+	progressDeployment string
+	progressReported   time.Time
 }
 
 type MenderPieces struct {
@@ -253,28 +404,86 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 		return nil, errors.Wrap(err, "error creating HTTP client")
 	}
 
+	deployment := &deploymentTracker{file: config.deploymentFile()}
+
 	stateScrExec := statescript.Launcher{
-		ArtScriptsPath:          defaultArtScriptsPath,
+		ArtScriptsPath:          config.artScriptsPath(),
 		RootfsScriptsPath:       defaultRootfsScriptsPath,
 		SupportedScriptVersions: []int{2},
 		Timeout:                 config.StateScriptTimeoutSeconds,
-		RetryTimeout:            config.StateScriptRetryIntervalSeconds,
-		RetryInterval:           config.StateScriptRetryTimeoutSeconds,
+		RetryTimeout:            config.StateScriptRetryTimeoutSeconds,
+		RetryInterval:           config.StateScriptRetryIntervalSeconds,
+		Env:                     deployment.environ,
 	}
 
 	m := &mender{
 		UInstallCommitRebooter: pieces.device,
-		updater:                client.NewUpdate(),
+		updater:                client.NewUpdateTransports(config.GetMinImageSize(), config.GetUpdateResponseConfig(), config.partialDownloadFile()),
 		artifactInfoFile:       defaultArtifactInfoFile,
-		deviceTypeFile:         defaultDeviceTypeFile,
+		deviceTypeFile:         config.deviceTypeFile(),
 		state:                  initState,
+		snapshot:               snapshotState(initState),
 		config:                 config,
 		authMgr:                pieces.authMgr,
+		store:                  pieces.store,
 		authReq:                client.NewAuth(),
 		api:                    api,
 		authToken:              noAuthToken,
 		stateScriptExecutor:    stateScrExec,
-		stateScriptPath:        defaultArtScriptsPath,
+		stateScriptPath:        config.artScriptsPath(),
+		updateModules: installer.UpdateModules{
+			Dir:     defaultModulesPath,
+			WorkDir: config.modulesWorkPath(),
+			Env:     deployment.environ,
+			Timeout: time.Duration(config.Watchdog.InstallStepSeconds) * time.Second,
+		},
+		downloadLimiter: utils.NewRateLimiter(
+			int64(config.DownloadLimit.BytesPerSecond),
+			int64(config.DownloadLimit.BurstBytes)),
+		metrics:       newClientMetrics(config.MetricsTextFile),
+		downloadMutex: new(sync.Mutex),
+		stateMutex:    new(sync.Mutex),
+		statusReporter: client.NewCoalescingStatus(client.NewStatus(),
+			config.GetCoalescing()),
+		inventorySubmitter: client.NewCoalescingInventory(client.NewInventory(),
+			config.GetCoalescing()),
+		deployment: deployment,
+	}
+
+	m.maintenanceWindows, err = parseMaintenanceWindows(config.MaintenanceWindows)
+	if err != nil {
+		return nil, err
+	}
+
+	checker, err := newConnectivityChecker(config)
+	if err != nil {
+		return nil, err
+	}
+	if checker != nil {
+		m.connectivity = &connectivityMonitor{checker: checker}
+	}
+
+	if config.ArtifactCache.Dir != "" {
+		deviceType, err := m.GetDeviceType()
+		if err != nil || deviceType == "" {
+			log.Warnf("not caching artifacts, the device type is unknown: %v", err)
+		} else {
+			m.artifactCache = &artifactCache{
+				dir:        config.ArtifactCache.Dir,
+				deviceType: deviceType,
+				keep:       config.ArtifactCache.Keep,
+			}
+		}
+	}
+	if config.UpdateControlMapAllowUnsigned && config.UpdateControlMapVerifyKey == "" {
+		log.Warn("update control maps are honored unsigned, " +
+			"no UpdateControlMapVerifyKey is configured")
+	}
+	if m.artifactCache != nil && config.PeerDistribution.Enabled {
+		m.peers, err = newPeerDistribution(config, m.artifactCache)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if m.authMgr != nil {
@@ -316,14 +525,16 @@ func getManifestData(dataType, manifestFile string) (string, error) {
 }
 
 func (m *mender) GetCurrentArtifactName() (string, error) {
-	return getManifestData("artifact_name", m.artifactInfoFile)
+	name, err := getManifestData("artifact_name", m.artifactInfoFile)
+	return name, errors.Wrapf(err, "failed to read the artifact name from %s",
+		m.artifactInfoFile)
 }
 
 func (m *mender) GetDeviceType() (string, error) {
 	return getManifestData("device_type", m.deviceTypeFile)
 }
 
-func (m *mender) GetArtifactVerifyKey() []byte {
+func (m *mender) GetArtifactVerifyKey() ([]byte, error) {
 	return m.config.GetVerificationKey()
 }
 
@@ -380,10 +591,24 @@ func (m *mender) loadAuth() menderError {
 	}
 
 	m.authToken = code
+	// the server may not have the inventory of the device sent before, e.g.
+	// if it was decommissioned meanwhile; the whole of it is sent then
+	if r, ok := m.inventorySubmitter.(client.InventoryResetter); ok {
+		r.ResetInventory()
+	}
 	return nil
 }
 
+// localUpdates tells if updates are read from a local directory, such as a
+// USB stick, in which case there is no server to talk to.
+func (m *mender) localUpdates() bool {
+	return client.IsLocalUpdateSource(m.config.ServerURL)
+}
+
 func (m *mender) IsAuthorized() bool {
+	if m.localUpdates() {
+		return true
+	}
 	if m.authMgr.IsAuthorized() {
 		log.Info("authorization data present and valid")
 		if err := m.loadAuth(); err != nil {
@@ -395,6 +620,11 @@ func (m *mender) IsAuthorized() bool {
 }
 
 func (m *mender) Authorize() menderError {
+	if m.localUpdates() {
+		log.Debugf("updates are read from %s, no authorization needed",
+			m.config.ServerURL)
+		return nil
+	}
 	if m.authMgr.IsAuthorized() {
 		log.Info("authorization data present and valid, skipping authorization attempt")
 		return m.loadAuth()
@@ -407,7 +637,17 @@ func (m *mender) Authorize() menderError {
 
 	m.authToken = noAuthToken
 
-	rsp, err := m.authReq.Request(m.api, m.config.ServerURL, m.authMgr)
+	// the server may have accepted the new key, and rejected the one it
+	// replaces, meanwhile
+	if ok, err := m.authorizePendingKey(); ok {
+		return m.loadAuth()
+	} else if err != nil {
+		log.Warn(err)
+	}
+
+	rsp, err := m.authReq.Request(client.WithTimeout(m.api,
+		m.getTimeout(m.config.Timeouts.AuthSeconds)),
+		m.config.ServerURL, m.authMgr)
 	if err != nil {
 		errCause := errors.Cause(err)
 		if errCause == client.AuthErrorUnauthorized {
@@ -429,6 +669,70 @@ func (m *mender) Authorize() menderError {
 	return m.loadAuth()
 }
 
+// RotateKey generates a new device key, unless one is pending already, and
+// authorizes with it; the current key is used until the server accepts the
+// new one. It tells whether the device has switched to the new key.
+func (m *mender) RotateKey() (bool, error) {
+	if m.authMgr.PendingKey() == nil {
+		log.Info("generating new device key")
+		if err := m.authMgr.GeneratePendingKey(); err != nil {
+			return false, err
+		}
+	}
+	return m.authorizePendingKey()
+}
+
+// CheckKeyRotation rotates the device key once it is older than
+// KeyRotationIntervalDays, and authorizes with the pending key until the
+// server accepts it.
+func (m *mender) CheckKeyRotation() {
+	if m.localUpdates() {
+		return
+	}
+	if days := m.config.KeyRotationIntervalDays; days > 0 && m.authMgr.PendingKey() == nil {
+		created := m.authMgr.KeyCreated()
+		if !created.IsZero() && time.Since(created) >= time.Duration(days)*24*time.Hour {
+			log.Infof("device key generated at %v is due for rotation", created)
+			if err := m.authMgr.GeneratePendingKey(); err != nil {
+				log.Errorf("failed to rotate the device key: %v", err)
+				return
+			}
+		}
+	}
+	if ok, err := m.authorizePendingKey(); err != nil {
+		log.Warn(err)
+	} else if !ok && m.authMgr.PendingKey() != nil {
+		log.Info("new device key not accepted by the server yet")
+	}
+}
+
+// authorizePendingKey authorizes the device with its pending key, if any,
+// switching to that key and its auth token if the server accepts it.
+func (m *mender) authorizePendingKey() (bool, error) {
+	pending := m.authMgr.PendingKey()
+	if pending == nil {
+		return false, nil
+	}
+	rsp, err := m.authReq.Request(client.WithTimeout(m.api,
+		m.getTimeout(m.config.Timeouts.AuthSeconds)),
+		m.config.ServerURL, pending)
+	if err != nil {
+		if errors.Cause(err) == client.AuthErrorUnauthorized {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "authorization request with the new device key failed")
+	}
+	if err := pending.RecvAuthResponse(rsp); err != nil {
+		return false, err
+	}
+	log.Info("the server accepted the new device key; switched to it")
+	m.authToken = noAuthToken
+	if merr := m.loadAuth(); merr != nil {
+		return true, merr.Cause()
+	}
+	return true, nil
+}
+
 func (m *mender) doBootstrap() menderError {
 	if !m.authMgr.HasKey() || m.forceBootstrap {
 		log.Infof("device keys not present or bootstrap forced, generating")
@@ -443,8 +747,140 @@ func (m *mender) doBootstrap() menderError {
 	return nil
 }
 
-func (m *mender) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+// How often the progress of downloading an update is logged.
+var downloadProgressInterval = 30 * time.Second
+
+// How often the progress of downloading an update is reported to the server,
+// as the substate of the downloading status.
+var downloadProgressReportInterval = 5 * time.Minute
+
+// Limit for API requests other than update checks and downloads, unless
+// configured otherwise.
+var defaultRequestTimeout = 10 * time.Minute
+
+// rangeAcceptor is implemented by downloads which can be split into ranges.
+type rangeAcceptor interface {
+	AcceptsRanges() bool
+}
+
+func (m *mender) FetchUpdate(url string, mirrors ...string) (io.ReadCloser, int64, error) {
+	// the stream outlives this call, so the download is bounded by the
+	// transport timeouts only, unless limited explicitly; it is aborted by
+	// canceling the context if stalled, or on shutdown
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if m.config.Timeouts.DownloadSeconds > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(),
+			time.Duration(m.config.Timeouts.DownloadSeconds)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	if !m.setDownloadCancel(cancel) {
+		cancel()
+		return nil, -1, errShuttingDown
+	}
+	release := cancel
+	cancel = func() {
+		m.setDownloadCancel(nil)
+		release()
+	}
+	r, size, err := m.updater.FetchUpdate(ctx, m.api, url,
+		m.GetRetryPollInterval())
+	if err != nil {
+		cancel()
+		return r, size, err
+	}
+	m.deployment.setSize(size)
+	policy := m.downloadPolicy
+	if policy == nil {
+		policy = &client.DownloadPolicy{}
+	}
+	// parallel downloads can not be suspended
+	if conf, ok := m.config.GetParallelDownload(size); ok {
+		if policy.MaxConnections > 0 && conf.Connections > policy.MaxConnections {
+			conf.Connections = policy.MaxConnections
+		}
+		if ra, ok := r.(rangeAcceptor); ok && ra.AcceptsRanges() {
+			log.Infof("downloading the update in ranges of %d bytes, %d at a time, "+
+				"from %d URLs", conf.ChunkSize, conf.Connections, 1+len(mirrors))
+			r = client.NewParallelDownload(ctx, m.api, r,
+				append([]string{url}, mirrors...), size, conf)
+		}
+	}
+	if s, ok := r.(downloadSuspender); ok {
+		m.setActiveDownload(s)
+		release := cancel
+		cancel = func() {
+			m.setActiveDownload(nil)
+			release()
+		}
+	}
+	if m.config.Watchdog.DownloadStallSeconds > 0 {
+		stall := time.Duration(m.config.Watchdog.DownloadStallSeconds) * time.Second
+		r = newStallWatchdogReader(r, stall, m.DownloadPaused, cancel)
+	}
+	r = &cancelReadCloser{ReadCloser: r, cancel: cancel}
+	r = &metricsReader{ReadCloser: r, metrics: m.metrics, start: time.Now()}
+	if m.downloadLimiter != nil {
+		r = &utils.RateLimitedReader{
+			ReadCloser: r,
+			Limiter:    m.downloadLimiter,
+		}
+	}
+	if policy.MaxRate > 0 {
+		log.Infof("download limited to %d B/s by the server", policy.MaxRate)
+		r = &utils.RateLimitedReader{
+			ReadCloser: r,
+			Limiter:    utils.NewRateLimiter(policy.MaxRate, 0),
+		}
+	}
+	return r, size, nil
+}
+
+// cancelReadCloser releases the context of the download once it is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (m *mender) ReportDownloadProgress(update client.UpdateResponse, p utils.Progress) {
+	var progress string
+	if p.Total > 0 {
+		progress = fmt.Sprintf("downloaded %d of %d bytes (%d%%)",
+			p.Current, p.Total, 100*p.Current/p.Total)
+		log.Infof("%s, %.0f B/s, %v left", progress, p.Rate, p.ETA.Round(time.Second))
+	} else {
+		progress = fmt.Sprintf("downloaded %d bytes", p.Current)
+		log.Infof("%s, %.0f B/s", progress, p.Rate)
+	}
+
+	if m.localUpdates() {
+		return
+	}
+	if update.ID == m.progressDeployment &&
+		time.Since(m.progressReported) < downloadProgressReportInterval {
+		return
+	}
+	m.progressDeployment, m.progressReported = update.ID, time.Now()
+	// the download waits for the report, which is not worth stalling it for
+	timeout := m.getTimeout(m.config.Timeouts.StatusReportSeconds)
+	if timeout > downloadProgressInterval {
+		timeout = downloadProgressInterval
+	}
+	err := m.statusReporter.Report(client.WithTimeout(m.authorizedRequest(), timeout),
+		m.config.ServerURL, client.StatusReport{
+			DeploymentID: update.ID,
+			Status:       client.StatusDownloading,
+			SubState:     progress,
+		})
+	if err != nil {
+		log.Warnf("failed to report download progress: %v", err)
+	}
 }
 
 // Check if new update is available. In case of errors, returns nil and error
@@ -457,14 +893,23 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 		if err == nil {
 			err = errors.New("artifact name is empty")
 		}
+		m.metrics.updateChecked(checkFailureLocal)
 		return nil, NewTransientError(fmt.Errorf("could not read the artifact name. This is a necessary condition in order for a mender update to finish safely. Please give the current artifact a name (This can be done by adding a name to the file /etc/mender/artifact_info) err: %v", err))
 	}
 
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
-		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.deviceTypeFile, err)
+	}
+	m.updatePollHint = 0
+	ctx := context.Background()
+	if m.config.Timeouts.UpdateCheckSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx,
+			time.Duration(m.config.Timeouts.UpdateCheckSeconds)*time.Second)
+		defer cancel()
 	}
-	haveUpdate, err := m.updater.GetScheduledUpdate(m.api.Request(m.authToken, reauthorize(m)),
+	haveUpdate, err := m.updater.GetScheduledUpdate(ctx, m.authorizedRequest(),
 		m.config.ServerURL, client.CurrentUpdate{
 			Artifact:   currentArtifactName,
 			DeviceType: deviceType,
@@ -480,13 +925,20 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 
 		}
 		log.Error("Error receiving scheduled update data: ", err)
+		m.metrics.updateChecked(checkFailureReason(err))
 		return nil, NewTransientError(err)
 	}
+	m.metrics.updateChecked("")
 
 	if haveUpdate == nil {
 		log.Debug("no updates available")
 		return nil, nil
 	}
+	if hint, ok := haveUpdate.(client.NoUpdateResponse); ok {
+		log.Debugf("no updates available, next check in %v", hint.NextPoll)
+		m.updatePollHint = hint.NextPoll
+		return nil, nil
+	}
 	update, ok := haveUpdate.(client.UpdateResponse)
 	if !ok {
 		return nil, NewTransientError(errors.Errorf("not an update response?"))
@@ -498,12 +950,80 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 		log.Info("Attempting to upgrade to currently installed artifact name, not performing upgrade.")
 		return &update, NewTransientError(os.ErrExist)
 	}
+	// artifacts of update modules do not change artifact_info, and the
+	// server may offer a deployment again if its success report got lost
+	if installed := m.installedArtifact(currentArtifactName); installed != nil &&
+		(installed.DeploymentID == update.ID ||
+			installed.ArtifactName == update.ArtifactName()) {
+		log.Infof("artifact %s of deployment %s is installed already, not performing upgrade",
+			installed.ArtifactName, installed.DeploymentID)
+		return &update, NewTransientError(os.ErrExist)
+	}
+
+	// no point downloading an artifact the installer is going to reject
+	if deviceType != "" && !isCompatibleDevice(deviceType, update.CompatibleDevices()) {
+		log.Errorf("artifact %s (device types %v) not compatible with device %s",
+			update.ArtifactName(), update.CompatibleDevices(), deviceType)
+		return &update, NewFatalError(errIncompatibleArtifact)
+	}
 	return &update, nil
 }
 
+// UpdateControlAction verifies the update control map of the update, failing
+// the deployment if the map is invalid, and returns its action at point.
+func (m *mender) UpdateControlAction(update client.UpdateResponse, point string) string {
+	if update.UpdateControlMap == nil {
+		return client.UpdateControlContinue
+	}
+	key, err := m.config.GetUpdateControlMapKey()
+	if err == nil && key == nil && !m.config.UpdateControlMapAllowUnsigned {
+		err = errors.New("no UpdateControlMapVerifyKey to verify it with, " +
+			"and UpdateControlMapAllowUnsigned is not set")
+	}
+	var ucm *client.UpdateControlMap
+	if err == nil {
+		ucm, err = update.UpdateControlMap.Verify(key)
+	}
+	if err != nil {
+		log.Errorf("rejecting update control map of deployment %s: %v", update.ID, err)
+		return client.UpdateControlFail
+	}
+	return ucm.Action(point, time.Now())
+}
+
+func (m *mender) FetchUpdateControlMap(update client.UpdateResponse) (
+	*client.SignedUpdateControlMap, menderError) {
+	// there is no server to release the deployment
+	if m.localUpdates() {
+		return update.UpdateControlMap, nil
+	}
+	signed, err := client.FetchUpdateControlMap(client.WithTimeout(m.authorizedRequest(),
+		m.getTimeout(m.config.Timeouts.StatusReportSeconds)), m.config.ServerURL, update.ID)
+	if err != nil {
+		if errors.Cause(err) == client.ErrDeploymentAborted {
+			return nil, NewFatalError(err)
+		}
+		return nil, NewTransientError(err)
+	}
+	return signed, nil
+}
+
+func isCompatibleDevice(deviceType string, compatible []string) bool {
+	for _, dev := range compatible {
+		if dev == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *mender) ReportUpdateStatus(update client.UpdateResponse, status string) menderError {
-	s := client.NewStatus()
-	err := s.Report(m.api.Request(m.authToken, reauthorize(m)), m.config.ServerURL,
+	if m.localUpdates() {
+		log.Infof("update status of %s: %s", update.ArtifactName(), status)
+		return nil
+	}
+	err := m.statusReporter.Report(client.WithTimeout(m.authorizedRequest(),
+		m.getTimeout(m.config.Timeouts.StatusReportSeconds)), m.config.ServerURL,
 		client.StatusReport{
 			DeploymentID: update.ID,
 			Status:       status,
@@ -525,6 +1045,40 @@ func (m *mender) ReportUpdateStatus(update client.UpdateResponse, status string)
 	return nil
 }
 
+// authorizedRequest returns a requester for API calls, renewing the auth
+// token first if it is about to expire.
+func (m *mender) authorizedRequest() *client.ApiRequest {
+	if m.authToken != noAuthToken && !m.authMgr.IsAuthorized() {
+		log.Info("renewing authorization token")
+		if err := m.Authorize(); err != nil {
+			log.Warnf("failed to renew authorization token: %v", err)
+		}
+	}
+	return m.api.Request(m.authToken, reauthorize(m))
+}
+
+// limitedRequest returns a requester for API calls with small responses,
+// which are limited by the request timeout.
+func (m *mender) limitedRequest() client.ApiRequester {
+	return client.WithTimeout(m.authorizedRequest(), m.getRequestTimeout())
+}
+
+func (m *mender) getRequestTimeout() time.Duration {
+	if m.config.Timeouts.RequestSeconds > 0 {
+		return time.Duration(m.config.Timeouts.RequestSeconds) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// getTimeout returns the limit configured for a class of requests, falling
+// back to the request timeout.
+func (m *mender) getTimeout(seconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return m.getRequestTimeout()
+}
+
 func reauthorize(m *mender) func() (client.AuthToken, error) {
 	// force reauthorization
 	return func() (client.AuthToken, error) {
@@ -540,8 +1094,11 @@ func reauthorize(m *mender) func() (client.AuthToken, error) {
 }
 
 func (m *mender) UploadLog(update client.UpdateResponse, logs []byte) menderError {
+	if m.localUpdates() {
+		return nil
+	}
 	s := client.NewLog()
-	err := s.Upload(m.api.Request(m.authToken, reauthorize(m)), m.config.ServerURL,
+	err := s.Upload(m.limitedRequest(), m.config.ServerURL,
 		client.LogData{
 			DeploymentID: update.ID,
 			Messages:     logs,
@@ -562,6 +1119,16 @@ func (m mender) GetUpdatePollInterval() time.Duration {
 	return t
 }
 
+func (m mender) GetUpdatePollSplay() time.Duration {
+	return time.Duration(m.config.UpdatePollSplaySeconds) * time.Second
+}
+
+// GetUpdatePollHint returns the time the server asked to wait for before
+// checking for updates again in the last update check; zero if it did not.
+func (m mender) GetUpdatePollHint() time.Duration {
+	return m.updatePollHint
+}
+
 func (m mender) GetInventoryPollInterval() time.Duration {
 	t := time.Duration(m.config.InventoryPollIntervalSeconds) * time.Second
 	if t == 0 {
@@ -580,14 +1147,83 @@ func (m mender) GetRetryPollInterval() time.Duration {
 	return t
 }
 
+// GetRetryPolicy returns the policy used for retrying both update checks and
+// artifact downloads. Backoff intervals are capped by the update poll interval.
+func (m mender) GetRetryPolicy() client.RetryPolicy {
+	return client.RetryPolicy{
+		MaxInterval:    m.GetUpdatePollInterval(),
+		MaxAttempts:    m.config.Retry.MaxAttempts,
+		MaxElapsedTime: time.Duration(m.config.Retry.MaxElapsedTimeSeconds) * time.Second,
+		Jitter:         m.config.Retry.Jitter,
+	}
+}
+
+// GetUpdateCommitTimeout returns the time after booting the new image within
+// which the update must be committed; zero means there is no limit.
+func (m mender) GetUpdateCommitTimeout() time.Duration {
+	return time.Duration(m.config.UpdateCommitTimeoutSeconds) * time.Second
+}
+
+// GetMaintenanceWindowWait returns the time until the next maintenance
+// window opens; zero if the device is inside one or none are configured.
+func (m mender) GetMaintenanceWindowWait() time.Duration {
+	return m.maintenanceWindows.wait(time.Now())
+}
+
+// SetDownloadPolicy applies the download policy of the deployment to the
+// downloads started from then on.
+func (m *mender) SetDownloadPolicy(policy *client.DownloadPolicy) {
+	m.downloadPolicy = policy
+}
+
+// GetDownloadWindowWait returns the time until the next window of the
+// download policy of the update opens. Windows which can not be parsed are
+// ignored, rather than deferring the download forever.
+func (m mender) GetDownloadWindowWait(update client.UpdateResponse) time.Duration {
+	if update.DownloadPolicy == nil {
+		return 0
+	}
+	var windows maintenanceWindows
+	for _, window := range update.DownloadPolicy.Windows {
+		w, err := parseMaintenanceWindow(window)
+		if err != nil {
+			log.Warnf("ignoring invalid download window %q of the server: %v", window, err)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return windows.wait(time.Now())
+}
+
+func (m mender) IsOnline() bool {
+	if m.connectivity == nil {
+		return true
+	}
+	return m.connectivity.Online()
+}
+
 func (m *mender) SetNextState(s State) {
+	snapshot := snapshotState(s)
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
 	m.state = s
+	m.snapshot = snapshot
 }
 
 func (m *mender) GetCurrentState() State {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
 	return m.state
 }
 
+// StateSnapshot returns a copy of what is shown of the current state, which
+// is safe to use from other goroutines than the one of the daemon.
+func (m *mender) StateSnapshot() stateSnapshot {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+	return m.snapshot
+}
+
 func shouldTransit(from, to State) bool {
 	return from.Transition() != to.Transition()
 }
@@ -655,14 +1291,21 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 		to.SetTransition(from.Transition())
 	}
 
+	// the metadata of the deployment is kept for the scripts of the state
+	// it is left from
+	upd, updErr := getUpdateFromState(to)
+	if updErr == nil {
+		m.deployment.track(&upd)
+	}
+
 	var report *client.StatusReportWrapper
-	if shouldReportUpdateStatus(to.Id()) {
+	if shouldReportUpdateStatus(to.Id()) && !m.localUpdates() {
 		upd, err := getUpdateFromState(to)
 		if err != nil {
 			log.Error(err)
 		} else {
 			report = &client.StatusReportWrapper{
-				API: m.api.Request(m.authToken, reauthorize(m)),
+				API: m.limitedRequest(),
 				URL: m.config.ServerURL,
 				Report: client.StatusReport{
 					DeploymentID: upd.ID,
@@ -693,6 +1336,9 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 		}
 
 		m.SetNextState(to)
+		if updErr != nil {
+			m.deployment.track(nil)
+		}
 
 		if err := to.Transition().Enter(m.stateScriptExecutor, report, ctx.store); err != nil {
 			log.Errorf("error calling enter script for (error) %s state: %v", to.Id(), err)
@@ -702,13 +1348,21 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 	}
 
 	m.SetNextState(to)
+	if updErr != nil {
+		m.deployment.track(nil)
+	}
+	if err := m.metrics.stateChanged(to.Id().String()); err != nil {
+		log.Warnf("failed to update metrics: %v", err)
+	}
 
 	// execute current state action
 	return to.Handle(ctx, m)
 }
 
 func (m *mender) InventoryRefresh() error {
-	ic := client.NewInventory()
+	if m.localUpdates() {
+		return nil
+	}
 	idg := NewInventoryDataRunner(path.Join(getDataDirPath(), "inventory"))
 
 	artifactName, err := m.GetCurrentArtifactName()
@@ -728,7 +1382,7 @@ func (m *mender) InventoryRefresh() error {
 
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
-		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.deviceTypeFile, err)
 	}
 	reqAttr := []client.InventoryAttribute{
 		{Name: "device_type", Value: deviceType},
@@ -746,7 +1400,7 @@ func (m *mender) InventoryRefresh() error {
 		return nil
 	}
 
-	err = ic.Submit(m.api.Request(m.authToken, reauthorize(m)), m.config.ServerURL, idata)
+	err = m.inventorySubmitter.Submit(m.limitedRequest(), m.config.ServerURL, idata)
 	if err != nil {
 		return errors.Wrapf(err, "failed to submit inventory data")
 	}
@@ -758,11 +1412,654 @@ func (m *mender) CheckScriptsCompatibility() error {
 	return m.stateScriptExecutor.CheckRootfsScriptsVersion()
 }
 
+// CheckUpdateCommit runs the configured update commit helper, which decides
+// whether the running update may be committed.
+func (m *mender) CheckUpdateCommit(artifactName string) error {
+	if m.config.UpdateCommitHelper == "" {
+		return nil
+	}
+	log.Infof("running update commit helper %s", m.config.UpdateCommitHelper)
+	out, err := exec.Command(m.config.UpdateCommitHelper, artifactName).CombinedOutput()
+	if len(out) > 0 {
+		log.Infof("output of update commit helper: %s", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "update commit helper rejected the update")
+	}
+	return nil
+}
+
+func (m *mender) CheckDeploymentFilters(update client.UpdateResponse) error {
+	return checkDeploymentFilters(m.config, update.ArtifactName())
+}
+
+// partitionSizer is implemented by devices with a partition to install
+// rootfs images to.
+type partitionSizer interface {
+	InactivePartitionSize() (uint64, error)
+}
+
+func (m *mender) OpenCachedUpdate(update client.UpdateResponse) (io.ReadCloser, int64) {
+	if m.artifactCache == nil {
+		return nil, 0
+	}
+	r, size, err := m.artifactCache.open(update.ArtifactName())
+	if err != nil {
+		log.Warnf("failed to open cached artifact %s: %v", update.ArtifactName(), err)
+		return nil, 0
+	}
+	if r != nil {
+		log.Infof("installing artifact %s from the cache", update.ArtifactName())
+		m.cachedArtifact = update.ArtifactName()
+		m.deployment.setSize(size)
+	}
+	return r, size
+}
+
+func (m *mender) FetchPeerUpdate(update client.UpdateResponse) (io.ReadCloser, int64) {
+	if m.peers == nil {
+		return nil, 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if !m.setDownloadCancel(cancel) {
+		cancel()
+		return nil, 0
+	}
+	release := cancel
+	cancel = func() {
+		m.setDownloadCancel(nil)
+		release()
+	}
+	// peers announce the checksums of their artifacts in hex
+	var checksum string
+	for _, c := range update.Checksums() {
+		if algorithm, digest := utils.SplitChecksum(c); algorithm == "sha256" {
+			checksum = digest
+		}
+	}
+	r, size, peer := m.peers.fetch(ctx, update.ArtifactName(), checksum)
+	if r == nil {
+		cancel()
+		return nil, 0
+	}
+	m.peerArtifact = peer
+	m.deployment.setSize(size)
+	return &cancelReadCloser{ReadCloser: r, cancel: cancel}, size
+}
+
+func (m *mender) CacheUpdate(update client.UpdateResponse, in io.ReadCloser,
+	size int64) io.ReadCloser {
+
+	if m.artifactCache == nil {
+		return in
+	}
+	var checksums []string
+	for _, c := range update.Checksums() {
+		if algorithm, _ := utils.SplitChecksum(c); utils.DigestSupported(algorithm) {
+			checksums = append(checksums, c)
+		}
+	}
+	r := m.artifactCache.resume(update.ArtifactName(), in, size, checksums,
+		m.skipDownload)
+	switch c := r.(type) {
+	case *cachingReader:
+		m.caching = c
+	case *resumedReader:
+		m.caching = c.caching
+	}
+	return r
+}
+
+func (m *mender) FinishCachedUpdate(update client.UpdateResponse, storeErr error) bool {
+	caching, cached, peer := m.caching, m.cachedArtifact, m.peerArtifact
+	m.caching, m.cachedArtifact, m.peerArtifact = nil, "", ""
+
+	if caching != nil {
+		if storeErr != nil && m.ShuttingDown() {
+			if err := caching.checkpoint(); err != nil {
+				log.Warnf("failed to keep partial download: %v", err)
+			}
+		} else if storeErr != nil {
+			caching.abort()
+		} else if err := caching.commit(); err != nil {
+			log.Warnf("failed to cache artifact: %v", err)
+		}
+	}
+	// downloaded from the other peers, or the server, instead; whatever
+	// made it fail, unless it is the device or the daemon stopping
+	if peer != "" && storeErr != nil && storeErr != errUpdateNotStored &&
+		utils.ErrorKindOf(storeErr) != utils.ErrorKindStorage && !m.ShuttingDown() {
+		log.Warnf("not downloading from peer %s again, storing its artifact failed: %v",
+			peer, storeErr)
+		m.peers.reject(peer)
+		return true
+	}
+	if utils.ErrorKindOf(storeErr) != utils.ErrorKindArtifact {
+		return false
+	}
+	// downloaded from peers, or the server, instead
+	if cached != "" {
+		log.Warnf("removing broken artifact %s from the cache: %v", cached, storeErr)
+		if err := m.artifactCache.remove(cached); err != nil {
+			log.Errorf("failed to remove artifact from the cache: %v", err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// CheckUpdateSpace returns errInsufficientSpace if an artifact of the given
+// size fits neither on the inactive partition nor, if there are update
+// modules to pass payloads to, into their work directory.
+func (m *mender) CheckUpdateSpace(size int64) error {
+	// the size is not always known in advance
+	if size <= 0 {
+		return nil
+	}
+
+	var checked bool
+	if ps, ok := m.UInstallCommitRebooter.(partitionSizer); ok {
+		checked = true
+		psz, err := ps.InactivePartitionSize()
+		if err != nil {
+			log.Warnf("failed to read size of the inactive partition: %v", err)
+			return nil
+		}
+		if uint64(size) <= psz {
+			return nil
+		}
+		log.Errorf("update (%v bytes) is larger than the inactive partition "+
+			"(%v bytes)", size, psz)
+	}
+
+	if modules, _ := ioutil.ReadDir(m.updateModules.Dir); len(modules) > 0 {
+		checked = true
+		free, err := freeSpace(m.updateModules.WorkDir)
+		if err != nil {
+			log.Warnf("failed to read free space of %s: %v",
+				m.updateModules.WorkDir, err)
+			return nil
+		}
+		if uint64(size) <= free {
+			return nil
+		}
+		log.Errorf("update (%v bytes) is larger than the free space of %s "+
+			"(%v bytes)", size, m.updateModules.WorkDir, free)
+	}
+	if !checked {
+		return nil
+	}
+	return errInsufficientSpace
+}
+
+// freeSpace returns the space available to unprivileged users in the file
+// system of the path, which does not need to exist yet.
+func freeSpace(path string) (uint64, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return stat.Bavail * uint64(stat.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if err != syscall.ENOENT || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
 func (m *mender) InstallUpdate(from io.ReadCloser, size int64) error {
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
-		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.deviceTypeFile, err)
+	}
+	key, err := m.GetArtifactVerifyKey()
+	if err != nil {
+		return errors.Wrapf(err, "can not verify update")
+	}
+	installed, err := m.InstalledProvides()
+	if err != nil {
+		return errors.Wrapf(err, "can not check the artifact depends")
+	}
+	deps := &installer.Dependencies{Installed: installed}
+	payloads, err := installer.InstallPayloads(from, deviceType,
+		key, m.stateScriptPath, m.UInstallCommitRebooter, true, &m.updateModules,
+		deps)
+	if payloads != nil {
+		types := make([]string, 0, len(payloads))
+		for _, p := range payloads {
+			types = append(types, p.Type)
+		}
+		m.deployment.setPayloadTypes(types)
+		if serr := storePayloads(m.store, payloads); serr != nil {
+			log.Errorf("failed to store the status of the payloads: %v", serr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// what the artifact provides takes effect once its payloads are
+	// committed
+	if err := storeProvides(m.store, pendingArtifactProvidesKey, deps.Provides); err != nil {
+		log.Errorf("failed to store what the artifact provides: %v", err)
+	}
+	return nil
+}
+
+// InstallModulePayloads calls the update modules to install the payloads of
+// the stored update; if one of them fails, all the payloads are rolled back.
+func (m *mender) InstallModulePayloads() error {
+	payloads, err := m.Payloads()
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the status of the payloads")
+	}
+	payloads.SetModules(&m.updateModules)
+	err = payloads.Install()
+	if serr := storePayloads(m.store, payloads); serr != nil {
+		log.Errorf("failed to store the status of the payloads: %v", serr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to install the payloads of the update")
+	}
+	return nil
+}
+
+// storeInstalledProvides stores what the installed artifact provides, along
+// with the name of the rootfs image it is installed on.
+func (m *mender) storeInstalledProvides(txn store.Transaction,
+	provides installer.Provides) error {
+
+	if err := storeProvides(txn, artifactProvidesKey, provides); err != nil {
+		return err
+	}
+	rootfsName, err := m.GetCurrentArtifactName()
+	if err != nil || rootfsName == "" {
+		log.Warnf("can not record the rootfs image of the installed artifact: %v", err)
+		if err := txn.Remove(artifactProvidesRootfsKey); !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return txn.WriteAll(artifactProvidesRootfsKey, []byte(rootfsName))
+}
+
+// InstalledProvides returns what the installed artifact provides, as stored
+// when installing it; the name and group of the artifact the device was
+// provisioned with, or of a rootfs image installed without the daemon since,
+// are read from artifact_info.
+func (m *mender) InstalledProvides() (installer.Provides, error) {
+	return installedProvides(m.store, m.artifactInfoFile)
+}
+
+func installedProvides(s store.Store, artifactInfoFile string) (installer.Provides, error) {
+	provides, err := loadProvides(s, artifactProvidesKey)
+	if err != nil {
+		return nil, err
+	}
+	name, err := GetCurrentArtifactName(artifactInfoFile)
+	if err != nil || name == "" {
+		log.Warnf("can not determine the name of the installed artifact: %v", err)
+		return provides, nil
+	}
+	// a rootfs image may have been installed without the daemon; told by
+	// artifact_info no longer naming the image the provides were stored on,
+	// or, in stores predating that record, the artifact they were stored for
+	rootfsName, err := s.ReadAll(artifactProvidesRootfsKey)
+	changed := string(rootfsName) != name
+	if os.IsNotExist(err) {
+		changed = provides[installer.ProvidesArtifactName] != name
+	} else if err != nil {
+		return nil, err
+	}
+	if len(provides) == 0 || changed {
+		provides = installer.Provides{installer.ProvidesArtifactName: name}
+		if group, _ := getManifestData("artifact_group",
+			artifactInfoFile); group != "" {
+			provides[installer.ProvidesArtifactGroup] = group
+		}
+	}
+	return provides, nil
+}
+
+// readInstalledProvides reads what the installed artifact provides without
+// the daemon, from the data store in dataDir.
+func readInstalledProvides(dataDir string) (installer.Provides, error) {
+	dbstore := store.NewDBStore(dataDir)
+	if dbstore == nil {
+		return nil, errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+	return installedProvides(dbstore, defaultArtifactInfoFile)
+}
+
+// CommitUpdate commits the running update, which makes what the artifact
+// provides take effect. The module payloads are committed first, then the
+// rootfs image if there is one; if any of them fails, all the payloads are
+// rolled back.
+func (m *mender) CommitUpdate() error {
+	payloads, err := m.Payloads()
+	if err != nil {
+		log.Errorf("failed to load the status of the payloads: %v", err)
+	}
+	// there is no image to commit for artifacts of module payloads only
+	rootfs := !payloads.ModulesOnly()
+	if payloads.Pending() {
+		payloads.SetModules(&m.updateModules)
+		err := payloads.Commit()
+		if serr := storePayloads(m.store, payloads); serr != nil {
+			log.Errorf("failed to store the status of the payloads: %v", serr)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to commit the payloads of the update")
+		}
+	}
+	if rootfs {
+		if err := m.UInstallCommitRebooter.CommitUpdate(); err != nil {
+			return err
+		}
+	}
+	err = store.WriteTransaction(m.store, func(txn store.Transaction) error {
+		provides, err := loadProvides(txn, pendingArtifactProvidesKey)
+		if err != nil || len(provides) == 0 {
+			return err
+		}
+		if err := m.storeInstalledProvides(txn, provides); err != nil {
+			return err
+		}
+		return txn.Remove(pendingArtifactProvidesKey)
+	})
+	if err != nil {
+		log.Errorf("failed to store what the artifact provides: %v", err)
+	}
+	return nil
+}
+
+// RollbackPayloads rolls back the payloads of the update which are installed,
+// but not committed; the rootfs image is rolled back by booting the active
+// partition.
+func (m *mender) RollbackPayloads() {
+	// the rootfs image is rolled back too, if any
+	err := store.WriteTransaction(m.store, func(txn store.Transaction) error {
+		if err := txn.Remove(pendingArtifactProvidesKey); !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("failed to remove what the update provides: %v", err)
+	}
+	payloads, err := m.Payloads()
+	if err != nil {
+		log.Errorf("failed to load the status of the payloads: %v", err)
+		return
+	}
+	if !payloads.Pending() {
+		return
+	}
+	log.Info("rolling back the payloads of the update")
+	payloads.SetModules(&m.updateModules)
+	payloads.Rollback()
+	if err := storePayloads(m.store, payloads); err != nil {
+		log.Errorf("failed to store the status of the payloads: %v", err)
+	}
+}
+
+// Payloads returns the status of the payloads of the artifact installed last.
+func (m *mender) Payloads() (installer.Payloads, error) {
+	data, err := m.store.ReadAll(artifactPayloadsKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var payloads installer.Payloads
+	if err := json.Unmarshal(data, &payloads); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", artifactPayloadsKey)
+	}
+	return payloads, nil
+}
+
+func storePayloads(s store.Transaction, payloads installer.Payloads) error {
+	data, err := json.Marshal(payloads)
+	if err != nil {
+		return err
+	}
+	return s.WriteAll(artifactPayloadsKey, data)
+}
+
+func loadProvides(s store.Transaction, key string) (installer.Provides, error) {
+	provides := installer.Provides{}
+	data, err := s.ReadAll(key)
+	if os.IsNotExist(err) {
+		return provides, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &provides); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", key)
+	}
+	return provides, nil
+}
+
+func storeProvides(s store.Transaction, key string, provides installer.Provides) error {
+	data, err := json.Marshal(provides)
+	if err != nil {
+		return err
+	}
+	return s.WriteAll(key, data)
+}
+
+// installedArtifact is the artifact installed last by the daemon.
+type installedArtifact struct {
+	ArtifactName string
+	DeploymentID string
+	// name in artifact_info once installed, to tell whether a rootfs image
+	// has been installed without the daemon since
+	RootfsArtifactName string
+}
+
+// StoreInstalledArtifact records the artifact of the update as installed.
+func (m *mender) StoreInstalledArtifact(update client.UpdateResponse) {
+	rootfsName, err := m.GetCurrentArtifactName()
+	if err != nil {
+		log.Warnf("can not record the installed artifact: %v", err)
+		return
+	}
+	data, err := json.Marshal(installedArtifact{
+		ArtifactName:       update.ArtifactName(),
+		DeploymentID:       update.ID,
+		RootfsArtifactName: rootfsName,
+	})
+	if err == nil {
+		err = m.store.WriteAll(installedArtifactKey, data)
+	}
+	if err != nil {
+		log.Errorf("failed to store the installed artifact: %v", err)
+	}
+}
+
+// installedArtifact returns the artifact installed last by the daemon, or nil
+// if the device does not run it anymore.
+func (m *mender) installedArtifact(rootfsName string) *installedArtifact {
+	data, err := m.store.ReadAll(installedArtifactKey)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read the installed artifact: %v", err)
+		}
+		return nil
+	}
+	var installed installedArtifact
+	if err := json.Unmarshal(data, &installed); err != nil {
+		log.Errorf("invalid %s: %v", installedArtifactKey, err)
+		return nil
+	}
+	if installed.RootfsArtifactName != rootfsName {
+		return nil
+	}
+	return &installed
+}
+
+// Metrics returns the health metrics of the client.
+func (m *mender) Metrics() *clientMetrics {
+	return m.metrics
+}
+
+// ModuleUpdateOnly returns true if the last installed artifact was fully
+// handled by update modules, i.e. there is no partition to switch to.
+func (m *mender) ModuleUpdateOnly() bool {
+	payloads, err := m.Payloads()
+	if err != nil {
+		log.Errorf("failed to load the status of the payloads: %v", err)
+	}
+	return payloads.ModulesOnly()
+}
+
+// SetDownloadLimit changes the limit for the rate of artifact downloads,
+// including the ones in progress.
+func (m *mender) SetDownloadLimit(bytesPerSecond, burstBytes int) {
+	if m.downloadLimiter == nil {
+		m.downloadLimiter = utils.NewRateLimiter(0, 0)
+	}
+	m.downloadLimiter.SetLimit(int64(bytesPerSecond), int64(burstBytes))
+	log.Infof("artifact download limit set to %d B/s", bytesPerSecond)
+}
+
+// ReloadConfig applies the settings of a reloaded configuration which can be
+// changed while the client is running: the poll intervals, the servers and
+// the proxies. The settings are kept as they are if the HTTP client can not
+// be set up for the new servers or proxies.
+func (m *mender) ReloadConfig(config menderConfig) error {
+	next := m.config
+	next.UpdatePollIntervalSeconds = config.UpdatePollIntervalSeconds
+	next.UpdatePollSplaySeconds = config.UpdatePollSplaySeconds
+	next.InventoryPollIntervalSeconds = config.InventoryPollIntervalSeconds
+	next.RetryPollIntervalSeconds = config.RetryPollIntervalSeconds
+	next.ServerURL = config.ServerURL
+	next.Servers = config.Servers
+	next.HttpProxy = config.HttpProxy
+	next.DownloadProxy = config.DownloadProxy
+
+	if !reflect.DeepEqual(next.GetHttpConfig(), m.config.GetHttpConfig()) ||
+		next.ServerURL != m.config.ServerURL {
+		api, err := client.New(next.GetHttpConfig())
+		if err != nil {
+			return errors.Wrap(err, "error creating HTTP client")
+		}
+		checker, err := newConnectivityChecker(next)
+		if err != nil {
+			return err
+		}
+		m.api = api
+		m.connectivity = nil
+		if checker != nil {
+			m.connectivity = &connectivityMonitor{checker: checker}
+		}
+		if next.DeviceConnect.Enabled || next.DeviceAPI.Socket != "" ||
+			next.UpdateNotifications.MQTTBroker != "" {
+			log.Warn("remote sessions, the device API and update notifications " +
+				"keep their connection settings until the daemon is restarted")
+		}
+		if next.ServerURL != m.config.ServerURL {
+			// the token was issued by the previous server
+			if err := m.authMgr.RemoveAuthToken(); err != nil {
+				log.Warnf("failed to remove the auth token of %s: %v",
+					m.config.ServerURL, err)
+			}
+			m.authToken = noAuthToken
+		}
+		log.Infof("connecting to %s with the reloaded configuration", next.ServerURL)
+	}
+	m.config = next
+	log.Info("reloaded configuration applied")
+	return nil
+}
+
+// downloadSuspender is implemented by downloads which can be suspended,
+// closing the connection, and resumed later from where they left off.
+type downloadSuspender interface {
+	Suspend()
+	Resume()
+}
+
+func (m *mender) setActiveDownload(s downloadSuspender) {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	m.activeDownload = s
+	if s != nil && m.DownloadPaused() {
+		s.Suspend()
+	}
+}
+
+// PauseDownload stops, or resumes, reading the artifact being downloaded.
+// The connection of a paused download is closed, so that nothing is
+// transferred, e.g. on a metered connection; once resumed, the download
+// continues from the same offset.
+func (m *mender) PauseDownload(paused bool) {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	if m.downloadLimiter == nil {
+		m.downloadLimiter = utils.NewRateLimiter(0, 0)
+	}
+	m.downloadLimiter.SetPaused(paused)
+	if m.activeDownload == nil {
+		return
+	}
+	if paused {
+		m.activeDownload.Suspend()
+	} else {
+		m.activeDownload.Resume()
+	}
+}
+
+// setDownloadCancel registers the cancel function of the download in
+// progress, returning false if the daemon is shutting down already.
+func (m *mender) setDownloadCancel(cancel context.CancelFunc) bool {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	if m.shuttingDown && cancel != nil {
+		return false
 	}
-	return installer.Install(from, deviceType,
-		m.GetArtifactVerifyKey(), m.stateScriptPath, m.UInstallCommitRebooter, true)
+	m.downloadCancel = cancel
+	return true
+}
+
+// Shutdown interrupts the download in progress, so that the daemon can
+// keep what was downloaded and stop, rather than being killed in the middle
+// of the download.
+func (m *mender) Shutdown() {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	m.shuttingDown = true
+	if m.downloadCancel != nil {
+		log.Info("interrupting the download in progress")
+		m.downloadCancel()
+	}
+}
+
+func (m *mender) ShuttingDown() bool {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	return m.shuttingDown
+}
+
+// downloadSkipper is implemented by downloads which can be continued at an
+// offset, rather than at the start.
+type downloadSkipper interface {
+	SkipTo(offset int64) error
+}
+
+func (m *mender) skipDownload(offset int64) error {
+	m.downloadMutex.Lock()
+	defer m.downloadMutex.Unlock()
+	if s, ok := m.activeDownload.(downloadSkipper); ok {
+		return s.SkipTo(offset)
+	}
+	return errors.New("download can not be resumed")
+}
+
+func (m *mender) DownloadPaused() bool {
+	return m.downloadLimiter != nil && m.downloadLimiter.Paused()
 }
@@ -17,10 +17,14 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -30,10 +34,14 @@ import (
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/mendersoftware/mender/client"
 	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type testMenderPieces struct {
@@ -73,6 +81,7 @@ func Test_getArtifactName_malformedArtifactNameLine_returnsError(t *testing.T) {
 
 	artName, err := mender.GetCurrentArtifactName()
 	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact_info")
 	assert.Equal(t, "", artName)
 }
 
@@ -126,6 +135,60 @@ func newDefaultTestMender() *mender {
 	return newTestMender(nil, menderConfig{}, testMenderPieces{})
 }
 
+func TestMenderStateScriptConfig(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{
+		StateScriptTimeoutSeconds:       10,
+		StateScriptRetryTimeoutSeconds:  600,
+		StateScriptRetryIntervalSeconds: 30,
+	}, testMenderPieces{})
+
+	l, ok := mender.stateScriptExecutor.(statescript.Launcher)
+	require.True(t, ok)
+	assert.Equal(t, 10, l.Timeout)
+	assert.Equal(t, 600, l.RetryTimeout)
+	assert.Equal(t, 30, l.RetryInterval)
+}
+
+func TestMenderReloadConfig(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{
+		ServerURL:                 "https://old.example.com",
+		UpdatePollIntervalSeconds: 1800,
+		StateScriptTimeoutSeconds: 10,
+		ConnectivityCheck:         connectivityProbe,
+	}, testMenderPieces{})
+	api := mender.api
+	require.NoError(t, mender.authMgr.RecvAuthResponse([]byte("old-token")))
+	require.NoError(t, mender.loadAuth())
+
+	config := menderConfig{
+		ServerURL:                 "https://new.example.com",
+		UpdatePollIntervalSeconds: 60,
+		HttpProxy:                 "http://proxy:3128",
+		StateScriptTimeoutSeconds: 20,
+		ConnectivityCheck:         connectivityProbe,
+	}
+	require.NoError(t, mender.ReloadConfig(config))
+	assert.Equal(t, "https://new.example.com", mender.config.ServerURL)
+	assert.Equal(t, 60, mender.config.UpdatePollIntervalSeconds)
+	assert.Equal(t, "http://proxy:3128", mender.config.HttpProxy)
+	// settings requiring a restart are not applied
+	assert.Equal(t, 10, mender.config.StateScriptTimeoutSeconds)
+	assert.NotEqual(t, api, mender.api)
+	require.NotNil(t, mender.connectivity)
+	require.IsType(t, &dialProbe{}, mender.connectivity.checker)
+	assert.Equal(t, "proxy:3128", mender.connectivity.checker.(*dialProbe).address)
+	// the token of the previous server is dropped
+	assert.Equal(t, noAuthToken, mender.authToken)
+	assert.False(t, mender.authMgr.IsAuthorized())
+
+	// the HTTP client is kept if only the intervals change
+	api = mender.api
+	config.UpdatePollIntervalSeconds = 120
+	require.NoError(t, mender.ReloadConfig(config))
+	assert.Equal(t, 120, mender.config.UpdatePollIntervalSeconds)
+	assert.Equal(t, api, mender.api)
+}
+
 func Test_ForceBootstrap(t *testing.T) {
 	// generate valid keys
 	ms := store.NewMemStore()
@@ -293,16 +356,55 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	// make artifact name different from current
 	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
 	srv.Update.Has = true
+
+	// artifact for other devices is rejected before downloading it
+	srv.Update.Data.Artifact.CompatibleDevices = []string{"vexpress"}
+	up, err = mender.CheckUpdate()
+	assert.Equal(t, err, NewFatalError(errIncompatibleArtifact))
+	assert.NotNil(t, up)
+
+	srv.Update.Data.Artifact.CompatibleDevices = []string{"vexpress", "hammer"}
 	up, err = mender.CheckUpdate()
 	assert.NoError(t, err)
 	assert.NotNil(t, up)
 	assert.Equal(t, *up, srv.Update.Data)
 
+	// installed already, as by an update module, or offered again by the
+	// same deployment
+	mender.StoreInstalledArtifact(*up)
+	_, err = mender.CheckUpdate()
+	assert.Equal(t, err, NewTransientError(os.ErrExist))
+	srv.Update.Data.Artifact.ArtifactName = currID + "-other"
+	_, err = mender.CheckUpdate()
+	assert.Equal(t, err, NewTransientError(os.ErrExist))
+	srv.Update.Data.ID = "bar"
+	_, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+
+	// not anymore once a rootfs image has been installed without the daemon
+	srv.Update.Data.ID = "foo"
+	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
+	srv.Update.Current.Artifact = "fake-id-2"
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id-2\nDEVICE_TYPE=hammer"), 0600)
+	_, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	srv.Update.Current.Artifact = currID
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id\nDEVICE_TYPE=hammer"), 0600)
+	mender.store.Remove(installedArtifactKey)
+
 	// pretend that we got 204 No Content from the server, i.e empty response body
 	srv.Update.Has = false
 	up, err = mender.CheckUpdate()
 	assert.NoError(t, err)
 	assert.Nil(t, up)
+	assert.Equal(t, time.Duration(0), mender.GetUpdatePollHint())
+
+	// the server asks to check again later
+	srv.Update.RetryAfter = "3600"
+	up, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	assert.Nil(t, up)
+	assert.Equal(t, time.Hour, mender.GetUpdatePollHint())
 }
 
 func TestMenderHasUpgrade(t *testing.T) {
@@ -350,6 +452,153 @@ func TestMenderGetUpdatePollInterval(t *testing.T) {
 	assert.Equal(t, time.Duration(20)*time.Second, intvl)
 }
 
+func TestMenderCheckUpdateCommit(t *testing.T) {
+	// no helper configured
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.NoError(t, mender.CheckUpdateCommit("release-2"))
+
+	tdir, err := ioutil.TempDir("", "commit-helper")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	helper := path.Join(tdir, "helper")
+	err = ioutil.WriteFile(helper, []byte("#!/bin/sh\n"+
+		"echo \"$1\" > "+path.Join(tdir, "args")+"\n"+
+		"test \"$1\" = release-2\n"), 0755)
+	require.NoError(t, err)
+
+	mender = newTestMender(nil, menderConfig{
+		UpdateCommitHelper: helper,
+	}, testMenderPieces{})
+	assert.NoError(t, mender.CheckUpdateCommit("release-2"))
+	args, err := ioutil.ReadFile(path.Join(tdir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "release-2\n", string(args))
+
+	assert.Error(t, mender.CheckUpdateCommit("release-3"))
+}
+
+type sizedPartitionDevice struct {
+	fakeDevice
+	size uint64
+}
+
+func (d *sizedPartitionDevice) InactivePartitionSize() (uint64, error) {
+	return d.size, nil
+}
+
+func TestMenderCheckUpdateSpace(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "update-space")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	dev := &sizedPartitionDevice{size: 1000}
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{device: dev},
+	})
+	mender.updateModules.Dir = path.Join(tdir, "modules")
+	mender.updateModules.WorkDir = path.Join(tdir, "work", "modules")
+
+	assert.NoError(t, mender.CheckUpdateSpace(1000))
+	// unknown size
+	assert.NoError(t, mender.CheckUpdateSpace(-1))
+	assert.Equal(t, errInsufficientSpace, mender.CheckUpdateSpace(1001))
+
+	// the payloads may be for update modules, stored in the work directory
+	require.NoError(t, os.MkdirAll(mender.updateModules.Dir, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(mender.updateModules.Dir,
+		"docker"), []byte("#!/bin/sh\n"), 0755))
+	free, err := freeSpace(mender.updateModules.WorkDir)
+	require.NoError(t, err)
+	assert.NoError(t, mender.CheckUpdateSpace(1001))
+	assert.Equal(t, errInsufficientSpace, mender.CheckUpdateSpace(int64(free)+1))
+
+	// nothing to check against
+	mender = newTestMender(nil, menderConfig{}, testMenderPieces{})
+	mender.updateModules.Dir = path.Join(tdir, "none")
+	assert.NoError(t, mender.CheckUpdateSpace(1<<40))
+}
+
+func TestMenderArtifactProvides(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "provides")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	mender.artifactInfoFile = path.Join(tdir, "artifact_info")
+	require.NoError(t, ioutil.WriteFile(mender.artifactInfoFile,
+		[]byte("artifact_name=release-1\nartifact_group=prod\n"), 0644))
+
+	// provisioned device
+	provides, err := mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, installer.Provides{
+		installer.ProvidesArtifactName:  "release-1",
+		installer.ProvidesArtifactGroup: "prod",
+	}, provides)
+
+	// what the update provides takes effect once committed
+	require.NoError(t, storeProvides(mender.store, pendingArtifactProvidesKey,
+		installer.Provides{
+			installer.ProvidesArtifactName:   "release-2",
+			installer.ProvidesRootfsChecksum: "abc",
+		}))
+	require.NoError(t, ioutil.WriteFile(mender.artifactInfoFile,
+		[]byte("artifact_name=release-2\n"), 0644))
+	require.NoError(t, mender.CommitUpdate())
+	provides, err = mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, installer.Provides{
+		installer.ProvidesArtifactName:   "release-2",
+		installer.ProvidesRootfsChecksum: "abc",
+	}, provides)
+	_, err = mender.store.ReadAll(pendingArtifactProvidesKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// an image installed some other way does not provide the same
+	require.NoError(t, ioutil.WriteFile(mender.artifactInfoFile,
+		[]byte("artifact_name=release-3\n"), 0644))
+	provides, err = mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, installer.Provides{
+		installer.ProvidesArtifactName: "release-3",
+	}, provides)
+
+	// an artifact without rootfs image keeps providing its name on it
+	require.NoError(t, store.WriteTransaction(mender.store,
+		func(txn store.Transaction) error {
+			return mender.storeInstalledProvides(txn, installer.Provides{
+				installer.ProvidesArtifactName: "app-1",
+				"data-partition.app.version":   "1",
+			})
+		}))
+	provides, err = mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, installer.Provides{
+		installer.ProvidesArtifactName: "app-1",
+		"data-partition.app.version":   "1",
+	}, provides)
+
+	// rolling back drops what the update would have provided
+	require.NoError(t, storeProvides(mender.store, pendingArtifactProvidesKey,
+		installer.Provides{installer.ProvidesArtifactName: "release-4"}))
+	mender.RollbackPayloads()
+	_, err = mender.store.ReadAll(pendingArtifactProvidesKey)
+	assert.True(t, os.IsNotExist(err))
+	provides, err = mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, "app-1", provides[installer.ProvidesArtifactName])
+
+	// until a rootfs image is installed some other way
+	require.NoError(t, ioutil.WriteFile(mender.artifactInfoFile,
+		[]byte("artifact_name=release-5\n"), 0644))
+	provides, err = mender.InstalledProvides()
+	require.NoError(t, err)
+	assert.Equal(t, installer.Provides{
+		installer.ProvidesArtifactName: "release-5",
+	}, provides)
+}
+
 func TestMenderGetInventoryPollInterval(t *testing.T) {
 	mender := newTestMender(nil, menderConfig{
 		InventoryPollIntervalSeconds: 10,
@@ -410,6 +659,149 @@ func (a *testAuthManager) RemoveAuthToken() error {
 	return nil
 }
 
+func (a *testAuthManager) SetTenantToken(token []byte) error {
+	return nil
+}
+
+func (a *testAuthManager) GeneratePendingKey() error {
+	return nil
+}
+
+func (a *testAuthManager) PendingKey() client.AuthDataMessenger {
+	return nil
+}
+
+func (a *testAuthManager) KeyCreated() time.Time {
+	return time.Time{}
+}
+
+func TestMenderRenewExpiringToken(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	expired := makeTestJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-time.Hour).Unix()))
+	renewed := makeTestJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+
+	ms := store.NewMemStore()
+	ms.WriteAll(authTokenName, []byte(expired))
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	assert.Equal(t, expired, mender.authToken)
+
+	// the token is renewed before it is used
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte(renewed)
+	mender.authorizedRequest()
+	assert.True(t, srv.Auth.Called)
+	assert.Equal(t, renewed, mender.authToken)
+
+	// and kept while it is valid
+	srv.Auth.Called = false
+	mender.authorizedRequest()
+	assert.False(t, srv.Auth.Called)
+	assert.Equal(t, renewed, mender.authToken)
+}
+
+func TestMenderRotateKey(t *testing.T) {
+	// the server accepts the keys in accepted, issuing token for them
+	accepted := map[string]bool{}
+	tokens := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ard client.AuthReqData
+		if err := json.NewDecoder(r.Body).Decode(&ard); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !accepted[ard.Pubkey] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(tokens[ard.Pubkey]))
+	}))
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL},
+		testMenderPieces{MenderPieces: MenderPieces{store: ms}})
+	require.NoError(t, mender.authMgr.GenerateKey())
+	mam := mender.authMgr.(*MenderAuthManager)
+	oldPub, err := mam.keyStore.PublicPEM()
+	require.NoError(t, err)
+	accepted[oldPub] = true
+	tokens[oldPub] = "token1"
+	if merr := mender.Authorize(); merr != nil {
+		t.Fatal(merr.Cause())
+	}
+	assert.Equal(t, client.AuthToken("token1"), mender.authToken)
+
+	// the new key is pending until the server accepts it
+	switched, err := mender.RotateKey()
+	assert.NoError(t, err)
+	assert.False(t, switched)
+	pending := mender.authMgr.PendingKey()
+	require.NotNil(t, pending)
+	req, err := pending.MakeAuthRequest()
+	require.NoError(t, err)
+	var ard client.AuthReqData
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	newPub := ard.Pubkey
+	assert.NotEqual(t, oldPub, newPub)
+	pub, _ := mam.keyStore.PublicPEM()
+	assert.Equal(t, oldPub, pub)
+	assert.Equal(t, client.AuthToken("token1"), mender.authToken)
+
+	// rotating again keeps the pending key
+	switched, err = mender.RotateKey()
+	assert.NoError(t, err)
+	assert.False(t, switched)
+	req, err = mender.authMgr.PendingKey().MakeAuthRequest()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.Equal(t, newPub, ard.Pubkey)
+
+	// and the device switches once it is accepted
+	accepted[newPub] = true
+	tokens[newPub] = "token2"
+	mender.CheckKeyRotation()
+	assert.Nil(t, mender.authMgr.PendingKey())
+	pub, _ = mam.keyStore.PublicPEM()
+	assert.Equal(t, newPub, pub)
+	assert.Equal(t, client.AuthToken("token2"), mender.authToken)
+
+	// keys are rotated automatically once older than the interval
+	mender.config.KeyRotationIntervalDays = 30
+	mender.CheckKeyRotation()
+	assert.Nil(t, mender.authMgr.PendingKey())
+	ms.WriteAll(keyCreatedName,
+		[]byte(time.Now().Add(-31*24*time.Hour).UTC().Format(time.RFC3339)))
+	mender.CheckKeyRotation()
+	pending = mender.authMgr.PendingKey()
+	require.NotNil(t, pending)
+	req, err = pending.MakeAuthRequest()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(req.Data, &ard))
+	rotatedPub := ard.Pubkey
+
+	// the device authorizes with the pending key once the server rejects
+	// the current one
+	delete(accepted, newPub)
+	require.NoError(t, mender.authMgr.RemoveAuthToken())
+	accepted[rotatedPub] = true
+	tokens[rotatedPub] = "token3"
+	require.Nil(t, mender.Authorize())
+	assert.Equal(t, client.AuthToken("token3"), mender.authToken)
+	assert.Nil(t, mender.authMgr.PendingKey())
+	pub, _ = mam.keyStore.PublicPEM()
+	assert.Equal(t, rotatedPub, pub)
+}
+
 func TestMenderAuthorize(t *testing.T) {
 	runner := newTestOSCalls("", -1)
 
@@ -551,6 +943,47 @@ func TestMenderReportStatus(t *testing.T) {
 	assert.True(t, err.IsFatal())
 }
 
+func TestMenderReportDownloadProgress(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
+
+	update := client.UpdateResponse{ID: "foobar"}
+	mender.ReportDownloadProgress(update, utils.Progress{Current: 250, Total: 1000})
+	assert.True(t, srv.Status.Called)
+	assert.Equal(t, client.StatusDownloading, srv.Status.Status)
+	assert.Equal(t, "downloaded 250 of 1000 bytes (25%)", srv.Status.SubState)
+
+	// not reported again until the interval has passed
+	srv.Status.Called = false
+	mender.ReportDownloadProgress(update, utils.Progress{Current: 500, Total: 1000})
+	assert.False(t, srv.Status.Called)
+
+	mender.progressReported = time.Now().Add(-downloadProgressReportInterval)
+	mender.ReportDownloadProgress(update, utils.Progress{Current: 750})
+	assert.True(t, srv.Status.Called)
+	assert.Equal(t, "downloaded 750 bytes", srv.Status.SubState)
+
+	// nor is the next deployment held up by the last one
+	srv.Status.Called = false
+	mender.ReportDownloadProgress(client.UpdateResponse{ID: "bar"},
+		utils.Progress{Current: 100, Total: 1000})
+	assert.True(t, srv.Status.Called)
+}
+
 func TestMenderLogUpload(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -930,6 +1363,215 @@ func TestMenderInstallUpdate(t *testing.T) {
 
 }
 
+func TestMenderTimeouts(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.Equal(t, defaultRequestTimeout, mender.getTimeout(0))
+
+	var config menderConfig
+	config.Timeouts.RequestSeconds = 60
+	config.Timeouts.AuthSeconds = 10
+	mender = newTestMender(nil, config, testMenderPieces{})
+	assert.Equal(t, 10*time.Second, mender.getTimeout(config.Timeouts.AuthSeconds))
+	assert.Equal(t, time.Minute, mender.getTimeout(config.Timeouts.StatusReportSeconds))
+}
+
+func TestMenderPayloads(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "payloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	calls := path.Join(tdir, "calls")
+	module := path.Join(tdir, "app")
+	require.NoError(t, ioutil.WriteFile(module, []byte("#!/bin/sh\necho $1 >> "+
+		calls+"\n[ ! -e "+path.Join(tdir, "fail")+" ]\n"), 0755))
+	pending := func() installer.Payloads {
+		return installer.Payloads{
+			{Index: 0, Type: "rootfs-image", Status: installer.PayloadInstalled},
+			{Index: 1, Type: "app", Status: installer.PayloadInstalled,
+				Module: module, WorkDir: path.Join(tdir, "work")},
+		}
+	}
+	readCalls := func() string {
+		data, _ := ioutil.ReadFile(calls)
+		os.Remove(calls)
+		return string(data)
+	}
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	payloads, err := mender.Payloads()
+	assert.NoError(t, err)
+	assert.Nil(t, payloads)
+
+	// the module payloads are committed with the rootfs image
+	require.NoError(t, storePayloads(mender.store, pending()))
+	require.NoError(t, mender.CommitUpdate())
+	payloads, err = mender.Payloads()
+	require.NoError(t, err)
+	assert.Equal(t, installer.PayloadCommitted, payloads[0].Status)
+	assert.Equal(t, installer.PayloadCommitted, payloads[1].Status)
+	assert.Equal(t, "ArtifactCommit\nCleanup\n", readCalls())
+
+	// and rolled back with it
+	require.NoError(t, storePayloads(mender.store, pending()))
+	mender.RollbackPayloads()
+	payloads, err = mender.Payloads()
+	require.NoError(t, err)
+	assert.Equal(t, installer.PayloadRolledBack, payloads[0].Status)
+	assert.Equal(t, installer.PayloadRolledBack, payloads[1].Status)
+	assert.Equal(t, "ArtifactRollback\nCleanup\n", readCalls())
+	mender.RollbackPayloads()
+	assert.Equal(t, "", readCalls())
+
+	// a failing payload fails the commit
+	require.NoError(t, ioutil.WriteFile(path.Join(tdir, "fail"), nil, 0644))
+	require.NoError(t, storePayloads(mender.store, pending()))
+	assert.Error(t, mender.CommitUpdate())
+	payloads, err = mender.Payloads()
+	require.NoError(t, err)
+	assert.Equal(t, installer.PayloadRolledBack, payloads[0].Status)
+	assert.Equal(t, installer.PayloadFailed, payloads[1].Status)
+
+	// payloads of update modules only are installed when asked to, and
+	// leave the image alone when committed
+	os.Remove(path.Join(tdir, "fail"))
+	readCalls()
+	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: &fakeDevice{retCommit: errors.New("no update")},
+		},
+	})
+	require.NoError(t, storePayloads(mender.store, installer.Payloads{
+		{Index: 0, Type: "app", Status: installer.PayloadDownloaded,
+			Module: module, WorkDir: path.Join(tdir, "work")},
+	}))
+	assert.True(t, mender.ModuleUpdateOnly())
+	require.NoError(t, mender.InstallModulePayloads())
+	assert.Equal(t, "ArtifactInstall\n", readCalls())
+	require.NoError(t, mender.CommitUpdate())
+	payloads, err = mender.Payloads()
+	require.NoError(t, err)
+	assert.Equal(t, installer.PayloadCommitted, payloads[0].Status)
+	assert.Equal(t, "ArtifactCommit\nCleanup\n", readCalls())
+}
+
+func TestMenderFetchUpdateTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100000000")
+		w.Write([]byte("some"))
+		w.(http.Flusher).Flush()
+		// the download stalls
+		<-stalled
+	}))
+	defer ts.Close()
+	defer close(stalled)
+
+	var config menderConfig
+	config.Timeouts.DownloadSeconds = 1
+	config.RetryPollIntervalSeconds = 1
+	mender := newTestMender(nil, config, testMenderPieces{})
+
+	img, _, err := mender.FetchUpdate(ts.URL)
+	require.NoError(t, err)
+	defer img.Close()
+	start := time.Now()
+	_, err = ioutil.ReadAll(img)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 30*time.Second)
+}
+
+func TestMenderPauseDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("artifact"), 100000)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	img, _, err := mender.FetchUpdate(ts.URL)
+	require.NoError(t, err)
+	start := make([]byte, 100)
+	_, err = io.ReadFull(img, start)
+	require.NoError(t, err)
+
+	// the connection is closed while paused, and the download continues
+	// where it left off
+	mender.PauseDownload(true)
+	mender.PauseDownload(false)
+	rest, err := ioutil.ReadAll(img)
+	require.NoError(t, err)
+	assert.Equal(t, content, append(start, rest...))
+	assert.Equal(t, []string{"", "bytes=100-"}, ranges)
+
+	assert.NoError(t, img.Close())
+	assert.Nil(t, mender.activeDownload)
+}
+
+func TestMenderShutdownDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("artifact"), 100000)
+	var ranges []string
+	stalled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// in the middle of the download when stopped
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:2000])
+			w.(http.Flusher).Flush()
+			<-stalled
+			return
+		}
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	defer close(stalled)
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "release-1"
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	mender.artifactCache = &artifactCache{dir: dir}
+	img, size, err := mender.FetchUpdate(ts.URL)
+	require.NoError(t, err)
+	img = mender.CacheUpdate(update, img, size)
+	start := make([]byte, 1000)
+	_, err = io.ReadFull(img, start)
+	require.NoError(t, err)
+
+	// the download is interrupted, and what was read of it kept
+	mender.Shutdown()
+	assert.True(t, mender.ShuttingDown())
+	_, err = ioutil.ReadAll(img)
+	assert.Error(t, err)
+	mender.FinishCachedUpdate(update, err)
+	img.Close()
+	_, _, err = mender.FetchUpdate(ts.URL)
+	assert.Equal(t, errShuttingDown, err)
+
+	// and continued from once started again
+	ranges = nil
+	mender = newTestMender(nil, menderConfig{}, testMenderPieces{})
+	mender.artifactCache = &artifactCache{dir: dir}
+	img, size, err = mender.FetchUpdate(ts.URL)
+	require.NoError(t, err)
+	img = mender.CacheUpdate(update, img, size)
+	data, err := ioutil.ReadAll(img)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"", "bytes=2000-"}, ranges)
+	mender.FinishCachedUpdate(update, nil)
+	img.Close()
+	r, _ := mender.OpenCachedUpdate(update)
+	require.NotNil(t, r)
+	r.Close()
+}
+
 func TestMenderFetchUpdate(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -975,3 +1617,189 @@ func TestMenderFetchUpdate(t *testing.T) {
 
 	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
 }
+
+func TestMenderFetchUpdateParallel(t *testing.T) {
+	content := make([]byte, 4096)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	var ranges int32
+	serve := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				atomic.AddInt32(&ranges, 1)
+			}
+			http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+		}))
+	}
+	origin := serve()
+	defer origin.Close()
+	mirror := serve()
+	defer mirror.Close()
+
+	config := menderConfig{}
+	config.ParallelDownload.MinSizeBytes = 1024
+	config.ParallelDownload.ChunkSizeBytes = 1024
+	mender := newTestMender(nil, config, testMenderPieces{})
+
+	img, size, err := mender.FetchUpdate(origin.URL+"/artifact", mirror.URL+"/artifact")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(content), size)
+	data, err := ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&ranges))
+
+	// too small to split
+	atomic.StoreInt32(&ranges, 0)
+	config.ParallelDownload.MinSizeBytes = 8192
+	mender = newTestMender(nil, config, testMenderPieces{})
+	img, _, err = mender.FetchUpdate(origin.URL+"/artifact", mirror.URL+"/artifact")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&ranges))
+}
+
+func TestMenderDownloadPolicy(t *testing.T) {
+	content := make([]byte, 4096)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	// fewer connections, and a lower rate, than configured
+	config := menderConfig{}
+	config.ParallelDownload.MinSizeBytes = 1024
+	config.ParallelDownload.ChunkSizeBytes = 512
+	mender := newTestMender(nil, config, testMenderPieces{})
+	mender.SetDownloadPolicy(&client.DownloadPolicy{MaxConnections: 1, MaxRate: 2048})
+	start := time.Now()
+	img, _, err := mender.FetchUpdate(ts.URL + "/artifact")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&maxInFlight))
+	assert.True(t, time.Since(start) > 500*time.Millisecond)
+
+	// and the configured ones once the policy is cleared
+	atomic.StoreInt32(&maxInFlight, 0)
+	mender.SetDownloadPolicy(nil)
+	img, _, err = mender.FetchUpdate(ts.URL + "/artifact")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.True(t, atomic.LoadInt32(&maxInFlight) > 1)
+
+	// download windows
+	update := client.UpdateResponse{}
+	assert.Zero(t, mender.GetDownloadWindowWait(update))
+	update.DownloadPolicy = &client.DownloadPolicy{Windows: []string{"00:00-24:00"}}
+	assert.Zero(t, mender.GetDownloadWindowWait(update))
+	later := (time.Now().Hour() + 2) % 24
+	update.DownloadPolicy.Windows = []string{
+		fmt.Sprintf("%02d:00-%02d:00", later, (later+1)%24)}
+	wait := mender.GetDownloadWindowWait(update)
+	assert.True(t, wait > time.Hour && wait <= 2*time.Hour, wait)
+	update.DownloadPolicy.Windows = []string{"Foo 01:00-02:00"}
+	assert.Zero(t, mender.GetDownloadWindowWait(update))
+}
+
+func TestMenderLocalUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-updates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "artifact_info"),
+		[]byte("artifact_name=release-1"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "release-2.mender"),
+		[]byte("artifact"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, client.FileDeploymentDescriptor),
+		[]byte(`{"id": "usb", "artifact": {"artifact_name": "release-2",
+			"device_types_compatible": ["vexpress-qemu"],
+			"source": {"uri": "release-2.mender"}}}`), 0644))
+
+	mender := newTestMender(nil, menderConfig{ServerURL: "file://" + dir},
+		testMenderPieces{})
+	mender.artifactInfoFile = path.Join(dir, "artifact_info")
+
+	// there is no server to authorize with or report to
+	assert.True(t, mender.IsAuthorized())
+	assert.Nil(t, mender.Authorize())
+	assert.NoError(t, mender.InventoryRefresh())
+
+	update, merr := mender.CheckUpdate()
+	require.Nil(t, merr)
+	assert.Equal(t, "file://"+path.Join(dir, "release-2.mender"), update.URI())
+	assert.Nil(t, mender.ReportUpdateStatus(*update, client.StatusDownloading))
+	assert.Nil(t, mender.UploadLog(*update, []byte("{}")))
+
+	img, size, err := mender.FetchUpdate(update.URI())
+	require.NoError(t, err)
+	defer img.Close()
+	assert.Equal(t, int64(8), size)
+	data, err := ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	assert.Equal(t, "artifact", string(data))
+}
+
+func TestMenderUpdateControlAction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-control")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := path.Join(dir, "control-map.pub")
+	require.NoError(t, ioutil.WriteFile(key, []byte(PublicRSAKey), 0644))
+
+	raw := []byte(`{"id":"map1","states":{"ArtifactInstall_Enter":{"action":"pause"}}}`)
+	sig, err := artifact.NewSigner([]byte(PrivateRSAKey)).Sign(raw)
+	require.NoError(t, err)
+	update := client.UpdateResponse{
+		ID:               "foo",
+		UpdateControlMap: &client.SignedUpdateControlMap{Map: raw},
+	}
+
+	// unsigned maps fail the deployment unless allowed explicitly
+	mender := newDefaultTestMender()
+	assert.Equal(t, client.UpdateControlFail,
+		mender.UpdateControlAction(update, updateControlInstall))
+	assert.Equal(t, client.UpdateControlContinue,
+		mender.UpdateControlAction(client.UpdateResponse{ID: "foo"}, updateControlInstall))
+
+	mender = newTestMender(nil, menderConfig{UpdateControlMapAllowUnsigned: true},
+		testMenderPieces{})
+	assert.Equal(t, client.UpdateControlPause,
+		mender.UpdateControlAction(update, updateControlInstall))
+	assert.Equal(t, client.UpdateControlContinue,
+		mender.UpdateControlAction(update, updateControlCommit))
+
+	// unsigned maps fail the deployment once a key is configured, even
+	// if allowed without one
+	mender = newTestMender(nil, menderConfig{UpdateControlMapVerifyKey: key,
+		UpdateControlMapAllowUnsigned: true}, testMenderPieces{})
+	assert.Equal(t, client.UpdateControlFail,
+		mender.UpdateControlAction(update, updateControlInstall))
+	update.UpdateControlMap.Signature = string(sig)
+	assert.Equal(t, client.UpdateControlPause,
+		mender.UpdateControlAction(update, updateControlInstall))
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Reasons of failed update checks.
+const (
+	checkFailureUnauthorized = "unauthorized"
+	checkFailureTimeout      = "timeout"
+	checkFailureNetwork      = "network"
+	checkFailureServer       = "server"
+	checkFailureLocal        = "local"
+)
+
+// clientMetrics collects the health of the client for monitoring; they are
+// written in the Prometheus text format.
+type clientMetrics struct {
+	lock                sync.Mutex
+	updateChecks        int64
+	updateCheckFailures map[string]int64
+	lastCheck           time.Time
+	lastCheckSuccess    time.Time
+	downloadBytes       int64
+	downloadSeconds     float64
+	state               string
+
+	// node_exporter textfile collector file the metrics are written to on
+	// every state transition; not written if empty
+	textFile string
+}
+
+func newClientMetrics(textFile string) *clientMetrics {
+	return &clientMetrics{
+		updateCheckFailures: make(map[string]int64),
+		textFile:            textFile,
+	}
+}
+
+// checkFailureReason tells why an update check failed.
+func checkFailureReason(err error) string {
+	cause := errors.Cause(err)
+	if cause == client.ErrNotAuthorized {
+		return checkFailureUnauthorized
+	}
+	if cause == context.DeadlineExceeded {
+		return checkFailureTimeout
+	}
+	if nerr, ok := cause.(net.Error); ok {
+		if nerr.Timeout() {
+			return checkFailureTimeout
+		}
+		return checkFailureNetwork
+	}
+	// the server answered, if the error wraps an API error
+	for err != nil {
+		if _, ok := err.(*client.APIError); ok {
+			return checkFailureServer
+		}
+		causer, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return checkFailureNetwork
+}
+
+func (cm *clientMetrics) updateChecked(reason string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.updateChecks++
+	cm.lastCheck = time.Now()
+	if reason == "" {
+		cm.lastCheckSuccess = time.Now()
+	} else {
+		cm.updateCheckFailures[reason]++
+	}
+}
+
+func (cm *clientMetrics) downloaded(n int64, d time.Duration) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.downloadBytes += n
+	cm.downloadSeconds += d.Seconds()
+}
+
+// lastChecks returns when updates were last checked for, and when that last
+// succeeded; zero if never.
+func (cm *clientMetrics) lastChecks() (time.Time, time.Time) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.lastCheck, cm.lastCheckSuccess
+}
+
+// stateChanged records the current state and writes the text file.
+func (cm *clientMetrics) stateChanged(state string) error {
+	cm.lock.Lock()
+	cm.state = state
+	cm.lock.Unlock()
+	if cm.textFile == "" {
+		return nil
+	}
+	return cm.writeTextFile()
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (cm *clientMetrics) WriteTo(w io.Writer) (int64, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP mender_update_checks_total Update checks done.\n")
+	fmt.Fprintf(&buf, "# TYPE mender_update_checks_total counter\n")
+	fmt.Fprintf(&buf, "mender_update_checks_total %d\n", cm.updateChecks)
+
+	fmt.Fprintf(&buf, "# HELP mender_update_check_failures_total Failed update checks, by reason.\n")
+	fmt.Fprintf(&buf, "# TYPE mender_update_check_failures_total counter\n")
+	reasons := make([]string, 0, len(cm.updateCheckFailures))
+	for reason := range cm.updateCheckFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&buf, "mender_update_check_failures_total{reason=%q} %d\n",
+			reason, cm.updateCheckFailures[reason])
+	}
+
+	fmt.Fprintf(&buf, "# HELP mender_last_update_check_success_timestamp_seconds "+
+		"Time of the last successful update check.\n")
+	fmt.Fprintf(&buf, "# TYPE mender_last_update_check_success_timestamp_seconds gauge\n")
+	var last int64
+	if !cm.lastCheckSuccess.IsZero() {
+		last = cm.lastCheckSuccess.Unix()
+	}
+	fmt.Fprintf(&buf, "mender_last_update_check_success_timestamp_seconds %d\n", last)
+
+	fmt.Fprintf(&buf, "# HELP mender_download_bytes_total Bytes of artifacts downloaded.\n")
+	fmt.Fprintf(&buf, "# TYPE mender_download_bytes_total counter\n")
+	fmt.Fprintf(&buf, "mender_download_bytes_total %d\n", cm.downloadBytes)
+	fmt.Fprintf(&buf, "# HELP mender_download_seconds_total Time spent downloading artifacts.\n")
+	fmt.Fprintf(&buf, "# TYPE mender_download_seconds_total counter\n")
+	fmt.Fprintf(&buf, "mender_download_seconds_total %g\n", cm.downloadSeconds)
+
+	if cm.state != "" {
+		fmt.Fprintf(&buf, "# HELP mender_state Current state of the client.\n")
+		fmt.Fprintf(&buf, "# TYPE mender_state gauge\n")
+		fmt.Fprintf(&buf, "mender_state{state=%q} 1\n", cm.state)
+	}
+	return buf.WriteTo(w)
+}
+
+// writeTextFile replaces the text file atomically, so that the collector
+// never reads it half written.
+func (cm *clientMetrics) writeTextFile() error {
+	f, err := ioutil.TempFile(filepath.Dir(cm.textFile), ".mender-metrics")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write metrics")
+	}
+	defer os.Remove(f.Name())
+	if _, err := cm.WriteTo(f); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write metrics")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write metrics")
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write metrics")
+	}
+	if err := os.Rename(f.Name(), cm.textFile); err != nil {
+		return errors.Wrapf(err, "failed to write metrics")
+	}
+	return nil
+}
+
+// metricsReader records the bytes read from a download and the time spent on
+// it once closed.
+type metricsReader struct {
+	io.ReadCloser
+	metrics *clientMetrics
+	start   time.Time
+	n       int64
+	once    sync.Once
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *metricsReader) Close() error {
+	r.once.Do(func() {
+		r.metrics.downloaded(r.n, time.Since(r.start))
+	})
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCheckFailureReason(t *testing.T) {
+	rsp := &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{},
+		Body: ioutil.NopCloser(strings.NewReader(""))}
+	assert.Equal(t, checkFailureUnauthorized,
+		checkFailureReason(client.NewAPIError(client.ErrNotAuthorized, rsp)))
+	rsp.StatusCode = http.StatusInternalServerError
+	assert.Equal(t, checkFailureServer,
+		checkFailureReason(client.NewAPIError(errors.New("invalid response"), rsp)))
+	assert.Equal(t, checkFailureTimeout,
+		checkFailureReason(errors.Wrap(context.DeadlineExceeded, "request failed")))
+	assert.Equal(t, checkFailureTimeout,
+		checkFailureReason(errors.Wrap(timeoutError{}, "request failed")))
+	assert.Equal(t, checkFailureNetwork,
+		checkFailureReason(errors.New("connection refused")))
+}
+
+func TestClientMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	textFile := filepath.Join(dir, "mender.prom")
+
+	cm := newClientMetrics(textFile)
+	cm.updateChecked("")
+	cm.updateChecked(checkFailureServer)
+	cm.updateChecked(checkFailureNetwork)
+	cm.updateChecked(checkFailureNetwork)
+	cm.downloaded(1000, 2*time.Second)
+	require.NoError(t, cm.stateChanged("update-check"))
+
+	data, err := ioutil.ReadFile(textFile)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = cm.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, buf.String(), string(data))
+
+	metrics := string(data)
+	assert.Contains(t, metrics, "mender_update_checks_total 4\n")
+	assert.Contains(t, metrics, `mender_update_check_failures_total{reason="network"} 2`+"\n")
+	assert.Contains(t, metrics, `mender_update_check_failures_total{reason="server"} 1`+"\n")
+	assert.Contains(t, metrics, "mender_download_bytes_total 1000\n")
+	assert.Contains(t, metrics, "mender_download_seconds_total 2\n")
+	assert.Contains(t, metrics, `mender_state{state="update-check"} 1`+"\n")
+	assert.NotContains(t, metrics, "mender_last_update_check_success_timestamp_seconds 0\n")
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// the text file is optional
+	assert.NoError(t, newClientMetrics("").stateChanged("idle"))
+}
+
+func TestMenderMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/devices/v1/deployments") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("12345"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	artifactInfo := filepath.Join(dir, "artifact_info")
+	require.NoError(t, ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-1"), 0644))
+
+	mender := newTestMender(nil, menderConfig{ServerURL: ts.URL}, testMenderPieces{})
+	mender.artifactInfoFile = artifactInfo
+	mender.authToken = "token"
+	_, merr := mender.CheckUpdate()
+	assert.Nil(t, merr)
+
+	mender.updater = &client.UpdateClient{}
+	img, _, err := mender.FetchUpdate(ts.URL + "/artifact")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(img)
+	require.NoError(t, err)
+	img.Close()
+
+	var buf bytes.Buffer
+	_, err = mender.Metrics().WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "mender_update_checks_total 1\n")
+	assert.Contains(t, buf.String(), "mender_download_bytes_total 5\n")
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+const maxNotifyBackoff = 10 * time.Minute
+
+// updateNotifier subscribes to the MQTT topic the server publishes to when a
+// deployment is available for the device, checking for updates right away
+// instead of waiting for the next poll.
+type updateNotifier struct {
+	api    *client.ApiClient
+	sub    client.MQTTSubscription
+	notify func()
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startUpdateNotifier(api *client.ApiClient, config menderConfig,
+	notify func()) *updateNotifier {
+
+	n := &updateNotifier{
+		api: api,
+		sub: client.MQTTSubscription{
+			Broker:    config.UpdateNotifications.MQTTBroker,
+			ClientID:  config.UpdateNotifications.ClientID,
+			Username:  config.UpdateNotifications.Username,
+			Password:  config.UpdateNotifications.Password,
+			Topic:     config.UpdateNotifications.Topic,
+			KeepAlive: time.Duration(config.UpdateNotifications.KeepAliveSeconds) * time.Second,
+		},
+		notify: notify,
+		done:   make(chan struct{}),
+	}
+	var ctx context.Context
+	ctx, n.cancel = context.WithCancel(context.Background())
+	go n.run(ctx)
+	log.Infof("update notifications: subscribing to %s at %s", n.sub.Topic, n.sub.Broker)
+	return n
+}
+
+func (n *updateNotifier) Close() error {
+	n.cancel()
+	<-n.done
+	return nil
+}
+
+func (n *updateNotifier) run(ctx context.Context) {
+	defer close(n.done)
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := n.api.SubscribeMQTT(ctx, n.sub, func(msg client.MQTTMessage) {
+			log.Infof("update notifications: deployment available (%s)", msg.Topic)
+			n.notify()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		// the subscription was up for a while, rather than failing
+		if time.Since(start) > maxNotifyBackoff {
+			attempt = 0
+		}
+		wait, berr := client.GetExponentialBackoffTime(attempt, maxNotifyBackoff)
+		if berr != nil {
+			wait = maxNotifyBackoff
+		}
+		log.Warnf("update notifications: %v; retrying in %v", err, wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/require"
+)
+
+// readMQTTPacket reads a packet shorter than 128 bytes.
+func readMQTTPacket(r *bufio.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, make([]byte, header[1]))
+	return err
+}
+
+func TestUpdateNotifier(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// connect, subscribe and publish a deployment notification
+		readMQTTPacket(r)
+		conn.Write([]byte{0x20, 2, 0, 0})
+		readMQTTPacket(r)
+		conn.Write([]byte{0x90, 3, 0, 1, 0})
+		conn.Write([]byte{0x30, 7, 0, 5, 'd', 'e', 'p', 'l', 'y'})
+		readMQTTPacket(r)
+	}()
+
+	api, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	var config menderConfig
+	config.UpdateNotifications.MQTTBroker = "tcp://" + l.Addr().String()
+	config.UpdateNotifications.Topic = "deply"
+	notified := make(chan struct{}, 1)
+	n := startUpdateNotifier(api, config, func() {
+		notified <- struct{}{}
+	})
+	defer n.Close()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update check not forced")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Service type the artifacts shared with peers are announced as over mDNS.
+const peerService = "_mender-artifact._tcp"
+
+// Time peers are given to start serving an artifact.
+var peerRequestTimeout = 10 * time.Second
+
+// peerInstance returns the name of an mDNS instance an artifact is announced
+// as: a hash of the device type and the artifact name, which need not be a
+// valid DNS label, as artifacts of the same name may be built for other
+// device types, and of the SHA256 checksum of the artifact unless empty. The
+// artifacts are announced both with and without it, so that devices knowing
+// the checksum of the deployment find exactly that artifact.
+func peerInstance(deviceType, artifactName, checksum string) string {
+	sum := sha256.Sum256([]byte(deviceType + "\x00" + artifactName + "\x00" +
+		strings.ToLower(checksum)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// peerDistribution shares the artifacts of the cache, which have been
+// verified when they were installed, with devices on the local network,
+// and downloads artifacts from them rather than from the server:
+//
+//	GET /v1/artifacts/<artifact name>  the artifact
+type peerDistribution struct {
+	cache     *artifactCache
+	tls       *client.PeerTLS
+	discovery time.Duration
+	// looks for the addresses of the peers having an artifact
+	lookup    func(context.Context, string, string, time.Duration) ([]string, error)
+	listener  net.Listener
+	server    *http.Server
+	responder *client.MDNSResponder
+
+	mutex sync.Mutex
+	// addresses of the peers which served broken artifacts, or failed to
+	// serve them, not downloaded from again
+	rejected map[string]bool
+}
+
+func newPeerDistribution(config menderConfig, cache *artifactCache) (*peerDistribution, error) {
+	tls, err := client.NewPeerTLS(config.GetHttpConfig(),
+		config.PeerDistribution.CACertificate)
+	if err != nil {
+		return nil, err
+	}
+	return &peerDistribution{
+		cache:     cache,
+		tls:       tls,
+		discovery: config.peerDiscovery(),
+		lookup:    client.LookupMDNS,
+		rejected:  make(map[string]bool),
+	}, nil
+}
+
+// serve starts sharing the artifacts of the cache on addr, announcing them
+// over mDNS.
+func (p *peerDistribution) serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on peer distribution address")
+	}
+	responder, err := client.StartMDNSResponder(peerService,
+		l.Addr().(*net.TCPAddr).Port, p.has)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	p.listener = l
+	p.responder = responder
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(client.PeerArtifactsPath, p.handleArtifact)
+	p.server = &http.Server{
+		Handler:           mux,
+		TLSConfig:         p.tls.ServerConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := p.server.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Errorf("sharing artifacts with peers failed: %v", err)
+		}
+	}()
+	log.Infof("sharing cached artifacts with peers on %s", l.Addr())
+	return nil
+}
+
+func (p *peerDistribution) Close() error {
+	if p.responder != nil {
+		p.responder.Close()
+	}
+	if p.server != nil {
+		return p.server.Close()
+	}
+	return nil
+}
+
+// has tells whether the artifact announced as instance is in the cache.
+func (p *peerDistribution) has(instance string) bool {
+	for _, name := range p.cache.names() {
+		if peerInstance(p.cache.deviceType, name, "") == instance {
+			return true
+		}
+		sum := p.cache.checksum(name)
+		if sum != "" && peerInstance(p.cache.deviceType, name, sum) == instance {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *peerDistribution) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, client.PeerArtifactsPath)
+	f, err := os.Open(p.cache.path(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("serving artifact %s to peer %s", name, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// fetch starts downloading the artifact of the given name, and of the given
+// hex encoded SHA256 checksum unless empty, from the first of the peers
+// having it which serves it, returning it with its size and the address of
+// the peer, or nil if none does. Peers which served broken artifacts are
+// skipped.
+func (p *peerDistribution) fetch(ctx context.Context, artifactName, checksum string) (
+	io.ReadCloser, int64, string) {
+
+	instance := peerInstance(p.cache.deviceType, artifactName, checksum)
+	addrs, err := p.lookup(ctx, peerService, instance, p.discovery)
+	if err != nil {
+		log.Warnf("failed to look for peers having artifact %s: %v", artifactName, err)
+	}
+	for _, addr := range addrs {
+		if p.isRejected(addr) {
+			continue
+		}
+		r, size, err := p.tls.FetchPeerArtifact(ctx, addr, artifactName,
+			peerRequestTimeout)
+		if err != nil {
+			log.Warnf("not downloading artifact %s from peer: %v", artifactName, err)
+			continue
+		}
+		log.Infof("downloading artifact %s from peer %s", artifactName, addr)
+		return r, size, addr
+	}
+	return nil, 0, ""
+}
+
+// reject makes the peer at addr, which served a broken artifact or failed
+// to serve it, not be downloaded from again.
+func (p *peerDistribution) reject(addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rejected[addr] = true
+}
+
+func (p *peerDistribution) isRejected(addr string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rejected[addr]
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerInstance(t *testing.T) {
+	i := peerInstance("beaglebone", "release-1", "")
+	assert.Len(t, i, 32)
+	assert.Equal(t, i, peerInstance("beaglebone", "release-1", ""))
+	assert.NotEqual(t, i, peerInstance("beaglebone", "release-2", ""))
+	assert.NotEqual(t, i, peerInstance("raspberrypi4", "release-1", ""))
+	assert.NotEqual(t, i, peerInstance("beaglebone", "release-1", "abcd"))
+	assert.Equal(t, peerInstance("beaglebone", "release-1", "abcd"),
+		peerInstance("beaglebone", "release-1", "ABCD"))
+}
+
+// newTestPeers returns the peer distribution of a device caching artifacts
+// in dir, with the device certificate written there, which is its own CA.
+func newTestPeers(t *testing.T, dir string) *peerDistribution {
+	config := menderConfig{}
+	config.HttpsClient.Certificate = filepath.Join(dir, "device.crt")
+	config.HttpsClient.Key = filepath.Join(dir, "device.key")
+	config.ArtifactCache.Dir = filepath.Join(dir, "cache")
+	config.PeerDistribution.Enabled = true
+	config.PeerDistribution.CACertificate = config.HttpsClient.Certificate
+	config.PeerDistribution.DiscoverySeconds = 1
+	writeEnrolledCert(t, client.Enrollment{ClientCert: config.HttpsClient.Certificate,
+		ClientKey: config.HttpsClient.Key}, time.Hour)
+	cache := &artifactCache{dir: config.ArtifactCache.Dir, deviceType: "beaglebone"}
+	require.NoError(t, os.MkdirAll(cache.typeDir(), 0755))
+
+	p, err := newPeerDistribution(config, cache)
+	require.NoError(t, err)
+	return p
+}
+
+func TestPeerDistributionArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := newTestPeers(t, dir)
+
+	require.NoError(t, ioutil.WriteFile(p.cache.path("release/1"), []byte("artifact"), 0644))
+	require.NoError(t, ioutil.WriteFile(p.cache.partialPath("release-2"), []byte("art"), 0644))
+	assert.Equal(t, []string{"release/1"}, p.cache.names())
+	assert.True(t, p.has(peerInstance("beaglebone", "release/1", "")))
+	// nor are artifacts for other devices
+	assert.False(t, p.has(peerInstance("raspberrypi4", "release/1", "")))
+	// partial downloads are not shared
+	assert.False(t, p.has(peerInstance("beaglebone", "release-2", "")))
+	// artifacts are announced with their checksums once known
+	assert.False(t, p.has(peerInstance("beaglebone", "release/1", "abcd")))
+	require.NoError(t, ioutil.WriteFile(p.cache.path("release/1")+artifactChecksumSuffix,
+		[]byte("abcd\n"), 0644))
+	assert.True(t, p.has(peerInstance("beaglebone", "release/1", "abcd")))
+	assert.False(t, p.has(peerInstance("beaglebone", "release/1", "dcba")))
+
+	for path, code := range map[string]int{
+		"/v1/artifacts/release/1": http.StatusOK,
+		"/v1/artifacts/release-2": http.StatusNotFound,
+		"/v1/artifacts/":          http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		p.handleArtifact(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, code, w.Code, path)
+		if code == http.StatusOK {
+			assert.Equal(t, "artifact", w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	p.handleArtifact(w, httptest.NewRequest(http.MethodPut, "/v1/artifacts/release/1", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestPeerDistributionFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serving := newTestPeers(t, dir)
+	require.NoError(t, ioutil.WriteFile(serving.cache.path("release-1"), []byte("artifact"), 0644))
+	if err := serving.serve("127.0.0.1:0"); err != nil {
+		t.Skipf("can not announce artifacts over mDNS: %v", err)
+	}
+	defer serving.Close()
+
+	// the same certificate, as that is the CA of the serving device
+	var looked []string
+	fetching := &peerDistribution{
+		cache:     &artifactCache{dir: filepath.Join(dir, "other"), deviceType: "beaglebone"},
+		tls:       serving.tls,
+		discovery: time.Second,
+		lookup: func(ctx context.Context, service, instance string,
+			timeout time.Duration) ([]string, error) {
+
+			looked = append(looked, instance)
+			assert.Equal(t, peerService, service)
+			assert.Equal(t, time.Second, timeout)
+			return []string{"127.0.0.1:1", serving.listener.Addr().String()}, nil
+		},
+		rejected: make(map[string]bool),
+	}
+	r, size, addr := fetching.fetch(context.Background(), "release-1", "")
+	require.NotNil(t, r)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "artifact", string(data))
+	assert.Equal(t, int64(8), size)
+	assert.Equal(t, serving.listener.Addr().String(), addr)
+	assert.Equal(t, []string{peerInstance("beaglebone", "release-1", "")}, looked)
+
+	// looked for by checksum if known
+	looked = nil
+	r, _, _ = fetching.fetch(context.Background(), "release-1", "abcd")
+	require.NotNil(t, r)
+	r.Close()
+	assert.Equal(t, []string{peerInstance("beaglebone", "release-1", "abcd")}, looked)
+
+	// not served by the peer
+	r, _, _ = fetching.fetch(context.Background(), "release-2", "")
+	assert.Nil(t, r)
+
+	// peers which served broken artifacts are not downloaded from again
+	fetching.reject(addr)
+	r, _, _ = fetching.fetch(context.Background(), "release-1", "")
+	assert.Nil(t, r)
+}
+
+func TestMenderPeerUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serving := newTestPeers(t, dir)
+	require.NoError(t, ioutil.WriteFile(serving.cache.path("release-1"), []byte("artifact"), 0644))
+	if err := serving.serve("127.0.0.1:0"); err != nil {
+		t.Skipf("can not announce artifacts over mDNS: %v", err)
+	}
+	defer serving.Close()
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "release-1"
+
+	// not fetched from peers unless configured
+	r, _ := mender.FetchPeerUpdate(update)
+	assert.Nil(t, r)
+
+	mender.artifactCache = &artifactCache{dir: filepath.Join(dir, "other"),
+		deviceType: "beaglebone"}
+	mender.peers = &peerDistribution{
+		cache:     mender.artifactCache,
+		tls:       serving.tls,
+		discovery: time.Second,
+		lookup: func(context.Context, string, string, time.Duration) ([]string, error) {
+			return []string{serving.listener.Addr().String()}, nil
+		},
+		rejected: make(map[string]bool),
+	}
+	// cached once stored, to be shared in turn
+	r, size := mender.FetchPeerUpdate(update)
+	require.NotNil(t, r)
+	assert.EqualValues(t, 8, size)
+	r = mender.CacheUpdate(update, r, size)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "artifact", string(data))
+	assert.False(t, mender.FinishCachedUpdate(update, nil))
+	r.Close()
+	assert.Equal(t, []string{"release-1"}, mender.artifactCache.names())
+	sum := sha256.Sum256([]byte("artifact"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), mender.artifactCache.checksum("release-1"))
+
+	// failing to store it for the device's sake keeps the peer
+	require.NoError(t, mender.artifactCache.remove("release-1"))
+	r, _ = mender.FetchPeerUpdate(update)
+	require.NotNil(t, r)
+	r.Close()
+	assert.False(t, mender.FinishCachedUpdate(update, utils.WithErrorKind(
+		utils.ErrorKindStorage, errors.New("write failed"))))
+
+	// broken artifacts are not downloaded from the same peer again, but
+	// from the next one or the server, in the same deployment
+	r, _ = mender.FetchPeerUpdate(update)
+	require.NotNil(t, r)
+	r.Close()
+	assert.True(t, mender.FinishCachedUpdate(update, utils.WithErrorKind(
+		utils.ErrorKindArtifact, errors.New("invalid signature"))))
+	r, _ = mender.FetchPeerUpdate(update)
+	assert.Nil(t, r)
+}
+
+func TestMenderPeerUpdateFailed(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "release-1"
+	mender.artifactCache = &artifactCache{deviceType: "beaglebone"}
+	mender.peers = &peerDistribution{rejected: make(map[string]bool)}
+
+	// peers failing to serve the artifact are left for the next one
+	mender.peerArtifact = "192.0.2.1:8443"
+	assert.True(t, mender.FinishCachedUpdate(update, errors.New("connection reset")))
+	assert.True(t, mender.peers.isRejected("192.0.2.1:8443"))
+
+	// unless nothing was stored
+	mender.peerArtifact = "192.0.2.2:8443"
+	assert.False(t, mender.FinishCachedUpdate(update, errUpdateNotStored))
+	assert.False(t, mender.peers.isRejected("192.0.2.2:8443"))
+}
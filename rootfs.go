@@ -14,10 +14,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/mendersoftware/log"
@@ -30,17 +32,121 @@ import (
 // This will be run manually from command line ONLY
 func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 	vKey []byte) error {
-	var image io.ReadCloser
-	var imageSize int64
-	var err error
-	var upclient client.Updater
 
-	if args == (runOptionsType{}) {
+	if args.imageFile == nil {
 		return errors.New("rootfs called without needed parameters")
 	}
 
 	log.Debug("Starting device update.")
 
+	image, imageSize, cr, err := openImage(args)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	fmt.Fprintf(os.Stdout, "Installing update from the artifact of size %d\n", imageSize)
+	p := &utils.ProgressWriter{
+		Out: os.Stdout,
+		N:   imageSize,
+	}
+	tr := io.TeeReader(image, p)
+
+	rootfs, err := installer.InstallWithModules(ioutil.NopCloser(tr), dt, vKey, "",
+		device, *args.runStateScripts, &installer.UpdateModules{
+			Dir:     defaultModulesPath,
+			WorkDir: args.modulesWorkDir(),
+		})
+	if err != nil {
+		log.Errorf("Installation failed: %s", err.Error())
+		return err
+	}
+
+	// the partition must not be enabled unless the whole artifact matches
+	if cr != nil {
+		if err := cr.Verify(); err != nil {
+			log.Errorf("Verifying image failed: %s", err.Error())
+			return err
+		}
+	}
+
+	if !rootfs {
+		log.Info("Update installed by update modules; no reboot needed")
+		return nil
+	}
+
+	err = device.EnableUpdatedPartition()
+	if err != nil {
+		log.Errorf("Enabling updated partition failed: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// doVerifyRootfs verifies the artifact like doRootfs would before installing
+// it, against what the installed artifact provides, and prints what would be
+// installed without touching the device.
+func doVerifyRootfs(device installer.UInstaller, args runOptionsType, dt string,
+	vKey []byte, installed installer.Provides, out io.Writer) error {
+
+	if args.imageFile == nil {
+		return errors.New("rootfs called without needed parameters")
+	}
+
+	image, _, cr, err := openImage(args)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	deps := &installer.Dependencies{Installed: installed}
+	payloads, err := installer.VerifyArtifact(image, dt, vKey, device,
+		*args.runStateScripts, &installer.UpdateModules{
+			Dir:     defaultModulesPath,
+			WorkDir: args.modulesWorkDir(),
+		}, deps)
+	if err != nil {
+		log.Errorf("Verifying artifact failed: %s", err.Error())
+		return err
+	}
+	if cr != nil {
+		if err := cr.Verify(); err != nil {
+			log.Errorf("Verifying image failed: %s", err.Error())
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "Artifact %s verified; nothing was installed (dry run).\n",
+		deps.Provides[installer.ProvidesArtifactName])
+	for _, p := range payloads {
+		if p.Module != "" {
+			fmt.Fprintf(out, "Payload %d of type %s would be installed by %s\n",
+				p.Index, p.Type, p.Module)
+		} else {
+			fmt.Fprintf(out, "Payload %d of type %s would be installed to the inactive partition\n",
+				p.Index, p.Type)
+		}
+	}
+	keys := make([]string, 0, len(deps.Provides))
+	for key := range deps.Provides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "The device would provide %s: %s\n", key, deps.Provides[key])
+	}
+	return nil
+}
+
+// openImage opens the artifact given on the command line, a local file or a
+// URL, verifying its checksum if one was given once it has been read.
+func openImage(args runOptionsType) (io.ReadCloser, int64, *utils.ChecksumReader, error) {
+	var image io.ReadCloser
+	var imageSize int64
+	var err error
+	var upclient client.Updater
+
 	updateLocation := *args.imageFile
 	if strings.HasPrefix(updateLocation, "http:") ||
 		strings.HasPrefix(updateLocation, "https:") {
@@ -50,16 +156,18 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 		// we are having remote update
 		ac, err = client.New(args.Config)
 		if err != nil {
-			return errors.New("Can not initialize client for performing network update.")
+			return nil, 0, nil, errors.Wrapf(err,
+				"can not initialize client for performing network update")
 		}
 		upclient = client.NewUpdate()
 
 		log.Debug("Client initialized. Start downloading image.")
 
-		image, imageSize, err = upclient.FetchUpdate(ac, updateLocation, 0)
+		image, imageSize, err = upclient.FetchUpdate(context.Background(), ac, updateLocation, 0)
 		log.Debugf("Image downloaded: %d [%v] [%v]", imageSize, image, err)
 	} else {
 		// perform update from local file
+		updateLocation = strings.TrimPrefix(updateLocation, "file://")
 		log.Infof("Start updating from local image file: [%s]", updateLocation)
 		image, imageSize, err = FetchUpdateFromFile(updateLocation)
 
@@ -67,30 +175,26 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
 	}
 
 	if image == nil || err != nil {
-		return errors.Wrapf(err, "rootfs: error while updating image from command line")
+		return nil, 0, nil, errors.Wrapf(err, "rootfs: error while updating image from command line")
 	}
-	defer image.Close()
-
-	fmt.Fprintf(os.Stdout, "Installing update from the artifact of size %d\n", imageSize)
-	p := &utils.ProgressWriter{
-		Out: os.Stdout,
-		N:   imageSize,
-	}
-	tr := io.TeeReader(image, p)
 
-	err = installer.Install(ioutil.NopCloser(tr), dt, vKey, "", device, *args.runStateScripts)
-	if err != nil {
-		log.Errorf("Installation failed: %s", err.Error())
-		return err
+	var cr *utils.ChecksumReader
+	if args.checksum != nil && *args.checksum != "" {
+		cr, err = utils.NewChecksumReader(image, *args.checksum)
+		if err != nil {
+			image.Close()
+			return nil, 0, nil, errors.Wrapf(err, "rootfs: can not verify image")
+		}
+		image = cr
 	}
+	return image, imageSize, cr, nil
+}
 
-	err = device.EnableUpdatedPartition()
-	if err != nil {
-		log.Errorf("Enabling updated partition failed: %s", err.Error())
-		return err
+func (args runOptionsType) modulesWorkDir() string {
+	if args.modulesWorkPath == "" {
+		return defaultModulesWorkPath
 	}
-
-	return nil
+	return args.modulesWorkPath
 }
 
 // FetchUpdateFromFile returns a byte stream of the given file, size of the file
@@ -14,13 +14,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -129,3 +134,87 @@ func Test_doManualUpdate_existingFile_updateSuccess(t *testing.T) {
 	err = doRootfs(dev, fakeRunOptions, "vexpress-qemu", nil)
 	assert.NoError(t, err)
 }
+
+func Test_doManualUpdate_checksum(t *testing.T) {
+	artifact, err := MakeRootfsImageArtifact(1, false)
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "update")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), artifact)
+	assert.NoError(t, err)
+	f.Close()
+
+	imageFileName := f.Name()
+	forceRunScriptsFlag := false
+
+	for _, tc := range []struct {
+		checksum string
+		ok       bool
+	}{
+		{hex.EncodeToString(h.Sum(nil)), true},
+		{strings.Repeat("00", sha256.Size), false},
+		{"not-a-checksum", false},
+	} {
+		checksum := tc.checksum
+		fakeRunOptions := runOptionsType{
+			imageFile:       &imageFileName,
+			runStateScripts: &forceRunScriptsFlag,
+			checksum:        &checksum,
+		}
+		err = doRootfs(fakeDevice{consumeUpdate: true}, fakeRunOptions,
+			"vexpress-qemu", nil)
+		if tc.ok {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err, "checksum: %s", tc.checksum)
+		}
+	}
+}
+
+func Test_doVerifyRootfs(t *testing.T) {
+	artifact, err := MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "update")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), artifact)
+	assert.NoError(t, err)
+	f.Close()
+
+	imageFileName := f.Name()
+	forceRunScriptsFlag := false
+	checksum := hex.EncodeToString(h.Sum(nil))
+	fakeRunOptions := runOptionsType{
+		imageFile:       &imageFileName,
+		runStateScripts: &forceRunScriptsFlag,
+		checksum:        &checksum,
+	}
+	// the device fails if anything is installed to it
+	dev := fakeDevice{
+		retInstallUpdate: errors.New("installed"),
+		retEnablePart:    errors.New("enabled"),
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = doVerifyRootfs(dev, fakeRunOptions, "vexpress-qemu", nil,
+		installer.Provides{"artifact_name": "mender-1.0"}, out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Artifact mender-1.1 verified")
+	assert.Contains(t, out.String(),
+		"Payload 0 of type rootfs-image would be installed to the inactive partition")
+	assert.Contains(t, out.String(), "The device would provide artifact_name: mender-1.1")
+
+	err = doVerifyRootfs(dev, fakeRunOptions, "other-device", nil, nil, ioutil.Discard)
+	assert.Error(t, err)
+
+	checksum = strings.Repeat("00", sha256.Size)
+	err = doVerifyRootfs(dev, fakeRunOptions, "vexpress-qemu", nil, nil, ioutil.Discard)
+	assert.Error(t, err)
+}
@@ -16,12 +16,15 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"math/rand"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -84,6 +87,11 @@ import (
 //                                  | (update fetched)                |
 //                                  v                                 |
 //                                                                    |
+//                             maintenance wait  (outside window)     |
+//                                                                    |
+//                                  |                                 |
+//                                  v                                 |
+//                                                                    |
 //                            update install -------------------------+
 //
 //                                  |
@@ -139,6 +147,15 @@ type StateContext struct {
 	lastUpdateCheck      time.Time
 	lastInventoryUpdate  time.Time
 	fetchInstallAttempts int
+	// time of the first failed fetch/install attempt
+	fetchInstallRetryStart time.Time
+	checkUpdateAttempts    int
+	// time of the first failed update check
+	checkUpdateRetryStart time.Time
+	// random delay added to the update poll interval in the current cycle
+	updateCheckSplay time.Duration
+	// poll interval of the current cycle asked for by the server, if any
+	updatePollHint time.Duration
 }
 
 type StateRunner interface {
@@ -232,6 +249,7 @@ type WaitState interface {
 	Id() MenderState
 	Wake() bool
 	Cancel() bool
+	Recheck()
 	Wait(next, same State, wait time.Duration) (State, bool)
 	Transition() Transition
 	SetTransition(t Transition)
@@ -275,6 +293,8 @@ type waitState struct {
 	baseState
 	cancel chan bool
 	wakeup chan bool
+	// pending until the next wait if not waiting
+	recheck chan bool
 }
 
 func NewWaitState(id MenderState, t Transition) WaitState {
@@ -282,6 +302,7 @@ func NewWaitState(id MenderState, t Transition) WaitState {
 		baseState: baseState{id: id, t: t},
 		cancel:    make(chan bool),
 		wakeup:    make(chan bool),
+		recheck:   make(chan bool, 1),
 	}
 }
 
@@ -299,6 +320,9 @@ func (ws *waitState) Wait(next, same State,
 	case <-ws.wakeup:
 		log.Info("forced wake-up from sleep")
 		return next, false
+	case <-ws.recheck:
+		log.Debugf("wait interrupted to be recalculated")
+		return same, false
 	case <-ws.cancel:
 		log.Infof("wait canceled")
 	}
@@ -310,6 +334,16 @@ func (ws *waitState) Wake() bool {
 	return true
 }
 
+// Recheck makes the state return itself from the wait, rather than the next
+// state, so that it is handled again, e.g. with the poll intervals of a
+// reloaded configuration.
+func (ws *waitState) Recheck() {
+	select {
+	case ws.recheck <- true:
+	default:
+	}
+}
+
 func (ws *waitState) Cancel() bool {
 	ws.cancel <- true
 	return true
@@ -401,6 +435,34 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 		c.SetNextState(NewUpdateCommitState(sd.UpdateInfo))
 		return idleState, false
 
+	// Interrupted while downloading; the inactive partition was not
+	// activated yet so it is safe to download the update again
+	case MenderStateUpdateFetch, MenderStateUpdateStore:
+		log.Infof("update download was interrupted, restarting")
+		return NewUpdateFetchState(sd.UpdateInfo), false
+
+	// The update was downloaded and is not enabled yet
+	case MenderStateMaintenanceWait:
+		return NewMaintenanceWaitState(sd.UpdateInfo), false
+
+	// The deployment was paused by its update control map
+	case MenderStateUpdateControlPause:
+		for point, status := range updateControlPauseStatus {
+			if status == sd.UpdateStatus {
+				return NewUpdateControlPauseState(sd.UpdateInfo, point), false
+			}
+		}
+		me := NewFatalError(errors.Errorf("got invalid paused state stored: %v",
+			sd.UpdateStatus))
+		return NewUpdateErrorState(me, sd.UpdateInfo), false
+
+	// Resend the status report that was interrupted
+	case MenderStateUpdateStatusReport:
+		if sd.UpdateStatus != "" {
+			return NewUpdateStatusReportState(sd.UpdateInfo, sd.UpdateStatus), false
+		}
+		fallthrough
+
 	// invalid entrypoint into the state-machine. Error out.
 	default:
 		if err := DeploymentLogger.Enable(sd.UpdateInfo.ID); err != nil {
@@ -493,6 +555,9 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	}
 
 	if has {
+		if s := checkUpdateControl(c, uv.Update(), updateControlCommit); s != nil {
+			return s, false
+		}
 		return NewUpdateCommitState(uv.Update()), false
 	}
 
@@ -526,39 +591,64 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 
 	log.Debugf("handle update commit state")
 
-	artifactName, err := c.GetCurrentArtifactName()
+	// artifacts of module payloads only leave the running image as it is,
+	// hence there is no image to check nor to reboot out of
+	artifactName := uc.Update().ArtifactName()
+	reboot := !c.ModuleUpdateOnly()
+	if reboot {
+		runningName, err := c.GetCurrentArtifactName()
 
-	if err != nil {
-		log.Errorf("Cannot determine name of new artifact. Update will not continue: %v : %v", defaultDeviceTypeFile, err)
-		return NewRollbackState(uc.Update(), false, true), false
-	} else if uc.Update().ArtifactName() != artifactName {
-		// seems like we're running in a different image than expected from update
-		// information, best report an error
-		// this can ONLY happen if the artifact name does not match information
-		// stored in `/etc/mender/artifact_info` file
-		log.Errorf("running with image %v, expected updated image %v",
-			artifactName, uc.Update().ArtifactName())
+		if err != nil {
+			log.Errorf("Cannot determine name of new artifact. Update will not continue: %v", err)
+			return NewRollbackState(uc.Update(), false, true), false
+		} else if artifactName != runningName {
+			// seems like we're running in a different image than expected from update
+			// information, best report an error
+			// this can ONLY happen if the artifact name does not match information
+			// stored in `/etc/mender/artifact_info` file
+			log.Errorf("running with image %v, expected updated image %v",
+				runningName, artifactName)
+
+			return NewRollbackState(uc.Update(), false, true), false
+		}
 
-		return NewRollbackState(uc.Update(), false, true), false
+		// update info and has upgrade flag are there, we're running the new
+		// update, everything looks good, proceed with committing
+		log.Infof("successfully running with new image %v", artifactName)
 	}
 
-	// update info and has upgrade flag are there, we're running the new
-	// update, everything looks good, proceed with committing
-	log.Infof("successfully running with new image %v", artifactName)
-
 	// check if state scripts version is supported
-	if err = c.CheckScriptsCompatibility(); err != nil {
+	if err := c.CheckScriptsCompatibility(); err != nil {
+		log.Errorf("update commit failed: %s", err)
+		return NewRollbackState(uc.Update(), false, reboot), false
+	}
+
+	// the new image must be committed within the configured time after
+	// booting it, otherwise it is considered broken
+	if timeout := c.GetUpdateCommitTimeout(); reboot && timeout > 0 {
+		uptime, err := systemUptime()
+		if err != nil {
+			log.Warnf("can not determine system uptime: %v", err)
+		} else if uptime > timeout {
+			log.Errorf("update not committed within %v after boot, rolling back",
+				timeout)
+			return NewRollbackState(uc.Update(), false, true), false
+		}
+	}
+
+	// let the device application test the new image before committing
+	if err := c.CheckUpdateCommit(artifactName); err != nil {
 		log.Errorf("update commit failed: %s", err)
-		return NewRollbackState(uc.Update(), false, true), false
+		return NewRollbackState(uc.Update(), false, reboot), false
 	}
 
-	err = c.CommitUpdate()
+	err := c.CommitUpdate()
 	if err != nil {
 		log.Errorf("update commit failed: %s", err)
 		// we need to perform roll-back here; one scenario is when u-boot fw utils
 		// won't work after update; at this point without rolling-back it won't be
 		// possible to perform new update
-		return NewRollbackState(uc.Update(), false, true), false
+		return NewRollbackState(uc.Update(), false, reboot), false
 	}
 
 	log.Info("Storing commit state data")
@@ -581,6 +671,18 @@ type UpdateCheckState struct {
 func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle update check state")
 	ctx.lastUpdateCheck = time.Now()
+	// spread update checks of multiple devices over time
+	ctx.updateCheckSplay = 0
+	ctx.updatePollHint = 0
+	if splay := c.GetUpdatePollSplay(); splay > 0 {
+		ctx.updateCheckSplay = time.Duration(rand.Int63n(int64(splay)))
+	}
+
+	// not counted as a failed check, which would be retried right away
+	if !c.IsOnline() {
+		log.Debugf("device is offline; skipping update check")
+		return checkWaitState, false
+	}
 
 	update, err := c.CheckUpdate()
 
@@ -590,14 +692,33 @@ func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 			// Just report successful update and return to normal operations.
 			return NewUpdateStatusReportState(*update, client.StatusAlreadyInstalled), false
 		}
+		if err.Cause() == errIncompatibleArtifact {
+			return NewUpdateStatusReportState(*update, client.StatusFailure), false
+		}
 
 		log.Errorf("update check failed: %s", err)
+		// retrying is pointless if the device needs to be authorized first
+		if !err.IsFatal() && utils.ErrorKindOf(err) != utils.ErrorKindAuth {
+			return NewCheckUpdateRetryState(err), false
+		}
 		return NewErrorState(err), false
 	}
 
+	// restart counter so that we are able to retry next time
+	ctx.checkUpdateAttempts = 0
+
 	if update != nil {
+		if err := c.CheckDeploymentFilters(*update); err != nil {
+			log.Infof("deferring update %s until the next update check: %v",
+				update.ArtifactName(), err)
+			if merr := c.ReportUpdateStatus(*update, client.StatusDeferred); merr != nil {
+				log.Errorf("failed to report deferred update: %v", merr)
+			}
+			return checkWaitState, false
+		}
 		return NewUpdateFetchState(*update), false
 	}
+	ctx.updatePollHint = c.GetUpdatePollHint()
 	return checkWaitState, false
 }
 
@@ -632,20 +753,146 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
+	if !c.IsOnline() {
+		return NewOfflineWaitState(u.update), false
+	}
+
+	if s := checkUpdateControl(c, u.update, updateControlDownload); s != nil {
+		return s, false
+	}
+
+	in, size := c.OpenCachedUpdate(u.update)
+	fetched := in == nil
+	// peers on the local network do not use the uplink the download
+	// windows are about
+	if in == nil {
+		if in, size = c.FetchPeerUpdate(u.update); in != nil {
+			in = c.CacheUpdate(u.update, in, size)
+		}
+	}
+	if in == nil && c.GetDownloadWindowWait(u.update) > 0 {
+		return NewDownloadWaitState(u.update), false
+	}
+
 	merr := c.ReportUpdateStatus(u.update, client.StatusDownloading)
 	if merr != nil && merr.IsFatal() {
+		if in != nil {
+			in.Close()
+		}
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	in, size, err := c.FetchUpdate(u.update.URI())
-	if err != nil {
-		log.Errorf("update fetch failed: %s", err)
-		return NewFetchStoreRetryState(u, u.update, err), false
+	if in == nil {
+		c.SetDownloadPolicy(u.update.DownloadPolicy)
+		if u.update.LinkExpired(time.Now()) {
+			if s := u.refreshLink(c); s != nil {
+				return s, false
+			}
+		}
+		var err error
+		for _, uri := range u.update.DownloadURIs() {
+			in, size, err = c.FetchUpdate(uri, u.update.Mirrors()...)
+			if err == nil {
+				break
+			}
+			log.Errorf("update fetch from %s failed: %s", uri, err)
+		}
+		if err != nil {
+			if c.ShuttingDown() {
+				return shutdownCheckpoint(ctx, c, u.update), false
+			}
+			// the artifact does not get any better by downloading it again
+			if utils.ErrorKindOf(err) == utils.ErrorKindArtifact {
+				return NewUpdateStatusReportState(u.update, client.StatusFailure), false
+			}
+			return NewFetchStoreRetryState(u, u.update, err), false
+		}
+		in = c.CacheUpdate(u.update, in, size)
+	}
+	if fetched {
+		update := u.update
+		in = &utils.ProgressReader{
+			ReadCloser: in,
+			N:          size,
+			Interval:   downloadProgressInterval,
+			Callback: func(p utils.Progress) {
+				c.ReportDownloadProgress(update, p)
+			},
+		}
+	}
+
+	// fail before writing anything rather than running out of space
+	if err := c.CheckUpdateSpace(size); err != nil {
+		in.Close()
+		log.Errorf("update can not be installed: %v", err)
+		return NewUpdateStatusReportState(u.update, client.StatusInsufficientSpace), false
+	}
+
+	if checksums := u.update.Checksums(); len(checksums) > 0 {
+		cr, err := utils.NewChecksumReader(in, supportedChecksums(checksums)...)
+		if err != nil {
+			in.Close()
+			log.Errorf("can not verify update: %s", err)
+			return NewUpdateStatusReportState(u.update, client.StatusFailure), false
+		}
+		in = cr
 	}
 
 	return NewUpdateStoreState(in, size, u.update), false
 }
 
+// refreshLink checks for the update again to get a new link to the artifact,
+// once the one of the deployment has expired, e.g. while waiting to retry the
+// download.
+func (u *UpdateFetchState) refreshLink(c Controller) State {
+	log.Infof("link to the artifact of deployment %s has expired, checking for the update again",
+		u.update.ID)
+	update, err := c.CheckUpdate()
+	if err != nil {
+		return NewFetchStoreRetryState(u, u.update, err)
+	}
+	if update == nil || update.ID != u.update.ID {
+		log.Errorf("deployment %s is not pending anymore", u.update.ID)
+		return NewUpdateStatusReportState(u.update, client.StatusFailure)
+	}
+	u.update = *update
+	return nil
+}
+
+// shutdownCheckpoint pauses the deployment interrupted while downloading the
+// update, as the daemon is stopping. The deployment is resumed by downloading
+// the update again once the daemon is started again; from where it was
+// interrupted, if the artifacts are cached. The daemon stops right away.
+func shutdownCheckpoint(ctx *StateContext, c Controller, update client.UpdateResponse) State {
+	log.Infof("pausing deployment %s until the daemon is started again", update.ID)
+	if err := StoreStateData(ctx.store, StateData{
+		Name:         MenderStateUpdateFetch,
+		UpdateInfo:   update,
+		UpdateStatus: client.StatusPausedByShutdown,
+	}); err != nil {
+		log.Errorf("failed to store state data on shutdown: %v", err)
+	}
+	if merr := c.ReportUpdateStatus(update, client.StatusPausedByShutdown); merr != nil {
+		log.Warnf("failed to report deployment paused by shutdown: %v", merr)
+	}
+	return doneState
+}
+
+// supportedChecksums leaves out the checksums of algorithms which can not be
+// verified, from a server providing further ones.
+func supportedChecksums(checksums []string) []string {
+	var supported []string
+	for _, c := range checksums {
+		if algorithm, _ := utils.SplitChecksum(c); !utils.DigestSupported(algorithm) {
+			log.Warnf("not verifying %s checksum of the update: algorithm not supported",
+				algorithm)
+			continue
+		}
+		supported = append(supported, c)
+	}
+	return supported
+}
+
 func (uf *UpdateFetchState) Update() client.UpdateResponse {
 	return uf.update
 }
@@ -671,11 +918,21 @@ func NewUpdateStoreState(in io.ReadCloser, size int64, update client.UpdateRespo
 	}
 }
 
-func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool) {
+func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (next State, cancel bool) {
 
 	// make sure to close the stream with image data
 	defer u.imagein.Close()
 
+	// the artifact is cached once stored; a broken one from the cache or
+	// a peer is fetched again from the next of them, or the server
+	storeErr := errUpdateNotStored
+	defer func() {
+		if c.FinishCachedUpdate(u.update, storeErr) {
+			log.Info("fetching the artifact again from elsewhere")
+			next, cancel = NewUpdateFetchState(u.update), false
+		}
+	}()
+
 	// start deployment logging
 	if err := DeploymentLogger.Enable(u.update.ID); err != nil {
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
@@ -697,10 +954,37 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 	}
 
 	if err := c.InstallUpdate(u.imagein, u.size); err != nil {
+		storeErr = err
+		if c.ShuttingDown() {
+			log.Infof("update download interrupted: %s", err)
+			return shutdownCheckpoint(ctx, c, u.update), false
+		}
 		log.Errorf("update install failed: %s", err)
+		// retrying does not make more space
+		if isNoSpaceError(err) {
+			return NewUpdateStatusReportState(u.update, client.StatusInsufficientSpace), false
+		}
+		// nor does it repair broken artifacts or storage; the payloads
+		// installed already are rolled back once the failure is reported
+		switch kind := utils.ErrorKindOf(err); kind {
+		case utils.ErrorKindArtifact, utils.ErrorKindStorage:
+			log.Errorf("not retrying the update: %s error", kind)
+			return NewUpdateStatusReportState(u.update, client.StatusFailure), false
+		}
 		return NewFetchStoreRetryState(u, u.update, err), false
 	}
 
+	// the installer may not consume trailing data of the artifact, hence
+	// the checksum needs to be verified explicitly
+	if cr, ok := u.imagein.(*utils.ChecksumReader); ok {
+		if err := cr.Verify(); err != nil {
+			storeErr = utils.WithErrorKind(utils.ErrorKindArtifact, err)
+			log.Errorf("update verification failed: %s", err)
+			return NewFetchStoreRetryState(u, u.update, err), false
+		}
+	}
+	storeErr = nil
+
 	// restart counter so that we are able to retry next time
 	ctx.fetchInstallAttempts = 0
 
@@ -712,13 +996,216 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	return NewUpdateInstallState(u.update), false
+	if s := checkUpdateControl(c, u.update, updateControlInstall); s != nil {
+		return s, false
+	}
+	return installState(c, u.update), false
+}
+
+// installState returns the state installing the stored update, waiting for
+// the next maintenance window first if need be.
+func installState(c Controller, update client.UpdateResponse) State {
+	if c.GetMaintenanceWindowWait() > 0 {
+		return NewMaintenanceWaitState(update)
+	}
+	return NewUpdateInstallState(update)
+}
+
+// isNoSpaceError tells if the error is due to a full device.
+func isNoSpaceError(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *os.PathError:
+		return cause.Err == syscall.ENOSPC
+	case *os.SyscallError:
+		return cause.Err == syscall.ENOSPC
+	default:
+		return cause == syscall.ENOSPC
+	}
 }
 
 func (us *UpdateStoreState) Update() client.UpdateResponse {
 	return us.update
 }
 
+// MaintenanceWaitState defers installing a downloaded update, and rebooting,
+// until the device is inside a maintenance window.
+type MaintenanceWaitState struct {
+	WaitState
+	update client.UpdateResponse
+}
+
+func NewMaintenanceWaitState(update client.UpdateResponse) State {
+	return &MaintenanceWaitState{
+		WaitState: NewWaitState(MenderStateMaintenanceWait, ToDownload),
+		update:    update,
+	}
+}
+
+func (m *MaintenanceWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	wait := c.GetMaintenanceWindowWait()
+	if wait <= 0 {
+		log.Info("inside maintenance window; installing update")
+		return NewUpdateInstallState(m.update), false
+	}
+
+	// keep waiting if the daemon is restarted meanwhile; the downloaded
+	// image is not enabled yet
+	if err := StoreStateData(ctx.store, StateData{
+		Name:       m.Id(),
+		UpdateInfo: m.update,
+	}); err != nil {
+		log.Errorf("failed to store state data in maintenance wait state: %v", err)
+		return NewUpdateStatusReportState(m.update, client.StatusFailure), false
+	}
+
+	merr := c.ReportUpdateStatus(m.update, client.StatusPauseBeforeInstalling)
+	if merr != nil && merr.IsFatal() {
+		return NewUpdateStatusReportState(m.update, client.StatusFailure), false
+	}
+
+	// check at least once per poll interval whether the deployment has
+	// been aborted meanwhile
+	if intvl := c.GetUpdatePollInterval(); intvl > 0 && wait > intvl {
+		wait = intvl
+	}
+	log.Infof("update installation deferred until the next maintenance window; "+
+		"waiting %v", wait)
+	return m.Wait(m, m, wait)
+}
+
+func (m *MaintenanceWaitState) Update() client.UpdateResponse {
+	return m.update
+}
+
+// Points of a deployment update control maps may pause it at, named after
+// the state scripts run once the deployment continues.
+const (
+	updateControlDownload = "Download_Enter"
+	updateControlInstall  = "ArtifactInstall_Enter"
+	updateControlCommit   = "ArtifactCommit_Enter"
+)
+
+// statuses reported while a deployment is paused at the points
+var updateControlPauseStatus = map[string]string{
+	updateControlDownload: client.StatusPauseBeforeDownloading,
+	updateControlInstall:  client.StatusPauseBeforeInstalling,
+	updateControlCommit:   client.StatusPauseBeforeCommitting,
+}
+
+// How often the update control map of a paused deployment is fetched again
+// if no update poll interval is configured.
+var updateControlRefreshInterval = time.Minute
+
+// checkUpdateControl returns the state pausing or failing the deployment at
+// point, as its update control map says, or nil if it continues.
+func checkUpdateControl(c Controller, update client.UpdateResponse, point string) State {
+	switch c.UpdateControlAction(update, point) {
+	case client.UpdateControlPause:
+		log.Infof("deployment paused by its update control map at %s", point)
+		return NewUpdateControlPauseState(update, point)
+	case client.UpdateControlFail:
+		log.Errorf("deployment failed by its update control map at %s", point)
+		return failUpdateControl(update, point)
+	}
+	return nil
+}
+
+func failUpdateControl(update client.UpdateResponse, point string) State {
+	// the device is running the uncommitted update already
+	if point == updateControlCommit {
+		return NewRollbackState(update, false, true)
+	}
+	return NewUpdateStatusReportState(update, client.StatusFailure)
+}
+
+// UpdateControlPauseState pauses a deployment at a point, until the server
+// releases it by updating, or removing, its update control map.
+type UpdateControlPauseState struct {
+	WaitState
+	update client.UpdateResponse
+	point  string
+}
+
+func NewUpdateControlPauseState(update client.UpdateResponse, point string) State {
+	// the state scripts of the point are run once the deployment continues
+	t := ToDownload
+	if point == updateControlCommit {
+		t = ToArtifactReboot_Leave
+	}
+	return &UpdateControlPauseState{
+		WaitState: NewWaitState(MenderStateUpdateControlPause, t),
+		update:    update,
+		point:     point,
+	}
+}
+
+func (p *UpdateControlPauseState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	if err := DeploymentLogger.Enable(p.update.ID); err != nil {
+		log.Errorf("failed to enable deployment logger: %s", err)
+	}
+
+	signed, merr := c.FetchUpdateControlMap(p.update)
+	if merr != nil && merr.IsFatal() {
+		log.Errorf("paused deployment can not continue: %v", merr)
+		return failUpdateControl(p.update, p.point), false
+	} else if merr != nil {
+		log.Warnf("failed to refresh the update control map: %v", merr)
+	} else {
+		p.update.UpdateControlMap = signed
+	}
+
+	switch c.UpdateControlAction(p.update, p.point) {
+	case client.UpdateControlContinue:
+		log.Infof("deployment released by its update control map at %s", p.point)
+		return p.resume(c), false
+	case client.UpdateControlFail:
+		log.Errorf("deployment failed by its update control map at %s", p.point)
+		return failUpdateControl(p.update, p.point), false
+	}
+
+	// keep pausing, with the current map, if the daemon is restarted
+	// meanwhile; on the uncommitted partition the state data of the reboot
+	// is the only valid one, resuming from which pauses again
+	status := updateControlPauseStatus[p.point]
+	if p.point != updateControlCommit {
+		if err := StoreStateData(ctx.store, StateData{
+			Name:         p.Id(),
+			UpdateInfo:   p.update,
+			UpdateStatus: status,
+		}); err != nil {
+			log.Errorf("failed to store state data in update control pause state: %v", err)
+			return failUpdateControl(p.update, p.point), false
+		}
+	}
+
+	merr = c.ReportUpdateStatus(p.update, status)
+	if merr != nil && merr.IsFatal() {
+		return failUpdateControl(p.update, p.point), false
+	}
+
+	wait := c.GetUpdatePollInterval()
+	if wait <= 0 {
+		wait = updateControlRefreshInterval
+	}
+	log.Infof("deployment paused at %s; checking again in %v", p.point, wait)
+	return p.Wait(p, p, wait)
+}
+
+// resume returns the state the deployment continues with once released.
+func (p *UpdateControlPauseState) resume(c Controller) State {
+	switch p.point {
+	case updateControlDownload:
+		return NewUpdateFetchState(p.update)
+	case updateControlInstall:
+		return installState(c, p.update)
+	}
+	return NewUpdateCommitState(p.update)
+}
+
+func (p *UpdateControlPauseState) Update() client.UpdateResponse {
+	return p.update
+}
+
 type UpdateInstallState struct {
 	UpdateState
 }
@@ -741,6 +1228,16 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 		return NewUpdateErrorState(NewTransientError(merr), is.Update()), false
 	}
 
+	// the update modules have only stored their payloads so far
+	if err := c.InstallModulePayloads(); err != nil {
+		log.Errorf("update install failed: %s", err)
+		return NewUpdateErrorState(NewTransientError(err), is.Update()), false
+	}
+	if c.ModuleUpdateOnly() {
+		log.Info("update installed by update modules; no reboot needed")
+		return NewUpdateCommitState(is.Update()), false
+	}
+
 	// if install was successful mark inactive partition as active one
 	if err := c.EnableUpdatedPartition(); err != nil {
 		return NewUpdateErrorState(NewTransientError(err), is.Update()), false
@@ -749,6 +1246,70 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 	return NewRebootState(is.Update()), false
 }
 
+// OfflineWaitState defers downloading an update until the device is online;
+// the connectivity is checked again every offlineRecheckInterval.
+type OfflineWaitState struct {
+	WaitState
+	update client.UpdateResponse
+}
+
+func NewOfflineWaitState(update client.UpdateResponse) State {
+	return &OfflineWaitState{
+		WaitState: NewWaitState(MenderStateOfflineWait, ToDownload),
+		update:    update,
+	}
+}
+
+func (o *OfflineWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("device is offline; waiting %v before downloading the update",
+		offlineRecheckInterval)
+	return o.Wait(NewUpdateFetchState(o.update), o, offlineRecheckInterval)
+}
+
+func (o *OfflineWaitState) Update() client.UpdateResponse {
+	return o.update
+}
+
+// DownloadWaitState defers downloading an update until a window of the
+// download policy of the server opens; updates in the cache are installed
+// right away. The deployment is reported paused meanwhile.
+type DownloadWaitState struct {
+	WaitState
+	update client.UpdateResponse
+}
+
+func NewDownloadWaitState(update client.UpdateResponse) State {
+	return &DownloadWaitState{
+		WaitState: NewWaitState(MenderStateDownloadWait, ToDownload),
+		update:    update,
+	}
+}
+
+func (d *DownloadWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	wait := c.GetDownloadWindowWait(d.update)
+	if wait <= 0 {
+		return NewUpdateFetchState(d.update), false
+	}
+
+	merr := c.ReportUpdateStatus(d.update, client.StatusPauseBeforeDownloading)
+	if merr != nil && merr.IsFatal() {
+		return NewUpdateStatusReportState(d.update, client.StatusFailure), false
+	}
+
+	// check at least once per poll interval whether the deployment has
+	// been aborted meanwhile
+	if intvl := c.GetUpdatePollInterval(); intvl > 0 && wait > intvl {
+		wait = intvl
+	}
+	log.Infof("update download deferred until the next download window of the server; "+
+		"waiting %v", wait)
+	return d.Wait(NewUpdateFetchState(d.update), d, wait)
+}
+
+func (d *DownloadWaitState) Update() client.UpdateResponse {
+	return d.update
+}
+
 type FetchStoreRetryState struct {
 	WaitState
 	from   State
@@ -769,7 +1330,12 @@ func NewFetchStoreRetryState(from State, update client.UpdateResponse,
 func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle fetch install retry state")
 
-	intvl, err := client.GetExponentialBackoffTime(ctx.fetchInstallAttempts, c.GetUpdatePollInterval())
+	if ctx.fetchInstallAttempts == 0 {
+		ctx.fetchInstallRetryStart = time.Now()
+	}
+
+	intvl, err := c.GetRetryPolicy().NextInterval(ctx.fetchInstallAttempts,
+		time.Since(ctx.fetchInstallRetryStart))
 	if err != nil {
 		if fir.err != nil {
 			return NewUpdateStatusReportState(fir.update, client.StatusFailure), false
@@ -784,6 +1350,41 @@ func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State,
 	return fir.Wait(NewUpdateFetchState(fir.update), fir, intvl)
 }
 
+// CheckUpdateRetryState is entered when checking for an update failed with a
+// transient error; the check is retried according to the retry policy.
+type CheckUpdateRetryState struct {
+	WaitState
+	err menderError
+}
+
+func NewCheckUpdateRetryState(err menderError) State {
+	return &CheckUpdateRetryState{
+		WaitState: NewWaitState(MenderStateCheckRetryWait, ToIdle),
+		err:       err,
+	}
+}
+
+func (cur *CheckUpdateRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle check update retry state")
+
+	if ctx.checkUpdateAttempts == 0 {
+		ctx.checkUpdateRetryStart = time.Now()
+	}
+
+	intvl, err := c.GetRetryPolicy().NextInterval(ctx.checkUpdateAttempts,
+		time.Since(ctx.checkUpdateRetryStart))
+	if err != nil {
+		log.Errorf("giving up on update check: %v", err)
+		ctx.checkUpdateAttempts = 0
+		return NewErrorState(cur.err), false
+	}
+
+	ctx.checkUpdateAttempts++
+
+	log.Debugf("wait %v before next update check attempt", intvl)
+	return cur.Wait(updateCheckState, cur, intvl)
+}
+
 type CheckWaitState struct {
 	WaitState
 }
@@ -798,8 +1399,12 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	log.Debugf("handle check wait state")
 
-	// calculate next interval
-	update := ctx.lastUpdateCheck.Add(c.GetUpdatePollInterval())
+	// calculate next interval; the server may ask for a different one
+	interval := c.GetUpdatePollInterval()
+	if ctx.updatePollHint > 0 {
+		interval = ctx.updatePollHint
+	}
+	update := ctx.lastUpdateCheck.Add(interval + ctx.updateCheckSplay)
 	inventory := ctx.lastInventoryUpdate.Add(c.GetInventoryPollInterval())
 
 	// if we haven't sent inventory so far
@@ -847,6 +1452,11 @@ func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State,
 
 	ctx.lastInventoryUpdate = time.Now()
 
+	if !c.IsOnline() {
+		log.Debugf("device is offline; skipping inventory update")
+		return checkWaitState, false
+	}
+
 	err := c.InventoryRefresh()
 	if err != nil {
 		log.Warnf("failed to refresh inventory: %v", err)
@@ -856,6 +1466,7 @@ func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State,
 	} else {
 		log.Debugf("inventory refresh complete")
 	}
+	c.CheckKeyRotation()
 	return checkWaitState, false
 }
 
@@ -997,6 +1608,12 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 			return NewReportErrorState(usr.Update(), usr.status), false
 		}
 	}
+	// the payloads of a failed update are rolled back together
+	if usr.status != client.StatusSuccess {
+		c.RollbackPayloads()
+	} else {
+		c.StoreInstalledArtifact(usr.Update())
+	}
 	if err := sendDeploymentStatus(usr.Update(), usr.status,
 		&usr.triesSendingReport, &usr.reportSent, c); err != nil {
 		log.Errorf("failed to send status to server: %v", err)
@@ -1007,7 +1624,8 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 			usr.status, usr.triesSendingReport), false
 	}
 
-	if usr.status == client.StatusFailure {
+	if usr.status == client.StatusFailure ||
+		usr.status == client.StatusInsufficientSpace {
 		log.Debugf("attempting to upload deployment logs for failed update")
 		if err := sendDeploymentLogs(usr.Update(),
 			&usr.triesSendingLogs, usr.logs, c); err != nil {
@@ -1104,7 +1722,7 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 	case client.StatusSuccess:
 		// error while reporting success; rollback
 		return NewRollbackState(res.Update(), true, true), false
-	case client.StatusFailure:
+	case client.StatusFailure, client.StatusInsufficientSpace:
 		// error while reporting failure;
 		// start from scratch as previous update was broken
 		log.Errorf("error while performing update: %v (%v)", res.updateStatus, res.Update())
@@ -20,13 +20,18 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type stateTestController struct {
@@ -34,8 +39,16 @@ type stateTestController struct {
 	updater         fakeUpdater
 	artifactName    string
 	pollIntvl       time.Duration
+	pollSplay       time.Duration
+	pollHint        time.Duration
+	commitTimeout   time.Duration
+	maintenanceWait time.Duration
+	downloadWait    time.Duration
+	downloadPolicy  *client.DownloadPolicy
 	retryIntvl      time.Duration
+	retryPolicy     client.RetryPolicy
 	hasUpgrade      bool
+	moduleOnly      bool
 	hasUpgradeErr   menderError
 	state           State
 	updateResp      *client.UpdateResponse
@@ -46,9 +59,26 @@ type stateTestController struct {
 	logSendingError menderError
 	reportStatus    string
 	reportUpdate    client.UpdateResponse
+	progressUpdate  client.UpdateResponse
+	progress        []utils.Progress
 	logUpdate       client.UpdateResponse
 	logs            []byte
 	inventoryErr    error
+	keyRotations    int
+	shuttingDown    bool
+	commitCheckErr  error
+	spaceErr        error
+	rolledBack      bool
+	installErr      error
+	offline         bool
+	installed       *client.UpdateResponse
+	controlMap      *client.SignedUpdateControlMap
+	controlMapErr   menderError
+	cached          []byte
+	cacheFinished   bool
+	cacheStoreErr   error
+	filtersErr      error
+	peerArtifact    []byte
 }
 
 func (s *stateTestController) GetCurrentArtifactName() (string, error) {
@@ -62,6 +92,14 @@ func (s *stateTestController) GetUpdatePollInterval() time.Duration {
 	return s.pollIntvl
 }
 
+func (s *stateTestController) GetUpdatePollSplay() time.Duration {
+	return s.pollSplay
+}
+
+func (s *stateTestController) GetUpdatePollHint() time.Duration {
+	return s.pollHint
+}
+
 func (s *stateTestController) GetInventoryPollInterval() time.Duration {
 	return s.pollIntvl
 }
@@ -70,15 +108,63 @@ func (s *stateTestController) GetRetryPollInterval() time.Duration {
 	return s.retryIntvl
 }
 
+func (s *stateTestController) GetRetryPolicy() client.RetryPolicy {
+	p := s.retryPolicy
+	if p.MaxInterval == 0 {
+		p.MaxInterval = s.pollIntvl
+	}
+	return p
+}
+
+func (s *stateTestController) GetUpdateCommitTimeout() time.Duration {
+	return s.commitTimeout
+}
+
+func (s *stateTestController) GetMaintenanceWindowWait() time.Duration {
+	return s.maintenanceWait
+}
+
+func (s *stateTestController) SetDownloadPolicy(policy *client.DownloadPolicy) {
+	s.downloadPolicy = policy
+}
+
+func (s *stateTestController) GetDownloadWindowWait(update client.UpdateResponse) time.Duration {
+	return s.downloadWait
+}
+
+func (s *stateTestController) ModuleUpdateOnly() bool {
+	return s.moduleOnly
+}
+
+func (s *stateTestController) InstallModulePayloads() error {
+	return s.installErr
+}
+
+func (s *stateTestController) RollbackPayloads() {
+	s.rolledBack = true
+}
+
 func (s *stateTestController) HasUpgrade() (bool, menderError) {
 	return s.hasUpgrade, s.hasUpgradeErr
 }
 
+func (s *stateTestController) CheckKeyRotation() {
+	s.keyRotations++
+}
+
+func (s *stateTestController) Shutdown() {
+	s.shuttingDown = true
+}
+
+func (s *stateTestController) ShuttingDown() bool {
+	return s.shuttingDown
+}
+
 func (s *stateTestController) CheckUpdate() (*client.UpdateResponse, menderError) {
 	return s.updateResp, s.updateRespErr
 }
 
-func (s *stateTestController) FetchUpdate(url string) (io.ReadCloser, int64, error) {
+func (s *stateTestController) FetchUpdate(url string, mirrors ...string) (io.ReadCloser, int64, error) {
 	return s.updater.FetchUpdate(nil, url)
 }
 
@@ -110,6 +196,12 @@ func (s *stateTestController) ReportUpdateStatus(update client.UpdateResponse, s
 	return s.reportError
 }
 
+func (s *stateTestController) ReportDownloadProgress(update client.UpdateResponse,
+	progress utils.Progress) {
+	s.progressUpdate = update
+	s.progress = append(s.progress, progress)
+}
+
 func (s *stateTestController) UploadLog(update client.UpdateResponse, logs []byte) menderError {
 	s.logUpdate = update
 	s.logs = logs
@@ -124,6 +216,79 @@ func (s *stateTestController) CheckScriptsCompatibility() error {
 	return nil
 }
 
+func (s *stateTestController) CheckUpdateCommit(artifactName string) error {
+	return s.commitCheckErr
+}
+
+func (s *stateTestController) CheckUpdateSpace(size int64) error {
+	return s.spaceErr
+}
+
+func (s *stateTestController) OpenCachedUpdate(update client.UpdateResponse) (io.ReadCloser, int64) {
+	if s.cached == nil {
+		return nil, 0
+	}
+	return ioutil.NopCloser(bytes.NewReader(s.cached)), int64(len(s.cached))
+}
+
+func (s *stateTestController) FetchPeerUpdate(update client.UpdateResponse) (io.ReadCloser, int64) {
+	if s.peerArtifact == nil {
+		return nil, 0
+	}
+	return ioutil.NopCloser(bytes.NewReader(s.peerArtifact)), int64(len(s.peerArtifact))
+}
+
+func (s *stateTestController) CacheUpdate(update client.UpdateResponse, in io.ReadCloser,
+	size int64) io.ReadCloser {
+	return in
+}
+
+func (s *stateTestController) FinishCachedUpdate(update client.UpdateResponse, storeErr error) bool {
+	s.cacheFinished = true
+	s.cacheStoreErr = storeErr
+	if utils.ErrorKindOf(storeErr) != utils.ErrorKindArtifact {
+		return false
+	}
+	if s.cached != nil {
+		s.cached = nil
+		return true
+	}
+	if s.peerArtifact != nil {
+		s.peerArtifact = nil
+		return true
+	}
+	return false
+}
+
+func (s *stateTestController) CheckDeploymentFilters(update client.UpdateResponse) error {
+	return s.filtersErr
+}
+
+func (s *stateTestController) StoreInstalledArtifact(update client.UpdateResponse) {
+	s.installed = &update
+}
+
+func (s *stateTestController) IsOnline() bool {
+	return !s.offline
+}
+
+func (s *stateTestController) UpdateControlAction(update client.UpdateResponse,
+	point string) string {
+	if update.UpdateControlMap == nil {
+		return client.UpdateControlContinue
+	}
+	m, err := update.UpdateControlMap.Verify(nil)
+	if err != nil {
+		return client.UpdateControlFail
+	}
+	return m.Action(point, time.Now())
+}
+
+func (s *stateTestController) FetchUpdateControlMap(update client.UpdateResponse) (
+	*client.SignedUpdateControlMap, menderError) {
+	return s.controlMap, s.controlMapErr
+}
+
 type waitStateTest struct {
 	baseState
 }
@@ -142,6 +307,10 @@ func (c *waitStateTest) Stop() {
 	// Noop for now.
 }
 
+func (c *waitStateTest) Recheck() {
+	// Noop for now.
+}
+
 func (c *waitStateTest) Handle(*StateContext, Controller) (State, bool) {
 	return c, false
 }
@@ -195,6 +364,16 @@ func TestStateWait(t *testing.T) {
 	// Wake should return the next state
 	assert.Equal(t, authorizeState, s)
 	assert.False(t, c)
+
+	// a recheck requested before waiting is not lost, and returns the same
+	// state, not cancelled
+	cs.Recheck()
+	cs.Recheck()
+	tstart = time.Now()
+	s, c = cs.Wait(authorizeState, authorizeWaitState, 10*time.Second)
+	assert.Equal(t, authorizeWaitState, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, time.Now(), tstart, 5*time.Millisecond)
 }
 
 func TestStateError(t *testing.T) {
@@ -271,6 +450,9 @@ func TestStateUpdateReportStatus(t *testing.T) {
 	usr.Handle(&ctx, sc)
 	assert.Equal(t, client.StatusFailure, sc.reportStatus)
 	assert.Equal(t, update, sc.reportUpdate)
+	// the payloads of the failed update are rolled back
+	assert.True(t, sc.rolledBack)
+	assert.Nil(t, sc.installed)
 
 	assert.NotEmpty(t, sc.logs)
 	assert.JSONEq(t, `{
@@ -287,6 +469,8 @@ func TestStateUpdateReportStatus(t *testing.T) {
 	usr.Handle(&ctx, sc)
 	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
 	assert.Equal(t, update, sc.reportUpdate)
+	assert.False(t, sc.rolledBack)
+	assert.Equal(t, &update, sc.installed)
 
 	// cancelled state should not wipe state data, for this pretend the reporting
 	// fails and cancel
@@ -464,6 +648,37 @@ func TestStateInit(t *testing.T) {
 	assert.False(t, c)
 	assert.IsType(t, ToArtifactCommit, ctrl.GetCurrentState().Transition())
 
+	// interrupted download is restarted
+	for _, name := range []MenderState{MenderStateUpdateFetch, MenderStateUpdateStore} {
+		StoreStateData(ms, StateData{
+			UpdateInfo: update,
+			Name:       name,
+		})
+		s, c = i.Handle(&ctx, &stateTestController{hasUpgrade: false})
+		assert.IsType(t, &UpdateFetchState{}, s)
+		assert.False(t, c)
+		assert.Equal(t, update, s.(*UpdateFetchState).update)
+	}
+
+	// interrupted status report is resent
+	StoreStateData(ms, StateData{
+		UpdateInfo:   update,
+		Name:         MenderStateUpdateStatusReport,
+		UpdateStatus: client.StatusSuccess,
+	})
+	s, c = i.Handle(&ctx, &stateTestController{hasUpgrade: false})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusSuccess, s.(*UpdateStatusReportState).status)
+
+	// but not without knowing the status
+	StoreStateData(ms, StateData{
+		UpdateInfo: update,
+		Name:       MenderStateUpdateStatusReport,
+	})
+	s, c = i.Handle(&ctx, &stateTestController{hasUpgrade: false})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
 }
 
 func TestStateAuthorize(t *testing.T) {
@@ -494,8 +709,11 @@ func TestStateInvetoryUpdate(t *testing.T) {
 	})
 	assert.IsType(t, &CheckWaitState{}, s)
 
-	s, _ = ius.Handle(ctx, &stateTestController{})
+	sc := &stateTestController{}
+	s, _ = ius.Handle(ctx, sc)
 	assert.IsType(t, &CheckWaitState{}, s)
+	// the device key is checked for rotation along with the inventory
+	assert.Equal(t, 1, sc.keyRotations)
 
 	// no artifact name should fail
 	s, _ = ius.Handle(ctx, &stateTestController{
@@ -643,6 +861,125 @@ func TestStateUpdateCommit(t *testing.T) {
 	assert.Equal(t, update, rs.Update())
 }
 
+func TestStateUpdateInstallModuleOnly(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	is := NewUpdateInstallState(update)
+
+	// rootfs update needs a reboot
+	sc := &stateTestController{}
+	s, _ := is.Handle(nil, sc)
+	assert.IsType(t, &RebootState{}, s)
+
+	// payloads installed by update modules are committed right away
+	sc = &stateTestController{moduleOnly: true}
+	s, _ = is.Handle(nil, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+
+	// the update modules failing to install their payloads fail the update
+	sc = &stateTestController{installErr: errors.New("install failed")}
+	s, _ = is.Handle(nil, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+}
+
+func TestStateUpdateCommitModuleOnly(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "app-1"
+	cs := NewUpdateCommitState(update)
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+
+	// the running image keeps its name
+	s, _ := cs.Handle(&ctx, &stateTestController{
+		artifactName:  "release-1",
+		commitTimeout: time.Nanosecond,
+		moduleOnly:    true,
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusSuccess, s.(*UpdateStatusReportState).status)
+
+	// and there is no image to reboot out of
+	s, _ = cs.Handle(&ctx, &stateTestController{
+		artifactName:   "release-1",
+		commitCheckErr: errors.New("self test failed"),
+		moduleOnly:     true,
+	})
+	assert.IsType(t, &RollbackState{}, s)
+	assert.False(t, s.(*RollbackState).reboot)
+}
+
+func TestStateUpdateCommitTimeout(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	oldUptime := systemUptime
+	defer func() { systemUptime = oldUptime }()
+	systemUptime = func() (time.Duration, error) {
+		return 10 * time.Minute, nil
+	}
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+	cs := NewUpdateCommitState(update)
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+
+	// no timeout configured
+	s, _ := cs.Handle(&ctx, &stateTestController{
+		artifactName: "fakeid",
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+
+	// committed in time
+	s, _ = cs.Handle(&ctx, &stateTestController{
+		artifactName:  "fakeid",
+		commitTimeout: 15 * time.Minute,
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+
+	// window exceeded
+	s, _ = cs.Handle(&ctx, &stateTestController{
+		artifactName:  "fakeid",
+		commitTimeout: 5 * time.Minute,
+	})
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, s.(*RollbackState).reboot)
+
+	// rejected by the update commit helper
+	s, _ = cs.Handle(&ctx, &stateTestController{
+		artifactName:   "fakeid",
+		commitCheckErr: errors.New("self test failed"),
+	})
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, s.(*RollbackState).reboot)
+
+	// unknown uptime does not prevent the commit
+	systemUptime = func() (time.Duration, error) {
+		return 0, errors.New("no uptime")
+	}
+	s, _ = cs.Handle(&ctx, &stateTestController{
+		artifactName:  "fakeid",
+		commitTimeout: 5 * time.Minute,
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
 func TestStateUpdateCheckWait(t *testing.T) {
 	cws := NewCheckWaitState()
 	ctx := new(StateContext)
@@ -688,6 +1025,60 @@ func TestStateUpdateCheckWait(t *testing.T) {
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
 }
 
+func TestStateUpdateCheckSplay(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	// no splay configured
+	cs.Handle(ctx, &stateTestController{})
+	assert.Equal(t, time.Duration(0), ctx.updateCheckSplay)
+
+	for i := 0; i < 10; i++ {
+		cs.Handle(ctx, &stateTestController{
+			pollSplay: 50 * time.Millisecond,
+		})
+		assert.True(t, ctx.updateCheckSplay >= 0 &&
+			ctx.updateCheckSplay < 50*time.Millisecond)
+	}
+
+	// splay delays the next update check
+	ctx.lastInventoryUpdate = time.Now().Add(time.Minute)
+	ctx.lastUpdateCheck = time.Now()
+	ctx.updateCheckSplay = 30 * time.Millisecond
+	tstart := time.Now()
+	s, _ := NewCheckWaitState().Handle(ctx, &stateTestController{
+		pollIntvl: 10 * time.Millisecond,
+	})
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.True(t, time.Since(tstart) >= 35*time.Millisecond)
+}
+
+func TestStateUpdateCheckPollHint(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	// the server asks to check again
+	s, _ := cs.Handle(ctx, &stateTestController{
+		pollHint: 20 * time.Millisecond,
+	})
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.Equal(t, 20*time.Millisecond, ctx.updatePollHint)
+
+	// the hint takes precedence over the poll interval
+	ctx.lastInventoryUpdate = time.Now().Add(time.Minute)
+	tstart := time.Now()
+	s, _ = NewCheckWaitState().Handle(ctx, &stateTestController{
+		pollIntvl: time.Hour,
+	})
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.True(t, time.Since(tstart) >= 20*time.Millisecond)
+	assert.True(t, time.Since(tstart) < time.Minute)
+
+	// hints are only valid for a single check
+	cs.Handle(ctx, &stateTestController{})
+	assert.Equal(t, time.Duration(0), ctx.updatePollHint)
+}
+
 func TestStateUpdateCheck(t *testing.T) {
 	cs := UpdateCheckState{}
 	ctx := new(StateContext)
@@ -704,6 +1095,19 @@ func TestStateUpdateCheck(t *testing.T) {
 	s, c = cs.Handle(ctx, &stateTestController{
 		updateRespErr: NewTransientError(errors.New("check failed")),
 	})
+	assert.IsType(t, &CheckUpdateRetryState{}, s)
+	assert.False(t, c)
+
+	// no point in retrying if the device is not authorized
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateRespErr: NewTransientError(client.ErrNotAuthorized),
+	})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateRespErr: NewFatalError(errors.New("check failed")),
+	})
 	assert.IsType(t, &ErrorState{}, s)
 	assert.False(t, c)
 
@@ -717,6 +1121,49 @@ func TestStateUpdateCheck(t *testing.T) {
 	assert.False(t, c)
 	ufs, _ := s.(*UpdateFetchState)
 	assert.Equal(t, *update, ufs.update)
+
+	// deferred by the deployment filters, until the next update check
+	sc := &stateTestController{
+		updateResp: update,
+		filtersErr: errors.New("device is not on AC power"),
+	}
+	s, c = cs.Handle(ctx, sc)
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusDeferred, sc.reportStatus)
+}
+
+func TestStateCheckUpdateRetry(t *testing.T) {
+	ctx := new(StateContext)
+	stc := stateTestController{
+		pollIntvl: 5 * time.Minute,
+		retryPolicy: client.RetryPolicy{
+			MaxAttempts: 3,
+		},
+	}
+
+	s := NewCheckUpdateRetryState(NewTransientError(errors.New("check failed")))
+	for i := 0; i < 3; i++ {
+		s.(*CheckUpdateRetryState).WaitState = &waitStateTest{}
+
+		next, c := s.Handle(ctx, &stc)
+		assert.IsType(t, &UpdateCheckState{}, next)
+		assert.False(t, c)
+		assert.Equal(t, i+1, ctx.checkUpdateAttempts)
+	}
+
+	// attempts exhausted
+	s.(*CheckUpdateRetryState).WaitState = &waitStateTest{}
+	next, c := s.Handle(ctx, &stc)
+	assert.IsType(t, &ErrorState{}, next)
+	assert.False(t, c)
+	assert.Equal(t, 0, ctx.checkUpdateAttempts)
+
+	// successful check resets the counter
+	ctx.checkUpdateAttempts = 2
+	cs := UpdateCheckState{}
+	cs.Handle(ctx, &stc)
+	assert.Equal(t, 0, ctx.checkUpdateAttempts)
 }
 
 func TestUpdateCheckSameImage(t *testing.T) {
@@ -742,6 +1189,23 @@ func TestUpdateCheckSameImage(t *testing.T) {
 	assert.Equal(t, client.StatusAlreadyInstalled, urs.status)
 }
 
+func TestUpdateCheckIncompatibleArtifact(t *testing.T) {
+	cs := UpdateCheckState{}
+	update := &client.UpdateResponse{
+		ID: "my-id",
+	}
+
+	// deployment fails right away instead of being retried
+	s, _ := cs.Handle(new(StateContext), &stateTestController{
+		updateResp:    update,
+		updateRespErr: NewFatalError(errIncompatibleArtifact),
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	urs, _ := s.(*UpdateStatusReportState)
+	assert.Equal(t, *update, urs.Update())
+	assert.Equal(t, client.StatusFailure, urs.status)
+}
+
 func TestStateUpdateFetch(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -790,9 +1254,18 @@ func TestStateUpdateFetch(t *testing.T) {
 	}, ud)
 
 	uis, _ := s.(*UpdateStoreState)
-	assert.Equal(t, stream, uis.imagein)
+	require.IsType(t, &utils.ProgressReader{}, uis.imagein)
+	assert.Equal(t, stream, uis.imagein.(*utils.ProgressReader).ReadCloser)
 	assert.Equal(t, int64(len(data)), uis.size)
 
+	// the progress of the download is passed on to the controller
+	_, err = ioutil.ReadAll(uis.imagein)
+	assert.NoError(t, err)
+	require.Len(t, sc.progress, 1)
+	assert.Equal(t, update, sc.progressUpdate)
+	assert.Equal(t, int64(len(data)), sc.progress[0].Current)
+	assert.Equal(t, int64(len(data)), sc.progress[0].Total)
+
 	ms.ReadOnly(true)
 	// pretend writing update state data fails
 	sc = &stateTestController{}
@@ -808,6 +1281,53 @@ func TestStateUpdateFetch(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateUpdateFetchExpiredLink(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.Source.URI = "https://storage/expired"
+	update.Artifact.Source.Expire = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	refreshed := update
+	refreshed.Artifact.Source.URI = "https://storage/fresh"
+	refreshed.Artifact.Source.Expire = time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	data := "test"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+		updateResp: &refreshed,
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	assert.Equal(t, refreshed, s.(*UpdateStoreState).update)
+
+	// the update check fails
+	sc.updateResp = nil
+	sc.updateRespErr = NewTransientError(errors.New("update check failed"))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// the deployment is gone
+	sc.updateRespErr = nil
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+
+	other := refreshed
+	other.ID = "other"
+	sc.updateResp = &other
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
 func TestStateUpdateFetchRetry(t *testing.T) {
 	// pretend we have an update
 	update := client.UpdateResponse{
@@ -854,31 +1374,151 @@ func TestStateUpdateFetchRetry(t *testing.T) {
 	assert.False(t, c)
 }
 
-func TestStateUpdateStore(t *testing.T) {
-	// create directory for storing deployments logs
+func TestStateUpdateFetchChecksum(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
 	DeploymentLogger = NewDeploymentLogManager(tempDir)
 
 	data := "test"
-	stream := ioutil.NopCloser(bytes.NewBufferString(data))
-
-	update := client.UpdateResponse{
-		ID: "foo",
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	newController := func() *stateTestController {
+		return &stateTestController{
+			updater: fakeUpdater{
+				fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+				fetchUpdateReturnSize:       int64(len(data)),
+			},
+		}
 	}
-	uis := NewUpdateStoreState(stream, int64(len(data)), update)
 
-	ms := store.NewMemStore()
-	ctx := StateContext{
-		store: ms,
+	update := client.UpdateResponse{
+		ID: "foobar",
 	}
 
-	ms.ReadOnly(true)
-	// pretend writing update state data fails
-	sc := &stateTestController{}
-	s, c := uis.Handle(&ctx, sc)
+	// malformed checksum
+	update.Artifact.Source.Checksum = "not-hex"
+	s, c := NewUpdateFetchState(update).Handle(&ctx, newController())
 	assert.IsType(t, &UpdateStatusReportState{}, s)
-	ms.ReadOnly(false)
+	assert.False(t, c)
+
+	// checksum mismatch is detected once the update is stored
+	update.Artifact.Source.Checksum =
+		"0000000000000000000000000000000000000000000000000000000000000000"
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, newController())
+	assert.IsType(t, &UpdateStoreState{}, s)
+	s, _ = s.Handle(&ctx, newController())
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// sha256 of "test"
+	update.Artifact.Source.Checksum =
+		"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, newController())
+	assert.IsType(t, &UpdateStoreState{}, s)
+	s, _ = s.Handle(&ctx, newController())
+	assert.IsType(t, &UpdateInstallState{}, s)
+
+	// further checksums are verified too, those of unsupported algorithms
+	// left out
+	update.Artifact.Source.Checksums = map[string]string{
+		"sha512": "ee26b0dd4af7e749aa1a8ee3c10ae9923f618980772e473f8819a5d4940e0db2" +
+			"7ac185f8a0e1d5f84f88bc887fd67b143732c304cc5fa9ad8e6f57f50028a8ff",
+		"blake2b": "a71079d42853dea26e453004338670a53814b78137ffbed07603a41d76a483aa" +
+			"9bc33b582f77d30a65e6f29a896c0411f38312e1d66e0bf16386c86a89bea572",
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, newController())
+	assert.IsType(t, &UpdateStoreState{}, s)
+	s, _ = s.Handle(&ctx, newController())
+	assert.IsType(t, &UpdateInstallState{}, s)
+
+	update.Artifact.Source.Checksums["sha512"] = strings.Repeat("00", 64)
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, newController())
+	assert.IsType(t, &UpdateStoreState{}, s)
+	s, _ = s.Handle(&ctx, newController())
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// none of them can be verified
+	update.Artifact.Source.Checksum = ""
+	update.Artifact.Source.Checksums = map[string]string{"blake2b": "abcd"}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, newController())
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
+// cacheFetchController fails fetching updates from the artifact cache
+type cacheFetchController struct {
+	stateTestController
+	fetched []string
+}
+
+func (c *cacheFetchController) FetchUpdate(url string, mirrors ...string) (io.ReadCloser, int64, error) {
+	c.fetched = append(c.fetched, url)
+	if strings.HasPrefix(url, "https://gateway.local/") {
+		return nil, 0, errors.New("cache not available")
+	}
+	return c.stateTestController.FetchUpdate(url)
+}
+
+func TestStateUpdateFetchArtifactCache(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	data := "test"
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.Source.URI = "https://hosted.mender.io/artifact"
+	update.ArtifactCache = "https://gateway.local/cache"
+
+	// the origin is used if the cache fails
+	c := &cacheFetchController{
+		stateTestController: stateTestController{
+			updater: fakeUpdater{
+				fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+				fetchUpdateReturnSize:       int64(len(data)),
+			},
+		},
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, c)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.Equal(t, update.DownloadURIs(), c.fetched)
+
+	// both fail
+	c = &cacheFetchController{}
+	c.updater.fetchUpdateReturnError = errors.New("no route to host")
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, c)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+	assert.Len(t, c.fetched, 2)
+}
+
+func TestStateUpdateStore(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	data := "test"
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	uis := NewUpdateStoreState(stream, int64(len(data)), update)
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	ms.ReadOnly(true)
+	// pretend writing update state data fails
+	sc := &stateTestController{}
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	ms.ReadOnly(false)
 
 	sc = &stateTestController{}
 	s, c = uis.Handle(&ctx, sc)
@@ -902,6 +1542,523 @@ func TestStateUpdateStore(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateShutdownCheckpoint(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	paused := StateData{
+		Version:      stateDataVersion,
+		Name:         MenderStateUpdateFetch,
+		UpdateInfo:   update,
+		UpdateStatus: client.StatusPausedByShutdown,
+	}
+
+	// the download is interrupted while fetching the update
+	sc := &stateTestController{
+		shuttingDown: true,
+		updater: fakeUpdater{
+			fetchUpdateReturnError: errors.New("context canceled"),
+		},
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.Equal(t, doneState, s)
+	assert.Equal(t, client.StatusPausedByShutdown, sc.reportStatus)
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, paused, sd)
+
+	// or while storing it
+	data := "test"
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+	sc = &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: errors.New("context canceled"),
+		},
+		shuttingDown: true,
+	}
+	s, _ = NewUpdateStoreState(stream, int64(len(data)), update).Handle(&ctx, sc)
+	assert.Equal(t, doneState, s)
+	assert.Equal(t, client.StatusPausedByShutdown, sc.reportStatus)
+	sd, err = LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, paused, sd)
+
+	// and downloaded again once started again
+	s, _ = initState.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateFetchState{}, s)
+}
+
+func TestStateMaintenanceWait(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// downloaded outside of a maintenance window
+	sc := &stateTestController{maintenanceWait: time.Hour}
+	uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+		4, update)
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &MaintenanceWaitState{}, s)
+	assert.False(t, c)
+
+	// the update modules do not install their payloads until then either
+	sc = &stateTestController{maintenanceWait: time.Hour, moduleOnly: true}
+	uis = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+		4, update)
+	s, _ = uis.Handle(&ctx, sc)
+	assert.IsType(t, &MaintenanceWaitState{}, s)
+
+	// waits for the window, at most a poll interval at a time
+	mws := NewMaintenanceWaitState(update)
+	sc = &stateTestController{
+		maintenanceWait: time.Hour,
+		pollIntvl:       10 * time.Millisecond,
+	}
+	s, c = mws.Handle(&ctx, sc)
+	assert.Equal(t, mws, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusPauseBeforeInstalling, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateMaintenanceWait, ud.Name)
+	assert.Equal(t, update, ud.UpdateInfo)
+
+	// restarted while waiting
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &MaintenanceWaitState{}, s)
+
+	// the deployment is aborted meanwhile
+	sc = &stateTestController{
+		maintenanceWait: time.Hour,
+		reportError:     NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, _ = mws.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// other report errors do not stop waiting
+	sc = &stateTestController{
+		maintenanceWait: 10 * time.Millisecond,
+		reportError:     NewTransientError(errors.New("offline")),
+	}
+	s, _ = mws.Handle(&ctx, sc)
+	assert.Equal(t, mws, s)
+
+	// the window opens
+	sc = &stateTestController{}
+	s, c = mws.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, update, s.(*UpdateInstallState).Update())
+
+	// the wait is canceled when the daemon stops
+	sc = &stateTestController{maintenanceWait: time.Hour}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mws.Cancel()
+	}()
+	s, c = mws.Handle(&ctx, sc)
+	assert.Equal(t, mws, s)
+	assert.True(t, c)
+}
+
+func TestStateDownloadWait(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+		DownloadPolicy: &client.DownloadPolicy{
+			MaxRate: 1024,
+			Windows: []string{"Mon-Fri 01:00-05:00"},
+		},
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// outside of the download windows, resuming after a restart
+	sc := &stateTestController{
+		downloadWait: time.Hour,
+		pollIntvl:    10 * time.Millisecond,
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &DownloadWaitState{}, s)
+	assert.Empty(t, sc.reportStatus)
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateFetch, sd.Name)
+
+	// waits for the window, at most a poll interval at a time
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, client.StatusPauseBeforeDownloading, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+
+	// the deployment is aborted meanwhile
+	sc.reportError = NewFatalError(client.ErrDeploymentAborted)
+	s, _ = NewDownloadWaitState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// the window opens; the download is limited as the policy asks
+	data := "test"
+	sc = &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+	s, _ = NewDownloadWaitState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.Equal(t, update.DownloadPolicy, sc.downloadPolicy)
+
+	// cached artifacts are not downloaded, so need not wait
+	sc = &stateTestController{
+		downloadWait: time.Hour,
+		cached:       []byte(data),
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.Nil(t, sc.downloadPolicy)
+
+	// nor are those of peers on the local network
+	sc = &stateTestController{
+		downloadWait: time.Hour,
+		peerArtifact: []byte(data),
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.Nil(t, sc.downloadPolicy)
+}
+
+func TestStateUpdateControl(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	controlMap := func(point, action, expires string) *client.SignedUpdateControlMap {
+		m := `{"id": "map1", "states": {"` + point + `": {"action": "` + action + `"}}`
+		if expires != "" {
+			m += `, "expires": "` + expires + `"`
+		}
+		return &client.SignedUpdateControlMap{Map: []byte(m + "}")}
+	}
+	update := client.UpdateResponse{
+		ID:               "foo",
+		UpdateControlMap: controlMap(updateControlDownload, "pause", ""),
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// paused before downloading, until released
+	sc := &stateTestController{
+		pollIntvl:  10 * time.Millisecond,
+		controlMap: update.UpdateControlMap,
+	}
+	ps, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateControlPauseState{}, ps)
+	s, c := ps.Handle(&ctx, sc)
+	assert.Equal(t, ps, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusPauseBeforeDownloading, sc.reportStatus)
+
+	// restarted while paused
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateControlPause, ud.Name)
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.JSONEq(t, string(update.UpdateControlMap.Map),
+		string(s.(*UpdateControlPauseState).Update().UpdateControlMap.Map))
+	assert.Equal(t, updateControlDownload, s.(*UpdateControlPauseState).point)
+
+	// refresh errors keep the map, unless the deployment is aborted
+	sc.controlMapErr = NewTransientError(errors.New("offline"))
+	s, _ = ps.Handle(&ctx, sc)
+	assert.Equal(t, ps, s)
+	sc.controlMapErr = NewFatalError(client.ErrDeploymentAborted)
+	s, _ = ps.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	sc.controlMapErr = nil
+	sc.controlMap = controlMap(updateControlDownload, "fail", "")
+	s, _ = ps.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+
+	sc.controlMap = nil
+	s, _ = ps.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Nil(t, s.(*UpdateFetchState).Update().UpdateControlMap)
+
+	// paused before installing the stored update
+	update.UpdateControlMap = controlMap(updateControlInstall, "pause", "")
+	sc = &stateTestController{}
+	s, _ = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+		4, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.Equal(t, updateControlInstall, s.(*UpdateControlPauseState).point)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+
+	// paused before committing the running update, keeping the state data
+	// of the reboot
+	update.UpdateControlMap = controlMap(updateControlCommit, "pause", "")
+	assert.NoError(t, StoreStateData(ms, StateData{
+		Name:       MenderStateReboot,
+		UpdateInfo: update,
+	}))
+	sc = &stateTestController{
+		hasUpgrade: true,
+		pollIntvl:  10 * time.Millisecond,
+		controlMap: update.UpdateControlMap,
+	}
+	ps, _ = NewUpdateVerifyState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateControlPauseState{}, ps)
+	s, _ = ps.Handle(&ctx, sc)
+	assert.Equal(t, ps, s)
+	assert.Equal(t, client.StatusPauseBeforeCommitting, sc.reportStatus)
+	ud, err = LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateReboot, ud.Name)
+
+	// failing once the map has expired
+	sc.controlMap = controlMap(updateControlCommit, "pause", "2018-01-01T00:00:00Z")
+	s, _ = ps.Handle(&ctx, sc)
+	assert.IsType(t, &RollbackState{}, s)
+
+	sc.controlMap = controlMap(updateControlCommit, "continue", "")
+	s, _ = ps.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+}
+
+func TestStateOffline(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		offline: true,
+		// would fail the checks
+		updateRespErr: NewTransientError(errors.New("offline")),
+		inventoryErr:  errors.New("offline"),
+	}
+
+	// neither checked nor retried
+	s, _ := updateCheckState.Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Equal(t, 0, ctx.checkUpdateAttempts)
+	s, _ = inventoryUpdateState.Handle(&ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+
+	// the download is deferred, resuming after a restart
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &OfflineWaitState{}, s)
+	assert.Empty(t, sc.reportStatus)
+	sd, err := LoadStateData(ctx.store)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateFetch, sd.Name)
+
+	oldInterval := offlineRecheckInterval
+	offlineRecheckInterval = time.Millisecond
+	defer func() { offlineRecheckInterval = oldInterval }()
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, update, s.(*UpdateFetchState).update)
+}
+
+func TestStateUpdateInsufficientSpace(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+
+	// the update does not fit, nothing is written
+	data := "test"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+		spaceErr: errInsufficientSpace,
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusInsufficientSpace, s.(*UpdateStatusReportState).status)
+
+	// running out of space while writing is not retried
+	sc = &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: &os.PathError{Op: "write", Path: "/dev/mmcblk0p3",
+				Err: syscall.ENOSPC},
+		},
+	}
+	uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+	s, _ = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusInsufficientSpace, s.(*UpdateStatusReportState).status)
+}
+
+func TestStateUpdateStoreDepends(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: &installer.DependsError{
+				Key:       installer.ProvidesArtifactName,
+				Installed: "release-1",
+				Accepted:  []string{"release-0"},
+			},
+		},
+	}
+	uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+		4, client.UpdateResponse{ID: "foo"})
+
+	// not retried, what is installed does not change
+	s, _ := uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+}
+
+func TestStateUpdateErrorKinds(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	update := client.UpdateResponse{ID: "foo"}
+
+	// broken artifacts are not downloaded again
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnError: utils.WithErrorKind(utils.ErrorKindArtifact,
+				errors.New("image size 1 is smaller than the minimum of 4096 bytes")),
+		},
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	for err, retried := range map[error]bool{
+		utils.WithErrorKind(utils.ErrorKindArtifact,
+			errors.New("invalid signature")): false,
+		utils.WithErrorKind(utils.ErrorKindStorage,
+			&os.PathError{Op: "write", Path: "/dev/mmcblk0p3", Err: syscall.EIO}): false,
+		// the download broke while installing
+		utils.WithErrorKind(utils.ErrorKindArtifact,
+			utils.WithErrorKind(utils.ErrorKindNetwork,
+				errors.New("Cannot resume download"))): true,
+		errors.New("install failed"): true,
+	} {
+		sc = &stateTestController{
+			fakeDevice: fakeDevice{retInstallUpdate: err},
+		}
+		uis := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+			4, update)
+		s, _ = uis.Handle(&ctx, sc)
+		if retried {
+			assert.IsType(t, &FetchStoreRetryState{}, s, err.Error())
+		} else {
+			assert.IsType(t, &UpdateStatusReportState{}, s, err.Error())
+			assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+		}
+	}
+}
+
+func TestStateUpdateFetchCached(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	update := client.UpdateResponse{ID: "foo"}
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnError: errors.New("no route to host"),
+		},
+		cached: []byte("test"),
+	}
+
+	// installed from the cache, without downloading it
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	assert.EqualValues(t, 4, s.(*UpdateStoreState).size)
+
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.True(t, sc.cacheFinished)
+	assert.NoError(t, sc.cacheStoreErr)
+
+	// failing to install it is passed on, and the artifact is downloaded
+	// again in the same deployment
+	sc.fakeDevice.retInstallUpdate = utils.WithErrorKind(utils.ErrorKindArtifact,
+		errors.New("invalid signature"))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, utils.ErrorKindArtifact, utils.ErrorKindOf(sc.cacheStoreErr))
+	assert.Nil(t, sc.cached)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// but not if it was downloaded from the server
+	s, _ = NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString("test")),
+		4, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
 func TestStateUpdateInstallRetry(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -35,9 +35,9 @@ const (
 	// exitRetryLater - exit code returned if a script requests a retry
 	exitRetryLater = 21
 
-	defaultStateScriptRetryInterval time.Duration = 30 * time.Minute
+	defaultStateScriptRetryInterval time.Duration = 60 * time.Second
 
-	defaultStateScriptRetryTimeout time.Duration = 60 * time.Second
+	defaultStateScriptRetryTimeout time.Duration = 30 * time.Minute
 )
 
 type Executor interface {
@@ -52,6 +52,9 @@ type Launcher struct {
 	Timeout                 int
 	RetryInterval           int
 	RetryTimeout            int
+	// variables added to the environment of the scripts, e.g. the
+	// metadata of the deployment in progress; evaluated for every script
+	Env func() []string
 }
 
 func (l *Launcher) getRetryInterval() time.Duration {
@@ -59,8 +62,8 @@ func (l *Launcher) getRetryInterval() time.Duration {
 	if l.RetryInterval != 0 {
 		return time.Duration(l.RetryInterval) * time.Second
 	}
-	log.Warningf("No timeout interval set for the retry-scripts. Falling back to default: %s", defaultStateScriptRetryTimeout.String())
-	return defaultStateScriptRetryTimeout
+	log.Warningf("No timeout interval set for the retry-scripts. Falling back to default: %s", defaultStateScriptRetryInterval.String())
+	return defaultStateScriptRetryInterval
 }
 
 func (l *Launcher) getRetryTimeout() time.Duration {
@@ -68,8 +71,8 @@ func (l *Launcher) getRetryTimeout() time.Duration {
 	if l.RetryTimeout != 0 {
 		return time.Duration(l.RetryTimeout) * time.Second
 	}
-	log.Warningf("No total time set for the retry-scripts' timeslot. Falling back to default: %s", defaultStateScriptRetryInterval.String())
-	return defaultStateScriptRetryInterval
+	log.Warningf("No total time set for the retry-scripts' timeslot. Falling back to default: %s", defaultStateScriptRetryTimeout.String())
+	return defaultStateScriptRetryTimeout
 }
 
 //TODO: we can optimize for reading directories once and then creating
@@ -181,9 +184,19 @@ func (l Launcher) getTimeout() time.Duration {
 	return t
 }
 
-func execute(name string, timeout time.Duration) error {
+func (l Launcher) environ() []string {
+	if l.Env == nil {
+		return nil
+	}
+	return l.Env()
+}
+
+func execute(name string, timeout time.Duration, env []string) error {
 
 	cmd := exec.Command(name)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	var stderr io.ReadCloser
 	var err error
@@ -205,6 +218,18 @@ func execute(name string, timeout time.Duration) error {
 		return err
 	}
 
+	// The timer must be running while stderr is drained, as a hanging
+	// script keeps the pipe open.
+	timer := time.AfterFunc(timeout, func() {
+		log.Errorf("statescript: %s timed out after %s, killing it",
+			name, timeout.String())
+		// In addition to kill a single process we are sending SIGKILL to
+		// process group making sure we are killing the hanging script and
+		// all its children.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	defer timer.Stop()
+
 	var bts []byte
 	if stderr != nil {
 		bts, err = ioutil.ReadAll(stderr)
@@ -221,14 +246,6 @@ func execute(name string, timeout time.Duration) error {
 		}
 	}
 
-	timer := time.AfterFunc(timeout, func() {
-		// In addition to kill a single process we are sending SIGKILL to
-		// process group making sure we are killing the hanging script and
-		// all its children.
-		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
-	})
-	defer timer.Stop()
-
 	if err := cmd.Wait(); err != nil {
 		return err
 	}
@@ -256,7 +273,7 @@ func executeScript(s os.FileInfo, dir string, l Launcher, timeout time.Duration,
 
 	iet := time.Now()
 	for {
-		err := execute(filepath.Join(dir, s.Name()), timeout)
+		err := execute(filepath.Join(dir, s.Name()), timeout, l.environ())
 		switch ret := retCode(err); ret {
 		case 0:
 			// success
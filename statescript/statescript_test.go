@@ -24,10 +24,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStore(t *testing.T) {
@@ -203,7 +205,7 @@ func TestExecutor(t *testing.T) {
 	log.SetOutput(&buf)
 	fileP, err := createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_00", "#!/bin/bash \necho 'error data' >&2")
 	assert.NoError(t, err)
-	err = execute(fileP.Name(), 100) // give the script plenty of time to run
+	err = execute(fileP.Name(), 100*time.Second, nil) // give the script plenty of time to run
 	assert.NoError(t, err)
 	assert.Contains(t, buf.String(), "error data")
 
@@ -212,16 +214,26 @@ func TestExecutor(t *testing.T) {
 	// write more than 10KB to stderr
 	fileP, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_11", "#!/bin/bash \nhead -c 89999 </dev/urandom >&2\n exit 1")
 	assert.NoError(t, err)
-	err = execute(fileP.Name(), 100)
+	err = execute(fileP.Name(), 100*time.Second, nil)
 	assert.EqualError(t, err, "exit status 1")
 	assert.Contains(t, buf.String(), "Truncated to 10KB")
 
 	// add a script that will time-out, and die
 	filep, err := createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_10_btoot", "!#/bin/bash \nsleep 2")
 	assert.NoError(t, err)
-	ret := retCode(execute(filep.Name(), 1))
+	ret := retCode(execute(filep.Name(), 1, nil))
 	assert.Equal(t, ret, -1)
 
+	// a hanging script holding stderr open is killed once the timeout
+	// expires
+	filep, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Leave_12",
+		"#!/bin/bash \necho 'started' >&2\nsleep 10")
+	assert.NoError(t, err)
+	start := time.Now()
+	ret = retCode(execute(filep.Name(), 1*time.Second, nil))
+	assert.Equal(t, -1, ret)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
 	// Test retry-later functionality
 	l := Launcher{
 		ArtScriptsPath:          tmpArt,
@@ -409,3 +421,36 @@ func TestReportScriptStatus(t *testing.T) {
 		string(`{"status":"installing", "substate":"finished executing script: ArtifactInstall_Enter_06"}`),
 		string(responder.recdata[3]))
 }
+
+func TestExecutorEnv(t *testing.T) {
+	tmpArt, err := ioutil.TempDir("", "art_scripts")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpArt)
+
+	out := filepath.Join(tmpArt, "out")
+	_, err = createArtifactTestScript(tmpArt, "ArtifactInstall_Enter_00",
+		"#!/bin/sh\necho \"$MENDER_ARTIFACT_NAME $PATH\" > "+out)
+	require.NoError(t, err)
+	require.NoError(t, NewStore(tmpArt).Finalize(2))
+
+	name := "release-1"
+	l := Launcher{
+		ArtScriptsPath:          tmpArt,
+		SupportedScriptVersions: []int{2},
+		Env: func() []string {
+			return []string{"MENDER_ARTIFACT_NAME=" + name}
+		},
+	}
+	require.NoError(t, l.ExecuteAll("ArtifactInstall", "Enter", false, nil))
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	// added to the environment of the daemon
+	assert.Equal(t, "release-1 "+os.Getenv("PATH")+"\n", string(data))
+
+	// evaluated for every script
+	name = "release-2"
+	require.NoError(t, l.ExecuteAll("ArtifactInstall", "Enter", false, nil))
+	data, err = ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "release-2 ")
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// validateStatusPageAddress checks that the status page is served on a
+// loopback address only, as it is not authenticated.
+func validateStatusPageAddress(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid StatusPage address %q", addr)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("StatusPage must be served on a loopback address, not %q", addr)
+	}
+	return nil
+}
+
+// loggedError is the last error logged by the client.
+type loggedError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// errorRecorder is a logrus hook keeping the last error logged while it is
+// enabled.
+type errorRecorder struct {
+	mutex   sync.Mutex
+	enabled bool
+	last    *loggedError
+}
+
+// statusPageErrors records the errors for the status page. The logger has no
+// way of removing a hook, so it is added once, and enabled only while the
+// status page is served.
+var (
+	statusPageErrors     = &errorRecorder{}
+	statusPageErrorsHook sync.Once
+)
+
+// enable starts recording errors, forgetting the last one.
+func (e *errorRecorder) enable(enabled bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.enabled = enabled
+	e.last = nil
+}
+
+func (e *errorRecorder) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel}
+}
+
+func (e *errorRecorder) Fire(entry *logrus.Entry) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.enabled {
+		e.last = &loggedError{Message: entry.Message, Time: entry.Time}
+	}
+	return nil
+}
+
+func (e *errorRecorder) lastError() *loggedError {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.last
+}
+
+// pendingDeployment is the deployment the client is busy with.
+type pendingDeployment struct {
+	ID           string `json:"id"`
+	ArtifactName string `json:"artifact_name"`
+}
+
+// stateSnapshot is a copy of what the status page shows of a state, taken by
+// the daemon when it enters the state, so that the page never reads the state
+// the daemon is handling.
+type stateSnapshot struct {
+	state      string
+	deployment *pendingDeployment
+}
+
+func snapshotState(state State) stateSnapshot {
+	s := stateSnapshot{state: state.Id().String()}
+	if update, err := getUpdateFromState(state); err == nil && update.ID != "" {
+		s.deployment = &pendingDeployment{
+			ID:           update.ID,
+			ArtifactName: update.ArtifactName(),
+		}
+	}
+	return s
+}
+
+// stateSnapshotter is implemented by controllers which keep a snapshot of
+// their current state.
+type stateSnapshotter interface {
+	StateSnapshot() stateSnapshot
+}
+
+// deviceStatus is what the status page shows.
+type deviceStatus struct {
+	ArtifactName string `json:"artifact_name"`
+	State        string `json:"state"`
+	// zero if never
+	LastUpdateCheck           time.Time          `json:"last_update_check"`
+	LastSuccessfulUpdateCheck time.Time          `json:"last_successful_update_check"`
+	LastError                 *loggedError       `json:"last_error,omitempty"`
+	Deployment                *pendingDeployment `json:"deployment,omitempty"`
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Mender client status</title>
+</head>
+<body>
+<h1>Mender client status</h1>
+<table>
+<tr><th align="left">Artifact</th><td>{{.ArtifactName}}</td></tr>
+<tr><th align="left">State</th><td>{{.State}}</td></tr>
+<tr><th align="left">Last update check</th><td>{{if .LastUpdateCheck.IsZero}}never{{else}}{{.LastUpdateCheck.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+<tr><th align="left">Last successful update check</th><td>{{if .LastSuccessfulUpdateCheck.IsZero}}never{{else}}{{.LastSuccessfulUpdateCheck.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+<tr><th align="left">Last error</th><td>{{with .LastError}}{{.Time.Format "2006-01-02 15:04:05 MST"}}: {{.Message}}{{else}}none{{end}}</td></tr>
+<tr><th align="left">Deployment</th><td>{{with .Deployment}}{{.ID}}, artifact {{.ArtifactName}}{{else}}none{{end}}</td></tr>
+</table>
+<p><a href="/v1/status">JSON</a></p>
+</body>
+</html>
+`))
+
+// statusPage serves a read-only page of the status of the client, on a
+// loopback address, so that technicians can diagnose the device with a
+// browser or curl without access to the server:
+//
+//	GET /           status page
+//	GET /v1/status  the same status as JSON
+type statusPage struct {
+	daemon   *menderDaemon
+	errors   *errorRecorder
+	listener net.Listener
+	server   *http.Server
+}
+
+func startStatusPage(d *menderDaemon, addr string) (*statusPage, error) {
+	if err := validateStatusPageAddress(addr); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on status page address")
+	}
+
+	p := &statusPage{
+		daemon:   d,
+		errors:   statusPageErrors,
+		listener: l,
+	}
+	statusPageErrorsHook.Do(func() {
+		log.AddHook(statusPageErrors)
+	})
+	p.errors.enable(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.handlePage)
+	mux.HandleFunc("/v1/status", p.handleStatus)
+	p.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("status page failed: %v", err)
+		}
+	}()
+	log.Infof("serving status page on http://%s/", l.Addr())
+	return p, nil
+}
+
+func (p *statusPage) Close() error {
+	p.errors.enable(false)
+	return p.server.Close()
+}
+
+func (p *statusPage) status() deviceStatus {
+	m := p.daemon.mender
+	var s deviceStatus
+	name, err := m.GetCurrentArtifactName()
+	if err != nil {
+		log.Debugf("status page failed to read the artifact name: %v", err)
+	}
+	s.ArtifactName = name
+	var snapshot stateSnapshot
+	if ss, ok := m.(stateSnapshotter); ok {
+		snapshot = ss.StateSnapshot()
+	} else {
+		snapshot = snapshotState(m.GetCurrentState())
+	}
+	s.State = snapshot.state
+	s.Deployment = snapshot.deployment
+	if mp, ok := m.(metricsProvider); ok {
+		s.LastUpdateCheck, s.LastSuccessfulUpdateCheck = mp.Metrics().lastChecks()
+	}
+	s.LastError = p.errors.lastError()
+	return s
+}
+
+// readOnly answers requests other than GET and HEAD as not allowed.
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (p *statusPage) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !readOnly(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, p.status()); err != nil {
+		log.Warnf("status page failed to write response: %v", err)
+	}
+}
+
+func (p *statusPage) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	writeJSON(w, p.status())
+}
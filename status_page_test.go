@@ -0,0 +1,115 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status-page")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "artifact_info"),
+		[]byte("artifact_name=release-1"), 0644))
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{store: ms},
+	})
+	mender.artifactInfoFile = path.Join(dir, "artifact_info")
+	d := NewDaemon(mender, ms)
+
+	_, err = startStatusPage(d, "0.0.0.0:0")
+	assert.Error(t, err)
+	sp, err := startStatusPage(d, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sp.Close()
+	url := "http://" + sp.listener.Addr().String()
+
+	getStatus := func() map[string]interface{} {
+		rsp, err := http.Get(url + "/v1/status")
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		var status map[string]interface{}
+		require.NoError(t, json.NewDecoder(rsp.Body).Decode(&status))
+		return status
+	}
+
+	status := getStatus()
+	assert.Equal(t, "release-1", status["artifact_name"])
+	assert.Equal(t, "init", status["state"])
+	assert.Equal(t, "0001-01-01T00:00:00Z", status["last_update_check"])
+	assert.NotContains(t, status, "last_error")
+	assert.NotContains(t, status, "deployment")
+
+	// busy with a deployment, after an update check failed
+	update := client.UpdateResponse{ID: "deployment-1"}
+	update.Artifact.ArtifactName = "release-2"
+	mender.SetNextState(NewUpdateFetchState(update))
+	mender.metrics.updateChecked(checkFailureNetwork)
+	// an error logged, as passed on to the hook
+	sp.errors.Fire(&logrus.Entry{
+		Message: "update check failed: no route to host",
+		Level:   logrus.ErrorLevel,
+		Time:    time.Now(),
+	})
+
+	status = getStatus()
+	assert.Equal(t, "update-fetch", status["state"])
+	assert.NotEqual(t, "0001-01-01T00:00:00Z", status["last_update_check"])
+	assert.Equal(t, "0001-01-01T00:00:00Z", status["last_successful_update_check"])
+	assert.Equal(t, "update check failed: no route to host",
+		status["last_error"].(map[string]interface{})["message"])
+	assert.Equal(t, map[string]interface{}{
+		"id":            "deployment-1",
+		"artifact_name": "release-2",
+	}, status["deployment"])
+
+	rsp, err := http.Get(url + "/")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Contains(t, rsp.Header.Get("Content-Type"), "text/html")
+	for _, s := range []string{"release-1", "update-fetch", "no route to host",
+		"deployment-1"} {
+		assert.Contains(t, string(body), s)
+	}
+
+	// read-only
+	rsp, err = http.Post(url+"/v1/status", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	rsp, err = http.Get(url + "/update-check")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
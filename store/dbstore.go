@@ -197,3 +197,65 @@ func (dbw *DBStoreWrite) Close() error {
 func (dbw *DBStoreWrite) Commit() error {
 	return dbw.dbs.writeBytes(dbw.name, &dbw.data)
 }
+
+// dbTxn is a transaction of a DBStore.
+type dbTxn struct {
+	txn *lmdb.Txn
+	dbi lmdb.DBI
+}
+
+func (t *dbTxn) ReadAll(name string) ([]byte, error) {
+	data, err := t.txn.Get(t.dbi, []byte(name))
+	if lmdb.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read data for key %s", name)
+	}
+	// the data is only valid until the transaction ends
+	return append([]byte(nil), data...), nil
+}
+
+func (t *dbTxn) WriteAll(name string, data []byte) error {
+	if err := t.txn.Put(t.dbi, []byte(name), data, 0); err != nil {
+		return errors.Wrapf(err, "failed to write data for key %s", name)
+	}
+	return nil
+}
+
+func (t *dbTxn) Remove(name string) error {
+	err := t.txn.Del(t.dbi, []byte(name), nil)
+	if lmdb.IsNotFound(err) {
+		return os.ErrNotExist
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to delete key %s", name)
+	}
+	return nil
+}
+
+// WriteTransaction runs txnFunc in an LMDB write transaction, which is
+// durable once committed.
+func (db *DBStore) WriteTransaction(txnFunc func(txn Transaction) error) error {
+	if db.env == nil {
+		return ErrDBStoreNotInitialized
+	}
+	return db.env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		return txnFunc(&dbTxn{txn: txn, dbi: dbi})
+	})
+}
+
+func (db *DBStore) ReadTransaction(txnFunc func(txn Transaction) error) error {
+	if db.env == nil {
+		return ErrDBStoreNotInitialized
+	}
+	return db.env.View(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		return txnFunc(&dbTxn{txn: txn, dbi: dbi})
+	})
+}
@@ -129,6 +129,73 @@ func (ms *MemStore) Disable(disable bool) {
 	ms.disable = disable
 }
 
+// memTxn is a transaction of a MemStore, working on a copy of the entries.
+type memTxn struct {
+	data     map[string]*MemStoreData
+	readonly bool
+}
+
+func (t *memTxn) ReadAll(name string) ([]byte, error) {
+	v, ok := t.data[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), v.data...), nil
+}
+
+func (t *memTxn) WriteAll(name string, data []byte) error {
+	if t.readonly {
+		return errReadOnly
+	}
+	t.data[name] = &MemStoreData{data: append([]byte(nil), data...)}
+	return nil
+}
+
+func (t *memTxn) Remove(name string) error {
+	if t.readonly {
+		return errReadOnly
+	}
+	if _, ok := t.data[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(t.data, name)
+	return nil
+}
+
+func (ms *MemStore) transaction(readonly bool) (*memTxn, error) {
+	if ms.disable {
+		return nil, errDisabled
+	}
+	txn := &memTxn{
+		data:     make(map[string]*MemStoreData, len(ms.data)),
+		readonly: readonly || ms.readonly,
+	}
+	for name, v := range ms.data {
+		txn.data[name] = v
+	}
+	return txn, nil
+}
+
+func (ms *MemStore) WriteTransaction(txnFunc func(txn Transaction) error) error {
+	txn, err := ms.transaction(false)
+	if err != nil {
+		return err
+	}
+	if err := txnFunc(txn); err != nil {
+		return err
+	}
+	ms.data = txn.data
+	return nil
+}
+
+func (ms *MemStore) ReadTransaction(txnFunc func(txn Transaction) error) error {
+	txn, err := ms.transaction(true)
+	if err != nil {
+		return err
+	}
+	return txnFunc(txn)
+}
+
 func NewMemStore() *MemStore {
 	return &MemStore{
 		data: make(map[string]*MemStoreData),
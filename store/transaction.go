@@ -0,0 +1,124 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Transaction gives access to the entries of a store within a transaction;
+// errors preserve the semantics of the Store methods.
+type Transaction interface {
+	ReadAll(name string) ([]byte, error)
+	WriteAll(name string, data []byte) error
+	Remove(name string) error
+}
+
+// Transactioner is implemented by stores able to change several entries
+// atomically, so that either all or none of the changes survive a crash or
+// power cut.
+type Transactioner interface {
+	// run txnFunc in a transaction, which is committed if it returns nil
+	// and discarded otherwise
+	WriteTransaction(txnFunc func(txn Transaction) error) error
+	// run txnFunc with a consistent view of the store
+	ReadTransaction(txnFunc func(txn Transaction) error) error
+}
+
+// WriteTransaction runs txnFunc in a write transaction of s or, if s does
+// not support transactions, on s directly.
+func WriteTransaction(s Store, txnFunc func(txn Transaction) error) error {
+	if t, ok := s.(Transactioner); ok {
+		return t.WriteTransaction(txnFunc)
+	}
+	return txnFunc(s)
+}
+
+// ReadTransaction runs txnFunc in a read transaction of s or, if s does not
+// support transactions, on s directly.
+func ReadTransaction(s Store, txnFunc func(txn Transaction) error) error {
+	if t, ok := s.(Transactioner); ok {
+		return t.ReadTransaction(txnFunc)
+	}
+	return txnFunc(s)
+}
+
+// SchemaVersionKey is the entry holding the version of the schema of the
+// entries of a store, zero if missing.
+const SchemaVersionKey = "schema-version"
+
+// Migration upgrades the entries of a store to a version of their schema.
+type Migration struct {
+	Version int
+	Migrate func(txn Transaction) error
+}
+
+// Migrate applies the migrations for the versions newer than the schema of s,
+// in order and each in a transaction of its own, together with updating the
+// version. It returns the version the store had before.
+func Migrate(s Store, migrations []Migration) (int, error) {
+	var from int
+	err := ReadTransaction(s, func(txn Transaction) error {
+		var err error
+		from, err = schemaVersion(txn)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	version := from
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Infof("migrating data store from schema version %d to %d",
+			version, m.Version)
+		err := WriteTransaction(s, func(txn Transaction) error {
+			if err := m.Migrate(txn); err != nil {
+				return err
+			}
+			return txn.WriteAll(SchemaVersionKey, []byte(strconv.Itoa(m.Version)))
+		})
+		if err != nil {
+			return from, errors.Wrapf(err, "failed to migrate data store to "+
+				"schema version %d", m.Version)
+		}
+		version = m.Version
+	}
+	if len(migrations) > 0 && version > migrations[len(migrations)-1].Version {
+		// written by a newer client, e.g. before rolling back an update
+		log.Warnf("data store has schema version %d, newer than the "+
+			"supported version %d", version, migrations[len(migrations)-1].Version)
+	}
+	return from, nil
+}
+
+func schemaVersion(txn Transaction) (int, error) {
+	data, err := txn.ReadAll(SchemaVersionKey)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid schema version of data store")
+	}
+	return version, nil
+}
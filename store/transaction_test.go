@@ -0,0 +1,133 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTransactions(t *testing.T, s Store) {
+	require.NoError(t, s.WriteAll("a", []byte("1")))
+
+	err := WriteTransaction(s, func(txn Transaction) error {
+		data, err := txn.ReadAll("a")
+		require.NoError(t, err)
+		assert.Equal(t, "1", string(data))
+		require.NoError(t, txn.WriteAll("b", []byte("2")))
+		return txn.Remove("a")
+	})
+	require.NoError(t, err)
+	_, err = s.ReadAll("a")
+	assert.True(t, os.IsNotExist(err))
+	data, err := s.ReadAll("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(data))
+
+	// nothing is changed by failing transactions
+	err = WriteTransaction(s, func(txn Transaction) error {
+		require.NoError(t, txn.WriteAll("b", []byte("3")))
+		require.NoError(t, txn.WriteAll("c", []byte("3")))
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	data, err = s.ReadAll("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(data))
+	_, err = s.ReadAll("c")
+	assert.True(t, os.IsNotExist(err))
+
+	err = ReadTransaction(s, func(txn Transaction) error {
+		_, err := txn.ReadAll("c")
+		assert.True(t, os.IsNotExist(err))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestMemStoreTransactions(t *testing.T) {
+	testTransactions(t, NewMemStore())
+}
+
+func TestDBStoreTransactions(t *testing.T) {
+	tmppath, err := ioutil.TempDir("", "mendertest-dbstore-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmppath)
+
+	db := NewDBStore(tmppath)
+	require.NotNil(t, db)
+	defer db.Close()
+	testTransactions(t, db)
+
+	assert.Equal(t, ErrDBStoreNotInitialized, (&DBStore{}).WriteTransaction(
+		func(Transaction) error { return nil }))
+}
+
+func TestMigrate(t *testing.T) {
+	ms := NewMemStore()
+	var applied []int
+	migrations := []Migration{
+		{Version: 1, Migrate: func(txn Transaction) error {
+			applied = append(applied, 1)
+			return txn.WriteAll("one", []byte("1"))
+		}},
+		{Version: 2, Migrate: func(txn Transaction) error {
+			applied = append(applied, 2)
+			return nil
+		}},
+	}
+
+	from, err := Migrate(ms, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, 0, from)
+	assert.Equal(t, []int{1, 2}, applied)
+	version, err := ms.ReadAll(SchemaVersionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(version))
+
+	// migrations are applied once
+	from, err = Migrate(ms, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, 2, from)
+	assert.Equal(t, []int{1, 2}, applied)
+
+	// the version is only updated together with the migration
+	ms = NewMemStore()
+	migrations[1].Migrate = func(txn Transaction) error {
+		txn.WriteAll("two", []byte("2"))
+		return errors.New("failed")
+	}
+	_, err = Migrate(ms, migrations)
+	assert.Error(t, err)
+	version, err = ms.ReadAll(SchemaVersionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(version))
+	_, err = ms.ReadAll("two")
+	assert.True(t, os.IsNotExist(err))
+
+	// stores of newer clients are left alone
+	require.NoError(t, ms.WriteAll(SchemaVersionKey, []byte("5")))
+	from, err = Migrate(ms, migrations)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, from)
+
+	require.NoError(t, ms.WriteAll(SchemaVersionKey, []byte("x")))
+	_, err = Migrate(ms, migrations)
+	assert.Error(t, err)
+}
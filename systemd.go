@@ -0,0 +1,111 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// States other than wait states taking longer than this are considered
+// wedged, and the systemd watchdog is no longer fed. Downloads are bounded
+// only by Timeouts.DownloadSeconds, if set; slower ones count as wedged too.
+var maxStateDuration = 5 * time.Hour
+
+// sdNotify sends a notification, e.g. READY=1, to systemd. It does nothing
+// unless the daemon runs as a systemd service of Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval the systemd watchdog expects
+// heartbeats in, or zero if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// stateWatchdog feeds the systemd watchdog as long as the state machine
+// makes progress.
+type stateWatchdog struct {
+	mutex   sync.Mutex
+	since   time.Time
+	waiting bool
+}
+
+// enter records the state machine entering a new state.
+func (w *stateWatchdog) enter(s State) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.since = time.Now()
+	_, w.waiting = s.(WaitState)
+
+	if err := sdNotify("STATUS=" + s.Id().String() + "\nWATCHDOG=1"); err != nil {
+		log.Debugf("failed to notify systemd: %v", err)
+	}
+}
+
+// healthy returns false if the current state takes longer than any state
+// should.
+func (w *stateWatchdog) healthy(now time.Time) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.waiting || now.Sub(w.since) < maxStateDuration
+}
+
+// run sends heartbeats in the given interval until stop is closed.
+func (w *stateWatchdog) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if !w.healthy(now) {
+				log.Errorf("state machine stuck for more than %v; "+
+					"not feeding the watchdog", maxStateDuration)
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Debugf("failed to notify systemd: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotify sets up a socket receiving systemd notifications.
+func listenNotify(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "notify")
+	require.NoError(t, err)
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+
+	old, hadOld := os.LookupEnv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", name)
+	return conn, func() {
+		if hadOld {
+			os.Setenv("NOTIFY_SOCKET", old)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	// not running under systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(t, sdNotify("READY=1"))
+
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+	assert.NoError(t, sdNotify("READY=1"))
+	assert.Equal(t, "READY=1", readNotify(t, conn))
+
+	os.Setenv("NOTIFY_SOCKET", "/does/not/exist")
+	assert.Error(t, sdNotify("READY=1"))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	// meant for another process
+	os.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
+
+func TestStateWatchdog(t *testing.T) {
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	var w stateWatchdog
+	w.enter(updateCheckState)
+	assert.Equal(t, "STATUS=update-check\nWATCHDOG=1", readNotify(t, conn))
+	assert.True(t, w.healthy(time.Now()))
+	assert.False(t, w.healthy(time.Now().Add(maxStateDuration)))
+
+	// waiting may take as long as it is configured to
+	w.enter(NewCheckWaitState())
+	readNotify(t, conn)
+	assert.True(t, w.healthy(time.Now().Add(2*maxStateDuration)))
+
+	stop := make(chan struct{})
+	go w.run(time.Millisecond, stop)
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, conn))
+	close(stop)
+}
+
+func TestDaemonNotifiesSystemd(t *testing.T) {
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil, menderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	mender.state = &fakePreDoneState{
+		baseState{
+			id: MenderStateInit,
+		},
+	}
+
+	d := NewDaemon(mender, ms)
+	assert.NoError(t, d.Run())
+	assert.Equal(t, "READY=1", readNotify(t, conn))
+	assert.Equal(t, "STATUS=init\nWATCHDOG=1", readNotify(t, conn))
+}
@@ -272,25 +272,11 @@ func (sexec *stateScriptReportExecutor) CheckRootfsScriptsVersion() error {
 func TestTransitionReporting(t *testing.T) {
 
 	update := client.UpdateResponse{
-		Artifact: struct {
-			Source struct {
-				URI    string
-				Expire string
-			}
-			CompatibleDevices []string `json:"device_types_compatible"`
-			ArtifactName      string   `json:"artifact_name"`
-		}{
-			Source: struct {
-				URI    string
-				Expire string
-			}{
-				URI: strings.Join([]string{"www.example.com", "test"}, "/"),
-			},
-			CompatibleDevices: []string{"vexpress"},
-			ArtifactName:      "foo",
-		},
 		ID: "foo",
 	}
+	update.Artifact.Source.URI = strings.Join([]string{"www.example.com", "test"}, "/")
+	update.Artifact.CompatibleDevices = []string{"vexpress"}
+	update.Artifact.ArtifactName = "foo"
 
 	tc := []struct {
 		state    State
@@ -0,0 +1,372 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const defaultFwEnvConfig = "/etc/fw_env.config"
+
+// envDevice is the device, or file, holding a copy of the U-Boot environment.
+type envDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// fwEnvCopy is the location of a copy of the environment, as given by a line
+// of fw_env.config.
+type fwEnvCopy struct {
+	device string
+	offset int64
+	size   int64
+}
+
+// ubootEnvCopy is the content of a copy of the environment.
+type ubootEnvCopy struct {
+	vars  BootVars
+	flags byte
+	valid bool
+}
+
+// ubootEnvFile reads and writes the U-Boot environment without fw_printenv
+// and fw_setenv, committing changes in two phases so that a power loss at any
+// point leaves a valid environment: the new environment is written to the
+// inactive redundant copy first, under a flag making U-Boot prefer the active
+// copy, and read back; only then is the flag, which the checksum does not
+// cover, set to make it the active copy. Copies on block devices and in files
+// are supported, not on raw NAND or UBI volumes.
+type ubootEnvFile struct {
+	configFile string
+	open       func(name string) (envDevice, error)
+}
+
+func NewUBootEnvFile(configFile string) *ubootEnvFile {
+	if configFile == "" {
+		configFile = defaultFwEnvConfig
+	}
+	return &ubootEnvFile{
+		configFile: configFile,
+		open: func(name string) (envDevice, error) {
+			return os.OpenFile(name, os.O_RDWR, 0)
+		},
+	}
+}
+
+// parseFwEnvConfig parses the copies of the environment from fw_env.config,
+// with lines of device, offset and size; further columns, e.g. the erase
+// block size, are ignored.
+func parseFwEnvConfig(r io.Reader) ([]fwEnvCopy, error) {
+	var copies []fwEnvCopy
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.Errorf("invalid line %q", line)
+		}
+		offset, err := strconv.ParseInt(fields[1], 0, 64)
+		if err != nil || offset < 0 {
+			return nil, errors.Errorf("invalid offset in %q", line)
+		}
+		size, err := strconv.ParseInt(fields[2], 0, 64)
+		// large enough for the header and the terminating zero bytes
+		if err != nil || size < 8 {
+			return nil, errors.Errorf("invalid size in %q", line)
+		}
+		name := filepath.Base(fields[0])
+		if strings.HasPrefix(name, "mtd") || strings.HasPrefix(name, "ubi") {
+			return nil, errors.Errorf("environment on %s is not supported; "+
+				"only block devices and files are", fields[0])
+		}
+		copies = append(copies, fwEnvCopy{device: fields[0], offset: offset, size: size})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(copies) == 0:
+		return nil, errors.New("no environment configured")
+	case len(copies) > 2:
+		return nil, errors.New("at most two copies of the environment are supported")
+	case len(copies) == 2 && copies[0].size != copies[1].size:
+		return nil, errors.New("the copies of the environment differ in size")
+	}
+	return copies, nil
+}
+
+func (e *ubootEnvFile) config() ([]fwEnvCopy, error) {
+	f, err := os.Open(e.configFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read U-Boot environment configuration")
+	}
+	defer f.Close()
+	copies, err := parseFwEnvConfig(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid U-Boot environment configuration %s",
+			e.configFile)
+	}
+	return copies, nil
+}
+
+// headerSize returns the size of the header of the copies, the checksum and,
+// for redundant environments, the flag.
+func headerSize(redundant bool) int {
+	if redundant {
+		return 5
+	}
+	return 4
+}
+
+// decodeEnvCopy returns the content of a copy; the copy is not valid if its
+// checksum does not match, as after an interrupted write.
+func decodeEnvCopy(data []byte, redundant bool) ubootEnvCopy {
+	hdr := headerSize(redundant)
+	var c ubootEnvCopy
+	if crc32.ChecksumIEEE(data[hdr:]) != binary.LittleEndian.Uint32(data) {
+		return c
+	}
+	if redundant {
+		c.flags = data[4]
+	}
+	c.vars = make(BootVars)
+	for _, kv := range bytes.Split(data[hdr:], []byte{0}) {
+		if len(kv) == 0 {
+			// the end of the variables
+			break
+		}
+		parts := strings.SplitN(string(kv), "=", 2)
+		if len(parts) != 2 {
+			return ubootEnvCopy{}
+		}
+		c.vars[parts[0]] = parts[1]
+	}
+	c.valid = true
+	return c
+}
+
+func encodeEnvCopy(vars BootVars, flags byte, size int64, redundant bool) ([]byte, error) {
+	hdr := headerSize(redundant)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := make([]byte, hdr, size)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "=\x00") ||
+			strings.Contains(vars[name], "\x00") {
+			return nil, errors.Errorf("invalid U-Boot variable %q", name)
+		}
+		data = append(data, name+"="+vars[name]+"\x00"...)
+	}
+	// terminated by an empty variable
+	if int64(len(data)+1) > size {
+		return nil, errors.Errorf("U-Boot environment does not fit in %d bytes", size)
+	}
+	data = data[:size]
+
+	if redundant {
+		data[4] = flags
+	}
+	binary.LittleEndian.PutUint32(data, crc32.ChecksumIEEE(data[hdr:]))
+	return data, nil
+}
+
+// activeCopy returns the index of the copy U-Boot uses: the valid one or, if
+// both are, the one with the newer flag, the flag being a counter wrapping
+// from 255 to 0.
+func activeCopy(copies []ubootEnvCopy) int {
+	if len(copies) == 1 || !copies[1].valid {
+		if copies[0].valid {
+			return 0
+		}
+		return -1
+	}
+	if !copies[0].valid {
+		return 1
+	}
+	f0, f1 := copies[0].flags, copies[1].flags
+	switch {
+	case f0 == 255 && f1 == 0:
+		return 1
+	case f1 == 255 && f0 == 0:
+		return 0
+	case f1 > f0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (e *ubootEnvFile) readCopy(loc fwEnvCopy, redundant bool) (ubootEnvCopy, error) {
+	dev, err := e.open(loc.device)
+	if err != nil {
+		return ubootEnvCopy{}, errors.Wrapf(err, "failed to open U-Boot environment")
+	}
+	defer dev.Close()
+	data := make([]byte, loc.size)
+	if _, err := dev.ReadAt(data, loc.offset); err != nil {
+		return ubootEnvCopy{}, errors.Wrapf(err, "failed to read U-Boot environment")
+	}
+	return decodeEnvCopy(data, redundant), nil
+}
+
+// read returns the locations and contents of the copies of the environment,
+// and which of them is active.
+func (e *ubootEnvFile) read() ([]fwEnvCopy, []ubootEnvCopy, int, error) {
+	locs, err := e.config()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	copies := make([]ubootEnvCopy, len(locs))
+	for i, loc := range locs {
+		if copies[i], err = e.readCopy(loc, len(locs) == 2); err != nil {
+			return nil, nil, -1, err
+		}
+	}
+	active := activeCopy(copies)
+	if active < 0 {
+		return nil, nil, -1, errors.New("no valid U-Boot environment found")
+	}
+	return locs, copies, active, nil
+}
+
+func checkEnvVarsCanary(vars BootVars) error {
+	if vars["mender_check_saveenv_canary"] == "1" && vars["mender_saveenv_canary"] != "1" {
+		return errors.New(saveEnvCanaryErrMsg)
+	}
+	return nil
+}
+
+// ReadEnv returns the given variables, or all of them if no names are given.
+// Like fw_printenv, it fails if any of the given variables is not defined.
+func (e *ubootEnvFile) ReadEnv(names ...string) (BootVars, error) {
+	_, copies, active, err := e.read()
+	if err != nil {
+		return nil, err
+	}
+	all := copies[active].vars
+	if err := checkEnvVarsCanary(all); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return all, nil
+	}
+	vars := make(BootVars)
+	for _, name := range names {
+		val, ok := all[name]
+		if !ok {
+			return nil, errors.Errorf("U-Boot variable %q not defined", name)
+		}
+		vars[name] = val
+	}
+	return vars, nil
+}
+
+// WriteEnv sets the given variables; variables with empty values are
+// removed from the environment. Either all or none of the changes survive a
+// power loss if the environment is redundant.
+func (e *ubootEnvFile) WriteEnv(vars BootVars) error {
+	locs, copies, active, err := e.read()
+	if err != nil {
+		return err
+	}
+	if err := checkEnvVarsCanary(copies[active].vars); err != nil {
+		return err
+	}
+
+	env := make(BootVars)
+	for k, v := range copies[active].vars {
+		env[k] = v
+	}
+	for k, v := range vars {
+		if v == "" {
+			delete(env, k)
+		} else {
+			env[k] = v
+		}
+	}
+
+	if len(locs) == 1 {
+		log.Warn("U-Boot environment is not redundant; writing it is not " +
+			"safe against power loss")
+		data, err := encodeEnvCopy(env, 0, locs[0].size, false)
+		if err != nil {
+			return err
+		}
+		return e.writeCopy(locs[0], data, 0)
+	}
+
+	// phase one: the new environment loses against the active copy until
+	// it has been written completely
+	target := 1 - active
+	flags := copies[active].flags
+	data, err := encodeEnvCopy(env, flags-1, locs[target].size, true)
+	if err != nil {
+		return err
+	}
+	if err := e.writeCopy(locs[target], data, 0); err != nil {
+		return errors.Wrapf(err, "failed to write redundant U-Boot environment")
+	}
+
+	// phase two: switch to the new environment by writing the flag alone
+	if err := e.writeCopy(locs[target], []byte{flags + 1}, 4); err != nil {
+		return errors.Wrapf(err, "failed to activate redundant U-Boot environment")
+	}
+	return nil
+}
+
+// writeCopy writes data at pos of the copy, and verifies it by reading it
+// back once it has been synced.
+func (e *ubootEnvFile) writeCopy(loc fwEnvCopy, data []byte, pos int64) error {
+	dev, err := e.open(loc.device)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open U-Boot environment")
+	}
+	defer dev.Close()
+
+	if _, err := dev.WriteAt(data, loc.offset+pos); err != nil {
+		return err
+	}
+	if err := dev.Sync(); err != nil {
+		return err
+	}
+	written := make([]byte, len(data))
+	if _, err := dev.ReadAt(written, loc.offset+pos); err != nil {
+		return err
+	}
+	if !bytes.Equal(written, data) {
+		return errors.New("U-Boot environment read back differs from what was written")
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEnvSize = 0x100
+
+// memEnvDevice is an environment device in memory, losing power once the
+// given number of bytes has been written.
+type memEnvDevice struct {
+	data []byte
+	// bytes written before the power is lost; negative for never
+	powerLossAfter int
+}
+
+var errPowerLoss = errors.New("power lost")
+
+func (d *memEnvDevice) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *memEnvDevice) WriteAt(p []byte, off int64) (int, error) {
+	if d.powerLossAfter >= 0 && len(p) > d.powerLossAfter {
+		n := copy(d.data[off:], p[:d.powerLossAfter])
+		d.powerLossAfter = 0
+		return n, errPowerLoss
+	}
+	if d.powerLossAfter >= 0 {
+		d.powerLossAfter -= len(p)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memEnvDevice) Sync() error  { return nil }
+func (d *memEnvDevice) Close() error { return nil }
+
+// newTestUBootEnv returns an environment of two copies on dev, the first
+// holding vars.
+func newTestUBootEnv(t *testing.T, dir string, dev *memEnvDevice, vars BootVars) *ubootEnvFile {
+	conf := filepath.Join(dir, "fw_env.config")
+	require.NoError(t, ioutil.WriteFile(conf, []byte(
+		"# device offset size\n/dev/test 0x0 0x100\n/dev/test 0x100 0x100\n"), 0600))
+
+	dev.data = make([]byte, 2*testEnvSize)
+	dev.powerLossAfter = -1
+	data, err := encodeEnvCopy(vars, 1, testEnvSize, true)
+	require.NoError(t, err)
+	copy(dev.data, data)
+
+	env := NewUBootEnvFile(conf)
+	env.open = func(name string) (envDevice, error) {
+		assert.Equal(t, "/dev/test", name)
+		return dev, nil
+	}
+	return env
+}
+
+func TestParseFwEnvConfig(t *testing.T) {
+	copies, err := parseFwEnvConfig(strings.NewReader(
+		"/dev/mmcblk0 0x400000 0x4000\n\n# comment\n/dev/mmcblk0 0x800000 16384 0x4000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []fwEnvCopy{
+		{device: "/dev/mmcblk0", offset: 0x400000, size: 0x4000},
+		{device: "/dev/mmcblk0", offset: 0x800000, size: 0x4000},
+	}, copies)
+
+	for _, conf := range []string{
+		"",
+		"/dev/mmcblk0 0x400000",
+		"/dev/mmcblk0 foo 0x4000",
+		"/dev/mmcblk0 0x400000 0x4",
+		"/dev/mtd1 0x0 0x4000",
+		"/dev/ubi0_0 0x0 0x4000",
+		"/dev/mmcblk0 0x0 0x4000\n/dev/mmcblk0 0x4000 0x2000",
+		"/dev/mmcblk0 0x0 0x4000\n/dev/mmcblk0 0x4000 0x4000\n/dev/mmcblk0 0x8000 0x4000",
+	} {
+		_, err := parseFwEnvConfig(strings.NewReader(conf))
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestActiveEnvCopy(t *testing.T) {
+	valid := func(flags byte) ubootEnvCopy { return ubootEnvCopy{flags: flags, valid: true} }
+
+	assert.Equal(t, 0, activeCopy([]ubootEnvCopy{valid(0)}))
+	assert.Equal(t, -1, activeCopy([]ubootEnvCopy{{}}))
+	assert.Equal(t, -1, activeCopy([]ubootEnvCopy{{}, {}}))
+	assert.Equal(t, 1, activeCopy([]ubootEnvCopy{{flags: 9}, valid(1)}))
+	assert.Equal(t, 0, activeCopy([]ubootEnvCopy{valid(1), {flags: 9}}))
+	assert.Equal(t, 1, activeCopy([]ubootEnvCopy{valid(1), valid(2)}))
+	assert.Equal(t, 0, activeCopy([]ubootEnvCopy{valid(3), valid(2)}))
+	assert.Equal(t, 0, activeCopy([]ubootEnvCopy{valid(2), valid(2)}))
+	// the flag wraps
+	assert.Equal(t, 1, activeCopy([]ubootEnvCopy{valid(255), valid(0)}))
+	assert.Equal(t, 0, activeCopy([]ubootEnvCopy{valid(0), valid(255)}))
+}
+
+func TestUBootEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubootenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dev := new(memEnvDevice)
+	env := newTestUBootEnv(t, dir, dev, BootVars{"bootcount": "0", "upgrade_available": "0"})
+
+	vars, err := env.ReadEnv("bootcount")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"bootcount": "0"}, vars)
+	_, err = env.ReadEnv("mender_boot_part")
+	assert.Error(t, err)
+
+	// written alternately to the copies
+	require.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "3", "bootcount": ""}))
+	vars, err = env.ReadEnv()
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "0"}, vars)
+	assert.Equal(t, byte(2), dev.data[testEnvSize+4])
+
+	require.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "1"}))
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+	assert.Equal(t, byte(3), dev.data[4])
+
+	// the flag wraps
+	dev.data[4] = 255
+	copy(dev.data[testEnvSize:], make([]byte, testEnvSize))
+	require.NoError(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+	assert.Equal(t, byte(0), dev.data[testEnvSize+4])
+	vars, err = env.ReadEnv("bootcount")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"bootcount": "1"}, vars)
+
+	err = env.WriteEnv(BootVars{"big": strings.Repeat("x", testEnvSize)})
+	assert.Error(t, err)
+	err = env.WriteEnv(BootVars{"a=b": "1"})
+	assert.Error(t, err)
+
+	// nothing valid to start from
+	copy(dev.data, make([]byte, 2*testEnvSize))
+	_, err = env.ReadEnv()
+	assert.Error(t, err)
+	assert.Error(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+}
+
+func TestUBootEnvFilePowerLoss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubootenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old := BootVars{"bootcount": "0", "mender_boot_part": "2"}
+	updated := BootVars{"bootcount": "0", "mender_boot_part": "3", "upgrade_available": "1"}
+
+	// losing power after each number of bytes written, through the write
+	// of the copy and of the flag, leaves either environment
+	for n := 0; n <= testEnvSize+1; n++ {
+		dev := new(memEnvDevice)
+		env := newTestUBootEnv(t, dir, dev, old)
+		dev.powerLossAfter = n
+		err := env.WriteEnv(BootVars{"mender_boot_part": "3", "upgrade_available": "1"})
+
+		vars, rerr := env.ReadEnv()
+		require.NoError(t, rerr, n)
+		if err != nil {
+			assert.Equal(t, old, vars, n)
+		} else {
+			assert.Equal(t, updated, vars, n)
+		}
+		assert.Equal(t, n > testEnvSize, err == nil, n)
+	}
+
+	// a torn copy is ignored, even with a newer flag
+	dev := new(memEnvDevice)
+	env := newTestUBootEnv(t, dir, dev, old)
+	data, err := encodeEnvCopy(updated, 2, testEnvSize, true)
+	require.NoError(t, err)
+	copy(dev.data[testEnvSize:], data)
+	dev.data[testEnvSize+8] ^= 0xff
+	vars, err := env.ReadEnv()
+	require.NoError(t, err)
+	assert.Equal(t, old, vars)
+}
+
+func TestUBootEnvFileVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubootenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dev := new(memEnvDevice)
+	env := newTestUBootEnv(t, dir, dev, BootVars{"bootcount": "0"})
+	env.open = func(string) (envDevice, error) {
+		return &lossyEnvDevice{dev}, nil
+	}
+	err = env.WriteEnv(BootVars{"bootcount": "1"})
+	assert.Error(t, err)
+
+	// the active copy is untouched
+	env.open = func(string) (envDevice, error) { return dev, nil }
+	vars, err := env.ReadEnv()
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"bootcount": "0"}, vars)
+}
+
+// lossyEnvDevice silently corrupts what is written.
+type lossyEnvDevice struct {
+	*memEnvDevice
+}
+
+func (d *lossyEnvDevice) WriteAt(p []byte, off int64) (int, error) {
+	corrupted := append([]byte(nil), p...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	return d.memEnvDevice.WriteAt(corrupted, off)
+}
+
+func TestUBootEnvFileCanary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubootenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dev := new(memEnvDevice)
+	env := newTestUBootEnv(t, dir, dev, BootVars{"mender_check_saveenv_canary": "1"})
+	_, err = env.ReadEnv("mender_check_saveenv_canary")
+	assert.Error(t, err)
+	assert.Error(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+
+	env = newTestUBootEnv(t, dir, dev, BootVars{
+		"mender_check_saveenv_canary": "1",
+		"mender_saveenv_canary":       "1",
+	})
+	assert.NoError(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+}
+
+func TestUBootEnvFileNotRedundant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ubootenv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dev := filepath.Join(dir, "env")
+	conf := filepath.Join(dir, "fw_env.config")
+	require.NoError(t, ioutil.WriteFile(conf, []byte(dev+" 0x10 0x100\n"), 0600))
+
+	data, err := encodeEnvCopy(BootVars{"bootcount": "0"}, 0, testEnvSize, false)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dev, append(make([]byte, 0x10), data...), 0600))
+
+	env := NewUBootEnvFile(conf)
+	require.NoError(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+	vars, err := env.ReadEnv("bootcount")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{"bootcount": "1"}, vars)
+
+	fi, err := os.Stat(dev)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0x10+testEnvSize), fi.Size())
+}
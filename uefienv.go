@@ -0,0 +1,412 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	bootloaderUEFI = "uefi"
+
+	// boot managers of UEFI devices
+	bootManagerEfibootmgr  = "efibootmgr"
+	bootManagerSystemdBoot = "systemd-boot"
+
+	// vendor GUID of the variables of systemd-boot
+	systemdBootVendor = "4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+
+	// boot variable of the UEFI environment only, the boot trying the
+	// updated partition was started from
+	uefiTrialBootID = "uefi_trial_boot_id"
+)
+
+var (
+	// needed so that we can override them when testing
+	efivarsDir = "/sys/firmware/efi/efivars"
+	bootIDFile = "/proc/sys/kernel/random/boot_id"
+)
+
+// uefiBootManager switches the boot entries of a UEFI device.
+type uefiBootManager interface {
+	// the entry the device has been booted from
+	booted() (string, error)
+	// boots the entry on the next boot only, the default entry after that
+	bootOnce(entry string) error
+	// makes the entry the one booted by default, and cancels booting
+	// another one once
+	setDefault(entry string) error
+}
+
+// uefiEnv keeps the boot variables of the client, the same the U-Boot and
+// GRUB integrations use, in a file on the data partition and switches the
+// boot entries of the root filesystem partitions accordingly: the updated
+// partition is booted once, rather than counting boot attempts, so that the
+// firmware boots the previous one again if the update does not boot, or
+// resets before it is committed, and the committed one is made the default.
+// The new boot after an update not having booted the updated partition is
+// noted as a rollback by resetting upgrade_available.
+type uefiEnv struct {
+	manager uefiBootManager
+	envFile string
+	// entries by partition number
+	entries map[string]string
+}
+
+// NewUEFIEnvironment returns the boot environment of a UEFI device switching
+// entries with the configured boot manager.
+func NewUEFIEnvironment(cmd Commander, config *menderConfig) BootEnvReadWriter {
+	var manager uefiBootManager = &efibootmgr{cmd}
+	if config.UEFI.BootManager == bootManagerSystemdBoot {
+		manager = &systemdBoot{cmd}
+	}
+	return &uefiEnv{
+		manager: manager,
+		envFile: config.uefiEnvFile(),
+		entries: config.UEFI.BootEntries,
+	}
+}
+
+func validateUEFIConfig(config menderConfig) error {
+	switch config.UEFI.BootManager {
+	case "", bootManagerEfibootmgr, bootManagerSystemdBoot:
+	default:
+		return errors.Errorf("unsupported UEFI.BootManager: %q", config.UEFI.BootManager)
+	}
+	if config.Bootloader == bootloaderUEFI && len(config.UEFI.BootEntries) < 2 {
+		return errors.New("UEFI.BootEntries of both root filesystem partitions " +
+			"are required with the uefi Bootloader")
+	}
+	for part := range config.UEFI.BootEntries {
+		if _, err := strconv.Atoi(part); err != nil {
+			return errors.Errorf("invalid partition number of UEFI.BootEntries: %q", part)
+		}
+	}
+	return nil
+}
+
+func (e *uefiEnv) partition(entry string) (string, bool) {
+	for part, ent := range e.entries {
+		if ent == entry {
+			return part, true
+		}
+	}
+	return "", false
+}
+
+func (e *uefiEnv) load() (BootVars, error) {
+	vars := make(BootVars)
+	data, err := ioutil.ReadFile(e.envFile)
+	if os.IsNotExist(err) {
+		return vars, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read UEFI boot environment")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Invalid UEFI boot variable: " + line)
+		}
+		vars[kv[0]] = kv[1]
+	}
+	return vars, nil
+}
+
+func (e *uefiEnv) store(vars BootVars) error {
+	lines := make([]string, 0, len(vars))
+	for k, v := range vars {
+		if v != "" {
+			lines = append(lines, k+"="+v+"\n")
+		}
+	}
+	sort.Strings(lines)
+
+	f, err := ioutil.TempFile(filepath.Dir(e.envFile), ".mender-uefi-env")
+	if err == nil {
+		_, err = f.WriteString(strings.Join(lines, ""))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), e.envFile)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	return errors.Wrapf(err, "failed to write UEFI boot environment")
+}
+
+func currentBootID() (string, error) {
+	id, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read boot ID")
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+func setBootPart(vars BootVars, part string) {
+	vars["mender_boot_part"] = part
+	if n, err := strconv.Atoi(part); err == nil {
+		vars["mender_boot_part_hex"] = fmt.Sprintf("%X", n)
+	}
+}
+
+// ReadEnv returns the given variables, or all of them if no names are given,
+// failing if any of the given ones is not defined. The partition booted is
+// taken from the boot manager until an update has been installed.
+func (e *uefiEnv) ReadEnv(names ...string) (BootVars, error) {
+	vars, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if vars["mender_boot_part"] == "" || vars["upgrade_available"] == "1" {
+		if err := e.checkBooted(vars); err != nil {
+			return nil, err
+		}
+	}
+	delete(vars, uefiTrialBootID)
+
+	if len(names) == 0 {
+		return vars, nil
+	}
+	result := make(BootVars)
+	for _, name := range names {
+		val, ok := vars[name]
+		if !ok {
+			return nil, errors.Errorf("UEFI boot variable %q not defined", name)
+		}
+		result[name] = val
+	}
+	return result, nil
+}
+
+// checkBooted sets the partition booted if it is not known yet, and notes
+// booting the previous partition again after an update.
+func (e *uefiEnv) checkBooted(vars BootVars) error {
+	entry, err := e.manager.booted()
+	if err != nil {
+		return err
+	}
+	part, ok := e.partition(entry)
+	if !ok {
+		return errors.Errorf("booted from UEFI boot entry %q, which is none of "+
+			"UEFI.BootEntries", entry)
+	}
+
+	if vars["mender_boot_part"] == "" {
+		setBootPart(vars, part)
+		vars["upgrade_available"] = "0"
+		vars["bootcount"] = "0"
+		return nil
+	}
+
+	// the device has not been rebooted since the update was installed
+	bootID, err := currentBootID()
+	if err != nil {
+		return err
+	}
+	if bootID == vars[uefiTrialBootID] || part == vars["mender_boot_part"] {
+		return nil
+	}
+	log.Errorf("booted partition %s rather than the updated partition %s; "+
+		"the update did not boot", part, vars["mender_boot_part"])
+	setBootPart(vars, part)
+	vars["upgrade_available"] = "0"
+	delete(vars, uefiTrialBootID)
+	return e.store(vars)
+}
+
+// WriteEnv sets the given variables, removing those with empty values, and
+// switches the boot entries: the partition of mender_boot_part is booted
+// once if upgrade_available is set, and by default otherwise.
+func (e *uefiEnv) WriteEnv(vars BootVars) error {
+	env, err := e.ReadEnv()
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		env[k] = v
+	}
+
+	part := env["mender_boot_part"]
+	entry, ok := e.entries[part]
+	if !ok {
+		return errors.Errorf("no UEFI boot entry of partition %q in UEFI.BootEntries", part)
+	}
+	if env["upgrade_available"] == "1" {
+		if env[uefiTrialBootID], err = currentBootID(); err != nil {
+			return err
+		}
+		// the variables first, so that the partition is not booted
+		// without them noting the update
+		if err := e.store(env); err != nil {
+			return err
+		}
+		log.Infof("booting UEFI boot entry %s of partition %s once", entry, part)
+		return e.manager.bootOnce(entry)
+	}
+
+	log.Infof("booting UEFI boot entry %s of partition %s by default", entry, part)
+	if err := e.manager.setDefault(entry); err != nil {
+		return err
+	}
+	return e.store(env)
+}
+
+func runBootManager(cmd Commander, name string, args ...string) ([]byte, error) {
+	c := cmd.Command(name, args...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed: %s", name, strings.Join(args, " "),
+			strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// efibootmgr switches the firmware boot entries, Boot####, with BootNext and
+// BootOrder.
+type efibootmgr struct {
+	Commander
+}
+
+// status returns the BootCurrent, BootNext and BootOrder efibootmgr reports.
+func (m *efibootmgr) status() (map[string]string, error) {
+	out, err := runBootManager(m, "efibootmgr")
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 {
+			status[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return status, nil
+}
+
+func (m *efibootmgr) booted() (string, error) {
+	status, err := m.status()
+	if err != nil {
+		return "", err
+	}
+	current, ok := status["BootCurrent"]
+	if !ok {
+		return "", errors.New("efibootmgr did not report BootCurrent")
+	}
+	return current, nil
+}
+
+func (m *efibootmgr) bootOnce(entry string) error {
+	_, err := runBootManager(m, "efibootmgr", "--bootnext", entry)
+	return err
+}
+
+func (m *efibootmgr) setDefault(entry string) error {
+	status, err := m.status()
+	if err != nil {
+		return err
+	}
+	order := []string{entry}
+	for _, e := range strings.Split(status["BootOrder"], ",") {
+		if e != "" && e != entry {
+			order = append(order, e)
+		}
+	}
+	if _, err := runBootManager(m, "efibootmgr", "--bootorder", strings.Join(order, ",")); err != nil {
+		return err
+	}
+	if _, ok := status["BootNext"]; ok {
+		_, err = runBootManager(m, "efibootmgr", "--delete-bootnext")
+	}
+	return err
+}
+
+// systemdBoot switches the loader entries of systemd-boot with bootctl; the
+// entry booted is read from its LoaderEntrySelected variable.
+type systemdBoot struct {
+	Commander
+}
+
+// readEFIString reads a variable of systemd-boot holding a UTF-16 string; ""
+// if it is not set.
+func readEFIString(name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(efivarsDir, name+"-"+systemdBootVendor))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to read EFI variable %s", name)
+	}
+	// attributes first
+	if len(data) < 4 || len(data)%2 != 0 {
+		return "", errors.Errorf("invalid EFI variable %s", name)
+	}
+	chars := make([]uint16, 0, (len(data)-4)/2)
+	for i := 4; i < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+func (b *systemdBoot) booted() (string, error) {
+	entry, err := readEFIString("LoaderEntrySelected")
+	if err == nil && entry == "" {
+		err = errors.New("systemd-boot did not set LoaderEntrySelected")
+	}
+	return entry, err
+}
+
+func (b *systemdBoot) bootOnce(entry string) error {
+	_, err := runBootManager(b, "bootctl", "set-oneshot", entry)
+	return err
+}
+
+func (b *systemdBoot) setDefault(entry string) error {
+	if _, err := runBootManager(b, "bootctl", "set-default", entry); err != nil {
+		return err
+	}
+	oneshot, err := readEFIString("LoaderEntryOneShot")
+	if err == nil && oneshot != "" {
+		_, err = runBootManager(b, "bootctl", "set-oneshot", "")
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEfibootmgr keeps BootCurrent, BootNext and BootOrder in files next to
+// it, and logs the changes.
+const fakeEfibootmgr = `#!/bin/sh
+dir=$(dirname "$0")
+case $1 in
+"")
+	echo "BootCurrent: $(cat "$dir/current")"
+	if [ -f "$dir/next" ]; then
+		echo "BootNext: $(cat "$dir/next")"
+	fi
+	echo "Timeout: 1 seconds"
+	echo "BootOrder: $(cat "$dir/order")"
+	echo "Boot0001* rootfs A"
+	echo "Boot0002* rootfs B"
+	echo "Boot0003* PXE"
+	;;
+--bootnext)
+	echo "$2" > "$dir/next"
+	;;
+--delete-bootnext)
+	rm "$dir/next"
+	;;
+--bootorder)
+	echo "$2" > "$dir/order"
+	;;
+*)
+	echo "unknown option $1" >&2
+	exit 1
+	;;
+esac
+echo "$@" >> "$dir/log"
+`
+
+// fakeBootctl sets the systemd-boot variables in efivarsDir.
+const fakeBootctl = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/log"
+echo "$2" > "$dir/$1"
+`
+
+func fakeBootReboot(t *testing.T, dir string) {
+	// the firmware boots BootNext once, or the first of BootOrder
+	next, err := ioutil.ReadFile(filepath.Join(dir, "next"))
+	if err == nil {
+		os.Remove(filepath.Join(dir, "next"))
+	} else {
+		order, err := ioutil.ReadFile(filepath.Join(dir, "order"))
+		require.NoError(t, err)
+		next = []byte(strings.Split(string(order), ",")[0])
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "current"), next, 0644))
+	bootID, err := ioutil.ReadFile(bootIDFile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(bootIDFile, append([]byte("1"), bootID...), 0644))
+}
+
+func readFakeBootFile(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	return strings.TrimSpace(string(data))
+}
+
+func setupUEFIEnv(t *testing.T, script, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "uefienv")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755))
+
+	oldBootIDFile, oldEfivarsDir := bootIDFile, efivarsDir
+	bootIDFile = filepath.Join(dir, "boot_id")
+	efivarsDir = dir
+	require.NoError(t, ioutil.WriteFile(bootIDFile, []byte("first-boot\n"), 0644))
+	return dir, func() {
+		bootIDFile, efivarsDir = oldBootIDFile, oldEfivarsDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUEFIEnvEfibootmgr(t *testing.T) {
+	dir, cleanup := setupUEFIEnv(t, fakeEfibootmgr, "efibootmgr")
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "current"), []byte("0001"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order"), []byte("0001,0002,0003"), 0644))
+
+	config := &menderConfig{Bootloader: bootloaderUEFI}
+	config.UEFI.BootEntries = map[string]string{"2": "0001", "3": "0002"}
+	config.UEFI.EnvFile = filepath.Join(dir, "uefi_env")
+	env := NewBootEnvironment(dirCommander{dir}, config)
+
+	// the booted partition, before any update
+	vars, err := env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2", "upgrade_available": "0"}, vars)
+
+	// the update boots once
+	assert.NoError(t, env.WriteEnv(BootVars{
+		"upgrade_available":    "1",
+		"mender_boot_part":     "3",
+		"mender_boot_part_hex": "3",
+		"bootcount":            "0",
+	}))
+	assert.Equal(t, "0002", readFakeBootFile(t, dir, "next"))
+	assert.Equal(t, "0001,0002,0003", readFakeBootFile(t, dir, "order"))
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+
+	fakeBootReboot(t, dir)
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+
+	// and becomes the default once committed
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	assert.Equal(t, "0002,0001,0003", readFakeBootFile(t, dir, "order"))
+
+	fakeBootReboot(t, dir)
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "mender_boot_part_hex": "3",
+		"upgrade_available": "0", "bootcount": "0"}, vars)
+
+	// the firmware boots the committed partition again if the update does
+	// not boot
+	assert.NoError(t, env.WriteEnv(BootVars{
+		"upgrade_available":    "1",
+		"mender_boot_part":     "2",
+		"mender_boot_part_hex": "2",
+	}))
+	os.Remove(filepath.Join(dir, "next"))
+	fakeBootReboot(t, dir)
+	vars, err = env.ReadEnv("mender_boot_part", "mender_boot_part_hex", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "mender_boot_part_hex": "3",
+		"upgrade_available": "0"}, vars)
+
+	// rolling back before rebooting cancels BootNext
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "1",
+		"mender_boot_part": "2"}))
+	assert.Equal(t, "0002", readFakeBootFile(t, dir, "current"))
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0",
+		"mender_boot_part": "3"}))
+	_, err = os.Stat(filepath.Join(dir, "next"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, readFakeBootFile(t, dir, "log"), "--delete-bootnext")
+
+	_, err = env.ReadEnv("bootargs")
+	assert.Error(t, err)
+	assert.Error(t, env.WriteEnv(BootVars{"mender_boot_part": "4"}))
+}
+
+func TestUEFIEnvUnknownEntry(t *testing.T) {
+	dir, cleanup := setupUEFIEnv(t, fakeEfibootmgr, "efibootmgr")
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "current"), []byte("0003"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "order"), []byte("0003"), 0644))
+
+	config := &menderConfig{Bootloader: bootloaderUEFI}
+	config.UEFI.BootEntries = map[string]string{"2": "0001", "3": "0002"}
+	config.UEFI.EnvFile = filepath.Join(dir, "uefi_env")
+	env := NewBootEnvironment(dirCommander{dir}, config)
+
+	_, err := env.ReadEnv("mender_boot_part")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"0003"`)
+}
+
+func writeEFIString(t *testing.T, name, value string) {
+	data := []byte{7, 0, 0, 0}
+	for _, c := range utf16.Encode([]rune(value + "\x00")) {
+		data = append(data, 0, 0)
+		binary.LittleEndian.PutUint16(data[len(data)-2:], c)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(efivarsDir,
+		name+"-"+systemdBootVendor), data, 0644))
+}
+
+func TestUEFIEnvSystemdBoot(t *testing.T) {
+	dir, cleanup := setupUEFIEnv(t, fakeBootctl, "bootctl")
+	defer cleanup()
+	writeEFIString(t, "LoaderEntrySelected", "rootfs-a.conf")
+
+	config := &menderConfig{Bootloader: bootloaderUEFI}
+	config.UEFI.BootManager = bootManagerSystemdBoot
+	config.UEFI.BootEntries = map[string]string{"2": "rootfs-a.conf", "3": "rootfs-b.conf"}
+	config.UEFI.EnvFile = filepath.Join(dir, "uefi_env")
+	env := NewBootEnvironment(dirCommander{dir}, config)
+
+	vars, err := env.ReadEnv("mender_boot_part")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2"}, vars)
+
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "1",
+		"mender_boot_part": "3"}))
+	assert.Equal(t, "rootfs-b.conf", readFakeBootFile(t, dir, "set-oneshot"))
+
+	require.NoError(t, ioutil.WriteFile(bootIDFile, []byte("second-boot\n"), 0644))
+	writeEFIString(t, "LoaderEntrySelected", "rootfs-b.conf")
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	assert.Equal(t, "rootfs-b.conf", readFakeBootFile(t, dir, "set-default"))
+	// no one-shot entry pending
+	assert.NotContains(t, readFakeBootFile(t, dir, "log")+"\n", "\nset-oneshot\n")
+
+	// the update does not boot
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "1",
+		"mender_boot_part": "2"}))
+	writeEFIString(t, "LoaderEntryOneShot", "rootfs-a.conf")
+	require.NoError(t, ioutil.WriteFile(bootIDFile, []byte("third-boot\n"), 0644))
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "0"}, vars)
+
+	// the pending one-shot entry is cleared with the default set
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	assert.Contains(t, readFakeBootFile(t, dir, "log")+"\n", "\nset-oneshot\n")
+}
+
+func TestUEFIConfig(t *testing.T) {
+	config := menderConfig{Bootloader: bootloaderUEFI}
+	assert.Error(t, config.validate())
+
+	config.UEFI.BootEntries = map[string]string{"2": "0001", "3": "0002"}
+	assert.NoError(t, config.validate())
+	assert.Equal(t, filepath.Join(getStateDirPath(), "uefi_env"), config.uefiEnvFile())
+	config.DataDir = "/data/mender"
+	assert.Equal(t, "/data/mender/uefi_env", config.uefiEnvFile())
+
+	config.UEFI.BootManager = "refind"
+	assert.Error(t, config.validate())
+
+	config.UEFI.BootManager = bootManagerSystemdBoot
+	config.UEFI.BootEntries = map[string]string{"rootfs-a": "a.conf", "3": "b.conf"}
+	assert.Error(t, config.validate())
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bsdiffMagic      = "BSDIFF40"
+	bsdiffHeaderSize = 32
+)
+
+var ErrCorruptPatch = errors.New("corrupt patch")
+
+// Patch is a binary diff in the format produced by bsdiff: a header followed
+// by bzip2 compressed control, diff and extra blocks.
+type Patch struct {
+	r       io.ReaderAt
+	size    int64
+	ctrlLen int64
+	diffLen int64
+	// size of the file the patch produces
+	NewSize int64
+}
+
+// offtin decodes the sign-magnitude integers used by bsdiff.
+func offtin(buf []byte) int64 {
+	v := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		return -v
+	}
+	return v
+}
+
+// NewPatch reads the header of the patch of the given size.
+func NewPatch(r io.ReaderAt, size int64) (*Patch, error) {
+	hdr := make([]byte, bsdiffHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, errors.Wrapf(err, "failed to read patch header")
+	}
+	if !bytes.Equal(hdr[:8], []byte(bsdiffMagic)) {
+		return nil, errors.Wrapf(ErrCorruptPatch, "invalid patch header")
+	}
+
+	p := &Patch{
+		r:       r,
+		size:    size,
+		ctrlLen: offtin(hdr[8:]),
+		diffLen: offtin(hdr[16:]),
+		NewSize: offtin(hdr[24:]),
+	}
+	if p.ctrlLen < 0 || p.diffLen < 0 || p.NewSize < 0 ||
+		bsdiffHeaderSize+p.ctrlLen+p.diffLen > size {
+		return nil, errors.Wrapf(ErrCorruptPatch, "invalid patch header")
+	}
+	return p, nil
+}
+
+func (p *Patch) block(off, n int64) io.Reader {
+	return bzip2.NewReader(io.NewSectionReader(p.r, off, n))
+}
+
+// Apply reconstructs the new file from old and writes it to w.
+func (p *Patch) Apply(old io.ReaderAt, oldSize int64, w io.Writer) error {
+	ctrl := p.block(bsdiffHeaderSize, p.ctrlLen)
+	diff := p.block(bsdiffHeaderSize+p.ctrlLen, p.diffLen)
+	extraOff := bsdiffHeaderSize + p.ctrlLen + p.diffLen
+	extra := p.block(extraOff, p.size-extraOff)
+
+	var oldPos, newPos int64
+	buf := make([]byte, 32*1024)
+	oldBuf := make([]byte, len(buf))
+	ctrlBuf := make([]byte, 24)
+
+	for newPos < p.NewSize {
+		if _, err := io.ReadFull(ctrl, ctrlBuf); err != nil {
+			return errors.Wrapf(ErrCorruptPatch, "failed to read control block: %v", err)
+		}
+		diffLen := offtin(ctrlBuf)
+		extraLen := offtin(ctrlBuf[8:])
+		seek := offtin(ctrlBuf[16:])
+		if diffLen < 0 || extraLen < 0 || newPos+diffLen+extraLen > p.NewSize {
+			return errors.Wrapf(ErrCorruptPatch, "invalid control data")
+		}
+
+		// diff block bytes are added to the bytes of the old file
+		for diffLen > 0 {
+			n := int64(len(buf))
+			if diffLen < n {
+				n = diffLen
+			}
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return errors.Wrapf(ErrCorruptPatch, "failed to read diff block: %v", err)
+			}
+			if err := readOld(old, oldSize, oldPos, oldBuf[:n]); err != nil {
+				return err
+			}
+			for i := int64(0); i < n; i++ {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			diffLen -= n
+			oldPos += n
+			newPos += n
+		}
+
+		// extra block bytes are copied as they are
+		if _, err := io.CopyN(w, extra, extraLen); err != nil {
+			return errors.Wrapf(ErrCorruptPatch, "failed to read extra block: %v", err)
+		}
+		newPos += extraLen
+		oldPos += seek
+	}
+	return nil
+}
+
+// readOld fills buf with the old file contents at off; bytes outside of the
+// old file read as zero.
+func readOld(old io.ReaderAt, oldSize, off int64, buf []byte) error {
+	for i := range buf {
+		buf[i] = 0
+	}
+	start, end := off, off+int64(len(buf))
+	if start < 0 {
+		start = 0
+	}
+	if end > oldSize {
+		end = oldSize
+	}
+	if start >= end {
+		return nil
+	}
+	if _, err := old.ReadAt(buf[start-off:end-off], start); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to read base of the patch")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	patchOld = "hello mender world, this is the old image"
+	patchNew = "hello MENDER world, this is the new image!!"
+	// patch from patchOld to patchNew, with two control entries of which
+	// the first one seeks backwards in the old file
+	patchHex = "4253444946463430320000000000000051000000000000002b00000000000000425a68393141592653591fa061e400000ae0405c040804400020002188d3210c08d6e320e20a65be2ee48a70a1203f40c3c8425a683931415926535949e891890000004e19f6c400022000088000040016400010e2a000314006234d3468534000d36a1a113535b348cc852b2193c00a9e369c043be5e697e2ee48a70a12093d123120425a6839314159265359a11fd63600000011804000000080802000219819816177245385090a11fd6360"
+)
+
+func TestPatch(t *testing.T) {
+	data, err := hex.DecodeString(patchHex)
+	require.NoError(t, err)
+
+	p, err := NewPatch(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(patchNew)), p.NewSize)
+
+	out := bytes.NewBuffer(nil)
+	assert.NoError(t, p.Apply(bytes.NewReader([]byte(patchOld)),
+		int64(len(patchOld)), out))
+	assert.Equal(t, patchNew, out.String())
+
+	// bad magic
+	bad := append([]byte("BSDIFF41"), data[8:]...)
+	_, err = NewPatch(bytes.NewReader(bad), int64(len(bad)))
+	assert.Equal(t, ErrCorruptPatch, errors.Cause(err))
+
+	// truncated patch
+	_, err = NewPatch(bytes.NewReader(data[:40]), 40)
+	assert.Equal(t, ErrCorruptPatch, errors.Cause(err))
+
+	// control block not matching the size of the new file
+	broken := make([]byte, len(data))
+	copy(broken, data)
+	broken[24] += 10
+	p, err = NewPatch(bytes.NewReader(broken), int64(len(broken)))
+	require.NoError(t, err)
+	err = p.Apply(bytes.NewReader([]byte(patchOld)), int64(len(patchOld)),
+		bytes.NewBuffer(nil))
+	assert.Equal(t, ErrCorruptPatch, errors.Cause(err))
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// DefaultDigest is the algorithm of checksums not naming one.
+const DefaultDigest = "sha256"
+
+// digests are the hash algorithms of checksums, by their identifier.
+var digests = map[string]func() hash.Hash{
+	"sha256":     sha256.New,
+	"sha384":     sha512.New384,
+	"sha512":     sha512.New,
+	"sha512-256": sha512.New512_256,
+}
+
+// RegisterDigest makes the hash algorithm newHash available to checksums as
+// name, e.g. "blake2b-256". Meant to be called from init functions.
+func RegisterDigest(name string, newHash func() hash.Hash) {
+	digests[strings.ToLower(name)] = newHash
+}
+
+// DigestSupported tells whether checksums of the algorithm name can be
+// verified.
+func DigestSupported(name string) bool {
+	_, ok := digests[strings.ToLower(name)]
+	return ok
+}
+
+// SplitChecksum returns the algorithm and the hex encoded digest of a
+// checksum given as <algorithm>:<hex>, or as plain hex of DefaultDigest.
+func SplitChecksum(checksum string) (string, string) {
+	if i := strings.Index(checksum, ":"); i >= 0 {
+		return strings.ToLower(checksum[:i]), checksum[i+1:]
+	}
+	return DefaultDigest, checksum
+}
+
+// ValidateChecksum checks the format of a checksum given as <algorithm>:<hex>,
+// or as plain hex of DefaultDigest, and its length if the algorithm is
+// supported; checksums of other algorithms are left to be skipped.
+func ValidateChecksum(c string) error {
+	algorithm, digest := SplitChecksum(c)
+	if algorithm == "" || strings.TrimLeft(algorithm, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return errors.Errorf("invalid checksum algorithm '%s'", algorithm)
+	}
+	if digest == "" {
+		return errors.Errorf("invalid checksum '%s'", c)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return errors.Wrapf(err, "invalid checksum '%s'", c)
+	}
+	if DigestSupported(algorithm) {
+		_, err := parseChecksum(c)
+		return err
+	}
+	return nil
+}
+
+type checksum struct {
+	algorithm string
+	h         hash.Hash
+	expected  []byte
+}
+
+func parseChecksum(c string) (*checksum, error) {
+	algorithm, digest := SplitChecksum(c)
+	newHash, ok := digests[algorithm]
+	if !ok {
+		return nil, errors.Errorf("unsupported checksum algorithm '%s'", algorithm)
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid checksum '%s'", c)
+	}
+	h := newHash()
+	if len(expected) != h.Size() {
+		return nil, errors.Errorf("invalid %s checksum length %d, expected %d",
+			algorithm, len(expected), h.Size())
+	}
+	return &checksum{algorithm: algorithm, h: h, expected: expected}, nil
+}
+
+// ChecksumReader is a wrapper for io.ReadCloser computing digests of all the
+// data read through it. Once the underlying reader is exhausted the computed
+// digests are compared with the expected ones, and a mismatch is reported in
+// place of io.EOF.
+type ChecksumReader struct {
+	r         io.ReadCloser
+	checksums []*checksum
+	err       error
+}
+
+// NewChecksumReader returns a ChecksumReader verifying that data read from r
+// matches all the checksums, each given as <algorithm>:<hex>, or as hex
+// encoded SHA256.
+func NewChecksumReader(r io.ReadCloser, checksums ...string) (*ChecksumReader, error) {
+	if len(checksums) == 0 {
+		return nil, errors.New("no checksum to verify")
+	}
+	cr := &ChecksumReader{r: r}
+	for _, c := range checksums {
+		parsed, err := parseChecksum(c)
+		if err != nil {
+			return nil, err
+		}
+		cr.checksums = append(cr.checksums, parsed)
+	}
+	return cr, nil
+}
+
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.r.Read(p)
+	for _, cs := range c.checksums {
+		cs.h.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		for _, cs := range c.checksums {
+			if sum := cs.h.Sum(nil); !bytes.Equal(sum, cs.expected) {
+				c.err = errors.Wrapf(ErrChecksumMismatch, "expected %s %x, got %x",
+					cs.algorithm, cs.expected, sum)
+				return n, c.err
+			}
+		}
+	}
+	c.err = err
+	return n, err
+}
+
+// Verify consumes any data not read so far and returns an error if the
+// checksum of the whole stream does not match the expected one.
+func (c *ChecksumReader) Verify() error {
+	_, err := io.Copy(ioutil.Discard, c)
+	return err
+}
+
+func (c *ChecksumReader) Close() error {
+	return c.r.Close()
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := []byte("some data to be verified")
+
+	_, err := NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)), "zz")
+	assert.Error(t, err)
+	_, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)), "abcd")
+	assert.Error(t, err)
+
+	// matching checksum
+	cr, err := NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex(data))
+	assert.NoError(t, err)
+	out, err := ioutil.ReadAll(cr)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.NoError(t, cr.Verify())
+	assert.NoError(t, cr.Close())
+
+	// mismatch is reported instead of EOF
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex([]byte("other data")))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(cr)
+	assert.Error(t, err)
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+	// and is sticky
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(cr.Verify()))
+
+	// partially read stream is verified in full
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex(data))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = cr.Read(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, cr.Verify())
+
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex(data[:4]))
+	assert.NoError(t, err)
+	_, err = cr.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(cr.Verify()))
+}
+
+func TestChecksumReaderAlgorithms(t *testing.T) {
+	data := []byte("some data to be verified")
+	sum512 := sha512.Sum512(data)
+	sha512Hex := hex.EncodeToString(sum512[:])
+
+	// of the default algorithm, named or not
+	for _, c := range []string{sha256Hex(data), "sha256:" + sha256Hex(data),
+		"SHA256:" + sha256Hex(data)} {
+		cr, err := NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)), c)
+		assert.NoError(t, err, c)
+		assert.NoError(t, cr.Verify(), c)
+	}
+
+	cr, err := NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		"sha512:"+sha512Hex)
+	assert.NoError(t, err)
+	assert.NoError(t, cr.Verify())
+
+	// length of the digest of the algorithm
+	_, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		"sha512:"+sha256Hex(data))
+	assert.Error(t, err)
+	_, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		"md5:"+sha256Hex(data))
+	assert.Error(t, err)
+	_, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)))
+	assert.Error(t, err)
+
+	// all the checksums must match
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex(data), "sha512:"+sha512Hex)
+	assert.NoError(t, err)
+	assert.NoError(t, cr.Verify())
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		sha256Hex(data), "sha512:"+strings.Repeat("00", sha512.Size))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(cr.Verify()))
+
+	// further algorithms can be registered
+	assert.False(t, DigestSupported("md5"))
+	RegisterDigest("MD5", md5.New)
+	defer delete(digests, "md5")
+	assert.True(t, DigestSupported("md5"))
+	sumMD5 := md5.Sum(data)
+	cr, err = NewChecksumReader(ioutil.NopCloser(bytes.NewReader(data)),
+		"md5:"+hex.EncodeToString(sumMD5[:]))
+	assert.NoError(t, err)
+	assert.NoError(t, cr.Verify())
+}
+
+func TestSplitChecksum(t *testing.T) {
+	algorithm, digest := SplitChecksum("abcd")
+	assert.Equal(t, DefaultDigest, algorithm)
+	assert.Equal(t, "abcd", digest)
+
+	algorithm, digest = SplitChecksum("SHA512:abcd")
+	assert.Equal(t, "sha512", algorithm)
+	assert.Equal(t, "abcd", digest)
+}
+
+func TestValidateChecksum(t *testing.T) {
+	digest := sha256Hex([]byte("some data"))
+	for c, valid := range map[string]bool{
+		digest:                      true,
+		"sha256:" + digest:          true,
+		"SHA256:" + digest:          true,
+		"sha256:" + digest[:62]:     false,
+		"sha256:" + digest[:63]:     false,
+		"sha256:":                   false,
+		"":                          false,
+		"sha256:" + digest + "0g":   false,
+		"sha 256:" + digest:         false,
+		":" + digest:                false,
+		"sha3-256:" + digest:        true,
+		"sha3-256:" + digest + "zz": false,
+		"sha512:" + digest:          false,
+	} {
+		if valid {
+			assert.NoError(t, ValidateChecksum(c), c)
+		} else {
+			assert.Error(t, ValidateChecksum(c), c)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorKind classifies errors by what can be done about them: retrying,
+// authorizing again, or failing the deployment.
+type ErrorKind int
+
+const (
+	// errors not classified otherwise
+	ErrorKindUnknown ErrorKind = iota
+	// the server could not be reached or did not respond properly, e.g.
+	// connection failures, timeouts and 5xx statuses
+	ErrorKindNetwork
+	// the device is not authorized, or not anymore
+	ErrorKindAuth
+	// the artifact is broken or can not be installed on the device
+	ErrorKindArtifact
+	// the artifact could not be written, e.g. as the device is full
+	ErrorKindStorage
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindNetwork:
+		return "network"
+	case ErrorKindAuth:
+		return "authorization"
+	case ErrorKindArtifact:
+		return "artifact"
+	case ErrorKindStorage:
+		return "storage"
+	}
+	return "unknown"
+}
+
+// Retryable tells whether operations failing with errors of the kind may
+// succeed if retried as they are. Authorization errors are not, the device
+// needs to authorize first.
+func (k ErrorKind) Retryable() bool {
+	return k == ErrorKindNetwork
+}
+
+// kindError classifies the error it wraps.
+type kindError struct {
+	error
+	kind ErrorKind
+}
+
+func (e *kindError) Cause() error {
+	return e.error
+}
+
+func (e *kindError) ErrorKind() ErrorKind {
+	return e.kind
+}
+
+// WithErrorKind classifies err as of kind, unless its cause is classified
+// otherwise already. It returns nil if err is nil.
+func WithErrorKind(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{error: err, kind: kind}
+}
+
+// ErrorKindOf returns the kind of err. The errors err wraps are classified
+// in turn and the innermost classification applies, so that e.g. an artifact
+// failing to be read because the connection broke is a network error.
+// Besides errors classified with WithErrorKind, or implementing ErrorKind()
+// themselves, errors of the network, and those of the device running out of
+// space or failing to write, are told apart on their own.
+func ErrorKindOf(err error) ErrorKind {
+	kind := ErrorKindUnknown
+	for err != nil {
+		if k := ownErrorKind(err); k != ErrorKindUnknown {
+			kind = k
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return kind
+}
+
+func ownErrorKind(err error) ErrorKind {
+	if k, ok := err.(interface {
+		ErrorKind() ErrorKind
+	}); ok {
+		return k.ErrorKind()
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		return storageErrorKind(e.Err)
+	case *os.SyscallError:
+		return storageErrorKind(e.Err)
+	case *os.LinkError:
+		return storageErrorKind(e.Err)
+	case syscall.Errno:
+		return storageErrorKind(e)
+	case net.Error:
+		// including timeouts of requests and of contexts
+		return ErrorKindNetwork
+	}
+	return ErrorKindUnknown
+}
+
+func storageErrorKind(err error) ErrorKind {
+	switch errors.Cause(err) {
+	case syscall.ENOSPC, syscall.EDQUOT, syscall.EROFS, syscall.EIO:
+		return ErrorKindStorage
+	}
+	return ErrorKindUnknown
+}
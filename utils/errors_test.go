@@ -0,0 +1,63 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKindOf(t *testing.T) {
+	for err, kind := range map[error]ErrorKind{
+		errors.New("foo"):                                   ErrorKindUnknown,
+		context.DeadlineExceeded:                            ErrorKindNetwork,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}: ErrorKindNetwork,
+		&os.PathError{Op: "write", Err: syscall.ENOSPC}:     ErrorKindStorage,
+		&os.PathError{Op: "open", Err: syscall.ENOENT}:      ErrorKindUnknown,
+		errors.Wrap(&os.SyscallError{Syscall: "fsync", Err: syscall.EIO},
+			"sync failed"): ErrorKindStorage,
+		WithErrorKind(ErrorKindArtifact, errors.New("bad signature")): ErrorKindArtifact,
+		// the innermost classification applies
+		WithErrorKind(ErrorKindArtifact, errors.Wrap(WithErrorKind(ErrorKindStorage,
+			&net.OpError{Op: "read", Err: syscall.ECONNRESET}), "read failed")): ErrorKindNetwork,
+		WithErrorKind(ErrorKindArtifact,
+			&os.PathError{Op: "write", Err: syscall.EROFS}): ErrorKindStorage,
+	} {
+		assert.Equal(t, kind, ErrorKindOf(err), err.Error())
+	}
+	assert.Equal(t, ErrorKindUnknown, ErrorKindOf(nil))
+	assert.Nil(t, WithErrorKind(ErrorKindNetwork, nil))
+}
+
+func TestErrorKindWrapping(t *testing.T) {
+	cause := errors.New("bad signature")
+	err := errors.Wrap(WithErrorKind(ErrorKindArtifact, cause), "install failed")
+	assert.Equal(t, cause, errors.Cause(err))
+	assert.Equal(t, "install failed: bad signature", err.Error())
+}
+
+func TestErrorKindRetryable(t *testing.T) {
+	assert.True(t, ErrorKindNetwork.Retryable())
+	for _, k := range []ErrorKind{ErrorKindUnknown, ErrorKindAuth,
+		ErrorKindArtifact, ErrorKindStorage} {
+		assert.False(t, k.Retryable(), k.String())
+	}
+	assert.Equal(t, "storage", ErrorKindStorage.String())
+}
@@ -16,6 +16,7 @@ package utils
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 type ProgressWriter struct {
@@ -34,7 +35,7 @@ func (p *ProgressWriter) Write(data []byte) (int, error) {
 }
 
 func (p *ProgressWriter) maybeWarn(then int64) {
-	if p.N != 0 && then > p.N && !p.over {
+	if p.N > 0 && then > p.N && !p.over {
 		w := fmt.Sprintf("going over declared size, expected %v N, now %v\n",
 			p.N, then)
 		p.Out.Write([]byte(w))
@@ -61,7 +62,7 @@ func (p *ProgressWriter) reportGeneric(n int) {
 			var s string
 			nowSize := (nowDots + 1) * perDot
 			nowSizekB := nowSize / 1024
-			if p.N == 0 || then > p.N {
+			if p.N <= 0 || then > p.N {
 				s = fmt.Sprintf(" %v KiB\n", nowSizekB)
 			} else {
 				s = fmt.Sprintf(" %3d%% %v KiB\n",
@@ -108,3 +109,56 @@ func (p *ProgressWriter) reportGeneric(n int) {
 		p.Out.Write([]byte(s))
 	}
 }
+
+// Progress is a snapshot of the state of a transfer.
+type Progress struct {
+	Current int64         // bytes transferred so far
+	Total   int64         // expected size, zero if unknown
+	Rate    float64       // average rate in bytes per second
+	ETA     time.Duration // estimated time left, zero if unknown
+}
+
+// ProgressReader wraps a reader and calls Callback with the progress of
+// reading from it, at most once per Interval and once more when the data is
+// exhausted.
+type ProgressReader struct {
+	io.ReadCloser
+	N        int64 // size of the input
+	Interval time.Duration
+	Callback func(Progress)
+
+	c     int64     // current count
+	start time.Time // time of the first read
+	last  time.Time // time of the last callback
+}
+
+func (p *ProgressReader) Read(data []byte) (int, error) {
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start = now
+		p.last = now
+	}
+
+	n, err := p.ReadCloser.Read(data)
+	p.c += int64(n)
+
+	if p.Callback != nil && (err == io.EOF || now.Sub(p.last) >= p.Interval) {
+		p.last = now
+		p.Callback(p.progress(now))
+	}
+	return n, err
+}
+
+func (p *ProgressReader) progress(now time.Time) Progress {
+	pr := Progress{
+		Current: p.c,
+		Total:   p.N,
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		pr.Rate = float64(p.c) / elapsed
+	}
+	if p.N > p.c && pr.Rate > 0 {
+		pr.ETA = time.Duration(float64(p.N-p.c) / pr.Rate * float64(time.Second))
+	}
+	return pr
+}
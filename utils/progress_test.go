@@ -16,7 +16,9 @@ package utils
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -122,3 +124,51 @@ going over declared size, expected 100 N, now 101
 		b.String())
 
 }
+
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(data []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(data)
+}
+
+func TestProgressReader(t *testing.T) {
+	var reports []Progress
+	p := &ProgressReader{
+		ReadCloser: ioutil.NopCloser(&slowReader{
+			r:     bytes.NewReader(make([]byte, 100)),
+			delay: 5 * time.Millisecond,
+		}),
+		N:        100,
+		Interval: 10 * time.Millisecond,
+		Callback: func(pr Progress) {
+			reports = append(reports, pr)
+		},
+	}
+
+	buf := make([]byte, 10)
+	for {
+		_, err := p.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+
+	// callbacks are rate limited, but the final one is always made
+	assert.True(t, len(reports) > 1 && len(reports) < 11,
+		"unexpected number of reports: %d", len(reports))
+	last := reports[len(reports)-1]
+	assert.Equal(t, int64(100), last.Current)
+	assert.Equal(t, int64(100), last.Total)
+	assert.True(t, last.Rate > 0)
+	assert.Equal(t, time.Duration(0), last.ETA)
+
+	mid := reports[0]
+	assert.True(t, mid.Current < 100)
+	assert.True(t, mid.ETA > 0)
+	assert.NoError(t, p.Close())
+}
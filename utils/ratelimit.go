@@ -0,0 +1,161 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const maxRateLimitWait = time.Second
+
+// RateLimiter is a token bucket limiting the rate of transfers. The limit
+// can be changed at any time, also while transfers are in progress.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64 // bytes per second, no limit if zero
+	burst  int64 // size of the bucket
+	tokens int64
+	last   time.Time // time the bucket was last refilled
+	paused bool
+
+	// for tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec on average and
+// bursts of up to burst bytes. A burst of zero defaults to one second worth
+// of data.
+func NewRateLimiter(bytesPerSec, burst int64) *RateLimiter {
+	l := &RateLimiter{
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.SetLimit(bytesPerSec, burst)
+	return l
+}
+
+// SetLimit changes the limit; a rate of zero disables limiting.
+func (l *RateLimiter) SetLimit(bytesPerSec, burst int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.rate = bytesPerSec
+	l.burst = burst
+	l.tokens = burst
+	l.last = l.now()
+}
+
+// SetPaused stops or resumes all transfers.
+func (l *RateLimiter) SetPaused(paused bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.paused = paused
+}
+
+func (l *RateLimiter) Paused() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.paused
+}
+
+// Limit returns the current rate and burst size.
+func (l *RateLimiter) Limit() (int64, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate, l.burst
+}
+
+// take returns how many of the n bytes may be transferred at once, which is
+// zero if the caller has to wait for the returned duration first.
+func (l *RateLimiter) take(n int64) (int64, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.paused {
+		return 0, maxRateLimitWait
+	}
+	if l.rate <= 0 {
+		return n, 0
+	}
+
+	now := l.now()
+	l.tokens += int64(now.Sub(l.last).Seconds() * float64(l.rate))
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens <= 0 {
+		// wait until a reasonable chunk can be transferred
+		want := n
+		if want > l.burst {
+			want = l.burst
+		}
+		wait := time.Duration(float64(want-l.tokens) / float64(l.rate) *
+			float64(time.Second))
+		// wake up regularly to pick up changes of the limit
+		if wait > maxRateLimitWait {
+			wait = maxRateLimitWait
+		}
+		return 0, wait
+	}
+	if n > l.tokens {
+		n = l.tokens
+	}
+	l.tokens -= n
+	return n, 0
+}
+
+// giveBack returns tokens which were taken, but not used.
+func (l *RateLimiter) giveBack(n int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate > 0 && n > 0 {
+		l.tokens += n
+	}
+}
+
+// Wait blocks until up to n bytes may be transferred and returns how many.
+func (l *RateLimiter) Wait(n int) int {
+	for {
+		allowed, wait := l.take(int64(n))
+		if allowed > 0 || n == 0 {
+			return int(allowed)
+		}
+		l.sleep(wait)
+	}
+}
+
+// RateLimitedReader reads from ReadCloser no faster than Limiter allows.
+type RateLimitedReader struct {
+	io.ReadCloser
+	Limiter *RateLimiter
+}
+
+func (r *RateLimitedReader) Read(data []byte) (int, error) {
+	if r.Limiter == nil {
+		return r.ReadCloser.Read(data)
+	}
+	allowed := r.Limiter.Wait(len(data))
+	n, err := r.ReadCloser.Read(data[:allowed])
+	r.Limiter.giveBack(int64(allowed - n))
+	return n, err
+}
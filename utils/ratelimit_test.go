@@ -0,0 +1,135 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock advances only when sleeping.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func newTestLimiter(rate, burst int64) (*RateLimiter, *fakeClock) {
+	c := &fakeClock{t: time.Unix(0, 0)}
+	l := &RateLimiter{now: c.now, sleep: c.sleep}
+	l.SetLimit(rate, burst)
+	return l, c
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := make([]byte, 10000)
+
+	// burst is available immediately, the rest at the given rate
+	l, c := newTestLimiter(1000, 2000)
+	r := &RateLimitedReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		Limiter:    l,
+	}
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	// reading past the end may need to wait for a little longer
+	assert.True(t, c.slept >= 8*time.Second && c.slept < 9*time.Second,
+		"unexpected time spent: %v", c.slept)
+
+	// burst defaults to one second worth of data
+	l, c = newTestLimiter(5000, 0)
+	rate, burst := l.Limit()
+	assert.Equal(t, int64(5000), rate)
+	assert.Equal(t, int64(5000), burst)
+	r = &RateLimitedReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		Limiter:    l,
+	}
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.True(t, c.slept >= time.Second && c.slept < 2*time.Second,
+		"unexpected time spent: %v", c.slept)
+
+	// no limit
+	l, c = newTestLimiter(0, 0)
+	r = &RateLimitedReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		Limiter:    l,
+	}
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.Equal(t, time.Duration(0), c.slept)
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	l, c := newTestLimiter(10, 10)
+	assert.Equal(t, 10, l.Wait(100))
+
+	// waiting is done in steps, so that a new limit is picked up quickly
+	assert.Equal(t, 10, l.Wait(100))
+	assert.Equal(t, time.Second, c.slept)
+
+	l.SetLimit(0, 0)
+	c.slept = 0
+	assert.Equal(t, 100, l.Wait(100))
+	assert.Equal(t, time.Duration(0), c.slept)
+
+	// unused tokens are given back
+	l.SetLimit(100, 100)
+	assert.Equal(t, 100, l.Wait(1000))
+	l.giveBack(60)
+	assert.Equal(t, 60, l.Wait(1000))
+	assert.Equal(t, time.Duration(0), c.slept)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	var slept int32
+	l := &RateLimiter{
+		now: time.Now,
+		sleep: func(time.Duration) {
+			atomic.AddInt32(&slept, 1)
+			time.Sleep(time.Millisecond)
+		},
+	}
+	l.SetPaused(true)
+	assert.True(t, l.Paused())
+
+	done := make(chan int)
+	go func() {
+		done <- l.Wait(100)
+	}()
+	select {
+	case <-done:
+		t.Fatal("transfer not paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.SetPaused(false)
+	assert.Equal(t, 100, <-done)
+	assert.True(t, atomic.LoadInt32(&slept) > 0)
+}
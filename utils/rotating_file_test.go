@@ -0,0 +1,72 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mender.log")
+
+	// existing contents are kept and count towards the size
+	require.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+
+	r, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		n, err := r.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, r.Close())
+
+	assert.Equal(t, "four\n", readTestFile(t, path))
+	assert.Equal(t, "two\nthree\n", readTestFile(t, path+".1"))
+	assert.Equal(t, "old\none\n", readTestFile(t, path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// without backups the file starts over
+	r, err = OpenRotatingFile(path, 10, 0)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("longer line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "longer line\n", readTestFile(t, path))
+	assert.Equal(t, "two\nthree\n", readTestFile(t, path+".1"))
+
+	// no limit
+	r, err = OpenRotatingFile(path, 0, 2)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("more\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "longer line\nmore\n", readTestFile(t, path))
+}
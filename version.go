@@ -13,6 +13,12 @@
 //    limitations under the License.
 package main
 
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
 var (
 	// Version information of current build
 	Version string
@@ -24,3 +30,23 @@ func VersionString() string {
 	}
 	return "unknown"
 }
+
+var kernelReleaseFile = "/proc/sys/kernel/osrelease"
+
+// userAgent identifies the client, the device type, read from deviceTypeFile,
+// and the kernel in requests to the server.
+func userAgent(deviceTypeFile string) string {
+	var details []string
+	if dt, err := GetDeviceType(deviceTypeFile); err == nil && dt != "" {
+		details = append(details, dt)
+	}
+	if release, err := ioutil.ReadFile(kernelReleaseFile); err == nil {
+		details = append(details, "Linux "+strings.TrimSpace(string(release)))
+	}
+
+	ua := "mender/" + VersionString()
+	if len(details) > 0 {
+		ua += fmt.Sprintf(" (%s)", strings.Join(details, "; "))
+	}
+	return ua
+}
@@ -14,8 +14,13 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestVersionUnknown(t *testing.T) {
@@ -32,3 +37,26 @@ func TestVersionVersion(t *testing.T) {
 	// tag takes priority over other settings
 	assert.Equal(t, "foo", v)
 }
+
+func TestUserAgent(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-user-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	oldKernel := kernelReleaseFile
+	defer func() {
+		kernelReleaseFile = oldKernel
+	}()
+	deviceTypeFile := path.Join(td, "device_type")
+	kernelReleaseFile = path.Join(td, "osrelease")
+	Version = "1.7.0"
+	defer func() { Version = "" }()
+
+	// nothing known about the device
+	assert.Equal(t, "mender/1.7.0", userAgent(deviceTypeFile))
+
+	ioutil.WriteFile(deviceTypeFile, []byte("device_type=qemux86-64\n"), 0644)
+	ioutil.WriteFile(kernelReleaseFile, []byte("4.14.48-yocto-standard\n"), 0644)
+	assert.Equal(t, "mender/1.7.0 (qemux86-64; Linux 4.14.48-yocto-standard)",
+		userAgent(deviceTypeFile))
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+var errDownloadStalled = errors.New("download stalled")
+
+// stallWatchdogReader aborts a download, through cancel, once a read of it
+// has been waiting for data for timeout, unless the download is paused
+// deliberately. Reading fails with a network error then, so that the download
+// is retried. The time the reader of the download takes, e.g. writing to a
+// slow storage, does not count.
+type stallWatchdogReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	paused  func() bool
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	stalled int32
+	// guards reading, the timer is armed only while a read is blocked
+	lock    sync.Mutex
+	reading bool
+}
+
+func newStallWatchdogReader(r io.ReadCloser, timeout time.Duration,
+	paused func() bool, cancel context.CancelFunc) *stallWatchdogReader {
+
+	w := &stallWatchdogReader{
+		ReadCloser: r,
+		timeout:    timeout,
+		paused:     paused,
+		cancel:     cancel,
+	}
+	w.timer = time.AfterFunc(timeout, w.expired)
+	w.timer.Stop()
+	return w
+}
+
+func (w *stallWatchdogReader) arm(reading bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.reading = reading
+	if reading {
+		w.timer.Reset(w.timeout)
+	} else {
+		w.timer.Stop()
+	}
+}
+
+func (w *stallWatchdogReader) expired() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.reading {
+		return
+	}
+	if w.paused != nil && w.paused() {
+		w.timer.Reset(w.timeout)
+		return
+	}
+	log.Errorf("no data of the update received for %s; aborting the download", w.timeout)
+	atomic.StoreInt32(&w.stalled, 1)
+	w.cancel()
+}
+
+func (w *stallWatchdogReader) Read(p []byte) (int, error) {
+	w.arm(true)
+	n, err := w.ReadCloser.Read(p)
+	w.arm(false)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&w.stalled) == 1 {
+		err = utils.WithErrorKind(utils.ErrorKindNetwork, errors.Wrapf(errDownloadStalled,
+			"no data received for %s", w.timeout))
+	}
+	return n, err
+}
+
+func (w *stallWatchdogReader) Close() error {
+	w.arm(false)
+	return w.ReadCloser.Close()
+}
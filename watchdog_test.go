@@ -0,0 +1,111 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ctxReader blocks reading until data is written to it or its context is
+// canceled.
+type ctxReader struct {
+	ctx  context.Context
+	data chan []byte
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	select {
+	case d := <-r.data:
+		return copy(p, d), nil
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+func (r *ctxReader) Close() error {
+	return nil
+}
+
+func TestStallWatchdogReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := &ctxReader{ctx: ctx, data: make(chan []byte, 1)}
+	var paused int32 = 1
+	w := newStallWatchdogReader(in, 50*time.Millisecond, func() bool {
+		return atomic.LoadInt32(&paused) == 1
+	}, cancel)
+	defer w.Close()
+
+	// not aborted while paused deliberately
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, ctx.Err())
+	atomic.StoreInt32(&paused, 0)
+
+	// nor while data keeps coming
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		in.data <- []byte("data")
+		n, err := w.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, 4, n)
+		time.Sleep(20 * time.Millisecond)
+	}
+	// nor while the data read is being handled
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, ctx.Err())
+
+	_, err := w.Read(buf)
+	require.Error(t, err)
+	assert.Equal(t, errDownloadStalled, errors.Cause(err))
+	assert.Equal(t, utils.ErrorKindNetwork, utils.ErrorKindOf(err))
+}
+
+func TestMenderFetchUpdateStalled(t *testing.T) {
+	stalled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100000000")
+		w.Write([]byte("some"))
+		w.(http.Flusher).Flush()
+		<-stalled
+	}))
+	defer ts.Close()
+	defer close(stalled)
+
+	var config menderConfig
+	config.Watchdog.DownloadStallSeconds = 1
+	config.RetryPollIntervalSeconds = 1
+	mender := newTestMender(nil, config, testMenderPieces{})
+
+	img, _, err := mender.FetchUpdate(ts.URL)
+	require.NoError(t, err)
+	defer img.Close()
+	start := time.Now()
+	_, err = ioutil.ReadAll(img)
+	require.Error(t, err)
+	assert.Equal(t, errDownloadStalled, errors.Cause(err))
+	// retried, rather than failing the deployment
+	assert.True(t, utils.ErrorKindOf(err).Retryable())
+	assert.True(t, time.Since(start) < 30*time.Second)
+}